@@ -0,0 +1,236 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"text/tabwriter"
+
+	"github.com/snakeice/gunnel/pkg/client"
+	"github.com/spf13/cobra"
+)
+
+// adminResult is what a mutating admin command reports. Changed is false
+// when the server already matched, so configuration management tools can
+// tell whether anything happened.
+type adminResult struct {
+	Changed bool   `json:"changed"`
+	Kind    string `json:"kind"`
+	Name    string `json:"name"`
+	ID      string `json:"id"`
+	// Token is set when the command issued a credential.
+	Token string `json:"token,omitempty"`
+}
+
+type adminOptions struct {
+	api  client.AdminAPI
+	json bool
+}
+
+func (o *adminOptions) print(w io.Writer, result adminResult) error {
+	if o.json {
+		return json.NewEncoder(w).Encode(result)
+	}
+
+	status := "ok"
+	if result.Changed {
+		status = "changed"
+	}
+	fmt.Fprintf(w, "%s: %s %s (%s)\n", status, result.Kind, result.Name, result.ID)
+	if result.Token != "" {
+		fmt.Fprintf(w, "token: %s\n", result.Token)
+	}
+	return nil
+}
+
+func AddAdminCmd(rootCmd *cobra.Command) error {
+	opts := &adminOptions{}
+
+	adminCmd := &cobra.Command{
+		Use:   "admin",
+		Short: "Administer a server through its admin API",
+		Long: `Every admin command is idempotent: running it again once the server matches
+changes nothing and reports "ok" instead of "changed" ("changed": false with
+--json), so it can be driven by Ansible or other configuration management.`,
+	}
+	adminCmd.PersistentFlags().StringVar(&opts.api.URL, "admin-url", os.Getenv("GUNNEL_ADMIN_URL"),
+		"Server admin API URL, e.g. https://gunnel.example.com (env GUNNEL_ADMIN_URL)")
+	adminCmd.PersistentFlags().StringVar(&opts.api.Token, "admin-token", os.Getenv("GUNNEL_ADMIN_TOKEN"),
+		"Admin API token (env GUNNEL_ADMIN_TOKEN)")
+	adminCmd.PersistentFlags().BoolVar(&opts.json, "json", false, "Print JSON")
+
+	adminCmd.AddCommand(
+		newAdminCreateTokenCmd(opts),
+		newAdminReserveSubdomainCmd(opts),
+		newAdminSetQuotaCmd(opts),
+		newAdminListCmd(opts),
+	)
+	rootCmd.AddCommand(adminCmd)
+
+	return nil
+}
+
+func newAdminCreateTokenCmd(opts *adminOptions) *cobra.Command {
+	var spec client.TokenSpec
+
+	cmd := &cobra.Command{
+		Use:   "create-token <name>",
+		Short: "Create a client token unless it exists",
+		Long: `Create a client token. The generated token is printed once; pass
+--token-sha256 to register a token you generated instead. An existing token is
+left as it is, use set-quota to change its limits.`,
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := context.Background()
+			result := adminResult{Kind: client.KindToken, Name: args[0]}
+
+			existing, err := opts.api.GetToken(ctx, args[0])
+			switch {
+			case err == nil:
+				result.ID = existing.ID
+				if spec.TokenSHA256 != "" && spec.TokenSHA256 != existing.TokenSHA256 {
+					return fmt.Errorf("token %s exists with another token_sha256", args[0])
+				}
+			case errors.Is(err, client.ErrAdminNotFound):
+				token, err := opts.api.PutToken(ctx, args[0], spec)
+				if err != nil {
+					return err
+				}
+				result.Changed, result.ID, result.Token = true, token.ID, token.Token
+			default:
+				return err
+			}
+			return opts.print(cmd.OutOrStdout(), result)
+		},
+	}
+	cmd.Flags().StringSliceVar(&spec.Subdomains, "subdomain", nil,
+		"Subdomain pattern the token may register, e.g. preview-* (repeatable, default any)")
+	cmd.Flags().IntVar(&spec.MaxTunnels, "max-tunnels", 0, "Tunnels the token may hold at once (0 = unlimited)")
+	cmd.Flags().StringVar(&spec.TokenSHA256, "token-sha256", "", "Hex SHA-256 of a token to use instead of a new one")
+	return cmd
+}
+
+func newAdminReserveSubdomainCmd(opts *adminOptions) *cobra.Command {
+	var name string
+
+	cmd := &cobra.Command{
+		Use:   "reserve-subdomain <subdomain>",
+		Short: "Reserve a subdomain with a named tunnel",
+		Long: `Reserve a subdomain for a named tunnel (named after the subdomain unless
+--name is given), moving the tunnel if it reserves another one. The tunnel's
+credential token is printed when it is created; see "gunnel tunnel run".`,
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := context.Background()
+			if name == "" {
+				name = args[0]
+			}
+			result := adminResult{Kind: client.KindTunnel, Name: name}
+
+			existing, err := opts.api.GetTunnel(ctx, name)
+			switch {
+			case err == nil && existing.Subdomain == args[0]:
+				result.ID = existing.TunnelID
+				return opts.print(cmd.OutOrStdout(), result)
+			case err != nil && !errors.Is(err, client.ErrAdminNotFound):
+				return err
+			}
+
+			creds, err := opts.api.PutTunnel(ctx, name, args[0])
+			if err != nil {
+				return err
+			}
+			result.Changed, result.ID, result.Token = true, creds.TunnelID, creds.Token
+			return opts.print(cmd.OutOrStdout(), result)
+		},
+	}
+	cmd.Flags().StringVar(&name, "name", "", "Named tunnel holding the subdomain (defaults to the subdomain)")
+	return cmd
+}
+
+func newAdminSetQuotaCmd(opts *adminOptions) *cobra.Command {
+	var maxTunnels int
+	var subdomains []string
+
+	cmd := &cobra.Command{
+		Use:          "set-quota <token-name>",
+		Short:        "Set the tunnel quota and subdomain patterns of a client token",
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := context.Background()
+			current, err := opts.api.GetToken(ctx, args[0])
+			if err != nil {
+				return err
+			}
+
+			spec := client.TokenSpec{Subdomains: current.Subdomains, MaxTunnels: current.MaxTunnels}
+			if cmd.Flags().Changed("max-tunnels") {
+				spec.MaxTunnels = maxTunnels
+			}
+			if cmd.Flags().Changed("subdomain") {
+				spec.Subdomains = subdomains
+			}
+
+			result := adminResult{Kind: client.KindToken, Name: args[0], ID: current.ID}
+			if spec.MaxTunnels != current.MaxTunnels || !slices.Equal(spec.Subdomains, current.Subdomains) {
+				if _, err := opts.api.PutToken(ctx, args[0], spec); err != nil {
+					return err
+				}
+				result.Changed = true
+			}
+			return opts.print(cmd.OutOrStdout(), result)
+		},
+	}
+	cmd.Flags().IntVar(&maxTunnels, "max-tunnels", 0, "Tunnels the token may hold at once (0 = unlimited)")
+	cmd.Flags().StringSliceVar(&subdomains, "subdomain", nil,
+		"Subdomain patterns the token may register, replacing the current ones (repeatable)")
+	return cmd
+}
+
+func newAdminListCmd(opts *adminOptions) *cobra.Command {
+	return &cobra.Command{
+		Use:          "list",
+		Short:        "List the named tunnels and client tokens of the server",
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			ctx := context.Background()
+			tunnels, err := opts.api.ListTunnels(ctx)
+			if err != nil {
+				return err
+			}
+			tokens, err := opts.api.ListTokens(ctx)
+			if err != nil {
+				return err
+			}
+
+			if opts.json {
+				return json.NewEncoder(cmd.OutOrStdout()).Encode(map[string]any{
+					"tunnels": tunnels,
+					"tokens":  tokens,
+				})
+			}
+
+			w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "KIND\tNAME\tID\tSUBDOMAINS\tMAX TUNNELS")
+			for _, t := range tunnels {
+				fmt.Fprintf(w, "tunnel\t%s\t%s\t%s\t-\n", t.Name, t.TunnelID, t.Subdomain)
+			}
+			for _, t := range tokens {
+				patterns := "*"
+				if len(t.Subdomains) > 0 {
+					patterns = fmt.Sprint(t.Subdomains)
+				}
+				fmt.Fprintf(w, "token\t%s\t%s\t%s\t%d\n", t.Name, t.ID, patterns, t.MaxTunnels)
+			}
+			return w.Flush()
+		},
+	}
+}
@@ -0,0 +1,77 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/snakeice/gunnel/pkg/client"
+	"github.com/spf13/cobra"
+)
+
+func AddApplyCmd(rootCmd *cobra.Command) error {
+	var file string
+	var prune, dryRun bool
+	admin := client.AdminAPI{}
+
+	applyCmd := &cobra.Command{
+		Use:   "apply -f <state.yaml>",
+		Short: "Make the server's named tunnels and client tokens match a state file",
+		Long: `Apply reconciles the named tunnels and client tokens of a server with a
+declarative state file through the admin API. Applying the same file again
+changes nothing; --prune also deletes what the file does not list.`,
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			if file == "" {
+				return errors.New("a state file is required (-f)")
+			}
+			state, err := client.LoadState(file)
+			if err != nil {
+				return err
+			}
+
+			ctx := context.Background()
+			changes, err := admin.Plan(ctx, state, prune)
+			if err != nil {
+				return err
+			}
+
+			out := cmd.OutOrStdout()
+			if len(changes) == 0 {
+				fmt.Fprintln(out, "No changes, the server matches the state.")
+				return nil
+			}
+			if dryRun {
+				for _, change := range changes {
+					fmt.Fprintln(out, change)
+				}
+				fmt.Fprintf(out, "Plan: %d changes (dry run, nothing applied)\n", len(changes))
+				return nil
+			}
+
+			applied, err := admin.Apply(ctx, state, changes)
+			for _, change := range applied {
+				fmt.Fprintln(out, change)
+				if change.Token != "" {
+					fmt.Fprintf(out, "    token: %s\n", change.Token)
+				}
+			}
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(out, "Applied %d changes\n", len(applied))
+			return nil
+		},
+	}
+	applyCmd.Flags().StringVarP(&file, "file", "f", "", "State file listing tunnels and tokens")
+	applyCmd.Flags().BoolVar(&prune, "prune", false, "Delete tunnels and tokens missing from the state file")
+	applyCmd.Flags().BoolVar(&dryRun, "dry-run", false, "Print the changes without applying them")
+	applyCmd.Flags().StringVar(&admin.URL, "admin-url", "", "Server admin API URL (e.g. https://gunnel.example.com)")
+	applyCmd.Flags().StringVar(&admin.Token, "admin-token", os.Getenv("GUNNEL_ADMIN_TOKEN"),
+		"Admin API token (env GUNNEL_ADMIN_TOKEN)")
+
+	rootCmd.AddCommand(applyCmd)
+	return nil
+}
@@ -14,6 +14,8 @@ import (
 func AddClientCmd(rootCmd *cobra.Command) error {
 	var configFile string
 	var pprofAddr string
+	var share shareOptions
+	var printRequests bool
 
 	var clientCmd = &cobra.Command{
 		Use:   "client",
@@ -21,7 +23,7 @@ func AddClientCmd(rootCmd *cobra.Command) error {
 		Long: `Run the tunnel client that connects to a server and exposes a local port.
 The client supports both HTTP and TCP protocols.`,
 		RunE: func(_ *cobra.Command, _ []string) error {
-			return runClient(configFile, pprofAddr)
+			return runClient(configFile, pprofAddr, printRequests, &share)
 		},
 	}
 
@@ -29,13 +31,16 @@ The client supports both HTTP and TCP protocols.`,
 		StringVarP(&configFile, "config", "c", "gunnel.yaml", "Path to the client config file")
 	clientCmd.Flags().
 		StringVar(&pprofAddr, "pprof", "", "pprof address (e.g. localhost:6061), empty to disable")
+	clientCmd.Flags().
+		BoolVar(&printRequests, "print-requests", false, "Print one line per proxied request, whatever the log level")
+	share.addFlags(clientCmd)
 
 	rootCmd.AddCommand(clientCmd)
 
 	return nil
 }
 
-func runClient(configFile, pprofAddr string) error {
+func runClient(configFile, pprofAddr string, printRequests bool, share *shareOptions) error {
 	if pprofAddr != "" {
 		go func() {
 			logrus.Infof("Starting pprof server on %s", pprofAddr)
@@ -60,19 +65,23 @@ func runClient(configFile, pprofAddr string) error {
 
 	logrus.Info("Starting client mode")
 
-	cm, err := client.New(clientConfig)
+	cm, err := client.NewGroup(clientConfig)
 
 	if err != nil {
 		logrus.WithError(err).Error("Failed to create connection manager")
 		return nil
 	}
+	share.attach(cm)
+	if printRequests {
+		cm.OnRequest(newRequestPrinter().print)
+	}
 
-	if err := cm.Start(context.Background()); err != nil {
+	ctx, cancel := untilSignal(context.Background(), signal.WaitInterruptSignal)
+	defer cancel()
+	if err := cm.Start(ctx); err != nil {
 		logrus.WithError(err).Error("Failed to start client")
 		return nil
 	}
 
-	signal.WaitInterruptSignal()
-
 	return nil
 }
@@ -0,0 +1,40 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/snakeice/gunnel/pkg/client"
+	"github.com/spf13/cobra"
+)
+
+func AddPauseCmd(rootCmd *cobra.Command) error {
+	var apiAddr string
+
+	newCmd := func(use, short string, paused bool) *cobra.Command {
+		cmd := &cobra.Command{
+			Use:   use + " <subdomain>",
+			Short: short,
+			Args:  cobra.ExactArgs(1),
+			// Errors come from the running client, not from bad usage.
+			SilenceUsage: true,
+			RunE: func(cmd *cobra.Command, args []string) error {
+				if err := client.RequestPause(context.Background(), apiAddr, args[0], paused); err != nil {
+					return err
+				}
+				fmt.Fprintf(cmd.OutOrStdout(), "%s: %sd\n", args[0], use)
+				return nil
+			},
+		}
+		cmd.Flags().
+			StringVar(&apiAddr, "api", client.DefaultLocalAPIAddr, "Address of the running client's local API")
+		return cmd
+	}
+
+	rootCmd.AddCommand(
+		newCmd("pause", "Stop serving public traffic for a tunnel without disconnecting", true),
+		newCmd("resume", "Resume public traffic for a paused tunnel", false),
+	)
+
+	return nil
+}
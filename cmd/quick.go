@@ -0,0 +1,129 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/snakeice/gunnel/pkg/client"
+	"github.com/snakeice/gunnel/pkg/daemon"
+	"github.com/snakeice/gunnel/pkg/protocol"
+	"github.com/snakeice/gunnel/pkg/signal"
+	"github.com/spf13/cobra"
+)
+
+func AddHTTPCmd(rootCmd *cobra.Command) error {
+	return addQuickCmd(rootCmd, protocol.HTTP, &cobra.Command{
+		Use:   "http [port | host:port]",
+		Short: "Expose a local HTTP server without a config file",
+		Long: `Expose a local HTTP server without a config file. With --process the port
+is found from the named local process, e.g. "vite", and followed when the
+process restarts on another port.`,
+	})
+}
+
+func AddTCPCmd(rootCmd *cobra.Command) error {
+	return addQuickCmd(rootCmd, protocol.TCP, &cobra.Command{
+		Use:   "tcp [port | host:port]",
+		Short: "Expose a local TCP service without a config file",
+		Long: `Expose a local TCP service, e.g. a database, without a config file. The
+server opens a public port for it and the command prints it as a tcp:// URL.`,
+	})
+}
+
+// quickRunner runs the tunnel of a quick command, in this process or in the
+// daemon.
+type quickRunner interface {
+	OnTunnelUp(fn func(subdomain, publicURL string))
+	OnRequest(fn func(client.RequestLog))
+	Start(ctx context.Context) error
+}
+
+// addQuickCmd completes cmd into a command running a single tunnel of proto
+// described by its flags. The tunnel runs in the daemon when one is running.
+func addQuickCmd(rootCmd *cobra.Command, proto protocol.Protocol, cmd *cobra.Command) error {
+	var quick client.QuickTunnel
+	var printRequests bool
+	var share shareOptions
+	var socket string
+	var standalone bool
+
+	cmd.Args = cobra.MaximumNArgs(1)
+	cmd.SilenceUsage = true
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		if len(args) == 1 {
+			quick.Target = args[0]
+		}
+		quick.Protocol = proto
+		quick.ServerAddr = withDefaultPort(quick.ServerAddr)
+
+		config, err := quick.Config()
+		if err != nil {
+			return err
+		}
+
+		var cm quickRunner
+		if !standalone && daemon.Running(socket) {
+			logrus.WithField("socket", socket).Info("Attaching to the daemon")
+			cm = daemon.Attach(socket, quick)
+		} else if cm, err = client.New(config); err != nil {
+			return fmt.Errorf("failed to create connection manager: %w", err)
+		}
+		share.attach(cm)
+		target := quick.Target
+		if target == "" {
+			target = "process " + quick.Process
+		}
+		out := cmd.OutOrStdout()
+		cm.OnTunnelUp(func(_, publicURL string) {
+			fmt.Fprintf(out, "Forwarding %s -> %s\n", publicURL, target)
+		})
+		if printRequests {
+			cm.OnRequest(newRequestPrinter().print)
+		}
+
+		logrus.WithFields(logrus.Fields{
+			"subdomain": quick.Subdomain,
+			"target":    quick.Target,
+			"process":   quick.Process,
+		}).Info("Starting tunnel")
+		ctx, cancel := untilSignal(context.Background(), signal.WaitInterruptSignal)
+		defer cancel()
+		if err := cm.Start(ctx); err != nil {
+			return fmt.Errorf("failed to start client: %w", err)
+		}
+		return nil
+	}
+
+	cmd.Flags().StringVar(&quick.ServerAddr, "server", "",
+		"Address of the server, port "+defaultQuicPort+" when omitted (e.g. tunnel.example.com)")
+	cmd.Flags().StringVar(&quick.Subdomain, "subdomain", "", "Subdomain to expose the service at (random when omitted)")
+	cmd.Flags().StringVar(&quick.Process, "process", "", "Expose the port the named local process listens on")
+	if proto == protocol.HTTP {
+		cmd.Flags().
+			BoolVar(&printRequests, "print-requests", false, "Print one line per proxied request, whatever the log level")
+	}
+	share.addFlags(cmd)
+	defaultSocket, err := daemon.DefaultSocketPath()
+	if err != nil {
+		return err
+	}
+	cmd.Flags().StringVar(&socket, "socket", defaultSocket, "Path of the socket of the daemon to attach to")
+	cmd.Flags().BoolVar(&standalone, "standalone", false, "Connect from this process even when a daemon is running")
+	if err := cmd.MarkFlagRequired("server"); err != nil {
+		return err
+	}
+
+	rootCmd.AddCommand(cmd)
+	return nil
+}
+
+// withDefaultPort adds the default QUIC port to a server address without one.
+func withDefaultPort(addr string) string {
+	if _, _, err := net.SplitHostPort(addr); err == nil || addr == "" {
+		return addr
+	}
+	return net.JoinHostPort(strings.Trim(addr, "[]"), defaultQuicPort)
+}
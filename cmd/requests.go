@@ -0,0 +1,90 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/snakeice/gunnel/pkg/client"
+)
+
+const (
+	colorReset  = "\x1b[0m"
+	colorGreen  = "\x1b[32m"
+	colorCyan   = "\x1b[36m"
+	colorYellow = "\x1b[33m"
+	colorRed    = "\x1b[31m"
+	colorDim    = "\x1b[2m"
+)
+
+// requestPrinter prints one line per proxied request, like a dev server
+// console. Colors are left out when stdout is not a terminal or NO_COLOR is
+// set.
+type requestPrinter struct {
+	mu    sync.Mutex
+	out   io.Writer
+	color bool
+}
+
+func newRequestPrinter() *requestPrinter {
+	color := os.Getenv("NO_COLOR") == ""
+	if info, err := os.Stdout.Stat(); err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		color = false
+	}
+	return &requestPrinter{out: os.Stdout, color: color}
+}
+
+func (p *requestPrinter) print(r client.RequestLog) {
+	status := fmt.Sprintf("%d %s", r.Status, http.StatusText(r.Status))
+	line := fmt.Sprintf("%s %-7s %s %s %s %s\n",
+		p.paint(colorDim, time.Now().Format(time.TimeOnly)),
+		r.Method,
+		r.Path,
+		p.paint(statusColor(r.Status), status),
+		p.paint(colorDim, r.Duration.Round(time.Millisecond).String()),
+		p.paint(colorDim, formatSize(r.Bytes)),
+	)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, err := io.WriteString(p.out, line); err != nil {
+		logrus.WithError(err).Debug("Failed to print request")
+	}
+}
+
+func (p *requestPrinter) paint(color, s string) string {
+	if !p.color {
+		return s
+	}
+	return color + s + colorReset
+}
+
+func statusColor(status int) string {
+	switch {
+	case status >= http.StatusInternalServerError:
+		return colorRed
+	case status >= http.StatusBadRequest:
+		return colorYellow
+	case status >= http.StatusMultipleChoices:
+		return colorCyan
+	default:
+		return colorGreen
+	}
+}
+
+func formatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for v := n / unit; v >= unit; v /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -2,13 +2,15 @@ package cmd
 
 import (
 	"os"
+	"strings"
 
 	"github.com/sirupsen/logrus"
+	"github.com/snakeice/gunnel/pkg/logging"
 	"github.com/spf13/cobra"
 )
 
 func Execute() {
-	var level string
+	var level, levels string
 	logrus.SetFormatter(&logrus.TextFormatter{
 		FullTimestamp:   true,
 		ForceColors:     true,
@@ -29,15 +31,18 @@ func Execute() {
 
 				logrus.Infof("Setting log level to %s", lvl)
 
-				logrus.SetLevel(lvl)
+				logging.SetLevel(lvl)
 			}
 
-			return nil
+			return logging.SetLevels(levels)
 		},
 	}
 
 	rootCmd.PersistentFlags().
 		StringVarP(&level, "log-level", "l", "debug", "Set the log level (trace, debug, info, warn, error, fatal, panic)")
+	rootCmd.PersistentFlags().
+		StringVar(&levels, "log-levels", "", "Set the level of named loggers ("+strings.Join(logging.Names(), ", ")+
+			"), e.g. data=warn,control=trace")
 	if err := rootCmd.PersistentFlags().MarkHidden("log-level"); err != nil {
 		logrus.Error(err)
 		os.Exit(1)
@@ -53,6 +58,46 @@ func Execute() {
 		os.Exit(1)
 	}
 
+	if err := AddPauseCmd(rootCmd); err != nil {
+		logrus.Error(err)
+		os.Exit(1)
+	}
+
+	if err := AddHTTPCmd(rootCmd); err != nil {
+		logrus.Error(err)
+		os.Exit(1)
+	}
+
+	if err := AddTCPCmd(rootCmd); err != nil {
+		logrus.Error(err)
+		os.Exit(1)
+	}
+
+	if err := AddStartCmd(rootCmd); err != nil {
+		logrus.Error(err)
+		os.Exit(1)
+	}
+
+	if err := AddTunnelCmd(rootCmd); err != nil {
+		logrus.Error(err)
+		os.Exit(1)
+	}
+
+	if err := AddAdminCmd(rootCmd); err != nil {
+		logrus.Error(err)
+		os.Exit(1)
+	}
+
+	if err := AddApplyCmd(rootCmd); err != nil {
+		logrus.Error(err)
+		os.Exit(1)
+	}
+
+	if err := AddVersionCmd(rootCmd); err != nil {
+		logrus.Error(err)
+		os.Exit(1)
+	}
+
 	if err := rootCmd.Execute(); err != nil {
 		logrus.Error(err)
 		os.Exit(1)
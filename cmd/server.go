@@ -4,12 +4,14 @@ import (
 	"fmt"
 
 	"github.com/snakeice/gunnel/pkg/server"
+	"github.com/snakeice/gunnel/pkg/signal"
 	"github.com/spf13/cobra"
 )
 
 func AddServerCmd(rootCmd *cobra.Command) error {
 	var (
 		configFile string
+		allowRoot  bool
 	)
 
 	var serverCmd = &cobra.Command{
@@ -27,10 +29,19 @@ Uses separate ports for client-server communication and user connections.`,
 				}
 			}
 
+			config.AllowRoot = allowRoot
 			srv := server.NewServer(config)
 
+			waitSignal := signal.WaitInterruptSignal
+			if srv.HandlesHangup() {
+				// SIGHUP reloads the secrets instead of stopping the server.
+				waitSignal = signal.WaitShutdownSignal
+			}
+			ctx, cancel := untilSignal(cmd.Context(), waitSignal)
+			defer cancel()
+
 			// Start HTTP/TCP server for user connections
-			if err := srv.Start(cmd.Context()); err != nil {
+			if err := srv.Start(ctx); err != nil {
 				return fmt.Errorf("failed to start server: %w", err)
 			}
 
@@ -41,6 +52,8 @@ Uses separate ports for client-server communication and user connections.`,
 
 	serverCmd.Flags().
 		StringVarP(&configFile, "config", "c", "", "Path to the server configuration file")
+	serverCmd.Flags().
+		BoolVar(&allowRoot, "allow-root", false, "Keep running as root when no user to drop privileges to is set")
 
 	return nil
 }
@@ -0,0 +1,63 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/atotto/clipboard"
+	"github.com/sirupsen/logrus"
+	"github.com/skip2/go-qrcode"
+	"github.com/spf13/cobra"
+)
+
+// shareOptions prints or copies the public URL of a tunnel once it is up,
+// e.g. to open it on a phone.
+type shareOptions struct {
+	qr   bool
+	copy bool
+}
+
+func (o *shareOptions) addFlags(cmd *cobra.Command) {
+	cmd.Flags().BoolVar(&o.qr, "qr", false, "Print a QR code of the public URL when the tunnel is up")
+	cmd.Flags().BoolVar(&o.copy, "copy", false, "Copy the public URL to the clipboard when the tunnel is up")
+}
+
+// tunnelNotifier is implemented by client.Client and client.Group.
+type tunnelNotifier interface {
+	OnTunnelUp(fn func(subdomain, publicURL string))
+}
+
+func (o *shareOptions) attach(cm tunnelNotifier) {
+	if !o.qr && !o.copy {
+		return
+	}
+
+	cm.OnTunnelUp(func(subdomain, publicURL string) {
+		if publicURL == "" {
+			logrus.WithField("subdomain", subdomain).Warn("The server did not report the public URL")
+			return
+		}
+		if o.qr {
+			printQR(publicURL)
+		}
+		if o.copy {
+			if err := clipboard.WriteAll(publicURL); err != nil {
+				logrus.WithError(err).Warn("Failed to copy the public URL to the clipboard")
+				return
+			}
+			logrus.WithField("url", publicURL).Info("Copied the public URL to the clipboard")
+		}
+	})
+}
+
+func printQR(publicURL string) {
+	code, err := qrcode.New(publicURL, qrcode.Medium)
+	if err != nil {
+		logrus.WithError(err).Warn("Failed to encode the public URL as a QR code")
+		return
+	}
+	// Dark modules are left blank, which suits terminals with a dark background.
+	if _, err := fmt.Fprintf(os.Stdout, "\n%s\n  %s\n\n", code.ToSmallString(false), publicURL); err != nil {
+		logrus.WithError(err).Debug("Failed to print the QR code")
+	}
+}
@@ -0,0 +1,14 @@
+package cmd
+
+import "context"
+
+// untilSignal returns a context canceled once waitSignal returns, which is
+// how the commands stop the server and clients on an interrupt.
+func untilSignal(ctx context.Context, waitSignal func()) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		waitSignal()
+		cancel()
+	}()
+	return ctx, cancel
+}
@@ -0,0 +1,75 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"text/tabwriter"
+
+	"github.com/snakeice/gunnel/pkg/daemon"
+	"github.com/snakeice/gunnel/pkg/signal"
+	"github.com/spf13/cobra"
+)
+
+func AddStartCmd(rootCmd *cobra.Command) error {
+	var background bool
+	var socket string
+
+	startCmd := &cobra.Command{
+		Use:   "start",
+		Short: "Run the agent that the http and tcp commands attach their tunnels to",
+		Long: `Run the agent that the http and tcp commands attach their tunnels to over a
+local socket. Tunnels to the same server then share one connection, and each
+one closes when the command that opened it exits. With --daemon the agent runs
+in the background and logs to daemon.log next to the socket.`,
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			out := cmd.OutOrStdout()
+			if daemon.Running(socket) {
+				fmt.Fprintf(out, "Daemon already running on %s\n", socket)
+				return printSessions(cmd, socket)
+			}
+			if !background {
+				ctx, cancel := untilSignal(context.Background(), signal.WaitInterruptSignal)
+				defer cancel()
+				return daemon.New(socket).Run(ctx)
+			}
+
+			logFile := filepath.Join(filepath.Dir(socket), "daemon.log")
+			args := []string{"start", "--socket", socket}
+			if level := cmd.Flag("log-level"); level != nil && level.Changed {
+				args = append(args, "--log-level", level.Value.String())
+			}
+			proc, err := daemon.Spawn(args, socket, logFile)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(out, "Daemon started (pid %d) on %s, logging to %s\n", proc.Pid, socket, logFile)
+			return nil
+		},
+	}
+
+	defaultSocket, err := daemon.DefaultSocketPath()
+	if err != nil {
+		return err
+	}
+	startCmd.Flags().BoolVar(&background, "daemon", false, "Run in the background")
+	startCmd.Flags().StringVar(&socket, "socket", defaultSocket, "Path of the daemon socket")
+
+	rootCmd.AddCommand(startCmd)
+	return nil
+}
+
+func printSessions(cmd *cobra.Command, socket string) error {
+	sessions, err := daemon.Sessions(cmd.Context(), socket)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SESSION\tSERVER\tURL\tTARGET")
+	for _, s := range sessions {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", s.ID, s.Server, s.URL, s.Target)
+	}
+	return w.Flush()
+}
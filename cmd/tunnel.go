@@ -0,0 +1,197 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"text/tabwriter"
+
+	"github.com/sirupsen/logrus"
+	"github.com/snakeice/gunnel/pkg/client"
+	"github.com/snakeice/gunnel/pkg/protocol"
+	"github.com/snakeice/gunnel/pkg/signal"
+	"github.com/spf13/cobra"
+)
+
+const defaultQuicPort = "8081"
+
+func AddTunnelCmd(rootCmd *cobra.Command) error {
+	tunnelCmd := &cobra.Command{
+		Use:   "tunnel",
+		Short: "Manage and run named tunnels",
+		Long: `Named tunnels are created once on the server, which issues a credentials
+file. "gunnel tunnel run" then connects using those credentials, so only the
+local service has to be given on each run.`,
+	}
+
+	admin := client.AdminAPI{}
+	tunnelCmd.PersistentFlags().
+		StringVar(&admin.URL, "admin-url", "", "Server admin API URL (e.g. https://gunnel.example.com)")
+	tunnelCmd.PersistentFlags().
+		StringVar(&admin.Token, "admin-token", os.Getenv("GUNNEL_ADMIN_TOKEN"),
+			"Admin API token (env GUNNEL_ADMIN_TOKEN)")
+
+	tunnelCmd.AddCommand(
+		newTunnelCreateCmd(&admin),
+		newTunnelListCmd(&admin),
+		newTunnelDeleteCmd(&admin),
+		newTunnelRunCmd(),
+	)
+	rootCmd.AddCommand(tunnelCmd)
+
+	return nil
+}
+
+func newTunnelCreateCmd(admin *client.AdminAPI) *cobra.Command {
+	var subdomain, serverAddr, out string
+
+	cmd := &cobra.Command{
+		Use:          "create <name>",
+		Short:        "Create a named tunnel and write its credentials file",
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if serverAddr == "" {
+				addr, err := quicAddrFromAdminURL(admin.URL)
+				if err != nil {
+					return err
+				}
+				serverAddr = addr
+			}
+			if out == "" {
+				path, err := client.DefaultCredentialsPath(args[0])
+				if err != nil {
+					return err
+				}
+				out = path
+			}
+
+			creds, err := admin.CreateTunnel(context.Background(), args[0], subdomain)
+			if err != nil {
+				return err
+			}
+			creds.ServerAddr = serverAddr
+
+			if err := creds.Save(out); err != nil {
+				return fmt.Errorf("tunnel created but failed to write credentials: %w", err)
+			}
+
+			fmt.Fprintf(cmd.OutOrStdout(), "Created tunnel %s (%s) for subdomain %s\nCredentials written to %s\n",
+				creds.Name, creds.TunnelID, creds.Subdomain, out)
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&subdomain, "subdomain", "", "Subdomain reserved for the tunnel (defaults to its name)")
+	cmd.Flags().StringVar(&serverAddr, "server-addr", "",
+		"QUIC address clients connect to (defaults to the admin host:8081)")
+	cmd.Flags().StringVarP(&out, "out", "o", "", "Credentials file (defaults to ~/.gunnel/tunnels/<name>.json)")
+	return cmd
+}
+
+func newTunnelListCmd(admin *client.AdminAPI) *cobra.Command {
+	return &cobra.Command{
+		Use:          "list",
+		Short:        "List the named tunnels of the server",
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			tunnels, err := admin.ListTunnels(context.Background())
+			if err != nil {
+				return err
+			}
+
+			w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "NAME\tID\tSUBDOMAIN\tCONNECTED\tCREATED")
+			for _, t := range tunnels {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%t\t%s\n",
+					t.Name, t.TunnelID, t.Subdomain, t.Connected, t.CreatedAt.Format("2006-01-02 15:04"))
+			}
+			return w.Flush()
+		},
+	}
+}
+
+func newTunnelDeleteCmd(admin *client.AdminAPI) *cobra.Command {
+	return &cobra.Command{
+		Use:          "delete <name>",
+		Short:        "Delete a named tunnel, revoking its credentials",
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := admin.DeleteTunnel(context.Background(), args[0]); err != nil {
+				return err
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "Deleted tunnel %s\n", args[0])
+			return nil
+		},
+	}
+}
+
+func newTunnelRunCmd() *cobra.Command {
+	var credsFile, target, proto string
+	var share shareOptions
+
+	cmd := &cobra.Command{
+		Use:          "run <name>",
+		Short:        "Connect a named tunnel using its credentials file",
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+		RunE: func(_ *cobra.Command, args []string) error {
+			if credsFile == "" {
+				path, err := client.DefaultCredentialsPath(args[0])
+				if err != nil {
+					return err
+				}
+				credsFile = path
+			}
+
+			creds, err := client.LoadCredentials(credsFile)
+			if err != nil {
+				return fmt.Errorf("failed to load credentials: %w", err)
+			}
+
+			config, err := creds.Config(target, protocol.Protocol(proto))
+			if err != nil {
+				return err
+			}
+
+			logrus.WithFields(logrus.Fields{
+				"tunnel":    creds.Name,
+				"subdomain": creds.Subdomain,
+				"target":    target,
+			}).Info("Starting named tunnel")
+
+			cm, err := client.New(config)
+			if err != nil {
+				return fmt.Errorf("failed to create connection manager: %w", err)
+			}
+			share.attach(cm)
+			if err := cm.Start(context.Background()); err != nil {
+				return fmt.Errorf("failed to start client: %w", err)
+			}
+
+			signal.WaitInterruptSignal()
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&credsFile, "credentials", "", "Credentials file (defaults to ~/.gunnel/tunnels/<name>.json)")
+	cmd.Flags().StringVar(&target, "url", "", "Local service to expose, as host:port or port")
+	cmd.Flags().StringVar(&proto, "protocol", string(protocol.HTTP), "Protocol of the local service")
+	share.addFlags(cmd)
+	if err := cmd.MarkFlagRequired("url"); err != nil {
+		logrus.WithError(err).Error("Failed to mark url flag as required")
+	}
+	return cmd
+}
+
+// quicAddrFromAdminURL assumes the QUIC listener runs on the admin URL's
+// host at the default port.
+func quicAddrFromAdminURL(adminURL string) (string, error) {
+	u, err := url.Parse(adminURL)
+	if err != nil || u.Hostname() == "" {
+		return "", fmt.Errorf("invalid admin URL %q", adminURL)
+	}
+	return net.JoinHostPort(u.Hostname(), defaultQuicPort), nil
+}
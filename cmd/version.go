@@ -0,0 +1,72 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/snakeice/gunnel/pkg/client"
+	"github.com/snakeice/gunnel/pkg/version"
+	"github.com/spf13/cobra"
+)
+
+func AddVersionCmd(rootCmd *cobra.Command) error {
+	var (
+		asJSON    bool
+		serverURL string
+	)
+
+	versionCmd := &cobra.Command{
+		Use:   "version",
+		Short: "Print the version and build information",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			info := version.Get()
+			if serverURL != "" {
+				return printServerVersion(cmd, info, serverURL, asJSON)
+			}
+			if asJSON {
+				enc := json.NewEncoder(cmd.OutOrStdout())
+				enc.SetIndent("", "  ")
+				return enc.Encode(info)
+			}
+			_, err := fmt.Fprintln(cmd.OutOrStdout(), "gunnel "+info.String())
+			return err
+		},
+	}
+	versionCmd.Flags().BoolVar(&asJSON, "json", false, "Print the build information as JSON")
+	versionCmd.Flags().StringVar(&serverURL, "server", "",
+		"Also check the version of the server whose WebUI is at this URL, e.g. https://gunnel.example.com")
+
+	rootCmd.AddCommand(versionCmd)
+	rootCmd.Version = version.Version
+
+	return nil
+}
+
+// printServerVersion prints the versions of this binary and of the server at
+// serverURL, and fails when they are not compatible.
+func printServerVersion(cmd *cobra.Command, info version.Info, serverURL string, asJSON bool) error {
+	server, err := client.ServerVersion(cmd.Context(), serverURL)
+	if err != nil {
+		return err
+	}
+	compatible := version.Compatible(info.Version, server.Version)
+
+	if asJSON {
+		enc := json.NewEncoder(cmd.OutOrStdout())
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(map[string]any{"client": info, "server": server, "compatible": compatible}); err != nil {
+			return err
+		}
+	} else {
+		out := cmd.OutOrStdout()
+		fmt.Fprintln(out, "client: gunnel "+info.String())
+		fmt.Fprintln(out, "server: gunnel "+server.String())
+	}
+
+	if !compatible {
+		return fmt.Errorf("client %s is not compatible with server %s, download the matching client from %s",
+			info.Version, server.Version, serverURL)
+	}
+	return nil
+}
@@ -0,0 +1,251 @@
+package client
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// State is the server configuration managed as code by "gunnel apply": the
+// named tunnels reserving subdomains and the client tokens with their
+// subdomain patterns and tunnel quotas.
+type State struct {
+	Tunnels []TunnelSpec `yaml:"tunnels"`
+	Tokens  []TokenSpec  `yaml:"tokens"`
+}
+
+// TunnelSpec is a named tunnel; Subdomain defaults to Name.
+type TunnelSpec struct {
+	Name      string `yaml:"name"`
+	Subdomain string `yaml:"subdomain"`
+}
+
+// TokenSpec is a client token. Without TokenSHA256 the server generates the
+// token when creating it.
+type TokenSpec struct {
+	Name        string   `yaml:"name"`
+	Subdomains  []string `yaml:"subdomains"`
+	MaxTunnels  int      `yaml:"max_tunnels"`
+	TokenSHA256 string   `yaml:"token_sha256"`
+}
+
+// ClientToken describes a client token as returned by the admin API.
+type ClientToken struct {
+	ID          string    `json:"id"`
+	Name        string    `json:"name"`
+	Subdomains  []string  `json:"subdomains"`
+	MaxTunnels  int       `json:"max_tunnels"`
+	TokenSHA256 string    `json:"token_sha256"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+	// Token is only returned when the server generated it.
+	Token string `json:"token,omitempty"`
+}
+
+// LoadState reads a state file, expanding ${ENV} placeholders.
+func LoadState(path string) (*State, error) {
+	file, err := os.Open(filepath.Clean(path))
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			logrus.WithError(err).WithField("path", path).Warn("Failed to close state file")
+		}
+	}()
+
+	state := &State{}
+	if err := decodeExpanded(file, state); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	return state, state.validate()
+}
+
+func (s *State) validate() error {
+	tunnels := make(map[string]bool, len(s.Tunnels))
+	for _, t := range s.Tunnels {
+		if t.Name == "" || tunnels[t.Name] {
+			return fmt.Errorf("tunnel names must be set and unique, got %q", t.Name)
+		}
+		tunnels[t.Name] = true
+	}
+
+	tokens := make(map[string]bool, len(s.Tokens))
+	for _, t := range s.Tokens {
+		if t.Name == "" || tokens[t.Name] {
+			return fmt.Errorf("token names must be set and unique, got %q", t.Name)
+		}
+		tokens[t.Name] = true
+	}
+	return nil
+}
+
+// ChangeAction is what applying a state does to one resource.
+type ChangeAction string
+
+const (
+	ChangeCreate ChangeAction = "create"
+	ChangeUpdate ChangeAction = "update"
+	ChangeDelete ChangeAction = "delete"
+)
+
+// Resource kinds of a Change.
+const (
+	KindTunnel = "tunnel"
+	KindToken  = "token"
+)
+
+// Change is one step of applying a state.
+type Change struct {
+	Action ChangeAction
+	Kind   string
+	Name   string
+	// Token is the credential issued by a creation, once applied.
+	Token string
+}
+
+func (c Change) String() string {
+	symbol := map[ChangeAction]string{ChangeCreate: "+", ChangeUpdate: "~", ChangeDelete: "-"}[c.Action]
+	return symbol + " " + c.Kind + " " + c.Name
+}
+
+// Plan compares state with the server and returns the changes applying it
+// makes, creations and updates first. With prune, resources missing from the
+// state are deleted.
+func (a AdminAPI) Plan(ctx context.Context, state *State, prune bool) ([]Change, error) {
+	tunnels, err := a.ListTunnels(ctx)
+	if err != nil {
+		return nil, err
+	}
+	tokens, err := a.ListTokens(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []Change
+	for _, want := range state.Tunnels {
+		i := slices.IndexFunc(tunnels, func(t NamedTunnel) bool { return t.Name == want.Name })
+		switch {
+		case i < 0:
+			changes = append(changes, Change{Action: ChangeCreate, Kind: KindTunnel, Name: want.Name})
+		case !strings.EqualFold(tunnels[i].Subdomain, cmp.Or(want.Subdomain, want.Name)):
+			changes = append(changes, Change{Action: ChangeUpdate, Kind: KindTunnel, Name: want.Name})
+		}
+	}
+	for _, want := range state.Tokens {
+		i := slices.IndexFunc(tokens, func(t ClientToken) bool { return t.Name == want.Name })
+		switch {
+		case i < 0:
+			changes = append(changes, Change{Action: ChangeCreate, Kind: KindToken, Name: want.Name})
+		case !want.matches(tokens[i]):
+			changes = append(changes, Change{Action: ChangeUpdate, Kind: KindToken, Name: want.Name})
+		}
+	}
+
+	if !prune {
+		return changes, nil
+	}
+	for _, t := range tunnels {
+		if !slices.ContainsFunc(state.Tunnels, func(want TunnelSpec) bool { return want.Name == t.Name }) {
+			changes = append(changes, Change{Action: ChangeDelete, Kind: KindTunnel, Name: t.Name})
+		}
+	}
+	for _, t := range tokens {
+		if !slices.ContainsFunc(state.Tokens, func(want TokenSpec) bool { return want.Name == t.Name }) {
+			changes = append(changes, Change{Action: ChangeDelete, Kind: KindToken, Name: t.Name})
+		}
+	}
+	return changes, nil
+}
+
+// Apply makes the planned changes in order and returns the applied ones with
+// the credentials issued on creation. It stops at the first failure; applying
+// the state again picks up where it stopped.
+func (a AdminAPI) Apply(ctx context.Context, state *State, changes []Change) ([]Change, error) {
+	applied := make([]Change, 0, len(changes))
+	for _, change := range changes {
+		var err error
+		switch {
+		case change.Action == ChangeDelete && change.Kind == KindTunnel:
+			err = a.DeleteTunnel(ctx, change.Name)
+		case change.Action == ChangeDelete:
+			err = a.DeleteToken(ctx, change.Name)
+		case change.Kind == KindTunnel:
+			i := slices.IndexFunc(state.Tunnels, func(t TunnelSpec) bool { return t.Name == change.Name })
+			var creds *Credentials
+			if creds, err = a.PutTunnel(ctx, change.Name, state.Tunnels[i].Subdomain); err == nil {
+				change.Token = creds.Token
+			}
+		default:
+			i := slices.IndexFunc(state.Tokens, func(t TokenSpec) bool { return t.Name == change.Name })
+			var token *ClientToken
+			if token, err = a.PutToken(ctx, change.Name, state.Tokens[i]); err == nil {
+				change.Token = token.Token
+			}
+		}
+		if err != nil {
+			return applied, fmt.Errorf("%s: %w", change, err)
+		}
+		applied = append(applied, change)
+	}
+	return applied, nil
+}
+
+func (s TokenSpec) matches(current ClientToken) bool {
+	if s.TokenSHA256 != "" && !strings.EqualFold(s.TokenSHA256, current.TokenSHA256) {
+		return false
+	}
+	return s.MaxTunnels == current.MaxTunnels && slices.Equal(s.Subdomains, current.Subdomains)
+}
+
+// ListTokens returns the client tokens known to the server.
+func (a AdminAPI) ListTokens(ctx context.Context) ([]ClientToken, error) {
+	var list []ClientToken
+	if err := a.do(ctx, http.MethodGet, "tokens", nil, &list, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// GetToken returns the client token name, or ErrAdminNotFound.
+func (a AdminAPI) GetToken(ctx context.Context, name string) (*ClientToken, error) {
+	token := &ClientToken{}
+	if err := a.do(ctx, http.MethodGet, "tokens/"+url.PathEscape(name), nil, token, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+// PutToken creates or replaces the client token name.
+func (a AdminAPI) PutToken(ctx context.Context, name string, spec TokenSpec) (*ClientToken, error) {
+	body, err := json.Marshal(map[string]any{
+		"subdomains":   spec.Subdomains,
+		"max_tunnels":  spec.MaxTunnels,
+		"token_sha256": spec.TokenSHA256,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	token := &ClientToken{}
+	path := "tokens/" + url.PathEscape(name)
+	if err := a.do(ctx, http.MethodPut, path, body, token, http.StatusOK, http.StatusCreated); err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+// DeleteToken revokes the client token name.
+func (a AdminAPI) DeleteToken(ctx context.Context, name string) error {
+	return a.do(ctx, http.MethodDelete, "tokens/"+url.PathEscape(name), nil, nil, http.StatusNoContent)
+}
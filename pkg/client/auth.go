@@ -0,0 +1,75 @@
+package client
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/snakeice/gunnel/pkg/protocol"
+	"github.com/snakeice/gunnel/pkg/transport"
+	"golang.org/x/crypto/ssh"
+)
+
+// loadAuthKey reads an unencrypted OpenSSH ed25519 private key.
+func loadAuthKey(path string) (ed25519.PrivateKey, error) {
+	pem, err := os.ReadFile(filepath.Clean(path))
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := ssh.ParseRawPrivateKey(pem)
+	if err != nil {
+		var missing *ssh.PassphraseMissingError
+		if errors.As(err, &missing) {
+			return nil, fmt.Errorf("%s is protected by a passphrase, which is not supported", path)
+		}
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+
+	switch key := raw.(type) {
+	case ed25519.PrivateKey:
+		return key, nil
+	case *ed25519.PrivateKey:
+		return *key, nil
+	default:
+		return nil, fmt.Errorf("%s is not an ed25519 key", path)
+	}
+}
+
+// signRegistration asks the server for a nonce on stream and signs it with
+// the client's key, so reg authenticates without the shared token.
+func (c *Client) signRegistration(stream transport.Stream, reg *protocol.ConnectionRegister) error {
+	if c.authKey == nil {
+		return nil
+	}
+
+	if err := stream.Send(&protocol.AuthChallenge{}); err != nil {
+		return fmt.Errorf("failed to request challenge: %w", err)
+	}
+
+	msg, err := c.receiveRegistration(stream)
+	if err != nil {
+		return fmt.Errorf("failed to receive challenge: %w", err)
+	}
+	if msg.Type != protocol.MessageAuthChallenge {
+		return fmt.Errorf("unexpected response to challenge request: %s", msg.Type.String())
+	}
+
+	challenge := protocol.AuthChallenge{}
+	if err := protocol.Unmarshal(&challenge, msg); err != nil {
+		return err
+	}
+	if len(challenge.Nonce) == 0 {
+		return errors.New("server sent an empty challenge")
+	}
+
+	pub, ok := c.authKey.Public().(ed25519.PublicKey)
+	if !ok {
+		return errors.New("invalid auth key")
+	}
+	reg.PublicKey = pub
+	reg.Signature = ed25519.Sign(c.authKey, challenge.SignedMessage())
+	return nil
+}
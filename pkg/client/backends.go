@@ -0,0 +1,129 @@
+package client
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/snakeice/gunnel/pkg/connection"
+	"github.com/snakeice/gunnel/pkg/protocol"
+	"github.com/snakeice/gunnel/pkg/transport"
+)
+
+// addBackendGrace is how long the connection replaced when a backend is
+// added keeps serving the requests already routed to it.
+const addBackendGrace = 10 * time.Second
+
+// ErrBackendExists is returned by AddBackend for a name or subdomain already
+// in use.
+var ErrBackendExists = errors.New("backend already exists")
+
+// backends returns a snapshot of the configured backends by name.
+func (c *Client) backends() map[string]*BackendConfig {
+	c.backendsMu.RLock()
+	defer c.backendsMu.RUnlock()
+	return maps.Clone(c.config.Backend)
+}
+
+// AddBackend registers backend as name with the server while the client
+// runs, waiting for Start first. The tunnel is registered on a new
+// connection together with the others, which then replaces the primary one,
+// so a refused subdomain is reported without disturbing the other tunnels.
+// Service discovery and process watching stop with ctx.
+func (c *Client) AddBackend(ctx context.Context, name string, backend *BackendConfig) error {
+	if err := backend.validate(); err != nil {
+		return err
+	}
+
+	select {
+	case <-c.started:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if c.runCtx.Err() != nil {
+		return errors.New("client is stopped")
+	}
+
+	c.tunnelsMu.Lock()
+	defer c.tunnelsMu.Unlock()
+
+	existing := c.backends()
+	for key, b := range existing {
+		if key == name || (backend.Subdomain != "" && b.Subdomain == backend.Subdomain) {
+			return fmt.Errorf("%w: %s", ErrBackendExists, cmp.Or(backend.Subdomain, name))
+		}
+	}
+	if backend.TTL > 0 {
+		backend.expiresAt = time.Now().Add(backend.TTL)
+	}
+
+	transp, err := transport.NewWithDialer(c.connectedServer(), c.dialer)
+	if err != nil {
+		return fmt.Errorf("failed to create transport: %w", err)
+	}
+	// registryBackendWithTransport closes transp on failure.
+	if err := c.registryBackendWithTransport(transp, backend); err != nil {
+		return err
+	}
+	for _, other := range existing {
+		if err := c.registryBackendWithTransport(transp, other); err != nil {
+			return fmt.Errorf("failed to move backend %s to a new connection: %w", other.Subdomain, err)
+		}
+	}
+
+	c.backendsMu.Lock()
+	c.config.Backend[name] = backend
+	c.backendsMu.Unlock()
+	c.watchBackend(ctx, backend)
+
+	c.mu.Lock()
+	primary := c.connWrapper
+	c.mu.Unlock()
+	if primary == nil {
+		// Reconnecting: the reconnect loop registers every backend.
+		transp.Close()
+		return nil
+	}
+	c.replaceConnection(c.runCtx, reconnectRequest{conn: primary, grace: addBackendGrace}, transp)
+	return nil
+}
+
+// RemoveBackend drops the tunnel of the backend name on the server, leaving
+// the other tunnels of the client up.
+func (c *Client) RemoveBackend(name string) error {
+	c.tunnelsMu.Lock()
+	defer c.tunnelsMu.Unlock()
+
+	c.backendsMu.Lock()
+	backend, ok := c.config.Backend[name]
+	delete(c.config.Backend, name)
+	c.backendsMu.Unlock()
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownTunnel, name)
+	}
+
+	c.mu.Lock()
+	conns := make([]*connection.Connection, 0, 1+len(c.extras))
+	if c.connWrapper != nil {
+		conns = append(conns, c.connWrapper)
+	}
+	for _, extra := range c.extras {
+		conns = append(conns, extra.wrapper)
+	}
+	c.mu.Unlock()
+
+	for _, conn := range conns {
+		conn.Send(&protocol.TunnelState{Subdomain: backend.Subdomain, Closed: true})
+	}
+
+	c.hooks.tunnelDown(backend.Subdomain)
+	c.logger.WithFields(logrus.Fields{
+		"name":      name,
+		"subdomain": backend.Subdomain,
+	}).Info("Tunnel closed")
+	return nil
+}
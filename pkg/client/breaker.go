@@ -0,0 +1,107 @@
+package client
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultBreakerFailures = 5
+	defaultBreakerCooldown = 30 * time.Second
+)
+
+// CircuitBreakerConfig stops sending requests to a backend that keeps failing
+// to answer. After Failures consecutive failures the tunnel answers 503 right
+// away; once Cooldown has passed, a single request probes the backend and
+// closes the circuit again if it gets a response.
+type CircuitBreakerConfig struct {
+	Failures int           `yaml:"failures"`
+	Cooldown time.Duration `yaml:"cooldown"`
+}
+
+func (c *CircuitBreakerConfig) validate() error {
+	if c == nil {
+		return nil
+	}
+	if c.Failures < 0 {
+		return errors.New("failures must not be negative")
+	}
+	if c.Cooldown < 0 {
+		return errors.New("cooldown must not be negative")
+	}
+	return nil
+}
+
+type circuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+func newCircuitBreaker(cfg *CircuitBreakerConfig) *circuitBreaker {
+	if cfg == nil {
+		return nil
+	}
+	cb := &circuitBreaker{threshold: cfg.Failures, cooldown: cfg.Cooldown}
+	if cb.threshold == 0 {
+		cb.threshold = defaultBreakerFailures
+	}
+	if cb.cooldown == 0 {
+		cb.cooldown = defaultBreakerCooldown
+	}
+	return cb
+}
+
+// allow reports whether a request may go to the backend. While the circuit
+// is open it lets one probe through per cooldown.
+func (cb *circuitBreaker) allow() bool {
+	if cb == nil {
+		return true
+	}
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if cb.failures < cb.threshold {
+		return true
+	}
+	if cb.probing || time.Now().Before(cb.openUntil) {
+		return false
+	}
+	cb.probing = true
+	return true
+}
+
+// record counts the outcome of a request let through by allow; ok means the
+// backend answered, whatever its status.
+func (cb *circuitBreaker) record(ok bool, logger *logrus.Entry) {
+	if cb == nil {
+		return
+	}
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	wasOpen := cb.failures >= cb.threshold
+	cb.probing = false
+	if ok {
+		cb.failures = 0
+		if wasOpen {
+			logger.Info("Backend recovered, closing circuit")
+		}
+		return
+	}
+
+	cb.failures++
+	if cb.failures >= cb.threshold {
+		cb.openUntil = time.Now().Add(cb.cooldown)
+		if !wasOpen {
+			logger.WithFields(logrus.Fields{"failures": cb.failures, "cooldown": cb.cooldown}).
+				Warn("Backend keeps failing, opening circuit")
+		}
+	}
+}
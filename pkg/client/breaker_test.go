@@ -0,0 +1,64 @@
+package client_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/snakeice/gunnel/pkg/client"
+)
+
+func TestCircuitBreakerOpensAfterFailures(t *testing.T) {
+	cb := client.NewCircuitBreaker(&client.CircuitBreakerConfig{Failures: 2, Cooldown: time.Hour})
+
+	for range 2 {
+		if !cb.Allow() {
+			t.Fatal("closed circuit rejected a request")
+		}
+		cb.Record(false)
+	}
+	if cb.Allow() {
+		t.Fatal("open circuit let a request through before its cooldown")
+	}
+}
+
+func TestCircuitBreakerSuccessResetsFailures(t *testing.T) {
+	cb := client.NewCircuitBreaker(&client.CircuitBreakerConfig{Failures: 2, Cooldown: time.Hour})
+
+	cb.Record(false)
+	cb.Record(true)
+	cb.Record(false)
+	if !cb.Allow() {
+		t.Fatal("circuit opened on failures separated by a success")
+	}
+}
+
+func TestCircuitBreakerProbesAfterCooldown(t *testing.T) {
+	cooldown := 20 * time.Millisecond
+	cb := client.NewCircuitBreaker(&client.CircuitBreakerConfig{Failures: 1, Cooldown: cooldown})
+	cb.Record(false)
+	time.Sleep(cooldown)
+
+	if !cb.Allow() {
+		t.Fatal("no probe was let through after the cooldown")
+	}
+	if cb.Allow() {
+		t.Fatal("a second request was let through while probing")
+	}
+
+	// A failed probe opens the circuit for another cooldown.
+	cb.Record(false)
+	if cb.Allow() {
+		t.Fatal("circuit closed after a failed probe")
+	}
+	time.Sleep(cooldown)
+
+	if !cb.Allow() {
+		t.Fatal("no probe was let through after the second cooldown")
+	}
+	cb.Record(true)
+	for range 3 {
+		if !cb.Allow() {
+			t.Fatal("circuit stayed open after a successful probe")
+		}
+	}
+}
@@ -2,74 +2,222 @@ package client
 
 import (
 	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"fmt"
-	"io"
 	"math"
+	"net"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/snakeice/gunnel/pkg/connection"
+	"github.com/snakeice/gunnel/pkg/discovery"
+	"github.com/snakeice/gunnel/pkg/logging"
 	"github.com/snakeice/gunnel/pkg/protocol"
+	"github.com/snakeice/gunnel/pkg/proxy"
+	gunnelquic "github.com/snakeice/gunnel/pkg/quic"
+	"github.com/snakeice/gunnel/pkg/resolver"
+	"github.com/snakeice/gunnel/pkg/subdomain"
 	"github.com/snakeice/gunnel/pkg/transport"
+	"github.com/snakeice/gunnel/pkg/version"
 )
 
 // Client manages client connections to the server.
 type Client struct {
+	id             string
 	config         *Config
 	conn           transport.Transport
 	connWrapper    *connection.Connection
+	extras         []*pooledConn
 	mu             sync.Mutex
 	reconnectDelay time.Duration
 	token          string
+	authKey        ed25519.PrivateKey
+	dialer         gunnelquic.PacketDialer
 	logger         *logrus.Entry
+	hooks          *hooks
+	// onRequest holds the callbacks registered through OnRequest.
+	onRequest []func(RequestLog)
+	// resolver looks up backend hostnames; nil uses the system resolver.
+	resolver *resolver.Resolver
+	// serverAddr is the server in use among the configured candidates.
+	serverAddr string
+	// peers are the clients of the other servers in a Group, controlled
+	// through this client's local API.
+	peers []*Client
+
+	limiter         *rateLimiter
+	features        map[string]bool
+	serverHeartbeat time.Duration
+	notices         []protocol.Broadcast
+
+	// acceptCancel interrupts the worker's accept on the primary connection
+	// and connChanged is closed whenever the primary connection is replaced.
+	acceptCancel context.CancelFunc
+	connChanged  chan struct{}
+	// reconnects queues the connections the server asked to rotate.
+	reconnects chan reconnectRequest
+	// udp holds the sessions of the UDP tunnels, see udp.go.
+	udp udpSessions
+	// activeStreams counts the running stream handlers, waited for on
+	// shutdown.
+	activeStreams atomic.Int64
+
+	// backendsMu guards config.Backend, which AddBackend and RemoveBackend
+	// change while the client runs.
+	backendsMu sync.RWMutex
+	// tunnelsMu serializes AddBackend and RemoveBackend with the
+	// registration of every tunnel on a new primary connection.
+	tunnelsMu sync.Mutex
+	// runCtx is the context of the running Start, closed started once it
+	// registered the configured backends.
+	runCtx  context.Context //nolint:containedctx // AddBackend outlives the caller's context
+	started chan struct{}
 }
 
 // New creates a new connection manager.
 func New(config *Config) (*Client, error) {
-	transp, err := transport.New(config.ServerAddr)
+	token := config.Token
+	if token == "" {
+		token = os.Getenv("GUNNEL_TOKEN")
+	}
+
+	var authKey ed25519.PrivateKey
+	if config.AuthKey != "" {
+		key, err := loadAuthKey(config.AuthKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load auth key: %w", err)
+		}
+		authKey = key
+	}
+
+	dialer, err := packetDialer(config)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create transport: %w", err)
+		return nil, err
 	}
 
 	c := &Client{
+		id:             newClientID(),
 		config:         config,
 		reconnectDelay: 5 * time.Second,
-		conn:           transp,
-		token:          os.Getenv("GUNNEL_TOKEN"),
-		logger: logrus.WithFields(
+		token:          token,
+		authKey:        authKey,
+		dialer:         dialer,
+		limiter:        newRateLimiter(config.RateLimit),
+		features:       make(map[string]bool),
+		connChanged:    make(chan struct{}),
+		reconnects:     make(chan reconnectRequest, 1),
+		started:        make(chan struct{}),
+		logger: logging.Control.WithFields(
 			logrus.Fields{
-				"server_addr": config.ServerAddr,
+				"server_addr": strings.Join(config.serverCandidates(), ","),
 			},
 		),
 	}
 
+	if c.conn, err = c.dialServer(); err != nil {
+		return nil, fmt.Errorf("failed to create transport: %w", err)
+	}
+
+	if config.DNS != nil {
+		if c.resolver, err = resolver.New(config.DNS); err != nil {
+			return nil, fmt.Errorf("dns: %w", err)
+		}
+	}
+
+	integrationList, err := config.integrations()
+	if err != nil {
+		return nil, err
+	}
+	c.hooks = newHooks(config.Hooks, integrationList, c.logger)
+
+	now := time.Now()
+	for _, backend := range config.Backend {
+		if backend.TTL > 0 {
+			backend.expiresAt = now.Add(backend.TTL)
+		}
+	}
+
 	return c, nil
 }
 
-// Start starts the connection manager.
+// OnTunnelUp calls fn with the public URL of each tunnel once it is
+// registered, and again when the URL changes. Call it before Start.
+func (c *Client) OnTunnelUp(fn func(subdomain, publicURL string)) {
+	c.hooks.onUp = append(c.hooks.onUp, fn)
+}
+
+// Start runs the connection manager until ctx is done, then shuts it down
+// gracefully: the server stops routing to it and the streams in flight
+// finish before the connections close.
 func (c *Client) Start(ctx context.Context) error {
 	c.logger.Info("Starting registration process")
 
+	c.tunnelsMu.Lock()
 	err := c.register()
 	if err != nil {
+		c.tunnelsMu.Unlock()
 		c.logger.WithError(err).Error("Failed to register client")
 		return err
 	}
+	c.runCtx = ctx
+	close(c.started)
+	c.tunnelsMu.Unlock()
+
+	defer c.shutdown()
+
+	c.watchBackends(ctx)
 
 	go c.reconnectLoop(ctx)
+	go c.scaleLoop(ctx)
+	go c.rotationLoop(ctx)
+	if c.config.LocalAPI != "" {
+		go c.serveLocalAPI(ctx)
+	}
 
 	return c.worker(ctx)
 }
 
+// watchBackends resolves the backends found through service discovery or by
+// process name and keeps watching them for changes.
+func (c *Client) watchBackends(ctx context.Context) {
+	for _, backend := range c.backends() {
+		c.watchBackend(ctx, backend)
+	}
+}
+
+func (c *Client) watchBackend(ctx context.Context, backend *BackendConfig) {
+	logger := c.logger.WithField("subdomain", backend.Subdomain)
+	if backend.Discovery != nil {
+		backend.pool = discovery.NewPool(backend.Discovery, logger)
+		if err := backend.pool.Refresh(ctx); err != nil {
+			logger.WithError(err).Warn("Failed to discover backend instances")
+		}
+		go backend.pool.Run(ctx)
+	}
+	if backend.Process != "" {
+		backend.detectProcessPort(logger)
+		if backend.detectedPort.Load() == 0 && backend.Port == 0 {
+			logger.WithField("process", backend.Process).Warn("Backend process is not listening yet")
+		}
+		go backend.watchProcess(ctx, logger)
+	}
+}
+
 func (c *Client) register() error {
 	if c.conn == nil || c.conn.IsClosed() {
 		return nil
 	}
 
-	for _, backend := range c.config.Backend {
+	for _, backend := range c.backends() {
 		if err := c.registryBackendWithTransport(c.conn, backend); err != nil {
 			c.logger.WithError(err).Error("Failed to register backend")
 			continue
@@ -79,7 +227,7 @@ func (c *Client) register() error {
 	c.logger.Info("Backends registered")
 
 	if c.conn != nil && !c.conn.IsClosed() {
-		c.connWrapper = connection.New(c.conn)
+		c.connWrapper = c.newConnection(c.conn)
 		c.connWrapper.Start()
 	}
 
@@ -87,7 +235,7 @@ func (c *Client) register() error {
 }
 
 func (c *Client) registerWithTransport(transp transport.Transport) {
-	for _, backend := range c.config.Backend {
+	for _, backend := range c.backends() {
 		if err := c.registryBackendWithTransport(transp, backend); err != nil {
 			c.logger.WithError(err).Error("Failed to register backend")
 			continue
@@ -98,7 +246,7 @@ func (c *Client) registerWithTransport(transp transport.Transport) {
 	if c.connWrapper != nil {
 		c.connWrapper.Close()
 	}
-	c.connWrapper = connection.New(transp)
+	c.connWrapper = c.newConnection(transp)
 	c.connWrapper.Start()
 }
 
@@ -106,13 +254,30 @@ func (c *Client) registryBackendWithTransport(
 	transp transport.Transport,
 	backend *BackendConfig,
 ) error {
+	ttl, expired := backend.remainingTTL(time.Now())
+	if expired {
+		c.logger.WithField("subdomain", backend.Subdomain).Info("Tunnel TTL elapsed, not registering")
+		return nil
+	}
+
 	stream := transp.Root()
 	reg := protocol.ConnectionRegister{
-		Subdomain: backend.Subdomain,
-		Host:      backend.Host,
-		Port:      backend.Port,
-		Protocol:  backend.Protocol,
-		Token:     c.token,
+		Subdomain:    backend.Subdomain,
+		Host:         backend.Host,
+		Port:         backend.Port,
+		Protocol:     backend.Protocol,
+		Token:        c.token,
+		ClientID:     c.id,
+		TTL:          ttl,
+		Schedule:     backend.scheduleSpec,
+		JWT:          backend.JWT.policy(),
+		Version:      version.Version,
+		PublicStatus: backend.PublicStatus,
+	}
+
+	if err := c.signRegistration(stream, &reg); err != nil {
+		transp.Close()
+		return err
 	}
 
 	c.logger.Debug("Registering client with server")
@@ -122,7 +287,7 @@ func (c *Client) registryBackendWithTransport(
 		return fmt.Errorf("failed to send registration message: %w", err)
 	}
 
-	msg, err := stream.Receive()
+	msg, err := c.receiveRegistration(stream)
 	if err != nil {
 		transp.Close()
 		return fmt.Errorf("failed to receive registration response: %w", err)
@@ -130,7 +295,10 @@ func (c *Client) registryBackendWithTransport(
 
 	if msg.Type == protocol.MessageError {
 		errMsg := protocol.ErrorMessage{}
-		protocol.Unmarshal(&errMsg, msg)
+		if err := protocol.Unmarshal(&errMsg, msg); err != nil {
+			transp.Close()
+			return fmt.Errorf("server sent error during registration: %w", err)
+		}
 
 		transp.Close()
 		return fmt.Errorf("server sent error during registration: %s", errMsg.Message)
@@ -144,40 +312,160 @@ func (c *Client) registryBackendWithTransport(
 	}
 
 	connectionResponse := protocol.ConnectionRegisterResp{}
-	protocol.Unmarshal(&connectionResponse, msg)
+	if err := protocol.Unmarshal(&connectionResponse, msg); err != nil {
+		transp.Close()
+		return err
+	}
 	if !connectionResponse.Success {
 		transp.Close()
-		return fmt.Errorf("server rejected connection: %s", connectionResponse.Message)
+		return &RegistrationError{
+			Subdomain: backend.Subdomain,
+			Reason:    connectionResponse.Reject,
+			Message:   connectionResponse.Message,
+		}
 	}
 
+	assigned := backend.Subdomain == ""
 	backend.Subdomain = connectionResponse.Subdomain
+	if connectionResponse.URL == "" && connectionResponse.Port != 0 {
+		connectionResponse.URL = portURL(backend.Protocol, stream.RemoteAddr(), connectionResponse.Port)
+	}
+	if assigned {
+		c.logger.WithFields(logrus.Fields{
+			"subdomain": backend.Subdomain,
+			"url":       connectionResponse.URL,
+		}).Info("Server assigned a random subdomain")
+	}
+
+	if backend.paused.Load() {
+		state := protocol.TunnelState{Subdomain: backend.Subdomain, Paused: true}
+		if err := stream.Send(&state); err != nil {
+			c.logger.WithError(err).Warn("Failed to restore paused state")
+		}
+	}
 
 	c.logger.WithFields(logrus.Fields{
-		"subdomain": backend.Subdomain,
+		"subdomain":      backend.Subdomain,
+		"url":            connectionResponse.URL,
+		"server_version": connectionResponse.Version,
 	}).Info("Registered with server")
+	if !version.Compatible(version.Version, connectionResponse.Version) {
+		c.logger.WithFields(logrus.Fields{
+			"client_version": version.Version,
+			"server_version": connectionResponse.Version,
+		}).Warn("Server runs an incompatible version, download the matching client from its WebUI")
+	}
+	c.hooks.tunnelUp(backend.Subdomain, connectionResponse.URL)
 	return nil
 }
 
-func (c *Client) worker(ctx context.Context) error {
+// RegistrationError is returned when the server refuses to register a tunnel.
+// When the subdomain was the problem it matches subdomain.ErrInvalid,
+// ErrReserved or ErrConfusable, so callers can ask for another name.
+type RegistrationError struct {
+	Subdomain string
+	Reason    protocol.RejectReason
+	Message   string
+}
+
+func (e *RegistrationError) Error() string {
+	return "server rejected connection: " + e.Message
+}
+
+func (e *RegistrationError) Is(target error) bool {
+	switch e.Reason { //nolint:exhaustive // other reasons have no subdomain error
+	case protocol.RejectInvalidSubdomain:
+		return target == subdomain.ErrInvalid
+	case protocol.RejectReservedSubdomain:
+		return target == subdomain.ErrReserved
+	case protocol.RejectConfusableSubdomain:
+		return target == subdomain.ErrConfusable
+	default:
+		return false
+	}
+}
+
+// receiveRegistration waits for the answer to a registration request. Any
+// configuration update, notice or expiry the server sends in between is
+// handled first.
+func (c *Client) receiveRegistration(stream transport.Stream) (*protocol.Message, error) {
 	for {
-		select {
-		case <-ctx.Done():
-			c.logger.Info("Stopping connection manager worker")
-			return nil
-		default:
+		msg, err := stream.Receive()
+		if err != nil {
+			return nil, err
 		}
 
-		if c.shouldWaitForReconnection(ctx) {
+		var reply protocol.Parsable
+		switch msg.Type { //nolint:exhaustive // everything else is the registration answer
+		case protocol.MessageConfigUpdate:
+			if ack, err := c.handleConfigUpdate(msg); err == nil {
+				reply = ack
+			} else {
+				reply = c.malformed(err)
+			}
+		case protocol.MessageBroadcast:
+			if err := c.handleBroadcast(msg); err != nil {
+				reply = c.malformed(err)
+			}
+		case protocol.MessageTunnelExpiry:
+			if err := c.handleTunnelExpiry(msg); err != nil {
+				reply = c.malformed(err)
+			}
+		default:
+			return msg, nil
+		}
+		if reply == nil {
 			continue
 		}
+		if err := stream.Send(reply); err != nil {
+			return nil, fmt.Errorf("failed to answer %s message: %w", msg.Type, err)
+		}
+	}
+}
+
+// malformed logs a server message that could not be decoded and returns
+// the ErrorMessage answering it.
+func (c *Client) malformed(err error) *protocol.ErrorMessage {
+	c.logger.WithError(err).Warn("Malformed message from server")
+	return protocol.NewErrorMessage(err.Error())
+}
+
+// worker accepts the streams the server opens on the primary connection. It
+// blocks on the connection and only wakes for a new stream or when the
+// connection is replaced.
+func (c *Client) worker(ctx context.Context) error {
+	for {
+		c.mu.Lock()
+		conn, changed := c.conn, c.connChanged
+		acceptCtx, cancel := context.WithCancel(ctx)
+		c.acceptCancel = cancel
+		c.mu.Unlock()
+
+		if connClosed(conn) {
+			cancel()
+			c.logger.Debug("Connection is closed, waiting for reconnection")
+			select {
+			case <-ctx.Done():
+				c.logger.Info("Stopping connection manager worker")
+				return nil
+			case <-changed:
+				continue
+			}
+		}
 
-		strm, err := c.conn.AcceptStream(ctx)
+		strm, err := conn.AcceptStream(acceptCtx)
+		cancel()
 		if err != nil {
-			if errors.Is(err, context.Canceled) {
+			if ctx.Err() != nil {
+				c.logger.Info("Stopping connection manager worker")
 				return nil
 			}
-			c.logger.WithError(err).Error("Failed to accept stream from server")
-			c.disconnect()
+			// A canceled accept means the connection was replaced; anything
+			// else means it is gone and the reconnect loop takes over.
+			if !errors.Is(err, context.Canceled) {
+				c.logger.WithError(err).Log(transport.LogLevel(err), "Failed to accept stream from server")
+				conn.Close()
+			}
 			continue
 		}
 
@@ -185,56 +473,68 @@ func (c *Client) worker(ctx context.Context) error {
 	}
 }
 
-func (c *Client) shouldWaitForReconnection(ctx context.Context) bool {
-	if c.conn == nil || c.conn.IsClosed() {
-		c.logger.Warn("Connection is closed, waiting for reconnection")
-		select {
-		case <-ctx.Done():
-			return false
-		case <-time.After(c.reconnectDelay):
-			return true
-		}
+// connClosed reports whether transp is missing or its connection is gone.
+func connClosed(transp transport.Transport) bool {
+	return transp == nil || transp.IsClosed() || transp.Context().Err() != nil
+}
+
+// setConnLocked replaces the primary connection, moving the worker off the old
+// one and waking every loop waiting for a change. c.mu must be held.
+func (c *Client) setConnLocked(transp transport.Transport) {
+	c.conn = transp
+	if c.acceptCancel != nil {
+		c.acceptCancel()
 	}
-	return false
+	close(c.connChanged)
+	c.connChanged = make(chan struct{})
 }
 
 func (c *Client) handleAcceptedStream(ctx context.Context, strm transport.Stream) {
-	strmLogger := c.logger.WithFields(logrus.Fields{
-		"client_id": strm.ID(),
+	strmLogger := logging.Data.WithFields(c.logger.Data).WithFields(logrus.Fields{
+		"stream_id":     strm.ID(),
+		"connection_id": strm.ConnectionID(),
 	})
 
 	strmLogger.Debug("Accepted new stream from server")
 
+	c.activeStreams.Add(1)
 	go func() {
+		defer c.activeStreams.Add(-1)
 		if err := c.handleStream(ctx, strm, strmLogger); err != nil {
-			if !errors.Is(err, io.EOF) && !errors.Is(err, context.Canceled) {
-				strmLogger.WithError(err).Error("Failed to handle stream")
-			}
+			strmLogger.WithError(err).Log(transport.LogLevel(err), "Failed to handle stream")
 		}
 	}()
 }
 
+// reconnectLoop replaces the primary connection once it is lost, backing off
+// exponentially between failed attempts. It sleeps until the connection
+// closes or is replaced instead of polling it.
 func (c *Client) reconnectLoop(ctx context.Context) {
-	const checkInterval = 1 * time.Second
 	attemptCount := 0
 
 	for {
-		select {
-		case <-ctx.Done():
-			c.logger.Info("Stopping reconnect loop")
-			return
-		case <-time.After(checkInterval):
-		}
-
 		c.mu.Lock()
-		needsReconnect := c.conn == nil || c.conn.IsClosed()
+		conn, changed := c.conn, c.connChanged
 		c.mu.Unlock()
 
-		if !needsReconnect {
+		if !connClosed(conn) {
 			attemptCount = 0
+			select {
+			case <-ctx.Done():
+				c.logger.Info("Stopping reconnect loop")
+				return
+			case <-conn.Context().Done():
+				if ctx.Err() == nil {
+					c.logClosed(conn)
+				}
+			case <-changed:
+			}
 			continue
 		}
 
+		if attemptCount == 0 {
+			c.hooks.allDown()
+		}
 		attemptCount++
 		exponentialFactor := math.Pow(2, float64(attemptCount-1))
 		nextRetry := time.Duration(math.Min(
@@ -254,32 +554,53 @@ func (c *Client) reconnectLoop(ctx context.Context) {
 		case <-time.After(nextRetry):
 		}
 
-		transp, err := transport.New(c.config.ServerAddr)
+		transp, err := c.dialServer()
 		if err != nil {
 			c.logger.WithError(err).Warnf("Failed to create transport (attempt %d)", attemptCount)
 			continue
 		}
 
+		c.tunnelsMu.Lock()
 		c.registerWithTransport(transp)
-
 		c.mu.Lock()
-		c.conn = transp
+		c.setConnLocked(transp)
 		c.mu.Unlock()
+		c.tunnelsMu.Unlock()
 
 		c.logger.Info("Reconnected")
 		attemptCount = 0
 	}
 }
 
-// Stop gracefully stops the client.
+// logClosed tells why the server, or this client, closed conn.
+func (c *Client) logClosed(conn transport.Transport) {
+	reason := transport.CloseReason(conn)
+	if reason == "" {
+		reason = "unknown"
+	}
+	c.logger.WithFields(logrus.Fields{
+		"connection_id": conn.ID(),
+		"reason":        reason,
+	}).Warn("Connection to server closed")
+}
+
+// Stop gracefully stops the client, see Start.
 func (c *Client) Stop() {
-	c.disconnect()
+	c.shutdown()
 }
 
-// disconnect closes all connections.
-func (c *Client) disconnect() {
+// disconnect closes all connections, telling the server why.
+func (c *Client) disconnect(code protocol.CloseCode, reason string) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	for _, extra := range c.extras {
+		extra.transp.CloseWithReason(code, reason)
+		extra.close()
+	}
+	c.extras = nil
+	if c.conn != nil {
+		c.conn.CloseWithReason(code, reason)
+	}
 	if c.connWrapper != nil {
 		c.connWrapper.Close()
 		c.connWrapper = nil
@@ -288,16 +609,84 @@ func (c *Client) disconnect() {
 		return
 	}
 	c.logger.Info("Closing connection manager")
-	c.conn.Close()
 
-	c.conn = nil
+	c.setConnLocked(nil)
+}
+
+// packetDialer returns the dialer for the configured local binding or proxy,
+// falling back to ALL_PROXY/HTTPS_PROXY. A proxy from the environment that
+// cannot carry QUIC is ignored, as those variables are often set for other
+// tools.
+func packetDialer(config *Config) (gunnelquic.PacketDialer, error) {
+	if config.BindAddress != "" || config.BindInterface != "" {
+		dialer, err := gunnelquic.BindDialer(config.BindAddress, config.BindInterface)
+		if err != nil {
+			return nil, err
+		}
+		logging.Control.WithFields(logrus.Fields{
+			"address":   config.BindAddress,
+			"interface": config.BindInterface,
+		}).Info("Binding connection to local address")
+		return dialer, nil
+	}
+
+	if configured := config.Proxy; configured != "" {
+		dialer, err := proxy.Dialer(configured)
+		if err != nil {
+			return nil, fmt.Errorf("proxy: %w", err)
+		}
+		logging.Control.WithField("proxy", redactProxy(configured)).Info("Connecting through proxy")
+		return dialer, nil
+	}
+
+	fromEnv := proxy.FromEnvironment()
+	if fromEnv == "" {
+		return nil, nil //nolint:nilnil // nil dialer means a direct connection
+	}
+
+	dialer, err := proxy.Dialer(fromEnv)
+	if err != nil {
+		logging.Control.WithError(err).WithField("proxy", redactProxy(fromEnv)).
+			Warn("Ignoring proxy from environment, connecting directly")
+		return nil, nil //nolint:nilnil // nil dialer means a direct connection
+	}
+	logging.Control.WithField("proxy", redactProxy(fromEnv)).Info("Connecting through proxy from environment")
+	return dialer, nil
+}
+
+func redactProxy(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "invalid"
+	}
+	return u.Redacted()
+}
+
+// newClientID returns a random identifier the server uses to group every
+// connection opened by this client process.
+func newClientID() string {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(buf)
 }
 
 func (c *Client) getBackend(subdomain string) *BackendConfig {
-	for _, backend := range c.config.Backend {
+	for _, backend := range c.backends() {
 		if backend.Subdomain == subdomain {
 			return backend
 		}
 	}
 	return nil
 }
+
+// portURL is the public address of a TCP or UDP tunnel on server, for
+// servers that only report the port.
+func portURL(proto protocol.Protocol, server net.Addr, port uint16) string {
+	host := server.String()
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return string(proto) + "://" + net.JoinHostPort(host, strconv.Itoa(int(port)))
+}
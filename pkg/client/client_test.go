@@ -1,9 +1,18 @@
 package client_test
 
 import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/snakeice/gunnel/pkg/client"
+	"github.com/snakeice/gunnel/pkg/protocol"
+	"github.com/snakeice/gunnel/pkg/subdomain"
 )
 
 // TestClientCreation tests that client config validation works.
@@ -43,3 +52,98 @@ func TestClientConfigValidation(t *testing.T) {
 		t.Log("✓ Client created (empty backend allowed)")
 	}
 }
+
+func TestRegistrationErrorMatchesSubdomainErrors(t *testing.T) {
+	err := error(&client.RegistrationError{Subdomain: "admin", Reason: protocol.RejectReservedSubdomain})
+	if !errors.Is(err, subdomain.ErrReserved) {
+		t.Error("reserved rejection does not match subdomain.ErrReserved")
+	}
+	if errors.Is(err, subdomain.ErrInvalid) {
+		t.Error("reserved rejection matches subdomain.ErrInvalid")
+	}
+}
+
+func TestBackendRoutes(t *testing.T) {
+	backend := &client.BackendConfig{
+		Host: "localhost",
+		Port: 3000,
+		Routes: []*client.RouteConfig{
+			{Path: "/api/*", Port: 8080},
+			{Headers: map[string]string{"X-Version": "2*"}, Host: "127.0.0.1", Port: 9090},
+		},
+	}
+
+	api := httptest.NewRequest(http.MethodGet, "/api/users", nil)
+	v2 := httptest.NewRequest(http.MethodGet, "/", nil)
+	v2.Header.Set("X-Version", "2.1")
+	tests := map[*http.Request]string{
+		api: "localhost:8080",
+		v2:  "127.0.0.1:9090",
+		httptest.NewRequest(http.MethodGet, "/index.html", nil): "localhost:3000",
+	}
+	for req, want := range tests {
+		if got := backend.AddrFor(req); got != want {
+			t.Errorf("AddrFor(%s) = %q, want %q", req.URL.Path, got, want)
+		}
+	}
+}
+
+func TestLoadConfigAssignsBackendsToServers(t *testing.T) {
+	dir := t.TempDir()
+	write := func(content string) string {
+		path := filepath.Join(dir, "gunnel.yaml")
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	_, err := client.LoadConfig(write(`
+server_addr: cloud.example.com:8081
+servers:
+  office:
+    server_addr: office.internal:8081
+backend:
+  demo: {port: 3000, subdomain: demo}
+  wiki: {port: 8080, subdomain: wiki, server: office}
+`))
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+
+	_, err = client.LoadConfig(write(`
+backend:
+  wiki: {port: 8080, subdomain: wiki, server: office}
+`))
+	if err == nil || !strings.Contains(err.Error(), "unknown server") {
+		t.Errorf("LoadConfig() error = %v, want an unknown server error", err)
+	}
+}
+
+func TestLoadConfigTypedPlaceholders(t *testing.T) {
+	t.Setenv("GUNNEL_TEST_PORT", "3000")
+	t.Setenv("GUNNEL_TEST_STATUS", "true")
+	t.Setenv("GUNNEL_TEST_TTL", "1h")
+
+	path := filepath.Join(t.TempDir(), "gunnel.yaml")
+	err := os.WriteFile(path, []byte(`
+backend:
+  demo:
+    port: ${GUNNEL_TEST_PORT}
+    subdomain: demo
+    public_status: ${GUNNEL_TEST_STATUS}
+    ttl: ${GUNNEL_TEST_TTL}
+`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := client.LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+	demo := config.Backend["demo"]
+	if demo.Port != 3000 || !demo.PublicStatus || demo.TTL != time.Hour {
+		t.Errorf("backend = port %d, public_status %v, ttl %s", demo.Port, demo.PublicStatus, demo.TTL)
+	}
+}
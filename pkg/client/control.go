@@ -0,0 +1,202 @@
+package client
+
+import (
+	"maps"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/snakeice/gunnel/pkg/connection"
+	"github.com/snakeice/gunnel/pkg/protocol"
+	"github.com/snakeice/gunnel/pkg/transport"
+)
+
+// maxNotices is how many operator notices the client keeps.
+const maxNotices = 20
+
+// newConnection wraps transp with heartbeats and the client's control message
+// handler, applying the effective heartbeat interval.
+func (c *Client) newConnection(transp transport.Transport) *connection.Connection {
+	conn := connection.New(transp, c.handleControlMessage)
+	if interval := c.heartbeatInterval(); interval > 0 {
+		conn.SetHeartbeatConfig(interval, 0)
+	}
+	go c.receiveDatagrams(transp)
+	return conn
+}
+
+// handleControlMessage handles server initiated messages on the root stream.
+func (c *Client) handleControlMessage(conn *connection.Connection, msg *protocol.Message) error {
+	switch msg.Type { //nolint:exhaustive // other messages are handled by the connection itself
+	case protocol.MessageConfigUpdate:
+		ack, err := c.handleConfigUpdate(msg)
+		if err != nil {
+			return err
+		}
+		conn.Send(ack)
+	case protocol.MessageBroadcast:
+		return c.handleBroadcast(msg)
+	case protocol.MessageTunnelExpiry:
+		return c.handleTunnelExpiry(msg)
+	case protocol.MessageReconnect:
+		return c.handleReconnect(conn, msg)
+	default:
+		c.logger.WithField("type", msg.Type.String()).Warn("Unexpected control message")
+	}
+	return nil
+}
+
+func (c *Client) handleConfigUpdate(msg *protocol.Message) (*protocol.ConfigUpdateAck, error) {
+	update := protocol.ConfigUpdate{}
+	if err := protocol.Unmarshal(&update, msg); err != nil {
+		return nil, err
+	}
+
+	ack := c.applyConfigUpdate(&update)
+	c.logger.WithFields(map[string]any{
+		"version": update.Version,
+		"applied": ack.Applied,
+		"detail":  ack.Message,
+	}).Info("Received configuration update from server")
+
+	return ack, nil
+}
+
+// applyConfigUpdate applies server settings, keeping any value the local
+// config sets explicitly.
+func (c *Client) applyConfigUpdate(update *protocol.ConfigUpdate) *protocol.ConfigUpdateAck {
+	ack := &protocol.ConfigUpdateAck{Version: update.Version, Applied: true}
+
+	if c.config.IgnoreServerConfig {
+		ack.Applied = false
+		ack.Message = "client ignores server configuration"
+		return ack
+	}
+
+	if update.Notice != "" {
+		c.recordNotice(protocol.Broadcast{
+			Level:   logrus.WarnLevel.String(),
+			Message: update.Notice,
+			SentAt:  time.Now(),
+		})
+	}
+
+	var kept []string
+
+	if update.HeartbeatInterval > 0 {
+		if c.config.HeartbeatInterval > 0 {
+			kept = append(kept, "heartbeat_interval")
+		} else {
+			c.setServerHeartbeat(update.HeartbeatInterval)
+		}
+	}
+
+	if update.RateLimit > 0 {
+		if c.config.RateLimit > 0 {
+			kept = append(kept, "rate_limit")
+		} else {
+			c.limiter.SetRate(int(update.RateLimit))
+		}
+	}
+
+	c.mu.Lock()
+	maps.Copy(c.features, update.Features)
+	c.mu.Unlock()
+
+	if len(kept) > 0 {
+		ack.Message = "kept local " + strings.Join(kept, ", ")
+	}
+
+	return ack
+}
+
+func (c *Client) handleBroadcast(msg *protocol.Message) error {
+	notice := protocol.Broadcast{}
+	if err := protocol.Unmarshal(&notice, msg); err != nil {
+		return err
+	}
+
+	c.recordNotice(notice)
+	return nil
+}
+
+func (c *Client) handleTunnelExpiry(msg *protocol.Message) error {
+	expiry := protocol.TunnelExpiry{}
+	if err := protocol.Unmarshal(&expiry, msg); err != nil {
+		return err
+	}
+
+	logger := c.logger.WithField("subdomain", expiry.Subdomain)
+	if expiry.Expired {
+		logger.Warn("Tunnel expired, the server removed it")
+		c.hooks.tunnelDown(expiry.Subdomain)
+		return nil
+	}
+
+	logger.WithField("expires_at", expiry.ExpiresAt.Format(time.RFC3339)).
+		Warnf("Tunnel expires in %s", time.Until(expiry.ExpiresAt).Round(time.Second))
+	return nil
+}
+
+// recordNotice logs an operator notice and keeps it for the local UI.
+func (c *Client) recordNotice(notice protocol.Broadcast) {
+	level, err := logrus.ParseLevel(notice.Level)
+	if err != nil || level < logrus.ErrorLevel {
+		level = logrus.InfoLevel
+	}
+	c.logger.WithField("sent_at", notice.SentAt.Format(time.RFC3339)).
+		Logf(level, "Server notice: %s", notice.Message)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.notices = append(c.notices, notice)
+	if len(c.notices) > maxNotices {
+		c.notices = slices.Delete(c.notices, 0, len(c.notices)-maxNotices)
+	}
+}
+
+// Notices returns the most recent operator notices, oldest first.
+func (c *Client) Notices() []protocol.Broadcast {
+	c.mu.Lock()
+	notices := slices.Clone(c.notices)
+	c.mu.Unlock()
+
+	for _, peer := range c.peers {
+		notices = append(notices, peer.Notices()...)
+	}
+	return notices
+}
+
+// Feature reports whether the server enabled the named feature flag.
+func (c *Client) Feature(name string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.features[name]
+}
+
+func (c *Client) heartbeatInterval() time.Duration {
+	if c.config.HeartbeatInterval > 0 {
+		return c.config.HeartbeatInterval
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.serverHeartbeat
+}
+
+func (c *Client) setServerHeartbeat(interval time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.serverHeartbeat = interval
+	if c.connWrapper != nil {
+		c.connWrapper.SetHeartbeatConfig(interval, 0)
+	}
+	for _, extra := range c.extras {
+		extra.wrapper.SetHeartbeatConfig(interval, 0)
+	}
+}
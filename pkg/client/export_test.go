@@ -0,0 +1,30 @@
+package client
+
+import (
+	"net/http"
+
+	"github.com/sirupsen/logrus"
+)
+
+// CircuitBreaker is the circuit breaker of a backend.
+type CircuitBreaker = circuitBreaker
+
+// NewCircuitBreaker returns the circuit breaker cfg configures.
+func NewCircuitBreaker(cfg *CircuitBreakerConfig) *CircuitBreaker {
+	return newCircuitBreaker(cfg)
+}
+
+// Allow reports whether a request may go to the backend.
+func (cb *circuitBreaker) Allow() bool {
+	return cb.allow()
+}
+
+// Record counts the outcome of a request let through by Allow.
+func (cb *circuitBreaker) Record(ok bool) {
+	cb.record(ok, logrus.NewEntry(logrus.New()))
+}
+
+// LocalOnly guards next the way the local API is guarded.
+func LocalOnly(next http.Handler) http.Handler {
+	return localOnly(next)
+}
@@ -0,0 +1,87 @@
+package client
+
+import (
+	"errors"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/snakeice/gunnel/pkg/transport"
+)
+
+// serverCandidates returns the addresses the client may connect to.
+func (c *Config) serverCandidates() []string {
+	if len(c.ServerAddrs) > 0 {
+		return c.ServerAddrs
+	}
+	return []string{c.ServerAddr}
+}
+
+// connectedServer returns the address of the server the client uses, which
+// additional and replacement connections must reach as well.
+func (c *Client) connectedServer() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.serverAddr
+}
+
+type dialResult struct {
+	addr   string
+	transp transport.Transport
+	rtt    time.Duration
+	err    error
+}
+
+// dialServer connects to the server. With several candidates it dials all of
+// them at once and keeps the first completed handshake, i.e. the server with
+// the lowest latency that is up, which also fails over when one is down.
+func (c *Client) dialServer() (transport.Transport, error) {
+	addrs := c.config.serverCandidates()
+	results := make(chan dialResult, len(addrs))
+	for _, addr := range addrs {
+		go func() {
+			start := time.Now()
+			transp, err := transport.NewWithDialer(addr, c.dialer)
+			results <- dialResult{addr: addr, transp: transp, rtt: time.Since(start), err: err}
+		}()
+	}
+
+	var errs []error
+	for pending := len(addrs); pending > 0; pending-- {
+		r := <-results
+		if r.err != nil {
+			c.logger.WithError(r.err).WithField("candidate", r.addr).Debug("Server unreachable")
+			errs = append(errs, r.err)
+			continue
+		}
+
+		c.mu.Lock()
+		previous := c.serverAddr
+		c.serverAddr = r.addr
+		c.mu.Unlock()
+
+		if len(addrs) > 1 {
+			logger := c.logger.WithFields(logrus.Fields{"selected": r.addr, "handshake": r.rtt})
+			if previous != "" && previous != r.addr {
+				logger.WithField("previous", previous).Warn("Failed over to another server")
+			} else {
+				logger.Info("Selected the server with the lowest latency")
+			}
+		}
+		go c.closeSlowerDials(results, pending-1)
+		return r.transp, nil
+	}
+	return nil, errors.Join(errs...)
+}
+
+// closeSlowerDials closes the connections that completed after the selected
+// one.
+func (c *Client) closeSlowerDials(results <-chan dialResult, pending int) {
+	for range pending {
+		r := <-results
+		if r.err != nil {
+			continue
+		}
+		c.logger.WithFields(logrus.Fields{"candidate": r.addr, "handshake": r.rtt}).Debug("Closing slower server")
+		r.transp.Close()
+	}
+}
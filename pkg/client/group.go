@@ -0,0 +1,174 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"sync"
+
+	"github.com/snakeice/gunnel/pkg/secret"
+)
+
+// ServerConfig is an additional server backends can be assigned to with
+// BackendConfig.Server. The other client settings are shared.
+type ServerConfig struct {
+	ServerAddr string `yaml:"server_addr"`
+	// Token and TokenFile authorize with this server; the top-level token is
+	// never sent to it. When both are empty GUNNEL_TOKEN is used.
+	Token     string `yaml:"token"`
+	TokenFile string `yaml:"token_file"`
+	AuthKey   string `yaml:"auth_key"`
+}
+
+func (s *ServerConfig) validate() error {
+	if s == nil || s.ServerAddr == "" {
+		return errors.New("server_addr is required")
+	}
+	token, err := secret.Resolve(s.Token, s.TokenFile)
+	if err != nil {
+		return fmt.Errorf("token_file: %w", err)
+	}
+	s.Token = token
+	return nil
+}
+
+func (c *Config) validateServers() error {
+	for name, server := range c.Servers {
+		if err := server.validate(); err != nil {
+			return fmt.Errorf("server %s: %w", name, err)
+		}
+	}
+	for name, backend := range c.Backend {
+		if backend.Server == "" {
+			continue
+		}
+		if _, ok := c.Servers[backend.Server]; !ok {
+			return fmt.Errorf("backend %s: unknown server %q", name, backend.Server)
+		}
+	}
+	return nil
+}
+
+// perServer splits the config into one config per server with the backends
+// assigned to it. Only the default server keeps the local API.
+func (c *Config) perServer() []*Config {
+	configs := make([]*Config, 0, len(c.Servers)+1)
+	for _, name := range append([]string{""}, slices.Sorted(maps.Keys(c.Servers))...) {
+		sub := *c
+		sub.Servers = nil
+		sub.Backend = make(map[string]*BackendConfig)
+		for key, backend := range c.Backend {
+			if backend.Server == name {
+				sub.Backend[key] = backend
+			}
+		}
+		if len(sub.Backend) == 0 {
+			continue
+		}
+
+		if server := c.Servers[name]; server != nil {
+			sub.ServerAddr, sub.ServerAddrs = server.ServerAddr, nil
+			sub.Token, sub.TokenFile, sub.AuthKey = server.Token, "", server.AuthKey
+			sub.LocalAPI = ""
+		}
+		configs = append(configs, &sub)
+	}
+	return configs
+}
+
+// Group runs one Client per server of a config, with a shared lifecycle.
+type Group struct {
+	clients []*Client
+
+	// stop and stopped belong to the running Start, for Shutdown.
+	runMu   sync.Mutex
+	stop    context.CancelFunc
+	stopped chan struct{}
+}
+
+// NewGroup creates the clients of every server used by the config's
+// backends.
+func NewGroup(config *Config) (*Group, error) {
+	g := &Group{}
+	for _, sub := range config.perServer() {
+		c, err := New(sub)
+		if err != nil {
+			return nil, fmt.Errorf("server %s: %w", sub.ServerAddr, err)
+		}
+		g.clients = append(g.clients, c)
+	}
+	if len(g.clients) == 0 {
+		return nil, errors.New("at least one backend is required")
+	}
+
+	// The local API of the first client also controls the tunnels of the
+	// others.
+	g.clients[0].peers = g.clients[1:]
+	return g, nil
+}
+
+// OnTunnelUp registers fn with every client. Call it before Start.
+func (g *Group) OnTunnelUp(fn func(subdomain, publicURL string)) {
+	for _, c := range g.clients {
+		c.OnTunnelUp(fn)
+	}
+}
+
+// OnRequest registers fn with every client. Call it before Start.
+func (g *Group) OnRequest(fn func(RequestLog)) {
+	for _, c := range g.clients {
+		c.OnRequest(fn)
+	}
+}
+
+// Start starts every client and returns once all of them stopped, when ctx
+// is done or Shutdown is called, or as soon as one fails, in which case the
+// others are stopped too.
+func (g *Group) Start(ctx context.Context) error {
+	stopped := make(chan struct{})
+	defer close(stopped)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	g.runMu.Lock()
+	g.stop, g.stopped = cancel, stopped
+	g.runMu.Unlock()
+
+	errs := make(chan error, len(g.clients))
+	for _, c := range g.clients {
+		go func() {
+			err := c.Start(ctx)
+			if err != nil {
+				err = fmt.Errorf("server %s: %w", c.config.ServerAddr, err)
+				cancel()
+			}
+			errs <- err
+		}()
+	}
+
+	var err error
+	for range g.clients {
+		err = errors.Join(err, <-errs)
+	}
+	return err
+}
+
+// Shutdown stops the clients and waits for Start to return, or for ctx to be
+// done.
+func (g *Group) Shutdown(ctx context.Context) error {
+	g.runMu.Lock()
+	stop, stopped := g.stop, g.stopped
+	g.runMu.Unlock()
+	if stop == nil {
+		return nil
+	}
+	stop()
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
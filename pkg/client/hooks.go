@@ -0,0 +1,316 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"runtime"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/snakeice/gunnel/pkg/integrations"
+)
+
+// HookEvent names a tunnel event hooks can run on.
+type HookEvent string
+
+const (
+	// HookTunnelUp fires once a tunnel is registered with the server.
+	HookTunnelUp HookEvent = "tunnel_up"
+	// HookTunnelDown fires when a tunnel is lost or expires.
+	HookTunnelDown HookEvent = "tunnel_down"
+	// HookRequestFailures fires when FailureThreshold requests of a tunnel
+	// fail within FailureWindow.
+	HookRequestFailures HookEvent = "request_failures"
+)
+
+const (
+	defaultHookTimeout   = 10 * time.Second
+	defaultFailureWindow = time.Minute
+)
+
+// HookConfig runs a shell command or calls a webhook on tunnel events, e.g.
+// to update the URL registered in a third-party dashboard.
+type HookConfig struct {
+	On []HookEvent `yaml:"on"`
+	// Command runs through the shell with the event in GUNNEL_EVENT,
+	// GUNNEL_SUBDOMAIN, GUNNEL_URL and GUNNEL_FAILURES.
+	Command string `yaml:"command"`
+	// Webhook receives the event as a JSON POST.
+	Webhook string `yaml:"webhook"`
+	// Subdomain limits the hook to one tunnel (empty = every tunnel).
+	Subdomain string `yaml:"subdomain"`
+
+	FailureThreshold int           `yaml:"failure_threshold"`
+	FailureWindow    time.Duration `yaml:"failure_window"` // default 1m
+	Timeout          time.Duration `yaml:"timeout"`        // default 10s
+}
+
+// HookPayload describes an event to a hook.
+type HookPayload struct {
+	Event     HookEvent `json:"event"`
+	Subdomain string    `json:"subdomain"`
+	URL       string    `json:"url,omitempty"`
+	Failures  int       `json:"failures,omitempty"`
+	Time      time.Time `json:"time"`
+}
+
+func (h *HookConfig) validate() error {
+	if h.Command == "" && h.Webhook == "" {
+		return errors.New("hook needs a command or a webhook")
+	}
+	if h.Webhook != "" {
+		u, err := url.Parse(h.Webhook)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errors.New("webhook must be an absolute http(s) URL")
+		}
+	}
+	if len(h.On) == 0 {
+		return errors.New("hook needs at least one event")
+	}
+	for _, event := range h.On {
+		switch event {
+		case HookTunnelUp, HookTunnelDown:
+		case HookRequestFailures:
+			if h.FailureThreshold <= 0 {
+				return errors.New("request_failures hooks need a positive failure_threshold")
+			}
+		default:
+			return fmt.Errorf("unknown hook event %q", event)
+		}
+	}
+	return nil
+}
+
+func (h *HookConfig) handles(event HookEvent, subdomain string) bool {
+	return slices.Contains(h.On, event) && (h.Subdomain == "" || h.Subdomain == subdomain)
+}
+
+// hooks tracks which tunnels are up and the recent request failures, and runs
+// the configured hooks when either changes.
+type hooks struct {
+	list         []*HookConfig
+	integrations []*integrations.Integration
+	logger       *logrus.Entry
+	http         *http.Client
+	// onUp holds the callbacks registered through Client.OnTunnelUp.
+	onUp []func(subdomain, publicURL string)
+
+	mu sync.Mutex
+	// up maps the subdomains currently registered to their public URL.
+	up map[string]string
+	// failures holds the recent failure times per hook and subdomain.
+	failures map[*HookConfig]map[string][]time.Time
+}
+
+func newHooks(list []*HookConfig, integrationList []*integrations.Integration, logger *logrus.Entry) *hooks {
+	return &hooks{
+		list:         list,
+		integrations: integrationList,
+		logger:       logger,
+		http:         &http.Client{},
+		up:           make(map[string]string),
+		failures:     make(map[*HookConfig]map[string][]time.Time),
+	}
+}
+
+// tunnelUp records that subdomain is served at url. Registering it again on
+// another connection does not fire the hooks a second time.
+func (h *hooks) tunnelUp(subdomain, publicURL string) {
+	h.mu.Lock()
+	prev, ok := h.up[subdomain]
+	h.up[subdomain] = publicURL
+	h.mu.Unlock()
+
+	if !ok || prev != publicURL {
+		for _, fn := range h.onUp {
+			fn(subdomain, publicURL)
+		}
+		h.fire(HookPayload{Event: HookTunnelUp, Subdomain: subdomain, URL: publicURL})
+		h.updateIntegrations(subdomain, publicURL)
+	}
+}
+
+// updateIntegrations points the webhooks following subdomain at publicURL.
+func (h *hooks) updateIntegrations(subdomain, publicURL string) {
+	for _, integration := range h.integrations {
+		if !integration.Matches(subdomain) {
+			continue
+		}
+		go func() {
+			logger := h.logger.WithFields(logrus.Fields{
+				"integration": integration.Name(),
+				"subdomain":   subdomain,
+			})
+			if err := integration.Update(context.Background(), publicURL); err != nil {
+				logger.WithError(err).Warn("Failed to update webhook URL")
+				return
+			}
+			logger.WithField("url", publicURL).Info("Updated webhook URL")
+		}()
+	}
+}
+
+// tunnelDown records that subdomain is no longer served.
+func (h *hooks) tunnelDown(subdomain string) {
+	h.mu.Lock()
+	publicURL, ok := h.up[subdomain]
+	delete(h.up, subdomain)
+	h.mu.Unlock()
+
+	if ok {
+		h.fire(HookPayload{Event: HookTunnelDown, Subdomain: subdomain, URL: publicURL})
+	}
+}
+
+// allDown marks every tunnel down, e.g. once the connection is lost.
+func (h *hooks) allDown() {
+	h.mu.Lock()
+	up := h.up
+	h.up = make(map[string]string)
+	h.mu.Unlock()
+
+	for subdomain, publicURL := range up {
+		h.fire(HookPayload{Event: HookTunnelDown, Subdomain: subdomain, URL: publicURL})
+	}
+}
+
+// requestFailed counts a failed request of subdomain and runs the hooks
+// whose threshold it crosses. Their count starts over afterwards.
+func (h *hooks) requestFailed(subdomain string) {
+	now := time.Now()
+
+	h.mu.Lock()
+	publicURL := h.up[subdomain]
+	var crossed []*HookConfig
+	var counts []int
+	for _, hook := range h.list {
+		if !hook.handles(HookRequestFailures, subdomain) {
+			continue
+		}
+		window := hook.FailureWindow
+		if window <= 0 {
+			window = defaultFailureWindow
+		}
+
+		bySubdomain := h.failures[hook]
+		if bySubdomain == nil {
+			bySubdomain = make(map[string][]time.Time)
+			h.failures[hook] = bySubdomain
+		}
+		recent := slices.DeleteFunc(bySubdomain[subdomain], func(t time.Time) bool {
+			return now.Sub(t) > window
+		})
+		recent = append(recent, now)
+
+		if len(recent) >= hook.FailureThreshold {
+			crossed = append(crossed, hook)
+			counts = append(counts, len(recent))
+			recent = nil
+		}
+		bySubdomain[subdomain] = recent
+	}
+	h.mu.Unlock()
+
+	for i, hook := range crossed {
+		h.start(hook, HookPayload{
+			Event:     HookRequestFailures,
+			Subdomain: subdomain,
+			URL:       publicURL,
+			Failures:  counts[i],
+			Time:      now,
+		})
+	}
+}
+
+func (h *hooks) fire(payload HookPayload) {
+	payload.Time = time.Now()
+	for _, hook := range h.list {
+		if hook.handles(payload.Event, payload.Subdomain) {
+			h.start(hook, payload)
+		}
+	}
+}
+
+func (h *hooks) start(hook *HookConfig, payload HookPayload) {
+	go func() {
+		timeout := hook.Timeout
+		if timeout <= 0 {
+			timeout = defaultHookTimeout
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+
+		logger := h.logger.WithFields(logrus.Fields{
+			"event":     payload.Event,
+			"subdomain": payload.Subdomain,
+		})
+		if hook.Command != "" {
+			if err := runHookCommand(ctx, hook.Command, payload); err != nil {
+				logger.WithError(err).Warn("Hook command failed")
+			}
+		}
+		if hook.Webhook != "" {
+			if err := h.postWebhook(ctx, hook.Webhook, payload); err != nil {
+				logger.WithError(err).Warn("Hook webhook failed")
+			}
+		}
+		logger.Debug("Ran tunnel hook")
+	}()
+}
+
+func runHookCommand(ctx context.Context, command string, payload HookPayload) error {
+	shell, flag := "sh", "-c"
+	if runtime.GOOS == "windows" {
+		shell, flag = "cmd", "/C"
+	}
+
+	//nolint:gosec // G204: the command comes from the user's own config
+	cmd := exec.CommandContext(ctx, shell, flag, command)
+	cmd.Env = append(os.Environ(),
+		"GUNNEL_EVENT="+string(payload.Event),
+		"GUNNEL_SUBDOMAIN="+payload.Subdomain,
+		"GUNNEL_URL="+payload.URL,
+		"GUNNEL_FAILURES="+strconv.Itoa(payload.Failures),
+	)
+
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%w: %s", err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+func (h *hooks) postWebhook(ctx context.Context, webhook string, payload HookPayload) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := h.http.Do(req)
+	if err != nil {
+		return err
+	}
+	if err := resp.Body.Close(); err != nil {
+		h.logger.WithError(err).Debug("Failed to close webhook response body")
+	}
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,207 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/snakeice/gunnel/pkg/protocol"
+)
+
+const localAPITimeout = 5 * time.Second
+
+// LocalAPIHeader must be set on requests that change state through the local
+// API. Browsers cannot send it cross-site without a CORS preflight, which the
+// API never answers.
+const LocalAPIHeader = "X-Gunnel-Local-API"
+
+var ErrUnknownTunnel = errors.New("unknown tunnel")
+
+// TunnelStatus describes a configured backend as reported by the local API.
+type TunnelStatus struct {
+	Name      string `json:"name"`
+	Subdomain string `json:"subdomain"`
+	Paused    bool   `json:"paused"`
+}
+
+// serveLocalAPI runs the client control API until ctx is done.
+func (c *Client) serveLocalAPI(ctx context.Context) {
+	server := &http.Server{
+		Addr:              c.config.LocalAPI,
+		Handler:           c.localAPIHandler(),
+		ReadHeaderTimeout: localAPITimeout,
+	}
+
+	go func() {
+		<-ctx.Done()
+		if err := server.Close(); err != nil {
+			c.logger.WithError(err).Debug("Failed to close local API")
+		}
+	}()
+
+	c.logger.WithField("addr", c.config.LocalAPI).Info("Starting local API")
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		c.logger.WithError(err).Error("Local API failed")
+	}
+}
+
+// localAPIHandler routes the local API behind localOnly.
+func (c *Client) localAPIHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/tunnels", c.handleListTunnels)
+	mux.HandleFunc("POST /api/tunnels/{subdomain}/pause", c.handleTunnelState(true))
+	mux.HandleFunc("POST /api/tunnels/{subdomain}/resume", c.handleTunnelState(false))
+	mux.HandleFunc("GET /api/notices", c.handleNotices)
+	return localOnly(mux)
+}
+
+// localOnly keeps web pages away from the local API: a Host that is not
+// loopback means DNS rebinding, an Origin means a browser, and requests
+// changing state must carry LocalAPIHeader, which a cross-site form cannot.
+func localOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isLoopbackHost(r.Host) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		if r.Header.Get("Origin") != "" {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		if r.Method != http.MethodGet && r.Method != http.MethodHead && r.Header.Get(LocalAPIHeader) == "" {
+			http.Error(w, "Missing "+LocalAPIHeader+" header", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// isLoopbackHost reports whether the Host header host names localhost or a
+// loopback address.
+func isLoopbackHost(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.Trim(host, "[]"), ".")
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// Tunnels returns the configured backends and whether each one is paused.
+func (c *Client) Tunnels() []TunnelStatus {
+	backends := c.backends()
+	tunnels := make([]TunnelStatus, 0, len(backends))
+	for name, backend := range backends {
+		tunnels = append(tunnels, TunnelStatus{
+			Name:      name,
+			Subdomain: backend.Subdomain,
+			Paused:    backend.paused.Load(),
+		})
+	}
+	for _, peer := range c.peers {
+		tunnels = append(tunnels, peer.Tunnels()...)
+	}
+	return tunnels
+}
+
+// SetPaused toggles public access to subdomain on the server while keeping
+// the tunnel registered.
+func (c *Client) SetPaused(subdomain string, paused bool) error {
+	backend := c.getBackend(subdomain)
+	if backend == nil {
+		for _, peer := range c.peers {
+			if peer.getBackend(subdomain) != nil {
+				return peer.SetPaused(subdomain, paused)
+			}
+		}
+		return fmt.Errorf("%w: %s", ErrUnknownTunnel, subdomain)
+	}
+
+	backend.paused.Store(paused)
+
+	c.mu.Lock()
+	conn := c.connWrapper
+	c.mu.Unlock()
+
+	if conn != nil {
+		conn.Send(&protocol.TunnelState{Subdomain: subdomain, Paused: paused})
+	}
+
+	c.logger.WithFields(map[string]any{
+		"subdomain": subdomain,
+		"paused":    paused,
+	}).Info("Tunnel state changed")
+
+	return nil
+}
+
+func (c *Client) handleListTunnels(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, c.Tunnels())
+}
+
+func (c *Client) handleNotices(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, c.Notices())
+}
+
+func (c *Client) handleTunnelState(paused bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		subdomain := r.PathValue("subdomain")
+		if err := c.SetPaused(subdomain, paused); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		writeJSON(w, TunnelStatus{Subdomain: subdomain, Paused: paused})
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		http.Error(w, "Failed to encode JSON", http.StatusInternalServerError)
+	}
+}
+
+// RequestPause asks the client whose local API listens on addr to pause or
+// resume subdomain.
+func RequestPause(ctx context.Context, addr, subdomain string, paused bool) error {
+	action := "resume"
+	if paused {
+		action = "pause"
+	}
+
+	endpoint := fmt.Sprintf("http://%s/api/tunnels/%s/%s", addr, url.PathEscape(subdomain), action)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(LocalAPIHeader, "1")
+
+	httpClient := &http.Client{Timeout: localAPITimeout}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach client local API at %s: %w", addr, err)
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			logrus.WithError(err).Debug("Failed to close local API response body")
+		}
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("failed to %s %s: %s", action, subdomain, strings.TrimSpace(string(body)))
+	}
+
+	return nil
+}
@@ -0,0 +1,59 @@
+package client_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/snakeice/gunnel/pkg/client"
+)
+
+func TestLocalAPIRejectsBrowserRequests(t *testing.T) {
+	handler := client.LocalOnly(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		host   string
+		header map[string]string
+		want   int
+	}{
+		{"list", http.MethodGet, "/api/tunnels", "127.0.0.1:4040", nil, http.StatusOK},
+		{"list from localhost", http.MethodGet, "/api/notices", "localhost:4040", nil, http.StatusOK},
+		{"list from IPv6 loopback", http.MethodGet, "/api/tunnels", "[::1]:4040", nil, http.StatusOK},
+		{"rebound host", http.MethodGet, "/api/tunnels", "evil.example:4040", nil, http.StatusForbidden},
+		{"rebound notices", http.MethodGet, "/api/notices", "evil.example", nil, http.StatusForbidden},
+		{
+			"browser origin", http.MethodGet, "/api/tunnels", "127.0.0.1:4040",
+			map[string]string{"Origin": "http://evil.example"}, http.StatusForbidden,
+		},
+		{"pause without header", http.MethodPost, "/api/tunnels/demo/pause", "127.0.0.1:4040", nil, http.StatusForbidden},
+		{
+			"cross-site form", http.MethodPost, "/api/tunnels/demo/resume", "127.0.0.1:4040",
+			map[string]string{"Origin": "http://evil.example", client.LocalAPIHeader: "1"}, http.StatusForbidden,
+		},
+		{
+			"pause", http.MethodPost, "/api/tunnels/demo/pause", "127.0.0.1:4040",
+			map[string]string{client.LocalAPIHeader: "1"}, http.StatusOK,
+		},
+		{
+			"resume", http.MethodPost, "/api/tunnels/demo/resume", "localhost:4040",
+			map[string]string{client.LocalAPIHeader: "1"}, http.StatusOK,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			req.Host = tt.host
+			for k, v := range tt.header {
+				req.Header.Set(k, v)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("%s %s from %s = %d, want %d", tt.method, tt.path, tt.host, rec.Code, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,80 @@
+package client
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+
+	"github.com/sirupsen/logrus"
+	"github.com/snakeice/gunnel/pkg/protocol"
+	"github.com/snakeice/gunnel/pkg/transport"
+)
+
+// maxMalformedSnippet bounds the part of a malformed response sent to the
+// server.
+const maxMalformedSnippet = 512
+
+// malformedResponseError is a backend response that could not be parsed as
+// HTTP, with the start of what the backend sent.
+type malformedResponseError struct {
+	err     error
+	snippet []byte
+}
+
+func (e *malformedResponseError) Error() string {
+	return "malformed response: " + e.err.Error()
+}
+
+func (e *malformedResponseError) Unwrap() error {
+	return e.err
+}
+
+// isMalformed reports whether err, from reading a response, is about its
+// contents rather than the connection it came on.
+func isMalformed(err error) bool {
+	var netErr net.Error
+	return !errors.Is(err, io.EOF) &&
+		!errors.Is(err, io.ErrUnexpectedEOF) &&
+		!errors.Is(err, os.ErrDeadlineExceeded) &&
+		!errors.As(err, &netErr)
+}
+
+// snippetWriter keeps the first maxMalformedSnippet bytes written to it.
+type snippetWriter struct {
+	buf bytes.Buffer
+}
+
+func (w *snippetWriter) Write(p []byte) (int, error) {
+	if room := maxMalformedSnippet - w.buf.Len(); room > 0 {
+		w.buf.Write(p[:min(room, len(p))])
+	}
+	return len(p), nil
+}
+
+// writeMalformed answers on strm with a 502 marked as a malformed backend
+// response, carrying snippet, so the server shows its own error page.
+func writeMalformed(strm transport.Stream, logger *logrus.Entry, snippet []byte) {
+	status := http.StatusBadGateway
+	resp := &http.Response{
+		StatusCode:    status,
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        make(http.Header),
+		ContentLength: int64(len(snippet)),
+		Body:          io.NopCloser(bytes.NewReader(snippet)),
+	}
+	resp.Header.Set("Content-Type", "application/octet-stream")
+	resp.Header.Set(protocol.MalformedResponseHeader, "1")
+	if err := resp.Write(strm); err != nil {
+		logger.WithError(err).Error("Failed to write malformed response report")
+	}
+	if err := strm.Flush(); err != nil {
+		logger.WithError(err).Error("Failed to flush malformed response report")
+	}
+}
@@ -0,0 +1,142 @@
+package client
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/snakeice/gunnel/pkg/clientip"
+	"github.com/snakeice/gunnel/pkg/protocol"
+	"golang.org/x/net/http/httpguts"
+)
+
+// remoteIP returns the IP of the user begin describes, or nil when the server
+// did not send it.
+func remoteIP(begin *protocol.BeginConnection) net.IP {
+	host, _, err := net.SplitHostPort(begin.RemoteAddr)
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// isRemoteAllowed applies AllowedIPs to the user begin describes. Users of
+// unknown address, from servers too old to send it, are refused when the
+// list is set.
+func (b *BackendConfig) isRemoteAllowed(begin *protocol.BeginConnection) bool {
+	if len(b.allowedNets) == 0 {
+		return true
+	}
+	return clientip.Contains(b.allowedNets, remoteIP(begin))
+}
+
+// RequestHeadersConfig controls the headers the client sets on requests to
+// an HTTP backend, e.g. a marker telling tunneled traffic apart.
+type RequestHeadersConfig struct {
+	// Forwarded sets X-Forwarded-For, X-Real-IP, X-Forwarded-Host and
+	// X-Forwarded-Proto from what the server reports (default true).
+	Forwarded *bool `yaml:"forwarded"`
+	// UserAgent replaces the User-Agent the user sent.
+	UserAgent string `yaml:"user_agent"`
+	// Set replaces these headers, e.g. X-Tunneled-By: gunnel; an empty
+	// value removes the header.
+	Set map[string]string `yaml:"set"`
+}
+
+func (c *RequestHeadersConfig) validate() error {
+	if c == nil {
+		return nil
+	}
+	if !httpguts.ValidHeaderFieldValue(c.UserAgent) {
+		return fmt.Errorf("invalid user_agent %q", c.UserAgent)
+	}
+	for name, value := range c.Set {
+		if !httpguts.ValidHeaderFieldName(name) || !httpguts.ValidHeaderFieldValue(value) {
+			return fmt.Errorf("invalid header %q", name)
+		}
+	}
+	return nil
+}
+
+// setRequestHeaders sets the headers of req the backend gets from the
+// client. Go's default User-Agent is never added, so requests without one
+// reach the backend as the user sent them.
+func (b *BackendConfig) setRequestHeaders(req *http.Request, begin *protocol.BeginConnection) {
+	cfg := b.RequestHeaders
+	if cfg == nil || cfg.Forwarded == nil || *cfg.Forwarded {
+		setForwardedHeaders(req, begin)
+	}
+	if cfg != nil {
+		if cfg.UserAgent != "" {
+			req.Header.Set("User-Agent", cfg.UserAgent)
+		}
+		for name, value := range cfg.Set {
+			if value == "" {
+				req.Header.Del(name)
+				continue
+			}
+			req.Header.Set(name, value)
+		}
+	}
+	if _, ok := req.Header["User-Agent"]; !ok {
+		req.Header["User-Agent"] = []string{""}
+	}
+}
+
+// setForwardedHeaders tells the backend who sent req, as a reverse proxy
+// would. Headers the user sent are replaced, so they cannot be spoofed.
+func setForwardedHeaders(req *http.Request, begin *protocol.BeginConnection) {
+	if ip := remoteIP(begin); ip != nil {
+		req.Header.Set("X-Forwarded-For", ip.String())
+		req.Header.Set("X-Real-IP", ip.String())
+	}
+	if begin.Host != "" {
+		req.Header.Set("X-Forwarded-Host", begin.Host)
+	}
+	switch {
+	case begin.TLS != nil:
+		req.Header.Set("X-Forwarded-Proto", "https")
+	case begin.RemoteAddr != "":
+		req.Header.Set("X-Forwarded-Proto", "http")
+	}
+}
+
+// writeProxyHeader sends the PROXY protocol v1 header for the user begin
+// describes to a TCP backend, with dst as the destination when the server
+// did not send its own address.
+func writeProxyHeader(w io.Writer, begin *protocol.BeginConnection, dst net.Addr) error {
+	header := "PROXY UNKNOWN\r\n"
+	src, srcPort, srcErr := splitAddr(begin.RemoteAddr)
+	dstIP, dstPort, dstErr := splitAddr(begin.LocalAddr)
+	if dstErr != nil && dst != nil {
+		dstIP, dstPort, dstErr = splitAddr(dst.String())
+	}
+	if srcErr == nil && dstErr == nil {
+		switch {
+		case src.To4() != nil && dstIP.To4() != nil:
+			header = fmt.Sprintf("PROXY TCP4 %s %s %d %d\r\n", src, dstIP, srcPort, dstPort)
+		case src.To4() == nil && dstIP.To4() == nil:
+			header = fmt.Sprintf("PROXY TCP6 %s %s %d %d\r\n", src, dstIP, srcPort, dstPort)
+		}
+	}
+	_, err := io.WriteString(w, header)
+	return err
+}
+
+func splitAddr(addr string) (net.IP, int, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, 0, err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, 0, fmt.Errorf("not an IP address: %s", host)
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return nil, 0, err
+	}
+	return ip, p, nil
+}
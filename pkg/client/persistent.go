@@ -0,0 +1,99 @@
+package client
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// aliveCheckTimeout bounds the wait when checking whether the backend closed
+// a kept connection.
+const aliveCheckTimeout = time.Millisecond
+
+// backendConn is a connection to a backend with the reader its responses
+// are parsed from.
+type backendConn struct {
+	net.Conn
+	backend *BackendConfig
+	addr    string
+	reader  *bufio.Reader
+	snippet *snippetWriter
+}
+
+func newBackendConn(conn net.Conn, backend *BackendConfig, addr string) *backendConn {
+	snippet := &snippetWriter{}
+	return &backendConn{
+		Conn:    conn,
+		backend: backend,
+		addr:    addr,
+		reader:  bufio.NewReader(io.TeeReader(conn, snippet)),
+		snippet: snippet,
+	}
+}
+
+// alive reports whether the backend kept the connection open since its last
+// response, without waiting on it.
+func (c *backendConn) alive() bool {
+	if c.reader.Buffered() > 0 {
+		// Nothing should follow a response the backend left open.
+		return false
+	}
+	if err := c.SetReadDeadline(time.Now().Add(aliveCheckTimeout)); err != nil {
+		return false
+	}
+	_, err := c.reader.Peek(1)
+	if err := c.SetReadDeadline(time.Time{}); err != nil {
+		return false
+	}
+	return errors.Is(err, os.ErrDeadlineExceeded)
+}
+
+// streamBackend keeps the backend connection of a stream open between its
+// requests, like an HTTP/1.1 keep-alive connection.
+type streamBackend struct {
+	conn   *backendConn
+	logger *logrus.Entry
+}
+
+// take returns the kept connection if it leads to addr of backend and is
+// still open, and nil otherwise. The caller owns the connection returned.
+func (s *streamBackend) take(backend *BackendConfig, addr string) *backendConn {
+	conn := s.conn
+	s.conn = nil
+	if conn == nil {
+		return nil
+	}
+	if conn.backend == backend && conn.addr == addr && conn.alive() {
+		conn.snippet.buf.Reset()
+		return conn
+	}
+	s.closeConn(conn)
+	return nil
+}
+
+// keep holds conn for the next request on the stream.
+func (s *streamBackend) keep(conn *backendConn) {
+	if s.conn != nil {
+		s.closeConn(s.conn)
+	}
+	s.conn = conn
+}
+
+// close closes the kept connection, if any.
+func (s *streamBackend) close() {
+	if s.conn != nil {
+		s.closeConn(s.conn)
+		s.conn = nil
+	}
+}
+
+func (s *streamBackend) closeConn(conn *backendConn) {
+	if err := conn.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+		s.logger.WithError(err).Debug("Failed to close backend connection")
+	}
+}
@@ -0,0 +1,45 @@
+package client
+
+import (
+	"context"
+	"slices"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/snakeice/gunnel/pkg/procport"
+)
+
+// processPollInterval is how often the port of a backend process is
+// detected again, to follow dev servers restarting on another port.
+const processPollInterval = 2 * time.Second
+
+// detectProcessPort updates the port of a backend given by process name. It
+// keeps the current port while the process still listens on it.
+func (b *BackendConfig) detectProcessPort(logger *logrus.Entry) {
+	ports, err := procport.Find(b.Process)
+	if err != nil {
+		logger.WithError(err).Debug("Backend process port not found")
+		return
+	}
+
+	current := b.detectedPort.Load()
+	if slices.Contains(ports, int(current)) {
+		return
+	}
+	//nolint:gosec // G115: ports fit in 16 bits
+	b.detectedPort.Store(uint32(ports[0]))
+	logger.WithFields(logrus.Fields{"process": b.Process, "port": ports[0]}).Info("Detected backend port")
+}
+
+func (b *BackendConfig) watchProcess(ctx context.Context, logger *logrus.Entry) {
+	ticker := time.NewTicker(processPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			b.detectProcessPort(logger)
+		}
+	}
+}
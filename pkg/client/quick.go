@@ -0,0 +1,47 @@
+package client
+
+import (
+	"errors"
+
+	"github.com/snakeice/gunnel/pkg/protocol"
+)
+
+// QuickTunnel describes a single tunnel given on the command line instead of
+// a config file.
+type QuickTunnel struct {
+	ServerAddr string            `json:"server_addr"`
+	Subdomain  string            `json:"subdomain,omitempty"`
+	Protocol   protocol.Protocol `json:"protocol"`
+	// Target is the local service as host:port or port.
+	Target string `json:"target,omitempty"`
+	// Process finds the port of the named local process instead of Target.
+	Process string `json:"process,omitempty"`
+}
+
+// Config returns the client config serving the tunnel.
+func (q *QuickTunnel) Config() (*Config, error) {
+	backend := &BackendConfig{
+		Host:      "localhost",
+		Subdomain: q.Subdomain,
+		Protocol:  q.Protocol,
+		Process:   q.Process,
+	}
+	switch {
+	case q.Target != "":
+		host, port, err := parseTarget(q.Target)
+		if err != nil {
+			return nil, err
+		}
+		backend.Host, backend.Port = host, port
+	case q.Process == "":
+		return nil, errors.New("a port or a process name is required")
+	}
+
+	config := &Config{
+		ServerAddr:     q.ServerAddr,
+		MaxConnections: 1,
+		LocalAPI:       DefaultLocalAPIAddr,
+		Backend:        map[string]*BackendConfig{q.Subdomain: backend},
+	}
+	return config, config.Validate()
+}
@@ -0,0 +1,59 @@
+package client
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimiter is a per-subdomain token bucket refilled at rate tokens per
+// second. A non-positive rate disables limiting.
+type rateLimiter struct {
+	mu      sync.Mutex
+	rate    int
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate int) *rateLimiter {
+	return &rateLimiter{
+		rate:    rate,
+		buckets: make(map[string]*bucket),
+	}
+}
+
+func (r *rateLimiter) SetRate(rate int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.rate = rate
+	r.buckets = make(map[string]*bucket)
+}
+
+func (r *rateLimiter) Allow(subdomain string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.rate <= 0 {
+		return true
+	}
+
+	now := time.Now()
+	b, ok := r.buckets[subdomain]
+	if !ok {
+		b = &bucket{tokens: float64(r.rate), last: now}
+		r.buckets[subdomain] = b
+	}
+
+	b.tokens = min(float64(r.rate), b.tokens+now.Sub(b.last).Seconds()*float64(r.rate))
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
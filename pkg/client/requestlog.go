@@ -0,0 +1,53 @@
+package client
+
+import (
+	"io"
+	"net/http"
+	"time"
+)
+
+// RequestLog describes a request the client answered for a tunnel.
+type RequestLog struct {
+	Subdomain string        `json:"subdomain"`
+	Method    string        `json:"method"`
+	Path      string        `json:"path"`
+	Status    int           `json:"status"`
+	Duration  time.Duration `json:"duration"`
+	// Bytes is the size of the response body.
+	Bytes int64 `json:"bytes"`
+}
+
+// OnRequest calls fn after each request the client answers, whatever the
+// log level. Call it before Start.
+func (c *Client) OnRequest(fn func(RequestLog)) {
+	c.onRequest = append(c.onRequest, fn)
+}
+
+func (c *Client) requestDone(subdomain string, req *http.Request, status int, bytes int64, start time.Time) {
+	if len(c.onRequest) == 0 {
+		return
+	}
+	entry := RequestLog{
+		Subdomain: subdomain,
+		Method:    req.Method,
+		Path:      req.URL.RequestURI(),
+		Status:    status,
+		Duration:  time.Since(start),
+		Bytes:     bytes,
+	}
+	for _, fn := range c.onRequest {
+		fn(entry)
+	}
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.n += int64(n)
+	return n, err
+}
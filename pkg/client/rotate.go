@@ -0,0 +1,142 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/snakeice/gunnel/pkg/connection"
+	"github.com/snakeice/gunnel/pkg/protocol"
+	"github.com/snakeice/gunnel/pkg/transport"
+)
+
+// reconnectRequest is a connection the server asked the client to replace.
+type reconnectRequest struct {
+	conn  *connection.Connection
+	grace time.Duration
+}
+
+func (c *Client) handleReconnect(conn *connection.Connection, msg *protocol.Message) error {
+	req := protocol.Reconnect{}
+	if err := protocol.Unmarshal(&req, msg); err != nil {
+		return err
+	}
+
+	c.logger.WithFields(logrus.Fields{
+		"reason": req.Reason,
+		"grace":  req.Grace,
+	}).Info("Server asked to move to a new connection")
+
+	select {
+	case c.reconnects <- reconnectRequest{conn: conn, grace: req.Grace}:
+	default:
+		c.logger.Warn("Connection rotation already pending, ignoring request")
+	}
+	return nil
+}
+
+// rotationLoop replaces the connections the server asks to rotate.
+func (c *Client) rotationLoop(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case req := <-c.reconnects:
+			c.rotate(ctx, req)
+		}
+	}
+}
+
+// rotate registers every tunnel on a new connection before retiring the one
+// in req, so public traffic keeps flowing. If the new connection cannot be
+// set up, the server closes the old one after the grace period and the
+// reconnect loop takes over.
+func (c *Client) rotate(ctx context.Context, req reconnectRequest) {
+	c.tunnelsMu.Lock()
+	defer c.tunnelsMu.Unlock()
+
+	transp, err := transport.NewWithDialer(c.connectedServer(), c.dialer)
+	if err != nil {
+		c.logger.WithError(err).Warn("Failed to open replacement connection")
+		return
+	}
+
+	for _, backend := range c.backends() {
+		if err := c.registryBackendWithTransport(transp, backend); err != nil {
+			c.logger.WithError(err).Warn("Failed to register backend on replacement connection")
+			transp.Close()
+			return
+		}
+	}
+
+	c.replaceConnection(ctx, req, transp)
+}
+
+// replaceConnection retires the connection in req in favor of transp, on
+// which every tunnel is registered.
+func (c *Client) replaceConnection(ctx context.Context, req reconnectRequest, transp transport.Transport) {
+	fresh := &pooledConn{transp: transp, wrapper: c.newConnection(transp)}
+	fresh.wrapper.Start()
+
+	old, primary := c.swapConnection(req.conn, fresh)
+	if old == nil {
+		c.logger.Debug("Rotated connection already closed, dropping replacement")
+		fresh.close()
+		return
+	}
+
+	c.logger.WithField("grace", req.grace).Info("Moved tunnels to a new connection")
+
+	if !primary {
+		go c.serveExtra(ctx, fresh)
+		// serveExtra of the old connection keeps accepting until it closes.
+		time.AfterFunc(req.grace, old.close)
+		return
+	}
+
+	go c.retire(ctx, old, req.grace)
+}
+
+// swapConnection puts fresh in the place of conn and returns what it
+// replaced, or nil if conn is no longer in use.
+func (c *Client) swapConnection(conn *connection.Connection, fresh *pooledConn) (*pooledConn, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if conn == c.connWrapper && c.conn != nil {
+		old := &pooledConn{transp: c.conn, wrapper: c.connWrapper}
+		c.connWrapper = fresh.wrapper
+		c.setConnLocked(fresh.transp)
+		return old, true
+	}
+
+	i := slices.IndexFunc(c.extras, func(p *pooledConn) bool { return p.wrapper == conn })
+	if i < 0 {
+		return nil, false
+	}
+	old := c.extras[i]
+	c.extras[i] = fresh
+	return old, false
+}
+
+// retire serves the streams still arriving on a rotated primary connection
+// and closes it once grace has elapsed.
+func (c *Client) retire(ctx context.Context, old *pooledConn, grace time.Duration) {
+	timer := time.AfterFunc(grace, old.close)
+	defer timer.Stop()
+
+	for {
+		strm, err := old.transp.AcceptStream(ctx)
+		if err != nil {
+			if !errors.Is(err, context.Canceled) {
+				c.logger.WithError(err).Debug("Rotated connection closed")
+			}
+			old.close()
+			return
+		}
+
+		c.handleAcceptedStream(ctx, strm)
+	}
+}
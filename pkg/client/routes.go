@@ -0,0 +1,91 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/snakeice/gunnel/pkg/protocol"
+)
+
+// RouteConfig sends the requests of a tunnel that match Path and every
+// header in Headers to another local port. Path and header values match
+// exactly, or by prefix when they end with "*".
+type RouteConfig struct {
+	Path    string            `yaml:"path"`
+	Headers map[string]string `yaml:"headers"`
+	// Host defaults to the host of the backend.
+	Host string `yaml:"host"`
+	Port uint32 `yaml:"port"`
+}
+
+func (r *RouteConfig) validate() error {
+	if r == nil {
+		return errors.New("is nil")
+	}
+	if r.Port == 0 {
+		return errors.New("port is required")
+	}
+	if r.Path == "" && len(r.Headers) == 0 {
+		return errors.New("path or headers is required")
+	}
+	return nil
+}
+
+func (r *RouteConfig) matches(req *http.Request) bool {
+	if r.Path != "" && !matchPattern(r.Path, req.URL.Path) {
+		return false
+	}
+	for name, pattern := range r.Headers {
+		values := req.Header.Values(name)
+		if len(values) == 0 || !matchPattern(pattern, values[0]) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchPattern reports whether value equals pattern, or starts with it when
+// pattern ends with "*".
+func matchPattern(pattern, value string) bool {
+	if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+		return strings.HasPrefix(value, prefix)
+	}
+	return value == pattern
+}
+
+// AddrFor returns the local address serving req: the port of the first
+// matching route, the next discovered instance, or the backend's own.
+func (b *BackendConfig) AddrFor(req *http.Request) string {
+	for _, route := range b.Routes {
+		if !route.matches(req) {
+			continue
+		}
+		host := route.Host
+		if host == "" {
+			host = b.Host
+		}
+		return net.JoinHostPort(host, strconv.FormatUint(uint64(route.Port), 10))
+	}
+	if b.pool != nil {
+		if addr, ok := b.pool.Next(); ok {
+			return addr
+		}
+	}
+	return b.getAddr()
+}
+
+func (b *BackendConfig) validateRoutes() error {
+	if len(b.Routes) > 0 && b.Protocol != protocol.HTTP {
+		return errors.New("routes require an http backend")
+	}
+	for i, route := range b.Routes {
+		if err := route.validate(); err != nil {
+			return fmt.Errorf("routes[%d]: %w", i, err)
+		}
+	}
+	return nil
+}
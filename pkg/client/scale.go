@@ -0,0 +1,136 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"time"
+
+	"github.com/snakeice/gunnel/pkg/connection"
+	"github.com/snakeice/gunnel/pkg/transport"
+)
+
+const (
+	scaleCheckInterval = 5 * time.Second
+	// scaleUpThreshold is the stream utilization at which every open
+	// connection is considered saturated.
+	scaleUpThreshold = 0.8
+)
+
+// pooledConn is an additional QUIC connection opened while the primary
+// connection is saturated. The server groups it with the primary through the
+// client ID sent at registration.
+type pooledConn struct {
+	transp  transport.Transport
+	wrapper *connection.Connection
+}
+
+func (p *pooledConn) close() {
+	p.wrapper.Close()
+	p.transp.Close()
+}
+
+func (c *Client) scaleLoop(ctx context.Context) {
+	if c.config.MaxConnections <= 1 {
+		return
+	}
+
+	ticker := time.NewTicker(scaleCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			c.maybeScaleUp(ctx)
+		}
+	}
+}
+
+// saturated reports whether every open connection is above scaleUpThreshold.
+func (c *Client) saturated() bool {
+	c.mu.Lock()
+	transports := []transport.Transport{c.conn}
+	for _, extra := range c.extras {
+		transports = append(transports, extra.transp)
+	}
+	c.mu.Unlock()
+
+	open := 0
+	for _, transp := range transports {
+		if transp == nil || transp.IsClosed() || transp.StreamLimit() == 0 {
+			continue
+		}
+		open++
+		if float64(transp.LenActive())/float64(transp.StreamLimit()) < scaleUpThreshold {
+			return false
+		}
+	}
+
+	return open > 0
+}
+
+func (c *Client) maybeScaleUp(ctx context.Context) {
+	c.mu.Lock()
+	count := 1 + len(c.extras)
+	c.mu.Unlock()
+
+	if count >= c.config.MaxConnections || !c.saturated() {
+		return
+	}
+
+	c.logger.WithField("connections", count+1).Info("Connections saturated, opening another one")
+
+	transp, err := transport.NewWithDialer(c.connectedServer(), c.dialer)
+	if err != nil {
+		c.logger.WithError(err).Warn("Failed to open additional connection")
+		return
+	}
+
+	for _, backend := range c.backends() {
+		if err := c.registryBackendWithTransport(transp, backend); err != nil {
+			c.logger.WithError(err).Warn("Failed to register backend on additional connection")
+			transp.Close()
+			return
+		}
+	}
+
+	extra := &pooledConn{transp: transp, wrapper: c.newConnection(transp)}
+	extra.wrapper.Start()
+
+	c.mu.Lock()
+	c.extras = append(c.extras, extra)
+	c.mu.Unlock()
+
+	go c.serveExtra(ctx, extra)
+}
+
+// serveExtra accepts streams on an additional connection until it closes.
+func (c *Client) serveExtra(ctx context.Context, extra *pooledConn) {
+	for {
+		strm, err := extra.transp.AcceptStream(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				// The client is stopping; shutdown closes the connection once
+				// its streams finished.
+				return
+			}
+			if !errors.Is(err, context.Canceled) {
+				c.logger.WithError(err).Debug("Additional connection closed")
+			}
+			c.dropExtra(extra)
+			return
+		}
+
+		c.handleAcceptedStream(ctx, strm)
+	}
+}
+
+func (c *Client) dropExtra(extra *pooledConn) {
+	extra.close()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.extras = slices.DeleteFunc(c.extras, func(p *pooledConn) bool { return p == extra })
+}
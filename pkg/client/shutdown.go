@@ -0,0 +1,64 @@
+package client
+
+import (
+	"time"
+
+	"github.com/snakeice/gunnel/pkg/protocol"
+	"github.com/snakeice/gunnel/pkg/transport"
+)
+
+const (
+	// defaultShutdownTimeout bounds how long a stopping client waits for the
+	// streams in flight.
+	defaultShutdownTimeout = 10 * time.Second
+	shutdownPollInterval   = 50 * time.Millisecond
+	shutdownReason         = "client shutting down"
+)
+
+// shutdown tells the server on every connection that this client is
+// leaving, so it stops routing requests to it at once, waits for the streams
+// in flight and then closes the connections.
+func (c *Client) shutdown() {
+	c.mu.Lock()
+	conns := make([]transport.Transport, 0, 1+len(c.extras))
+	if c.conn != nil {
+		conns = append(conns, c.conn)
+	}
+	for _, extra := range c.extras {
+		conns = append(conns, extra.transp)
+	}
+	c.mu.Unlock()
+
+	goodbye := &protocol.CloseConnection{Reason: shutdownReason, Code: protocol.CloseClientShutdown}
+	for _, conn := range conns {
+		if conn.IsClosed() {
+			continue
+		}
+		if err := conn.Root().Send(goodbye); err != nil {
+			c.logger.WithError(err).Log(transport.LogLevel(err), "Failed to tell the server the client is leaving")
+		}
+	}
+
+	c.waitStreams()
+	c.disconnect(protocol.CloseClientShutdown, shutdownReason)
+}
+
+// waitStreams waits until no stream handler runs, or for the shutdown
+// timeout.
+func (c *Client) waitStreams() {
+	timeout := c.config.ShutdownTimeout
+	if timeout <= 0 {
+		timeout = defaultShutdownTimeout
+	}
+	deadline := time.Now().Add(timeout)
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for c.activeStreams.Load() > 0 {
+		if time.Now().After(deadline) {
+			c.logger.WithField("streams", c.activeStreams.Load()).Warn("Streams still active at shutdown, closing them")
+			return
+		}
+		<-ticker.C
+	}
+}
@@ -1,53 +1,68 @@
 package client
 
 import (
-	"bufio"
 	"context"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"os"
 	"strings"
 	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/snakeice/gunnel/pkg/protocol"
 	"github.com/snakeice/gunnel/pkg/transport"
+	"github.com/snakeice/gunnel/pkg/tunnel"
 )
 
 const streamIdleTimeout = 30 * time.Second
 
-var ErrStreamIdle = errors.New("stream idle timeout")
+var (
+	ErrStreamIdle     = errors.New("stream idle timeout")
+	ErrBackendTimeout = errors.New("backend timed out")
+	// errBackendUnreachable marks failures to resolve or connect to the
+	// backend, which the server is told of with a StreamError.
+	errBackendUnreachable = errors.New("backend unreachable")
+	// errStreamConsumed ends a stream that carried a raw TCP connection and
+	// cannot take another request.
+	errStreamConsumed = errors.New("stream consumed by a TCP connection")
+)
 
 func (c *Client) handleStream(
 	ctx context.Context,
 	strm transport.Stream,
 	logger *logrus.Entry,
 ) error {
+	kept := &streamBackend{logger: logger}
 	defer func() {
 		if r := recover(); r != nil {
 			logger.WithField("panic", r).Error("Stream handler panicked")
 		}
+		kept.close()
 		logger.Trace("Closing stream")
 		if err := strm.Close(); err != nil {
-			logger.WithError(err).Error("Failed to close stream")
+			logger.WithError(err).Log(transport.LogLevel(err), "Failed to close stream")
 		}
 	}()
 
 	for {
 		select {
 		case <-ctx.Done():
-			logger.Infof("Stopping stream %s handler", strm.ID())
+			logger.Debugf("Stopping stream %s handler", strm.ID())
 			return nil
 		default:
 		}
 
-		if err := c.waitOrReceiveAndHandle(ctx, strm, logger); err != nil {
+		if err := c.waitOrReceiveAndHandle(ctx, strm, kept, logger); err != nil {
 			if errors.Is(err, ErrStreamIdle) {
 				logger.Debug("Stream idle timeout, closing")
 				return nil
 			}
+			if errors.Is(err, errStreamConsumed) {
+				return nil
+			}
 			return err
 		}
 
@@ -58,6 +73,7 @@ func (c *Client) handleStream(
 func (c *Client) waitOrReceiveAndHandle(
 	ctx context.Context,
 	strm transport.Stream,
+	kept *streamBackend,
 	logger *logrus.Entry,
 ) error {
 	idleCtx, cancel := context.WithTimeout(ctx, streamIdleTimeout)
@@ -94,17 +110,18 @@ func (c *Client) waitOrReceiveAndHandle(
 
 	logger.WithField("msg_size", msg.Length).Debug("Received message from server")
 
-	return c.dispatchMessage(strm, logger, msg)
+	return c.dispatchMessage(strm, kept, logger, msg)
 }
 
 func (c *Client) dispatchMessage(
 	strm transport.Stream,
+	kept *streamBackend,
 	logger *logrus.Entry,
 	msg *protocol.Message,
 ) error {
 	switch msg.Type { //nolint:exhaustive // not all message types need handling here
 	case protocol.MessageBeginStream:
-		return c.handleBeginStream(strm, logger, msg)
+		return c.handleBeginStream(strm, kept, logger, msg)
 
 	case protocol.MessageEndStream:
 		logger.Info("Received end stream message")
@@ -112,13 +129,21 @@ func (c *Client) dispatchMessage(
 
 	case protocol.MessageDisconnect:
 		closeMsg := protocol.CloseConnection{}
-		protocol.Unmarshal(&closeMsg, msg)
-		logger.Info("Server closed connection")
+		if err := protocol.Unmarshal(&closeMsg, msg); err != nil {
+			logger.WithError(err).Warn("Malformed disconnect message")
+		}
+		logger.WithFields(logrus.Fields{
+			"reason": closeMsg.Reason,
+			"code":   closeMsg.Code,
+		}).Info("Server closed connection")
 		return nil
 
 	case protocol.MessageError:
 		errMsg := protocol.ErrorMessage{}
-		protocol.Unmarshal(&errMsg, msg)
+		if err := protocol.Unmarshal(&errMsg, msg); err != nil {
+			logger.WithError(err).Warn("Malformed error message")
+			return nil
+		}
 		logger.WithField("error", errMsg.Message).Error("Server sent error")
 		return nil
 
@@ -130,13 +155,42 @@ func (c *Client) dispatchMessage(
 	}
 }
 
+// writeStatus answers the request on strm with a plain text status response.
+func writeStatus(strm transport.Stream, logger *logrus.Entry, status int, reason string) {
+	text := fmt.Sprintf("%d %s", status, http.StatusText(status))
+	body := text + ": " + reason
+	resp := &http.Response{
+		StatusCode:    status,
+		Status:        text,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        make(http.Header),
+		ContentLength: int64(len(body)),
+		Body:          io.NopCloser(strings.NewReader(body)),
+	}
+	resp.Header.Set("Content-Type", "text/plain")
+	if err := resp.Write(strm); err != nil {
+		logger.WithError(err).Errorf("Failed to write %d response", status)
+	}
+	if err := strm.Flush(); err != nil {
+		logger.WithError(err).Errorf("Failed to flush %d response", status)
+	}
+}
+
 func (c *Client) handleBeginStream(
 	strm transport.Stream,
+	kept *streamBackend,
 	baseLogger *logrus.Entry,
 	msg *protocol.Message,
 ) error {
 	beginMsg := protocol.BeginConnection{}
-	protocol.Unmarshal(&beginMsg, msg)
+	if err := protocol.Unmarshal(&beginMsg, msg); err != nil {
+		if sendErr := strm.Send(protocol.NewErrorMessage(err.Error())); sendErr != nil {
+			baseLogger.WithError(sendErr).Debug("Failed to report malformed begin message")
+		}
+		return err
+	}
 
 	baseLogger.Debug("Received begin connection message")
 
@@ -144,16 +198,28 @@ func (c *Client) handleBeginStream(
 	if backend == nil {
 		baseLogger.WithField("subdomain", beginMsg.Subdomain).
 			Error("No backend found for subdomain")
+		sendStreamError(strm, baseLogger, protocol.StreamErrorNoBackend, "no backend for "+beginMsg.Subdomain)
 		return fmt.Errorf("no backend found for subdomain: %s", beginMsg.Subdomain)
 	}
 
-	logger := baseLogger.WithFields(logrus.Fields{
-		"subdomain": beginMsg.Subdomain,
-		"client_id": strm.ID(),
-	})
+	logger := baseLogger.WithField("subdomain", beginMsg.Subdomain)
+	if beginMsg.RemoteAddr != "" {
+		logger = logger.WithField("remote", beginMsg.RemoteAddr)
+	}
+
+	if backend.Protocol == protocol.TCP {
+		if !backend.isRemoteAllowed(&beginMsg) {
+			logger.Warn("Address not allowed, refusing connection")
+			sendStreamError(strm, logger, protocol.StreamErrorRefused, "address not allowed")
+			return errStreamConsumed
+		}
+		return c.proxyTCP(strm, backend, &beginMsg, logger)
+	}
 
 	readyMsg := &protocol.ConnectionReady{
-		Subdomain: beginMsg.Subdomain,
+		Subdomain:  beginMsg.Subdomain,
+		KeepAlive:  beginMsg.KeepAliveInterval > 0,
+		Persistent: !backend.DisableKeepAlive,
 	}
 	if err := strm.Send(readyMsg); err != nil {
 		logger.Error("Failed to send connection ready message")
@@ -164,55 +230,340 @@ func (c *Client) handleBeginStream(
 	if err != nil {
 		return fmt.Errorf("failed to read request from stream: %w", err)
 	}
+	start := time.Now()
+
+	if !backend.isRemoteAllowed(&beginMsg) {
+		logger.WithField("path", req.URL.Path).Warn("Address not allowed")
+		writeStatus(strm, logger, http.StatusForbidden, "address not allowed")
+		c.requestDone(beginMsg.Subdomain, req, http.StatusForbidden, 0, start)
+		return nil
+	}
+	backend.setRequestHeaders(req, &beginMsg)
 
 	if !backend.IsPathAllowed(req.URL.Path) {
 		logger.WithField("path", req.URL.Path).Warn("Path not allowed")
-		forbiddenResp := &http.Response{
-			StatusCode: http.StatusForbidden,
-			Status:     "403 Forbidden",
-			Proto:      "HTTP/1.1",
-			ProtoMajor: 1,
-			ProtoMinor: 1,
-			Header:     make(http.Header),
-			Body:       io.NopCloser(strings.NewReader("403 Forbidden: path not allowed")),
-		}
-		forbiddenResp.Header.Set("Content-Type", "text/plain")
-		if err := forbiddenResp.Write(strm); err != nil {
-			logger.WithError(err).Error("Failed to write forbidden response")
-		}
+		writeStatus(strm, logger, http.StatusForbidden, "path not allowed")
+		c.requestDone(beginMsg.Subdomain, req, http.StatusForbidden, 0, start)
 		return nil
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	if !c.limiter.Allow(beginMsg.Subdomain) {
+		logger.WithField("path", req.URL.Path).Warn("Rate limit exceeded")
+		writeStatus(strm, logger, http.StatusTooManyRequests, "rate limit exceeded")
+		c.requestDone(beginMsg.Subdomain, req, http.StatusTooManyRequests, 0, start)
+		return nil
+	}
+
+	if !backend.breaker.allow() {
+		logger.WithField("path", req.URL.Path).Debug("Circuit open, rejecting request")
+		writeStatus(strm, logger, http.StatusServiceUnavailable, "backend unavailable")
+		c.requestDone(beginMsg.Subdomain, req, http.StatusServiceUnavailable, 0, start)
+		return nil
+	}
+
+	status, written, err := c.forwardToBackend(strm, backend, req, kept, keepAliveOf(&beginMsg), logger)
+	backend.breaker.record(status != 0, logger)
+	if status == 0 && errors.Is(err, ErrBackendTimeout) {
+		logger.WithError(err).Warn("Backend did not answer in time")
+		writeStatus(strm, logger, http.StatusGatewayTimeout, "backend did not answer in time")
+		status, err = http.StatusGatewayTimeout, nil
+	}
+	var malformed *malformedResponseError
+	if status == 0 && errors.As(err, &malformed) {
+		logger.WithError(err).Warn("Backend sent a malformed response")
+		writeMalformed(strm, logger, malformed.snippet)
+		status, err = http.StatusBadGateway, nil
+	}
+	if status == 0 && errors.Is(err, errBackendUnreachable) {
+		// The request body was not read, so the stream cannot be reused.
+		logger.WithError(err).Warn("Failed to connect to backend")
+		sendStreamError(strm, logger, protocol.StreamErrorBackendUnreachable, err.Error())
+		status, err = http.StatusBadGateway, errStreamConsumed
+	}
+	if err != nil || status >= http.StatusInternalServerError {
+		c.hooks.requestFailed(beginMsg.Subdomain)
+	}
+	if err != nil && status == 0 {
+		status = http.StatusBadGateway
+	}
+	c.requestDone(beginMsg.Subdomain, req, status, written, start)
+	if err == nil && status == http.StatusSwitchingProtocols {
+		return errStreamConsumed
+	}
+	return err
+}
+
+// proxyTCP connects to the backend and pipes the raw connection on strm to
+// it. The connection is dialed before answering the server, so an unreachable
+// backend closes the public connection right away.
+func (c *Client) proxyTCP(
+	strm transport.Stream,
+	backend *BackendConfig,
+	beginMsg *protocol.BeginConnection,
+	logger *logrus.Entry,
+) error {
+	const dialTimeout = 10 * time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
 	defer cancel()
-	d := &net.Dialer{Timeout: 10 * time.Second}
-	backendConn, err := d.DialContext(ctx, "tcp", backend.getAddr())
+
+	backendConn, err := c.dialTCP(ctx, backend, beginMsg, dialTimeout)
+	if err == nil {
+		return c.pipeTCP(strm, backendConn, backend, keepAliveOf(beginMsg), logger)
+	}
+
+	logger.WithError(err).Warn("Failed to connect to TCP backend")
+	c.hooks.requestFailed(backend.Subdomain)
+	sendStreamError(strm, logger, protocol.StreamErrorBackendUnreachable, err.Error())
+	return errStreamConsumed
+}
+
+// dialTCP connects to a TCP backend, announcing the user with a PROXY
+// protocol header when the backend asks for it.
+func (c *Client) dialTCP(
+	ctx context.Context,
+	backend *BackendConfig,
+	beginMsg *protocol.BeginConnection,
+	timeout time.Duration,
+) (net.Conn, error) {
+	addr, err := c.resolver.ResolveAddr(ctx, backend.AddrFor(nil))
 	if err != nil {
-		return fmt.Errorf("failed to connect to backend: %w", err)
+		return nil, err
 	}
-	defer func() {
-		if err := backendConn.Close(); err != nil {
-			logger.WithError(err).Warn("Failed to close backend connection")
+	backendConn, err := backend.Socket.DialContext(ctx, addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if backend.ProxyProtocol {
+		if err := writeProxyHeader(backendConn, beginMsg, backendConn.RemoteAddr()); err != nil {
+			_ = backendConn.Close()
+			return nil, err
 		}
-	}()
+	}
+	return backendConn, nil
+}
+
+func (c *Client) pipeTCP(
+	strm transport.Stream,
+	backendConn net.Conn,
+	backend *BackendConfig,
+	keepAlive tunnel.KeepAlive,
+	logger *logrus.Entry,
+) error {
+	ready := &protocol.ConnectionReady{Subdomain: backend.Subdomain, KeepAlive: keepAlive.Enabled()}
+	if err := strm.Send(ready); err != nil {
+		_ = backendConn.Close()
+		return fmt.Errorf("failed to send connection ready message: %w", err)
+	}
 
-	if err := req.Write(backendConn); err != nil {
-		return fmt.Errorf("failed to write request to backend: %w", err)
+	start := time.Now()
+	t := tunnel.NewTunnelWithLocal(backendConn, strm).WithKeepAlive(keepAlive)
+	if err := t.Proxy(); err != nil {
+		logger.WithError(err).Warn("TCP tunnel failed")
+	}
+	if err := backendConn.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+		logger.WithError(err).Debug("Failed to close backend connection")
 	}
+	logger.WithField("duration", time.Since(start)).Debug("TCP connection closed")
+	return errStreamConsumed
+}
 
-	resp, err := http.ReadResponse(bufio.NewReader(backendConn), req)
+// keepAliveOf returns the stream keepalive the server offered in begin,
+// which the client always accepts.
+func keepAliveOf(begin *protocol.BeginConnection) tunnel.KeepAlive {
+	return tunnel.KeepAlive{Interval: begin.KeepAliveInterval, Timeout: begin.KeepAliveTimeout}
+}
+
+// forwardToBackend sends req to the backend and relays its response on strm,
+// returning the backend's status code and the size of the body relayed. The
+// backend connection kept by the stream is reused when it leads to the same
+// backend, and the connection is kept again unless either side asked to
+// close it. The backend timeout covers everything up to the response
+// headers; keepAlive applies if the backend switches protocols.
+func (c *Client) forwardToBackend(
+	strm transport.Stream,
+	backend *BackendConfig,
+	req *http.Request,
+	kept *streamBackend,
+	keepAlive tunnel.KeepAlive,
+	logger *logrus.Entry,
+) (int, int64, error) {
+	deadline := time.Now().Add(backend.Timeout)
+	addr := backend.AddrFor(req)
+
+	backendConn := kept.take(backend, addr)
+	reused := backendConn != nil
+	if !reused {
+		var err error
+		if backendConn, err = c.dialBackend(backend, addr); err != nil {
+			return 0, 0, err
+		}
+	}
+	resp, err := sendToBackend(backendConn, backend, req, deadline)
+	if err != nil && reused && retryable(req, err) {
+		// The backend closed the kept connection as the request went out.
+		logger.WithError(err).Debug("Kept backend connection failed, reconnecting")
+		kept.closeConn(backendConn)
+		if backendConn, err = c.dialBackend(backend, addr); err != nil {
+			return 0, 0, err
+		}
+		resp, err = sendToBackend(backendConn, backend, req, deadline)
+	}
 	if err != nil {
-		return fmt.Errorf("failed to read response from backend: %w", err)
+		kept.closeConn(backendConn)
+		return 0, 0, err
 	}
-	defer func() {
-		if err := resp.Body.Close(); err != nil {
-			logger.WithError(err).Warn("Failed to close response body")
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		defer kept.closeConn(backendConn)
+		upgraded := tunnel.NewBufferedConn(backendConn.Conn, backendConn.reader)
+		return resp.StatusCode, 0, c.pipeUpgrade(strm, resp, upgraded, keepAlive, logger)
+	}
+	reusable := !resp.Close && !req.Close && !backend.DisableKeepAlive
+
+	body := &countingReader{ReadCloser: resp.Body}
+	resp.Body = body
+	if transport.IsStreaming(resp) {
+		resp.Body = &flushingReader{ReadCloser: body, flush: strm.Flush}
+	}
+	if resp.ContentLength == -1 && len(resp.TransferEncoding) == 0 {
+		// A body delimited by the backend closing its connection is chunked
+		// on the stream, which stays open for the next request.
+		resp.Proto, resp.ProtoMajor, resp.ProtoMinor = "HTTP/1.1", 1, 1
+		resp.TransferEncoding = []string{"chunked"}
+		resp.Close = false
+	}
+
+	err = resp.Write(strm)
+	if err != nil {
+		err = fmt.Errorf("failed to write response to stream: %w", err)
+	} else if err = strm.Flush(); err != nil {
+		err = fmt.Errorf("failed to flush response to stream: %w", err)
+	}
+	if cerr := resp.Body.Close(); cerr != nil {
+		logger.WithError(cerr).Warn("Failed to close response body")
+		reusable = false
+	}
+	if err != nil || !reusable {
+		kept.closeConn(backendConn)
+	} else {
+		kept.keep(backendConn)
+	}
+	return resp.StatusCode, body.n, err
+}
+
+// dialBackend connects to addr of backend.
+func (c *Client) dialBackend(backend *BackendConfig, addr string) (*backendConn, error) {
+	dialTimeout := 10 * time.Second
+	if backend.Timeout > 0 {
+		dialTimeout = min(dialTimeout, backend.Timeout)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	defer cancel()
+
+	resolved, err := c.resolver.ResolveAddr(ctx, addr)
+	if err != nil {
+		return nil, backendError("failed to resolve backend", fmt.Errorf("%w: %w", errBackendUnreachable, err))
+	}
+	conn, err := backend.Socket.DialContext(ctx, resolved, dialTimeout)
+	if err != nil {
+		return nil, backendError("failed to connect to backend", fmt.Errorf("%w: %w", errBackendUnreachable, err))
+	}
+	return newBackendConn(conn, backend, addr), nil
+}
+
+// sendToBackend writes req on conn and reads the response headers, within
+// deadline if backend has a timeout.
+func sendToBackend(
+	conn *backendConn,
+	backend *BackendConfig,
+	req *http.Request,
+	deadline time.Time,
+) (*http.Response, error) {
+	if backend.Timeout > 0 {
+		if err := conn.SetDeadline(deadline); err != nil {
+			return nil, fmt.Errorf("failed to set backend deadline: %w", err)
 		}
-	}()
+	}
+
+	if err := req.Write(conn); err != nil {
+		return nil, backendError("failed to write request to backend", err)
+	}
 
+	resp, err := http.ReadResponse(conn.reader, req)
+	if err != nil {
+		if isMalformed(err) {
+			err = &malformedResponseError{err: err, snippet: conn.snippet.buf.Bytes()}
+		}
+		return nil, backendError("failed to read response from backend", err)
+	}
+	if backend.Timeout > 0 {
+		// The body may stream for as long as it needs.
+		if err := conn.SetDeadline(time.Time{}); err != nil {
+			return nil, fmt.Errorf("failed to clear backend deadline: %w", err)
+		}
+	}
+	return resp, nil
+}
+
+// retryable reports whether req, which failed with err on a kept backend
+// connection, may be sent again on a new one: it has no body that was
+// already read, and the backend did not answer at all.
+func retryable(req *http.Request, err error) bool {
+	var malformed *malformedResponseError
+	return req.Body == http.NoBody &&
+		!errors.Is(err, ErrBackendTimeout) &&
+		!errors.As(err, &malformed)
+}
+
+// pipeUpgrade relays the backend's 101 answer on strm and then pipes the
+// upgraded connection, e.g. a WebSocket, both ways until either side closes.
+func (c *Client) pipeUpgrade(
+	strm transport.Stream,
+	resp *http.Response,
+	backendConn net.Conn,
+	keepAlive tunnel.KeepAlive,
+	logger *logrus.Entry,
+) error {
 	if err := resp.Write(strm); err != nil {
 		return fmt.Errorf("failed to write response to stream: %w", err)
 	}
+	if err := strm.Flush(); err != nil {
+		return fmt.Errorf("failed to flush response to stream: %w", err)
+	}
 
+	start := time.Now()
+	if err := tunnel.NewTunnelWithLocal(backendConn, strm).WithKeepAlive(keepAlive).Proxy(); err != nil {
+		logger.WithError(err).Warn("Upgraded connection failed")
+	}
+	logger.WithField("duration", time.Since(start)).Debug("Upgraded connection closed")
 	return nil
 }
+
+// flushingReader flushes what was relayed so far before waiting on the
+// backend for more, so a streamed response reaches the server as it is
+// produced instead of once the stream buffer fills.
+type flushingReader struct {
+	io.ReadCloser
+	flush func() error
+}
+
+func (r *flushingReader) Read(p []byte) (int, error) {
+	if err := r.flush(); err != nil {
+		return 0, err
+	}
+	return r.ReadCloser.Read(p)
+}
+
+// backendError wraps err with msg, marking timeouts with ErrBackendTimeout.
+// sendStreamError tells the server why strm could not be served.
+func sendStreamError(strm transport.Stream, logger *logrus.Entry, code protocol.StreamErrorCode, message string) {
+	if err := strm.Send(&protocol.StreamError{Code: code, Message: message}); err != nil {
+		logger.WithError(err).Debug("Failed to report stream error")
+	}
+}
+
+func backendError(msg string, err error) error {
+	if errors.Is(err, os.ErrDeadlineExceeded) || errors.Is(err, context.DeadlineExceeded) {
+		err = fmt.Errorf("%w: %w", ErrBackendTimeout, err)
+	}
+	return fmt.Errorf("%s: %w", msg, err)
+}
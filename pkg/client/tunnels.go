@@ -0,0 +1,261 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/snakeice/gunnel/pkg/protocol"
+	"github.com/snakeice/gunnel/pkg/version"
+)
+
+const adminAPITimeout = 10 * time.Second
+
+// ErrAdminNotFound is returned when the admin API does not know a resource.
+var ErrAdminNotFound = errors.New("not found")
+
+// Credentials identify a named tunnel. They are issued once by the server's
+// admin API and hold everything needed to connect, so a run only has to say
+// where the traffic goes.
+type Credentials struct {
+	TunnelID   string `json:"tunnel_id"`
+	Name       string `json:"name"`
+	Subdomain  string `json:"subdomain"`
+	Token      string `json:"token"`
+	ServerAddr string `json:"server_addr"`
+}
+
+// NamedTunnel describes a named tunnel as listed by the admin API.
+type NamedTunnel struct {
+	TunnelID  string    `json:"tunnel_id"`
+	Name      string    `json:"name"`
+	Subdomain string    `json:"subdomain"`
+	CreatedAt time.Time `json:"created_at"`
+	Connected bool      `json:"connected"`
+}
+
+// AdminAPI talks to the admin API served on the gunnel subdomain of a server.
+type AdminAPI struct {
+	URL   string
+	Token string
+}
+
+// CreateTunnel creates a named tunnel and returns its credentials. Subdomain
+// defaults to the tunnel name.
+func (a AdminAPI) CreateTunnel(ctx context.Context, name, subdomain string) (*Credentials, error) {
+	body, err := json.Marshal(map[string]string{"name": name, "subdomain": subdomain})
+	if err != nil {
+		return nil, err
+	}
+
+	creds := &Credentials{}
+	if err := a.do(ctx, http.MethodPost, "tunnels", body, creds, http.StatusCreated); err != nil {
+		return nil, err
+	}
+	return creds, nil
+}
+
+// ListTunnels returns the named tunnels known to the server.
+func (a AdminAPI) ListTunnels(ctx context.Context) ([]NamedTunnel, error) {
+	var list []NamedTunnel
+	if err := a.do(ctx, http.MethodGet, "tunnels", nil, &list, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// DeleteTunnel removes a named tunnel, revoking its credentials.
+func (a AdminAPI) DeleteTunnel(ctx context.Context, name string) error {
+	return a.do(ctx, http.MethodDelete, "tunnels/"+url.PathEscape(name), nil, nil, http.StatusNoContent)
+}
+
+// GetTunnel returns the named tunnel name, or ErrAdminNotFound.
+func (a AdminAPI) GetTunnel(ctx context.Context, name string) (*NamedTunnel, error) {
+	tunnel := &NamedTunnel{}
+	if err := a.do(ctx, http.MethodGet, "tunnels/"+url.PathEscape(name), nil, tunnel, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return tunnel, nil
+}
+
+// PutTunnel creates the named tunnel or moves it to subdomain. Credentials
+// only carry a token when the tunnel was created.
+func (a AdminAPI) PutTunnel(ctx context.Context, name, subdomain string) (*Credentials, error) {
+	body, err := json.Marshal(map[string]string{"subdomain": subdomain})
+	if err != nil {
+		return nil, err
+	}
+
+	creds := &Credentials{}
+	path := "tunnels/" + url.PathEscape(name)
+	if err := a.do(ctx, http.MethodPut, path, body, creds, http.StatusOK, http.StatusCreated); err != nil {
+		return nil, err
+	}
+	return creds, nil
+}
+
+// do calls the admin API and decodes the answer into out, failing unless it
+// has one of the wanted status codes.
+func (a AdminAPI) do(ctx context.Context, method, path string, body []byte, out any, want ...int) error {
+	if a.Token == "" {
+		return errors.New("admin token is required")
+	}
+
+	endpoint := strings.TrimSuffix(a.URL, "/") + "/api/admin/" + path
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+a.Token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	httpClient := &http.Client{Timeout: adminAPITimeout}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach admin API at %s: %w", a.URL, err)
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			logrus.WithError(err).Debug("Failed to close admin API response body")
+		}
+	}()
+
+	if !slices.Contains(want, resp.StatusCode) {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		if resp.StatusCode == http.StatusNotFound {
+			return fmt.Errorf("%w: %s", ErrAdminNotFound, strings.TrimSpace(string(msg)))
+		}
+		return fmt.Errorf("admin API answered %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("failed to decode admin API response: %w", err)
+	}
+	return nil
+}
+
+// ServerVersion returns the build information the WebUI at webURL reports,
+// e.g. https://gunnel.example.com.
+func ServerVersion(ctx context.Context, webURL string) (*version.Info, error) {
+	endpoint := strings.TrimSuffix(webURL, "/") + "/api/version"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	httpClient := &http.Client{Timeout: adminAPITimeout}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach %s: %w", webURL, err)
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			logrus.WithError(err).Debug("Failed to close version response body")
+		}
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("server answered %s", resp.Status)
+	}
+	info := &version.Info{}
+	if err := json.NewDecoder(resp.Body).Decode(info); err != nil {
+		return nil, fmt.Errorf("failed to decode server version: %w", err)
+	}
+	return info, nil
+}
+
+// DefaultCredentialsPath returns ~/.gunnel/tunnels/<name>.json.
+func DefaultCredentialsPath(name string) (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".gunnel", "tunnels", name+".json"), nil
+}
+
+// LoadCredentials reads a credentials file written by Save.
+func LoadCredentials(path string) (*Credentials, error) {
+	data, err := os.ReadFile(filepath.Clean(path))
+	if err != nil {
+		return nil, err
+	}
+
+	creds := &Credentials{}
+	if err := json.Unmarshal(data, creds); err != nil {
+		return nil, fmt.Errorf("failed to parse credentials: %w", err)
+	}
+	if creds.Token == "" || creds.Subdomain == "" || creds.ServerAddr == "" {
+		return nil, errors.New("credentials file is missing token, subdomain or server_addr")
+	}
+	return creds, nil
+}
+
+// Save writes the credentials to path, readable by the owner only.
+func (c *Credentials) Save(path string) error {
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0o600)
+}
+
+// Config builds a client configuration that serves the named tunnel from
+// target ("host:port" or a bare port) over proto.
+func (c *Credentials) Config(target string, proto protocol.Protocol) (*Config, error) {
+	host, port, err := parseTarget(target)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &Config{
+		ServerAddr:     c.ServerAddr,
+		Token:          c.Token,
+		MaxConnections: 1,
+		LocalAPI:       DefaultLocalAPIAddr,
+		Backend: map[string]*BackendConfig{
+			c.Name: {
+				Host:      host,
+				Port:      port,
+				Subdomain: c.Subdomain,
+				Protocol:  proto,
+			},
+		},
+	}
+	return config, config.Validate()
+}
+
+// parseTarget splits a local service given as host:port or port.
+func parseTarget(target string) (string, uint32, error) {
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		host, portStr = "localhost", target
+	}
+
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid target %q: %w", target, err)
+	}
+	return host, uint32(port), nil
+}
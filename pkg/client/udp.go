@@ -0,0 +1,175 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/snakeice/gunnel/pkg/protocol"
+	"github.com/snakeice/gunnel/pkg/transport"
+)
+
+const (
+	// udpSessionTimeout closes the backend socket of a UDP session after
+	// this long without traffic.
+	udpSessionTimeout = 2 * time.Minute
+	udpDialTimeout    = 5 * time.Second
+	maxUDPPacket      = 64 << 10
+)
+
+type udpSessionKey struct {
+	subdomain string
+	id        uint32
+}
+
+// udpSession is a public peer of a UDP tunnel: its packets go to the backend
+// through a socket of its own, and what the backend answers on that socket
+// goes back to the peer.
+type udpSession struct {
+	key      udpSessionKey
+	conn     net.Conn
+	lastSeen atomic.Int64
+	// transp is the server connection the peer's packets last came on, where
+	// replies are sent.
+	transp atomic.Pointer[transport.Transport]
+}
+
+// udpSessions holds the UDP sessions of a client.
+type udpSessions struct {
+	mu       sync.Mutex
+	sessions map[udpSessionKey]*udpSession
+}
+
+// receiveDatagrams forwards the UDP packets the server sends on transp to
+// the backends.
+func (c *Client) receiveDatagrams(transp transport.Transport) {
+	ctx := transp.Context()
+	for {
+		data, err := transp.ReceiveDatagram(ctx)
+		if err != nil {
+			if ctx.Err() == nil && !errors.Is(err, context.Canceled) {
+				c.logger.WithError(err).Log(transport.LogLevel(err), "Failed to receive datagram")
+			}
+			return
+		}
+
+		var d protocol.Datagram
+		if err := d.UnmarshalBinary(data); err != nil {
+			c.logger.WithError(err).Debug("Dropping invalid datagram")
+			continue
+		}
+
+		session, err := c.udpSession(transp, &d)
+		if err != nil {
+			c.logger.WithError(err).WithField("subdomain", d.Subdomain).Warn("Failed to connect to UDP backend")
+			c.hooks.requestFailed(d.Subdomain)
+			continue
+		}
+		if session == nil {
+			continue
+		}
+		if _, err := session.conn.Write(d.Payload); err != nil {
+			c.logger.WithError(err).WithField("subdomain", d.Subdomain).Debug("Failed to send UDP packet to backend")
+		}
+	}
+}
+
+// udpSession returns the session d belongs to, connecting a new one to the
+// backend. It returns nil when the subdomain has no UDP backend.
+func (c *Client) udpSession(transp transport.Transport, d *protocol.Datagram) (*udpSession, error) {
+	key := udpSessionKey{subdomain: d.Subdomain, id: d.Session}
+
+	c.udp.mu.Lock()
+	session, ok := c.udp.sessions[key]
+	c.udp.mu.Unlock()
+	if ok {
+		session.lastSeen.Store(time.Now().UnixNano())
+		session.transp.Store(&transp)
+		return session, nil
+	}
+
+	backend := c.getBackend(d.Subdomain)
+	if backend == nil || backend.Protocol != protocol.UDP {
+		return nil, nil //nolint:nilnil // not a UDP tunnel of this client
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), udpDialTimeout)
+	defer cancel()
+	addr, err := c.resolver.ResolveAddr(ctx, backend.AddrFor(nil))
+	if err != nil {
+		return nil, err
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	session = &udpSession{key: key, conn: conn}
+	session.lastSeen.Store(time.Now().UnixNano())
+	session.transp.Store(&transp)
+
+	c.udp.mu.Lock()
+	if existing, ok := c.udp.sessions[key]; ok {
+		c.udp.mu.Unlock()
+		_ = conn.Close()
+		return existing, nil
+	}
+	if c.udp.sessions == nil {
+		c.udp.sessions = make(map[udpSessionKey]*udpSession)
+	}
+	c.udp.sessions[key] = session
+	c.udp.mu.Unlock()
+
+	c.logger.WithFields(logrus.Fields{
+		"subdomain": d.Subdomain,
+		"session":   d.Session,
+		"backend":   addr,
+	}).Debug("Opened UDP session")
+	go c.relayUDPReplies(session)
+	return session, nil
+}
+
+// relayUDPReplies sends what the backend answers on session back to the
+// server until the session goes idle.
+func (c *Client) relayUDPReplies(session *udpSession) {
+	defer func() {
+		c.udp.mu.Lock()
+		delete(c.udp.sessions, session.key)
+		c.udp.mu.Unlock()
+		_ = session.conn.Close()
+	}()
+
+	buf := make([]byte, maxUDPPacket)
+	for {
+		deadline := time.Unix(0, session.lastSeen.Load()).Add(udpSessionTimeout)
+		if err := session.conn.SetReadDeadline(deadline); err != nil {
+			return
+		}
+		n, err := session.conn.Read(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() &&
+				time.Since(time.Unix(0, session.lastSeen.Load())) < udpSessionTimeout {
+				continue
+			}
+			return
+		}
+		session.lastSeen.Store(time.Now().UnixNano())
+
+		d := protocol.Datagram{Subdomain: session.key.subdomain, Session: session.key.id, Payload: buf[:n]}
+		data, err := d.MarshalBinary()
+		if err != nil {
+			continue
+		}
+		transp := *session.transp.Load()
+		if err := transp.SendDatagram(data); err != nil {
+			c.logger.WithError(err).WithField("subdomain", session.key.subdomain).
+				Log(transport.LogLevel(err), "Failed to send UDP reply")
+		}
+	}
+}
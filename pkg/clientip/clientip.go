@@ -0,0 +1,105 @@
+// Package clientip determines the address of the client behind a request,
+// honoring forwarding headers only when they come from a trusted proxy.
+package clientip
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Resolver knows which peers may set X-Forwarded-For and X-Real-IP. A nil
+// or empty Resolver trusts nobody and always returns the peer address.
+type Resolver struct {
+	trusted []*net.IPNet
+}
+
+// NewResolver trusts the given CIDRs; plain IPs are accepted as /32 or /128.
+func NewResolver(cidrs []string) (*Resolver, error) {
+	trusted, err := ParseNets(cidrs)
+	if err != nil {
+		return nil, fmt.Errorf("invalid trusted proxy: %w", err)
+	}
+	return &Resolver{trusted: trusted}, nil
+}
+
+// ParseNets parses a list of CIDRs; plain IPs are accepted as /32 or /128.
+func ParseNets(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("%q: %w", cidr, err)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// Contains reports whether ip is in one of nets.
+func Contains(nets []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Resolver) isTrusted(ip net.IP) bool {
+	if r == nil {
+		return false
+	}
+	return Contains(r.trusted, ip)
+}
+
+// ClientIP returns the client address of req. When the peer is trusted, the
+// X-Forwarded-For chain is walked from the right, skipping trusted hops, so
+// entries a client prepends itself are ignored; X-Real-IP is used when there
+// is no chain.
+func (r *Resolver) ClientIP(req *http.Request) string {
+	peer := PeerIP(req)
+	if !r.isTrusted(net.ParseIP(peer)) {
+		return peer
+	}
+
+	if xff := req.Header.Values("X-Forwarded-For"); len(xff) > 0 {
+		hops := strings.Split(strings.Join(xff, ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			ip := net.ParseIP(strings.TrimSpace(hops[i]))
+			if ip == nil {
+				break
+			}
+			if !r.isTrusted(ip) || i == 0 {
+				return ip.String()
+			}
+		}
+		return peer
+	}
+
+	if ip := net.ParseIP(strings.TrimSpace(req.Header.Get("X-Real-IP"))); ip != nil {
+		return ip.String()
+	}
+	return peer
+}
+
+// PeerIP returns the address of the connection req arrived on.
+func PeerIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
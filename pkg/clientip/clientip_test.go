@@ -0,0 +1,77 @@
+package clientip_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/snakeice/gunnel/pkg/clientip"
+)
+
+func TestClientIP(t *testing.T) {
+	resolver, err := clientip.NewResolver([]string{"10.0.0.0/8", "192.0.2.1"})
+	if err != nil {
+		t.Fatalf("NewResolver failed: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		resolver *clientip.Resolver
+		remote   string
+		headers  map[string]string
+		want     string
+	}{
+		{
+			name:     "untrusted peer ignores headers",
+			resolver: resolver,
+			remote:   "203.0.113.5:1234",
+			headers:  map[string]string{"X-Forwarded-For": "198.51.100.1"},
+			want:     "203.0.113.5",
+		},
+		{
+			name:    "nil resolver trusts nobody",
+			remote:  "10.0.0.2:1234",
+			headers: map[string]string{"X-Forwarded-For": "198.51.100.1"},
+			want:    "10.0.0.2",
+		},
+		{
+			name:     "trusted peer",
+			resolver: resolver,
+			remote:   "10.0.0.2:1234",
+			headers:  map[string]string{"X-Forwarded-For": "198.51.100.1"},
+			want:     "198.51.100.1",
+		},
+		{
+			name:     "spoofed entries left of the client are skipped",
+			resolver: resolver,
+			remote:   "192.0.2.1:1234",
+			headers:  map[string]string{"X-Forwarded-For": "1.2.3.4, 198.51.100.1, 10.1.1.1"},
+			want:     "198.51.100.1",
+		},
+		{
+			name:     "x-real-ip",
+			resolver: resolver,
+			remote:   "10.0.0.2:1234",
+			headers:  map[string]string{"X-Real-IP": "198.51.100.9"},
+			want:     "198.51.100.9",
+		},
+		{
+			name:     "garbage falls back to the peer",
+			resolver: resolver,
+			remote:   "10.0.0.2:1234",
+			headers:  map[string]string{"X-Forwarded-For": "not-an-ip"},
+			want:     "10.0.0.2",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &http.Request{RemoteAddr: tt.remote, Header: http.Header{}}
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+			if got := tt.resolver.ClientIP(req); got != tt.want {
+				t.Errorf("ClientIP() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
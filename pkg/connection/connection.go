@@ -2,12 +2,15 @@ package connection
 
 import (
 	"context"
+	"fmt"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/sirupsen/logrus"
+	"github.com/snakeice/gunnel/pkg/logging"
 	"github.com/snakeice/gunnel/pkg/protocol"
+	gunnelquic "github.com/snakeice/gunnel/pkg/quic"
 	"github.com/snakeice/gunnel/pkg/transport"
 )
 
@@ -17,10 +20,15 @@ type Connection struct {
 	transp transport.Transport
 	stream transport.Stream
 
-	connected        bool
+	// connected and lastActive, as unix nanoseconds, are written by the
+	// send and receive loops without taking mu.
+	connected        atomic.Bool
 	heartbeatEmitter bool
-	lastActive       time.Time
+	lastActive       atomic.Int64
 	mu               sync.RWMutex
+	// draining marks a connection being rotated out; it only gets new
+	// streams when no other connection of its client can take them.
+	draining atomic.Bool
 
 	sendChannel    chan protocol.Parsable
 	receiveChannel chan *protocol.Message
@@ -28,7 +36,9 @@ type Connection struct {
 
 	heartbeatInterval time.Duration
 	heartbeatTimeout  time.Duration
-	heartbeatStats    struct {
+	// heartbeatReset wakes observeConnection when the intervals change.
+	heartbeatReset chan struct{}
+	heartbeatStats struct {
 		last     time.Time
 		sent     int64
 		received int64
@@ -47,8 +57,6 @@ func New(transp transport.Transport, messageHandler ...MessageHandlerFunc) *Conn
 		sendChannel:    make(chan protocol.Parsable, 100),
 		receiveChannel: make(chan *protocol.Message, 100),
 		transp:         transp,
-		connected:      true,
-		lastActive:     time.Now(),
 		closed:         make(chan struct{}),
 		heartbeatStats: struct {
 			last                   time.Time
@@ -57,12 +65,16 @@ func New(transp transport.Transport, messageHandler ...MessageHandlerFunc) *Conn
 		heartbeatEmitter:  !transp.ImServer(),
 		heartbeatInterval: 30 * time.Second,
 		heartbeatTimeout:  90 * time.Second,
-		logger: logrus.WithFields(
+		heartbeatReset:    make(chan struct{}, 1),
+		logger: logging.Control.WithFields(
 			logrus.Fields{
-				"addr": transp.Addr(),
+				"addr":          transp.Addr(),
+				"connection_id": transp.ID(),
 			},
 		),
 	}
+	conn.connected.Store(true)
+	conn.markActive()
 	if len(messageHandler) > 0 {
 		conn.handler = messageHandler[0]
 	}
@@ -80,7 +92,7 @@ func (c *Connection) Start() {
 	go c.watchSend(ctx)
 	go c.observeConnection(ctx)
 
-	logrus.Infof("Client connected: %s", c.transp.Addr())
+	logging.Control.Infof("Client connected: %s", c.transp.Addr())
 }
 
 func (c *Connection) watchReceive(ctx context.Context) {
@@ -89,22 +101,22 @@ func (c *Connection) watchReceive(ctx context.Context) {
 		case <-c.closed:
 			return
 		case <-ctx.Done():
-			c.logger.Info("Client context done, shutting down")
+			c.logger.Debug("Client context done, shutting down")
 			return
 		default:
 		}
 
 		if c.stream == nil {
 			c.logger.Error("Stream is nil, cannot receive")
-			c.connected = false
+			c.connected.Store(false)
 			c.transp.Close()
 			return
 		}
 
 		msg, err := c.stream.Receive()
 		if err != nil {
-			c.logger.WithError(err).Errorf("Failed to read message from %s", c.transp.Addr())
-			c.connected = false
+			c.logger.WithError(err).Logf(transport.LogLevel(err), "Failed to read message from %s", c.transp.Addr())
+			c.connected.Store(false)
 			c.markActive()
 			c.transp.Close()
 			return
@@ -126,20 +138,20 @@ func (c *Connection) watchSend(ctx context.Context) {
 		case <-c.closed:
 			return
 		case <-ctx.Done():
-			c.logger.Info("Client context done, shutting down")
+			c.logger.Debug("Client context done, shutting down")
 			return
 		case msg := <-c.sendChannel:
 			if c.stream == nil {
 				c.logger.Error("Stream is nil, cannot send")
-				c.connected = false
+				c.connected.Store(false)
 				c.transp.Close()
 				return
 			}
 
 			if err := c.stream.Send(msg); err != nil {
-				c.logger.WithError(err).Errorf("Failed to send message to %s", c.transp.Addr())
-				c.connected = false
-				c.lastActive = time.Now()
+				c.logger.WithError(err).Logf(transport.LogLevel(err), "Failed to send message to %s", c.transp.Addr())
+				c.connected.Store(false)
+				c.markActive()
 				c.transp.Close()
 				return
 			}
@@ -148,10 +160,14 @@ func (c *Connection) watchSend(ctx context.Context) {
 }
 
 func (c *Connection) observeConnection(ctx context.Context) {
-	ticker := time.NewTicker(c.heartbeatInterval)
+	c.mu.RLock()
+	interval, timeout := c.heartbeatInterval, c.heartbeatTimeout
+	c.mu.RUnlock()
+
+	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
-	timeoutTicker := time.NewTicker(c.heartbeatTimeout)
+	timeoutTicker := time.NewTicker(timeout)
 	defer timeoutTicker.Stop()
 
 	for {
@@ -179,8 +195,16 @@ func (c *Connection) observeConnection(ctx context.Context) {
 					"No heartbeat received for %v, connection may be stale",
 					timeSinceLastHeartbeat,
 				)
-				c.disconnect()
+				c.CloseWithReason(
+					protocol.CloseHeartbeatTimeout,
+					fmt.Sprintf("no heartbeat for %v", timeSinceLastHeartbeat.Round(time.Second)),
+				)
 			}
+		case <-c.heartbeatReset:
+			c.mu.RLock()
+			ticker.Reset(c.heartbeatInterval)
+			timeoutTicker.Reset(c.heartbeatTimeout)
+			c.mu.RUnlock()
 		case msg := <-c.receiveChannel:
 			c.handleMessage(msg)
 		}
@@ -191,7 +215,7 @@ func (c *Connection) Send(msg protocol.Parsable) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	if !c.connected {
+	if !c.connected.Load() {
 		c.logger.Warn("Client is not connected, cannot send message")
 		return
 	}
@@ -203,29 +227,71 @@ func (c *Connection) Acquire() (transport.Stream, error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	c.lastActive = time.Now()
+	c.markActive()
 
 	return c.transp.Acquire()
 }
 
+// SendDatagram sends p as a QUIC datagram on the connection.
+func (c *Connection) SendDatagram(p []byte) error {
+	return c.transp.SendDatagram(p)
+}
+
 func (c *Connection) Release(stream transport.Stream) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	c.lastActive = time.Now()
+	c.markActive()
 	if err := c.transp.Release(stream); err != nil {
 		c.logger.WithError(err).Errorf("Failed to release stream %s", stream.ID())
 	}
 	c.logger.Debugf("Released stream %s", stream.ID())
 }
 
+// Owns reports whether stream belongs to this connection's transport.
+func (c *Connection) Owns(stream transport.Stream) bool {
+	return c.transp.Has(stream)
+}
+
 func (c *Connection) disconnect() {
+	c.CloseWithReason(protocol.CloseNone, "")
+}
+
+// CloseWithReason closes the connection, telling the peer why with code and
+// reason; CloseReason then returns them.
+func (c *Connection) CloseWithReason(code protocol.CloseCode, reason string) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	c.connected = false
-	c.lastActive = time.Now()
-	c.transp.Close()
-	logrus.Debugf("Client %s disconnected", c.transp.Addr())
+	c.connected.Store(false)
+	c.markActive()
+	c.transp.CloseWithReason(code, reason)
+	logging.Control.WithField("reason", reason).Debugf("Client %s disconnected", c.transp.Addr())
+}
+
+// CloseReason describes why the connection closed, by either side, or is
+// empty while it is open or when it closed without a reason.
+func (c *Connection) CloseReason() string {
+	return transport.CloseReason(c.transp)
+}
+
+// SetDraining marks the connection as being replaced by a newer one.
+func (c *Connection) SetDraining() {
+	c.draining.Store(true)
+}
+
+// Draining reports whether the connection is being replaced.
+func (c *Connection) Draining() bool {
+	return c.draining.Load()
+}
+
+// ID returns the ID of the underlying transport connection.
+func (c *Connection) ID() string {
+	return c.transp.ID()
+}
+
+// Handshake returns the QUIC version and TLS parameters of the connection.
+func (c *Connection) Handshake() gunnelquic.Handshake {
+	return c.transp.Handshake()
 }
 
 // GetConnCount returns the client's connections.
@@ -235,24 +301,24 @@ func (c *Connection) GetConnCount(subdomain ...string) int {
 
 // GetLastActive returns the client's last active timestamp.
 func (c *Connection) GetLastActive() time.Time {
-	return c.lastActive
+	return time.Unix(0, c.lastActive.Load())
 }
 
 func (c *Connection) Connected() bool {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 
-	if !c.connected {
+	if !c.connected.Load() {
 		return false
 	}
 
 	if c.transp != nil && c.transp.IsClosed() {
-		c.connected = false
+		c.connected.Store(false)
 		return false
 	}
 
 	if c.stream == nil {
-		c.connected = false
+		c.connected.Store(false)
 		return false
 	}
 
@@ -269,6 +335,15 @@ func (c *Connection) GetHeartbeatStats() map[string]any {
 	}
 }
 
+// LastHeartbeat returns when the peer last sent a heartbeat, or when the
+// connection was opened, and whether any heartbeat was received yet.
+func (c *Connection) LastHeartbeat() (time.Time, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.heartbeatStats.last, atomic.LoadInt64(&c.heartbeatStats.received) > 0
+}
+
 // SetHeartbeatConfig updates the heartbeat configuration.
 func (c *Connection) SetHeartbeatConfig(interval, timeout time.Duration) {
 	c.mu.Lock()
@@ -280,13 +355,23 @@ func (c *Connection) SetHeartbeatConfig(interval, timeout time.Duration) {
 	if timeout > 0 {
 		c.heartbeatTimeout = timeout
 	}
+
+	select {
+	case c.heartbeatReset <- struct{}{}:
+	default:
+	}
 }
 
-func (c *Connection) markActive() {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+// HeartbeatInterval returns the interval between heartbeats.
+func (c *Connection) HeartbeatInterval() time.Duration {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.heartbeatInterval
+}
 
-	c.lastActive = time.Now()
+func (c *Connection) markActive() {
+	c.lastActive.Store(time.Now().UnixNano())
 }
 
 func (c *Connection) Close() {
@@ -304,7 +389,7 @@ func (c *Connection) Close() {
 	}
 
 	close(c.closed)
-	c.connected = false
+	c.connected.Store(false)
 
 	if c.transp != nil {
 		c.transp.Close()
@@ -1,9 +1,11 @@
 package connection
 
 import (
+	"errors"
 	"sync/atomic"
 	"time"
 
+	"github.com/sirupsen/logrus"
 	"github.com/snakeice/gunnel/pkg/protocol"
 )
 
@@ -12,7 +14,9 @@ func (c *Connection) handleMessage(msg *protocol.Message) {
 
 	switch msg.Type { //nolint:exhaustive // this switch not exhaustive
 	case protocol.MessageHeartbeat:
+		c.mu.Lock()
 		c.heartbeatStats.last = time.Now()
+		c.mu.Unlock()
 		atomic.AddInt64(&c.heartbeatStats.received, 1)
 
 		if !c.heartbeatEmitter {
@@ -20,25 +24,58 @@ func (c *Connection) handleMessage(msg *protocol.Message) {
 		}
 		atomic.AddInt64(&c.heartbeatStats.sent, 1)
 	case protocol.MessageDisconnect:
-		c.logger.Infof("Client %s disconnected", c.transp.Addr())
+		closeMsg := protocol.CloseConnection{}
+		if err := protocol.Unmarshal(&closeMsg, msg); err != nil {
+			// The peer leaves either way; only its reason is lost.
+			c.logger.WithError(err).Warn("Malformed disconnect message")
+		}
+		c.logger.WithFields(logrus.Fields{
+			"reason": closeMsg.Reason,
+			"code":   closeMsg.Code,
+		}).Infof("Client %s disconnected", c.transp.Addr())
+		if closeMsg.Code == protocol.CloseClientShutdown && c.handler != nil {
+			// A stopping client finishes its streams in flight and closes the
+			// connection itself; the handler only stops routing to it.
+			if err := c.handler(c, msg); err != nil {
+				c.logger.WithError(err).Error("Handler error for disconnect message")
+			}
+			return
+		}
 		c.disconnect()
 		return
 	case protocol.MessageError:
 		errMsg := protocol.ErrorMessage{}
-		errMsg.Unmarshal(msg.Payload)
+		if err := protocol.Unmarshal(&errMsg, msg); err != nil {
+			c.logger.WithError(err).Warn("Malformed error message")
+			return
+		}
 		if errMsg.Message == "" {
 			c.logger.Errorf("Error message from %s: %s", c.transp.Addr(), errMsg.Message)
 			c.disconnect()
 			return
 		}
+		c.logger.WithField("error", errMsg.Message).Warnf("Error message from %s", c.transp.Addr())
 
 	default:
 		if c.handler != nil {
 			if err := c.handler(c, msg); err != nil {
 				c.logger.WithError(err).Errorf("Handler error for message type: %s", msg.Type)
+				c.rejectMalformed(err)
 			}
 		} else {
 			c.logger.Warnf("No handler registered for message type: %s", msg.Type)
 		}
 	}
 }
+
+// rejectMalformed answers a message the handler could not decode with an
+// ErrorMessage, so the peer learns why nothing else came back.
+func (c *Connection) rejectMalformed(err error) {
+	if !errors.Is(err, protocol.ErrInvalidMessage) {
+		return
+	}
+	select {
+	case c.sendChannel <- protocol.NewErrorMessage(err.Error()):
+	default:
+	}
+}
@@ -0,0 +1,152 @@
+package daemon
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/snakeice/gunnel/pkg/client"
+)
+
+const dialTimeout = time.Second
+
+// Running reports whether a daemon answers on socket.
+func Running(socket string) bool {
+	conn, err := net.DialTimeout("unix", socket, dialTimeout)
+	if err != nil {
+		return false
+	}
+	if err := conn.Close(); err != nil {
+		logrus.WithError(err).Debug("Failed to close daemon connection")
+	}
+	return true
+}
+
+// httpClient talks HTTP to the daemon on socket.
+func httpClient(socket string) *http.Client {
+	dialer := &net.Dialer{Timeout: dialTimeout}
+	return &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "unix", socket)
+		},
+	}}
+}
+
+// Attachment runs a tunnel in the daemon instead of in this process. It has
+// the methods of client.Client the quick commands use.
+type Attachment struct {
+	socket    string
+	tunnel    client.QuickTunnel
+	onUp      []func(subdomain, publicURL string)
+	onRequest []func(client.RequestLog)
+}
+
+// Attach returns an attachment running tunnel in the daemon on socket.
+func Attach(socket string, tunnel client.QuickTunnel) *Attachment {
+	return &Attachment{socket: socket, tunnel: tunnel}
+}
+
+// OnTunnelUp calls fn with the public URL of the tunnel once it is
+// registered, and again when the URL changes. Call it before Start.
+func (a *Attachment) OnTunnelUp(fn func(subdomain, publicURL string)) {
+	a.onUp = append(a.onUp, fn)
+}
+
+// OnRequest calls fn after each request the tunnel answers. Call it before
+// Start.
+func (a *Attachment) OnRequest(fn func(client.RequestLog)) {
+	a.onRequest = append(a.onRequest, fn)
+}
+
+// Start asks the daemon to open the tunnel and keeps it open until ctx is
+// done; the daemon closes the tunnel once this process goes away.
+func (a *Attachment) Start(ctx context.Context) error {
+	body, err := json.Marshal(a.tunnel)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://daemon/sessions", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := httpClient(a.socket).Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		return fmt.Errorf("failed to reach daemon at %s: %w", a.socket, err)
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			logrus.WithError(err).Debug("Failed to close daemon response body")
+		}
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("daemon refused the tunnel: %s", strings.TrimSpace(string(msg)))
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		var event Event
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			return fmt.Errorf("invalid event from daemon: %w", err)
+		}
+		switch event.Type {
+		case EventUp:
+			for _, fn := range a.onUp {
+				fn(event.Subdomain, event.URL)
+			}
+		case EventRequest:
+			if event.Request != nil {
+				for _, fn := range a.onRequest {
+					fn(*event.Request)
+				}
+			}
+		case EventError:
+			return errors.New(event.Error)
+		}
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("lost the daemon: %w", err)
+	}
+	return errors.New("the daemon closed the tunnel")
+}
+
+// Sessions lists the tunnels attached to the daemon on socket.
+func Sessions(ctx context.Context, socket string) ([]Session, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://daemon/sessions", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := httpClient(socket).Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach daemon at %s: %w", socket, err)
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			logrus.WithError(err).Debug("Failed to close daemon response body")
+		}
+	}()
+
+	var list []Session
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, fmt.Errorf("failed to decode daemon sessions: %w", err)
+	}
+	return list, nil
+}
@@ -0,0 +1,376 @@
+// Package daemon runs the tunnels of "gunnel http" and "gunnel tcp" in one
+// background agent. Each command attaches to it over a local socket, and the
+// tunnels to the same server share that server's connection.
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/snakeice/gunnel/pkg/client"
+	"github.com/snakeice/gunnel/pkg/logging"
+)
+
+const (
+	readHeaderTimeout = 5 * time.Second
+	// eventBuffer is how many events a slow attached command may lag behind
+	// before request events are dropped.
+	eventBuffer = 64
+)
+
+// Event types streamed to an attached command.
+const (
+	EventUp      = "up"
+	EventRequest = "request"
+	EventError   = "error"
+)
+
+// Event is one line of the stream answering an attach request.
+type Event struct {
+	Type      string             `json:"type"`
+	Subdomain string             `json:"subdomain,omitempty"`
+	URL       string             `json:"url,omitempty"`
+	Request   *client.RequestLog `json:"request,omitempty"`
+	Error     string             `json:"error,omitempty"`
+}
+
+// Session describes an attached tunnel as listed by the daemon.
+type Session struct {
+	ID        string `json:"id"`
+	Server    string `json:"server"`
+	Subdomain string `json:"subdomain"`
+	Target    string `json:"target"`
+	URL       string `json:"url"`
+}
+
+// DefaultSocketPath returns ~/.gunnel/daemon.sock.
+func DefaultSocketPath() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".gunnel", "daemon.sock"), nil
+}
+
+// Daemon serves attach requests on a unix socket, running one client per
+// server for the tunnels attached to it.
+type Daemon struct {
+	socket string
+
+	mu      sync.Mutex
+	servers map[string]*server
+	nextID  int
+}
+
+// server is the client of one server address and the sessions using it.
+type server struct {
+	addr     string
+	client   *client.Client
+	ctx      context.Context //nolint:containedctx // canceled when the client stops
+	stop     context.CancelFunc
+	done     chan struct{}
+	sessions map[string]*session
+	urls     map[string]string
+}
+
+type session struct {
+	id      string
+	tunnel  client.QuickTunnel
+	backend *client.BackendConfig
+	events  chan Event
+}
+
+// New returns a daemon listening on socket once Run is called.
+func New(socket string) *Daemon {
+	return &Daemon{socket: socket, servers: make(map[string]*server)}
+}
+
+// Run serves attach requests until ctx is done, then closes every tunnel.
+func (d *Daemon) Run(ctx context.Context) error {
+	if err := os.MkdirAll(filepath.Dir(d.socket), 0o700); err != nil {
+		return err
+	}
+	if Running(d.socket) {
+		return fmt.Errorf("a daemon already listens on %s", d.socket)
+	}
+	// A socket left behind by a daemon that did not stop cleanly.
+	if err := os.Remove(d.socket); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	ln, err := (&net.ListenConfig{}).Listen(ctx, "unix", d.socket)
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(d.socket, 0o600); err != nil {
+		ln.Close()
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /sessions", d.handleAttach)
+	mux.HandleFunc("GET /sessions", d.handleListSessions)
+	httpServer := &http.Server{Handler: mux, ReadHeaderTimeout: readHeaderTimeout}
+
+	go func() {
+		<-ctx.Done()
+		// Closing the connections ends every session, which closes its tunnel.
+		if err := httpServer.Close(); err != nil {
+			logging.Control.WithError(err).Debug("Failed to close daemon socket")
+		}
+	}()
+
+	logging.Control.WithField("socket", d.socket).Info("Daemon started")
+	err = httpServer.Serve(ln)
+	d.stopAll()
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// stopAll stops the client of every server and waits for them.
+func (d *Daemon) stopAll() {
+	d.mu.Lock()
+	servers := make([]*server, 0, len(d.servers))
+	for _, srv := range d.servers {
+		servers = append(servers, srv)
+	}
+	d.mu.Unlock()
+
+	for _, srv := range servers {
+		srv.stop()
+		<-srv.done
+	}
+}
+
+func (d *Daemon) handleAttach(w http.ResponseWriter, r *http.Request) {
+	var tunnel client.QuickTunnel
+	if err := json.NewDecoder(r.Body).Decode(&tunnel); err != nil {
+		http.Error(w, "invalid tunnel: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	config, err := tunnel.Config()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	backend := config.Backend[tunnel.Subdomain]
+
+	srv, sess, err := d.attach(config, tunnel, backend)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer d.detach(srv, sess)
+
+	// AddBackend gives up when the client stops before registering.
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	stopAdd := context.AfterFunc(srv.ctx, cancel)
+	defer stopAdd()
+
+	if err := srv.client.AddBackend(ctx, sess.id, backend); err != nil {
+		status := http.StatusBadGateway
+		if errors.Is(err, client.ErrBackendExists) {
+			status = http.StatusConflict
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	d.stream(r.Context(), w, srv, sess)
+}
+
+// stream writes the events of sess until the attached command goes away or
+// the client stops.
+func (d *Daemon) stream(ctx context.Context, w http.ResponseWriter, srv *server, sess *session) {
+	enc := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+	write := func(event Event) bool {
+		if err := enc.Encode(event); err != nil {
+			return false
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return true
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-srv.done:
+			write(Event{Type: EventError, Error: "the connection to " + srv.addr + " stopped"})
+			return
+		case event := <-sess.events:
+			if !write(event) {
+				return
+			}
+		}
+	}
+}
+
+// attach records a session for tunnel on the client of its server, starting
+// that client if no other session uses it.
+func (d *Daemon) attach(
+	config *client.Config,
+	tunnel client.QuickTunnel,
+	backend *client.BackendConfig,
+) (*server, *session, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	srv, ok := d.servers[tunnel.ServerAddr]
+	if !ok {
+		var err error
+		if srv, err = d.startServer(config); err != nil {
+			return nil, nil, err
+		}
+		d.servers[tunnel.ServerAddr] = srv
+	}
+
+	d.nextID++
+	sess := &session{
+		id:      "session-" + strconv.Itoa(d.nextID),
+		tunnel:  tunnel,
+		backend: backend,
+		events:  make(chan Event, eventBuffer),
+	}
+	srv.sessions[sess.id] = sess
+	logging.Control.WithFields(logrus.Fields{
+		"session": sess.id,
+		"server":  srv.addr,
+		"target":  tunnel.Target,
+	}).Info("Command attached")
+	return srv, sess, nil
+}
+
+// startServer starts a client for the server of config, without any tunnel
+// yet. d.mu must be held.
+func (d *Daemon) startServer(config *client.Config) (*server, error) {
+	// The tunnels are added by the sessions, and the daemon socket replaces
+	// the local API.
+	config.Backend = make(map[string]*client.BackendConfig)
+	config.LocalAPI = ""
+
+	c, err := client.New(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", config.ServerAddr, err)
+	}
+
+	ctx, stop := context.WithCancel(context.Background())
+	srv := &server{
+		addr:     config.ServerAddr,
+		client:   c,
+		ctx:      ctx,
+		stop:     stop,
+		done:     make(chan struct{}),
+		sessions: make(map[string]*session),
+		urls:     make(map[string]string),
+	}
+	c.OnTunnelUp(func(subdomain, publicURL string) {
+		d.publish(srv, subdomain, Event{Type: EventUp, Subdomain: subdomain, URL: publicURL})
+	})
+	c.OnRequest(func(entry client.RequestLog) {
+		d.publish(srv, entry.Subdomain, Event{Type: EventRequest, Subdomain: entry.Subdomain, Request: &entry})
+	})
+
+	go func() {
+		defer close(srv.done)
+		defer stop()
+		if err := c.Start(ctx); err != nil {
+			logging.Control.WithError(err).WithField("server", srv.addr).Error("Client stopped")
+		}
+		d.mu.Lock()
+		if d.servers[srv.addr] == srv {
+			delete(d.servers, srv.addr)
+		}
+		d.mu.Unlock()
+	}()
+	return srv, nil
+}
+
+// publish hands event to the sessions of srv serving subdomain. Up events
+// are never dropped; request events are when the session lags behind.
+func (d *Daemon) publish(srv *server, subdomain string, event Event) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if event.Type == EventUp {
+		srv.urls[subdomain] = event.URL
+	}
+	for _, sess := range srv.sessions {
+		if sess.backend.Subdomain != subdomain {
+			continue
+		}
+		select {
+		case sess.events <- event:
+		default:
+			logging.Control.WithField("session", sess.id).Debug("Attached command lags behind, dropping event")
+		}
+	}
+}
+
+// detach closes the tunnel of sess, and stops the client of srv once no
+// session uses it.
+func (d *Daemon) detach(srv *server, sess *session) {
+	if err := srv.client.RemoveBackend(sess.id); err != nil && !errors.Is(err, client.ErrUnknownTunnel) {
+		logging.Control.WithError(err).WithField("session", sess.id).Warn("Failed to close tunnel")
+	}
+
+	d.mu.Lock()
+	delete(srv.sessions, sess.id)
+	delete(srv.urls, sess.backend.Subdomain)
+	idle := len(srv.sessions) == 0
+	if idle && d.servers[srv.addr] == srv {
+		delete(d.servers, srv.addr)
+	}
+	d.mu.Unlock()
+
+	logging.Control.WithField("session", sess.id).Info("Command detached")
+	if idle {
+		srv.stop()
+	}
+}
+
+func (d *Daemon) handleListSessions(w http.ResponseWriter, _ *http.Request) {
+	d.mu.Lock()
+	list := make([]Session, 0)
+	for _, srv := range d.servers {
+		for _, sess := range srv.sessions {
+			target := sess.tunnel.Target
+			if target == "" {
+				target = "process " + sess.tunnel.Process
+			}
+			list = append(list, Session{
+				ID:        sess.id,
+				Server:    srv.addr,
+				Subdomain: sess.backend.Subdomain,
+				Target:    target,
+				URL:       srv.urls[sess.backend.Subdomain],
+			})
+		}
+	}
+	d.mu.Unlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(list); err != nil {
+		http.Error(w, "Failed to encode JSON", http.StatusInternalServerError)
+	}
+}
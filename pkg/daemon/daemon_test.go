@@ -0,0 +1,238 @@
+package daemon_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/snakeice/gunnel/pkg/client"
+	"github.com/snakeice/gunnel/pkg/daemon"
+	"github.com/snakeice/gunnel/pkg/protocol"
+	"github.com/snakeice/gunnel/pkg/server"
+)
+
+func freePort(t *testing.T, network string) int {
+	t.Helper()
+	if network == "udp" {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		return conn.LocalAddr().(*net.UDPAddr).Port
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+// harness is a server and a daemon attached commands reach it through.
+type harness struct {
+	socket  string
+	quic    string
+	httpURL string
+}
+
+func startHarness(t *testing.T) *harness {
+	t.Helper()
+	t.Setenv("GUNNEL_INSECURE", "true")
+
+	httpPort, quicPort, mgmtPort := freePort(t, "tcp"), freePort(t, "udp"), freePort(t, "tcp")
+	config := server.DefaultConfig()
+	config.Domain = "localhost"
+	config.BindAddress = "127.0.0.1"
+	config.ServerPort = httpPort
+	config.QuicPort = quicPort
+	config.ManagementPort = mgmtPort
+	config.AllowRoot = true
+
+	ctx, cancel := context.WithCancel(context.Background())
+	srvDone := make(chan error, 1)
+	go func() { srvDone <- server.NewServer(config).Start(ctx) }()
+
+	// Unix socket paths are short, so keep the socket out of t.TempDir.
+	dir, err := os.MkdirTemp("", "gunnel-daemon")
+	if err != nil {
+		cancel()
+		t.Fatal(err)
+	}
+	h := &harness{
+		socket:  filepath.Join(dir, "daemon.sock"),
+		quic:    fmt.Sprintf("127.0.0.1:%d", quicPort),
+		httpURL: fmt.Sprintf("http://127.0.0.1:%d", httpPort),
+	}
+	daemonDone := make(chan error, 1)
+	go func() { daemonDone <- daemon.New(h.socket).Run(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		<-daemonDone
+		<-srvDone
+		os.RemoveAll(dir)
+	})
+
+	eventually(t, "server and daemon ready", func() bool {
+		resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/readyz", mgmtPort))
+		if err != nil {
+			return false
+		}
+		resp.Body.Close()
+		return resp.StatusCode == http.StatusOK && daemon.Running(h.socket)
+	})
+	return h
+}
+
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// attach runs a tunnel for subdomain in the daemon, answering every request
+// with the subdomain, until the returned func detaches it.
+func (h *harness) attach(t *testing.T, subdomain string) func() {
+	t.Helper()
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		io.WriteString(w, subdomain)
+	}))
+	t.Cleanup(backend.Close)
+
+	att := daemon.Attach(h.socket, client.QuickTunnel{
+		ServerAddr: h.quic,
+		Subdomain:  subdomain,
+		Protocol:   protocol.HTTP,
+		Target:     strconv.Itoa(backend.Listener.Addr().(*net.TCPAddr).Port),
+	})
+	up := make(chan string, 1)
+	att.OnTunnelUp(func(_, publicURL string) {
+		select {
+		case up <- publicURL:
+		default:
+		}
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- att.Start(ctx) }()
+	detach := sync.OnceFunc(func() {
+		cancel()
+		<-done
+	})
+	t.Cleanup(detach)
+
+	select {
+	case <-up:
+	case err := <-done:
+		t.Fatalf("attaching %s failed: %v", subdomain, err)
+	case <-time.After(10 * time.Second):
+		t.Fatalf("tunnel %s did not come up", subdomain)
+	}
+	return detach
+}
+
+// get returns the status and body the server answers for subdomain.
+func (h *harness) get(t *testing.T, subdomain string) (int, string) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, h.httpURL+"/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = subdomain + ".localhost"
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(body)
+}
+
+func (h *harness) expectServed(t *testing.T, subdomain string) {
+	t.Helper()
+	if status, body := h.get(t, subdomain); status != http.StatusOK || body != subdomain {
+		t.Fatalf("%s answered %d %q, want 200 %q", subdomain, status, body, subdomain)
+	}
+}
+
+func sessionSubdomains(t *testing.T, socket string) []string {
+	t.Helper()
+	list, err := daemon.Sessions(context.Background(), socket)
+	if err != nil {
+		t.Fatalf("Sessions: %v", err)
+	}
+	subdomains := make([]string, 0, len(list))
+	for _, sess := range list {
+		subdomains = append(subdomains, sess.Subdomain)
+	}
+	return subdomains
+}
+
+func TestSecondAttachKeepsFirstTunnelServed(t *testing.T) {
+	h := startHarness(t)
+
+	h.attach(t, "first")
+	h.expectServed(t, "first")
+
+	h.attach(t, "second")
+	h.expectServed(t, "second")
+	h.expectServed(t, "first")
+
+	if got := sessionSubdomains(t, h.socket); len(got) != 2 || got[0] != "first" || got[1] != "second" {
+		t.Errorf("sessions = %v, want [first second]", got)
+	}
+}
+
+func TestDetachClosesOnlyItsTunnel(t *testing.T) {
+	h := startHarness(t)
+
+	h.attach(t, "first")
+	detach := h.attach(t, "second")
+	detach()
+
+	eventually(t, "the detached session to be dropped", func() bool {
+		got := sessionSubdomains(t, h.socket)
+		return len(got) == 1 && got[0] == "first"
+	})
+	eventually(t, "the detached tunnel to close", func() bool {
+		status, _ := h.get(t, "second")
+		return status != http.StatusOK
+	})
+	h.expectServed(t, "first")
+}
+
+func TestAttachRefusesTakenSubdomain(t *testing.T) {
+	h := startHarness(t)
+	h.attach(t, "first")
+
+	att := daemon.Attach(h.socket, client.QuickTunnel{
+		ServerAddr: h.quic,
+		Subdomain:  "first",
+		Protocol:   protocol.HTTP,
+		Target:     "1",
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := att.Start(ctx); err == nil {
+		t.Fatal("second attach of the same subdomain succeeded")
+	}
+	h.expectServed(t, "first")
+	if got := sessionSubdomains(t, h.socket); len(got) != 1 {
+		t.Errorf("sessions = %v, want only the first", got)
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd)
+
+package daemon
+
+import "syscall"
+
+func detachAttr() *syscall.SysProcAttr {
+	return nil
+}
@@ -0,0 +1,11 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd
+
+package daemon
+
+import "syscall"
+
+// detachAttr starts the daemon in its own session, so it survives the
+// terminal it was started from.
+func detachAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Setsid: true}
+}
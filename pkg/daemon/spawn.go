@@ -0,0 +1,59 @@
+package daemon
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+)
+
+const (
+	startTimeout      = 5 * time.Second
+	startPollInterval = 50 * time.Millisecond
+)
+
+// Spawn starts this executable with args in the background, its output
+// appended to logFile, and waits until it answers on socket.
+func Spawn(args []string, socket, logFile string) (*os.Process, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(logFile), 0o700); err != nil {
+		return nil, err
+	}
+	logs, err := os.OpenFile(filepath.Clean(logFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	defer logs.Close()
+
+	cmd := exec.Command(exe, args...) //nolint:gosec // re-executes this binary
+	cmd.Stdout, cmd.Stderr = logs, logs
+	cmd.SysProcAttr = detachAttr()
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+
+	deadline := time.After(startTimeout)
+	ticker := time.NewTicker(startPollInterval)
+	defer ticker.Stop()
+	for !Running(socket) {
+		select {
+		case err := <-exited:
+			if err == nil {
+				err = errors.New("exited")
+			}
+			return nil, fmt.Errorf("daemon failed to start, see %s: %w", logFile, err)
+		case <-deadline:
+			return nil, fmt.Errorf("daemon did not start within %s, see %s", startTimeout, logFile)
+		case <-ticker.C:
+		}
+	}
+	return cmd.Process, nil
+}
@@ -0,0 +1,242 @@
+// Package discovery finds backend instances through DNS SRV records or the
+// Consul catalog and balances requests across them.
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultRefresh       = 30 * time.Second
+	defaultConsulAddress = "http://127.0.0.1:8500"
+	// consulWait bounds Consul blocking queries, which return as soon as the
+	// service changes.
+	consulWait = 5 * time.Minute
+)
+
+// Config names the service backing a tunnel. Exactly one of SRV and Consul
+// is set.
+type Config struct {
+	// SRV is a DNS SRV name such as _http._tcp.api.service.consul.
+	SRV    string        `yaml:"srv"`
+	Consul *ConsulConfig `yaml:"consul"`
+	// Refresh is how often SRV records are looked up again (default 30s).
+	// Consul changes are watched and picked up right away.
+	Refresh time.Duration `yaml:"refresh"`
+}
+
+// ConsulConfig selects the healthy instances of a Consul service.
+type ConsulConfig struct {
+	// Address of the Consul HTTP API (default http://127.0.0.1:8500).
+	Address string `yaml:"address"`
+	Service string `yaml:"service"`
+	Tag     string `yaml:"tag"`
+	Token   string `yaml:"token"`
+}
+
+// Validate reports incomplete or ambiguous settings.
+func (c *Config) Validate() error {
+	switch {
+	case c == nil:
+		return nil
+	case (c.SRV == "") == (c.Consul == nil):
+		return errors.New("exactly one of srv and consul is required")
+	case c.Refresh < 0:
+		return errors.New("refresh must not be negative")
+	case c.Consul != nil && c.Consul.Service == "":
+		return errors.New("consul.service is required")
+	case c.Consul != nil && c.Consul.Address != "":
+		if u, err := url.Parse(c.Consul.Address); err != nil || u.Host == "" {
+			return errors.New("consul.address must be an absolute URL")
+		}
+	}
+	return nil
+}
+
+// Pool holds the instances of a service and hands them out in turn.
+type Pool struct {
+	cfg    *Config
+	http   *http.Client
+	logger *logrus.Entry
+
+	mu    sync.RWMutex
+	addrs []string
+	next  atomic.Uint64
+	// index is the Consul index of the last answer, for blocking queries.
+	index uint64
+}
+
+// NewPool returns an empty pool for cfg; Run fills it.
+func NewPool(cfg *Config, logger *logrus.Entry) *Pool {
+	return &Pool{cfg: cfg, http: &http.Client{Timeout: consulWait + 30*time.Second}, logger: logger}
+}
+
+// Next returns the next instance address, or false when none is known.
+func (p *Pool) Next() (string, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if len(p.addrs) == 0 {
+		return "", false
+	}
+	n := p.next.Add(1) - 1
+	return p.addrs[n%uint64(len(p.addrs))], true
+}
+
+// Refresh looks the instances up once.
+func (p *Pool) Refresh(ctx context.Context) error {
+	var (
+		addrs []string
+		err   error
+	)
+	if p.cfg.Consul != nil {
+		addrs, err = p.lookupConsul(ctx)
+	} else {
+		addrs, err = lookupSRV(ctx, p.cfg.SRV)
+	}
+	if err != nil {
+		return err
+	}
+
+	slices.Sort(addrs)
+	p.mu.Lock()
+	changed := !slices.Equal(p.addrs, addrs)
+	p.addrs = addrs
+	p.mu.Unlock()
+
+	if changed {
+		p.logger.WithField("instances", addrs).Info("Backend instances changed")
+	}
+	return nil
+}
+
+// Run keeps the pool up to date until ctx is done.
+func (p *Pool) Run(ctx context.Context) {
+	refresh := p.cfg.Refresh
+	if refresh == 0 {
+		refresh = defaultRefresh
+	}
+
+	for {
+		err := p.Refresh(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			p.logger.WithError(err).Warn("Failed to discover backend instances")
+		}
+
+		// A Consul blocking query already waited for a change; only pause
+		// after errors so a failing agent is not hammered.
+		if p.cfg.Consul != nil && err == nil {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(refresh):
+		}
+	}
+}
+
+func lookupSRV(ctx context.Context, name string) ([]string, error) {
+	_, records, err := net.DefaultResolver.LookupSRV(ctx, "", "", name)
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]string, 0, len(records))
+	for _, r := range records {
+		addrs = append(addrs, net.JoinHostPort(trimDot(r.Target), strconv.Itoa(int(r.Port))))
+	}
+	return addrs, nil
+}
+
+func trimDot(s string) string {
+	if len(s) > 1 && s[len(s)-1] == '.' {
+		return s[:len(s)-1]
+	}
+	return s
+}
+
+type consulEntry struct {
+	Node struct {
+		Address string `json:"Address"`
+	} `json:"Node"`
+	Service struct {
+		Address string `json:"Address"`
+		Port    int    `json:"Port"`
+	} `json:"Service"`
+}
+
+func (p *Pool) lookupConsul(ctx context.Context) ([]string, error) {
+	c := p.cfg.Consul
+	base := c.Address
+	if base == "" {
+		base = defaultConsulAddress
+	}
+
+	query := url.Values{"passing": {"true"}}
+	if c.Tag != "" {
+		query.Set("tag", c.Tag)
+	}
+	if p.index > 0 {
+		query.Set("index", strconv.FormatUint(p.index, 10))
+		query.Set("wait", consulWait.String())
+	}
+	endpoint := base + "/v1/health/service/" + url.PathEscape(c.Service) + "?" + query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	if c.Token != "" {
+		req.Header.Set("X-Consul-Token", c.Token)
+	}
+
+	resp, err := p.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			p.logger.WithError(err).Debug("Failed to close Consul response")
+		}
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("consul answered %s", resp.Status)
+	}
+
+	var entries []consulEntry
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, fmt.Errorf("decode consul response: %w", err)
+	}
+	// An index going backwards means Consul reset it; start over.
+	if index, err := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64); err == nil {
+		if index < p.index {
+			index = 0
+		}
+		p.index = index
+	}
+
+	addrs := make([]string, 0, len(entries))
+	for _, e := range entries {
+		host := e.Service.Address
+		if host == "" {
+			host = e.Node.Address
+		}
+		addrs = append(addrs, net.JoinHostPort(host, strconv.Itoa(e.Service.Port)))
+	}
+	return addrs, nil
+}
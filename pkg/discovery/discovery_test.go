@@ -0,0 +1,63 @@
+package discovery_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/snakeice/gunnel/pkg/discovery"
+)
+
+func TestConsulPoolBalancesHealthyInstances(t *testing.T) {
+	consul := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/health/service/api" || r.URL.Query().Get("passing") != "true" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("X-Consul-Index", "7")
+		_, _ = w.Write([]byte(`[
+			{"Node": {"Address": "10.0.0.1"}, "Service": {"Address": "", "Port": 8080}},
+			{"Node": {"Address": "10.0.0.9"}, "Service": {"Address": "10.0.0.2", "Port": 8080}}
+		]`))
+	}))
+	t.Cleanup(consul.Close)
+
+	pool := discovery.NewPool(
+		&discovery.Config{Consul: &discovery.ConsulConfig{Address: consul.URL, Service: "api"}},
+		logrus.NewEntry(logrus.New()),
+	)
+	if _, ok := pool.Next(); ok {
+		t.Fatal("Next() returned an instance before the first refresh")
+	}
+	if err := pool.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh() error = %v", err)
+	}
+
+	seen := map[string]int{}
+	for range 4 {
+		addr, _ := pool.Next()
+		seen[addr]++
+	}
+	if seen["10.0.0.1:8080"] != 2 || seen["10.0.0.2:8080"] != 2 {
+		t.Errorf("Next() spread = %v, want both instances twice", seen)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	invalid := []*discovery.Config{
+		{},
+		{SRV: "_http._tcp.api", Consul: &discovery.ConsulConfig{Service: "api"}},
+		{Consul: &discovery.ConsulConfig{}},
+		{Consul: &discovery.ConsulConfig{Service: "api", Address: "consul:8500"}},
+	}
+	for _, cfg := range invalid {
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("Validate(%+v) accepted an invalid config", cfg)
+		}
+	}
+	if err := (&discovery.Config{SRV: "_http._tcp.api.service.consul"}).Validate(); err != nil {
+		t.Errorf("Validate() error = %v", err)
+	}
+}
@@ -0,0 +1,82 @@
+package gunnel
+
+import (
+	"context"
+
+	"github.com/snakeice/gunnel/pkg/client"
+)
+
+// ClientOption configures a Client.
+type ClientOption func(*client.Config)
+
+// WithClientConfig starts from config; the options after it change it in
+// place.
+func WithClientConfig(config *client.Config) ClientOption {
+	return func(c *client.Config) { *c = *config }
+}
+
+// WithServerAddr sets the QUIC address of the server. It is required.
+func WithServerAddr(addr string) ClientOption {
+	return func(c *client.Config) { c.ServerAddr = addr }
+}
+
+// WithClientToken sets the token presented to the server.
+func WithClientToken(token string) ClientOption {
+	return func(c *client.Config) { c.Token = token }
+}
+
+// WithBackend exposes backend under name. At least one is required.
+func WithBackend(name string, backend *client.BackendConfig) ClientOption {
+	return func(c *client.Config) {
+		if c.Backend == nil {
+			c.Backend = make(map[string]*client.BackendConfig)
+		}
+		c.Backend[name] = backend
+	}
+}
+
+// WithLocalAPI serves the local API, off by default for embedded clients, on
+// addr.
+func WithLocalAPI(addr string) ClientOption {
+	return func(c *client.Config) { c.LocalAPI = addr }
+}
+
+// Client is an embedded gunnel client.
+type Client struct {
+	group *client.Group
+}
+
+// NewClient validates the options and creates the client without connecting.
+func NewClient(opts ...ClientOption) (*Client, error) {
+	config := &client.Config{MaxConnections: 1}
+	for _, opt := range opts {
+		opt(config)
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	group, err := client.NewGroup(config)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{group: group}, nil
+}
+
+// OnTunnelUp calls fn with the public URL of each tunnel once it is
+// registered. Call it before Start.
+func (c *Client) OnTunnelUp(fn func(subdomain, publicURL string)) {
+	c.group.OnTunnelUp(fn)
+}
+
+// Start connects to the server and serves the tunnels until ctx is done or
+// Shutdown is called.
+func (c *Client) Start(ctx context.Context) error {
+	return c.group.Start(ctx)
+}
+
+// Shutdown closes the tunnels and waits until the client has stopped, or
+// until ctx is done.
+func (c *Client) Shutdown(ctx context.Context) error {
+	return c.group.Shutdown(ctx)
+}
@@ -0,0 +1,67 @@
+package gunnel_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/snakeice/gunnel/pkg/gunnel"
+)
+
+func freePort(t *testing.T, network string) int {
+	t.Helper()
+	if network == "udp" {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		return conn.LocalAddr().(*net.UDPAddr).Port
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+func TestNewServerRequiresDomain(t *testing.T) {
+	if _, err := gunnel.NewServer(gunnel.WithQUICPort(9000)); err == nil {
+		t.Fatal("expected an error without a domain")
+	}
+}
+
+func TestNewClientRequiresBackend(t *testing.T) {
+	if _, err := gunnel.NewClient(gunnel.WithServerAddr("localhost:8081")); err == nil {
+		t.Fatal("expected an error without backends")
+	}
+}
+
+func TestServerShutdown(t *testing.T) {
+	srv, err := gunnel.NewServer(
+		gunnel.WithDomain("localhost"),
+		gunnel.WithBindAddress("127.0.0.1"),
+		gunnel.WithHTTPPort(freePort(t, "tcp")),
+		gunnel.WithQUICPort(freePort(t, "udp")),
+		gunnel.WithTokenValidator(func(token string) bool { return token == "secret" }),
+		gunnel.WithAllowRoot(true),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- srv.Start(context.Background()) }()
+	time.Sleep(100 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+}
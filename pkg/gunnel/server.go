@@ -0,0 +1,111 @@
+// Package gunnel embeds the gunnel server and client in other Go programs.
+//
+//	srv, err := gunnel.NewServer(
+//		gunnel.WithDomain("tunnel.example.com"),
+//		gunnel.WithQUICPort(8081),
+//		gunnel.WithTokenValidator(users.ValidToken),
+//	)
+//	if err != nil {
+//		return err
+//	}
+//	go srv.Start(ctx)
+//	defer srv.Shutdown(context.Background())
+//
+// Neither the server nor the client exit the process or wait for signals;
+// both run until their context is done or Shutdown is called.
+package gunnel
+
+import (
+	"context"
+
+	"github.com/snakeice/gunnel/pkg/server"
+)
+
+// ServerOption configures a Server.
+type ServerOption func(*serverOptions)
+
+type serverOptions struct {
+	config    *server.Config
+	validator func(token string) bool
+}
+
+// WithServerConfig starts from config instead of the defaults of
+// server.DefaultConfig; the options after it change it in place.
+func WithServerConfig(config *server.Config) ServerOption {
+	return func(o *serverOptions) { o.config = config }
+}
+
+// WithDomain sets the domain the tunnels are subdomains of. It is required.
+func WithDomain(domain string) ServerOption {
+	return func(o *serverOptions) { o.config.Domain = domain }
+}
+
+// WithHTTPPort sets the port of the HTTP listener for users (8080 by default).
+func WithHTTPPort(port int) ServerOption {
+	return func(o *serverOptions) { o.config.ServerPort = port }
+}
+
+// WithQUICPort sets the port clients connect to (8081 by default).
+func WithQUICPort(port int) ServerOption {
+	return func(o *serverOptions) { o.config.QuicPort = port }
+}
+
+// WithBindAddress limits the listeners to one local IP.
+func WithBindAddress(addr string) ServerOption {
+	return func(o *serverOptions) { o.config.BindAddress = addr }
+}
+
+// WithToken requires clients to present token.
+func WithToken(token string) ServerOption {
+	return func(o *serverOptions) { o.config.Token = token }
+}
+
+// WithTokenValidator checks client tokens with valid instead of the tokens
+// of the config, e.g. against the embedding program's own user store.
+func WithTokenValidator(valid func(token string) bool) ServerOption {
+	return func(o *serverOptions) { o.validator = valid }
+}
+
+// WithAdminToken enables the admin API, guarded by token.
+func WithAdminToken(token string) ServerOption {
+	return func(o *serverOptions) { o.config.AdminToken = token }
+}
+
+// WithAllowRoot lets the server run as root without dropping privileges.
+func WithAllowRoot(allow bool) ServerOption {
+	return func(o *serverOptions) { o.config.AllowRoot = allow }
+}
+
+// Server is an embedded gunnel server.
+type Server struct {
+	srv *server.Server
+}
+
+// NewServer validates the options and creates the server without starting
+// it.
+func NewServer(opts ...ServerOption) (*Server, error) {
+	o := &serverOptions{config: server.DefaultConfig()}
+	for _, opt := range opts {
+		opt(o)
+	}
+	if err := o.config.Validate(); err != nil {
+		return nil, err
+	}
+
+	srv := server.NewServer(o.config)
+	if o.validator != nil {
+		srv.SetTokenValidator(o.validator)
+	}
+	return &Server{srv: srv}, nil
+}
+
+// Start runs the server until ctx is done or Shutdown is called.
+func (s *Server) Start(ctx context.Context) error {
+	return s.srv.Start(ctx)
+}
+
+// Shutdown stops the server and waits until it has stopped, or until ctx is
+// done.
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.srv.Shutdown(ctx)
+}
@@ -3,7 +3,6 @@ package honeypot
 import (
 	"crypto/rand"
 	"math/big"
-	"net"
 	"net/http"
 	"sync"
 	"time"
@@ -35,12 +34,17 @@ type Honeypot struct {
 	enabled          bool
 	threshold        int
 	maxRequestsPerIP int
-	minDelay         time.Duration
-	maxDelay         time.Duration
-	cleanupInterval  time.Duration
-	ipTTL            time.Duration
-	stopCleanup      chan struct{}
-	logger           *logrus.Entry
+	// maxCaptured bounds the requests kept across all IPs (0 = unlimited);
+	// captured and peakCaptured count them.
+	maxCaptured     int
+	captured        int
+	peakCaptured    int
+	minDelay        time.Duration
+	maxDelay        time.Duration
+	cleanupInterval time.Duration
+	ipTTL           time.Duration
+	stopCleanup     chan struct{}
+	logger          *logrus.Entry
 }
 
 type Config struct {
@@ -86,12 +90,12 @@ func New(config Config) *Honeypot {
 	return h
 }
 
-func (h *Honeypot) RecordRequest(req *http.Request, subdomain string) {
+// RecordRequest tracks a request from ip to an unknown subdomain.
+func (h *Honeypot) RecordRequest(req *http.Request, ip, subdomain string) {
 	if !h.enabled {
 		return
 	}
 
-	ip := extractIP(req)
 	if ip == "" {
 		return
 	}
@@ -113,7 +117,9 @@ func (h *Honeypot) RecordRequest(req *http.Request, subdomain string) {
 	stats.RequestCount++
 	stats.SubdomainsTried[subdomain]++
 
-	if len(stats.Requests) < h.maxRequestsPerIP {
+	if len(stats.Requests) < h.maxRequestsPerIP && (h.maxCaptured == 0 || h.captured < h.maxCaptured) {
+		h.captured++
+		h.peakCaptured = max(h.peakCaptured, h.captured)
 		stats.Requests = append(stats.Requests, SuspiciousRequest{
 			Timestamp:   time.Now(),
 			Subdomain:   subdomain,
@@ -367,6 +373,22 @@ func (h *Honeypot) Clear() {
 	defer h.mu.Unlock()
 
 	h.ipStats = make(map[string]*IPStats)
+	h.captured = 0
+}
+
+// SetMaxCaptured bounds the requests kept across all IPs; once reached, new
+// requests are still counted but not kept. Zero means unlimited.
+func (h *Honeypot) SetMaxCaptured(n int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.maxCaptured = n
+}
+
+// Captured returns how many requests are kept and the peak since the start.
+func (h *Honeypot) Captured() (int, int) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.captured, h.peakCaptured
 }
 
 func (h *Honeypot) SetEnabled(enabled bool) {
@@ -399,6 +421,7 @@ func (h *Honeypot) cleanupStaleIPs() {
 
 	for ip, stats := range h.ipStats {
 		if now.Sub(stats.LastSeen) > h.ipTTL {
+			h.captured -= len(stats.Requests)
 			delete(h.ipStats, ip)
 			removed++
 		}
@@ -416,65 +439,6 @@ func (h *Honeypot) Stop() {
 	close(h.stopCleanup)
 }
 
-func extractIP(req *http.Request) string {
-	xff := req.Header.Get("X-Forwarded-For")
-	if xff != "" {
-		ips := splitCSV(xff)
-		if len(ips) > 0 {
-			ip := trimSpace(ips[0])
-			if net.ParseIP(ip) != nil {
-				return ip
-			}
-		}
-	}
-
-	xri := req.Header.Get("X-Real-IP")
-	if xri != "" {
-		ip := trimSpace(xri)
-		if net.ParseIP(ip) != nil {
-			return ip
-		}
-	}
-
-	host, _, err := net.SplitHostPort(req.RemoteAddr)
-	if err != nil {
-		return req.RemoteAddr
-	}
-
-	return host
-}
-
-func splitCSV(s string) []string {
-	var result []string
-	start := 0
-	for i := 0; i <= len(s); i++ {
-		if i == len(s) || s[i] == ',' {
-			part := trimSpace(s[start:i])
-			if part != "" {
-				result = append(result, part)
-			}
-			start = i + 1
-		}
-	}
-	return result
-}
-
-func trimSpace(s string) string {
-	start := 0
-	end := len(s)
-	for start < end && isSpace(s[start]) {
-		start++
-	}
-	for end > start && isSpace(s[end-1]) {
-		end--
-	}
-	return s[start:end]
-}
-
-func isSpace(c byte) bool {
-	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
-}
-
 func contains(s, substr string) bool {
 	for i := 0; i <= len(s)-len(substr); i++ {
 		if s[i:i+len(substr)] == substr {
@@ -0,0 +1,62 @@
+package integrations
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// gitHub updates a repository or organization webhook.
+type gitHub struct {
+	client   *http.Client
+	token    string
+	endpoint string
+}
+
+// newGitHub needs hook_id and either repository (owner/name) or organization.
+func newGitHub(token string, settings map[string]string, client *http.Client) (Provider, error) {
+	values, err := required(settings, "hook_id")
+	if err != nil {
+		return nil, err
+	}
+	hookID := url.PathEscape(values[0])
+
+	base := apiURL(settings, "https://api.github.com")
+	var endpoint string
+	switch repo, org := settings["repository"], settings["organization"]; {
+	case repo != "":
+		owner, name, ok := strings.Cut(repo, "/")
+		if !ok || owner == "" || name == "" {
+			return nil, errors.New("repository must be owner/name")
+		}
+		endpoint = base + "/repos/" + url.PathEscape(owner) + "/" + url.PathEscape(name) + "/hooks/" + hookID + "/config"
+	case org != "":
+		endpoint = base + "/orgs/" + url.PathEscape(org) + "/hooks/" + hookID + "/config"
+	default:
+		return nil, errors.New("repository or organization is required")
+	}
+
+	return &gitHub{client: client, token: token, endpoint: endpoint}, nil
+}
+
+func (g *gitHub) Update(ctx context.Context, webhookURL string) error {
+	body, err := json.Marshal(map[string]string{"url": webhookURL})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPatch, g.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+g.token)
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("Content-Type", "application/json")
+
+	_, err = send(g.client, req)
+	return err
+}
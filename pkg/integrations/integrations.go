@@ -0,0 +1,162 @@
+// Package integrations points the webhook endpoints of third-party services
+// at the public URL of a tunnel once it is up.
+package integrations
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const requestTimeout = 15 * time.Second
+
+// Provider updates the webhook endpoint of one service.
+type Provider interface {
+	// Update points the webhook at url.
+	Update(ctx context.Context, url string) error
+}
+
+// Factory builds a provider from its API token and settings. It returns an
+// error when a required setting is missing.
+type Factory func(token string, settings map[string]string, client *http.Client) (Provider, error)
+
+//nolint:gochecknoglobals // registry of providers, extended through Register
+var (
+	registryMu sync.RWMutex
+	registry   = map[string]Factory{
+		"github": newGitHub,
+		"stripe": newStripe,
+		"slack":  newSlack,
+	}
+)
+
+// Register makes a provider available under name, replacing any provider
+// registered with the same name.
+func Register(name string, factory Factory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	registry[name] = factory
+}
+
+// Providers returns the names of the registered providers.
+func Providers() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// Config describes one webhook to update. Settings holds the options of
+// the provider, e.g. repository and hook_id for GitHub.
+type Config struct {
+	Provider string `yaml:"provider"`
+	// Subdomain selects the tunnel whose URL is used (empty = every tunnel).
+	Subdomain string `yaml:"subdomain"`
+	// Path is appended to the tunnel URL, e.g. /webhooks/stripe.
+	Path     string            `yaml:"path"`
+	Token    string            `yaml:"token"`
+	Settings map[string]string `yaml:",inline"`
+}
+
+// Integration is a configured provider.
+type Integration struct {
+	config   Config
+	provider Provider
+}
+
+// New builds the integration described by config.
+func New(config Config) (*Integration, error) {
+	registryMu.RLock()
+	factory, ok := registry[config.Provider]
+	registryMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown provider %q (available: %s)",
+			config.Provider, strings.Join(Providers(), ", "))
+	}
+	if config.Token == "" {
+		return nil, errors.New("token is required")
+	}
+	if config.Path != "" && !strings.HasPrefix(config.Path, "/") {
+		return nil, errors.New("path must start with /")
+	}
+
+	provider, err := factory(config.Token, config.Settings, &http.Client{Timeout: requestTimeout})
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", config.Provider, err)
+	}
+	return &Integration{config: config, provider: provider}, nil
+}
+
+// Name identifies the integration in logs.
+func (i *Integration) Name() string {
+	return i.config.Provider
+}
+
+// Matches reports whether the integration follows subdomain.
+func (i *Integration) Matches(subdomain string) bool {
+	return i.config.Subdomain == "" || i.config.Subdomain == subdomain
+}
+
+// Update points the webhook at tunnelURL followed by the configured path.
+func (i *Integration) Update(ctx context.Context, tunnelURL string) error {
+	if tunnelURL == "" {
+		return errors.New("the server did not report the tunnel URL")
+	}
+	return i.provider.Update(ctx, strings.TrimSuffix(tunnelURL, "/")+i.config.Path)
+}
+
+// required returns the settings named in keys, failing on the first missing one.
+func required(settings map[string]string, keys ...string) ([]string, error) {
+	values := make([]string, len(keys))
+	for i, key := range keys {
+		values[i] = settings[key]
+		if values[i] == "" {
+			return nil, fmt.Errorf("%s is required", key)
+		}
+	}
+	return values, nil
+}
+
+// apiURL returns the api_url setting, used to point a provider at a test
+// server or an enterprise installation, or fallback.
+func apiURL(settings map[string]string, fallback string) string {
+	if u := settings["api_url"]; u != "" {
+		return strings.TrimSuffix(u, "/")
+	}
+	return fallback
+}
+
+// send performs req and returns its body, failing on non-2xx answers.
+func send(client *http.Client, req *http.Request) ([]byte, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			logrus.WithError(err).Debug("Failed to close integration response body")
+		}
+	}()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return body, nil
+}
@@ -0,0 +1,94 @@
+package integrations_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/snakeice/gunnel/pkg/integrations"
+)
+
+func TestNewValidatesConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		config integrations.Config
+	}{
+		{"unknown provider", integrations.Config{Provider: "nope", Token: "t"}},
+		{"missing token", integrations.Config{Provider: "stripe", Settings: map[string]string{"endpoint_id": "we_1"}}},
+		{"missing setting", integrations.Config{Provider: "github", Token: "t", Settings: map[string]string{"hook_id": "1"}}},
+		{"relative path", integrations.Config{
+			Provider: "stripe", Token: "t", Path: "hooks", Settings: map[string]string{"endpoint_id": "we_1"},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := integrations.New(tt.config); err == nil {
+				t.Error("New() succeeded, want an error")
+			}
+		})
+	}
+}
+
+func TestGitHubUpdate(t *testing.T) {
+	var gotPath, gotAuth, gotURL string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath, gotAuth = r.Method+" "+r.URL.Path, r.Header.Get("Authorization")
+		var body map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("decode body: %v", err)
+		}
+		gotURL = body["url"]
+	}))
+	defer srv.Close()
+
+	integration, err := integrations.New(integrations.Config{
+		Provider: "github",
+		Token:    "ghp_test",
+		Path:     "/github",
+		Settings: map[string]string{"repository": "acme/app", "hook_id": "42", "api_url": srv.URL},
+	})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	if err := integration.Update(context.Background(), "https://test.example.com"); err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+
+	if gotPath != "PATCH /repos/acme/app/hooks/42/config" {
+		t.Errorf("request = %q", gotPath)
+	}
+	if gotAuth != "Bearer ghp_test" {
+		t.Errorf("Authorization = %q", gotAuth)
+	}
+	if gotURL != "https://test.example.com/github" {
+		t.Errorf("url = %q", gotURL)
+	}
+}
+
+func TestStripeUpdateReportsErrors(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Errorf("parse form: %v", err)
+		}
+		if r.URL.Path != "/v1/webhook_endpoints/we_1" || r.PostForm.Get("url") != "https://test.example.com" {
+			t.Errorf("unexpected request %s %v", r.URL.Path, r.PostForm)
+		}
+		http.Error(w, `{"error":{"message":"No such webhook endpoint"}}`, http.StatusNotFound)
+	}))
+	defer srv.Close()
+
+	integration, err := integrations.New(integrations.Config{
+		Provider: "stripe",
+		Token:    "sk_test",
+		Settings: map[string]string{"endpoint_id": "we_1", "api_url": srv.URL},
+	})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	if err := integration.Update(context.Background(), "https://test.example.com"); err == nil {
+		t.Error("Update() succeeded, want the API error")
+	}
+}
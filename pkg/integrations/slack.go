@@ -0,0 +1,94 @@
+package integrations
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// slack updates the request URLs in the manifest of a Slack app.
+type slack struct {
+	client *http.Client
+	token  string
+	appID  string
+	api    string
+}
+
+type slackResponse struct {
+	OK       bool           `json:"ok"`
+	Error    string         `json:"error"`
+	Manifest map[string]any `json:"manifest"`
+}
+
+// newSlack needs the app_id; the token is an app configuration token.
+func newSlack(token string, settings map[string]string, client *http.Client) (Provider, error) {
+	values, err := required(settings, "app_id")
+	if err != nil {
+		return nil, err
+	}
+	return &slack{
+		client: client,
+		token:  token,
+		appID:  values[0],
+		api:    apiURL(settings, "https://slack.com/api"),
+	}, nil
+}
+
+// Update sets the event subscription request URL, and the interactivity one
+// when the app enables it.
+func (s *slack) Update(ctx context.Context, webhookURL string) error {
+	exported, err := s.call(ctx, "apps.manifest.export", url.Values{"app_id": {s.appID}})
+	if err != nil {
+		return err
+	}
+
+	settings, ok := exported.Manifest["settings"].(map[string]any)
+	if !ok {
+		return errors.New("app manifest has no settings")
+	}
+	events, ok := settings["event_subscriptions"].(map[string]any)
+	if !ok {
+		return errors.New("app has no event subscriptions")
+	}
+	events["request_url"] = webhookURL
+	if interactivity, ok := settings["interactivity"].(map[string]any); ok && interactivity["is_enabled"] == true {
+		interactivity["request_url"] = webhookURL
+	}
+
+	manifest, err := json.Marshal(exported.Manifest)
+	if err != nil {
+		return err
+	}
+	_, err = s.call(ctx, "apps.manifest.update", url.Values{
+		"app_id":   {s.appID},
+		"manifest": {string(manifest)},
+	})
+	return err
+}
+
+func (s *slack) call(ctx context.Context, method string, form url.Values) (*slackResponse, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.api+"/"+method, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+s.token)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	body, err := send(s.client, req)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &slackResponse{}
+	if err := json.Unmarshal(body, resp); err != nil {
+		return nil, fmt.Errorf("%s: %w", method, err)
+	}
+	if !resp.OK {
+		return nil, fmt.Errorf("%s: %s", method, resp.Error)
+	}
+	return resp, nil
+}
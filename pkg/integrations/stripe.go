@@ -0,0 +1,39 @@
+package integrations
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// stripe updates a webhook endpoint of a Stripe account.
+type stripe struct {
+	client   *http.Client
+	token    string
+	endpoint string
+}
+
+// newStripe needs the endpoint_id (we_...) of the webhook endpoint.
+func newStripe(token string, settings map[string]string, client *http.Client) (Provider, error) {
+	values, err := required(settings, "endpoint_id")
+	if err != nil {
+		return nil, err
+	}
+
+	endpoint := apiURL(settings, "https://api.stripe.com") + "/v1/webhook_endpoints/" + url.PathEscape(values[0])
+	return &stripe{client: client, token: token, endpoint: endpoint}, nil
+}
+
+func (s *stripe) Update(ctx context.Context, webhookURL string) error {
+	form := url.Values{"url": {webhookURL}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+s.token)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	_, err = send(s.client, req)
+	return err
+}
@@ -0,0 +1,140 @@
+// Package logging provides the named loggers of the parts of gunnel, whose
+// levels are set apart from the rest of the log, e.g. the data path at warn
+// while registration is debugged at trace.
+package logging
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Names of the named loggers.
+const (
+	ControlName  = "control"
+	DataName     = "data"
+	HTTPEdgeName = "http-edge"
+	WebUIName    = "webui"
+)
+
+// The named loggers. They write through the standard logger's output and
+// formatter, with a "logger" field naming them.
+//
+//nolint:gochecknoglobals // shared by every package, like the standard logger
+var (
+	// Control logs client connections, registration and control messages.
+	Control = newLogger(ControlName)
+	// Data logs streams and the TCP, UDP and WebSocket traffic they carry.
+	Data = newLogger(DataName)
+	// HTTPEdge logs public HTTP requests and how they are routed.
+	HTTPEdge = newLogger(HTTPEdgeName)
+	// WebUI logs the web UI and its admin API.
+	WebUI = newLogger(WebUIName)
+)
+
+//nolint:gochecknoglobals // registry of the loggers above
+var (
+	mu      sync.Mutex
+	loggers = map[string]*logrus.Logger{}
+	// pinned holds the loggers given their own level, which SetLevel keeps.
+	pinned = map[string]bool{}
+)
+
+func newLogger(name string) *logrus.Logger {
+	l := &logrus.Logger{
+		Out:       stdWriter{},
+		Formatter: stdFormatter{name: name},
+		Hooks:     make(logrus.LevelHooks),
+		Level:     logrus.GetLevel(),
+		ExitFunc:  logrus.StandardLogger().ExitFunc,
+	}
+	loggers[name] = l
+	return l
+}
+
+// Names lists the named loggers.
+func Names() []string {
+	mu.Lock()
+	defer mu.Unlock()
+	return slices.Sorted(maps.Keys(loggers))
+}
+
+// SetLevel sets the level of the standard logger and of the named loggers
+// not given their own.
+func SetLevel(level logrus.Level) {
+	mu.Lock()
+	defer mu.Unlock()
+	logrus.SetLevel(level)
+	for name, l := range loggers {
+		if !pinned[name] {
+			l.SetLevel(level)
+		}
+	}
+}
+
+// SetLevels gives named loggers their own level from a list such as
+// "data=warn,control=trace".
+func SetLevels(spec string) error {
+	levels, err := ParseLevels(spec)
+	if err != nil {
+		return err
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	for name, level := range levels {
+		loggers[name].SetLevel(level)
+		pinned[name] = true
+	}
+	return nil
+}
+
+// ParseLevels parses a list of name=level pairs separated by commas.
+func ParseLevels(spec string) (map[string]logrus.Level, error) {
+	levels := make(map[string]logrus.Level)
+	for pair := range strings.SplitSeq(spec, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid log level %q, want name=level", pair)
+		}
+		name = strings.TrimSpace(name)
+		if _, known := loggers[name]; !known {
+			return nil, fmt.Errorf("unknown logger %q, want one of %s", name, strings.Join(Names(), ", "))
+		}
+		level, err := logrus.ParseLevel(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("logger %s: %w", name, err)
+		}
+		levels[name] = level
+	}
+	return levels, nil
+}
+
+// stdWriter writes to the output of the standard logger, wherever it is set
+// to.
+type stdWriter struct{}
+
+func (stdWriter) Write(p []byte) (int, error) {
+	return logrus.StandardLogger().Out.Write(p)
+}
+
+// stdFormatter formats entries with the formatter of the standard logger,
+// adding the logger name.
+type stdFormatter struct {
+	name string
+}
+
+func (f stdFormatter) Format(e *logrus.Entry) ([]byte, error) {
+	entry := *e
+	entry.Data = make(logrus.Fields, len(e.Data)+1)
+	maps.Copy(entry.Data, e.Data)
+	entry.Data["logger"] = f.name
+	return logrus.StandardLogger().Formatter.Format(&entry)
+}
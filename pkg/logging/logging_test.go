@@ -0,0 +1,33 @@
+package logging_test
+
+import (
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/snakeice/gunnel/pkg/logging"
+)
+
+func TestSetLevelsKeepsPinnedLoggers(t *testing.T) {
+	if err := logging.SetLevels("data=warn, control=trace"); err != nil {
+		t.Fatalf("SetLevels() error = %v", err)
+	}
+	logging.SetLevel(logrus.InfoLevel)
+
+	want := map[*logrus.Logger]logrus.Level{
+		logging.Data:     logrus.WarnLevel,
+		logging.Control:  logrus.TraceLevel,
+		logging.HTTPEdge: logrus.InfoLevel,
+		logging.WebUI:    logrus.InfoLevel,
+	}
+	for l, level := range want {
+		if got := l.GetLevel(); got != level {
+			t.Errorf("level = %s, want %s", got, level)
+		}
+	}
+
+	for _, spec := range []string{"data", "tunnel=info", "data=loud"} {
+		if _, err := logging.ParseLevels(spec); err == nil {
+			t.Errorf("ParseLevels(%q) succeeded, want an error", spec)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package manager
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"sync"
+
+	"github.com/snakeice/gunnel/pkg/connection"
+	"github.com/snakeice/gunnel/pkg/logging"
+	"github.com/snakeice/gunnel/pkg/protocol"
+)
+
+const nonceSize = 32
+
+// connAuth holds the outstanding public key challenge of one connection.
+type connAuth struct {
+	mu    sync.Mutex
+	nonce []byte
+}
+
+// issue replaces the outstanding nonce with a fresh one.
+func (a *connAuth) issue() ([]byte, error) {
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.nonce = nonce
+	return nonce, nil
+}
+
+// take returns the outstanding nonce and clears it, so each nonce
+// authenticates a single registration.
+func (a *connAuth) take() []byte {
+	if a == nil {
+		return nil
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	nonce := a.nonce
+	a.nonce = nil
+	return nonce
+}
+
+// SetAuthorizedKeys lets clients holding one of keys register by signing a
+// server issued nonce instead of presenting the shared token. Once called,
+// registrations must authenticate even when keys is empty.
+func (m *Manager) SetAuthorizedKeys(keys []ed25519.PublicKey) {
+	authorized := make(map[string]struct{}, len(keys))
+	for _, key := range keys {
+		authorized[string(key)] = struct{}{}
+	}
+
+	m.authMu.Lock()
+	defer m.authMu.Unlock()
+	m.authorizedKeys = authorized
+}
+
+func (m *Manager) isAuthorizedKey(key []byte) bool {
+	m.authMu.RLock()
+	defer m.authMu.RUnlock()
+
+	_, ok := m.authorizedKeys[string(key)]
+	return ok
+}
+
+func (m *Manager) keyAuthEnabled() bool {
+	m.authMu.RLock()
+	defer m.authMu.RUnlock()
+
+	return m.authorizedKeys != nil
+}
+
+func (m *Manager) handleAuthChallenge(client *connection.Connection, auth *connAuth) {
+	nonce, err := auth.issue()
+	if err != nil {
+		logging.Control.WithError(err).Error("Failed to generate authentication nonce")
+		client.Send(&protocol.ErrorMessage{Message: "failed to issue challenge"})
+		return
+	}
+	client.Send(&protocol.AuthChallenge{Nonce: nonce})
+}
+
+// authorizeRegistration accepts a registration carrying the shared token, a
+// team or client token or a valid signature over the connection's outstanding
+// nonce. Without a token, authorized keys, teams or client tokens configured
+// every registration is accepted. Subdomains reserved by a named tunnel only accept that tunnel's
+// credentials.
+func (m *Manager) authorizeRegistration(reg *protocol.ConnectionRegister, auth *connAuth) bool {
+	if tunnel, ok := m.namedTunnelFor(reg.Subdomain); ok {
+		if !tunnel.matches(reg.Token) {
+			logging.Control.WithField("tunnel", tunnel.Name).Warn("Registration without the named tunnel's credentials")
+			return false
+		}
+		return true
+	}
+
+	keyAuth := m.keyAuthEnabled()
+	if m.tokenValidator == nil && !keyAuth && !m.teamsEnabled() && !m.clientTokensEnabled() {
+		return true
+	}
+
+	if m.tokenValidator != nil && m.tokenValidator(reg.Token) {
+		return true
+	}
+
+	if _, ok := m.TeamMember(reg.Token); ok {
+		return true
+	}
+
+	if _, ok := m.clientTokenFor(reg.Token); ok {
+		return true
+	}
+
+	nonce := auth.take()
+	if !keyAuth || len(reg.PublicKey) != ed25519.PublicKeySize || len(nonce) == 0 {
+		return false
+	}
+
+	if !m.isAuthorizedKey(reg.PublicKey) {
+		logging.Control.Warn("Registration signed with a key that is not authorized")
+		return false
+	}
+
+	challenge := protocol.AuthChallenge{Nonce: nonce}
+	return ed25519.Verify(reg.PublicKey, challenge.SignedMessage(), reg.Signature)
+}
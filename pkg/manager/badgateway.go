@@ -0,0 +1,91 @@
+package manager
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/snakeice/gunnel/pkg/metrics"
+)
+
+const (
+	// maxMalformedSnippet bounds the part of a malformed response kept.
+	maxMalformedSnippet = 512
+	// badGatewayReason completes "The service behind <host> ..." on the
+	// generic 502 page.
+	badGatewayReason = "did not answer properly"
+)
+
+//nolint:gochecknoglobals // parsed once from the embedded templates
+var gatewayErrorTemplate = template.Must(template.ParseFS(templates, "templates/gatewayerror.html"))
+
+// MalformedResponse is a response of a tunnel's backend that was not valid
+// HTTP, as the client reported it.
+type MalformedResponse struct {
+	At     time.Time `json:"at"`
+	Method string    `json:"method"`
+	Path   string    `json:"path"`
+	// Snippet is the start of what the backend sent.
+	Snippet string `json:"snippet"`
+}
+
+// LastMalformedResponse returns the last malformed response the backend of
+// subdomain sent.
+func (m *Manager) LastMalformedResponse(subdomain string) (*MalformedResponse, bool) {
+	value, ok := m.malformed.Load(subdomain)
+	if !ok {
+		return nil, false
+	}
+	r, ok := value.(*MalformedResponse)
+	return r, ok
+}
+
+// serveMalformed answers req with the bad gateway page after the client
+// reported, in resp, that the backend sent something that is not HTTP.
+func (m *Manager) serveMalformed(
+	w http.ResponseWriter,
+	req *http.Request,
+	resp *http.Response,
+	subdomain string,
+	logger *logrus.Entry,
+) (int, int64, error) {
+	snippet, err := io.ReadAll(io.LimitReader(resp.Body, maxMalformedSnippet))
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to read response: %w", err)
+	}
+
+	m.malformed.Store(subdomain, &MalformedResponse{
+		At:      time.Now(),
+		Method:  req.Method,
+		Path:    req.URL.RequestURI(),
+		Snippet: string(snippet),
+	})
+	metrics.RecordTunnelError(subdomain, "malformed_response")
+	logger.WithField("snippet", string(snippet[:min(len(snippet), 64)])).Warn("Backend sent a malformed response")
+
+	serveGatewayError(w, req, http.StatusBadGateway, badGatewayReason, logger)
+	return http.StatusBadGateway, 0, nil
+}
+
+// serveGatewayError writes the error page of status, which tells users what
+// went wrong in reason but nothing of the internals.
+func serveGatewayError(w http.ResponseWriter, req *http.Request, status int, reason string, logger *logrus.Entry) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if status == http.StatusServiceUnavailable {
+		w.Header().Set("Retry-After", "5")
+	}
+	w.WriteHeader(status)
+
+	data := struct {
+		Host   string
+		Title  string
+		Reason string
+	}{Host: req.Host, Title: http.StatusText(status), Reason: reason}
+	if err := gatewayErrorTemplate.Execute(w, data); err != nil {
+		logger.WithError(err).Warn("Failed to render bad gateway page")
+	}
+}
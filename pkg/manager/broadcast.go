@@ -0,0 +1,37 @@
+package manager
+
+import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/snakeice/gunnel/pkg/connection"
+	"github.com/snakeice/gunnel/pkg/logging"
+	"github.com/snakeice/gunnel/pkg/protocol"
+)
+
+// Broadcast sends an operator notice to every connected client and returns
+// how many connections it was sent to.
+func (m *Manager) Broadcast(level, message string) int {
+	if level == "" {
+		level = logrus.InfoLevel.String()
+	}
+
+	notice := protocol.Broadcast{
+		Level:   level,
+		Message: message,
+		SentAt:  time.Now(),
+	}
+
+	sent := m.forEachConnection(func(conn *connection.Connection) {
+		msg := notice
+		conn.Send(&msg)
+	})
+
+	logging.Control.WithFields(logrus.Fields{
+		"level":   level,
+		"message": message,
+		"clients": sent,
+	}).Info("Broadcast notice to clients")
+
+	return sent
+}
@@ -0,0 +1,58 @@
+package manager
+
+import (
+	"github.com/sirupsen/logrus"
+	"github.com/snakeice/gunnel/pkg/connection"
+	"github.com/snakeice/gunnel/pkg/logging"
+	"github.com/snakeice/gunnel/pkg/protocol"
+)
+
+// recordDisconnect keeps why a connection of subdomain closed, shown as the
+// reason of the tunnel going offline when it was the last one. Call it
+// before removing the connection, so the tunnel is never offline without it.
+func (m *Manager) recordDisconnect(subdomain, reason string) {
+	value, ok := m.health.Load(subdomain)
+	if !ok {
+		return
+	}
+	if h, ok := value.(*tunnelHealth); ok {
+		h.mu.Lock()
+		h.closeReason = reason
+		h.mu.Unlock()
+	}
+}
+
+// CloseAll closes every registered client connection with code and reason,
+// e.g. when the server stops.
+func (m *Manager) CloseAll(code protocol.CloseCode, reason string) {
+	closed := make(map[*connection.Connection]bool)
+	m.ForEachClient(func(_ string, conn *connection.Connection) {
+		if !closed[conn] {
+			closed[conn] = true
+			conn.CloseWithReason(code, reason)
+		}
+	})
+}
+
+// revokeTenant disconnects the clients registered with the credential of
+// tenant, which was just revoked.
+func (m *Manager) revokeTenant(tenant, reason string) {
+	m.tenants.Range(func(key, value any) bool {
+		subdomain, _ := key.(string)
+		if value != tenant {
+			return true
+		}
+		group, ok := m.getGroup(subdomain)
+		if !ok {
+			return true
+		}
+		for _, conn := range group.list() {
+			conn.CloseWithReason(protocol.CloseAuthRevoked, reason)
+		}
+		logging.Control.WithFields(logrus.Fields{
+			"subdomain": subdomain,
+			"tenant":    tenant,
+		}).Info("Disconnected client of revoked credentials")
+		return true
+	})
+}
@@ -0,0 +1,81 @@
+package manager
+
+import (
+	"github.com/sirupsen/logrus"
+	"github.com/snakeice/gunnel/pkg/connection"
+	"github.com/snakeice/gunnel/pkg/logging"
+	"github.com/snakeice/gunnel/pkg/protocol"
+)
+
+// heartbeatTimeoutFactor is how many pushed heartbeat intervals the server
+// waits before considering a client gone.
+const heartbeatTimeoutFactor = 3
+
+// SetClientConfig sets the settings sent to every client right after it registers.
+func (m *Manager) SetClientConfig(update protocol.ConfigUpdate) {
+	m.configMu.Lock()
+	defer m.configMu.Unlock()
+
+	update.Version = m.configVersion.Add(1)
+	m.clientConfig = &update
+}
+
+// ClientConfig returns the settings sent to clients, if any are set.
+func (m *Manager) ClientConfig() (protocol.ConfigUpdate, bool) {
+	m.configMu.RLock()
+	defer m.configMu.RUnlock()
+
+	if m.clientConfig == nil {
+		return protocol.ConfigUpdate{}, false
+	}
+	return *m.clientConfig, true
+}
+
+// PushConfig replaces the client settings and sends them to every connected
+// client, returning how many it reached.
+func (m *Manager) PushConfig(update protocol.ConfigUpdate) int {
+	m.SetClientConfig(update)
+
+	sent := m.forEachConnection(m.sendClientConfig)
+
+	logging.Control.WithField("clients", sent).Info("Pushed configuration update")
+	return sent
+}
+
+func (m *Manager) sendClientConfig(conn *connection.Connection) {
+	m.configMu.RLock()
+	update := m.clientConfig
+	m.configMu.RUnlock()
+
+	if update == nil {
+		return
+	}
+
+	if update.HeartbeatInterval > 0 {
+		conn.SetHeartbeatConfig(0, heartbeatTimeoutFactor*update.HeartbeatInterval)
+	}
+
+	msg := *update
+	conn.Send(&msg)
+}
+
+func (m *Manager) handleConfigAck(msg *protocol.Message) error {
+	ack := protocol.ConfigUpdateAck{}
+	if err := protocol.Unmarshal(&ack, msg); err != nil {
+		return err
+	}
+
+	logger := logging.Control.WithFields(logrus.Fields{
+		"version": ack.Version,
+		"applied": ack.Applied,
+		"detail":  ack.Message,
+	})
+
+	if !ack.Applied {
+		logger.Warn("Client rejected configuration update")
+		return nil
+	}
+
+	logger.Debug("Client acknowledged configuration update")
+	return nil
+}
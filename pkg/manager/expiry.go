@@ -0,0 +1,93 @@
+package manager
+
+import (
+	"slices"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/snakeice/gunnel/pkg/connection"
+	"github.com/snakeice/gunnel/pkg/logging"
+	"github.com/snakeice/gunnel/pkg/protocol"
+)
+
+// expiryWarning is how long before a tunnel expires its client is warned.
+// Tunnels with a shorter TTL are warned halfway through.
+const expiryWarning = time.Minute
+
+type tunnelExpiry struct {
+	conn   *connection.Connection
+	warn   *time.Timer
+	expire *time.Timer
+}
+
+func (e *tunnelExpiry) stop() {
+	e.warn.Stop()
+	e.expire.Stop()
+}
+
+// scheduleExpiry removes the route for subdomain once ttl elapses, warning
+// conn shortly before. A later registration of the subdomain replaces it.
+func (m *Manager) scheduleExpiry(subdomain string, conn *connection.Connection, ttl time.Duration) {
+	expiresAt := time.Now().Add(ttl)
+
+	lead := expiryWarning
+	if ttl <= 2*expiryWarning {
+		lead = ttl / 2
+	}
+
+	entry := &tunnelExpiry{conn: conn}
+	entry.warn = time.AfterFunc(ttl-lead, func() {
+		conn.Send(&protocol.TunnelExpiry{Subdomain: subdomain, ExpiresAt: expiresAt})
+	})
+	entry.expire = time.AfterFunc(ttl, func() {
+		m.expireTunnel(subdomain, entry, expiresAt)
+	})
+
+	if prev, loaded := m.expiries.Swap(subdomain, entry); loaded {
+		if prev, ok := prev.(*tunnelExpiry); ok {
+			prev.stop()
+		}
+	}
+
+	logging.Control.WithFields(logrus.Fields{
+		"subdomain":  subdomain,
+		"expires_at": expiresAt.Format(time.RFC3339),
+	}).Info("Tunnel registered with TTL")
+}
+
+// cancelExpiry drops the expiry of subdomain if it still belongs to conn.
+func (m *Manager) cancelExpiry(subdomain string, conn *connection.Connection) {
+	value, ok := m.expiries.Load(subdomain)
+	if !ok {
+		return
+	}
+	entry, ok := value.(*tunnelExpiry)
+	if !ok || entry.conn != conn {
+		return
+	}
+	if m.expiries.CompareAndDelete(subdomain, entry) {
+		entry.stop()
+	}
+}
+
+func (m *Manager) expireTunnel(subdomain string, entry *tunnelExpiry, expiresAt time.Time) {
+	if !m.expiries.CompareAndDelete(subdomain, entry) {
+		return
+	}
+
+	group, ok := m.getGroup(subdomain)
+	if !ok || !slices.Contains(group.list(), entry.conn) {
+		return
+	}
+
+	if m.subdomains.CompareAndDelete(subdomain, group) {
+		m.closePublicPorts(subdomain)
+	}
+	entry.conn.Send(&protocol.TunnelExpiry{
+		Subdomain: subdomain,
+		ExpiresAt: expiresAt,
+		Expired:   true,
+	})
+
+	logging.Control.WithField("subdomain", subdomain).Info("Tunnel expired, removed from registry")
+}
@@ -0,0 +1,36 @@
+package manager
+
+import (
+	"net/http"
+
+	"github.com/sirupsen/logrus"
+	"github.com/snakeice/gunnel/pkg/protocol"
+)
+
+// Authorize exposes ForwardAuth.authorize to the tests.
+func (fa *ForwardAuth) Authorize(w http.ResponseWriter, req *http.Request, clientIP string) bool {
+	return fa.authorize(w, req, clientIP, logrus.NewEntry(logrus.New()))
+}
+
+// ReserveClientToken exposes the quota check of registrations to the tests.
+func (m *Manager) ReserveClientToken(token, subdomain string) (func(), string, bool) {
+	return m.reserveClientToken(token, subdomain)
+}
+
+// AuthorizeJWT exposes the JWT check of subdomain to the tests.
+func (m *Manager) AuthorizeJWT(w http.ResponseWriter, req *http.Request, subdomain string) bool {
+	return m.authorizeJWT(w, req, subdomain, logrus.NewEntry(logrus.New()))
+}
+
+// SpendHedge runs the retry budget of subdomain for one request, slow when
+// it waited long enough to be hedged, reporting whether it was hedged.
+func (m *Manager) SpendHedge(subdomain string, slow bool) bool {
+	budget := m.hedging.Load().budget(subdomain)
+	budget.deposit()
+	return slow && budget.withdraw()
+}
+
+// SetClientJWTPolicy applies policy to subdomain as if a client sent it.
+func (m *Manager) SetClientJWTPolicy(subdomain string, policy protocol.JWTPolicy) {
+	m.setClientJWTPolicy(subdomain, &policy)
+}
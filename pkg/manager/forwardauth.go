@@ -0,0 +1,150 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultForwardAuthTimeout = 5 * time.Second
+	// maxForwardAuthBody bounds the denial body relayed back to the user.
+	maxForwardAuthBody = 1 << 20
+)
+
+// hopHeaders are connection specific and never forwarded to the auth endpoint.
+//
+//nolint:gochecknoglobals // read-only list
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// ForwardAuth verifies every proxied request against an external endpoint,
+// in the style of Traefik's forward-auth middleware.
+type ForwardAuth struct {
+	address         string
+	responseHeaders []string
+	client          *http.Client
+}
+
+// NewForwardAuth returns a ForwardAuth that calls address with the headers of
+// each request. responseHeaders lists headers copied from a successful auth
+// response onto the proxied request.
+func NewForwardAuth(address string, responseHeaders []string, timeout time.Duration) *ForwardAuth {
+	if timeout <= 0 {
+		timeout = defaultForwardAuthTimeout
+	}
+
+	return &ForwardAuth{
+		address:         address,
+		responseHeaders: responseHeaders,
+		client: &http.Client{
+			Timeout: timeout,
+			// Redirects such as a login page are meant for the user.
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+}
+
+// SetForwardAuth enables forward authentication for every tunnel; nil disables it.
+func (m *Manager) SetForwardAuth(fa *ForwardAuth) {
+	m.forwardAuth = fa
+}
+
+// authorize asks the auth endpoint about req. It reports whether the request
+// may be proxied; otherwise the endpoint's answer has been written to w.
+func (fa *ForwardAuth) authorize(
+	w http.ResponseWriter,
+	req *http.Request,
+	clientIP string,
+	logger *logrus.Entry,
+) bool {
+	authReq, err := http.NewRequestWithContext(req.Context(), http.MethodGet, fa.address, nil)
+	if err != nil {
+		logger.WithError(err).Error("Failed to build forward auth request")
+		http.Error(w, "500 Internal Server Error: forward auth misconfigured", http.StatusInternalServerError)
+		return false
+	}
+
+	authReq.Header = req.Header.Clone()
+	for _, h := range hopHeaders {
+		authReq.Header.Del(h)
+	}
+	authReq.Header.Set("X-Forwarded-Method", req.Method)
+	authReq.Header.Set("X-Forwarded-Proto", forwardedProto(req))
+	authReq.Header.Set("X-Forwarded-Host", req.Host)
+	authReq.Header.Set("X-Forwarded-Uri", req.URL.RequestURI())
+	authReq.Header.Set("X-Forwarded-For", clientIP)
+
+	resp, err := fa.client.Do(authReq)
+	if err != nil {
+		logger.WithError(err).Error("Forward auth request failed")
+		status := http.StatusBadGateway
+		if req.Context().Err() == nil && isTimeout(err) {
+			status = http.StatusGatewayTimeout
+		}
+		http.Error(w, http.StatusText(status)+": authentication unavailable", status)
+		return false
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			logger.WithError(err).Debug("Failed to close forward auth response body")
+		}
+	}()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		// The backend trusts these headers to come from the auth endpoint, so
+		// the copies sent by the client are dropped even when it sets none.
+		for _, h := range fa.responseHeaders {
+			req.Header.Del(h)
+			if v := resp.Header.Values(h); len(v) > 0 {
+				req.Header[http.CanonicalHeaderKey(h)] = v
+			}
+		}
+		return true
+	}
+
+	logger.WithField("status", resp.StatusCode).Info("Forward auth denied request")
+
+	for key, values := range resp.Header {
+		for _, value := range values {
+			w.Header().Add(key, value)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	if _, err := io.Copy(w, io.LimitReader(resp.Body, maxForwardAuthBody)); err != nil {
+		logger.WithError(err).Debug("Failed to relay forward auth response")
+	}
+
+	return false
+}
+
+// forwardedProto is the scheme of the connection req arrived on; the
+// client's own X-Forwarded-Proto is not trusted.
+func forwardedProto(req *http.Request) string {
+	if req.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+func isTimeout(err error) bool {
+	var timeout interface{ Timeout() bool }
+	if errors.As(err, &timeout) {
+		return timeout.Timeout()
+	}
+	return errors.Is(err, context.DeadlineExceeded)
+}
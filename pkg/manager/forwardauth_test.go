@@ -0,0 +1,87 @@
+package manager_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/snakeice/gunnel/pkg/manager"
+)
+
+func TestForwardAuthAllowStripsClientHeaders(t *testing.T) {
+	var seen http.Header
+	auth := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = r.Header.Clone()
+		w.Header().Set("X-Forwarded-User", "alice")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer auth.Close()
+
+	fa := manager.NewForwardAuth(auth.URL, []string{"X-Forwarded-User", "Remote-Email"}, 0)
+	req := httptest.NewRequest(http.MethodPost, "http://app.example.com/orders?id=1", nil)
+	req.Header.Set("X-Forwarded-User", "admin")
+	req.Header.Set("Remote-Email", "admin@example.com")
+	req.Header.Set("X-Forwarded-Proto", "https")
+	req.Header.Set("X-Forwarded-Host", "evil.example.com")
+	rec := httptest.NewRecorder()
+
+	if !fa.Authorize(rec, req, "203.0.113.7") {
+		t.Fatalf("expected the request to be allowed, got %d", rec.Code)
+	}
+	if got := req.Header.Values("X-Forwarded-User"); len(got) != 1 || got[0] != "alice" {
+		t.Errorf("expected X-Forwarded-User from the auth endpoint only, got %q", got)
+	}
+	if got := req.Header.Get("Remote-Email"); got != "" {
+		t.Errorf("expected the client's Remote-Email to be dropped, got %q", got)
+	}
+
+	want := map[string]string{
+		"X-Forwarded-Method": http.MethodPost,
+		"X-Forwarded-Proto":  "http",
+		"X-Forwarded-Host":   "app.example.com",
+		"X-Forwarded-Uri":    "/orders?id=1",
+		"X-Forwarded-For":    "203.0.113.7",
+	}
+	for name, value := range want {
+		if got := seen.Get(name); got != value {
+			t.Errorf("auth endpoint got %s %q, want %q", name, got, value)
+		}
+	}
+}
+
+func TestForwardAuthDeny(t *testing.T) {
+	auth := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="app"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		_, _ = w.Write([]byte("login required"))
+	}))
+	defer auth.Close()
+
+	fa := manager.NewForwardAuth(auth.URL, nil, 0)
+	rec := httptest.NewRecorder()
+	if fa.Authorize(rec, httptest.NewRequest(http.MethodGet, "http://app.example.com/", nil), "203.0.113.7") {
+		t.Fatal("expected the request to be denied")
+	}
+	if rec.Code != http.StatusUnauthorized || rec.Body.String() != "login required" {
+		t.Errorf("expected the auth endpoint's denial, got %d %q", rec.Code, rec.Body.String())
+	}
+	if got := rec.Header().Get("WWW-Authenticate"); got != `Basic realm="app"` {
+		t.Errorf("expected the auth endpoint's headers, got WWW-Authenticate %q", got)
+	}
+}
+
+func TestForwardAuthRedirect(t *testing.T) {
+	auth := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "https://login.example.com/", http.StatusFound)
+	}))
+	defer auth.Close()
+
+	fa := manager.NewForwardAuth(auth.URL, nil, 0)
+	rec := httptest.NewRecorder()
+	if fa.Authorize(rec, httptest.NewRequest(http.MethodGet, "http://app.example.com/", nil), "203.0.113.7") {
+		t.Fatal("expected the request to be redirected")
+	}
+	if rec.Code != http.StatusFound || rec.Header().Get("Location") != "https://login.example.com/" {
+		t.Errorf("expected the redirect to reach the user, got %d to %q", rec.Code, rec.Header().Get("Location"))
+	}
+}
@@ -0,0 +1,139 @@
+package manager
+
+import (
+	"errors"
+	"slices"
+	"sync"
+	"sync/atomic"
+
+	"github.com/snakeice/gunnel/pkg/connection"
+	"github.com/snakeice/gunnel/pkg/transport"
+)
+
+// clientGroup holds every QUIC connection a single logical client opened for a
+// subdomain. Streams are spread across the connections round-robin.
+type clientGroup struct {
+	clientID string
+	conns    []*connection.Connection
+	next     atomic.Uint64
+	mu       sync.RWMutex
+}
+
+func newClientGroup(clientID string, conn *connection.Connection) *clientGroup {
+	return &clientGroup{
+		clientID: clientID,
+		conns:    []*connection.Connection{conn},
+	}
+}
+
+// sameClient reports whether a registration with clientID belongs to this group.
+// Registrations without an ID never join an existing group.
+func (g *clientGroup) sameClient(clientID string) bool {
+	return clientID != "" && g.clientID == clientID
+}
+
+func (g *clientGroup) add(conn *connection.Connection) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if !slices.Contains(g.conns, conn) {
+		g.conns = append(g.conns, conn)
+	}
+}
+
+// remove drops conn from the group and reports whether the group is now empty.
+func (g *clientGroup) remove(conn *connection.Connection) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.conns = slices.DeleteFunc(g.conns, func(c *connection.Connection) bool {
+		return c == conn
+	})
+
+	return len(g.conns) == 0
+}
+
+func (g *clientGroup) list() []*connection.Connection {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	return slices.Clone(g.conns)
+}
+
+// primary returns the first connected connection of the group.
+func (g *clientGroup) primary() (*connection.Connection, bool) {
+	for _, conn := range g.list() {
+		if conn.Connected() {
+			return conn, true
+		}
+	}
+	return nil, false
+}
+
+func (g *clientGroup) connected() bool {
+	_, ok := g.primary()
+	return ok
+}
+
+func (g *clientGroup) closeAll() {
+	for _, conn := range g.list() {
+		conn.Close()
+	}
+}
+
+func (g *clientGroup) has(conn *connection.Connection) bool {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	return slices.Contains(g.conns, conn)
+}
+
+// find returns the group member that owns stream.
+func (g *clientGroup) find(stream transport.Stream) (*connection.Connection, bool) {
+	for _, conn := range g.list() {
+		if conn.Owns(stream) {
+			return conn, true
+		}
+	}
+	return nil, false
+}
+
+// acquire opens a stream on the next connection, moving on to the following
+// member when a connection has exhausted its stream limit. Draining
+// connections are only used once every other member has been tried.
+func (g *clientGroup) acquire() (transport.Stream, error) {
+	conns := g.list()
+	if len(conns) == 0 {
+		return nil, ErrNoConnection
+	}
+
+	start := g.next.Add(1)
+	ordered := make([]*connection.Connection, 0, len(conns))
+	var draining []*connection.Connection
+	for i := range conns {
+		//nolint:gosec // G115: len(conns) is small and positive
+		conn := conns[(start+uint64(i))%uint64(len(conns))]
+		if !conn.Connected() {
+			continue
+		}
+		if conn.Draining() {
+			draining = append(draining, conn)
+			continue
+		}
+		ordered = append(ordered, conn)
+	}
+
+	var lastErr error = ErrNoConnection
+	for _, conn := range append(ordered, draining...) {
+		stream, err := conn.Acquire()
+		if err == nil {
+			return stream, nil
+		}
+		lastErr = err
+		if !errors.Is(err, transport.ErrStreamLimit) {
+			return nil, err
+		}
+	}
+
+	return nil, lastErr
+}
@@ -0,0 +1,45 @@
+package manager
+
+import (
+	"net/http"
+	"strings"
+)
+
+// AllTunnels selects every tunnel in per-subdomain server settings.
+const AllTunnels = "*"
+
+// SetResponseHeaders makes the server set headers on every response proxied
+// for subdomain, or for all tunnels with AllTunnels. Values may contain
+// {subdomain} and {connection_id}, replaced per request. Headers of a
+// subdomain override the ones set for all tunnels, and both override the
+// backend's.
+func (m *Manager) SetResponseHeaders(subdomain string, headers map[string]string) {
+	if len(headers) == 0 {
+		m.responseHeaders.Delete(subdomain)
+		return
+	}
+
+	canonical := make(http.Header, len(headers))
+	for name, value := range headers {
+		canonical.Set(name, value)
+	}
+	m.responseHeaders.Store(subdomain, canonical)
+}
+
+// injectResponseHeaders applies the configured headers for subdomain to h.
+func (m *Manager) injectResponseHeaders(h http.Header, subdomain, connectionID string) {
+	replacer := strings.NewReplacer("{subdomain}", subdomain, "{connection_id}", connectionID)
+	for _, key := range []string{AllTunnels, subdomain} {
+		value, ok := m.responseHeaders.Load(key)
+		if !ok {
+			continue
+		}
+		headers, ok := value.(http.Header)
+		if !ok {
+			continue
+		}
+		for name, values := range headers {
+			h.Set(name, replacer.Replace(values[0]))
+		}
+	}
+}
@@ -0,0 +1,289 @@
+package manager
+
+import (
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/snakeice/gunnel/pkg/connection"
+	"github.com/snakeice/gunnel/pkg/logging"
+	"github.com/snakeice/gunnel/pkg/metrics"
+)
+
+// TunnelState summarizes the health of a tunnel for its users.
+type TunnelState string
+
+const (
+	// StateRegistered is a tunnel whose client has not sent a heartbeat nor
+	// answered a request yet.
+	StateRegistered TunnelState = "registered"
+	// StateOnline is a tunnel with timely heartbeats and few errors.
+	StateOnline TunnelState = "online"
+	// StateDegraded is a tunnel with overdue heartbeats or many failed
+	// requests.
+	StateDegraded TunnelState = "degraded"
+	// StateDraining is a tunnel whose connections are all being replaced.
+	StateDraining TunnelState = "draining"
+	// StateOffline is a known tunnel without a connected client.
+	StateOffline TunnelState = "offline"
+)
+
+// TunnelStates lists every state a tunnel can be in.
+func TunnelStates() []TunnelState {
+	return []TunnelState{StateRegistered, StateOnline, StateDegraded, StateDraining, StateOffline}
+}
+
+const (
+	// healthWindow is how far back request outcomes count, in one minute
+	// buckets.
+	healthWindow = 5
+	// degradedErrorRate marks a tunnel degraded once that share of at least
+	// minRateRequests recent requests failed.
+	degradedErrorRate = 0.5
+	minRateRequests   = 5
+	// forgetOffline drops tunnels offline for this long, unless named.
+	forgetOffline = time.Hour
+)
+
+// TunnelStatus is the machine-readable health of a tunnel.
+type TunnelStatus struct {
+	Subdomain string      `json:"subdomain"`
+	State     TunnelState `json:"state"`
+	Reason    string      `json:"reason,omitempty"`
+	// Since is when the tunnel entered State.
+	Since         time.Time `json:"since"`
+	Connections   int       `json:"connections"`
+	Paused        bool      `json:"paused"`
+	LastHeartbeat time.Time `json:"last_heartbeat,omitzero"`
+	// Requests and ErrorRate cover the last five minutes; failures are
+	// proxy errors and 5xx responses.
+	Requests  int64   `json:"requests"`
+	ErrorRate float64 `json:"error_rate"`
+}
+
+type healthBucket struct {
+	minute        int64
+	total, failed int64
+}
+
+// tunnelHealth keeps the recent request outcomes and state of a tunnel.
+type tunnelHealth struct {
+	mu      sync.Mutex
+	buckets [healthWindow]healthBucket
+	state   TunnelState
+	since   time.Time
+	// closeReason is why the last client connection closed.
+	closeReason string
+}
+
+func (h *tunnelHealth) record(now time.Time, failed bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	minute := now.Unix() / 60
+	b := &h.buckets[minute%healthWindow]
+	if b.minute != minute {
+		*b = healthBucket{minute: minute}
+	}
+	b.total++
+	if failed {
+		b.failed++
+	}
+}
+
+func (h *tunnelHealth) outcomes(now time.Time) (int64, int64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var total, failed int64
+	minute := now.Unix() / 60
+	for _, b := range h.buckets {
+		if minute-b.minute < healthWindow {
+			total += b.total
+			failed += b.failed
+		}
+	}
+	return total, failed
+}
+
+// observe records state and returns since when the tunnel is in it and
+// whether it just entered it.
+func (h *tunnelHealth) observe(subdomain string, state TunnelState, reason string, now time.Time) (time.Time, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	changed := h.state != state
+	if changed {
+		if h.state != "" {
+			logging.Control.WithFields(logrus.Fields{
+				"subdomain": subdomain,
+				"from":      h.state,
+				"to":        state,
+				"reason":    reason,
+			}).Info("Tunnel state changed")
+		}
+		h.state, h.since = state, now
+	}
+	return h.since, changed
+}
+
+func (h *tunnelHealth) lastCloseReason() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.closeReason
+}
+
+func (m *Manager) healthOf(subdomain string) *tunnelHealth {
+	value, _ := m.health.LoadOrStore(subdomain, &tunnelHealth{})
+	h, _ := value.(*tunnelHealth)
+	return h
+}
+
+// recordOutcome counts a proxied request of a registered tunnel.
+func (m *Manager) recordOutcome(subdomain string, failed bool, bytesIn, bytesOut int64) {
+	value, ok := m.health.Load(subdomain)
+	if !ok {
+		return
+	}
+	if h, ok := value.(*tunnelHealth); ok {
+		h.record(time.Now(), failed)
+	}
+	if m.series != nil {
+		m.series.Record(subdomain, failed, bytesIn, bytesOut)
+	}
+}
+
+// TunnelStatus returns the health of subdomain; false means the server
+// knows no such tunnel.
+func (m *Manager) TunnelStatus(subdomain string) (TunnelStatus, bool) {
+	value, tracked := m.health.Load(subdomain)
+	h, _ := value.(*tunnelHealth)
+	if !tracked {
+		if _, named := m.namedTunnelFor(subdomain); !named {
+			return TunnelStatus{}, false
+		}
+		h = m.healthOf(subdomain)
+	}
+	return m.tunnelStatus(subdomain, h, time.Now()), true
+}
+
+// TunnelStatuses returns the health of every known tunnel, sorted by
+// subdomain.
+func (m *Manager) TunnelStatuses() []TunnelStatus {
+	for _, t := range m.NamedTunnels() {
+		m.healthOf(t.Subdomain)
+	}
+
+	now := time.Now()
+	list := make([]TunnelStatus, 0)
+	m.health.Range(func(key, value any) bool {
+		subdomain, _ := key.(string)
+		if h, ok := value.(*tunnelHealth); ok {
+			list = append(list, m.tunnelStatus(subdomain, h, now))
+		}
+		return true
+	})
+	slices.SortFunc(list, func(a, b TunnelStatus) int { return strings.Compare(a.Subdomain, b.Subdomain) })
+	return list
+}
+
+// UpdateTunnelStates refreshes the tunnel state metrics and forgets tunnels
+// that have been offline for a long time.
+func (m *Manager) UpdateTunnelStates() {
+	states := make([]string, 0, len(TunnelStates()))
+	for _, s := range TunnelStates() {
+		states = append(states, string(s))
+	}
+
+	now := time.Now()
+	for _, st := range m.TunnelStatuses() {
+		if st.State == StateOffline && now.Sub(st.Since) > forgetOffline {
+			if _, named := m.namedTunnelFor(st.Subdomain); !named {
+				m.health.Delete(st.Subdomain)
+				m.public.Delete(st.Subdomain)
+				metrics.RemoveTunnelState(st.Subdomain)
+				continue
+			}
+		}
+		metrics.SetTunnelState(st.Subdomain, string(st.State), states)
+	}
+}
+
+// refreshTunnelState updates the state of subdomain at once, e.g. to mark
+// it offline as soon as its client is gone instead of at the next update.
+func (m *Manager) refreshTunnelState(subdomain string) {
+	value, ok := m.health.Load(subdomain)
+	if !ok {
+		return
+	}
+	h, _ := value.(*tunnelHealth)
+	st := m.tunnelStatus(subdomain, h, time.Now())
+
+	states := make([]string, 0, len(TunnelStates()))
+	for _, s := range TunnelStates() {
+		states = append(states, string(s))
+	}
+	metrics.SetTunnelState(subdomain, string(st.State), states)
+}
+
+func (m *Manager) tunnelStatus(subdomain string, h *tunnelHealth, now time.Time) TunnelStatus {
+	st := TunnelStatus{Subdomain: subdomain, Paused: m.isPaused(subdomain)}
+
+	var conns []*connection.Connection
+	if group, ok := m.getGroup(subdomain); ok {
+		for _, conn := range group.list() {
+			if conn.Connected() {
+				conns = append(conns, conn)
+			}
+		}
+	}
+	st.Connections = len(conns)
+
+	var lastSign time.Time
+	var interval time.Duration
+	heard, draining := false, len(conns) > 0
+	for _, conn := range conns {
+		last, received := conn.LastHeartbeat()
+		if last.After(lastSign) {
+			lastSign = last
+		}
+		if received && last.After(st.LastHeartbeat) {
+			st.LastHeartbeat = last
+		}
+		heard = heard || received
+		interval = max(interval, conn.HeartbeatInterval())
+		draining = draining && conn.Draining()
+	}
+
+	total, failed := h.outcomes(now)
+	st.Requests = total
+	if total > 0 {
+		st.ErrorRate = float64(failed) / float64(total)
+	}
+
+	switch {
+	case len(conns) == 0:
+		st.State, st.Reason = StateOffline, "no client connected"
+		if reason := h.lastCloseReason(); reason != "" {
+			st.Reason = "client disconnected: " + reason
+		}
+	case draining:
+		st.State, st.Reason = StateDraining, "connections are being replaced"
+	case now.Sub(lastSign) > 2*interval:
+		st.State, st.Reason = StateDegraded, "heartbeat overdue"
+	case total >= minRateRequests && st.ErrorRate >= degradedErrorRate:
+		st.State, st.Reason = StateDegraded, "high error rate"
+	case !heard && total == failed:
+		st.State, st.Reason = StateRegistered, "waiting for the first heartbeat"
+	default:
+		st.State = StateOnline
+	}
+	since, changed := h.observe(subdomain, st.State, st.Reason, now)
+	st.Since = since
+	if changed {
+		m.uptimeHistory().record(subdomain, StateChange{State: st.State, Reason: st.Reason, At: now})
+	}
+	return st
+}
@@ -0,0 +1,211 @@
+package manager
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/snakeice/gunnel/pkg/metrics"
+	"github.com/snakeice/gunnel/pkg/transport"
+)
+
+const (
+	// DefaultHedgeBudget is the share of requests that may be hedged.
+	DefaultHedgeBudget = 0.1
+	// hedgeBurst is how many hedges an idle tunnel may send in a row.
+	hedgeBurst = 10
+)
+
+// HedgePolicy sends a second copy of idempotent requests that got no answer
+// after Delay on a new stream and uses whichever response arrives first.
+// Budget bounds hedges to that share of each tunnel's requests, so a slow
+// backend does not receive twice the load.
+type HedgePolicy struct {
+	Delay  time.Duration
+	Budget float64
+}
+
+type hedger struct {
+	HedgePolicy
+
+	budgets sync.Map
+}
+
+// retryBudget earns ratio for every request and spends one per hedge, up to
+// hedgeBurst saved.
+type retryBudget struct {
+	mu      sync.Mutex
+	ratio   float64
+	balance float64
+}
+
+func (b *retryBudget) deposit() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.balance = min(b.balance+b.ratio, hedgeBurst)
+}
+
+func (b *retryBudget) withdraw() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.balance < 1 {
+		return false
+	}
+	b.balance--
+	return true
+}
+
+// SetHedgePolicy enables hedging of slow idempotent requests; nil disables it.
+func (m *Manager) SetHedgePolicy(p *HedgePolicy) {
+	if p == nil || p.Delay <= 0 {
+		m.hedging.Store(nil)
+		return
+	}
+	h := &hedger{HedgePolicy: *p}
+	if h.Budget <= 0 {
+		h.Budget = DefaultHedgeBudget
+	}
+	m.hedging.Store(h)
+}
+
+// hedgerFor returns the hedger to use for req, or nil when req must only be
+// sent once.
+func (m *Manager) hedgerFor(req *http.Request) *hedger {
+	h := m.hedging.Load()
+	if h == nil {
+		return nil
+	}
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+	default:
+		return nil
+	}
+	if hasBody(req) || req.Header.Get("Upgrade") != "" {
+		return nil
+	}
+	return h
+}
+
+func (h *hedger) budget(subdomain string) *retryBudget {
+	value, _ := h.budgets.LoadOrStore(subdomain, &retryBudget{ratio: h.Budget, balance: hedgeBurst})
+	budget, _ := value.(*retryBudget)
+	return budget
+}
+
+// tryHedgedRequest proxies req like tryProxyRequest, hedging it when the
+// first attempt is slow. It returns the stream that served the response, or
+// failed last, which the caller releases like the one it passed in.
+func (m *Manager) tryHedgedRequest(
+	primary transport.Stream,
+	w http.ResponseWriter,
+	req *http.Request,
+	subdomain string,
+	logger *logrus.Entry,
+	h *hedger,
+) (transport.Stream, int, int64, error) {
+	resp, stream, err := m.hedgedRoundTrip(primary, req, subdomain, logger, h)
+	if err != nil {
+		return stream, 0, 0, err
+	}
+	status, written, err := m.writeResponse(w, req, resp, subdomain, stream, streamLogger(logger, stream))
+	return stream, status, written, err
+}
+
+type attempt struct {
+	stream transport.Stream
+	resp   *http.Response
+	err    error
+}
+
+func (m *Manager) hedgedRoundTrip(
+	primary transport.Stream,
+	req *http.Request,
+	subdomain string,
+	logger *logrus.Entry,
+	h *hedger,
+) (*http.Response, transport.Stream, error) {
+	budget := h.budget(subdomain)
+	budget.deposit()
+
+	results := make(chan attempt, 2)
+	inflight := make(map[transport.Stream]bool, 2)
+	send := func(stream transport.Stream) {
+		inflight[stream] = true
+		// Each attempt rewrites its own copy of the headers.
+		clone := req.Clone(req.Context())
+		go func() {
+			resp, _, err := m.roundTrip(stream, clone, subdomain, streamLogger(logger, stream))
+			results <- attempt{stream: stream, resp: resp, err: err}
+		}()
+	}
+	send(primary)
+
+	timer := time.NewTimer(h.Delay)
+	defer timer.Stop()
+
+	var failed *attempt
+	for {
+		select {
+		case <-timer.C:
+			if !budget.withdraw() {
+				logger.Debug("Hedge budget exhausted")
+				continue
+			}
+			hedge, err := m.Acquire(subdomain)
+			if err != nil {
+				logger.WithError(err).Debug("No stream for hedged request")
+				continue
+			}
+			logger.WithField("delay", h.Delay).Debug("Hedging slow request")
+			send(hedge)
+
+		case a := <-results:
+			delete(inflight, a.stream)
+			if a.err != nil {
+				if failed != nil {
+					m.discardAttempt(*failed, subdomain, logger)
+				}
+				failed = &a
+				if len(inflight) == 0 {
+					return nil, a.stream, a.err
+				}
+				continue
+			}
+
+			if failed != nil {
+				m.discardAttempt(*failed, subdomain, logger)
+			}
+			if len(inflight) > 0 || a.stream != primary {
+				metrics.RecordHedge(subdomain, a.stream != primary)
+			}
+			// The slower attempt is abandoned; closing its stream ends it.
+			for stream := range inflight {
+				if err := stream.Close(); err != nil {
+					logger.WithError(err).Debug("Failed to close hedged stream")
+				}
+			}
+			go m.discardAttempts(results, len(inflight), subdomain, logger)
+			return a.resp, a.stream, nil
+		}
+	}
+}
+
+// discardAttempts collects the attempts still running once another one won.
+func (m *Manager) discardAttempts(results <-chan attempt, pending int, subdomain string, logger *logrus.Entry) {
+	for range pending {
+		m.discardAttempt(<-results, subdomain, logger)
+	}
+}
+
+func (m *Manager) discardAttempt(a attempt, subdomain string, logger *logrus.Entry) {
+	if a.resp != nil {
+		if err := a.resp.Body.Close(); err != nil {
+			logger.WithError(err).Debug("Failed to close hedged response")
+		}
+	}
+	if err := a.stream.Close(); err != nil {
+		logger.WithError(err).Debug("Failed to close hedged stream")
+	}
+	m.Release(subdomain, a.stream)
+}
@@ -0,0 +1,33 @@
+package manager_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/snakeice/gunnel/pkg/manager"
+)
+
+func TestHedgeBudget(t *testing.T) {
+	m := manager.New()
+	m.SetHedgePolicy(&manager.HedgePolicy{Delay: time.Second, Budget: 0.5})
+
+	// The budget starts with a burst of 10 and earns half a hedge per
+	// request, so 19 slow requests in a row are hedged.
+	for i := range 19 {
+		if !m.SpendHedge("demo", true) {
+			t.Fatalf("slow request %d was not hedged", i+1)
+		}
+	}
+	if m.SpendHedge("demo", true) {
+		t.Fatal("slow request was hedged with the budget spent")
+	}
+	if !m.SpendHedge("other", true) {
+		t.Fatal("a tunnel's spent budget stopped hedges of another")
+	}
+
+	// Requests answered in time earn hedges back.
+	m.SpendHedge("demo", false)
+	if !m.SpendHedge("demo", true) {
+		t.Fatal("slow request was not hedged once the budget recovered")
+	}
+}
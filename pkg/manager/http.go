@@ -10,37 +10,94 @@ import (
 	"time"
 
 	"github.com/caddyserver/certmagic"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
+	"github.com/snakeice/gunnel/pkg/logging"
 	"github.com/snakeice/gunnel/pkg/metrics"
 	"github.com/snakeice/gunnel/pkg/protocol"
 	"github.com/snakeice/gunnel/pkg/transport"
+	"github.com/snakeice/gunnel/pkg/tunnel"
 )
 
 func (m *Manager) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	if req.URL.Path == "/metrics" {
-		promhttp.Handler().ServeHTTP(w, req)
-		return
-	}
-
 	subdomain := extractSubdomain(req)
 	if subdomain == gunnelSubdomain {
 		m.handleGunnel(w, req)
 		return
 	}
+	if subdomain == statusSubdomain && m.statusPageEnabled() {
+		m.handleStatusPage(w, req)
+		return
+	}
 
-	logger := logrus.WithFields(logrus.Fields{
+	req, subdomain, redirected := m.routeByPath(w, req, subdomain)
+	if redirected {
+		return
+	}
+	subdomain = m.ResolveShareLink(subdomain)
+
+	logPolicy := m.requestLogPolicy(subdomain)
+	target := logPolicy.redact(req.URL)
+	logger := logging.HTTPEdge.WithFields(logrus.Fields{
 		"subdomain": subdomain,
-		"req":       fmt.Sprintf("%s %s", req.Method, req.URL),
+		"req":       fmt.Sprintf("%s %s", req.Method, target),
 	})
 
-	logger.Infof("%s %s", req.Method, req.URL)
+	sw := &statusWriter{ResponseWriter: w}
+	w = sw
+	defer logRequest(logger, logPolicy, req, target, sw, time.Now())
+
+	if m.isPaused(subdomain) && m.HasKnownSubdomain(subdomain) {
+		logger.Debug("Tunnel paused by its owner")
+		m.serveOffline(w, subdomain, "This tunnel has been paused by its owner.", time.Time{}, logger)
+		return
+	}
+
+	if next, offline := m.offlineUntil(subdomain, time.Now()); offline && m.HasKnownSubdomain(subdomain) {
+		logger.Debug("Tunnel outside its scheduled hours")
+		m.serveOffline(w, subdomain, "This tunnel is only available during scheduled hours.", next, logger)
+		return
+	}
+
+	if m.HasKnownSubdomain(subdomain) && !m.authorize(w, req, subdomain, logger) {
+		return
+	}
+
+	release, exhausted := m.memory.admit()
+	if release == nil {
+		logger.WithField("resource", exhausted).Warn("Server at its memory limits, shedding request")
+		metrics.RecordLoadShed(exhausted)
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "503 Service Unavailable: server overloaded", http.StatusServiceUnavailable)
+		return
+	}
+	defer release()
+
+	capture := m.capture(req, subdomain, sw)
+	defer capture.done(sw)
+
+	if ep := m.uploadEndpoint(req, subdomain); ep != nil {
+		m.handleUpload(w, req, subdomain, ep, logger)
+		return
+	}
 
 	if err := m.handleProxyFlow(w, req, subdomain, logger); err != nil {
 		m.handleProxyError(w, req, subdomain, logger, err)
 	}
 }
 
+// authorize runs the access checks configured for subdomain, cheapest first.
+// It reports whether the request may be proxied; otherwise the rejection has
+// been written to w.
+func (m *Manager) authorize(w http.ResponseWriter, req *http.Request, subdomain string, logger *logrus.Entry) bool {
+	if !m.authorizeClientCert(w, req, subdomain, logger) {
+		return false
+	}
+	if m.forwardAuth != nil && !m.forwardAuth.authorize(w, req, m.clientIP(req), logger) {
+		return false
+	}
+	return m.authorizeJWT(w, req, subdomain, logger)
+}
+
 func (m *Manager) handleProxyError(
 	w http.ResponseWriter,
 	req *http.Request,
@@ -48,27 +105,42 @@ func (m *Manager) handleProxyError(
 	logger *logrus.Entry,
 	err error,
 ) {
-	logger.WithError(err).Error("Proxy flow failed")
-	status := http.StatusInternalServerError
-
 	if errors.Is(err, ErrNoConnection) || errors.Is(err, ErrSubdomainNotFound) {
-		status = http.StatusNotFound
-		if m.honeypot != nil && subdomain != "" {
-			m.serveHoneypotResponse(w, req, subdomain, logger)
+		if m.honeypot != nil && subdomain != "" && m.serveHoneypotResponse(w, req, subdomain, logger) {
 			return
 		}
+		m.serveNotFound(w, req)
+		return
 	}
-	http.Error(w, err.Error(), status)
+
+	var streamErr *streamError
+	if errors.As(err, &streamErr) {
+		serveGatewayError(w, req, streamErr.status(), streamErr.reason(), logger)
+		return
+	}
+
+	logger.WithError(err).Error("Proxy flow failed")
+
+	if errors.Is(err, ErrTunnelAtCapacity) {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "503 Service Unavailable: tunnel at capacity", http.StatusServiceUnavailable)
+		return
+	}
+
+	serveGatewayError(w, req, http.StatusBadGateway, badGatewayReason, logger)
 }
 
+// serveHoneypotResponse records a request for an unknown subdomain and, once
+// its source looks like a scanner, answers it with a fake response. It
+// reports whether it wrote the response.
 func (m *Manager) serveHoneypotResponse(
 	w http.ResponseWriter,
 	req *http.Request,
 	subdomain string,
 	logger *logrus.Entry,
-) {
-	ip := extractClientIP(req)
-	m.honeypot.RecordRequest(req, subdomain)
+) bool {
+	ip := m.clientIP(req)
+	m.honeypot.RecordRequest(req, ip, subdomain)
 
 	if m.honeypot.IsSuspicious(ip) {
 		delay := m.honeypot.GetDelay(ip)
@@ -84,56 +156,9 @@ func (m *Manager) serveHoneypotResponse(
 			logger.WithError(writeErr).Warn("Failed to write fake response")
 		}
 
-		return
-	}
-}
-
-func extractClientIP(req *http.Request) string {
-	xff := req.Header.Get("X-Forwarded-For")
-	if xff != "" {
-		parts := splitCSV(xff)
-		if len(parts) > 0 {
-			return trimSpace(parts[0])
-		}
-	}
-
-	xri := req.Header.Get("X-Real-IP")
-	if xri != "" {
-		return trimSpace(xri)
-	}
-
-	host, _, err := net.SplitHostPort(req.RemoteAddr)
-	if err != nil {
-		return req.RemoteAddr
-	}
-	return host
-}
-
-func splitCSV(s string) []string {
-	var result []string
-	start := 0
-	for i := 0; i <= len(s); i++ {
-		if i == len(s) || s[i] == ',' {
-			part := trimSpace(s[start:i])
-			if part != "" {
-				result = append(result, part)
-			}
-			start = i + 1
-		}
-	}
-	return result
-}
-
-func trimSpace(s string) string {
-	start := 0
-	end := len(s)
-	for start < end && (s[start] == ' ' || s[start] == '\t' || s[start] == '\n' || s[start] == '\r') {
-		start++
-	}
-	for end > start && (s[end-1] == ' ' || s[end-1] == '\t' || s[end-1] == '\n' || s[end-1] == '\r') {
-		end--
+		return true
 	}
-	return s[start:end]
+	return false
 }
 
 func (m *Manager) handleGunnel(w http.ResponseWriter, req *http.Request) {
@@ -163,19 +188,33 @@ func (m *Manager) handleProxyFlow(
 		stream, err := m.Acquire(subdomain)
 		if err != nil {
 			if errors.Is(err, ErrNoConnection) {
-				logger.Error("No service found for subdomain")
+				logger.Info("No service found for subdomain")
 				metrics.RecordTunnelError(subdomain, "no_connection")
-				return fmt.Errorf("no service found for subdomain %s", subdomain)
+				return fmt.Errorf("no service found for subdomain %s: %w", subdomain, err)
+			}
+			if errors.Is(err, ErrTunnelAtCapacity) {
+				logger.Warn("Tunnel at capacity")
+				m.recordOutcome(subdomain, true, 0, 0)
+				metrics.RecordTunnelError(subdomain, "at_capacity")
+				return err
 			}
 			logger.WithError(err).Error("Failed to acquire transport")
 			metrics.RecordTunnelError(subdomain, "acquire_failed")
 			return fmt.Errorf("service temporarily unavailable: %w", err)
 		}
 
-		statusCode, err := m.tryProxyRequest(stream, w, req, subdomain, logger)
+		var statusCode int
+		var bytesOut int64
+		if h := m.hedgerFor(req); h != nil {
+			stream, statusCode, bytesOut, err = m.tryHedgedRequest(stream, w, req, subdomain, logger, h)
+		} else {
+			statusCode, bytesOut, err = m.tryProxyRequest(stream, w, req, subdomain, logger)
+		}
 		if err == nil {
 			m.Release(subdomain, stream)
+			m.recordOutcome(subdomain, statusCode >= http.StatusInternalServerError, req.ContentLength, bytesOut)
 			metrics.RecordRequest(subdomain, req.Method, statusCode, time.Since(start).Seconds())
+			m.recordUsage(subdomain, req, req.ContentLength, bytesOut)
 			return nil
 		}
 
@@ -187,6 +226,7 @@ func (m *Manager) handleProxyFlow(
 		m.Release(subdomain, stream)
 
 		if !isRetryableError(err) {
+			m.recordOutcome(subdomain, true, 0, 0)
 			metrics.RecordTunnelError(subdomain, lastErrorType)
 			return err
 		}
@@ -195,11 +235,16 @@ func (m *Manager) handleProxyFlow(
 	}
 
 	logger.WithError(lastErr).Error("All retry attempts failed")
+	m.recordOutcome(subdomain, true, 0, 0)
 	metrics.RecordTunnelError(subdomain, lastErrorType)
 	return lastErr
 }
 
 func classifyProxyError(err error) string {
+	var streamErr *streamError
+	if errors.As(err, &streamErr) {
+		return streamErr.code.String()
+	}
 	errStr := err.Error()
 	switch {
 	case strings.Contains(errStr, "not ready in time"):
@@ -216,6 +261,10 @@ func classifyProxyError(err error) string {
 }
 
 func isRetryableError(err error) bool {
+	var streamErr *streamError
+	if errors.As(err, &streamErr) {
+		return false
+	}
 	if errors.Is(err, io.EOF) {
 		return true
 	}
@@ -234,74 +283,236 @@ func (m *Manager) tryProxyRequest(
 	req *http.Request,
 	subdomain string,
 	logger *logrus.Entry,
-) (int, error) {
-	logger = logger.WithFields(logrus.Fields{
-		"stream_id": stream.ID(),
+) (int, int64, error) {
+	logger = streamLogger(logger, stream)
+	resp, keepAlive, err := m.roundTrip(stream, req, subdomain, logger)
+	if err != nil {
+		return 0, 0, err
+	}
+	if resp.StatusCode == http.StatusSwitchingProtocols && isUpgrade(req) {
+		return m.switchProtocols(w, resp, stream, keepAlive, subdomain, logger)
+	}
+	return m.writeResponse(w, req, resp, subdomain, stream, logger)
+}
+
+// hasBody reports whether req carries a body.
+func hasBody(req *http.Request) bool {
+	return req.ContentLength != 0 || (req.Body != nil && req.Body != http.NoBody)
+}
+
+func streamLogger(logger *logrus.Entry, stream transport.Stream) *logrus.Entry {
+	return logger.WithFields(logrus.Fields{
+		"stream_id":     stream.ID(),
+		"connection_id": stream.ConnectionID(),
 	})
+}
+
+// roundTrip asks the client behind stream to proxy req and reads the
+// response headers. The keepalive returned applies if the protocol is
+// switched.
+func (m *Manager) roundTrip(
+	stream transport.Stream,
+	req *http.Request,
+	subdomain string,
+	logger *logrus.Entry,
+) (*http.Response, tunnel.KeepAlive, error) {
+	beginMsg := m.beginMessage(req, subdomain)
+	if err := sendBegin(stream, beginMsg, logger); err != nil {
+		return nil, tunnel.KeepAlive{}, err
+	}
+
+	// A client keeping its backend connection open reads the next request
+	// right after answering, so requests without a body, which a refusal
+	// leaves nothing of, need not wait for its answer.
+	pipelined := stream.Persistent() == subdomain && !isUpgrade(req) && !hasBody(req)
+	var keepAlive tunnel.KeepAlive
+	if !pipelined {
+		ready, err := m.awaitReady(stream, logger)
+		if err != nil {
+			return nil, keepAlive, err
+		}
+		keepAlive = agreedKeepAlive(beginMsg, ready)
+		stream.SetPersistent(persistentFor(ready, subdomain))
+	}
+
+	m.prepareRewrite(req, subdomain)
+	if _, ok := req.Header["User-Agent"]; !ok {
+		// Keep req.Write from adding Go's User-Agent.
+		req.Header["User-Agent"] = []string{""}
+	}
+	if err := req.Write(stream); err != nil {
+		logger.WithError(err).Error("Failed to write request to stream")
+		return nil, keepAlive, fmt.Errorf("failed to write request to stream: %w", err)
+	}
+	if err := stream.Flush(); err != nil {
+		logger.WithError(err).Error("Failed to flush request to stream")
+		return nil, keepAlive, fmt.Errorf("failed to write request to stream: %w", err)
+	}
 
-	beginMsg := &protocol.BeginConnection{Subdomain: subdomain}
+	if pipelined {
+		ready, err := m.awaitReady(stream, logger)
+		if err != nil {
+			return nil, keepAlive, err
+		}
+		stream.SetPersistent(persistentFor(ready, subdomain))
+	}
+
+	if ok, err := receiveStreamError(stream, logger); ok {
+		return nil, keepAlive, err
+	}
+	resp, err := http.ReadResponse(stream.BufferedReader(), req)
+	if err != nil {
+		logger.WithError(err).Log(transport.LogLevel(err), "Failed to read response from stream")
+		return nil, keepAlive, fmt.Errorf("failed to read response: %w", err)
+	}
+	return resp, keepAlive, nil
+}
+
+// beginMessage describes the user of req to the client of subdomain.
+func (m *Manager) beginMessage(req *http.Request, subdomain string) *protocol.BeginConnection {
+	beginMsg := &protocol.BeginConnection{
+		Subdomain:  subdomain,
+		RemoteAddr: req.RemoteAddr,
+		Host:       req.Host,
+	}
+	if ip := m.clientIP(req); ip != "" {
+		if host, _, err := net.SplitHostPort(req.RemoteAddr); err != nil || host != ip {
+			beginMsg.RemoteAddr = net.JoinHostPort(ip, "0")
+		}
+	}
+	if addr, ok := req.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		beginMsg.LocalAddr = addr.String()
+	}
+	if isUpgrade(req) {
+		m.offerKeepAlive(beginMsg)
+	}
+	if req.TLS != nil {
+		beginMsg.TLS = &protocol.TLSInfo{
+			Version:     req.TLS.Version,
+			CipherSuite: req.TLS.CipherSuite,
+			ServerName:  req.TLS.ServerName,
+		}
+	}
+	return beginMsg
+}
+
+// beginStream sends beginMsg to the client behind stream, asking it to open a
+// connection to the backend, and waits until it is ready for data. It returns
+// the stream keepalive the client agreed to.
+func (m *Manager) beginStream(
+	stream transport.Stream,
+	beginMsg *protocol.BeginConnection,
+	logger *logrus.Entry,
+) (tunnel.KeepAlive, error) {
+	if err := sendBegin(stream, beginMsg, logger); err != nil {
+		return tunnel.KeepAlive{}, err
+	}
+	ready, err := m.awaitReady(stream, logger)
+	if err != nil {
+		return tunnel.KeepAlive{}, err
+	}
+	return agreedKeepAlive(beginMsg, ready), nil
+}
+
+// sendBegin sends beginMsg to the client behind stream.
+func sendBegin(stream transport.Stream, beginMsg *protocol.BeginConnection, logger *logrus.Entry) error {
 	logger.Debug("Sending begin connection message")
 	if err := stream.Send(beginMsg); err != nil {
 		logger.WithError(err).Error("Failed to send begin connection message")
-		return 0, fmt.Errorf("failed to send begin connection message: %w", err)
+		return fmt.Errorf("failed to send begin connection message: %w", err)
+	}
+	return nil
+}
+
+// persistentFor returns the subdomain to record with SetPersistent after
+// ready, the client's answer to a request for subdomain.
+func persistentFor(ready *protocol.ConnectionReady, subdomain string) string {
+	if ready.Persistent {
+		return subdomain
 	}
+	return ""
+}
 
-	readyChan := make(chan struct{})
+// awaitReady waits until the client behind stream answers a BeginConnection
+// with ConnectionReady, returning its answer.
+func (m *Manager) awaitReady(stream transport.Stream, logger *logrus.Entry) (*protocol.ConnectionReady, error) {
+	readyChan := make(chan *protocol.ConnectionReady)
 	respChan := make(chan error)
 	doneChan := make(chan struct{})
 
 	go m.readClientMessagesAndProxy(stream, readyChan, respChan, doneChan, logger)
 
 	select {
-	case <-readyChan:
+	case ready := <-readyChan:
 		logger.Debug("Client connection ready for proxying")
 		<-doneChan
+		return ready, nil
 	case <-time.After(streamAcceptTimeout):
 		logger.Error("Client connection not ready in time")
 		<-doneChan
-		return 0, errors.New("client connection not ready in time")
+		return nil, errors.New("client connection not ready in time")
 	case err := <-respChan:
 		<-doneChan
 		if err != nil {
 			logger.WithError(err).Error("Failed before proxy start")
-			return 0, fmt.Errorf("failed before proxy start: %w", err)
+			return nil, fmt.Errorf("failed before proxy start: %w", err)
 		}
 	}
 
-	if err := req.Write(stream); err != nil {
-		logger.WithError(err).Error("Failed to write request to stream")
-		return 0, fmt.Errorf("failed to write request to stream: %w", err)
-	}
+	return &protocol.ConnectionReady{}, nil
+}
 
-	resp, err := http.ReadResponse(stream.BufferedReader(), req)
-	if err != nil {
-		logger.WithError(err).Error("Failed to read response from stream")
-		return 0, fmt.Errorf("failed to read response: %w", err)
-	}
+// writeResponse relays resp, read from stream, to w and closes its body.
+func (m *Manager) writeResponse(
+	w http.ResponseWriter,
+	req *http.Request,
+	resp *http.Response,
+	subdomain string,
+	stream transport.Stream,
+	logger *logrus.Entry,
+) (int, int64, error) {
 	defer func() {
 		if err := resp.Body.Close(); err != nil {
 			logger.WithError(err).Warn("Failed to close response body")
 		}
 	}()
 
+	if resp.Header.Get(protocol.MalformedResponseHeader) != "" {
+		return m.serveMalformed(w, req, resp, subdomain, logger)
+	}
+
+	body, release, err := m.rewriteBody(resp, subdomain, logger)
+	defer release()
+	if err != nil {
+		logger.WithError(err).Log(transport.LogLevel(err), "Failed to read response body for rewriting")
+		return 0, 0, fmt.Errorf("failed to read response: %w", err)
+	}
+
 	for key, values := range resp.Header {
 		for _, value := range values {
 			w.Header().Add(key, value)
 		}
 	}
+	rewriteLocation(w.Header(), req)
+	m.injectResponseHeaders(w.Header(), subdomain, stream.ConnectionID())
 	w.WriteHeader(resp.StatusCode)
 
-	if _, err := io.Copy(w, resp.Body); err != nil {
-		logger.WithError(err).Error("Failed to write response body to client")
-		return resp.StatusCode, nil
+	var written int64
+	if transport.IsStreaming(resp) {
+		written, err = streamBody(w, body, stream, logger)
+	} else {
+		written, err = io.Copy(w, body)
+	}
+	if err != nil {
+		logger.WithError(err).Log(transport.LogLevel(err), "Failed to write response body to client")
 	}
 
-	return resp.StatusCode, nil
+	return resp.StatusCode, written, nil
 }
 
 func (m *Manager) readClientMessagesAndProxy(
 	stream transport.Stream,
-	readyChan chan<- struct{},
+	readyChan chan<- *protocol.ConnectionReady,
 	respChan chan<- error,
 	doneChan chan<- struct{},
 	logger *logrus.Entry,
@@ -311,7 +522,7 @@ func (m *Manager) readClientMessagesAndProxy(
 	for {
 		msg, err := stream.Receive()
 		if err != nil {
-			logger.WithError(err).Error("Failed to read message from client")
+			logger.WithError(err).Log(transport.LogLevel(err), "Failed to read message from client")
 			respChan <- fmt.Errorf("failed to read message: %w", err)
 			return
 		}
@@ -323,15 +534,25 @@ func (m *Manager) readClientMessagesAndProxy(
 			return
 
 		case protocol.MessageConnectionReady:
-			readyMsg := protocol.ConnectionReady{}
-			protocol.Unmarshal(&readyMsg, msg)
+			readyMsg := &protocol.ConnectionReady{}
+			if err := protocol.Unmarshal(readyMsg, msg); err != nil {
+				respChan <- err
+				return
+			}
 			logger.Debug("Received connection ready from proxying message")
-			readyChan <- struct{}{}
+			readyChan <- readyMsg
+			return
+
+		case protocol.MessageStreamError:
+			respChan <- newStreamError(msg, logger)
 			return
 
 		case protocol.MessageError:
 			errMsg := protocol.ErrorMessage{}
-			protocol.Unmarshal(&errMsg, msg)
+			if err := protocol.Unmarshal(&errMsg, msg); err != nil {
+				respChan <- err
+				return
+			}
 			logger.WithField("error", errMsg.Message).Error("Server sent error")
 			respChan <- fmt.Errorf("server error: %s", errMsg.Message)
 			return
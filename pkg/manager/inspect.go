@@ -0,0 +1,394 @@
+package manager
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/snakeice/gunnel/pkg/store"
+)
+
+// Defaults of InspectorConfig.
+const (
+	defaultInspectRequests = 50
+	defaultInspectBody     = 16 << 10
+)
+
+// InspectorConfig sets how much traffic the inspector keeps. Zero fields use
+// the defaults.
+type InspectorConfig struct {
+	// Requests is how many exchanges are kept per subdomain (default 50).
+	Requests int
+	// MaxBody bounds the bytes kept of each request and response body
+	// (default 16KB).
+	MaxBody int
+	// RedactHeaders lists the headers whose values are masked in captured
+	// exchanges; nil uses DefaultRedactHeaders.
+	RedactHeaders []string
+}
+
+// DefaultRedactHeaders carry credentials, which the inspector does not keep.
+//
+//nolint:gochecknoglobals // read-only list
+var DefaultRedactHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie"}
+
+// CapturedRequest is an HTTP exchange kept by the inspector. Bodies are cut
+// at the configured size.
+type CapturedRequest struct {
+	ID        string        `json:"id"`
+	Subdomain string        `json:"subdomain"`
+	At        time.Time     `json:"at"`
+	Duration  time.Duration `json:"duration"`
+	RemoteIP  string        `json:"remote_ip"`
+
+	Method                string      `json:"method"`
+	Host                  string      `json:"host"`
+	Path                  string      `json:"path"`
+	RequestHeaders        http.Header `json:"request_headers"`
+	RequestBody           string      `json:"request_body"`
+	RequestBodySize       int64       `json:"request_body_size"`
+	RequestBodyTruncated  bool        `json:"request_body_truncated"`
+	Status                int         `json:"status"`
+	ResponseHeaders       http.Header `json:"response_headers"`
+	ResponseBody          string      `json:"response_body"`
+	ResponseBodySize      int64       `json:"response_body_size"`
+	ResponseBodyTruncated bool        `json:"response_body_truncated"`
+}
+
+// CapturedSummary is a CapturedRequest without headers and bodies, for
+// listings.
+type CapturedSummary struct {
+	ID        string        `json:"id"`
+	Subdomain string        `json:"subdomain"`
+	At        time.Time     `json:"at"`
+	Duration  time.Duration `json:"duration"`
+	Method    string        `json:"method"`
+	Path      string        `json:"path"`
+	Status    int           `json:"status"`
+}
+
+func (c *CapturedRequest) summary() CapturedSummary {
+	return CapturedSummary{
+		ID:        c.ID,
+		Subdomain: c.Subdomain,
+		At:        c.At,
+		Duration:  c.Duration,
+		Method:    c.Method,
+		Path:      c.Path,
+		Status:    c.Status,
+	}
+}
+
+// inspector keeps the last exchanges of every subdomain in a ring.
+type inspector struct {
+	config InspectorConfig
+	nextID atomic.Uint64
+	// rings holds the *captureRing of each subdomain.
+	rings sync.Map
+
+	// store and key persist the rings once LoadCaptures set them; saveMu
+	// orders the saves and dirty tells whether a ring changed since the last.
+	store  store.Store
+	key    string
+	saveMu sync.Mutex
+	dirty  atomic.Bool
+}
+
+type captureRing struct {
+	mu      sync.Mutex
+	entries []*CapturedRequest
+	next    int
+}
+
+// SetInspector keeps the recent HTTP exchanges of every tunnel for
+// inspection; nil stops capturing and drops what was kept.
+func (m *Manager) SetInspector(config *InspectorConfig) {
+	if config == nil {
+		m.inspector.Store(nil)
+		return
+	}
+	cfg := *config
+	if cfg.Requests <= 0 {
+		cfg.Requests = defaultInspectRequests
+	}
+	if cfg.MaxBody <= 0 {
+		cfg.MaxBody = defaultInspectBody
+	}
+	if cfg.RedactHeaders == nil {
+		cfg.RedactHeaders = DefaultRedactHeaders
+	}
+	m.inspector.Store(&inspector{config: cfg})
+}
+
+// InspectorEnabled reports whether HTTP exchanges are captured.
+func (m *Manager) InspectorEnabled() bool {
+	return m.inspector.Load() != nil
+}
+
+// CapturedRequests lists the exchanges kept for the given subdomains, or for
+// all of them when subdomains is nil, newest first.
+func (m *Manager) CapturedRequests(subdomains []string) []CapturedSummary {
+	list := make([]CapturedSummary, 0)
+	ins := m.inspector.Load()
+	if ins == nil {
+		return list
+	}
+	ins.rings.Range(func(key, value any) bool {
+		subdomain, _ := key.(string)
+		ring, ok := value.(*captureRing)
+		if !ok || (subdomains != nil && !slices.Contains(subdomains, subdomain)) {
+			return true
+		}
+		ring.mu.Lock()
+		for _, c := range ring.entries {
+			list = append(list, c.summary())
+		}
+		ring.mu.Unlock()
+		return true
+	})
+	slices.SortFunc(list, func(a, b CapturedSummary) int { return b.At.Compare(a.At) })
+	return list
+}
+
+// CapturedRequest returns the exchange with id, if it is still kept.
+func (m *Manager) CapturedRequest(id string) (*CapturedRequest, bool) {
+	ins := m.inspector.Load()
+	if ins == nil {
+		return nil, false
+	}
+	var found *CapturedRequest
+	ins.rings.Range(func(_, value any) bool {
+		ring, ok := value.(*captureRing)
+		if !ok {
+			return true
+		}
+		ring.mu.Lock()
+		defer ring.mu.Unlock()
+		for _, c := range ring.entries {
+			if c.ID == id {
+				found = c
+				return false
+			}
+		}
+		return true
+	})
+	return found, found != nil
+}
+
+// purgeCaptured drops the exchanges kept for subdomain and returns how many
+// there were.
+func (m *Manager) purgeCaptured(subdomain string) int {
+	ins := m.inspector.Load()
+	if ins == nil {
+		return 0
+	}
+	value, ok := ins.rings.LoadAndDelete(subdomain)
+	if !ok {
+		return 0
+	}
+	ins.dirty.Store(true)
+	ring, _ := value.(*captureRing)
+	ring.mu.Lock()
+	defer ring.mu.Unlock()
+	return len(ring.entries)
+}
+
+// LoadCaptures reads the exchanges saved at key of st into the inspector and
+// keeps later ones there, see FlushCaptures. A missing key starts empty. It
+// does nothing while the inspector is off.
+func (m *Manager) LoadCaptures(st store.Store, key string) error {
+	ins := m.inspector.Load()
+	if ins == nil {
+		return nil
+	}
+
+	var saved []*CapturedRequest
+	data, err := st.Get(key)
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+	case err != nil:
+		return fmt.Errorf("failed to read captured requests: %w", err)
+	default:
+		if err := json.Unmarshal(data, &saved); err != nil {
+			return fmt.Errorf("failed to parse captured requests: %w", err)
+		}
+	}
+
+	slices.SortFunc(saved, func(a, b *CapturedRequest) int { return a.At.Compare(b.At) })
+	for _, e := range saved {
+		ins.keep(e)
+		if id, err := strconv.ParseUint(e.ID, 10, 64); err == nil && id > ins.nextID.Load() {
+			ins.nextID.Store(id)
+		}
+	}
+	ins.saveMu.Lock()
+	ins.store, ins.key = st, key
+	ins.saveMu.Unlock()
+	return nil
+}
+
+// FlushCaptures saves the kept exchanges to the store given to LoadCaptures
+// when they changed.
+func (m *Manager) FlushCaptures() error {
+	ins := m.inspector.Load()
+	if ins == nil {
+		return nil
+	}
+	ins.saveMu.Lock()
+	defer ins.saveMu.Unlock()
+	if ins.store == nil || !ins.dirty.Swap(false) {
+		return nil
+	}
+
+	saved := make([]*CapturedRequest, 0)
+	ins.rings.Range(func(_, value any) bool {
+		ring, _ := value.(*captureRing)
+		ring.mu.Lock()
+		saved = append(saved, ring.entries...)
+		ring.mu.Unlock()
+		return true
+	})
+	data, err := json.Marshal(saved)
+	if err == nil {
+		err = ins.store.Put(ins.key, data)
+	}
+	if err != nil {
+		ins.dirty.Store(true)
+		return fmt.Errorf("failed to save captured requests: %w", err)
+	}
+	return nil
+}
+
+// capture starts recording the exchange of req, or returns nil when the
+// inspector is off or subdomain has no client, so requests for random names
+// leave nothing behind. The request body is recorded as the backend reads it
+// and the response through w.
+func (m *Manager) capture(req *http.Request, subdomain string, w *statusWriter) *exchangeCapture {
+	ins := m.inspector.Load()
+	if ins == nil || !m.HasKnownSubdomain(subdomain) {
+		return nil
+	}
+	c := &exchangeCapture{
+		ins: ins,
+		entry: &CapturedRequest{
+			ID:             strconv.FormatUint(ins.nextID.Add(1), 10),
+			Subdomain:      subdomain,
+			At:             time.Now(),
+			RemoteIP:       m.clientIP(req),
+			Method:         req.Method,
+			Host:           req.Host,
+			Path:           req.URL.RequestURI(),
+			RequestHeaders: ins.redact(req.Header),
+		},
+		requestBody:  &bodyCapture{max: ins.config.MaxBody},
+		responseBody: &bodyCapture{max: ins.config.MaxBody},
+	}
+	if req.Body != nil && req.Body != http.NoBody {
+		req.Body = &teeReadCloser{ReadCloser: req.Body, w: c.requestBody}
+	}
+	w.capture = c.responseBody
+	return c
+}
+
+// redact returns a copy of h with the values of the redacted headers masked.
+func (ins *inspector) redact(h http.Header) http.Header {
+	out := h.Clone()
+	for _, name := range ins.config.RedactHeaders {
+		if values := out.Values(name); len(values) > 0 {
+			masked := make([]string, len(values))
+			for i := range masked {
+				masked[i] = redactedValue
+			}
+			out[http.CanonicalHeaderKey(name)] = masked
+		}
+	}
+	return out
+}
+
+// exchangeCapture is an exchange being recorded.
+type exchangeCapture struct {
+	ins          *inspector
+	entry        *CapturedRequest
+	requestBody  *bodyCapture
+	responseBody *bodyCapture
+}
+
+// done stores the exchange once w holds the response.
+func (c *exchangeCapture) done(w *statusWriter) {
+	if c == nil {
+		return
+	}
+	e := c.entry
+	e.Duration = time.Since(e.At)
+	e.RequestBody, e.RequestBodySize, e.RequestBodyTruncated = c.requestBody.result()
+	e.Status = w.statusCode()
+	header := w.capturedHeader
+	if header == nil {
+		header = w.Header()
+	}
+	e.ResponseHeaders = c.ins.redact(header)
+	e.ResponseBody, e.ResponseBodySize, e.ResponseBodyTruncated = c.responseBody.result()
+
+	c.ins.keep(e)
+	c.ins.dirty.Store(true)
+}
+
+// keep adds e to the ring of its subdomain, replacing the oldest exchange
+// once the ring is full.
+func (ins *inspector) keep(e *CapturedRequest) {
+	value, _ := ins.rings.LoadOrStore(e.Subdomain, &captureRing{})
+	ring, _ := value.(*captureRing)
+	ring.mu.Lock()
+	defer ring.mu.Unlock()
+	if len(ring.entries) < ins.config.Requests {
+		ring.entries = append(ring.entries, e)
+		return
+	}
+	ring.entries[ring.next] = e
+	ring.next = (ring.next + 1) % len(ring.entries)
+}
+
+// bodyCapture keeps the first max bytes written to it and counts the rest.
+type bodyCapture struct {
+	mu   sync.Mutex
+	max  int
+	buf  []byte
+	size int64
+}
+
+func (b *bodyCapture) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.size += int64(len(p))
+	if room := b.max - len(b.buf); room > 0 {
+		b.buf = append(b.buf, p[:min(room, len(p))]...)
+	}
+	return len(p), nil
+}
+
+func (b *bodyCapture) result() (string, int64, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return string(b.buf), b.size, b.size > int64(len(b.buf))
+}
+
+// teeReadCloser copies what is read from the body to w.
+type teeReadCloser struct {
+	io.ReadCloser
+	w io.Writer
+}
+
+func (t *teeReadCloser) Read(p []byte) (int, error) {
+	n, err := t.ReadCloser.Read(p)
+	if n > 0 {
+		_, _ = t.w.Write(p[:n])
+	}
+	return n, err
+}
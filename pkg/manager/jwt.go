@@ -0,0 +1,329 @@
+package manager
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	jose "github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	"github.com/sirupsen/logrus"
+	"github.com/snakeice/gunnel/pkg/logging"
+	"github.com/snakeice/gunnel/pkg/protocol"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	jwksRefreshInterval = 10 * time.Minute
+	// jwksMinRefresh throttles refetches triggered by unknown key IDs.
+	jwksMinRefresh = time.Minute
+	jwksTimeout    = 5 * time.Second
+	jwtLeeway      = 30 * time.Second
+	maxJWKSBody    = 1 << 20
+)
+
+var (
+	ErrMissingToken = errors.New("missing bearer token")
+	ErrUnknownKey   = errors.New("token signed with unknown key")
+	// ErrPrivateJWKS is returned when a client-sent JWKS URL leads to an
+	// address that is not publicly routable.
+	ErrPrivateJWKS = errors.New("jwks url points at a private address")
+)
+
+//nolint:gochecknoglobals // read-only list of accepted algorithms
+var jwtAlgorithms = []jose.SignatureAlgorithm{
+	jose.RS256, jose.RS384, jose.RS512,
+	jose.PS256, jose.PS384, jose.PS512,
+	jose.ES256, jose.ES384, jose.ES512,
+	jose.EdDSA,
+}
+
+// jwtValidator checks bearer tokens against a JWKS for one tunnel.
+type jwtValidator struct {
+	policy protocol.JWTPolicy
+	client *http.Client
+	// fetches lets concurrent requests share one JWKS fetch.
+	fetches singleflight.Group
+
+	mu        sync.Mutex
+	keys      *jose.JSONWebKeySet
+	fetchedAt time.Time
+}
+
+func newJWTValidator(policy protocol.JWTPolicy) *jwtValidator {
+	return &jwtValidator{
+		policy: policy,
+		client: &http.Client{Timeout: jwksTimeout},
+	}
+}
+
+// newClientJWTValidator validates against a policy sent by a client. Its
+// JWKS is only fetched over https from public addresses, checked again on
+// every dial so a hostname cannot resolve the server into its own network.
+func newClientJWTValidator(policy protocol.JWTPolicy) *jwtValidator {
+	dialer := &net.Dialer{Timeout: jwksTimeout, Control: publicOnly}
+	return &jwtValidator{
+		policy: policy,
+		client: &http.Client{
+			Timeout:   jwksTimeout,
+			Transport: &http.Transport{DialContext: dialer.DialContext, TLSHandshakeTimeout: jwksTimeout},
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				if req.URL.Scheme != "https" {
+					return errors.New("jwks redirect leaves https")
+				}
+				if len(via) >= 5 {
+					return errors.New("too many jwks redirects")
+				}
+				return nil
+			},
+		},
+	}
+}
+
+// checkJWKSURL reports why a JWKS URL sent by a client may not be fetched.
+// Hostnames are resolved only when dialing, where publicOnly checks them.
+func checkJWKSURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || u.Scheme != "https" || u.Hostname() == "" {
+		return errors.New("jwks url must be an absolute https URL")
+	}
+	if ip, err := netip.ParseAddr(u.Hostname()); err == nil && !isPublicAddr(ip) {
+		return fmt.Errorf("%w: %s", ErrPrivateJWKS, ip)
+	}
+	return nil
+}
+
+// publicOnly is a dialer Control hook refusing connections to loopback,
+// link-local, private and other non-public addresses.
+func publicOnly(_, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return err
+	}
+	if !isPublicAddr(ip) {
+		return fmt.Errorf("%w: %s", ErrPrivateJWKS, ip)
+	}
+	return nil
+}
+
+func isPublicAddr(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	return ip.IsGlobalUnicast() && !ip.IsPrivate()
+}
+
+// SetJWTPolicy makes the server enforce policy for subdomain regardless of
+// what clients request at registration.
+func (m *Manager) SetJWTPolicy(subdomain string, policy protocol.JWTPolicy) {
+	v := newJWTValidator(policy)
+	m.serverJWT.Store(subdomain, v)
+	m.jwtValidators.Store(subdomain, v)
+}
+
+// setClientJWTPolicy applies the policy a client sent at registration, unless
+// the server configures one for subdomain.
+func (m *Manager) setClientJWTPolicy(subdomain string, policy *protocol.JWTPolicy) {
+	if _, ok := m.serverJWT.Load(subdomain); ok {
+		return
+	}
+	if policy == nil {
+		m.jwtValidators.Delete(subdomain)
+		return
+	}
+	m.jwtValidators.Store(subdomain, newClientJWTValidator(*policy))
+}
+
+// checkClientJWTPolicy reports why the policy a client sent for subdomain
+// cannot be enforced. A server-configured policy replaces it, so it is not
+// checked then.
+func (m *Manager) checkClientJWTPolicy(subdomain string, policy *protocol.JWTPolicy) error {
+	if policy == nil {
+		return nil
+	}
+	if _, ok := m.serverJWT.Load(subdomain); ok {
+		return nil
+	}
+	return checkJWKSURL(policy.JWKSURL)
+}
+
+func (m *Manager) jwtValidator(subdomain string) (*jwtValidator, bool) {
+	value, ok := m.jwtValidators.Load(subdomain)
+	if !ok {
+		return nil, false
+	}
+	v, ok := value.(*jwtValidator)
+	return v, ok
+}
+
+// authorizeJWT validates the bearer token of req when subdomain requires one,
+// replacing claim headers with verified values. It reports whether the
+// request may be proxied; otherwise a 401 has been written.
+func (m *Manager) authorizeJWT(w http.ResponseWriter, req *http.Request, subdomain string, logger *logrus.Entry) bool {
+	v, ok := m.jwtValidator(subdomain)
+	if !ok {
+		return true
+	}
+
+	// Never let callers supply the headers the backend trusts.
+	for _, header := range v.policy.ClaimHeaders {
+		req.Header.Del(header)
+	}
+
+	claims, err := v.validate(req)
+	if err != nil {
+		logger.WithError(err).Info("Rejected request with invalid JWT")
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		http.Error(w, "401 Unauthorized: invalid or missing token", http.StatusUnauthorized)
+		return false
+	}
+
+	for claim, header := range v.policy.ClaimHeaders {
+		if value, ok := claimString(claims[claim]); ok {
+			req.Header.Set(header, value)
+		}
+	}
+
+	return true
+}
+
+func (v *jwtValidator) validate(req *http.Request) (map[string]any, error) {
+	raw, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if !ok || raw == "" {
+		return nil, ErrMissingToken
+	}
+
+	token, err := jwt.ParseSigned(raw, jwtAlgorithms)
+	if err != nil {
+		return nil, err
+	}
+
+	kid := ""
+	if len(token.Headers) > 0 {
+		kid = token.Headers[0].KeyID
+	}
+
+	key, err := v.key(req.Context(), kid)
+	if err != nil {
+		return nil, err
+	}
+
+	var registered jwt.Claims
+	custom := make(map[string]any)
+	if err := token.Claims(key, &registered, &custom); err != nil {
+		return nil, err
+	}
+
+	expected := jwt.Expected{Issuer: v.policy.Issuer, Time: time.Now()}
+	if v.policy.Audience != "" {
+		expected.AnyAudience = jwt.Audience{v.policy.Audience}
+	}
+	if err := registered.ValidateWithLeeway(expected, jwtLeeway); err != nil {
+		return nil, err
+	}
+
+	return custom, nil
+}
+
+// key returns the JWKS key for kid, refreshing the set when it is stale or
+// does not know kid yet. The set is fetched without holding v.mu, so a slow
+// JWKS endpoint does not stall the requests whose key is already known.
+func (v *jwtValidator) key(ctx context.Context, kid string) (*jose.JSONWebKey, error) {
+	v.mu.Lock()
+	age := time.Since(v.fetchedAt)
+	stale := v.keys == nil || age > jwksRefreshInterval || (len(v.lookup(kid)) == 0 && age > jwksMinRefresh)
+	v.mu.Unlock()
+
+	var err error
+	if stale {
+		// The fetch is shared, so it must outlive the request starting it.
+		_, err, _ = v.fetches.Do("", func() (any, error) {
+			return nil, v.refresh(context.WithoutCancel(ctx))
+		})
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.keys == nil && err != nil {
+		return nil, err
+	}
+	keys := v.lookup(kid)
+	if len(keys) == 0 {
+		return nil, ErrUnknownKey
+	}
+	return &keys[0], nil
+}
+
+// lookup returns the keys matching kid. v.mu must be held.
+func (v *jwtValidator) lookup(kid string) []jose.JSONWebKey {
+	if v.keys == nil {
+		return nil
+	}
+	if kid == "" {
+		return v.keys.Keys
+	}
+	return v.keys.Key(kid)
+}
+
+// refresh fetches the key set and swaps it in. A failed fetch keeps the
+// previous set.
+func (v *jwtValidator) refresh(ctx context.Context) error {
+	v.mu.Lock()
+	v.fetchedAt = time.Now()
+	v.mu.Unlock()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, v.policy.JWKSURL, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to fetch JWKS: %w", err)
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			logging.HTTPEdge.WithError(err).Debug("Failed to close JWKS response body")
+		}
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to fetch JWKS: %s", resp.Status)
+	}
+
+	var keys jose.JSONWebKeySet
+	if err := json.NewDecoder(http.MaxBytesReader(nil, resp.Body, maxJWKSBody)).Decode(&keys); err != nil {
+		return fmt.Errorf("failed to decode JWKS: %w", err)
+	}
+
+	v.mu.Lock()
+	v.keys = &keys
+	v.mu.Unlock()
+	return nil
+}
+
+func claimString(value any) (string, bool) {
+	switch v := value.(type) {
+	case nil:
+		return "", false
+	case string:
+		return v, true
+	default:
+		encoded, err := json.Marshal(v)
+		if err != nil {
+			return "", false
+		}
+		return string(encoded), true
+	}
+}
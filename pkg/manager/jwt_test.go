@@ -0,0 +1,170 @@
+package manager_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	jose "github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	"github.com/snakeice/gunnel/pkg/manager"
+	"github.com/snakeice/gunnel/pkg/protocol"
+)
+
+const jwtIssuer = "https://issuer.example.com"
+
+func signJWT(t *testing.T, key *ecdsa.PrivateKey, kid string) string {
+	t.Helper()
+	signer, err := jose.NewSigner(
+		jose.SigningKey{Algorithm: jose.ES256, Key: jose.JSONWebKey{Key: key, KeyID: kid}},
+		(&jose.SignerOptions{}).WithType("JWT"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := jwt.Signed(signer).Claims(jwt.Claims{
+		Issuer: jwtIssuer,
+		Expiry: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+	}).Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestJWKSFetchSharedByConcurrentRequests(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fetches atomic.Int32
+	release := make(chan struct{})
+	jwks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		// The first fetch is slow and fails, as an overloaded issuer would.
+		if fetches.Add(1) == 1 {
+			<-release
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		set := jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{Key: &key.PublicKey, KeyID: "k1", Algorithm: "ES256"}}}
+		if err := json.NewEncoder(w).Encode(set); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer jwks.Close()
+
+	m := manager.New()
+	m.SetJWTPolicy("app", protocol.JWTPolicy{Issuer: jwtIssuer, JWKSURL: jwks.URL})
+	token := signJWT(t, key, "k1")
+	authorize := func() bool {
+		req := httptest.NewRequest(http.MethodGet, "http://app.example.com/", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		return m.AuthorizeJWT(httptest.NewRecorder(), req, "app")
+	}
+
+	const requests = 10
+	var wg sync.WaitGroup
+	allowed := make(chan bool, requests)
+	for range requests {
+		wg.Go(func() { allowed <- authorize() })
+	}
+	// Let every request reach the blocked fetch before answering it.
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(allowed)
+
+	for ok := range allowed {
+		if ok {
+			t.Error("a request was allowed without a key set")
+		}
+	}
+	if got := fetches.Load(); got != 1 {
+		t.Errorf("JWKS fetched %d times, want one fetch shared by the concurrent requests", got)
+	}
+	if !authorize() {
+		t.Error("a valid token was refused once the JWKS endpoint recovered")
+	}
+}
+
+func TestJWTRejectsUnknownKey(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		set := jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{Key: &key.PublicKey, KeyID: "k1", Algorithm: "ES256"}}}
+		if err := json.NewEncoder(w).Encode(set); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer jwks.Close()
+
+	m := manager.New()
+	m.SetJWTPolicy("app", protocol.JWTPolicy{Issuer: jwtIssuer, JWKSURL: jwks.URL})
+
+	for name, token := range map[string]string{
+		"unknown kid": signJWT(t, other, "k2"),
+		"wrong key":   signJWT(t, other, "k1"),
+		"missing":     "",
+		"not a token": "garbage",
+	} {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "http://app.example.com/", nil)
+			if token != "" {
+				req.Header.Set("Authorization", "Bearer "+token)
+			}
+			rec := httptest.NewRecorder()
+			if m.AuthorizeJWT(rec, req, "app") {
+				t.Fatal("request allowed")
+			}
+			if rec.Code != http.StatusUnauthorized {
+				t.Errorf("status = %d, want 401", rec.Code)
+			}
+		})
+	}
+}
+
+func TestClientJWKSNeverFetchedFromPrivateAddress(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fetches atomic.Int32
+	jwks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		fetches.Add(1)
+		set := jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{Key: &key.PublicKey, KeyID: "k1", Algorithm: "ES256"}}}
+		if err := json.NewEncoder(w).Encode(set); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer jwks.Close()
+
+	// The policy skips the registration check, leaving the dialer to notice
+	// that localhost resolves to loopback.
+	m := manager.New()
+	m.SetClientJWTPolicy("app", protocol.JWTPolicy{
+		Issuer:  jwtIssuer,
+		JWKSURL: "http://localhost:" + jwks.URL[strings.LastIndex(jwks.URL, ":")+1:],
+	})
+	req := httptest.NewRequest(http.MethodGet, "http://app.example.com/", nil)
+	req.Header.Set("Authorization", "Bearer "+signJWT(t, key, "k1"))
+	if m.AuthorizeJWT(httptest.NewRecorder(), req, "app") {
+		t.Error("token accepted with keys from a loopback JWKS")
+	}
+	if got := fetches.Load(); got != 0 {
+		t.Errorf("loopback JWKS fetched %d times", got)
+	}
+}
@@ -0,0 +1,35 @@
+package manager
+
+import (
+	"github.com/snakeice/gunnel/pkg/protocol"
+	"github.com/snakeice/gunnel/pkg/tunnel"
+)
+
+// SetStreamKeepAlive pings the clients over TCP and WebSocket streams
+// while they are open, resetting streams that stop answering; nil turns it
+// off. Clients too old for it keep unframed streams.
+func (m *Manager) SetStreamKeepAlive(k *tunnel.KeepAlive) {
+	if k == nil || !k.Enabled() {
+		m.streamKeepAlive.Store(nil)
+		return
+	}
+	cfg := *k
+	m.streamKeepAlive.Store(&cfg)
+}
+
+// offerKeepAlive asks the client, in beginMsg, to use the stream keepalive.
+func (m *Manager) offerKeepAlive(beginMsg *protocol.BeginConnection) {
+	if k := m.streamKeepAlive.Load(); k != nil {
+		beginMsg.KeepAliveInterval = k.Interval
+		beginMsg.KeepAliveTimeout = k.Timeout
+	}
+}
+
+// agreedKeepAlive returns the keepalive offered in beginMsg when ready
+// accepts it.
+func agreedKeepAlive(beginMsg *protocol.BeginConnection, ready *protocol.ConnectionReady) tunnel.KeepAlive {
+	if ready == nil || !ready.KeepAlive {
+		return tunnel.KeepAlive{}
+	}
+	return tunnel.KeepAlive{Interval: beginMsg.KeepAliveInterval, Timeout: beginMsg.KeepAliveTimeout}
+}
@@ -3,13 +3,22 @@ package manager
 import (
 	"errors"
 	"net/http"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/sirupsen/logrus"
+	"github.com/snakeice/gunnel/pkg/clientip"
 	"github.com/snakeice/gunnel/pkg/connection"
 	"github.com/snakeice/gunnel/pkg/honeypot"
+	"github.com/snakeice/gunnel/pkg/logging"
+	"github.com/snakeice/gunnel/pkg/metrics"
+	"github.com/snakeice/gunnel/pkg/protocol"
+	"github.com/snakeice/gunnel/pkg/timeseries"
 	"github.com/snakeice/gunnel/pkg/transport"
+	"github.com/snakeice/gunnel/pkg/tunnel"
+	"github.com/snakeice/gunnel/pkg/usage"
 )
 
 const streamAcceptTimeout = 5 * time.Second
@@ -17,16 +26,104 @@ const streamAcceptTimeout = 5 * time.Second
 var (
 	ErrNoConnection      = errors.New("no connection available")
 	ErrSubdomainNotFound = errors.New("subdomain not found")
+	ErrTunnelAtCapacity  = errors.New("tunnel at capacity")
 )
 
 type Manager struct {
 	subdomains sync.Map
+	// expiries holds a *tunnelExpiry per subdomain registered with a TTL.
+	expiries sync.Map
+	// schedules holds the *schedule.Schedule of subdomains with active hours.
+	schedules sync.Map
+	// paused holds the subdomains whose owner paused public access.
+	paused sync.Map
+	// shares holds the ShareLink of each share link name, see share.go.
+	shares sync.Map
+	// sessions holds the *openSession of each long-lived connection, see
+	// sessions.go.
+	sessions      sync.Map
+	nextSessionID atomic.Uint64
 
 	gunnelSubdomainHandler http.HandlerFunc
+	// statusPageHandler serves status.<domain> (nil when disabled), listing
+	// the subdomains in public.
+	statusPageHandler http.HandlerFunc
+	public            sync.Map
+	// publicURL builds the address returned to clients for their subdomains.
+	publicURL func(subdomain string) string
+	// tcpListeners holds the *tcpListener of each TCP tunnel, see tcp.go.
+	tcpListeners   sync.Map
+	tcpBindAddress string
+	tcpHost        string
+	tcpPorts       portAllocator
+	// tcpGuard enforces the per-IP TCPLimits, see tcplimits.go.
+	tcpGuard tcpGuard
+	// udpTunnels holds the *udpTunnel of each UDP tunnel, see udp.go.
+	udpTunnels sync.Map
+
+	// memory enforces the MemoryLimits, see memory.go.
+	memory memoryGuard
 
 	tokenValidator func(string) bool
+	authorizedKeys map[string]struct{}
+	authMu         sync.RWMutex
+	// teamMembers holds the team tokens by hash; owners holds the team
+	// owning each subdomain registered with such a token.
+	teamMembers []teamToken
+	owners      sync.Map
+	// tenants holds the usage tenant of each subdomain, see tenantFor.
+	tenants sync.Map
+	usage   *usage.Recorder
+	// series records the per-minute traffic charted by the WebUI.
+	series *timeseries.Store
+	// named holds the registry of tunnels created through the admin API.
+	named atomic.Pointer[namedTunnels]
+	// clientTokens holds the registration tokens managed through the admin API.
+	clientTokens atomic.Pointer[clientTokenRegistry]
 
 	honeypot *honeypot.Honeypot
+	// notFound answers requests for unknown subdomains, see NewNotFoundHandler.
+	notFound http.Handler
+
+	forwardAuth *ForwardAuth
+	clientIPs   *clientip.Resolver
+	// jwtValidators holds the *jwtValidator of subdomains requiring a JWT;
+	// serverJWT the ones configured by the operator, which clients cannot change.
+	jwtValidators sync.Map
+	serverJWT     sync.Map
+	// clientCAs holds the *x509.CertPool of subdomains requiring mTLS.
+	clientCAs sync.Map
+	// responseHeaders holds the http.Header injected into the responses of a
+	// subdomain, or of every tunnel under AllTunnels.
+	responseHeaders sync.Map
+	// requestLogs holds the *requestLogPolicy of a subdomain, or of every
+	// tunnel under AllTunnels.
+	requestLogs sync.Map
+	// bodyRewrites holds the []compiledRule applied to response bodies.
+	bodyRewrites sync.Map
+	// uploads holds the *UploadEndpoint of subdomains accepting file drops.
+	uploads sync.Map
+	// pathRouting mounts tunnels under a path of the main domain when set.
+	pathRouting atomic.Pointer[PathRouting]
+	// inspector keeps recent HTTP exchanges when set, see inspect.go.
+	inspector atomic.Pointer[inspector]
+	// malformed holds the last *MalformedResponse of each subdomain.
+	malformed sync.Map
+	// health holds the *tunnelHealth of every tunnel registered so far.
+	health sync.Map
+	// history records the state changes of tunnels for uptime reports.
+	history atomic.Pointer[stateHistory]
+	// hedging re-sends slow idempotent requests when set.
+	hedging atomic.Pointer[hedger]
+	// streamKeepAlive is offered to clients for raw streams when set.
+	streamKeepAlive atomic.Pointer[tunnel.KeepAlive]
+
+	// rotation bounds how long a client connection may stay open.
+	rotation atomic.Pointer[rotationPolicy]
+
+	clientConfig  *protocol.ConfigUpdate
+	configVersion atomic.Uint32
+	configMu      sync.RWMutex
 }
 
 func New() *Manager {
@@ -47,6 +144,12 @@ func (m *Manager) SetGunnelSubdomainHandler(handler http.HandlerFunc) {
 	m.gunnelSubdomainHandler = handler
 }
 
+// SetPublicURL sets how the public address of a subdomain is built; it is
+// sent to clients when they register.
+func (m *Manager) SetPublicURL(fn func(subdomain string) string) {
+	m.publicURL = fn
+}
+
 func (m *Manager) SetTokenValidator(validator func(string) bool) {
 	m.tokenValidator = validator
 }
@@ -58,32 +161,55 @@ func (m *Manager) IsAuthorized(token string) bool {
 	return m.tokenValidator(token)
 }
 
+// ForEachClient calls fn for every connection of every registered subdomain.
+// A client that opened several connections is reported once per connection.
 func (m *Manager) ForEachClient(fn func(subdomain string, info *connection.Connection)) {
 	m.subdomains.Range(func(key, value any) bool {
 		subdomain, ok := key.(string)
 		if !ok {
 			return true
 		}
-		conn, ok := value.(*connection.Connection)
+		group, ok := value.(*clientGroup)
 		if !ok {
 			return true
 		}
-		fn(subdomain, conn)
+		for _, conn := range group.list() {
+			fn(subdomain, conn)
+		}
 		return true
 	})
 }
 
+// forEachConnection calls fn once for every connected connection, regardless
+// of how many subdomains it registered.
+func (m *Manager) forEachConnection(fn func(conn *connection.Connection)) int {
+	seen := make(map[*connection.Connection]struct{})
+	m.ForEachClient(func(_ string, conn *connection.Connection) {
+		if _, ok := seen[conn]; ok || !conn.Connected() {
+			return
+		}
+		seen[conn] = struct{}{}
+		fn(conn)
+	})
+	return len(seen)
+}
+
 func (m *Manager) Acquire(subdomain string) (transport.Stream, error) {
-	client, ok := m.getClient(subdomain)
+	group, ok := m.getGroup(subdomain)
 	if !ok {
 		return nil, ErrSubdomainNotFound
 	}
 
-	stream, err := client.Acquire()
+	start := time.Now()
+	stream, err := group.acquire()
+	metrics.RecordStreamAcquire(subdomain, time.Since(start))
 	if err != nil {
-		logrus.WithFields(logrus.Fields{
+		logging.Control.WithFields(logrus.Fields{
 			"subdomain": subdomain,
 		}).Errorf("Failed to acquire transport stream: %s", err)
+		if errors.Is(err, transport.ErrStreamLimit) {
+			return nil, ErrTunnelAtCapacity
+		}
 		return nil, ErrNoConnection
 	}
 
@@ -91,40 +217,67 @@ func (m *Manager) Acquire(subdomain string) (transport.Stream, error) {
 	return stream, nil
 }
 
-func (m *Manager) getClient(subdomain string) (*connection.Connection, bool) {
+func (m *Manager) getGroup(subdomain string) (*clientGroup, bool) {
 	value, ok := m.subdomains.Load(subdomain)
 	if !ok {
 		return nil, false
 	}
-	conn, ok := value.(*connection.Connection)
+	group, ok := value.(*clientGroup)
+	if !ok {
+		return nil, false
+	}
+	return group, true
+}
+
+func (m *Manager) getClient(subdomain string) (*connection.Connection, bool) {
+	group, ok := m.getGroup(subdomain)
 	if !ok {
 		return nil, false
 	}
-	return conn, true
+	return group.primary()
 }
 
 func (m *Manager) Release(subdomain string, stream transport.Stream) {
-	if client, ok := m.getClient(subdomain); ok {
+	group, ok := m.getGroup(subdomain)
+	if !ok {
+		return
+	}
+	if client, ok := group.find(stream); ok {
 		client.Release(stream)
+		return
+	}
+	if err := stream.Close(); err != nil {
+		logging.Control.WithError(err).Debug("Failed to close orphaned stream")
 	}
 }
 
-func (m *Manager) addClient(subdomain string, client *connection.Connection) {
-	if oldClient, exists := m.getClient(subdomain); exists {
-		if !oldClient.Connected() {
-			m.subdomains.Store(subdomain, client)
+// addClient registers client for subdomain. A connection carrying the same
+// client ID as the current owner joins its group; anything else replaces it.
+func (m *Manager) addClient(subdomain, clientID string, client *connection.Connection) {
+	m.healthOf(subdomain)
+	if group, exists := m.getGroup(subdomain); exists {
+		if group.sameClient(clientID) {
+			group.add(client)
+			logging.Control.WithFields(logrus.Fields{
+				"subdomain": subdomain,
+				"client_id": clientID,
+			}).Info("Added connection to existing client group")
+			return
+		}
+		if !group.connected() {
+			m.subdomains.Store(subdomain, newClientGroup(clientID, client))
 			return
 		}
-		if oldClient != client {
-			logrus.WithField("subdomain", subdomain).
+		if !slices.Contains(group.list(), client) {
+			logging.Control.WithField("subdomain", subdomain).
 				Info("Replacing existing client with new connection")
-			oldClient.Close()
-			m.subdomains.Store(subdomain, client)
+			group.closeAll()
+			m.subdomains.Store(subdomain, newClientGroup(clientID, client))
 		}
 		return
 	}
 
-	m.subdomains.Store(subdomain, client)
+	m.subdomains.Store(subdomain, newClientGroup(clientID, client))
 }
 
 const gunnelSubdomain = "gunnel"
@@ -132,14 +285,26 @@ const gunnelSubdomain = "gunnel"
 // HasKnownSubdomain returns true if the subdomain is either the built-in management
 // UI subdomain or a registered client with an active connection.
 func (m *Manager) HasKnownSubdomain(subdomain string) bool {
-	if subdomain == gunnelSubdomain {
+	if subdomain == gunnelSubdomain || (subdomain == statusSubdomain && m.statusPageEnabled()) {
 		return true
 	}
-	client, ok := m.getClient(subdomain)
-	return ok && client.Connected()
+	group, ok := m.getGroup(subdomain)
+	return ok && group.connected()
 }
 
-func (m *Manager) removeClient(subdomain string) {
-	m.subdomains.Delete(subdomain)
-	logrus.WithField("subdomain", subdomain).Debug("Removed client from registry")
+// removeClient detaches client from subdomain, dropping the route once the
+// last connection of the group is gone.
+func (m *Manager) removeClient(subdomain string, client *connection.Connection) {
+	group, ok := m.getGroup(subdomain)
+	if !ok {
+		return
+	}
+	if group.remove(client) {
+		if m.subdomains.CompareAndDelete(subdomain, group) {
+			m.owners.Delete(subdomain)
+			m.tenants.Delete(subdomain)
+			m.closePublicPorts(subdomain)
+		}
+		logging.Control.WithField("subdomain", subdomain).Debug("Removed client from registry")
+	}
 }
@@ -1,9 +1,21 @@
 package manager_test
 
 import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/snakeice/gunnel/pkg/logging"
 	"github.com/snakeice/gunnel/pkg/manager"
+	"github.com/snakeice/gunnel/pkg/protocol"
+	gunnelquic "github.com/snakeice/gunnel/pkg/quic"
+	"github.com/snakeice/gunnel/pkg/transport"
 )
 
 // TestManagerCreation tests that manager can be created successfully.
@@ -14,3 +26,330 @@ func TestManagerCreation(t *testing.T) {
 	}
 	t.Log("✓ Manager created successfully")
 }
+
+func TestUnknownSubdomainNotFound(t *testing.T) {
+	mgr := manager.New()
+
+	rec := httptest.NewRecorder()
+	mgr.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://missing.example.com/", nil))
+
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+	if strings.Contains(rec.Body.String(), "no service found") {
+		t.Error("404 page leaks the internal error")
+	}
+}
+
+func TestUnknownSubdomainRedirect(t *testing.T) {
+	mgr := manager.New()
+	handler, err := manager.NewNotFoundHandler(manager.NotFoundRedirect, "https://example.com/welcome")
+	if err != nil {
+		t.Fatalf("NewNotFoundHandler() error = %v", err)
+	}
+	mgr.SetNotFoundHandler(handler)
+
+	rec := httptest.NewRecorder()
+	mgr.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://missing.example.com/", nil))
+
+	if rec.Code != http.StatusFound || rec.Header().Get("Location") != "https://example.com/welcome" {
+		t.Errorf("got %d to %q, want a redirect to the landing page", rec.Code, rec.Header().Get("Location"))
+	}
+}
+
+func TestRequestLogPolicy(t *testing.T) {
+	mgr := manager.New()
+	handler, err := manager.NewNotFoundHandler(manager.NotFoundRedirect, "https://example.com/welcome")
+	if err != nil {
+		t.Fatalf("NewNotFoundHandler() error = %v", err)
+	}
+	mgr.SetNotFoundHandler(handler)
+	mgr.SetHoneypot(nil)
+	policy := &manager.RequestLogPolicy{SampleRate: 3, RedactQuery: []string{"*token"}}
+	if err := mgr.SetRequestLogPolicy("missing", policy); err != nil {
+		t.Fatalf("SetRequestLogPolicy() error = %v", err)
+	}
+
+	hook := logtest.NewLocal(logging.HTTPEdge)
+	defer hook.Reset()
+	for range 6 {
+		req := httptest.NewRequest(http.MethodGet, "http://missing.example.com/cb?access_token=secret&page=2", nil)
+		mgr.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	var lines []string
+	for _, entry := range hook.AllEntries() {
+		if strings.HasPrefix(entry.Message, http.MethodGet) {
+			lines = append(lines, entry.Message)
+		}
+	}
+	if len(lines) != 2 {
+		t.Fatalf("logged %d of 6 requests, want 2: %q", len(lines), lines)
+	}
+	if want := "GET http://missing.example.com/cb?access_token=REDACTED&page=2"; lines[0] != want {
+		t.Errorf("logged %q, want %q", lines[0], want)
+	}
+}
+
+func TestNewNotFoundHandlerValidates(t *testing.T) {
+	if _, err := manager.NewNotFoundHandler("teapot", ""); err == nil {
+		t.Error("unknown mode accepted")
+	}
+	if _, err := manager.NewNotFoundHandler(manager.NotFoundProxy, "localhost:8080"); err == nil {
+		t.Error("relative proxy target accepted")
+	}
+}
+
+func TestSubdomainFromHostNormalizesIDN(t *testing.T) {
+	tests := map[string]string{
+		"Test.example.com":       "test",
+		"münchen.example.com":    "xn--mnchen-3ya",
+		"xn--mnchen-3ya.example": "xn--mnchen-3ya",
+		"192.0.2.1":              "",
+	}
+	for host, want := range tests {
+		if got := manager.SubdomainFromHost(host); got != want {
+			t.Errorf("SubdomainFromHost(%q) = %q, want %q", host, got, want)
+		}
+	}
+}
+
+func TestValidateRewriteRules(t *testing.T) {
+	valid := []manager.RewriteRule{
+		{Match: "http://localhost:3000", Replace: "{public_url}"},
+		{Match: `localhost:(\d+)`, Replace: "example.com", Regex: true},
+	}
+	if err := manager.ValidateRewriteRules(valid); err != nil {
+		t.Errorf("ValidateRewriteRules() error = %v", err)
+	}
+	if err := manager.ValidateRewriteRules([]manager.RewriteRule{{Match: "(", Regex: true}}); err == nil {
+		t.Error("invalid regular expression accepted")
+	}
+	if err := manager.ValidateRewriteRules([]manager.RewriteRule{{Replace: "x"}}); err == nil {
+		t.Error("empty match accepted")
+	}
+}
+
+func TestPathRoutingRedirectsToMountRoot(t *testing.T) {
+	mgr := manager.New()
+	mgr.SetPathRouting(&manager.PathRouting{Prefix: "t"})
+
+	rec := httptest.NewRecorder()
+	mgr.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://example.com/t/app?x=1", nil))
+
+	if rec.Code != http.StatusMovedPermanently || rec.Header().Get("Location") != "/t/app/?x=1" {
+		t.Errorf("got %d to %q, want a redirect to the mount root", rec.Code, rec.Header().Get("Location"))
+	}
+}
+
+func TestMountPath(t *testing.T) {
+	tests := map[[2]string]string{
+		{"", "app"}:       "/t/app/",
+		{"/tunnels", ""}:  "/tunnels/",
+		{"/a/b/", "demo"}: "/a/b/demo/",
+	}
+	for in, want := range tests {
+		if got := manager.MountPath(in[0], in[1]); got != want {
+			t.Errorf("MountPath(%q, %q) = %q, want %q", in[0], in[1], got, want)
+		}
+	}
+}
+
+func TestUploadEndpointRequiresToken(t *testing.T) {
+	mgr := manager.New()
+	mgr.SetUploadEndpoint("app", &manager.UploadEndpoint{Token: "s3cret", Target: "/hooks"})
+
+	rec := httptest.NewRecorder()
+	mgr.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "http://app.example.com"+manager.UploadPath, nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("without token: status = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://app.example.com"+manager.UploadPath, nil)
+	req.SetBasicAuth("", "s3cret")
+	rec = httptest.NewRecorder()
+	mgr.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "/hooks") {
+		t.Errorf("with token: status = %d, want the upload form", rec.Code)
+	}
+}
+
+func TestCreateShareLinkRequiresConnectedTunnel(t *testing.T) {
+	mgr := manager.New()
+	if _, err := mgr.CreateShareLink("demo", 0); !errors.Is(err, manager.ErrSubdomainNotFound) {
+		t.Errorf("CreateShareLink() of an unknown tunnel error = %v, want ErrSubdomainNotFound", err)
+	}
+	if _, err := mgr.CreateShareLink("gunnel", 0); !errors.Is(err, manager.ErrSubdomainNotFound) {
+		t.Errorf("CreateShareLink() of the WebUI error = %v, want ErrSubdomainNotFound", err)
+	}
+	if _, err := mgr.CreateShareLink("demo", manager.MaxShareTTL+time.Hour); err == nil {
+		t.Error("CreateShareLink() accepted a ttl over the maximum")
+	}
+	if got := mgr.ResolveShareLink("demo-x7f2"); got != "demo-x7f2" {
+		t.Errorf("ResolveShareLink() of an unknown link = %q, want it unchanged", got)
+	}
+}
+
+func TestReplayTrafficValidates(t *testing.T) {
+	mgr := manager.New()
+	if _, err := mgr.ReplayTraffic(context.Background(), manager.TrafficReplay{From: "hooks"}); err == nil {
+		t.Error("ReplayTraffic() without a target succeeded")
+	}
+	_, err := mgr.ReplayTraffic(context.Background(), manager.TrafficReplay{From: "hooks", To: "staging"})
+	if !errors.Is(err, manager.ErrInspectorDisabled) {
+		t.Errorf("ReplayTraffic() without the inspector error = %v, want ErrInspectorDisabled", err)
+	}
+
+	mgr.SetInspector(&manager.InspectorConfig{})
+	_, err = mgr.ReplayTraffic(context.Background(), manager.TrafficReplay{From: "hooks", To: "staging"})
+	if !errors.Is(err, manager.ErrNoConnection) {
+		t.Errorf("ReplayTraffic() to an unknown tunnel error = %v, want ErrNoConnection", err)
+	}
+}
+
+// fakeTunnel registers subdomain with mgr over a local QUIC connection and
+// answers its requests with the status status returns for their path. A
+// zero status closes the stream without an answer.
+func fakeTunnel(t *testing.T, mgr *manager.Manager, subdomain string, status func(path string) int) {
+	t.Helper()
+	t.Setenv("GUNNEL_INSECURE", "true")
+
+	srv, err := gunnelquic.NewServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(func() {
+		cancel()
+		_ = srv.Close()
+	})
+	go func() {
+		conn, err := srv.Accept(ctx)
+		if err != nil {
+			return
+		}
+		transp, err := transport.NewFromServer(ctx, conn)
+		if err != nil {
+			return
+		}
+		mgr.HandleConnection(transp)
+	}()
+
+	client, err := transport.New(srv.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(client.Close)
+	root := client.Root()
+	if err := root.Send(&protocol.ConnectionRegister{
+		Subdomain: subdomain, Host: "127.0.0.1", Port: 1, Protocol: protocol.HTTP,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		msg, err := root.Receive()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.Type == protocol.MessageConnectionRegisterResp {
+			break
+		}
+	}
+
+	go func() {
+		for {
+			strm, err := client.AcceptStream(ctx)
+			if err != nil {
+				return
+			}
+			go serveFake(strm, subdomain, status)
+		}
+	}()
+}
+
+func serveFake(strm transport.Stream, subdomain string, status func(path string) int) {
+	defer strm.Close()
+	rd := strm.BufferedReader()
+	for {
+		msg, err := strm.Receive()
+		if err != nil || msg.Type != protocol.MessageBeginStream {
+			return
+		}
+		if err := strm.Send(&protocol.ConnectionReady{Subdomain: subdomain}); err != nil {
+			return
+		}
+		req, err := http.ReadRequest(rd)
+		if err != nil {
+			return
+		}
+		if _, err := io.Copy(io.Discard, req.Body); err != nil {
+			return
+		}
+		code := status(req.URL.Path)
+		if code == 0 {
+			return
+		}
+		resp := &http.Response{StatusCode: code, ProtoMajor: 1, ProtoMinor: 1, Body: http.NoBody}
+		if err := resp.Write(strm); err != nil || strm.Flush() != nil {
+			return
+		}
+	}
+}
+
+func TestReplayTrafficAgainstAnotherTunnel(t *testing.T) {
+	mgr := manager.New()
+	mgr.SetInspector(&manager.InspectorConfig{})
+	fakeTunnel(t, mgr, "hooks", func(string) int { return http.StatusOK })
+	fakeTunnel(t, mgr, "staging", func(path string) int {
+		switch path {
+		case "/same":
+			return http.StatusOK
+		case "/changed":
+			return http.StatusInternalServerError
+		default:
+			return 0
+		}
+	})
+
+	paths := []string{"/same", "/changed", "/failed"}
+	for _, path := range paths {
+		rec := httptest.NewRecorder()
+		mgr.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "http://hooks.example.com"+path, strings.NewReader("{}")))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("POST %s = %d", path, rec.Code)
+		}
+	}
+
+	const rate = 10
+	report, err := mgr.ReplayTraffic(context.Background(), manager.TrafficReplay{
+		From: "hooks", To: "staging", Rate: rate,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Sent != 3 || report.Same != 1 || report.Changed != 1 || report.Failed != 1 {
+		t.Errorf("report sent %d, same %d, changed %d, failed %d, want 3, 1, 1, 1",
+			report.Sent, report.Same, report.Changed, report.Failed)
+	}
+	// The first request goes out at once, the others one interval apart.
+	if minimum := time.Duration(len(paths)-1) * time.Second / rate; report.Duration < minimum {
+		t.Errorf("replay took %v, faster than %d requests per second allow (%v)", report.Duration, rate, minimum)
+	}
+
+	if len(report.Diffs) != 2 {
+		t.Fatalf("diffs = %+v, want the changed and the failed request", report.Diffs)
+	}
+	changed, failed := report.Diffs[0], report.Diffs[1]
+	if changed.Path != "/changed" || changed.Status != http.StatusOK ||
+		changed.ReplayStatus != http.StatusInternalServerError || changed.ReplayID == "" {
+		t.Errorf("changed diff = %+v", changed)
+	}
+	if failed.Path != "/failed" || failed.Error == "" || failed.ReplayID != "" {
+		t.Errorf("failed diff = %+v", failed)
+	}
+
+	replayed := mgr.CapturedRequests([]string{"staging"})
+	if len(replayed) != 2 {
+		t.Errorf("captured %d replays on staging, want the 2 that were answered", len(replayed))
+	}
+}
@@ -0,0 +1,106 @@
+package manager
+
+import (
+	"sync/atomic"
+
+	"github.com/snakeice/gunnel/pkg/metrics"
+)
+
+// shedThreshold is the share of MaxBufferedBytes past which new requests are
+// shed, so the ones in flight can still buffer what they need.
+const shedThreshold = 0.9
+
+// MemoryLimits caps what the server holds in memory at once. Zero fields are
+// unlimited.
+type MemoryLimits struct {
+	// MaxStreams bounds the requests and TCP connections proxied at once.
+	MaxStreams int64
+	// MaxBufferedBytes bounds the response bodies buffered for rewriting.
+	MaxBufferedBytes int64
+	// MaxCapturedRequests bounds the requests the honeypot keeps.
+	MaxCapturedRequests int
+}
+
+// memoryGuard tracks the streams in flight and the bytes buffered against
+// MemoryLimits, with their peaks.
+type memoryGuard struct {
+	limits       atomic.Pointer[MemoryLimits]
+	streams      atomic.Int64
+	buffered     atomic.Int64
+	peakStreams  atomic.Int64
+	peakBuffered atomic.Int64
+}
+
+// SetMemoryLimits sets the memory caps; nil removes them.
+func (m *Manager) SetMemoryLimits(limits *MemoryLimits) {
+	if limits == nil {
+		limits = &MemoryLimits{}
+	}
+	m.memory.limits.Store(limits)
+	if m.honeypot != nil {
+		m.honeypot.SetMaxCaptured(limits.MaxCapturedRequests)
+	}
+}
+
+func (g *memoryGuard) current() MemoryLimits {
+	if l := g.limits.Load(); l != nil {
+		return *l
+	}
+	return MemoryLimits{}
+}
+
+// admit takes a stream slot for a new request or TCP connection. It fails
+// with the exhausted resource, for metrics, when the server is at its
+// stream cap or close to its buffer cap; otherwise release must be called
+// once the stream is done.
+func (g *memoryGuard) admit() (func(), string) {
+	limits := g.current()
+	if limits.MaxBufferedBytes > 0 && float64(g.buffered.Load()) >= shedThreshold*float64(limits.MaxBufferedBytes) {
+		return nil, "buffered_bytes"
+	}
+
+	n := g.streams.Add(1)
+	if limits.MaxStreams > 0 && n > limits.MaxStreams {
+		g.streams.Add(-1)
+		return nil, "streams"
+	}
+	raisePeak(&g.peakStreams, n)
+	return func() { g.streams.Add(-1) }, ""
+}
+
+// reserve accounts for n more buffered bytes and reports whether they fit.
+func (g *memoryGuard) reserve(n int64) bool {
+	limit := g.current().MaxBufferedBytes
+	total := g.buffered.Add(n)
+	if limit > 0 && total > limit {
+		g.buffered.Add(-n)
+		return false
+	}
+	raisePeak(&g.peakBuffered, total)
+	return true
+}
+
+func (g *memoryGuard) release(n int64) {
+	g.buffered.Add(-n)
+}
+
+func raisePeak(peak *atomic.Int64, value int64) {
+	for {
+		old := peak.Load()
+		if value <= old || peak.CompareAndSwap(old, value) {
+			return
+		}
+	}
+}
+
+// ReportMemory publishes the memory usage, its peaks and the limits.
+func (m *Manager) ReportMemory() {
+	limits := m.memory.current()
+	metrics.SetMemoryUsage("streams", m.memory.streams.Load(), m.memory.peakStreams.Load(), limits.MaxStreams)
+	metrics.SetMemoryUsage("buffered_bytes",
+		m.memory.buffered.Load(), m.memory.peakBuffered.Load(), limits.MaxBufferedBytes)
+	if m.honeypot != nil {
+		captured, peak := m.honeypot.Captured()
+		metrics.SetMemoryUsage("captured_requests", int64(captured), int64(peak), int64(limits.MaxCapturedRequests))
+	}
+}
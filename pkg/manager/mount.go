@@ -0,0 +1,140 @@
+package manager
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/snakeice/gunnel/pkg/subdomain"
+)
+
+// DefaultMountPrefix is the path under which tunnels are mounted by default.
+const DefaultMountPrefix = "/t/"
+
+// PathRouting exposes tunnels under a path of any host, such as
+// https://example.com/t/<name>/, for domains without wildcard DNS.
+type PathRouting struct {
+	// Prefix precedes the tunnel name (DefaultMountPrefix when empty).
+	Prefix string
+	// RewriteBase adds a <base href> to HTML pages so their relative links
+	// stay under the mount path.
+	RewriteBase bool
+}
+
+type mountKey struct{}
+
+//nolint:gochecknoglobals // compiled once
+var (
+	headTag = regexp.MustCompile(`(?i)<head(\s[^>]*)?>`)
+	baseTag = regexp.MustCompile(`(?i)<base[\s>]`)
+)
+
+// SetPathRouting enables mounting tunnels under a path; nil disables it.
+func (m *Manager) SetPathRouting(pr *PathRouting) {
+	if pr != nil {
+		pr = &PathRouting{Prefix: MountPath(pr.Prefix, ""), RewriteBase: pr.RewriteBase}
+	}
+	m.pathRouting.Store(pr)
+}
+
+// MountPath returns the path a tunnel is mounted at under prefix, e.g.
+// "/t/app/", or the normalized prefix itself when name is empty.
+func MountPath(prefix, name string) string {
+	prefix = strings.Trim(prefix, "/")
+	if prefix == "" {
+		prefix = strings.Trim(DefaultMountPrefix, "/")
+	}
+	if name == "" {
+		return "/" + prefix + "/"
+	}
+	return "/" + prefix + "/" + name + "/"
+}
+
+// routeByPath resolves requests for a mounted tunnel when the host does not
+// name one. It returns the request to proxy, with the mount path stripped,
+// and its tunnel; the bool reports that a redirect was already written.
+func (m *Manager) routeByPath(
+	w http.ResponseWriter,
+	req *http.Request,
+	hostSubdomain string,
+) (*http.Request, string, bool) {
+	pr := m.pathRouting.Load()
+	if pr == nil || m.HasKnownSubdomain(hostSubdomain) || !strings.HasPrefix(req.URL.Path, pr.Prefix) {
+		return req, hostSubdomain, false
+	}
+
+	name, tail, hasSlash := strings.Cut(strings.TrimPrefix(req.URL.Path, pr.Prefix), "/")
+	normalized, err := subdomain.Normalize(name)
+	if err != nil {
+		return req, hostSubdomain, false
+	}
+
+	mountPath := pr.Prefix + name + "/"
+	if !hasSlash {
+		target := mountPath
+		if req.URL.RawQuery != "" {
+			target += "?" + req.URL.RawQuery
+		}
+		http.Redirect(w, req, target, http.StatusMovedPermanently)
+		return nil, "", true
+	}
+
+	mounted := req.Clone(context.WithValue(req.Context(), mountKey{}, mountPath))
+	mounted.URL.Path = "/" + tail
+	mounted.URL.RawPath = ""
+	if raw := req.URL.RawPath; strings.HasPrefix(raw, mountPath) {
+		mounted.URL.RawPath = "/" + strings.TrimPrefix(raw, mountPath)
+	}
+	mounted.RequestURI = mounted.URL.RequestURI()
+	mounted.Header.Set("X-Forwarded-Prefix", strings.TrimSuffix(mountPath, "/"))
+
+	return mounted, normalized, false
+}
+
+// mountPath returns the path req was mounted under, or "".
+func mountPath(req *http.Request) string {
+	if req == nil {
+		return ""
+	}
+	path, _ := req.Context().Value(mountKey{}).(string)
+	return path
+}
+
+// baseHref returns the <base href> to add to HTML responses for req.
+func (m *Manager) baseHref(req *http.Request) string {
+	pr := m.pathRouting.Load()
+	if pr == nil || !pr.RewriteBase {
+		return ""
+	}
+	return mountPath(req)
+}
+
+// rewriteLocation keeps absolute-path redirects of a mounted tunnel under its
+// mount path.
+func rewriteLocation(h http.Header, req *http.Request) {
+	prefix := mountPath(req)
+	loc := h.Get("Location")
+	if prefix == "" || !strings.HasPrefix(loc, "/") || strings.HasPrefix(loc, "//") {
+		return
+	}
+	h.Set("Location", strings.TrimSuffix(prefix, "/")+loc)
+}
+
+// insertBase adds <base href> right after the <head> tag unless the page
+// already sets one.
+func insertBase(body []byte, href string) []byte {
+	if baseTag.Match(body) {
+		return body
+	}
+	loc := headTag.FindIndex(body)
+	if loc == nil {
+		return body
+	}
+
+	tag := []byte(`<base href="` + href + `">`)
+	out := make([]byte, 0, len(body)+len(tag))
+	out = append(out, body[:loc[1]]...)
+	out = append(out, tag...)
+	return append(out, body[loc[1]:]...)
+}
@@ -0,0 +1,301 @@
+package manager
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/snakeice/gunnel/pkg/store"
+)
+
+var (
+	ErrTunnelExists   = errors.New("named tunnel already exists")
+	ErrTunnelNotFound = errors.New("named tunnel not found")
+	ErrInvalidName    = errors.New("invalid tunnel name")
+)
+
+//nolint:gochecknoglobals // compiled once
+var tunnelNamePattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// NamedTunnel is a tunnel identity created through the admin API. Only the
+// holder of its credentials may register its subdomain.
+type NamedTunnel struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Subdomain string    `json:"subdomain"`
+	CreatedAt time.Time `json:"created_at"`
+	// SecretHash is the hex SHA-256 of the credential secret.
+	SecretHash string `json:"secret_hash"`
+}
+
+// matches reports whether token ("<id>.<secret>") is this tunnel's credential.
+func (t *NamedTunnel) matches(token string) bool {
+	id, secret, ok := strings.Cut(token, ".")
+	if !ok || id != t.ID {
+		return false
+	}
+
+	sum := sha256.Sum256([]byte(secret))
+	return subtle.ConstantTimeCompare([]byte(hex.EncodeToString(sum[:])), []byte(t.SecretHash)) == 1
+}
+
+// namedTunnels is the registry of named tunnels, optionally persisted to a
+// store so credentials survive restarts.
+type namedTunnels struct {
+	mu      sync.RWMutex
+	store   store.Store
+	key     string
+	tunnels map[string]*NamedTunnel // by name
+}
+
+// LoadNamedTunnels reads the named tunnel registry from key of st and
+// persists later changes there. A missing key starts an empty registry.
+func (m *Manager) LoadNamedTunnels(st store.Store, key string) error {
+	registry := &namedTunnels{store: st, key: key, tunnels: map[string]*NamedTunnel{}}
+
+	data, err := st.Get(key)
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+	case err != nil:
+		return fmt.Errorf("failed to read named tunnels: %w", err)
+	default:
+		var list []*NamedTunnel
+		if err := json.Unmarshal(data, &list); err != nil {
+			return fmt.Errorf("failed to parse named tunnels: %w", err)
+		}
+		for _, t := range list {
+			registry.tunnels[t.Name] = t
+		}
+	}
+
+	m.named.Store(registry)
+	return nil
+}
+
+func (m *Manager) namedRegistry() *namedTunnels {
+	if registry := m.named.Load(); registry != nil {
+		return registry
+	}
+
+	m.named.CompareAndSwap(nil, &namedTunnels{tunnels: map[string]*NamedTunnel{}})
+	return m.named.Load()
+}
+
+// CreateNamedTunnel registers a named tunnel for subdomain and returns it
+// together with its credential token, which is not stored and cannot be
+// recovered later.
+func (m *Manager) CreateNamedTunnel(name, subdomain string) (NamedTunnel, string, error) {
+	subdomain, err := namedTunnelSubdomain(name, subdomain)
+	if err != nil {
+		return NamedTunnel{}, "", err
+	}
+
+	registry := m.namedRegistry()
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+
+	if _, ok := registry.tunnels[name]; ok {
+		return NamedTunnel{}, "", ErrTunnelExists
+	}
+	return registry.create(name, subdomain)
+}
+
+// PutNamedTunnel makes the named tunnel name reserve subdomain, creating it
+// when missing and moving it otherwise, so declarative tools can apply it
+// repeatedly. The credential token is only returned when the tunnel was
+// created; existing credentials stay valid.
+func (m *Manager) PutNamedTunnel(name, subdomain string) (NamedTunnel, string, bool, error) {
+	subdomain, err := namedTunnelSubdomain(name, subdomain)
+	if err != nil {
+		return NamedTunnel{}, "", false, err
+	}
+
+	registry := m.namedRegistry()
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+
+	tunnel, ok := registry.tunnels[name]
+	if !ok {
+		created, token, err := registry.create(name, subdomain)
+		return created, token, err == nil, err
+	}
+	if tunnel.Subdomain == subdomain {
+		return *tunnel, "", false, nil
+	}
+	if err := registry.checkSubdomainFree(subdomain); err != nil {
+		return NamedTunnel{}, "", false, err
+	}
+
+	moved := *tunnel
+	moved.Subdomain = subdomain
+	registry.tunnels[name] = &moved
+	if err := registry.save(); err != nil {
+		registry.tunnels[name] = tunnel
+		return NamedTunnel{}, "", false, err
+	}
+	return moved, "", false, nil
+}
+
+// LookupNamedTunnel returns the named tunnel called name.
+func (m *Manager) LookupNamedTunnel(name string) (NamedTunnel, bool) {
+	registry := m.namedRegistry()
+	registry.mu.RLock()
+	defer registry.mu.RUnlock()
+
+	tunnel, ok := registry.tunnels[name]
+	if !ok {
+		return NamedTunnel{}, false
+	}
+	return *tunnel, true
+}
+
+// namedTunnelSubdomain validates a tunnel name and returns the canonical
+// subdomain it reserves, which defaults to the name.
+func namedTunnelSubdomain(name, subdomain string) (string, error) {
+	if !tunnelNamePattern.MatchString(name) {
+		return "", ErrInvalidName
+	}
+	if subdomain == "" {
+		subdomain = name
+	}
+	normalized, _, err := normalizeSubdomain(subdomain)
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", ErrInvalidName, err)
+	}
+	return normalized, nil
+}
+
+// DeleteNamedTunnel removes a named tunnel, freeing its subdomain and
+// disconnecting the clients registered with its credentials.
+func (m *Manager) DeleteNamedTunnel(name string) error {
+	registry := m.namedRegistry()
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+
+	tunnel, ok := registry.tunnels[name]
+	if !ok {
+		return ErrTunnelNotFound
+	}
+
+	delete(registry.tunnels, name)
+	if err := registry.save(); err != nil {
+		registry.tunnels[name] = tunnel
+		return err
+	}
+	m.revokeTenant("tunnel:"+name, "named tunnel deleted")
+	return nil
+}
+
+// NamedTunnels lists the named tunnels sorted by name.
+func (m *Manager) NamedTunnels() []NamedTunnel {
+	registry := m.namedRegistry()
+	registry.mu.RLock()
+	defer registry.mu.RUnlock()
+
+	list := make([]NamedTunnel, 0, len(registry.tunnels))
+	for _, t := range registry.tunnels {
+		list = append(list, *t)
+	}
+	slices.SortFunc(list, func(a, b NamedTunnel) int { return strings.Compare(a.Name, b.Name) })
+	return list
+}
+
+// namedTunnelFor returns the named tunnel reserving subdomain.
+func (m *Manager) namedTunnelFor(subdomain string) (*NamedTunnel, bool) {
+	registry := m.named.Load()
+	if registry == nil {
+		return nil, false
+	}
+
+	registry.mu.RLock()
+	defer registry.mu.RUnlock()
+	for _, t := range registry.tunnels {
+		if t.Subdomain == subdomain {
+			return t, true
+		}
+	}
+	return nil, false
+}
+
+// create adds a tunnel with fresh credentials; callers hold mu.
+func (r *namedTunnels) create(name, subdomain string) (NamedTunnel, string, error) {
+	if err := r.checkSubdomainFree(subdomain); err != nil {
+		return NamedTunnel{}, "", err
+	}
+
+	id, err := randomHex(8)
+	if err != nil {
+		return NamedTunnel{}, "", err
+	}
+	secret, err := randomHex(32)
+	if err != nil {
+		return NamedTunnel{}, "", err
+	}
+	sum := sha256.Sum256([]byte(secret))
+
+	tunnel := &NamedTunnel{
+		ID:         id,
+		Name:       name,
+		Subdomain:  subdomain,
+		CreatedAt:  time.Now().UTC(),
+		SecretHash: hex.EncodeToString(sum[:]),
+	}
+
+	r.tunnels[name] = tunnel
+	if err := r.save(); err != nil {
+		delete(r.tunnels, name)
+		return NamedTunnel{}, "", err
+	}
+	return *tunnel, id + "." + secret, nil
+}
+
+// checkSubdomainFree fails when another tunnel reserves subdomain; callers
+// hold mu.
+func (r *namedTunnels) checkSubdomainFree(subdomain string) error {
+	for _, t := range r.tunnels {
+		if t.Subdomain == subdomain {
+			return fmt.Errorf("%w: subdomain %q is taken by %q", ErrTunnelExists, subdomain, t.Name)
+		}
+	}
+	return nil
+}
+
+// save writes the registry atomically; callers hold mu.
+func (r *namedTunnels) save() error {
+	if r.store == nil {
+		return nil
+	}
+
+	list := make([]*NamedTunnel, 0, len(r.tunnels))
+	for _, t := range r.tunnels {
+		list = append(list, t)
+	}
+	slices.SortFunc(list, func(a, b *NamedTunnel) int { return strings.Compare(a.Name, b.Name) })
+
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode named tunnels: %w", err)
+	}
+
+	if err := r.store.Put(r.key, data); err != nil {
+		return fmt.Errorf("failed to write named tunnels: %w", err)
+	}
+	return nil
+}
+
+func randomHex(n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
@@ -0,0 +1,148 @@
+package manager_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/snakeice/gunnel/pkg/manager"
+	"github.com/snakeice/gunnel/pkg/store"
+)
+
+func TestNamedTunnelsPersist(t *testing.T) {
+	st, err := store.NewFile(t.TempDir())
+	if err != nil {
+		t.Fatalf("store: %v", err)
+	}
+
+	mgr := manager.New()
+	if err := mgr.LoadNamedTunnels(st, "tunnels.json"); err != nil {
+		t.Fatalf("load empty registry: %v", err)
+	}
+
+	tunnel, token, err := mgr.CreateNamedTunnel("web", "")
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if tunnel.Subdomain != "web" || token == "" {
+		t.Fatalf("unexpected tunnel %+v with token %q", tunnel, token)
+	}
+
+	if _, _, err := mgr.CreateNamedTunnel("other", "web"); !errors.Is(err, manager.ErrTunnelExists) {
+		t.Fatalf("expected ErrTunnelExists for a taken subdomain, got %v", err)
+	}
+	if _, _, err := mgr.CreateNamedTunnel("Bad Name", ""); !errors.Is(err, manager.ErrInvalidName) {
+		t.Fatalf("expected ErrInvalidName, got %v", err)
+	}
+
+	reloaded := manager.New()
+	if err := reloaded.LoadNamedTunnels(st, "tunnels.json"); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if list := reloaded.NamedTunnels(); len(list) != 1 || list[0].ID != tunnel.ID {
+		t.Fatalf("expected the created tunnel after reload, got %+v", list)
+	}
+
+	if err := reloaded.DeleteNamedTunnel("web"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if err := reloaded.DeleteNamedTunnel("web"); !errors.Is(err, manager.ErrTunnelNotFound) {
+		t.Fatalf("expected ErrTunnelNotFound, got %v", err)
+	}
+}
+
+func TestNamedTunnelStatusOffline(t *testing.T) {
+	mgr := manager.New()
+	if err := mgr.LoadNamedTunnels(store.NewMemory(), "tunnels.json"); err != nil {
+		t.Fatalf("load empty registry: %v", err)
+	}
+	if _, ok := mgr.TunnelStatus("web"); ok {
+		t.Fatal("expected no status for an unknown tunnel")
+	}
+
+	if _, _, err := mgr.CreateNamedTunnel("web", ""); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	status, ok := mgr.TunnelStatus("web")
+	if !ok || status.State != manager.StateOffline || status.Connections != 0 {
+		t.Fatalf("expected an offline status for a named tunnel without client, got %+v", status)
+	}
+}
+
+func TestUptimeHistoryPersists(t *testing.T) {
+	st := store.NewMemory()
+
+	mgr := manager.New()
+	if err := mgr.LoadNamedTunnels(st, "tunnels.json"); err != nil {
+		t.Fatalf("load empty registry: %v", err)
+	}
+	if err := mgr.LoadUptimeHistory(st, "uptime.json", 0); err != nil {
+		t.Fatalf("load empty history: %v", err)
+	}
+	if _, _, err := mgr.CreateNamedTunnel("web", ""); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	mgr.TunnelStatuses()
+	if err := mgr.FlushUptimeHistory(); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+
+	reloaded := manager.New()
+	if err := reloaded.LoadUptimeHistory(st, "uptime.json", 0); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	uptime, ok := reloaded.TunnelUptime("web", time.Hour)
+	if !ok || uptime.Ratio != 0 || len(uptime.Events) != 1 || uptime.Events[0].State != manager.StateOffline {
+		t.Fatalf("expected one offline event and no uptime, got %+v", uptime)
+	}
+}
+
+func TestPutIsIdempotent(t *testing.T) {
+	st := store.NewMemory()
+	mgr := manager.New()
+	if err := mgr.LoadNamedTunnels(st, "tunnels.json"); err != nil {
+		t.Fatalf("load tunnels: %v", err)
+	}
+	if err := mgr.LoadClientTokens(st, "tokens.json"); err != nil {
+		t.Fatalf("load tokens: %v", err)
+	}
+
+	tunnel, token, created, err := mgr.PutNamedTunnel("web", "")
+	if err != nil || !created || token == "" {
+		t.Fatalf("first put: created=%t token=%q err=%v", created, token, err)
+	}
+	again, token, created, err := mgr.PutNamedTunnel("web", "")
+	if err != nil || created || token != "" || again.ID != tunnel.ID {
+		t.Fatalf("second put: %+v created=%t token=%q err=%v", again, created, token, err)
+	}
+	moved, _, _, err := mgr.PutNamedTunnel("web", "site")
+	if err != nil || moved.ID != tunnel.ID || moved.Subdomain != "site" {
+		t.Fatalf("move: %+v err=%v", moved, err)
+	}
+
+	spec := manager.ClientTokenSpec{Subdomains: []string{"preview-*"}, MaxTunnels: 2}
+	ci, secret, created, err := mgr.PutClientToken("ci", spec)
+	if err != nil || !created || secret == "" {
+		t.Fatalf("first token put: created=%t err=%v", created, err)
+	}
+	if same, secret, created, err := mgr.PutClientToken("ci", spec); err != nil || created || secret != "" ||
+		same.ID != ci.ID || !same.UpdatedAt.Equal(ci.UpdatedAt) {
+		t.Fatalf("second token put changed the token: %+v err=%v", same, err)
+	}
+	if mgr.TenantForToken(secret) != "client:ci" {
+		t.Fatalf("tenant of the generated token = %q", mgr.TenantForToken(secret))
+	}
+
+	bad := manager.ClientTokenSpec{Subdomains: []string{"[a-"}}
+	if _, _, _, err := mgr.PutClientToken("ci", bad); !errors.Is(err, manager.ErrInvalidClientToken) {
+		t.Fatalf("expected ErrInvalidClientToken for a bad pattern, got %v", err)
+	}
+
+	reloaded := manager.New()
+	if err := reloaded.LoadClientTokens(st, "tokens.json"); err != nil {
+		t.Fatalf("reload tokens: %v", err)
+	}
+	if got, ok := reloaded.LookupClientToken("ci"); !ok || got.ID != ci.ID || got.MaxTunnels != 2 {
+		t.Fatalf("expected the token after reload, got %+v", got)
+	}
+}
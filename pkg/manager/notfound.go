@@ -0,0 +1,78 @@
+package manager
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+
+	"github.com/snakeice/gunnel/pkg/logging"
+)
+
+// Ways of answering requests for subdomains no client registered.
+const (
+	NotFoundPage     = "page"
+	NotFoundRedirect = "redirect"
+	NotFoundProxy    = "proxy"
+)
+
+//nolint:gochecknoglobals // parsed once from the embedded templates
+var notFoundTemplate = template.Must(template.ParseFS(templates, "templates/notfound.html"))
+
+// NewNotFoundHandler returns the handler for unknown subdomains: a generic
+// 404 page, a redirect to target or a reverse proxy to the target backend.
+func NewNotFoundHandler(mode, target string) (http.Handler, error) {
+	switch mode {
+	case "", NotFoundPage:
+		return http.HandlerFunc(serveNotFoundPage), nil
+	case NotFoundRedirect, NotFoundProxy:
+	default:
+		return nil, fmt.Errorf("unknown not found mode %q", mode)
+	}
+
+	u, err := url.Parse(target)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, errors.New("not found target must be an absolute http(s) URL")
+	}
+
+	if mode == NotFoundRedirect {
+		return http.RedirectHandler(u.String(), http.StatusFound), nil
+	}
+
+	return &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.SetURL(u)
+			r.SetXForwarded()
+		},
+		ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+			logging.HTTPEdge.WithError(err).WithField("host", req.Host).Warn("Default backend failed")
+			http.Error(w, "502 Bad Gateway", http.StatusBadGateway)
+		},
+	}, nil
+}
+
+// SetNotFoundHandler sets how unknown subdomains are answered; nil restores
+// the generic 404 page.
+func (m *Manager) SetNotFoundHandler(h http.Handler) {
+	m.notFound = h
+}
+
+func (m *Manager) serveNotFound(w http.ResponseWriter, req *http.Request) {
+	if m.notFound != nil {
+		m.notFound.ServeHTTP(w, req)
+		return
+	}
+	serveNotFoundPage(w, req)
+}
+
+func serveNotFoundPage(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusNotFound)
+
+	if err := notFoundTemplate.Execute(w, struct{ Host string }{Host: req.Host}); err != nil {
+		logging.HTTPEdge.WithError(err).Warn("Failed to render not found page")
+	}
+}
@@ -0,0 +1,113 @@
+package manager
+
+import (
+	"embed"
+	"html/template"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/snakeice/gunnel/pkg/connection"
+	"github.com/snakeice/gunnel/pkg/logging"
+	"github.com/snakeice/gunnel/pkg/protocol"
+	"github.com/snakeice/gunnel/pkg/schedule"
+)
+
+//go:embed templates
+var templates embed.FS
+
+//nolint:gochecknoglobals // parsed once from the embedded templates
+var offlineTemplate = template.Must(template.ParseFS(templates, "templates/offline.html"))
+
+// setSchedule stores the active hours of subdomain; an empty spec removes them.
+func (m *Manager) setSchedule(subdomain, spec string) error {
+	if spec == "" {
+		m.schedules.Delete(subdomain)
+		return nil
+	}
+
+	sched, err := schedule.Parse(spec)
+	if err != nil {
+		return err
+	}
+
+	m.schedules.Store(subdomain, sched)
+	return nil
+}
+
+// offlineUntil reports whether subdomain is outside its active hours at now and,
+// if so, when it opens again.
+func (m *Manager) offlineUntil(subdomain string, now time.Time) (time.Time, bool) {
+	value, ok := m.schedules.Load(subdomain)
+	if !ok {
+		return time.Time{}, false
+	}
+	sched, ok := value.(*schedule.Schedule)
+	if !ok || sched.Active(now) {
+		return time.Time{}, false
+	}
+	return sched.Next(now), true
+}
+
+// handleTunnelState pauses or resumes a tunnel of conn, or hands it to
+// closeTunnel when the client closed it.
+func (m *Manager) handleTunnelState(
+	conn *connection.Connection,
+	msg *protocol.Message,
+	closeTunnel func(subdomain string),
+) error {
+	state := protocol.TunnelState{}
+	if err := protocol.Unmarshal(&state, msg); err != nil {
+		return err
+	}
+
+	logger := logging.HTTPEdge.WithFields(logrus.Fields{
+		"subdomain": state.Subdomain,
+		"paused":    state.Paused,
+	})
+
+	group, ok := m.getGroup(state.Subdomain)
+	if !ok || !slices.Contains(group.list(), conn) {
+		logger.Warn("Ignoring tunnel state for a subdomain the client does not own")
+		return nil
+	}
+
+	if state.Closed {
+		closeTunnel(state.Subdomain)
+		logger.Info("Client closed tunnel")
+		return nil
+	}
+	m.SetPaused(state.Subdomain, state.Paused)
+	logger.Info("Tunnel state changed")
+	return nil
+}
+
+func (m *Manager) isPaused(subdomain string) bool {
+	_, ok := m.paused.Load(subdomain)
+	return ok
+}
+
+func (m *Manager) serveOffline(
+	w http.ResponseWriter,
+	subdomain, reason string,
+	next time.Time,
+	logger *logrus.Entry,
+) {
+	if !next.IsZero() {
+		w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(next).Seconds())))
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusServiceUnavailable)
+
+	data := struct {
+		Subdomain string
+		Reason    string
+		Next      time.Time
+	}{Subdomain: subdomain, Reason: reason, Next: next}
+
+	if err := offlineTemplate.Execute(w, data); err != nil {
+		logger.WithError(err).Warn("Failed to render offline page")
+	}
+}
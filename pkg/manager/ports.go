@@ -0,0 +1,118 @@
+package manager
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+)
+
+// ErrNoFreePort is returned when every port of the range is taken.
+var ErrNoFreePort = errors.New("no free port in the tunnel port range")
+
+// portAllocator hands out the public ports of TCP and UDP tunnels from a
+// range, or lets the OS pick them when no range is set.
+type portAllocator struct {
+	mu       sync.Mutex
+	min, max int
+	// next is where the search for a free port starts, so a released port
+	// is not handed out again right away.
+	next  int
+	inUse map[portKey]bool
+}
+
+type portKey struct {
+	network string
+	port    int
+}
+
+// SetTCPPortRange makes TCP and UDP tunnels take their public port from
+// min-max (inclusive). Without a range the OS picks a free port.
+func (m *Manager) SetTCPPortRange(minPort, maxPort int) {
+	m.tcpPorts.mu.Lock()
+	defer m.tcpPorts.mu.Unlock()
+	m.tcpPorts.min, m.tcpPorts.max, m.tcpPorts.next = minPort, maxPort, minPort
+}
+
+// listen binds the next free TCP port of the range on host.
+func (p *portAllocator) listen(host string) (net.Listener, int, error) {
+	var ln net.Listener
+	port, err := p.take("tcp", func(port int) (net.Addr, error) {
+		l, err := net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+		if err != nil {
+			return nil, err
+		}
+		ln = l
+		return l.Addr(), nil
+	})
+	return ln, port, err
+}
+
+// listenPacket binds the next free UDP port of the range on host.
+func (p *portAllocator) listenPacket(host string) (net.PacketConn, int, error) {
+	var conn net.PacketConn
+	port, err := p.take("udp", func(port int) (net.Addr, error) {
+		c, err := net.ListenPacket("udp", net.JoinHostPort(host, strconv.Itoa(port)))
+		if err != nil {
+			return nil, err
+		}
+		conn = c
+		return c.LocalAddr(), nil
+	})
+	return conn, port, err
+}
+
+// take finds a port bind succeeds on and marks it used. Ports other
+// programs hold are skipped.
+func (p *portAllocator) take(network string, bind func(port int) (net.Addr, error)) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.min == 0 {
+		addr, err := bind(0)
+		if err != nil {
+			return 0, err
+		}
+		return addrPort(addr), nil
+	}
+
+	if p.inUse == nil {
+		p.inUse = make(map[portKey]bool)
+	}
+	size := p.max - p.min + 1
+	for i := range size {
+		port := p.min + (p.next-p.min+i)%size
+		if p.inUse[portKey{network, port}] {
+			continue
+		}
+		if _, err := bind(port); err != nil {
+			continue
+		}
+		p.inUse[portKey{network, port}] = true
+		p.next = port + 1
+		if p.next > p.max {
+			p.next = p.min
+		}
+		return port, nil
+	}
+	return 0, fmt.Errorf("%w %d-%d", ErrNoFreePort, p.min, p.max)
+}
+
+// release returns port to the range once it is closed.
+func (p *portAllocator) release(network string, port int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.inUse, portKey{network, port})
+}
+
+func addrPort(addr net.Addr) int {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.Port
+	case *net.UDPAddr:
+		return a.Port
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,52 @@
+package manager
+
+import (
+	"net/http"
+	"slices"
+
+	"github.com/caddyserver/certmagic"
+)
+
+// statusSubdomain serves the public status page when it is enabled.
+const statusSubdomain = "status"
+
+// SetStatusPageHandler serves the public status page at status.<domain> with
+// handler and keeps tunnels from registering that subdomain.
+func (m *Manager) SetStatusPageHandler(handler http.HandlerFunc) {
+	m.statusPageHandler = handler
+}
+
+func (m *Manager) statusPageEnabled() bool {
+	return m.statusPageHandler != nil
+}
+
+func (m *Manager) handleStatusPage(w http.ResponseWriter, req *http.Request) {
+	if !certmagic.DefaultACME.HandleHTTPChallenge(w, req) {
+		m.statusPageHandler(w, req)
+	}
+}
+
+// setPublic records whether the owner of subdomain listed it on the public
+// status page.
+func (m *Manager) setPublic(subdomain string, public bool) {
+	if public {
+		m.public.Store(subdomain, struct{}{})
+	} else {
+		m.public.Delete(subdomain)
+	}
+}
+
+// IsPublic reports whether the owner of subdomain listed it on the public
+// status page.
+func (m *Manager) IsPublic(subdomain string) bool {
+	_, ok := m.public.Load(subdomain)
+	return ok
+}
+
+// PublicTunnelStatuses returns the status of the tunnels listed on the public
+// status page.
+func (m *Manager) PublicTunnelStatuses() []TunnelStatus {
+	return slices.DeleteFunc(m.TunnelStatuses(), func(st TunnelStatus) bool {
+		return !m.IsPublic(st.Subdomain)
+	})
+}
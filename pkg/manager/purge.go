@@ -0,0 +1,98 @@
+package manager
+
+import (
+	"errors"
+	"slices"
+
+	"github.com/sirupsen/logrus"
+	"github.com/snakeice/gunnel/pkg/logging"
+	"github.com/snakeice/gunnel/pkg/metrics"
+	"github.com/snakeice/gunnel/pkg/protocol"
+)
+
+// PurgeReport tells what a purge deleted.
+type PurgeReport struct {
+	Subdomains []string `json:"subdomains"`
+	// UsageRecords counts the daily usage aggregates removed or stripped of
+	// the purged tunnels.
+	UsageRecords   int `json:"usage_records"`
+	UptimeHistory  int `json:"uptime_history"`
+	TrafficHistory int `json:"traffic_history"`
+	// CapturedRequests counts the exchanges dropped from the inspector.
+	CapturedRequests int `json:"captured_requests"`
+}
+
+// TenantForToken returns the usage tenant of clients registering with token.
+func (m *Manager) TenantForToken(token string) string {
+	return m.tenantFor(&protocol.ConnectionRegister{Token: token})
+}
+
+// PurgeSubdomain deletes the stored usage counts, uptime and traffic
+// history and metric series of subdomain and saves the stores right away.
+func (m *Manager) PurgeSubdomain(subdomain string) (PurgeReport, error) {
+	report := PurgeReport{Subdomains: []string{subdomain}}
+	m.purgeTunnel(subdomain, &report)
+	return report, m.savePurge(report)
+}
+
+// PurgeTenant deletes the usage aggregates of tenant and everything stored
+// about its tunnels: those it currently has registered and, as offline
+// tunnels are only known from them, those its usage records name.
+func (m *Manager) PurgeTenant(tenant string) (PurgeReport, error) {
+	report := PurgeReport{Subdomains: []string{}}
+	m.tenants.Range(func(key, value any) bool {
+		if owner, _ := value.(string); owner == tenant {
+			subdomain, _ := key.(string)
+			report.Subdomains = append(report.Subdomains, subdomain)
+		}
+		return true
+	})
+
+	if m.usage != nil {
+		report.Subdomains = append(report.Subdomains, m.usage.Tunnels(tenant)...)
+		report.UsageRecords += m.usage.PurgeTenant(tenant)
+	}
+	slices.Sort(report.Subdomains)
+	report.Subdomains = slices.Compact(report.Subdomains)
+	for _, subdomain := range report.Subdomains {
+		m.purgeTunnel(subdomain, &report)
+	}
+	return report, m.savePurge(report)
+}
+
+func (m *Manager) purgeTunnel(subdomain string, report *PurgeReport) {
+	if m.usage != nil {
+		report.UsageRecords += m.usage.PurgeTunnel(subdomain)
+	}
+	if m.purgeUptimeHistory(subdomain) {
+		report.UptimeHistory++
+	}
+	if m.series != nil && m.series.Purge(subdomain) {
+		report.TrafficHistory++
+	}
+	report.CapturedRequests += m.purgeCaptured(subdomain)
+	m.malformed.Delete(subdomain)
+	metrics.RemoveSubdomain(subdomain)
+}
+
+// savePurge persists the deletions so purged data does not survive until
+// the next periodic flush.
+func (m *Manager) savePurge(report PurgeReport) error {
+	var err error
+	if m.usage != nil {
+		err = errors.Join(err, m.usage.Flush())
+	}
+	if m.series != nil {
+		err = errors.Join(err, m.series.Flush())
+	}
+	err = errors.Join(err, m.FlushUptimeHistory())
+	err = errors.Join(err, m.FlushCaptures())
+
+	logging.Control.WithFields(logrus.Fields{
+		"subdomains":      report.Subdomains,
+		"usage_records":   report.UsageRecords,
+		"uptime_history":  report.UptimeHistory,
+		"traffic_history": report.TrafficHistory,
+	}).Info("Purged stored data")
+	return err
+}
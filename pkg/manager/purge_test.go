@@ -0,0 +1,39 @@
+package manager_test
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/snakeice/gunnel/pkg/manager"
+	"github.com/snakeice/gunnel/pkg/usage"
+)
+
+func TestPurgeTenantWithoutRegisteredTunnels(t *testing.T) {
+	rec, err := usage.New(nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec.Record("token:abcd", "web", "/", 0, 1)
+	rec.Record("token:abcd", "api", "/", 0, 1)
+	rec.Record("token:other", "shop", "/", 0, 1)
+
+	mgr := manager.New()
+	mgr.SetUsage(rec)
+
+	report, err := mgr.PurgeTenant("token:abcd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"api", "web"}; !slices.Equal(report.Subdomains, want) {
+		t.Errorf("purged subdomains %v, want the offline tunnels %v", report.Subdomains, want)
+	}
+	if report.UsageRecords != 1 {
+		t.Errorf("purged %d usage records, want 1", report.UsageRecords)
+	}
+	if got := rec.Tunnels("token:abcd"); len(got) != 0 {
+		t.Errorf("tunnels of the purged tenant %v, want none", got)
+	}
+	if got, want := rec.Tunnels("token:other"), []string{"shop"}; !slices.Equal(got, want) {
+		t.Errorf("tunnels of the other tenant %v, want %v", got, want)
+	}
+}
@@ -1,13 +1,16 @@
 package manager
 
 import (
-	"context"
 	"errors"
 
 	"github.com/sirupsen/logrus"
 	"github.com/snakeice/gunnel/pkg/connection"
+	"github.com/snakeice/gunnel/pkg/logging"
+	"github.com/snakeice/gunnel/pkg/metrics"
 	"github.com/snakeice/gunnel/pkg/protocol"
+	"github.com/snakeice/gunnel/pkg/subdomain"
 	"github.com/snakeice/gunnel/pkg/transport"
+	"github.com/snakeice/gunnel/pkg/version"
 )
 
 type registrationResult struct {
@@ -17,109 +20,297 @@ type registrationResult struct {
 
 // HandleConnection handles a new connection.
 func (m *Manager) HandleConnection(transp transport.Transport) {
-	registrationChan := make(chan registrationResult, 1)
+	registrationChan := make(chan registrationResult, 16)
+	leaving := make(chan string, 1)
+	closing := make(chan string)
+	auth := &connAuth{}
 	client := connection.New(transp, func(c *connection.Connection, msg *protocol.Message) error {
-		return m.handleStreamWithRegistration(c, msg, registrationChan)
+		switch msg.Type { //nolint:exhaustive // only client initiated control messages reach here
+		case protocol.MessageAuthChallenge:
+			m.handleAuthChallenge(c, auth)
+			return nil
+		case protocol.MessageConfigUpdateAck:
+			return m.handleConfigAck(msg)
+		case protocol.MessageTunnelState:
+			return m.handleTunnelState(c, msg, func(subdomain string) {
+				select {
+				case closing <- subdomain:
+				case <-transp.Context().Done():
+				}
+			})
+		case protocol.MessageDisconnect:
+			closeMsg := protocol.CloseConnection{}
+			if err := protocol.Unmarshal(&closeMsg, msg); err != nil {
+				return err
+			}
+			select {
+			case leaving <- closeMsg.Code.Describe(closeMsg.Reason):
+			default:
+			}
+			return nil
+		default:
+			return m.handleStreamWithRegistration(c, msg, auth, registrationChan)
+		}
 	})
 	client.Start()
+	stopRotation := m.scheduleRotation(client)
 
 	streamChan := make(chan transport.Stream)
 	go m.acceptStreams(transp, streamChan)
+	go m.receiveDatagrams(transp, client)
 
-	var registeredSubdomain string
+	registeredSubdomains := make(map[string]struct{})
 
 	for {
 		select {
-		case stream := <-streamChan:
-			logrus.WithFields(logrus.Fields{
-				"stream_id": stream.ID(),
-				"addr":      transp.Addr(),
+		case stream, ok := <-streamChan:
+			if !ok {
+				// The connection closed; the root stream context follows.
+				streamChan = nil
+				continue
+			}
+			logging.Control.WithFields(logrus.Fields{
+				"stream_id":     stream.ID(),
+				"connection_id": stream.ConnectionID(),
+				"addr":          transp.Addr(),
 			}).Debug("Stream received but no handler assigned (expected - handled by connection)")
 		case reg := <-registrationChan:
 			if reg.success {
-				registeredSubdomain = reg.subdomain
+				if len(registeredSubdomains) == 0 {
+					m.sendClientConfig(client)
+				}
+				registeredSubdomains[reg.subdomain] = struct{}{}
+			}
+		case subdomain := <-closing:
+			// The client dropped one tunnel and keeps serving the others.
+			if _, ok := registeredSubdomains[subdomain]; ok {
+				m.cancelExpiry(subdomain, client)
+				m.recordDisconnect(subdomain, "closed by client")
+				m.removeClient(subdomain, client)
+				m.refreshTunnelState(subdomain)
+				delete(registeredSubdomains, subdomain)
 			}
-		case <-transp.Root().Context().Done():
-			logrus.Info("Transport context done, stopping stream handling")
+		case reason := <-leaving:
+			// The client is stopping: route nothing more to it, while the
+			// requests in flight finish until it closes the connection.
+			for subdomain := range registeredSubdomains {
+				m.cancelExpiry(subdomain, client)
+				m.recordDisconnect(subdomain, reason)
+				m.removeClient(subdomain, client)
+				m.refreshTunnelState(subdomain)
+			}
+			logging.Control.WithFields(logrus.Fields{
+				"addr":       transp.Addr(),
+				"subdomains": len(registeredSubdomains),
+			}).Info("Client is shutting down, removed its tunnels")
+			clear(registeredSubdomains)
+		case <-transp.Context().Done():
+			// The QUIC connection closed: the client left, crashed and timed
+			// out, or was dropped. Free its tunnels now rather than waiting
+			// for missed heartbeats.
+			stopRotation()
 			client.Close()
-			if registeredSubdomain != "" {
-				m.removeClient(registeredSubdomain)
+			reason := client.CloseReason()
+			logging.Control.WithFields(logrus.Fields{
+				"addr":          transp.Addr(),
+				"connection_id": transp.ID(),
+				"reason":        reason,
+			}).Info("Client connection closed")
+			for subdomain := range registeredSubdomains {
+				m.cancelExpiry(subdomain, client)
+				m.recordDisconnect(subdomain, reason)
+				m.removeClient(subdomain, client)
+				m.refreshTunnelState(subdomain)
 			}
 			return
 		}
 	}
 }
 
+// acceptStreams forwards the streams the client opens until the connection
+// closes. It blocks on the connection instead of polling with timeouts.
 func (m *Manager) acceptStreams(transp transport.Transport, streamChan chan transport.Stream) {
 	defer close(streamChan)
+
+	ctx := transp.Context()
 	for {
-		ctx, cancel := context.WithTimeout(context.Background(), streamAcceptTimeout)
 		stream, err := transp.AcceptStream(ctx)
 		if err != nil {
-			if errors.Is(err, context.DeadlineExceeded) {
-				cancel()
-				continue
+			if ctx.Err() == nil {
+				logging.Control.WithError(err).Log(transport.LogLevel(err), "Failed to accept stream")
 			}
-			logrus.WithError(err).Error("Failed to accept stream")
-			cancel()
 			return
 		}
 
-		logrus.WithFields(logrus.Fields{
-			"stream_id": stream.ID(),
-			"addr":      transp.Addr(),
+		logging.Control.WithFields(logrus.Fields{
+			"stream_id":     stream.ID(),
+			"connection_id": stream.ConnectionID(),
+			"addr":          transp.Addr(),
 		}).Debug("Accepted new stream")
 
-		streamChan <- stream
-		cancel()
+		select {
+		case streamChan <- stream:
+		case <-ctx.Done():
+			return
+		}
 	}
 }
 
 func (m *Manager) handleStreamWithRegistration(
 	client *connection.Connection,
 	msg *protocol.Message,
+	auth *connAuth,
 	registrationChan chan<- registrationResult,
 ) error {
 	regMsg := protocol.ConnectionRegister{}
-	protocol.Unmarshal(&regMsg, msg)
+	if err := protocol.Unmarshal(&regMsg, msg); err != nil {
+		return err
+	}
 
 	subdomain := regMsg.Subdomain
 	if subdomain == "" {
-		subdomain = "default"
+		subdomain = m.randomSubdomain()
+		regMsg.Subdomain = subdomain
 	}
 
-	logrus.WithFields(logrus.Fields{
+	logging.Control.WithFields(logrus.Fields{
 		"subdomain": subdomain,
 		"host":      regMsg.Host,
 		"port":      regMsg.Port,
 		"protocol":  regMsg.Protocol,
+		"client_id": regMsg.ClientID,
+		"ttl":       regMsg.TTL,
+		"key_auth":  len(regMsg.PublicKey) > 0,
+		"version":   regMsg.Version,
 	}).Info("Client requested registration")
+	if !version.Compatible(version.Version, regMsg.Version) {
+		logging.Control.WithFields(logrus.Fields{
+			"subdomain":      subdomain,
+			"client_version": regMsg.Version,
+			"server_version": version.Version,
+		}).Warn("Client runs an incompatible version")
+	}
 
 	reason := "success"
+	reject := protocol.RejectNone
 
-	canAccept := true
+	// Credentials and ownership are checked against the canonical name, so
+	// a case or whitespace variant cannot slip past a named tunnel.
+	if normalized, code, err := normalizeSubdomain(subdomain); err != nil {
+		reason = err.Error()
+		reject = code
+	} else {
+		subdomain = normalized
+		regMsg.Subdomain = normalized
+	}
 
-	if !m.IsAuthorized(regMsg.Token) {
+	if reject == protocol.RejectNone && !m.authorizeRegistration(&regMsg, auth) {
 		reason = "unauthorized"
-		canAccept = false
+		reject = protocol.RejectUnauthorized
+	}
+
+	if reject == protocol.RejectNone && subdomain == statusSubdomain && m.statusPageEnabled() {
+		reason = "subdomain is reserved for the status page"
+		reject = protocol.RejectReservedSubdomain
+	}
+
+	if _, shared := m.ShareLink(subdomain); reject == protocol.RejectNone && shared {
+		reason = "subdomain is in use by a share link"
+		reject = protocol.RejectSubdomainTaken
+	}
+
+	if reject == protocol.RejectNone {
+		release, msg, ok := m.reserveClientToken(regMsg.Token, subdomain)
+		defer release()
+		if !ok {
+			reason = msg
+			reject = protocol.RejectNotPermitted
+		}
+	}
+
+	if reject == protocol.RejectNone && !m.mayClaim(subdomain, regMsg.Token) {
+		reason = "subdomain is owned by another team"
+		reject = protocol.RejectSubdomainTaken
 	}
 
+	if reject == protocol.RejectNone {
+		if err := m.setSchedule(subdomain, regMsg.Schedule); err != nil {
+			reason = "invalid schedule: " + err.Error()
+			reject = protocol.RejectInvalidSchedule
+		}
+	}
+
+	if reject == protocol.RejectNone {
+		if err := m.checkClientJWTPolicy(subdomain, regMsg.JWT); err != nil {
+			reason = err.Error()
+			reject = protocol.RejectInvalidJWKS
+		}
+	}
+
+	publicPort := 0
+	if reject == protocol.RejectNone {
+		var err error
+		switch regMsg.Protocol { //nolint:exhaustive // HTTP tunnels have no port of their own
+		case protocol.TCP:
+			m.closeUDPTunnel(subdomain)
+			publicPort, err = m.openTCPTunnel(subdomain)
+		case protocol.UDP:
+			m.closeTCPTunnel(subdomain)
+			publicPort, err = m.openUDPTunnel(subdomain)
+		default:
+			m.closePublicPorts(subdomain)
+		}
+		if err != nil {
+			logging.Control.WithError(err).WithFields(logrus.Fields{
+				"subdomain": subdomain,
+				"protocol":  regMsg.Protocol,
+			}).Error("Failed to open tunnel port")
+			reason = "no public port available"
+			reject = protocol.RejectNoPort
+		}
+	}
+
+	canAccept := reject == protocol.RejectNone
 	if canAccept {
-		m.addClient(subdomain, client)
+		m.claimSubdomain(subdomain, regMsg.Token)
+		m.paused.Delete(subdomain)
+		m.tenants.Store(subdomain, m.tenantFor(&regMsg))
+		m.setClientJWTPolicy(subdomain, regMsg.JWT)
+		m.setPublic(subdomain, regMsg.PublicStatus)
+		m.addClient(subdomain, regMsg.ClientID, client)
+		if regMsg.TTL > 0 {
+			m.scheduleExpiry(subdomain, client, regMsg.TTL)
+		} else {
+			m.cancelExpiry(subdomain, client)
+		}
 	}
 
 	regRespMsg := protocol.ConnectionRegisterResp{
 		Success:   canAccept,
 		Subdomain: subdomain,
 		Message:   reason,
+		Version:   version.Version,
+		Reject:    reject,
+	}
+	switch {
+	case canAccept && publicPort != 0:
+		regRespMsg.URL = m.portURL(regMsg.Protocol, publicPort)
+		regRespMsg.Port = uint16(publicPort) //nolint:gosec // G115: a port number
+	case canAccept && m.publicURL != nil:
+		regRespMsg.URL = m.publicURL(subdomain)
 	}
 	client.Send(&regRespMsg)
 
-	logrus.WithFields(logrus.Fields{
+	logging.Control.WithFields(logrus.Fields{
 		"subdomain": subdomain,
 		"accepted":  canAccept,
 		"reason":    reason,
 	}).Info("Client registration result")
+	result := "accepted"
+	if !canAccept {
+		result = reject.String()
+	}
+	metrics.RecordRegistration(result)
 
 	select {
 	case registrationChan <- registrationResult{subdomain: subdomain, success: canAccept}:
@@ -129,6 +320,41 @@ func (m *Manager) handleStreamWithRegistration(
 	return nil
 }
 
+// normalizeSubdomain validates a requested subdomain and returns its
+// canonical form, or the reason to send back when it is refused.
+func normalizeSubdomain(name string) (string, protocol.RejectReason, error) {
+	normalized, err := subdomain.Normalize(name)
+	switch {
+	case err == nil:
+		return normalized, protocol.RejectNone, nil
+	case errors.Is(err, subdomain.ErrReserved):
+		return "", protocol.RejectReservedSubdomain, err
+	case errors.Is(err, subdomain.ErrConfusable):
+		return "", protocol.RejectConfusableSubdomain, err
+	default:
+		return "", protocol.RejectInvalidSubdomain, err
+	}
+}
+
+// maxRandomAttempts bounds the random names tried for a free one.
+const maxRandomAttempts = 10
+
+// randomSubdomain picks a memorable subdomain no tunnel, named tunnel or team
+// holds, for clients registering without one.
+func (m *Manager) randomSubdomain() string {
+	var name string
+	for range maxRandomAttempts {
+		name = subdomain.Random()
+		_, registered := m.getGroup(name)
+		_, named := m.namedTunnelFor(name)
+		_, shared := m.ShareLink(name)
+		if !registered && !named && !shared && m.teamOf(name) == "" && name != statusSubdomain {
+			break
+		}
+	}
+	return name
+}
+
 func (m *Manager) HandleStream(client *connection.Connection, msg *protocol.Message) error {
-	return m.handleStreamWithRegistration(client, msg, nil)
+	return m.handleStreamWithRegistration(client, msg, nil, nil)
 }
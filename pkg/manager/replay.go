@@ -0,0 +1,99 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/snakeice/gunnel/pkg/logging"
+)
+
+// replayHeader marks replayed requests with the ID of the captured one, so
+// backends can tell them from the original.
+const replayHeader = "X-Gunnel-Replay"
+
+var (
+	// ErrCaptureNotFound is returned for exchanges the inspector no longer
+	// keeps.
+	ErrCaptureNotFound = errors.New("captured request not found")
+	// ErrInspectorDisabled is returned for replays when no traffic is
+	// captured.
+	ErrInspectorDisabled = errors.New("request inspector is disabled")
+	// ErrReplayTruncated is returned when replaying a request whose body was
+	// not kept whole.
+	ErrReplayTruncated = errors.New("request body was truncated when captured")
+)
+
+// ReplayRequest sends the captured request with id to its tunnel again and
+// returns the new exchange, which the inspector keeps as well.
+func (m *Manager) ReplayRequest(ctx context.Context, id string) (*CapturedRequest, error) {
+	orig, ok := m.CapturedRequest(id)
+	if !ok {
+		return nil, ErrCaptureNotFound
+	}
+	return m.replay(ctx, orig, orig.Subdomain)
+}
+
+// replay sends orig to the tunnel of subdomain and returns the new exchange.
+func (m *Manager) replay(ctx context.Context, orig *CapturedRequest, subdomain string) (*CapturedRequest, error) {
+	if orig.RequestBodyTruncated {
+		return nil, ErrReplayTruncated
+	}
+
+	host := orig.Host
+	if subdomain != orig.Subdomain {
+		host = withSubdomain(host, subdomain)
+	}
+	req, err := http.NewRequestWithContext(ctx, orig.Method, "http://"+host+orig.Path,
+		strings.NewReader(orig.RequestBody))
+	if err != nil {
+		return nil, err
+	}
+	req.Header = orig.RequestHeaders.Clone()
+	if ins := m.inspector.Load(); ins != nil {
+		// Their values were not kept.
+		for _, name := range ins.config.RedactHeaders {
+			req.Header.Del(name)
+		}
+	}
+	req.Header.Set(replayHeader, orig.ID)
+	req.RemoteAddr = net.JoinHostPort(orig.RemoteIP, "0")
+
+	sw := &statusWriter{ResponseWriter: &discardWriter{header: make(http.Header)}}
+	capture := m.capture(req, subdomain, sw)
+	if capture == nil {
+		return nil, ErrNoConnection
+	}
+
+	logger := logging.HTTPEdge.WithFields(logrus.Fields{
+		"subdomain": subdomain,
+		"replay":    orig.ID,
+	})
+	if err := m.handleProxyFlow(sw, req, subdomain, logger); err != nil {
+		return nil, err
+	}
+	capture.done(sw)
+	logger.WithField("status", sw.statusCode()).Info("Replayed captured request")
+	return capture.entry, nil
+}
+
+// withSubdomain returns host with its first label replaced by subdomain.
+func withSubdomain(host, subdomain string) string {
+	if _, rest, ok := strings.Cut(host, "."); ok {
+		return subdomain + "." + rest
+	}
+	return subdomain
+}
+
+// discardWriter is the ResponseWriter of replayed requests, whose response
+// only goes to the inspector.
+type discardWriter struct {
+	header http.Header
+}
+
+func (w *discardWriter) Header() http.Header         { return w.header }
+func (w *discardWriter) Write(p []byte) (int, error) { return len(p), nil }
+func (w *discardWriter) WriteHeader(int)             {}
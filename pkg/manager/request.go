@@ -4,6 +4,9 @@ import (
 	"net"
 	"net/http"
 	"strings"
+
+	"github.com/snakeice/gunnel/pkg/clientip"
+	"golang.org/x/net/idna"
 )
 
 func extractSubdomain(req *http.Request) string {
@@ -19,6 +22,12 @@ func extractSubdomain(req *http.Request) string {
 		host = h
 	}
 
+	return SubdomainFromHost(host)
+}
+
+// SubdomainFromHost returns the first label of host in lowercase punycode, or
+// "" for IP addresses and single label names.
+func SubdomainFromHost(host string) string {
 	// Strip IPv6 brackets if present
 	if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") && len(host) > 2 {
 		host = host[1 : len(host)-1]
@@ -32,9 +41,28 @@ func extractSubdomain(req *http.Request) string {
 		return ""
 	}
 
+	// Browsers send internationalized names as punycode, other clients may
+	// send them in Unicode; tunnels are registered under the punycode form.
+	if ascii, err := idna.Lookup.ToASCII(host); err == nil {
+		host = ascii
+	} else {
+		host = strings.ToLower(host)
+	}
+
 	parts := strings.Split(host, ".")
 	if len(parts) > 1 {
 		return parts[0]
 	}
 	return ""
 }
+
+// SetTrustedProxies controls which peers may report the client address
+// through X-Forwarded-For and X-Real-IP.
+func (m *Manager) SetTrustedProxies(r *clientip.Resolver) {
+	m.clientIPs = r
+}
+
+// clientIP returns the address used for logging, access checks and limits.
+func (m *Manager) clientIP(req *http.Request) string {
+	return m.clientIPs.ClientIP(req)
+}
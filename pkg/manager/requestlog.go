@@ -0,0 +1,188 @@
+package manager
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// redactedValue replaces the values of redacted query parameters in logs.
+const redactedValue = "REDACTED"
+
+// RequestLogPolicy thins and scrubs the request log of a tunnel at high
+// traffic.
+type RequestLogPolicy struct {
+	// SampleRate logs one in SampleRate successful requests; requests
+	// answered with a 4xx or 5xx status are all logged. 0 or 1 logs every
+	// request.
+	SampleRate int
+	// RedactQuery masks the values of query parameters whose names match one
+	// of these patterns, e.g. "token" or "*_key", case-insensitively.
+	RedactQuery []string
+}
+
+// requestLogPolicy is a RequestLogPolicy with the requests it has seen.
+type requestLogPolicy struct {
+	RequestLogPolicy
+	seen atomic.Uint64
+}
+
+// SetRequestLogPolicy sets the request log policy of subdomain, or of all
+// tunnels with AllTunnels; nil removes it. A policy of a subdomain replaces
+// the one for all tunnels.
+func (m *Manager) SetRequestLogPolicy(subdomain string, policy *RequestLogPolicy) error {
+	if policy == nil {
+		m.requestLogs.Delete(subdomain)
+		return nil
+	}
+	if err := ValidateRequestLogPolicy(policy); err != nil {
+		return err
+	}
+	m.requestLogs.Store(subdomain, &requestLogPolicy{RequestLogPolicy: *policy})
+	return nil
+}
+
+// ValidateRequestLogPolicy reports a negative rate or a malformed pattern.
+func ValidateRequestLogPolicy(policy *RequestLogPolicy) error {
+	if policy.SampleRate < 0 {
+		return fmt.Errorf("sample rate must not be negative: %d", policy.SampleRate)
+	}
+	for _, pattern := range policy.RedactQuery {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid redact pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+func (m *Manager) requestLogPolicy(subdomain string) *requestLogPolicy {
+	for _, key := range []string{subdomain, AllTunnels} {
+		if value, ok := m.requestLogs.Load(key); ok {
+			if policy, ok := value.(*requestLogPolicy); ok {
+				return policy
+			}
+		}
+	}
+	return nil
+}
+
+// redact returns u for logs, with the values of the matching query
+// parameters masked.
+func (p *requestLogPolicy) redact(u *url.URL) string {
+	if p == nil || len(p.RedactQuery) == 0 || u.RawQuery == "" {
+		return u.String()
+	}
+
+	params := strings.Split(u.RawQuery, "&")
+	for i, param := range params {
+		name, _, _ := strings.Cut(param, "=")
+		if unescaped, err := url.QueryUnescape(name); err == nil {
+			name = unescaped
+		}
+		if p.matches(name) {
+			params[i] = url.QueryEscape(name) + "=" + redactedValue
+		}
+	}
+	redacted := *u
+	redacted.RawQuery = strings.Join(params, "&")
+	return redacted.String()
+}
+
+func (p *requestLogPolicy) matches(name string) bool {
+	name = strings.ToLower(name)
+	for _, pattern := range p.RedactQuery {
+		if ok, _ := path.Match(strings.ToLower(pattern), name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// sampled reports whether a request answered with status is logged.
+func (p *requestLogPolicy) sampled(status int) bool {
+	if p == nil || p.SampleRate <= 1 || status >= http.StatusBadRequest {
+		return true
+	}
+	return p.seen.Add(1)%uint64(p.SampleRate) == 1 //nolint:gosec // G115: SampleRate is positive
+}
+
+// logRequest writes the log line of a request once it is answered.
+func logRequest(
+	logger *logrus.Entry,
+	policy *requestLogPolicy,
+	req *http.Request,
+	target string,
+	w *statusWriter,
+	start time.Time,
+) {
+	status := w.statusCode()
+	if !policy.sampled(status) {
+		return
+	}
+	logger.WithFields(logrus.Fields{
+		"status":   status,
+		"duration": time.Since(start),
+	}).Infof("%s %s", req.Method, target)
+}
+
+// statusWriter remembers the status of the response written through it.
+// Unwrap lets http.ResponseController reach the flushing and deadline
+// methods of the underlying writer; Hijack is kept for upgrade.go.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	// capture, when set, records the response body for the inspector, and
+	// capturedHeader the headers sent.
+	capture        *bodyCapture
+	capturedHeader http.Header
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 || w.status == http.StatusContinue || w.status == http.StatusEarlyHints {
+		w.status = status
+	}
+	if w.capture != nil && status >= http.StatusOK && w.capturedHeader == nil {
+		w.capturedHeader = w.Header().Clone()
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	n, err := w.ResponseWriter.Write(p)
+	if w.capture != nil && n > 0 {
+		_, _ = w.capture.Write(p[:n])
+	}
+	return n, err
+}
+
+// Hijack hands the connection over for protocol upgrades, whose 101
+// response is written on it directly.
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(w.ResponseWriter).Hijack()
+	if err == nil {
+		w.status = http.StatusSwitchingProtocols
+	}
+	return conn, brw, err
+}
+
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *statusWriter) statusCode() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
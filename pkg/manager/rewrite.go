@@ -0,0 +1,172 @@
+package manager
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// maxRewriteBody bounds the responses buffered for rewriting; larger ones
+// are passed through unchanged.
+const maxRewriteBody = 8 << 20
+
+// RewriteRule replaces text in HTML and JSON response bodies. Match is a
+// literal string, or a regular expression when Regex is set, in which case
+// Replace may use $1 style references. {public_url} and {subdomain} in
+// Replace are substituted for the tunnel.
+type RewriteRule struct {
+	Match   string
+	Replace string
+	Regex   bool
+}
+
+type compiledRule struct {
+	literal []byte
+	pattern *regexp.Regexp
+	replace string
+}
+
+// SetBodyRewrites sets the rules applied to the responses of subdomain; an
+// empty list removes them.
+func (m *Manager) SetBodyRewrites(subdomain string, rules []RewriteRule) error {
+	if len(rules) == 0 {
+		m.bodyRewrites.Delete(subdomain)
+		return nil
+	}
+
+	compiled, err := compileRewriteRules(rules)
+	if err != nil {
+		return err
+	}
+	m.bodyRewrites.Store(subdomain, compiled)
+	return nil
+}
+
+// ValidateRewriteRules reports the first invalid rule.
+func ValidateRewriteRules(rules []RewriteRule) error {
+	_, err := compileRewriteRules(rules)
+	return err
+}
+
+func compileRewriteRules(rules []RewriteRule) ([]compiledRule, error) {
+	compiled := make([]compiledRule, 0, len(rules))
+	for i, rule := range rules {
+		if rule.Match == "" {
+			return nil, fmt.Errorf("rule %d: match is required", i)
+		}
+		c := compiledRule{replace: rule.Replace}
+		if rule.Regex {
+			pattern, err := regexp.Compile(rule.Match)
+			if err != nil {
+				return nil, fmt.Errorf("rule %d: %w", i, err)
+			}
+			c.pattern = pattern
+		} else {
+			c.literal = []byte(rule.Match)
+		}
+		compiled = append(compiled, c)
+	}
+	return compiled, nil
+}
+
+func (m *Manager) rewriteRules(subdomain string) []compiledRule {
+	value, ok := m.bodyRewrites.Load(subdomain)
+	if !ok {
+		return nil
+	}
+	rules, _ := value.([]compiledRule)
+	return rules
+}
+
+// prepareRewrite asks the backend for an uncompressed response when the
+// body of subdomain may be rewritten.
+func (m *Manager) prepareRewrite(req *http.Request, subdomain string) {
+	if m.rewriteRules(subdomain) != nil || m.baseHref(req) != "" {
+		req.Header.Del("Accept-Encoding")
+	}
+}
+
+// rewriteBody returns the body to send for resp, rewritten when rules apply
+// to its content type, and updates the response headers to match. release
+// frees the buffered body once it is written. Bodies that would exceed the
+// buffer limit are passed through unchanged.
+func (m *Manager) rewriteBody(
+	resp *http.Response,
+	subdomain string,
+	logger *logrus.Entry,
+) (io.Reader, func(), error) {
+	rules := m.rewriteRules(subdomain)
+	href := m.baseHref(resp.Request)
+	mediaType, ok := rewritable(resp)
+	if (rules == nil && href == "") || !ok {
+		return resp.Body, func() {}, nil
+	}
+
+	reserved := int64(maxRewriteBody + 1)
+	if resp.ContentLength >= 0 && resp.ContentLength <= maxRewriteBody {
+		reserved = resp.ContentLength
+	}
+	if !m.memory.reserve(reserved) {
+		logger.Warn("Buffer limit reached, passing the response through without rewriting")
+		return resp.Body, func() {}, nil
+	}
+	release := func() { m.memory.release(reserved) }
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxRewriteBody+1))
+	if err != nil {
+		return nil, release, err
+	}
+	if len(body) > maxRewriteBody {
+		return io.MultiReader(bytes.NewReader(body), resp.Body), release, nil
+	}
+
+	publicURL := ""
+	if m.publicURL != nil {
+		publicURL = m.publicURL(subdomain)
+	}
+	placeholders := strings.NewReplacer("{public_url}", publicURL, "{subdomain}", subdomain)
+	for _, rule := range rules {
+		replace := placeholders.Replace(rule.replace)
+		if rule.pattern != nil {
+			body = rule.pattern.ReplaceAll(body, []byte(replace))
+		} else {
+			body = bytes.ReplaceAll(body, rule.literal, []byte(replace))
+		}
+	}
+	if href != "" && mediaType == "text/html" {
+		body = insertBase(body, href)
+	}
+
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	resp.Header.Del("ETag")
+	return bytes.NewReader(body), release, nil
+}
+
+// rewritable returns the media type of a response that carries an
+// uncompressed HTML or JSON body, and whether it does.
+func rewritable(resp *http.Response) (string, bool) {
+	if resp.Request != nil && resp.Request.Method == http.MethodHead {
+		return "", false
+	}
+	if resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusNotModified {
+		return "", false
+	}
+
+	h := resp.Header
+	if enc := h.Get("Content-Encoding"); enc != "" && enc != "identity" {
+		return "", false
+	}
+	mediaType, _, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil {
+		return "", false
+	}
+	ok := mediaType == "text/html" || mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+	return mediaType, ok
+}
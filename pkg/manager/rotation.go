@@ -0,0 +1,77 @@
+package manager
+
+import (
+	"math/rand/v2"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/snakeice/gunnel/pkg/connection"
+	"github.com/snakeice/gunnel/pkg/logging"
+	"github.com/snakeice/gunnel/pkg/protocol"
+)
+
+const (
+	// defaultRotationGrace is how long a rotated connection stays open for
+	// the client to move its tunnels when no grace period is configured.
+	defaultRotationGrace = time.Minute
+	// rotationJitter spreads the rotation of connections opened together,
+	// e.g. after a server restart, over this fraction of the lifetime.
+	rotationJitter = 0.1
+)
+
+type rotationPolicy struct {
+	lifetime time.Duration
+	grace    time.Duration
+}
+
+// SetConnectionLifetime makes the server ask clients to reconnect once a
+// connection has been open for lifetime (0 = never), closing the old
+// connection grace later.
+func (m *Manager) SetConnectionLifetime(lifetime, grace time.Duration) {
+	if grace <= 0 {
+		grace = defaultRotationGrace
+	}
+	m.rotation.Store(&rotationPolicy{lifetime: lifetime, grace: grace})
+}
+
+// scheduleRotation starts the lifetime timer of conn. The returned function
+// stops it.
+func (m *Manager) scheduleRotation(conn *connection.Connection) func() bool {
+	policy := m.rotation.Load()
+	if policy == nil || policy.lifetime <= 0 {
+		return func() bool { return false }
+	}
+
+	jitter := time.Duration(float64(policy.lifetime) * rotationJitter)
+	//nolint:gosec // G404: jitter does not need a secure source
+	lifetime := policy.lifetime + rand.N(jitter+1)
+
+	timer := time.AfterFunc(lifetime, func() {
+		m.rotateConnection(conn, lifetime, policy.grace)
+	})
+	return timer.Stop
+}
+
+// rotateConnection asks the client of conn to reconnect and stops routing new
+// streams to conn while it does.
+func (m *Manager) rotateConnection(conn *connection.Connection, age, grace time.Duration) {
+	if !conn.Connected() {
+		return
+	}
+
+	conn.SetDraining()
+	conn.Send(&protocol.Reconnect{Reason: "connection lifetime reached", Grace: grace})
+
+	logger := logging.Control.WithFields(logrus.Fields{
+		"age":   age.Round(time.Second),
+		"grace": grace,
+	})
+	logger.Info("Connection reached its maximum lifetime, asking client to reconnect")
+
+	time.AfterFunc(grace, func() {
+		if conn.Connected() {
+			logger.Info("Closing rotated connection")
+			conn.CloseWithReason(protocol.CloseRotated, "connection lifetime reached")
+		}
+	})
+}
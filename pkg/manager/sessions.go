@@ -0,0 +1,123 @@
+package manager
+
+import (
+	"errors"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/snakeice/gunnel/pkg/metrics"
+)
+
+// ErrSessionNotFound is returned when closing a session that is not open.
+var ErrSessionNotFound = errors.New("session not found")
+
+// SessionKind tells the long-lived connections of a tunnel apart.
+type SessionKind string
+
+const (
+	// SessionWebSocket is an HTTP connection switched to another protocol,
+	// usually WebSocket.
+	SessionWebSocket SessionKind = "websocket"
+	// SessionTCP is a connection to the public port of a TCP tunnel.
+	SessionTCP SessionKind = "tcp"
+)
+
+// Session is a long-lived connection piped through a tunnel.
+type Session struct {
+	ID        string      `json:"id"`
+	Subdomain string      `json:"subdomain"`
+	Kind      SessionKind `json:"kind"`
+	Remote    string      `json:"remote"`
+	// Protocol is the protocol an upgraded HTTP connection switched to.
+	Protocol string    `json:"protocol,omitempty"`
+	Since    time.Time `json:"since"`
+}
+
+// SessionCounts is the number of open sessions of a tunnel per kind.
+type SessionCounts struct {
+	WebSocket int `json:"websocket"`
+	TCP       int `json:"tcp"`
+}
+
+type openSession struct {
+	Session
+	close func() error
+}
+
+// openSession records s until the returned function is called; closing it
+// through the admin API calls closeFn.
+func (m *Manager) openSession(s Session, closeFn func() error) func() {
+	s.ID = strconv.FormatUint(m.nextSessionID.Add(1), 10)
+	s.Since = time.Now()
+	m.sessions.Store(s.ID, &openSession{Session: s, close: closeFn})
+	metrics.AddActiveSessions(s.Subdomain, string(s.Kind), 1)
+	return func() {
+		if _, ok := m.sessions.LoadAndDelete(s.ID); ok {
+			metrics.AddActiveSessions(s.Subdomain, string(s.Kind), -1)
+		}
+	}
+}
+
+// Sessions lists the open sessions of subdomain, or of every tunnel when
+// subdomain is "", oldest first.
+func (m *Manager) Sessions(subdomain string) []Session {
+	list := make([]Session, 0)
+	m.sessions.Range(func(_, value any) bool {
+		if s, ok := value.(*openSession); ok && (subdomain == "" || s.Subdomain == subdomain) {
+			list = append(list, s.Session)
+		}
+		return true
+	})
+	slices.SortFunc(list, func(a, b Session) int {
+		if c := a.Since.Compare(b.Since); c != 0 {
+			return c
+		}
+		return strings.Compare(a.ID, b.ID)
+	})
+	return list
+}
+
+// SessionCounts returns the open sessions of each tunnel having some.
+func (m *Manager) SessionCounts() map[string]SessionCounts {
+	counts := make(map[string]SessionCounts)
+	m.sessions.Range(func(_, value any) bool {
+		s, ok := value.(*openSession)
+		if !ok {
+			return true
+		}
+		c := counts[s.Subdomain]
+		switch s.Kind {
+		case SessionWebSocket:
+			c.WebSocket++
+		case SessionTCP:
+			c.TCP++
+		}
+		counts[s.Subdomain] = c
+		return true
+	})
+	return counts
+}
+
+// CloseSession closes the connection of the session with id.
+func (m *Manager) CloseSession(id string) error {
+	value, ok := m.sessions.Load(id)
+	if !ok {
+		return ErrSessionNotFound
+	}
+	s, _ := value.(*openSession)
+	return s.close()
+}
+
+// CloseSessions closes every open session of subdomain and returns how many
+// there were.
+func (m *Manager) CloseSessions(subdomain string) int {
+	closed := 0
+	for _, s := range m.Sessions(subdomain) {
+		if err := m.CloseSession(s.ID); !errors.Is(err, ErrSessionNotFound) {
+			closed++
+		}
+	}
+	return closed
+}
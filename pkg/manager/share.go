@@ -0,0 +1,143 @@
+package manager
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Bounds of the lifetime of share links.
+const (
+	DefaultShareTTL = 24 * time.Hour
+	MaxShareTTL     = 30 * 24 * time.Hour
+)
+
+// shareSuffixLen is the length of the random part of share link names.
+const shareSuffixLen = 4
+
+// shareAlphabet is what the random part of share link names is drawn from.
+const shareAlphabet = "abcdefghijklmnopqrstuvwxyz0123456789"
+
+// ErrShareNotFound is returned for share links that do not exist or expired.
+var ErrShareNotFound = errors.New("share link not found")
+
+// ShareLink is a temporary alternate name of an HTTP tunnel, e.g.
+// "demo-x7f2" for "demo", to share it without giving out its stable name.
+// Requests for it are served as if they were for the tunnel, with its access
+// checks.
+type ShareLink struct {
+	Name      string    `json:"name"`
+	Subdomain string    `json:"subdomain"`
+	URL       string    `json:"url,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// CreateShareLink mints a share link to the connected tunnel of subdomain,
+// valid for ttl (DefaultShareTTL when 0).
+func (m *Manager) CreateShareLink(subdomain string, ttl time.Duration) (ShareLink, error) {
+	if ttl == 0 {
+		ttl = DefaultShareTTL
+	}
+	if ttl < 0 || ttl > MaxShareTTL {
+		return ShareLink{}, fmt.Errorf("ttl must be positive and at most %s", MaxShareTTL)
+	}
+	if subdomain == gunnelSubdomain || subdomain == statusSubdomain || !m.HasKnownSubdomain(subdomain) {
+		return ShareLink{}, ErrSubdomainNotFound
+	}
+
+	// Keep the name a valid DNS label with room for the suffix.
+	prefix := subdomain
+	if maxPrefix := 63 - shareSuffixLen - 1; len(prefix) > maxPrefix {
+		prefix = strings.TrimRight(prefix[:maxPrefix], "-")
+	}
+	now := time.Now()
+	link := ShareLink{Subdomain: subdomain, CreatedAt: now, ExpiresAt: now.Add(ttl)}
+	for range maxRandomAttempts {
+		suffix, err := randomShareSuffix()
+		if err != nil {
+			return ShareLink{}, err
+		}
+		link.Name = prefix + "-" + suffix
+		if _, registered := m.getGroup(link.Name); registered {
+			continue
+		}
+		if _, named := m.namedTunnelFor(link.Name); named {
+			continue
+		}
+		if _, taken := m.shares.LoadOrStore(link.Name, link); !taken {
+			return m.withShareURL(link), nil
+		}
+	}
+	return ShareLink{}, errors.New("no free share link name")
+}
+
+// ShareLinks lists the share links not expired yet, by name.
+func (m *Manager) ShareLinks() []ShareLink {
+	now := time.Now()
+	list := make([]ShareLink, 0)
+	m.shares.Range(func(key, value any) bool {
+		link, _ := value.(ShareLink)
+		if !now.Before(link.ExpiresAt) {
+			m.shares.CompareAndDelete(key, value)
+			return true
+		}
+		list = append(list, m.withShareURL(link))
+		return true
+	})
+	slices.SortFunc(list, func(a, b ShareLink) int { return strings.Compare(a.Name, b.Name) })
+	return list
+}
+
+// ShareLink returns the share link called name, if it has not expired.
+func (m *Manager) ShareLink(name string) (ShareLink, bool) {
+	value, ok := m.shares.Load(name)
+	if !ok {
+		return ShareLink{}, false
+	}
+	link, _ := value.(ShareLink)
+	if !time.Now().Before(link.ExpiresAt) {
+		m.shares.CompareAndDelete(name, value)
+		return ShareLink{}, false
+	}
+	return m.withShareURL(link), true
+}
+
+// DeleteShareLink revokes the share link called name.
+func (m *Manager) DeleteShareLink(name string) error {
+	if _, ok := m.ShareLink(name); !ok {
+		return ErrShareNotFound
+	}
+	m.shares.Delete(name)
+	return nil
+}
+
+// ResolveShareLink returns the subdomain a share link stands for, or name
+// itself when it is not one.
+func (m *Manager) ResolveShareLink(name string) string {
+	if link, ok := m.ShareLink(name); ok {
+		return link.Subdomain
+	}
+	return name
+}
+
+func (m *Manager) withShareURL(link ShareLink) ShareLink {
+	if m.publicURL != nil {
+		link.URL = m.publicURL(link.Name)
+	}
+	return link
+}
+
+func randomShareSuffix() (string, error) {
+	buf := make([]byte, shareSuffixLen)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	for i, b := range buf {
+		buf[i] = shareAlphabet[int(b)%len(shareAlphabet)]
+	}
+	return string(buf), nil
+}
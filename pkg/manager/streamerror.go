@@ -0,0 +1,71 @@
+package manager
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/sirupsen/logrus"
+	"github.com/snakeice/gunnel/pkg/protocol"
+	"github.com/snakeice/gunnel/pkg/transport"
+)
+
+// streamError is a client's report that it could not serve a stream, e.g.
+// because nothing listens on its backend's port.
+type streamError struct {
+	code    protocol.StreamErrorCode
+	message string
+}
+
+func (e *streamError) Error() string {
+	return fmt.Sprintf("client could not serve stream (%s): %s", e.code, e.message)
+}
+
+// status is the HTTP status a request failing with e is answered with.
+func (e *streamError) status() int {
+	switch e.code {
+	case protocol.StreamErrorNoBackend:
+		return http.StatusServiceUnavailable
+	case protocol.StreamErrorRefused:
+		return http.StatusForbidden
+	default:
+		return http.StatusBadGateway
+	}
+}
+
+// reason completes "The service behind <host> ..." on the error page.
+func (e *streamError) reason() string {
+	switch e.code {
+	case protocol.StreamErrorNoBackend:
+		return "is not configured on the connected client"
+	case protocol.StreamErrorRefused:
+		return "refused the request"
+	default:
+		return "is not reachable right now"
+	}
+}
+
+func newStreamError(msg *protocol.Message, logger *logrus.Entry) *streamError {
+	report := protocol.StreamError{}
+	if err := protocol.Unmarshal(&report, msg); err != nil {
+		report = protocol.StreamError{Code: protocol.StreamErrorUnknown, Message: err.Error()}
+	}
+	logger.WithFields(logrus.Fields{
+		"code":  report.Code.String(),
+		"error": report.Message,
+	}).Warn("Client could not serve the stream")
+	return &streamError{code: report.Code, message: report.Message}
+}
+
+// receiveStreamError reads the StreamError a client sent in place of a
+// response. An HTTP response never starts with its message type.
+func receiveStreamError(stream transport.Stream, logger *logrus.Entry) (bool, error) {
+	first, err := stream.BufferedReader().Peek(1)
+	if err != nil || first[0] != byte(protocol.MessageStreamError) {
+		return false, nil
+	}
+	msg, err := stream.Receive()
+	if err != nil {
+		return true, fmt.Errorf("failed to read response: %w", err)
+	}
+	return true, newStreamError(msg, logger)
+}
@@ -0,0 +1,49 @@
+package manager
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/snakeice/gunnel/pkg/transport"
+)
+
+// streamBody copies a streamed response body to w, flushing every write so
+// events reach the user as they arrive. The stream and write deadlines are
+// lifted for the copy, as events may be minutes apart.
+func streamBody(w http.ResponseWriter, body io.Reader, stream transport.Stream, logger *logrus.Entry) (int64, error) {
+	rc := http.NewResponseController(w)
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		logger.WithError(err).Debug("Failed to lift response write deadline")
+	}
+	if err := stream.SetReadDeadline(transport.NoDeadline); err != nil {
+		logger.WithError(err).Debug("Failed to lift stream read deadline")
+	}
+	defer func() {
+		if err := stream.SetReadDeadline(time.Time{}); err != nil {
+			logger.WithError(err).Debug("Failed to restore stream read deadline")
+		}
+	}()
+
+	fw := &flushWriter{w: w, rc: rc}
+	if err := rc.Flush(); err != nil {
+		return 0, err
+	}
+	return io.Copy(fw, body)
+}
+
+// flushWriter flushes the response after every write.
+type flushWriter struct {
+	w  io.Writer
+	rc *http.ResponseController
+}
+
+func (f *flushWriter) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, f.rc.Flush()
+}
@@ -0,0 +1,185 @@
+package manager
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/snakeice/gunnel/pkg/logging"
+	"github.com/snakeice/gunnel/pkg/metrics"
+	"github.com/snakeice/gunnel/pkg/protocol"
+	"github.com/snakeice/gunnel/pkg/transport"
+	"github.com/snakeice/gunnel/pkg/tunnel"
+)
+
+// tcpListener is the public port of a raw TCP tunnel.
+type tcpListener struct {
+	ln   net.Listener
+	port int
+}
+
+// SetTCPEndpoint sets the local address TCP tunnels listen on (empty for all
+// addresses) and the host named in their public tcp:// URL.
+func (m *Manager) SetTCPEndpoint(bindAddress, host string) {
+	m.tcpBindAddress = bindAddress
+	m.tcpHost = host
+}
+
+// openTCPTunnel makes sure subdomain has a public TCP port, reusing the one
+// it already has when its client registers again, and returns the port.
+func (m *Manager) openTCPTunnel(subdomain string) (int, error) {
+	if value, ok := m.tcpListeners.Load(subdomain); ok {
+		if l, ok := value.(*tcpListener); ok {
+			return l.port, nil
+		}
+	}
+
+	ln, port, err := m.tcpPorts.listen(m.tcpBindAddress)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open a public TCP port: %w", err)
+	}
+
+	l := &tcpListener{ln: ln, port: port}
+	if existing, loaded := m.tcpListeners.LoadOrStore(subdomain, l); loaded {
+		_ = ln.Close()
+		m.tcpPorts.release("tcp", port)
+		if other, ok := existing.(*tcpListener); ok {
+			return other.port, nil
+		}
+	}
+
+	logging.Data.WithFields(logrus.Fields{
+		"subdomain": subdomain,
+		"port":      l.port,
+	}).Info("Opened TCP tunnel port")
+	go m.acceptTCP(subdomain, ln)
+	return l.port, nil
+}
+
+// closeTCPTunnel closes the public port of subdomain, if it has one.
+// Connections already proxied keep running until either side closes.
+func (m *Manager) closeTCPTunnel(subdomain string) {
+	value, ok := m.tcpListeners.LoadAndDelete(subdomain)
+	if !ok {
+		return
+	}
+	l, ok := value.(*tcpListener)
+	if !ok {
+		return
+	}
+	if err := l.ln.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+		logging.Data.WithError(err).WithField("subdomain", subdomain).Warn("Failed to close TCP tunnel port")
+	}
+	m.tcpPorts.release("tcp", l.port)
+	logging.Data.WithFields(logrus.Fields{
+		"subdomain": subdomain,
+		"port":      l.port,
+	}).Info("Closed TCP tunnel port")
+}
+
+// portURL returns the public address of a TCP or UDP tunnel, or "" when no
+// host is configured.
+func (m *Manager) portURL(proto protocol.Protocol, port int) string {
+	if m.tcpHost == "" {
+		return ""
+	}
+	u := url.URL{Scheme: string(proto), Host: net.JoinHostPort(m.tcpHost, strconv.Itoa(port))}
+	return u.String()
+}
+
+func (m *Manager) acceptTCP(subdomain string, ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				logging.Data.WithError(err).WithField("subdomain", subdomain).Error("Failed to accept TCP connection")
+			}
+			return
+		}
+		go m.handleTCPConn(subdomain, conn)
+	}
+}
+
+// handleTCPConn pipes a public TCP connection to the client of subdomain
+// over a new stream, without looking at the bytes.
+func (m *Manager) handleTCPConn(subdomain string, conn net.Conn) {
+	start := time.Now()
+	logger := logging.Data.WithFields(logrus.Fields{
+		"subdomain": subdomain,
+		"remote":    conn.RemoteAddr().String(),
+	})
+	defer func() {
+		if err := conn.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+			logger.WithError(err).Debug("Failed to close TCP connection")
+		}
+	}()
+
+	if m.isPaused(subdomain) {
+		logger.Debug("Tunnel paused by its owner, dropping TCP connection")
+		return
+	}
+	releaseIP, reason := m.tcpGuard.admit(hostOf(conn.RemoteAddr()), start)
+	if releaseIP == nil {
+		logger.WithField("reason", reason).Debug("Per-IP limit reached, dropping TCP connection")
+		metrics.RecordTCPRefused(reason)
+		return
+	}
+	defer releaseIP()
+	if _, offline := m.offlineUntil(subdomain, start); offline {
+		logger.Debug("Tunnel outside its scheduled hours, dropping TCP connection")
+		return
+	}
+	release, exhausted := m.memory.admit()
+	if release == nil {
+		logger.WithField("resource", exhausted).Warn("Server at its memory limits, dropping TCP connection")
+		metrics.RecordLoadShed(exhausted)
+		return
+	}
+	defer release()
+
+	stream, err := m.Acquire(subdomain)
+	if err != nil {
+		logger.WithError(err).Warn("No stream for TCP connection")
+		m.recordOutcome(subdomain, true, 0, 0)
+		metrics.RecordTunnelError(subdomain, "acquire_failed")
+		return
+	}
+	logger = streamLogger(logger, stream)
+	defer func() {
+		if err := stream.Close(); err != nil {
+			logger.WithError(err).Log(transport.LogLevel(err), "Failed to close stream")
+		}
+		m.Release(subdomain, stream)
+	}()
+
+	beginMsg := &protocol.BeginConnection{
+		Subdomain:  subdomain,
+		RemoteAddr: conn.RemoteAddr().String(),
+		LocalAddr:  conn.LocalAddr().String(),
+	}
+	m.offerKeepAlive(beginMsg)
+	keepAlive, err := m.beginStream(stream, beginMsg, logger)
+	if err != nil {
+		logger.WithError(err).Warn("Client refused TCP connection")
+		m.recordOutcome(subdomain, true, 0, 0)
+		metrics.RecordTunnelError(subdomain, classifyProxyError(err))
+		return
+	}
+
+	logger.Debug("Proxying TCP connection")
+	closeSession := m.openSession(Session{
+		Subdomain: subdomain,
+		Kind:      SessionTCP,
+		Remote:    conn.RemoteAddr().String(),
+	}, func() error { return errors.Join(conn.Close(), stream.Close()) })
+	defer closeSession()
+	if err := tunnel.NewTunnelWithLocal(conn, stream).WithKeepAlive(keepAlive).Proxy(); err != nil {
+		logger.WithError(err).Warn("TCP tunnel failed")
+	}
+	m.recordOutcome(subdomain, false, 0, 0)
+	logger.WithField("duration", time.Since(start)).Debug("TCP connection closed")
+}
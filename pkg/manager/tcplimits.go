@@ -0,0 +1,185 @@
+package manager
+
+import (
+	"errors"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/snakeice/gunnel/pkg/logging"
+	"github.com/snakeice/gunnel/pkg/metrics"
+)
+
+// ErrNotBanned is returned when lifting a ban an IP does not have.
+var ErrNotBanned = errors.New("ip is not banned")
+
+// TCPLimits caps the connections each source IP may open to the public ports
+// of TCP tunnels, over all of them. Zero fields are unlimited.
+type TCPLimits struct {
+	// MaxConnsPerIP bounds the connections an IP holds open at once.
+	MaxConnsPerIP int
+	// MaxConnsPerMinute bounds the connections an IP opens per minute.
+	MaxConnsPerMinute int
+	// BanAfter bans an IP once this many of its connections were refused
+	// within a minute, for BanDuration.
+	BanAfter    int
+	BanDuration time.Duration
+}
+
+// TCPBan is a source IP refused on every TCP tunnel port, the HTTP edge and
+// the QUIC listener until a time.
+type TCPBan struct {
+	IP    string    `json:"ip"`
+	Until time.Time `json:"until"`
+}
+
+// tcpGuard enforces TCPLimits per source IP.
+type tcpGuard struct {
+	mu     sync.Mutex
+	limits TCPLimits
+	peers  map[string]*tcpPeer
+}
+
+// tcpPeer is what tcpGuard knows of an IP. Rate and refusals are counted in
+// fixed one-minute windows.
+type tcpPeer struct {
+	active      int
+	windowStart time.Time
+	opened      int
+	refused     int
+	bannedUntil time.Time
+}
+
+// SetTCPLimits sets the per-IP caps of TCP tunnel ports; nil removes them.
+func (m *Manager) SetTCPLimits(limits *TCPLimits) {
+	m.tcpGuard.mu.Lock()
+	defer m.tcpGuard.mu.Unlock()
+	if limits == nil {
+		limits = &TCPLimits{}
+	}
+	m.tcpGuard.limits = *limits
+}
+
+// admit takes a connection slot for ip. It fails with the reason, for
+// metrics, when ip is banned or over a cap; otherwise release must be called
+// once the connection is closed.
+func (g *tcpGuard) admit(ip string, now time.Time) (func(), string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	l := g.limits
+	if l.MaxConnsPerIP <= 0 && l.MaxConnsPerMinute <= 0 {
+		return func() {}, ""
+	}
+	if g.peers == nil {
+		g.peers = make(map[string]*tcpPeer)
+	}
+	p, ok := g.peers[ip]
+	if !ok {
+		p = &tcpPeer{}
+		g.peers[ip] = p
+	}
+	if now.Before(p.bannedUntil) {
+		return nil, "banned"
+	}
+	if now.Sub(p.windowStart) >= time.Minute {
+		p.windowStart, p.opened, p.refused = now, 0, 0
+	}
+
+	reason := ""
+	switch {
+	case l.MaxConnsPerIP > 0 && p.active >= l.MaxConnsPerIP:
+		reason = "connections"
+	case l.MaxConnsPerMinute > 0 && p.opened >= l.MaxConnsPerMinute:
+		reason = "rate"
+	}
+	if reason != "" {
+		p.refused++
+		if l.BanAfter > 0 && l.BanDuration > 0 && p.refused >= l.BanAfter {
+			p.bannedUntil = now.Add(l.BanDuration)
+			logging.Data.WithFields(logrus.Fields{
+				"remote": ip,
+				"until":  p.bannedUntil,
+			}).Warn("Banning IP from TCP tunnels")
+			metrics.RecordTCPBan()
+		}
+		return nil, reason
+	}
+
+	p.active++
+	p.opened++
+	return func() {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		p.active--
+	}, ""
+}
+
+// TCPBans lists the IPs banned from TCP tunnel ports.
+func (m *Manager) TCPBans() []TCPBan {
+	m.tcpGuard.mu.Lock()
+	defer m.tcpGuard.mu.Unlock()
+
+	now := time.Now()
+	bans := make([]TCPBan, 0)
+	for ip, p := range m.tcpGuard.peers {
+		if now.Before(p.bannedUntil) {
+			bans = append(bans, TCPBan{IP: ip, Until: p.bannedUntil})
+		}
+	}
+	slices.SortFunc(bans, func(a, b TCPBan) int { return strings.Compare(a.IP, b.IP) })
+	return bans
+}
+
+// IPBanned reports whether ip is banned. Bans are earned on TCP tunnel ports
+// but the server refuses the IP on its other entry points as well.
+func (m *Manager) IPBanned(ip string) bool {
+	m.tcpGuard.mu.Lock()
+	defer m.tcpGuard.mu.Unlock()
+
+	p, ok := m.tcpGuard.peers[ip]
+	return ok && time.Now().Before(p.bannedUntil)
+}
+
+// UnbanTCP lifts the ban of ip and forgets its refused connections.
+func (m *Manager) UnbanTCP(ip string) error {
+	m.tcpGuard.mu.Lock()
+	defer m.tcpGuard.mu.Unlock()
+
+	p, ok := m.tcpGuard.peers[ip]
+	if !ok || !time.Now().Before(p.bannedUntil) {
+		return ErrNotBanned
+	}
+	p.bannedUntil, p.refused = time.Time{}, 0
+	return nil
+}
+
+// ReportTCPLimits forgets the IPs with nothing left to track and publishes
+// how many are banned.
+func (m *Manager) ReportTCPLimits() {
+	m.tcpGuard.mu.Lock()
+	defer m.tcpGuard.mu.Unlock()
+
+	now := time.Now()
+	banned := 0
+	for ip, p := range m.tcpGuard.peers {
+		switch {
+		case now.Before(p.bannedUntil):
+			banned++
+		case p.active == 0 && now.Sub(p.windowStart) >= time.Minute:
+			delete(m.tcpGuard.peers, ip)
+		}
+	}
+	metrics.SetTCPBannedIPs(banned)
+}
+
+func hostOf(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
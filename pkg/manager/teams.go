@@ -0,0 +1,168 @@
+package manager
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Role is the permission level of a team member.
+type Role string
+
+const (
+	// RoleViewer may see and inspect the team's tunnels.
+	RoleViewer Role = "viewer"
+	// RoleAdmin may also pause and resume them.
+	RoleAdmin Role = "admin"
+)
+
+// Valid reports whether r is a known role.
+func (r Role) Valid() bool {
+	return r == RoleViewer || r == RoleAdmin
+}
+
+// TeamMember is the identity behind a team token.
+type TeamMember struct {
+	Team string
+	Name string
+	Role Role
+}
+
+// CanManage reports whether the member may change the state of tunnels.
+func (t TeamMember) CanManage() bool {
+	return t.Role == RoleAdmin
+}
+
+// TeamTunnel describes a tunnel owned by a team.
+type TeamTunnel struct {
+	Subdomain   string      `json:"subdomain"`
+	Connections int         `json:"connections"` // QUIC connections serving the tunnel
+	Connected   bool        `json:"connected"`
+	Paused      bool        `json:"paused"`
+	LastActive  time.Time   `json:"last_active"`
+	State       TunnelState `json:"state"`
+}
+
+// teamToken is a team member and the SHA-256 hash of their token.
+type teamToken struct {
+	hash   [sha256.Size]byte
+	member TeamMember
+}
+
+// SetTeamMembers installs the team tokens, keyed by token. Members register
+// tunnels with their token and share them with the rest of their team.
+func (m *Manager) SetTeamMembers(members map[string]TeamMember) {
+	tokens := make([]teamToken, 0, len(members))
+	for token, member := range members {
+		tokens = append(tokens, teamToken{hash: sha256.Sum256([]byte(token)), member: member})
+	}
+
+	m.authMu.Lock()
+	defer m.authMu.Unlock()
+	m.teamMembers = tokens
+}
+
+// TeamMember returns the member owning token. Tokens are compared by hash in
+// constant time, so the time taken does not reveal how much of one matched.
+func (m *Manager) TeamMember(token string) (TeamMember, bool) {
+	if token == "" {
+		return TeamMember{}, false
+	}
+	hash := sha256.Sum256([]byte(token))
+
+	m.authMu.RLock()
+	defer m.authMu.RUnlock()
+	for _, t := range m.teamMembers {
+		if subtle.ConstantTimeCompare(hash[:], t.hash[:]) == 1 {
+			return t.member, true
+		}
+	}
+	return TeamMember{}, false
+}
+
+func (m *Manager) teamsEnabled() bool {
+	m.authMu.RLock()
+	defer m.authMu.RUnlock()
+	return len(m.teamMembers) > 0
+}
+
+// teamOf returns the team owning subdomain, if any.
+func (m *Manager) teamOf(subdomain string) string {
+	team, _ := m.owners.Load(subdomain)
+	name, _ := team.(string)
+	return name
+}
+
+// mayClaim reports whether the holder of token may register subdomain. It
+// may not while another team's client is connected on it.
+func (m *Manager) mayClaim(subdomain, token string) bool {
+	member, _ := m.TeamMember(token)
+	if owner := m.teamOf(subdomain); owner != "" && owner != member.Team {
+		if group, ok := m.getGroup(subdomain); ok && group.connected() {
+			return false
+		}
+	}
+	return true
+}
+
+// claimSubdomain records the team of token as the owner of subdomain, once
+// its registration succeeded.
+func (m *Manager) claimSubdomain(subdomain, token string) {
+	if member, ok := m.TeamMember(token); ok {
+		m.owners.Store(subdomain, member.Team)
+	} else {
+		m.owners.Delete(subdomain)
+	}
+}
+
+// TeamTunnels lists the registered tunnels owned by team.
+func (m *Manager) TeamTunnels(team string) []TeamTunnel {
+	tunnels := make([]TeamTunnel, 0)
+	m.subdomains.Range(func(key, value any) bool {
+		subdomain, ok := key.(string)
+		if !ok || m.teamOf(subdomain) != team {
+			return true
+		}
+		group, ok := value.(*clientGroup)
+		if !ok {
+			return true
+		}
+
+		tunnel := TeamTunnel{
+			Subdomain: subdomain,
+			Connected: group.connected(),
+			Paused:    m.isPaused(subdomain),
+		}
+		for _, conn := range group.list() {
+			tunnel.Connections++
+			if last := conn.GetLastActive(); last.After(tunnel.LastActive) {
+				tunnel.LastActive = last
+			}
+		}
+		if status, ok := m.TunnelStatus(subdomain); ok {
+			tunnel.State = status.State
+		}
+		tunnels = append(tunnels, tunnel)
+		return true
+	})
+
+	slices.SortFunc(tunnels, func(a, b TeamTunnel) int { return strings.Compare(a.Subdomain, b.Subdomain) })
+	return tunnels
+}
+
+// OwnedBy reports whether subdomain belongs to team.
+func (m *Manager) OwnedBy(subdomain, team string) bool {
+	return team != "" && m.teamOf(subdomain) == team
+}
+
+// SetPaused pauses or resumes public traffic for subdomain on the server's
+// side, as a client does with "gunnel pause".
+func (m *Manager) SetPaused(subdomain string, paused bool) {
+	if paused {
+		m.paused.Store(subdomain, struct{}{})
+	} else {
+		m.paused.Delete(subdomain)
+	}
+}
@@ -0,0 +1,25 @@
+package manager_test
+
+import (
+	"testing"
+
+	"github.com/snakeice/gunnel/pkg/manager"
+)
+
+func TestTeamMemberMatchesWholeToken(t *testing.T) {
+	m := manager.New()
+	bob := manager.TeamMember{Team: "blue", Name: "bob", Role: manager.RoleAdmin}
+	m.SetTeamMembers(map[string]manager.TeamMember{
+		"blue-token": bob,
+		"red-token":  {Team: "red", Name: "ann", Role: manager.RoleViewer},
+	})
+
+	if got, ok := m.TeamMember("blue-token"); !ok || got != bob {
+		t.Errorf("TeamMember(blue-token) = %+v, %v, want %+v", got, ok, bob)
+	}
+	for _, token := range []string{"", "blue", "blue-token2", "BLUE-TOKEN"} {
+		if got, ok := m.TeamMember(token); ok {
+			t.Errorf("TeamMember(%q) = %+v, want no member", token, got)
+		}
+	}
+}
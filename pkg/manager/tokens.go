@@ -0,0 +1,372 @@
+package manager
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/snakeice/gunnel/pkg/store"
+)
+
+const clientTokenPrefix = "gnt_"
+
+var (
+	ErrClientTokenNotFound = errors.New("client token not found")
+	ErrInvalidClientToken  = errors.New("invalid client token")
+)
+
+// ClientToken is a registration token managed through the admin API. It
+// limits which subdomains its clients may register and how many at once.
+type ClientToken struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// Subdomains are path.Match patterns such as "preview-*"; empty allows any.
+	Subdomains []string `json:"subdomains,omitempty"`
+	// MaxTunnels caps the tunnels registered at once (0 = unlimited).
+	MaxTunnels int       `json:"max_tunnels,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+	// TokenHash is the hex SHA-256 of the token.
+	TokenHash string `json:"token_hash"`
+}
+
+// ClientTokenSpec is the desired state of a client token. An empty TokenHash
+// keeps the current token, or has one generated when the token is created.
+type ClientTokenSpec struct {
+	Subdomains []string
+	MaxTunnels int
+	TokenHash  string
+}
+
+// ValidateClientToken checks the name and spec of a client token, and
+// normalizes the hash of spec.
+func ValidateClientToken(name string, spec *ClientTokenSpec) error {
+	if !tunnelNamePattern.MatchString(name) {
+		return fmt.Errorf("%w: bad name %q", ErrInvalidClientToken, name)
+	}
+	return spec.validate()
+}
+
+func (s *ClientTokenSpec) validate() error {
+	for _, pattern := range s.Subdomains {
+		if _, err := path.Match(pattern, ""); err != nil || pattern == "" {
+			return fmt.Errorf("%w: bad subdomain pattern %q", ErrInvalidClientToken, pattern)
+		}
+	}
+	if s.MaxTunnels < 0 {
+		return fmt.Errorf("%w: max_tunnels must not be negative", ErrInvalidClientToken)
+	}
+	if s.TokenHash != "" {
+		if sum, err := hex.DecodeString(s.TokenHash); err != nil || len(sum) != sha256.Size {
+			return fmt.Errorf("%w: token_sha256 must be a hex SHA-256", ErrInvalidClientToken)
+		}
+		s.TokenHash = strings.ToLower(s.TokenHash)
+	}
+	return nil
+}
+
+// allows reports whether the token may register subdomain.
+func (t *ClientToken) allows(subdomain string) bool {
+	if len(t.Subdomains) == 0 {
+		return true
+	}
+	for _, pattern := range t.Subdomains {
+		if ok, _ := path.Match(pattern, subdomain); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// clientTokenRegistry is the registry of client tokens, optionally persisted
+// to a store like the named tunnels.
+type clientTokenRegistry struct {
+	mu     sync.RWMutex
+	store  store.Store
+	key    string
+	tokens map[string]*ClientToken // by name
+
+	// quotaMu serializes the max_tunnels checks; pending counts the
+	// registrations in progress that passed them.
+	quotaMu sync.Mutex
+	pending map[pendingTunnel]int
+}
+
+type pendingTunnel struct {
+	tenant    string
+	subdomain string
+}
+
+// LoadClientTokens reads the client tokens from key of st and persists later
+// changes there. A missing key starts an empty registry.
+func (m *Manager) LoadClientTokens(st store.Store, key string) error {
+	registry := &clientTokenRegistry{store: st, key: key, tokens: map[string]*ClientToken{}}
+
+	data, err := st.Get(key)
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+	case err != nil:
+		return fmt.Errorf("failed to read client tokens: %w", err)
+	default:
+		var list []*ClientToken
+		if err := json.Unmarshal(data, &list); err != nil {
+			return fmt.Errorf("failed to parse client tokens: %w", err)
+		}
+		for _, t := range list {
+			registry.tokens[t.Name] = t
+		}
+	}
+
+	m.clientTokens.Store(registry)
+	return nil
+}
+
+func (m *Manager) clientTokenRegistry() *clientTokenRegistry {
+	if registry := m.clientTokens.Load(); registry != nil {
+		return registry
+	}
+
+	m.clientTokens.CompareAndSwap(nil, &clientTokenRegistry{tokens: map[string]*ClientToken{}})
+	return m.clientTokens.Load()
+}
+
+// PutClientToken makes the client token name match spec, creating it when
+// missing. Applying the same spec again changes nothing, so declarative tools
+// can call it repeatedly. The token is only returned when one was generated,
+// and cannot be recovered later.
+func (m *Manager) PutClientToken(name string, spec ClientTokenSpec) (ClientToken, string, bool, error) {
+	if err := ValidateClientToken(name, &spec); err != nil {
+		return ClientToken{}, "", false, err
+	}
+
+	registry := m.clientTokenRegistry()
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+
+	for _, other := range registry.tokens {
+		if other.Name != name && spec.TokenHash != "" && other.TokenHash == spec.TokenHash {
+			return ClientToken{}, "", false, fmt.Errorf("%w: token is already used by %q", ErrInvalidClientToken, other.Name)
+		}
+	}
+
+	now := time.Now().UTC()
+	current, exists := registry.tokens[name]
+	if exists {
+		if slices.Equal(current.Subdomains, spec.Subdomains) && current.MaxTunnels == spec.MaxTunnels &&
+			(spec.TokenHash == "" || spec.TokenHash == current.TokenHash) {
+			return *current, "", false, nil
+		}
+
+		updated := *current
+		updated.Subdomains = spec.Subdomains
+		updated.MaxTunnels = spec.MaxTunnels
+		updated.UpdatedAt = now
+		if spec.TokenHash != "" {
+			updated.TokenHash = spec.TokenHash
+		}
+		registry.tokens[name] = &updated
+		if err := registry.save(); err != nil {
+			registry.tokens[name] = current
+			return ClientToken{}, "", false, err
+		}
+		if updated.TokenHash != current.TokenHash {
+			m.revokeTenant("client:"+name, "client token rotated")
+		}
+		return updated, "", false, nil
+	}
+
+	id, err := randomHex(8)
+	if err != nil {
+		return ClientToken{}, "", false, err
+	}
+	token := &ClientToken{
+		ID:         id,
+		Name:       name,
+		Subdomains: spec.Subdomains,
+		MaxTunnels: spec.MaxTunnels,
+		CreatedAt:  now,
+		UpdatedAt:  now,
+		TokenHash:  spec.TokenHash,
+	}
+
+	var secret string
+	if token.TokenHash == "" {
+		random, err := randomHex(32)
+		if err != nil {
+			return ClientToken{}, "", false, err
+		}
+		secret = clientTokenPrefix + random
+		sum := sha256.Sum256([]byte(secret))
+		token.TokenHash = hex.EncodeToString(sum[:])
+	}
+
+	registry.tokens[name] = token
+	if err := registry.save(); err != nil {
+		delete(registry.tokens, name)
+		return ClientToken{}, "", false, err
+	}
+	return *token, secret, true, nil
+}
+
+// DeleteClientToken revokes a client token, disconnecting the clients
+// registered with it.
+func (m *Manager) DeleteClientToken(name string) error {
+	registry := m.clientTokenRegistry()
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+
+	token, ok := registry.tokens[name]
+	if !ok {
+		return ErrClientTokenNotFound
+	}
+
+	delete(registry.tokens, name)
+	if err := registry.save(); err != nil {
+		registry.tokens[name] = token
+		return err
+	}
+	m.revokeTenant("client:"+name, "client token deleted")
+	return nil
+}
+
+// LookupClientToken returns the client token called name.
+func (m *Manager) LookupClientToken(name string) (ClientToken, bool) {
+	registry := m.clientTokenRegistry()
+	registry.mu.RLock()
+	defer registry.mu.RUnlock()
+
+	token, ok := registry.tokens[name]
+	if !ok {
+		return ClientToken{}, false
+	}
+	return *token, true
+}
+
+// ClientTokens lists the client tokens sorted by name.
+func (m *Manager) ClientTokens() []ClientToken {
+	registry := m.clientTokenRegistry()
+	registry.mu.RLock()
+	defer registry.mu.RUnlock()
+
+	list := make([]ClientToken, 0, len(registry.tokens))
+	for _, t := range registry.tokens {
+		list = append(list, *t)
+	}
+	slices.SortFunc(list, func(a, b ClientToken) int { return strings.Compare(a.Name, b.Name) })
+	return list
+}
+
+// clientTokenFor returns the client token matching token.
+func (m *Manager) clientTokenFor(token string) (*ClientToken, bool) {
+	registry := m.clientTokens.Load()
+	if registry == nil || token == "" {
+		return nil, false
+	}
+
+	sum := sha256.Sum256([]byte(token))
+	hash := []byte(hex.EncodeToString(sum[:]))
+
+	registry.mu.RLock()
+	defer registry.mu.RUnlock()
+	for _, t := range registry.tokens {
+		if subtle.ConstantTimeCompare(hash, []byte(t.TokenHash)) == 1 {
+			return t, true
+		}
+	}
+	return nil, false
+}
+
+func (m *Manager) clientTokensEnabled() bool {
+	registry := m.clientTokens.Load()
+	if registry == nil {
+		return false
+	}
+
+	registry.mu.RLock()
+	defer registry.mu.RUnlock()
+	return len(registry.tokens) > 0
+}
+
+// reserveClientToken enforces the subdomain patterns and tunnel quota of the
+// client token matching token, returning why it refuses subdomain. An
+// accepted subdomain counts against the quota until release is called, which
+// the registration does once it has stored its tenant or failed, so
+// concurrent registrations with the same token cannot exceed the quota.
+func (m *Manager) reserveClientToken(token, subdomain string) (func(), string, bool) {
+	release := func() {}
+	t, ok := m.clientTokenFor(token)
+	if !ok {
+		return release, "", true
+	}
+	if !t.allows(subdomain) {
+		return release, fmt.Sprintf("token %q may not register subdomain %q", t.Name, subdomain), false
+	}
+	if t.MaxTunnels == 0 {
+		return release, "", true
+	}
+
+	registry := m.clientTokenRegistry()
+	registry.quotaMu.Lock()
+	defer registry.quotaMu.Unlock()
+
+	tenant := "client:" + t.Name
+	used := map[string]struct{}{}
+	m.tenants.Range(func(key, value any) bool {
+		if name, _ := key.(string); name != subdomain && value == tenant {
+			used[name] = struct{}{}
+		}
+		return true
+	})
+	for key := range registry.pending {
+		if key.subdomain != subdomain && key.tenant == tenant {
+			used[key.subdomain] = struct{}{}
+		}
+	}
+	if len(used) >= t.MaxTunnels {
+		return release, fmt.Sprintf("token %q already has %d of %d tunnels", t.Name, len(used), t.MaxTunnels), false
+	}
+
+	key := pendingTunnel{tenant: tenant, subdomain: subdomain}
+	if registry.pending == nil {
+		registry.pending = map[pendingTunnel]int{}
+	}
+	registry.pending[key]++
+	return func() {
+		registry.quotaMu.Lock()
+		defer registry.quotaMu.Unlock()
+		if registry.pending[key]--; registry.pending[key] == 0 {
+			delete(registry.pending, key)
+		}
+	}, "", true
+}
+
+// save writes the registry; callers hold mu.
+func (r *clientTokenRegistry) save() error {
+	if r.store == nil {
+		return nil
+	}
+
+	list := make([]*ClientToken, 0, len(r.tokens))
+	for _, t := range r.tokens {
+		list = append(list, t)
+	}
+	slices.SortFunc(list, func(a, b *ClientToken) int { return strings.Compare(a.Name, b.Name) })
+
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode client tokens: %w", err)
+	}
+
+	if err := r.store.Put(r.key, data); err != nil {
+		return fmt.Errorf("failed to write client tokens: %w", err)
+	}
+	return nil
+}
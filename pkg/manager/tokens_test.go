@@ -0,0 +1,42 @@
+package manager_test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+
+	"github.com/snakeice/gunnel/pkg/manager"
+)
+
+func TestClientTokenQuotaCountsPendingRegistrations(t *testing.T) {
+	mgr := manager.New()
+	sum := sha256.Sum256([]byte("secret"))
+	spec := manager.ClientTokenSpec{MaxTunnels: 1, TokenHash: hex.EncodeToString(sum[:])}
+	if _, _, _, err := mgr.PutClientToken("ci", spec); err != nil {
+		t.Fatalf("put token: %v", err)
+	}
+
+	release, _, ok := mgr.ReserveClientToken("secret", "one")
+	if !ok {
+		t.Fatal("expected the first tunnel to fit the quota")
+	}
+	if _, reason, ok := mgr.ReserveClientToken("secret", "two"); ok {
+		t.Fatal("expected a concurrent registration to exceed the quota")
+	} else if reason != `token "ci" already has 1 of 1 tunnels` {
+		t.Errorf("unexpected reason %q", reason)
+	}
+	// Another connection of the same tunnel does not count twice.
+	again, _, ok := mgr.ReserveClientToken("secret", "one")
+	if !ok {
+		t.Fatal("expected another connection of the reserved tunnel to be accepted")
+	}
+	again()
+
+	// A failed registration gives its slot back.
+	release()
+	releaseTwo, _, ok := mgr.ReserveClientToken("secret", "two")
+	if !ok {
+		t.Fatal("expected the released slot to be available")
+	}
+	releaseTwo()
+}
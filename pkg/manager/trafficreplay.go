@@ -0,0 +1,138 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// defaultReplayRate is the pace of traffic replays that do not set one.
+const defaultReplayRate = 5
+
+// TrafficReplay sends the requests the inspector captured for one tunnel to
+// another, e.g. yesterday's webhooks from production to staging.
+type TrafficReplay struct {
+	// From is the subdomain whose captured requests are replayed.
+	From string `json:"from"`
+	// To is the subdomain they are sent to; it may be From itself.
+	To string `json:"to"`
+	// Since skips the requests captured before it, when set.
+	Since time.Time `json:"since"`
+	// Rate bounds the requests sent per second (default 5).
+	Rate float64 `json:"rate"`
+	// Limit bounds the requests replayed, the oldest first (0 = all).
+	Limit int `json:"limit"`
+}
+
+// TrafficReplayReport sums up a traffic replay. Diffs lists the requests
+// whose replay was answered with another status, or failed.
+type TrafficReplayReport struct {
+	From     string        `json:"from"`
+	To       string        `json:"to"`
+	Sent     int           `json:"sent"`
+	Same     int           `json:"same"`
+	Changed  int           `json:"changed"`
+	Failed   int           `json:"failed"`
+	Skipped  int           `json:"skipped"`
+	Duration time.Duration `json:"duration"`
+	Diffs    []ReplayDiff  `json:"diffs"`
+}
+
+// ReplayDiff is a replayed request answered differently than the original.
+type ReplayDiff struct {
+	ID     string `json:"id"`
+	Method string `json:"method"`
+	Path   string `json:"path"`
+	Status int    `json:"status"`
+	// ReplayID is the captured replay, absent when it failed with Error.
+	ReplayID     string `json:"replay_id,omitempty"`
+	ReplayStatus int    `json:"replay_status,omitempty"`
+	Error        string `json:"error,omitempty"`
+}
+
+// ReplayTraffic replays the requests captured for r.From against r.To, in
+// the order they arrived and at most r.Rate per second, and reports how the
+// answers differ. Requests whose body was truncated are skipped. It stops
+// early when ctx is done.
+func (m *Manager) ReplayTraffic(ctx context.Context, r TrafficReplay) (TrafficReplayReport, error) {
+	report := TrafficReplayReport{From: r.From, To: r.To, Diffs: make([]ReplayDiff, 0)}
+	switch {
+	case r.From == "" || r.To == "":
+		return report, errors.New("from and to are required")
+	case r.Rate < 0 || r.Limit < 0:
+		return report, errors.New("rate and limit must not be negative")
+	case !m.InspectorEnabled():
+		return report, ErrInspectorDisabled
+	case !m.HasKnownSubdomain(r.To):
+		return report, fmt.Errorf("%w: %s", ErrNoConnection, r.To)
+	}
+	if r.Rate == 0 {
+		r.Rate = defaultReplayRate
+	}
+
+	captured := m.capturedFor(r.From, r.Since)
+	if r.Limit > 0 && len(captured) > r.Limit {
+		captured = captured[:r.Limit]
+	}
+
+	start := time.Now()
+	interval := time.Duration(float64(time.Second) / r.Rate)
+	next := start
+	for _, orig := range captured {
+		if orig.RequestBodyTruncated {
+			report.Skipped++
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			report.Duration = time.Since(start)
+			return report, ctx.Err()
+		case <-time.After(time.Until(next)):
+		}
+		next = next.Add(interval)
+
+		report.Sent++
+		diff := ReplayDiff{ID: orig.ID, Method: orig.Method, Path: orig.Path, Status: orig.Status}
+		replayed, err := m.replay(ctx, orig, r.To)
+		switch {
+		case err != nil:
+			report.Failed++
+			diff.Error = err.Error()
+		case replayed.Status == orig.Status:
+			report.Same++
+			continue
+		default:
+			report.Changed++
+			diff.ReplayID, diff.ReplayStatus = replayed.ID, replayed.Status
+		}
+		report.Diffs = append(report.Diffs, diff)
+	}
+	report.Duration = time.Since(start)
+	return report, nil
+}
+
+// capturedFor returns the exchanges kept for subdomain since the given time,
+// oldest first.
+func (m *Manager) capturedFor(subdomain string, since time.Time) []*CapturedRequest {
+	ins := m.inspector.Load()
+	if ins == nil {
+		return nil
+	}
+	value, ok := ins.rings.Load(subdomain)
+	if !ok {
+		return nil
+	}
+	ring, _ := value.(*captureRing)
+	ring.mu.Lock()
+	list := make([]*CapturedRequest, 0, len(ring.entries))
+	for _, c := range ring.entries {
+		if !c.At.Before(since) {
+			list = append(list, c)
+		}
+	}
+	ring.mu.Unlock()
+	slices.SortFunc(list, func(a, b *CapturedRequest) int { return a.At.Compare(b.At) })
+	return list
+}
@@ -0,0 +1,251 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/sirupsen/logrus"
+	"github.com/snakeice/gunnel/pkg/connection"
+	"github.com/snakeice/gunnel/pkg/logging"
+	"github.com/snakeice/gunnel/pkg/protocol"
+	"github.com/snakeice/gunnel/pkg/transport"
+)
+
+const (
+	// udpSessionTimeout is how long a public peer of a UDP tunnel is
+	// remembered without traffic.
+	udpSessionTimeout = 2 * time.Minute
+	// maxUDPSessions bounds the peers tracked per UDP tunnel; packets from
+	// new ones are dropped past it.
+	maxUDPSessions = 4096
+	// maxUDPPacket is the largest UDP payload.
+	maxUDPPacket = 64 << 10
+)
+
+// udpTunnel is the public port of a UDP tunnel and the peers sending to it.
+// Each peer address is a session, so replies from the backend reach it.
+type udpTunnel struct {
+	subdomain string
+	conn      net.PacketConn
+	port      int
+
+	mu       sync.Mutex
+	byAddr   map[string]*udpSession
+	byID     map[uint32]*udpSession
+	nextID   uint32
+	stopOnce sync.Once
+	stop     chan struct{}
+}
+
+type udpSession struct {
+	id       uint32
+	addr     net.Addr
+	lastSeen time.Time
+}
+
+// openUDPTunnel makes sure subdomain has a public UDP port, reusing the one
+// it already has when its client registers again, and returns the port.
+func (m *Manager) openUDPTunnel(subdomain string) (int, error) {
+	if value, ok := m.udpTunnels.Load(subdomain); ok {
+		if t, ok := value.(*udpTunnel); ok {
+			return t.port, nil
+		}
+	}
+
+	conn, port, err := m.tcpPorts.listenPacket(m.tcpBindAddress)
+	if err != nil {
+		return 0, err
+	}
+
+	t := &udpTunnel{
+		subdomain: subdomain,
+		conn:      conn,
+		port:      port,
+		byAddr:    make(map[string]*udpSession),
+		byID:      make(map[uint32]*udpSession),
+		stop:      make(chan struct{}),
+	}
+	if existing, loaded := m.udpTunnels.LoadOrStore(subdomain, t); loaded {
+		_ = conn.Close()
+		m.tcpPorts.release("udp", port)
+		if other, ok := existing.(*udpTunnel); ok {
+			return other.port, nil
+		}
+	}
+
+	logging.Data.WithFields(logrus.Fields{
+		"subdomain": subdomain,
+		"port":      port,
+	}).Info("Opened UDP tunnel port")
+	go m.serveUDP(t)
+	go t.expireSessions()
+	return port, nil
+}
+
+// closeUDPTunnel closes the public UDP port of subdomain, if it has one.
+func (m *Manager) closeUDPTunnel(subdomain string) {
+	value, ok := m.udpTunnels.LoadAndDelete(subdomain)
+	if !ok {
+		return
+	}
+	t, ok := value.(*udpTunnel)
+	if !ok {
+		return
+	}
+	t.stopOnce.Do(func() { close(t.stop) })
+	if err := t.conn.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+		logging.Data.WithError(err).WithField("subdomain", subdomain).Warn("Failed to close UDP tunnel port")
+	}
+	m.tcpPorts.release("udp", t.port)
+	logging.Data.WithFields(logrus.Fields{
+		"subdomain": subdomain,
+		"port":      t.port,
+	}).Info("Closed UDP tunnel port")
+}
+
+// closePublicPorts closes the TCP or UDP port of subdomain, if it has one.
+func (m *Manager) closePublicPorts(subdomain string) {
+	m.closeTCPTunnel(subdomain)
+	m.closeUDPTunnel(subdomain)
+}
+
+// serveUDP forwards the packets sent to the public port of t to its client.
+func (m *Manager) serveUDP(t *udpTunnel) {
+	logger := logging.Data.WithField("subdomain", t.subdomain)
+	buf := make([]byte, maxUDPPacket)
+	for {
+		n, addr, err := t.conn.ReadFrom(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				logger.WithError(err).Error("Failed to read UDP packet")
+			}
+			return
+		}
+
+		if m.isPaused(t.subdomain) {
+			continue
+		}
+		if _, offline := m.offlineUntil(t.subdomain, time.Now()); offline {
+			continue
+		}
+		client, ok := m.getClient(t.subdomain)
+		if !ok {
+			continue
+		}
+		session, ok := t.session(addr)
+		if !ok {
+			logger.WithField("remote", addr.String()).Debug("Too many UDP sessions, dropping packet")
+			continue
+		}
+
+		d := protocol.Datagram{Subdomain: t.subdomain, Session: session, Payload: buf[:n]}
+		data, err := d.MarshalBinary()
+		if err != nil {
+			continue
+		}
+		if err := client.SendDatagram(data); err != nil {
+			logDatagramError(logger, err)
+		}
+	}
+}
+
+// session returns the session of addr, starting one for a new peer.
+func (t *udpTunnel) session(addr net.Addr) (uint32, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key := addr.String()
+	if s, ok := t.byAddr[key]; ok {
+		s.lastSeen = time.Now()
+		return s.id, true
+	}
+	if len(t.byAddr) >= maxUDPSessions {
+		return 0, false
+	}
+	t.nextID++
+	s := &udpSession{id: t.nextID, addr: addr, lastSeen: time.Now()}
+	t.byAddr[key] = s
+	t.byID[s.id] = s
+	return s.id, true
+}
+
+// reply sends payload to the peer of session.
+func (t *udpTunnel) reply(session uint32, payload []byte) error {
+	t.mu.Lock()
+	s, ok := t.byID[session]
+	if ok {
+		s.lastSeen = time.Now()
+	}
+	t.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	_, err := t.conn.WriteTo(payload, s.addr)
+	return err
+}
+
+func (t *udpTunnel) expireSessions() {
+	ticker := time.NewTicker(udpSessionTimeout / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.stop:
+			return
+		case now := <-ticker.C:
+			t.mu.Lock()
+			for key, s := range t.byAddr {
+				if now.Sub(s.lastSeen) > udpSessionTimeout {
+					delete(t.byAddr, key)
+					delete(t.byID, s.id)
+				}
+			}
+			t.mu.Unlock()
+		}
+	}
+}
+
+// receiveDatagrams delivers the UDP replies a client sends on transp to the
+// public peers, for the tunnels client serves.
+func (m *Manager) receiveDatagrams(transp transport.Transport, client *connection.Connection) {
+	ctx := transp.Context()
+	for {
+		data, err := transp.ReceiveDatagram(ctx)
+		if err != nil {
+			if ctx.Err() == nil && !errors.Is(err, context.Canceled) {
+				logging.Data.WithError(err).Log(transport.LogLevel(err), "Failed to receive datagram")
+			}
+			return
+		}
+
+		var d protocol.Datagram
+		if err := d.UnmarshalBinary(data); err != nil {
+			continue
+		}
+		group, ok := m.getGroup(d.Subdomain)
+		if !ok || !group.has(client) {
+			continue
+		}
+		value, ok := m.udpTunnels.Load(d.Subdomain)
+		if !ok {
+			continue
+		}
+		if t, ok := value.(*udpTunnel); ok {
+			if err := t.reply(d.Session, d.Payload); err != nil && !errors.Is(err, net.ErrClosed) {
+				logging.Data.WithError(err).WithField("subdomain", d.Subdomain).Debug("Failed to send UDP reply")
+			}
+		}
+	}
+}
+
+func logDatagramError(logger *logrus.Entry, err error) {
+	var tooLarge *quic.DatagramTooLargeError
+	if errors.As(err, &tooLarge) {
+		logger.WithField("max_size", tooLarge.MaxDatagramPayloadSize).Debug("UDP packet too large for a datagram")
+		return
+	}
+	logger.WithError(err).Log(transport.LogLevel(err), "Failed to send datagram")
+}
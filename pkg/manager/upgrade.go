@@ -0,0 +1,86 @@
+package manager
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/snakeice/gunnel/pkg/transport"
+	"github.com/snakeice/gunnel/pkg/tunnel"
+	"golang.org/x/net/http/httpguts"
+)
+
+// errHijackUnsupported is returned for upgrades on connections that cannot be
+// taken over, e.g. HTTP/2 ones.
+var errHijackUnsupported = errors.New("connection does not support protocol upgrades")
+
+// isUpgrade reports whether req asks to switch protocols, as WebSocket
+// handshakes do.
+func isUpgrade(req *http.Request) bool {
+	return req.Header.Get("Upgrade") != "" &&
+		httpguts.HeaderValuesContainsToken(req.Header["Connection"], "upgrade")
+}
+
+// switchProtocols relays the 101 answer to an upgrade request, then pipes the
+// user's connection and stream in both directions until either side closes.
+// The stream cannot be reused afterwards, so it is closed. keepAlive is the
+// stream keepalive the client agreed to.
+func (m *Manager) switchProtocols(
+	w http.ResponseWriter,
+	resp *http.Response,
+	stream transport.Stream,
+	keepAlive tunnel.KeepAlive,
+	subdomain string,
+	logger *logrus.Entry,
+) (int, int64, error) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		return 0, 0, errHijackUnsupported
+	}
+	conn, brw, err := hijacker.Hijack()
+	if err != nil {
+		return 0, 0, errors.Join(errHijackUnsupported, err)
+	}
+	defer func() {
+		if err := conn.Close(); err != nil {
+			logger.WithError(err).Debug("Failed to close upgraded connection")
+		}
+		if err := stream.Close(); err != nil {
+			logger.WithError(err).Log(transport.LogLevel(err), "Failed to close upgraded stream")
+		}
+	}()
+
+	// The connection outlives the server's read and write timeouts.
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		logger.WithError(err).Warn("Failed to clear upgraded connection deadline")
+		return resp.StatusCode, 0, nil
+	}
+
+	m.injectResponseHeaders(resp.Header, subdomain, stream.ConnectionID())
+	err = resp.Write(brw)
+	if err == nil {
+		err = brw.Flush()
+	}
+	if err != nil {
+		logger.WithError(err).Warn("Failed to write upgrade response")
+		return resp.StatusCode, 0, nil
+	}
+
+	start := time.Now()
+	logger.WithField("protocol", resp.Header.Get("Upgrade")).Debug("Switched protocols")
+	closeSession := m.openSession(Session{
+		Subdomain: subdomain,
+		Kind:      SessionWebSocket,
+		Remote:    conn.RemoteAddr().String(),
+		Protocol:  resp.Header.Get("Upgrade"),
+	}, func() error { return errors.Join(conn.Close(), stream.Close()) })
+	defer closeSession()
+	if err := tunnel.NewTunnelWithLocal(tunnel.NewBufferedConn(conn, brw.Reader), stream).
+		WithKeepAlive(keepAlive).
+		Proxy(); err != nil {
+		logger.WithError(err).Warn("Upgraded connection failed")
+	}
+	logger.WithField("duration", time.Since(start)).Debug("Upgraded connection closed")
+	return resp.StatusCode, 0, nil
+}
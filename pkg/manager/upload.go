@@ -0,0 +1,175 @@
+package manager
+
+import (
+	"crypto/subtle"
+	"errors"
+	"html/template"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// UploadPath is where tunnels with an upload endpoint accept files.
+const UploadPath = "/_gunnel/upload"
+
+//nolint:gochecknoglobals // parsed once from the embedded templates
+var uploadTemplate = template.Must(template.ParseFS(templates, "templates/upload.html"))
+
+// UploadEndpoint lets holders of Token send a file to a tunnel at
+// UploadPath. The server streams the file to the backend as a POST to
+// Target, so large payloads never need to fit in memory.
+type UploadEndpoint struct {
+	Token string
+	// Target is the backend path receiving the file ("/" when empty).
+	Target string
+	// MaxBytes limits the upload size; zero means no limit.
+	MaxBytes int64
+}
+
+// SetUploadEndpoint enables the upload endpoint of subdomain; nil disables it.
+func (m *Manager) SetUploadEndpoint(subdomain string, ep *UploadEndpoint) {
+	if ep == nil {
+		m.uploads.Delete(subdomain)
+		return
+	}
+	m.uploads.Store(subdomain, ep)
+}
+
+func (m *Manager) uploadEndpoint(req *http.Request, subdomain string) *UploadEndpoint {
+	if req.URL.Path != UploadPath {
+		return nil
+	}
+	value, ok := m.uploads.Load(subdomain)
+	if !ok {
+		return nil
+	}
+	ep, _ := value.(*UploadEndpoint)
+	return ep
+}
+
+// handleUpload serves the upload form on GET and forwards uploaded files to
+// the backend on POST. Files may be sent as multipart form data, whose first
+// file is forwarded, or as the raw request body.
+func (m *Manager) handleUpload(
+	w http.ResponseWriter,
+	req *http.Request,
+	subdomain string,
+	ep *UploadEndpoint,
+	logger *logrus.Entry,
+) {
+	if !ep.authorized(req) {
+		logger.WithField("remote", req.RemoteAddr).Warn("Rejected upload request")
+		w.Header().Set("WWW-Authenticate", `Basic realm="gunnel upload"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		data := struct{ Subdomain, Path string }{Subdomain: subdomain, Path: ep.target().Path}
+		if err := uploadTemplate.Execute(w, data); err != nil {
+			logger.WithError(err).Warn("Failed to render upload page")
+		}
+		return
+	case http.MethodPost:
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body := req.Body
+	if ep.MaxBytes > 0 {
+		body = http.MaxBytesReader(w, req.Body, ep.MaxBytes)
+		req.Body = body
+	}
+	forward, err := ep.forwardRequest(req)
+	if err != nil {
+		logger.WithError(err).Info("Invalid upload")
+		http.Error(w, "400 Bad Request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	logger.WithField("filename", forward.Header.Get("X-Gunnel-Filename")).Info("Forwarding upload")
+	err = m.handleProxyFlow(w, forward, subdomain, logger)
+	// req.Write does not wrap body errors, so ask the body itself whether it
+	// hit the limit; a MaxBytesReader keeps returning its error.
+	var tooLarge *http.MaxBytesError
+	_, bodyErr := body.Read(nil)
+	switch {
+	case err != nil && errors.As(bodyErr, &tooLarge):
+		http.Error(w, "413 Request Entity Too Large", http.StatusRequestEntityTooLarge)
+	case err != nil:
+		m.handleProxyError(w, forward, subdomain, logger, err)
+	}
+}
+
+// authorized accepts the token as a bearer token or as the password of HTTP
+// basic auth, which browsers prompt for.
+func (ep *UploadEndpoint) authorized(req *http.Request) bool {
+	given, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		_, given, ok = req.BasicAuth()
+	}
+	return ok && ep.Token != "" && subtle.ConstantTimeCompare([]byte(given), []byte(ep.Token)) == 1
+}
+
+func (ep *UploadEndpoint) target() *url.URL {
+	u, err := url.ParseRequestURI(ep.Target)
+	if err != nil {
+		return &url.URL{Path: "/"}
+	}
+	return u
+}
+
+// forwardRequest builds the POST sent to the backend for an upload. The
+// Authorization header carrying the upload token is not forwarded, nor is
+// Expect: the server already answered it and the body is sent right away.
+func (ep *UploadEndpoint) forwardRequest(req *http.Request) (*http.Request, error) {
+	forward := req.Clone(req.Context())
+	forward.Method = http.MethodPost
+	forward.URL = ep.target()
+	forward.RequestURI = forward.URL.RequestURI()
+	forward.Header.Del("Authorization")
+	forward.Header.Del("Expect")
+
+	mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if mediaType != "multipart/form-data" {
+		return forward, nil
+	}
+
+	reader, err := req.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		part, err := reader.NextPart()
+		if errors.Is(err, io.EOF) {
+			return nil, errors.New("no file in form")
+		}
+		if err != nil {
+			return nil, err
+		}
+		if part.FileName() == "" {
+			continue
+		}
+
+		contentType := part.Header.Get("Content-Type")
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		forward.Header.Set("Content-Type", contentType)
+		forward.Header.Set("X-Gunnel-Filename", part.FileName())
+		forward.Header.Del("Content-Length")
+		// The length of the file is unknown, so it is sent chunked.
+		forward.ContentLength = -1
+		forward.Body = io.NopCloser(part)
+		return forward, nil
+	}
+}
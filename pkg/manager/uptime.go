@@ -0,0 +1,212 @@
+package manager
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/snakeice/gunnel/pkg/store"
+)
+
+// DefaultUptimeRetention is how long state changes are kept by default.
+const DefaultUptimeRetention = 30 * 24 * time.Hour
+
+// StateChange is an entry of a tunnel's incident timeline.
+type StateChange struct {
+	State  TunnelState `json:"state"`
+	Reason string      `json:"reason,omitempty"`
+	At     time.Time   `json:"at"`
+}
+
+// Uptime summarizes the states of a tunnel over a window ending now.
+type Uptime struct {
+	Subdomain string `json:"subdomain"`
+	Window    string `json:"window"`
+	// Ratio is the share of the observed time a client served the tunnel,
+	// Degraded the share it spent degraded. Time before the first recorded
+	// state does not count.
+	Ratio    float64       `json:"uptime"`
+	Degraded float64       `json:"degraded"`
+	Events   []StateChange `json:"events"`
+}
+
+// stateHistory keeps the state changes of every tunnel, optionally persisted
+// to a JSON file.
+type stateHistory struct {
+	mu        sync.Mutex
+	store     store.Store
+	key       string
+	retention time.Duration
+	tunnels   map[string][]StateChange
+	dirty     bool
+}
+
+// LoadUptimeHistory reads the state changes saved at key of st and keeps
+// later ones there for retention (DefaultUptimeRetention when zero). A
+// missing key starts an empty history; a nil st keeps it in memory.
+func (m *Manager) LoadUptimeHistory(st store.Store, key string, retention time.Duration) error {
+	if retention <= 0 {
+		retention = DefaultUptimeRetention
+	}
+	history := &stateHistory{store: st, key: key, retention: retention, tunnels: map[string][]StateChange{}}
+
+	if st != nil {
+		data, err := st.Get(key)
+		switch {
+		case errors.Is(err, store.ErrNotFound):
+		case err != nil:
+			return fmt.Errorf("failed to read uptime history: %w", err)
+		default:
+			if err := json.Unmarshal(data, &history.tunnels); err != nil {
+				return fmt.Errorf("failed to parse uptime history: %w", err)
+			}
+		}
+	}
+
+	m.history.Store(history)
+	return nil
+}
+
+func (m *Manager) uptimeHistory() *stateHistory {
+	if history := m.history.Load(); history != nil {
+		return history
+	}
+
+	m.history.CompareAndSwap(nil, &stateHistory{
+		retention: DefaultUptimeRetention,
+		tunnels:   map[string][]StateChange{},
+	})
+	return m.history.Load()
+}
+
+func (h *stateHistory) record(subdomain string, change StateChange) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.tunnels[subdomain] = append(h.tunnels[subdomain], change)
+	h.dirty = true
+}
+
+// FlushUptimeHistory drops state changes past the retention and saves the
+// history when it changed.
+func (m *Manager) FlushUptimeHistory() error {
+	h := m.uptimeHistory()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	cutoff := time.Now().Add(-h.retention)
+	for subdomain, changes := range h.tunnels {
+		// Keep the last change before the cutoff: it is the state at the
+		// start of the retained period.
+		i := slices.IndexFunc(changes, func(c StateChange) bool { return c.At.After(cutoff) })
+		switch {
+		case i == -1 && changes[len(changes)-1].State == StateOffline:
+			delete(h.tunnels, subdomain)
+			h.dirty = true
+		case i == -1:
+			h.tunnels[subdomain] = changes[len(changes)-1:]
+			h.dirty = h.dirty || len(changes) > 1
+		case i > 1:
+			h.tunnels[subdomain] = slices.Clone(changes[i-1:])
+			h.dirty = true
+		}
+	}
+
+	if h.store == nil || !h.dirty {
+		return nil
+	}
+
+	data, err := json.Marshal(h.tunnels)
+	if err != nil {
+		return fmt.Errorf("failed to encode uptime history: %w", err)
+	}
+	if err := h.store.Put(h.key, data); err != nil {
+		return fmt.Errorf("failed to write uptime history: %w", err)
+	}
+	h.dirty = false
+	return nil
+}
+
+// CloseUptimeHistory marks every tunnel offline, as the server is stopping,
+// and saves the history.
+func (m *Manager) CloseUptimeHistory() error {
+	h := m.uptimeHistory()
+	now := time.Now()
+	h.mu.Lock()
+	for subdomain, changes := range h.tunnels {
+		if changes[len(changes)-1].State != StateOffline {
+			h.tunnels[subdomain] = append(changes, StateChange{State: StateOffline, Reason: "server stopped", At: now})
+			h.dirty = true
+		}
+	}
+	h.mu.Unlock()
+
+	return m.FlushUptimeHistory()
+}
+
+// purgeUptimeHistory deletes the state changes of subdomain and reports
+// whether it had any.
+func (m *Manager) purgeUptimeHistory(subdomain string) bool {
+	h := m.uptimeHistory()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.tunnels[subdomain]; !ok {
+		return false
+	}
+	delete(h.tunnels, subdomain)
+	h.dirty = true
+	return true
+}
+
+// TunnelUptime returns the uptime and timeline of subdomain over the window
+// ending now; false means no state was ever recorded for it.
+func (m *Manager) TunnelUptime(subdomain string, window time.Duration) (Uptime, bool) {
+	h := m.uptimeHistory()
+	h.mu.Lock()
+	changes := slices.Clone(h.tunnels[subdomain])
+	h.mu.Unlock()
+	if len(changes) == 0 {
+		return Uptime{}, false
+	}
+
+	now := time.Now()
+	from := now.Add(-window)
+	report := Uptime{Subdomain: subdomain, Window: window.String(), Events: make([]StateChange, 0)}
+
+	var observed, up, degraded time.Duration
+	for i, c := range changes {
+		end := now
+		if i+1 < len(changes) {
+			end = changes[i+1].At
+		}
+		start := c.At
+		if start.Before(from) {
+			start = from
+		}
+		if !end.After(start) {
+			continue
+		}
+
+		span := end.Sub(start)
+		observed += span
+		if c.State != StateOffline {
+			up += span
+		}
+		if c.State == StateDegraded {
+			degraded += span
+		}
+		if !c.At.Before(from) {
+			report.Events = append(report.Events, c)
+		}
+	}
+
+	if observed > 0 {
+		report.Ratio = float64(up) / float64(observed)
+		report.Degraded = float64(degraded) / float64(observed)
+	}
+	return report, true
+}
@@ -0,0 +1,74 @@
+package manager
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+
+	"github.com/snakeice/gunnel/pkg/protocol"
+	"github.com/snakeice/gunnel/pkg/timeseries"
+	"github.com/snakeice/gunnel/pkg/usage"
+)
+
+const anonymousTenant = "anonymous"
+
+// SetUsage records every proxied request in r, grouped by the credential
+// the tunnel registered with.
+func (m *Manager) SetUsage(r *usage.Recorder) {
+	m.usage = r
+}
+
+func (m *Manager) Usage() *usage.Recorder {
+	return m.usage
+}
+
+// SetHistory sets where the per-minute traffic of tunnels is recorded.
+func (m *Manager) SetHistory(s *timeseries.Store) {
+	m.series = s
+}
+
+func (m *Manager) History() *timeseries.Store {
+	return m.series
+}
+
+// tenantFor names the credential reg authenticated with without revealing
+// it: a named tunnel, a team member, a client token, a key fingerprint or a
+// token hash.
+func (m *Manager) tenantFor(reg *protocol.ConnectionRegister) string {
+	if tunnel, ok := m.namedTunnelFor(reg.Subdomain); ok {
+		return "tunnel:" + tunnel.Name
+	}
+	if member, ok := m.TeamMember(reg.Token); ok {
+		return "team:" + member.Team + "/" + member.Name
+	}
+	if token, ok := m.clientTokenFor(reg.Token); ok {
+		return "client:" + token.Name
+	}
+	if len(reg.PublicKey) > 0 && m.keyAuthEnabled() {
+		sum := sha256.Sum256(reg.PublicKey)
+		return "key:SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+	}
+	if reg.Token != "" {
+		sum := sha256.Sum256([]byte(reg.Token))
+		return "token:" + hex.EncodeToString(sum[:4])
+	}
+	return anonymousTenant
+}
+
+// Tenant returns the usage tenant of the client registered on subdomain.
+func (m *Manager) Tenant(subdomain string) string {
+	if value, ok := m.tenants.Load(subdomain); ok {
+		if tenant, ok := value.(string); ok {
+			return tenant
+		}
+	}
+	return anonymousTenant
+}
+
+func (m *Manager) recordUsage(subdomain string, req *http.Request, bytesIn, bytesOut int64) {
+	if m.usage == nil {
+		return
+	}
+	m.usage.Record(m.Tenant(subdomain), subdomain, req.URL.EscapedPath(), bytesIn, bytesOut)
+}
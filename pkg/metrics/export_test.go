@@ -0,0 +1,8 @@
+package metrics
+
+const MaxPacketSize = maxPacketSize
+
+// Enabled returns the emitter the package recorders report to.
+func Enabled() *StatsD {
+	return statsd.Load()
+}
@@ -9,12 +9,15 @@ import (
 
 type StreamInfo struct {
 	ID            string
+	ConnectionID  string
 	Subdomain     string
 	StartTime     time.Time
-	LastActive    time.Time
 	IsActive      bool
 	BytesReceived atomic.Int64
 	BytesSent     atomic.Int64
+	// lastActive is unix nanoseconds; reads and writes of a stream update
+	// it from different goroutines.
+	lastActive atomic.Int64
 }
 
 type streamMetrics struct {
@@ -29,15 +32,16 @@ var metricsCollector = &streamMetrics{ //nolint:gochecknoglobals // singleton pa
 	streams: make([]*StreamInfo, 0),
 }
 
-func NewInfo(id string) *StreamInfo {
+func NewInfo(id, connectionID string) *StreamInfo {
 	info := &StreamInfo{
 		ID:            id,
+		ConnectionID:  connectionID,
 		StartTime:     time.Now(),
-		LastActive:    time.Now(),
 		IsActive:      true,
 		BytesReceived: atomic.Int64{},
 		BytesSent:     atomic.Int64{},
 	}
+	info.Touch()
 
 	metricsCollector.mu.Lock()
 	metricsCollector.streams = append(metricsCollector.streams, info)
@@ -50,21 +54,31 @@ func (s *StreamInfo) SetSubdomain(subdomain string) {
 	s.Subdomain = subdomain
 }
 
+// LastActive is when the stream last moved data or changed state.
+func (s *StreamInfo) LastActive() time.Time {
+	return time.Unix(0, s.lastActive.Load())
+}
+
+// Touch marks the stream active now.
+func (s *StreamInfo) Touch() {
+	s.lastActive.Store(time.Now().UnixNano())
+}
+
 func (s *StreamInfo) UpdateIn(in int) {
 	s.BytesReceived.Add(int64(in))
 	metricsCollector.totalIn.Add(int64(in))
-	s.LastActive = time.Now()
+	s.Touch()
 }
 
 func (s *StreamInfo) UpdateOut(out int) {
 	s.BytesSent.Add(int64(out))
 	metricsCollector.totalOut.Add(int64(out))
-	s.LastActive = time.Now()
+	s.Touch()
 }
 
 func (s *StreamInfo) Inactive() {
 	s.IsActive = false
-	s.LastActive = time.Now()
+	s.Touch()
 }
 
 func CleanupOldStreams(maxAge time.Duration) int {
@@ -76,7 +90,7 @@ func CleanupOldStreams(maxAge time.Duration) int {
 	removed := 0
 
 	for _, stream := range metricsCollector.streams {
-		if stream.IsActive || stream.LastActive.After(cutoff) {
+		if stream.IsActive || stream.LastActive().After(cutoff) {
 			active = append(active, stream)
 		} else {
 			removed++
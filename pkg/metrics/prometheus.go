@@ -1,6 +1,8 @@
 package metrics
 
 import (
+	"time"
+
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 )
@@ -72,6 +74,26 @@ var (
 		[]string{"subdomain"},
 	)
 
+	// ConnectionStreams tracks open QUIC streams per client connection.
+	ConnectionStreams = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "connection_open_streams",
+			Help:      "Number of open QUIC streams by client connection.",
+		},
+		[]string{"connection"},
+	)
+
+	// ConnectionStreamUtilization tracks open streams relative to the peer stream limit.
+	ConnectionStreamUtilization = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "connection_stream_utilization_ratio",
+			Help:      "Open QUIC streams divided by the stream limit by client connection.",
+		},
+		[]string{"connection"},
+	)
+
 	// TunnelErrors tracks tunnel-related errors.
 	TunnelErrors = promauto.NewCounterVec(
 		prometheus.CounterOpts{
@@ -81,6 +103,129 @@ var (
 		},
 		[]string{"subdomain", "error_type"},
 	)
+
+	// TunnelState is 1 for the current state of each tunnel and 0 for the others.
+	TunnelState = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "tunnel_state",
+			Help:      "Tunnel state by subdomain (1 for the current state).",
+		},
+		[]string{"subdomain", "state"},
+	)
+
+	// HedgedRequests tracks second attempts of slow requests and which attempt answered.
+	HedgedRequests = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "hedged_requests_total",
+			Help:      "Total hedged requests by subdomain and winning attempt (primary or hedge).",
+		},
+		[]string{"subdomain", "winner"},
+	)
+
+	// MemoryUsage tracks what the server holds against its memory limits.
+	MemoryUsage = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "memory_usage",
+			Help:      "Streams in flight, buffered bytes and captured requests held by the server.",
+		},
+		[]string{"resource"},
+	)
+
+	// MemoryHighWatermark tracks the peak of MemoryUsage since the start.
+	MemoryHighWatermark = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "memory_high_watermark",
+			Help:      "Peak memory usage since the server started by resource.",
+		},
+		[]string{"resource"},
+	)
+
+	// MemoryLimit tracks the configured limit of each resource (0 = unlimited).
+	MemoryLimit = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "memory_limit",
+			Help:      "Configured memory limit by resource (0 = unlimited).",
+		},
+		[]string{"resource"},
+	)
+
+	// LoadShed tracks requests refused with 503 to stay within the memory limits.
+	LoadShed = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "load_shed_total",
+			Help:      "Total requests and TCP connections shed by exhausted resource.",
+		},
+		[]string{"resource"},
+	)
+
+	// Registrations tracks client registrations, by result: "accepted" or
+	// the reason they were rejected.
+	Registrations = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "registrations_total",
+			Help:      "Total client registrations by result.",
+		},
+		[]string{"result"},
+	)
+
+	// StreamAcquireDuration tracks how long getting a stream to a tunnel's
+	// client takes, from the idle pool or by opening one.
+	StreamAcquireDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "stream_acquire_duration_seconds",
+			Help:      "Time to acquire a stream to the client of a subdomain.",
+			Buckets:   []float64{.0001, .0005, .001, .005, .01, .05, .1, .5, 1, 5},
+		},
+		[]string{"subdomain"},
+	)
+
+	// TCPRefused tracks connections to TCP tunnel ports refused by the per-IP
+	// limits.
+	TCPRefused = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "tcp_refused_total",
+			Help:      "Total TCP tunnel connections refused by per-IP limits, by reason.",
+		},
+		[]string{"reason"},
+	)
+
+	// TCPBans tracks the IPs banned from TCP tunnel ports.
+	TCPBans = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "tcp_bans_total",
+			Help:      "Total IPs banned from TCP tunnel ports.",
+		},
+	)
+
+	// TCPBannedIPs tracks the IPs currently banned from TCP tunnel ports.
+	TCPBannedIPs = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "tcp_banned_ips",
+			Help:      "IPs currently banned from TCP tunnel ports.",
+		},
+	)
+
+	// ActiveSessions tracks the long-lived connections, e.g. WebSockets and
+	// TCP connections, open through each tunnel.
+	ActiveSessions = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "active_sessions",
+			Help:      "Open long-lived connections by subdomain and kind.",
+		},
+		[]string{"subdomain", "kind"},
+	)
 )
 
 // RecordBytesReceived increments the bytes received counter for a subdomain.
@@ -89,6 +234,9 @@ func RecordBytesReceived(subdomain string, bytes int) {
 		subdomain = unknownLabel
 	}
 	BytesReceivedTotal.WithLabelValues(subdomain).Add(float64(bytes))
+	if s := statsd.Load(); s != nil {
+		s.count("bytes_received", int64(bytes), s.subdomainTags(subdomain))
+	}
 }
 
 // RecordBytesSent increments the bytes sent counter for a subdomain.
@@ -97,6 +245,9 @@ func RecordBytesSent(subdomain string, bytes int) {
 		subdomain = unknownLabel
 	}
 	BytesSentTotal.WithLabelValues(subdomain).Add(float64(bytes))
+	if s := statsd.Load(); s != nil {
+		s.count("bytes_sent", int64(bytes), s.subdomainTags(subdomain))
+	}
 }
 
 // RecordRequest records a completed HTTP request with its duration and status.
@@ -106,6 +257,11 @@ func RecordRequest(subdomain string, method string, statusCode int, durationSeco
 	}
 	RequestsTotal.WithLabelValues(subdomain, method, statusCodeString(statusCode)).Inc()
 	RequestDuration.WithLabelValues(subdomain, method).Observe(durationSeconds)
+	if s := statsd.Load(); s != nil {
+		tags := s.subdomainTags(subdomain, s.tag("method", method), s.tag("status", statusCodeString(statusCode)))
+		s.count("requests", 1, tags)
+		s.timing("request_duration", time.Duration(durationSeconds*float64(time.Second)), tags)
+	}
 }
 
 // IncActiveStream increments the active streams gauge for a subdomain.
@@ -114,6 +270,9 @@ func IncActiveStream(subdomain string) {
 		subdomain = unknownLabel
 	}
 	ActiveStreams.WithLabelValues(subdomain).Inc()
+	if s := statsd.Load(); s != nil {
+		s.addActive(subdomain, 1)
+	}
 }
 
 // DecActiveStream decrements the active streams gauge for a subdomain.
@@ -122,6 +281,9 @@ func DecActiveStream(subdomain string) {
 		subdomain = unknownLabel
 	}
 	ActiveStreams.WithLabelValues(subdomain).Dec()
+	if s := statsd.Load(); s != nil {
+		s.addActive(subdomain, -1)
+	}
 }
 
 // RecordStreamConnection records a new stream connection.
@@ -130,6 +292,9 @@ func RecordStreamConnection(subdomain string) {
 		subdomain = unknownLabel
 	}
 	StreamConnections.WithLabelValues(subdomain).Inc()
+	if s := statsd.Load(); s != nil {
+		s.count("stream_connections", 1, s.subdomainTags(subdomain))
+	}
 }
 
 // RecordTunnelError records a tunnel error.
@@ -138,6 +303,134 @@ func RecordTunnelError(subdomain string, errorType string) {
 		subdomain = unknownLabel
 	}
 	TunnelErrors.WithLabelValues(subdomain, errorType).Inc()
+	if s := statsd.Load(); s != nil {
+		s.count("tunnel_errors", 1, s.subdomainTags(subdomain, s.tag("error_type", errorType)))
+	}
+}
+
+// RecordHedge records a hedged request and whether the hedge or the primary
+// attempt answered first.
+func RecordHedge(subdomain string, hedgeWon bool) {
+	if subdomain == "" {
+		subdomain = unknownLabel
+	}
+	winner := "primary"
+	if hedgeWon {
+		winner = "hedge"
+	}
+	HedgedRequests.WithLabelValues(subdomain, winner).Inc()
+	if s := statsd.Load(); s != nil {
+		s.count("hedged_requests", 1, s.subdomainTags(subdomain, s.tag("winner", winner)))
+	}
+}
+
+// SetTunnelState marks state as the current one of subdomain among states.
+func SetTunnelState(subdomain, state string, states []string) {
+	for _, s := range states {
+		value := 0.0
+		if s == state {
+			value = 1
+		}
+		TunnelState.WithLabelValues(subdomain, s).Set(value)
+	}
+}
+
+// RemoveTunnelState drops the state series of a forgotten tunnel.
+func RemoveTunnelState(subdomain string) {
+	TunnelState.DeletePartialMatch(prometheus.Labels{"subdomain": subdomain})
+}
+
+// RemoveSubdomain drops every series labeled with subdomain, e.g. when its
+// data is purged.
+func RemoveSubdomain(subdomain string) {
+	labels := prometheus.Labels{"subdomain": subdomain}
+	BytesReceivedTotal.DeletePartialMatch(labels)
+	BytesSentTotal.DeletePartialMatch(labels)
+	RequestsTotal.DeletePartialMatch(labels)
+	RequestDuration.DeletePartialMatch(labels)
+	ActiveStreams.DeletePartialMatch(labels)
+	StreamConnections.DeletePartialMatch(labels)
+	TunnelErrors.DeletePartialMatch(labels)
+	TunnelState.DeletePartialMatch(labels)
+	HedgedRequests.DeletePartialMatch(labels)
+	StreamAcquireDuration.DeletePartialMatch(labels)
+	ActiveSessions.DeletePartialMatch(labels)
+}
+
+// SetConnectionStreams records the open stream count and utilization of a connection.
+func SetConnectionStreams(connection string, open, limit int) {
+	ConnectionStreams.WithLabelValues(connection).Set(float64(open))
+	if limit > 0 {
+		ConnectionStreamUtilization.WithLabelValues(connection).Set(float64(open) / float64(limit))
+	}
+}
+
+// RemoveConnection drops the per-connection series once a connection is closed.
+func RemoveConnection(connection string) {
+	ConnectionStreams.DeleteLabelValues(connection)
+	ConnectionStreamUtilization.DeleteLabelValues(connection)
+}
+
+// SetMemoryUsage records the usage, peak and limit of a memory resource.
+func SetMemoryUsage(resource string, usage, peak, limit int64) {
+	MemoryUsage.WithLabelValues(resource).Set(float64(usage))
+	MemoryHighWatermark.WithLabelValues(resource).Set(float64(peak))
+	MemoryLimit.WithLabelValues(resource).Set(float64(limit))
+}
+
+// RecordLoadShed records a request or TCP connection refused because
+// resource is exhausted.
+func RecordLoadShed(resource string) {
+	LoadShed.WithLabelValues(resource).Inc()
+	if s := statsd.Load(); s != nil {
+		s.count("load_shed", 1, []string{s.tag("resource", resource)})
+	}
+}
+
+// RecordRegistration records a client registration with its result.
+func RecordRegistration(result string) {
+	Registrations.WithLabelValues(result).Inc()
+	if s := statsd.Load(); s != nil {
+		s.count("registrations", 1, []string{s.tag("result", result)})
+	}
+}
+
+// RecordStreamAcquire records the time taken to acquire a stream for
+// subdomain.
+func RecordStreamAcquire(subdomain string, d time.Duration) {
+	if subdomain == "" {
+		subdomain = unknownLabel
+	}
+	StreamAcquireDuration.WithLabelValues(subdomain).Observe(d.Seconds())
+	if s := statsd.Load(); s != nil {
+		s.timing("stream_acquire_duration", d, s.subdomainTags(subdomain))
+	}
+}
+
+// RecordTCPRefused records a TCP tunnel connection refused for reason.
+func RecordTCPRefused(reason string) {
+	TCPRefused.WithLabelValues(reason).Inc()
+	if s := statsd.Load(); s != nil {
+		s.count("tcp_refused", 1, []string{s.tag("reason", reason)})
+	}
+}
+
+// RecordTCPBan records an IP banned from TCP tunnel ports.
+func RecordTCPBan() {
+	TCPBans.Inc()
+	if s := statsd.Load(); s != nil {
+		s.count("tcp_bans", 1, nil)
+	}
+}
+
+// SetTCPBannedIPs sets how many IPs are banned from TCP tunnel ports.
+func SetTCPBannedIPs(n int) {
+	TCPBannedIPs.Set(float64(n))
+}
+
+// AddActiveSessions adds delta to the open sessions of kind of subdomain.
+func AddActiveSessions(subdomain, kind string, delta int) {
+	ActiveSessions.WithLabelValues(subdomain, kind).Add(float64(delta))
 }
 
 // statusCodeString converts an HTTP status code to a string label.
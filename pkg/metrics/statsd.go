@@ -0,0 +1,198 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Flavor selects how a StatsD emitter encodes tags.
+type Flavor string
+
+const (
+	// DogStatsD appends tags as "|#key:value,...".
+	DogStatsD Flavor = "dogstatsd"
+	// Telegraf appends tags to the metric name as ",key=value".
+	Telegraf Flavor = "telegraf"
+	// PlainStatsD drops tags.
+	PlainStatsD Flavor = "statsd"
+)
+
+// maxPacketSize keeps StatsD datagrams below common path MTUs.
+const maxPacketSize = 1432
+
+//nolint:gochecknoglobals // the emitter is shared by the package-level recorders
+var statsd atomic.Pointer[StatsD]
+
+//nolint:gochecknoglobals // stateless and safe for concurrent use
+var tagReplacer = strings.NewReplacer("|", "_", ",", "_", "#", "_", "=", "_", " ", "_", "\n", "_")
+
+// StatsD buffers metrics and sends them to a StatsD agent over UDP.
+type StatsD struct {
+	conn   net.Conn
+	prefix string
+	flavor Flavor
+	tags   []string
+	tenant atomic.Pointer[func(subdomain string) string]
+
+	mu     sync.Mutex
+	buf    bytes.Buffer
+	active map[string]int64
+}
+
+// NewStatsD creates an emitter sending to addr. Every metric name is
+// prefixed with prefix and carries tags in addition to its own.
+func NewStatsD(addr, prefix string, flavor Flavor, tags map[string]string) (*StatsD, error) {
+	switch flavor {
+	case "":
+		flavor = DogStatsD
+	case DogStatsD, Telegraf, PlainStatsD:
+	default:
+		return nil, fmt.Errorf("unknown statsd flavor %q", flavor)
+	}
+	if addr == "" {
+		return nil, errors.New("statsd address is required")
+	}
+
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial statsd: %w", err)
+	}
+
+	s := &StatsD{
+		conn:   conn,
+		prefix: prefix,
+		flavor: flavor,
+		active: map[string]int64{},
+	}
+	for k, v := range tags {
+		s.tags = append(s.tags, s.tag(k, v))
+	}
+	return s, nil
+}
+
+// EnableStatsD makes the package recorders also report to s.
+func EnableStatsD(s *StatsD) {
+	statsd.Store(s)
+}
+
+// SetTenantLookup tags subdomain metrics with the tenant returned by fn.
+func (s *StatsD) SetTenantLookup(fn func(subdomain string) string) {
+	s.tenant.Store(&fn)
+}
+
+// Run flushes the buffered metrics every interval until ctx is done. It then
+// stops the package recorders reporting to s, unless another emitter was
+// enabled since, and closes its connection.
+func (s *StatsD) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			statsd.CompareAndSwap(s, nil)
+			s.flush()
+			if err := s.conn.Close(); err != nil {
+				logrus.WithError(err).Debug("Failed to close statsd connection")
+			}
+			return
+		case <-ticker.C:
+			s.flush()
+		}
+	}
+}
+
+func (s *StatsD) flush() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.flushLocked()
+}
+
+func (s *StatsD) flushLocked() {
+	if s.buf.Len() == 0 {
+		return
+	}
+	if _, err := s.conn.Write(s.buf.Bytes()); err != nil {
+		logrus.WithError(err).Debug("Failed to send statsd metrics")
+	}
+	s.buf.Reset()
+}
+
+// tag renders one tag in the emitter's flavor with separators removed.
+func (s *StatsD) tag(key, value string) string {
+	if s.flavor == Telegraf {
+		return tagReplacer.Replace(key) + "=" + tagReplacer.Replace(value)
+	}
+	return tagReplacer.Replace(key) + ":" + tagReplacer.Replace(value)
+}
+
+// subdomainTags returns the subdomain and tenant tags of subdomain.
+func (s *StatsD) subdomainTags(subdomain string, extra ...string) []string {
+	tags := append([]string{s.tag("subdomain", subdomain)}, extra...)
+	if fn := s.tenant.Load(); fn != nil && subdomain != unknownLabel {
+		if tenant := (*fn)(subdomain); tenant != "" {
+			tags = append(tags, s.tag("token", tenant))
+		}
+	}
+	return tags
+}
+
+func (s *StatsD) send(name, value, kind string, tags []string) {
+	var line strings.Builder
+	line.WriteString(s.prefix)
+	line.WriteString(name)
+
+	all := slices.Concat(s.tags, tags)
+	if s.flavor == Telegraf {
+		for _, t := range all {
+			line.WriteString(",")
+			line.WriteString(t)
+		}
+	}
+	line.WriteString(":" + value + "|" + kind)
+	if s.flavor == DogStatsD && len(all) > 0 {
+		line.WriteString("|#" + strings.Join(all, ","))
+	}
+	line.WriteString("\n")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.buf.Len()+line.Len() > maxPacketSize {
+		s.flushLocked()
+	}
+	s.buf.WriteString(line.String())
+}
+
+func (s *StatsD) count(name string, value int64, tags []string) {
+	s.send(name, strconv.FormatInt(value, 10), "c", tags)
+}
+
+func (s *StatsD) timing(name string, d time.Duration, tags []string) {
+	s.send(name, strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', 3, 64), "ms", tags)
+}
+
+// addActive tracks active streams locally so the gauge is sent as an
+// absolute value, which every flavor supports.
+func (s *StatsD) addActive(subdomain string, delta int64) {
+	s.mu.Lock()
+	s.active[subdomain] += delta
+	value := s.active[subdomain]
+	if value <= 0 {
+		delete(s.active, subdomain)
+		value = 0
+	}
+	s.mu.Unlock()
+
+	s.send("active_streams", strconv.FormatInt(value, 10), "g", s.subdomainTags(subdomain))
+}
@@ -0,0 +1,151 @@
+package metrics_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/snakeice/gunnel/pkg/metrics"
+)
+
+// agent is a local StatsD agent collecting the packets sent to it.
+type agent struct {
+	conn *net.UDPConn
+}
+
+func newAgent(t *testing.T) *agent {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &agent{conn: conn}
+}
+
+// packets returns every packet received until none arrives for a while.
+func (a *agent) packets(t *testing.T) []string {
+	t.Helper()
+	var packets []string
+	buf := make([]byte, 64*1024)
+	for {
+		if err := a.conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond)); err != nil {
+			t.Fatal(err)
+		}
+		n, err := a.conn.Read(buf)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return packets
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		packets = append(packets, string(buf[:n]))
+	}
+}
+
+// enable starts an emitter sending to a and returns a function that stops it
+// and waits for Run to return.
+func (a *agent) enable(t *testing.T, flavor metrics.Flavor, tags map[string]string) func() {
+	t.Helper()
+	s, err := metrics.NewStatsD(a.conn.LocalAddr().String(), "gunnel.", flavor, tags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics.EnableStatsD(s)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.Run(ctx, time.Hour)
+	}()
+	stop := func() {
+		cancel()
+		<-done
+	}
+	t.Cleanup(stop)
+	return stop
+}
+
+func TestStatsDFlavors(t *testing.T) {
+	for _, tt := range []struct {
+		flavor metrics.Flavor
+		want   string
+	}{
+		{metrics.DogStatsD, "gunnel.tcp_refused:1|c|#env:prod,reason:limit\n"},
+		{metrics.Telegraf, "gunnel.tcp_refused,env=prod,reason=limit:1|c\n"},
+		{metrics.PlainStatsD, "gunnel.tcp_refused:1|c\n"},
+	} {
+		t.Run(string(tt.flavor), func(t *testing.T) {
+			a := newAgent(t)
+			stop := a.enable(t, tt.flavor, map[string]string{"env": "prod"})
+			metrics.RecordTCPRefused("limit")
+			stop()
+
+			if got := strings.Join(a.packets(t), ""); got != tt.want {
+				t.Errorf("sent %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStatsDSanitisesTags(t *testing.T) {
+	a := newAgent(t)
+	stop := a.enable(t, metrics.DogStatsD, map[string]string{"env|x": "prod,eu #1"})
+	metrics.RecordTCPRefused("a=b\nc")
+	stop()
+
+	want := "gunnel.tcp_refused:1|c|#env_x:prod_eu__1,reason:a_b_c\n"
+	if got := strings.Join(a.packets(t), ""); got != want {
+		t.Errorf("sent %q, want %q", got, want)
+	}
+}
+
+func TestStatsDSplitsPackets(t *testing.T) {
+	const lines = 200
+	a := newAgent(t)
+	stop := a.enable(t, metrics.DogStatsD, nil)
+	for range lines {
+		metrics.RecordTCPRefused("limit")
+	}
+	stop()
+
+	packets := a.packets(t)
+	if len(packets) < 2 {
+		t.Fatalf("sent %d packets, want the lines split over several", len(packets))
+	}
+	var sent int
+	for _, packet := range packets {
+		if len(packet) > metrics.MaxPacketSize {
+			t.Errorf("packet of %d bytes exceeds %d", len(packet), metrics.MaxPacketSize)
+		}
+		if !strings.HasSuffix(packet, "\n") {
+			t.Errorf("packet %q splits a line", packet)
+		}
+		sent += strings.Count(packet, "gunnel.tcp_refused:1|c|#reason:limit\n")
+	}
+	if sent != lines {
+		t.Errorf("sent %d lines, want %d", sent, lines)
+	}
+}
+
+func TestStatsDRunDisablesEmitter(t *testing.T) {
+	a := newAgent(t)
+	stop := a.enable(t, metrics.DogStatsD, nil)
+	if metrics.Enabled() == nil {
+		t.Fatal("emitter not enabled")
+	}
+	stop()
+	if metrics.Enabled() != nil {
+		t.Error("emitter still enabled after Run returned")
+	}
+
+	metrics.RecordTCPRefused("limit")
+	if packets := a.packets(t); len(packets) != 0 {
+		t.Errorf("sent %q after Run returned", packets)
+	}
+}
@@ -0,0 +1,8 @@
+// Package procport finds the TCP ports a local process listens on, so a
+// tunnel can follow a dev server that picks a new port on each restart.
+package procport
+
+import "errors"
+
+// ErrNotFound is returned when no matching process listens on a TCP port.
+var ErrNotFound = errors.New("no listening process found")
@@ -0,0 +1,131 @@
+package procport
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const tcpListen = "0A"
+
+// Find returns the TCP ports processes named name listen on, lowest first.
+// It reads /proc, so only processes of the current user are visible unless
+// running as root.
+func Find(name string) ([]int, error) {
+	inodes, err := socketInodes(name)
+	if err != nil {
+		return nil, err
+	}
+	if len(inodes) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, name)
+	}
+
+	var ports []int
+	for _, table := range []string{"/proc/net/tcp", "/proc/net/tcp6"} {
+		found, err := listeningPorts(table, inodes)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		ports = append(ports, found...)
+	}
+	if len(ports) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, name)
+	}
+
+	slices.Sort(ports)
+	return slices.Compact(ports), nil
+}
+
+// socketInodes returns the inodes of the sockets opened by processes named
+// name, other than this one.
+func socketInodes(name string) (map[string]bool, error) {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+
+	self := strconv.Itoa(os.Getpid())
+	inodes := make(map[string]bool)
+	for _, entry := range entries {
+		pid := entry.Name()
+		if _, err := strconv.Atoi(pid); err != nil || pid == self {
+			continue
+		}
+
+		dir := filepath.Join("/proc", pid)
+		comm, _ := os.ReadFile(filepath.Join(dir, "comm"))
+		cmdline, _ := os.ReadFile(filepath.Join(dir, "cmdline"))
+		if !matches(name, strings.TrimSpace(string(comm)), splitCmdline(cmdline)) {
+			continue
+		}
+
+		// Processes of other users cannot be inspected; skip them.
+		fds, err := os.ReadDir(filepath.Join(dir, "fd"))
+		if err != nil {
+			continue
+		}
+		for _, fd := range fds {
+			link, err := os.Readlink(filepath.Join(dir, "fd", fd.Name()))
+			if err != nil {
+				continue
+			}
+			if inode, ok := strings.CutPrefix(link, "socket:["); ok {
+				inodes[strings.TrimSuffix(inode, "]")] = true
+			}
+		}
+	}
+	return inodes, nil
+}
+
+// listeningPorts parses a /proc/net/tcp table for listening sockets whose
+// inode is in inodes.
+func listeningPorts(table string, inodes map[string]bool) ([]int, error) {
+	f, err := os.Open(table)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close() //nolint:errcheck // read-only
+
+	var ports []int
+	scanner := bufio.NewScanner(f)
+	scanner.Scan() // header
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 || fields[3] != tcpListen || !inodes[fields[9]] {
+			continue
+		}
+		_, hexPort, ok := strings.Cut(fields[1], ":")
+		if !ok {
+			continue
+		}
+		port, err := strconv.ParseUint(hexPort, 16, 16)
+		if err != nil {
+			continue
+		}
+		ports = append(ports, int(port))
+	}
+	return ports, scanner.Err()
+}
+
+// matches reports whether a process runs name: its command name is name, or
+// one of its arguments is a path to it, e.g. node .../.bin/vite for "vite".
+func matches(name, comm string, args []string) bool {
+	if comm == name {
+		return true
+	}
+	for _, arg := range args {
+		if filepath.Base(arg) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// splitCmdline splits a NUL separated command line.
+func splitCmdline(raw []byte) []string {
+	return strings.FieldsFunc(string(raw), func(r rune) bool { return r == 0 })
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package procport
+
+import (
+	"errors"
+	"runtime"
+)
+
+// Find is only implemented on Linux, where /proc exposes the sockets of each
+// process.
+func Find(string) ([]int, error) {
+	return nil, errors.New("process port detection is not supported on " + runtime.GOOS)
+}
@@ -0,0 +1,73 @@
+package procport_test
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"testing"
+
+	"github.com/snakeice/gunnel/pkg/procport"
+)
+
+// TestMain turns the test binary into a process listening on a random port
+// when GUNNEL_PROCPORT_HELPER is set.
+func TestMain(m *testing.M) {
+	if os.Getenv("GUNNEL_PROCPORT_HELPER") == "" {
+		os.Exit(m.Run())
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		os.Exit(1)
+	}
+	_, _ = os.Stdout.WriteString(strconv.Itoa(ln.Addr().(*net.TCPAddr).Port) + "\n")
+	_, _ = os.Stdin.Read(make([]byte, 1))
+	os.Exit(0)
+}
+
+func TestFindListeningPort(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("process port detection needs /proc")
+	}
+
+	cmd := exec.Command(os.Args[0]) //nolint:gosec // re-runs this test binary
+	cmd.Env = append(os.Environ(), "GUNNEL_PROCPORT_HELPER=1")
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = stdin.Close()
+		_ = cmd.Wait()
+	})
+
+	line, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil {
+		t.Fatalf("helper did not report its port: %v", err)
+	}
+	want, _ := strconv.Atoi(line[:len(line)-1])
+
+	ports, err := procport.Find(filepath.Base(os.Args[0]))
+	if err != nil {
+		t.Fatalf("Find() error = %v", err)
+	}
+	if !slices.Contains(ports, want) {
+		t.Errorf("Find() = %v, want it to contain %d", ports, want)
+	}
+
+	if _, err := procport.Find("no-such-gunnel-process"); !errors.Is(err, procport.ErrNotFound) {
+		t.Errorf("Find() for a missing process error = %v, want ErrNotFound", err)
+	}
+}
@@ -0,0 +1,35 @@
+package protocol
+
+// authContext prefixes every signed nonce so a signature made for gunnel
+// cannot be replayed in another protocol.
+const authContext = "gunnel-auth-v1\x00"
+
+// AuthChallenge carries the nonce a client signs to authenticate with a
+// public key. The client sends it with an empty Nonce to request one; the
+// server answers with a fresh nonce bound to the connection.
+type AuthChallenge struct {
+	Nonce []byte
+}
+
+// SignedMessage returns the bytes the client signs for this challenge.
+func (a *AuthChallenge) SignedMessage() []byte {
+	return append([]byte(authContext), a.Nonce...)
+}
+
+func (a *AuthChallenge) Marshal() *Message {
+	payload := make([]byte, 0, 1+len(a.Nonce))
+	payload = append(payload, byte(len(a.Nonce)))
+	payload = append(payload, a.Nonce...)
+
+	return &Message{
+		Type:    MessageAuthChallenge,
+		Length:  lenUint32(payload),
+		Payload: payload,
+	}
+}
+
+func (a *AuthChallenge) Unmarshal(payload []byte) error {
+	d := newDecoder(payload)
+	a.Nonce = d.bytes8()
+	return d.err
+}
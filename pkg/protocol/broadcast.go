@@ -0,0 +1,43 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// Broadcast is an operator notice the server sends to every connected client.
+type Broadcast struct {
+	// Level is a logrus level name such as "info" or "warning".
+	Level   string
+	Message string
+	SentAt  time.Time
+}
+
+func (b *Broadcast) Marshal() *Message {
+	payload := make([]byte, 0)
+
+	payload = append(payload, byte(len(b.Level)))
+	payload = append(payload, []byte(b.Level)...)
+
+	// Message (4 byte length + bytes)
+	payload = binary.BigEndian.AppendUint32(payload, lenUint32(b.Message))
+	payload = append(payload, []byte(b.Message)...)
+
+	//nolint:gosec // G115: unix seconds are positive for any realistic timestamp
+	payload = binary.BigEndian.AppendUint64(payload, uint64(b.SentAt.Unix()))
+
+	return &Message{
+		Type:    MessageBroadcast,
+		Length:  lenUint32(payload),
+		Payload: payload,
+	}
+}
+
+func (b *Broadcast) Unmarshal(payload []byte) error {
+	d := newDecoder(payload)
+	b.Level = d.string8()
+	b.Message = d.string32()
+	//nolint:gosec // G115: written from a unix timestamp
+	b.SentAt = time.Unix(int64(d.uint64()), 0)
+	return d.err
+}
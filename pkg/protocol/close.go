@@ -0,0 +1,61 @@
+package protocol
+
+// CloseCode tells the peer why a connection was closed. It is the QUIC
+// application error code of the close and the code of CloseConnection.
+type CloseCode uint64
+
+// Close codes start above the small codes used for plain and failed closes,
+// so peers that predate them still treat them as errors.
+const (
+	// CloseNone is a close without a specific reason.
+	CloseNone CloseCode = 0
+	// CloseServerShutdown: the server is stopping or restarting.
+	CloseServerShutdown CloseCode = 0x100 + iota
+	// CloseClientShutdown: the client is stopping.
+	CloseClientShutdown
+	// CloseHeartbeatTimeout: the peer stopped answering heartbeats.
+	CloseHeartbeatTimeout
+	// CloseAuthRevoked: the credentials the client registered with were
+	// revoked.
+	CloseAuthRevoked
+	// CloseConnectionLimit: the server refused a connection over its limits.
+	CloseConnectionLimit
+	// CloseRotated: the connection reached its maximum lifetime and was
+	// replaced.
+	CloseRotated
+)
+
+// Known reports whether c is a close code of this version.
+func (c CloseCode) Known() bool {
+	return c >= CloseServerShutdown && c <= CloseRotated
+}
+
+func (c CloseCode) String() string {
+	switch c {
+	case CloseNone:
+		return "closed"
+	case CloseServerShutdown:
+		return "server shutdown"
+	case CloseClientShutdown:
+		return "client shutdown"
+	case CloseHeartbeatTimeout:
+		return "heartbeat timeout"
+	case CloseAuthRevoked:
+		return "auth revoked"
+	case CloseConnectionLimit:
+		return "connection limit"
+	case CloseRotated:
+		return "connection rotated"
+	default:
+		return "unknown"
+	}
+}
+
+// Describe joins the code and the reason a connection was closed with, e.g.
+// "heartbeat timeout: no heartbeat for 1m30s".
+func (c CloseCode) Describe(reason string) string {
+	if reason == "" {
+		return c.String()
+	}
+	return c.String() + ": " + reason
+}
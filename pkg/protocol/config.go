@@ -0,0 +1,112 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"slices"
+	"time"
+)
+
+type (
+	// ConfigUpdate carries settings the server pushes to a connected client.
+	// Zero values mean "leave unchanged".
+	ConfigUpdate struct {
+		Version           uint32
+		HeartbeatInterval time.Duration
+		// RateLimit is the maximum number of requests per second per tunnel.
+		RateLimit uint32
+		Features  map[string]bool
+		Notice    string
+	}
+
+	// ConfigUpdateAck is the client's answer to a ConfigUpdate.
+	ConfigUpdateAck struct {
+		Version uint32
+		Applied bool
+		// Message lists settings the client kept because of local overrides.
+		Message string
+	}
+)
+
+func (c *ConfigUpdate) Marshal() *Message {
+	payload := make([]byte, 0)
+
+	payload = binary.BigEndian.AppendUint32(payload, c.Version)
+	payload = binary.BigEndian.AppendUint32(payload, durationSeconds(c.HeartbeatInterval))
+	payload = binary.BigEndian.AppendUint32(payload, c.RateLimit)
+
+	// Features (1 byte count, then 1 byte name length + name + 1 byte flag)
+	names := make([]string, 0, len(c.Features))
+	for name := range c.Features {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	payload = append(payload, byte(len(names)))
+	for _, name := range names {
+		payload = append(payload, byte(len(name)))
+		payload = append(payload, []byte(name)...)
+		payload = append(payload, boolToByte(c.Features[name]))
+	}
+
+	// Notice (4 byte length + bytes)
+	payload = binary.BigEndian.AppendUint32(payload, lenUint32(c.Notice))
+	payload = append(payload, []byte(c.Notice)...)
+
+	return &Message{
+		Type:    MessageConfigUpdate,
+		Length:  lenUint32(payload),
+		Payload: payload,
+	}
+}
+
+func (c *ConfigUpdate) Unmarshal(payload []byte) error {
+	d := newDecoder(payload)
+	c.Version = d.uint32()
+	c.HeartbeatInterval = time.Duration(d.uint32()) * time.Second
+	c.RateLimit = d.uint32()
+
+	featureCount := int(d.uint8())
+	c.Features = make(map[string]bool, featureCount)
+	for range featureCount {
+		name := d.string8()
+		c.Features[name] = d.bool()
+	}
+
+	c.Notice = d.string32()
+	return d.err
+}
+
+func (c *ConfigUpdateAck) Marshal() *Message {
+	payload := make([]byte, 0)
+
+	payload = binary.BigEndian.AppendUint32(payload, c.Version)
+	payload = append(payload, boolToByte(c.Applied))
+	payload = binary.BigEndian.AppendUint32(payload, lenUint32(c.Message))
+	payload = append(payload, []byte(c.Message)...)
+
+	return &Message{
+		Type:    MessageConfigUpdateAck,
+		Length:  lenUint32(payload),
+		Payload: payload,
+	}
+}
+
+func (c *ConfigUpdateAck) Unmarshal(payload []byte) error {
+	d := newDecoder(payload)
+	c.Version = d.uint32()
+	c.Applied = d.bool()
+	c.Message = d.string32()
+	return d.err
+}
+
+// durationSeconds converts d to whole seconds, clamped to the uint32 range.
+func durationSeconds(d time.Duration) uint32 {
+	secs := int64(d / time.Second)
+	if secs <= 0 {
+		return 0
+	}
+	if secs > int64(^uint32(0)) {
+		return ^uint32(0)
+	}
+	return uint32(secs)
+}
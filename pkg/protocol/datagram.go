@@ -0,0 +1,47 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// ErrInvalidDatagram is returned when a datagram is too short for its header.
+var ErrInvalidDatagram = errors.New("invalid datagram")
+
+// Datagram is a UDP packet of a tunnel, carried in a QUIC datagram rather
+// than a stream so loss and reordering pass through as they would on UDP.
+// Session tells the public peers of the tunnel apart: the server picks it for
+// each peer address and the client answers with the same one.
+type Datagram struct {
+	Subdomain string
+	Session   uint32
+	Payload   []byte
+}
+
+// MarshalBinary encodes the datagram as subLen(1) + subdomain + session(4)
+// + payload.
+func (d *Datagram) MarshalBinary() ([]byte, error) {
+	if len(d.Subdomain) > 255 {
+		return nil, errors.New("subdomain too long")
+	}
+	data := make([]byte, 0, 1+len(d.Subdomain)+4+len(d.Payload))
+	data = append(data, byte(len(d.Subdomain)))
+	data = append(data, d.Subdomain...)
+	data = binary.BigEndian.AppendUint32(data, d.Session)
+	return append(data, d.Payload...), nil
+}
+
+// UnmarshalBinary decodes a datagram; Payload aliases data.
+func (d *Datagram) UnmarshalBinary(data []byte) error {
+	if len(data) < 1 {
+		return ErrInvalidDatagram
+	}
+	subdomainLen := int(data[0])
+	if len(data) < 1+subdomainLen+4 {
+		return ErrInvalidDatagram
+	}
+	d.Subdomain = string(data[1 : 1+subdomainLen])
+	d.Session = binary.BigEndian.Uint32(data[1+subdomainLen:])
+	d.Payload = data[1+subdomainLen+4:]
+	return nil
+}
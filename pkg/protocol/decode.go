@@ -0,0 +1,102 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// ErrTruncated is returned when a payload ends inside a field.
+var ErrTruncated = fmt.Errorf("%w: truncated payload", ErrInvalidMessage)
+
+// decoder reads the fields of a payload in order. Reading past the end of
+// the payload records ErrTruncated and yields zero values from then on, so
+// Unmarshal methods read their fields and check err once.
+type decoder struct {
+	payload []byte
+	offset  int
+	err     error
+}
+
+func newDecoder(payload []byte) *decoder {
+	return &decoder{payload: payload}
+}
+
+// remaining is the number of unread bytes.
+func (d *decoder) remaining() int {
+	if d.err != nil {
+		return 0
+	}
+	return len(d.payload) - d.offset
+}
+
+// has reports whether n more bytes can be read. Optional fields, which older
+// peers leave out, are read once has(1) holds, so one cut short fails
+// instead of being dropped.
+func (d *decoder) has(n int) bool {
+	return d.remaining() >= n
+}
+
+// next returns the next n bytes, which alias the payload.
+func (d *decoder) next(n int) []byte {
+	if n < 0 || !d.has(n) {
+		if d.err == nil {
+			d.err = fmt.Errorf("%w: need %d bytes at offset %d of %d", ErrTruncated, n, d.offset, len(d.payload))
+		}
+		return nil
+	}
+	b := d.payload[d.offset : d.offset+n]
+	d.offset += n
+	return b
+}
+
+func (d *decoder) uint8() byte {
+	if b := d.next(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (d *decoder) bool() bool {
+	return byteToBool(d.uint8())
+}
+
+func (d *decoder) uint16() uint16 {
+	if b := d.next(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (d *decoder) uint32() uint32 {
+	if b := d.next(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (d *decoder) uint64() uint64 {
+	if b := d.next(8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
+
+// bytes8 reads bytes preceded by their length as 1 byte.
+func (d *decoder) bytes8() []byte {
+	return d.next(int(d.uint8()))
+}
+
+// string8 reads a string preceded by its length as 1 byte.
+func (d *decoder) string8() string {
+	return string(d.bytes8())
+}
+
+// string16 reads a string preceded by its length as 2 bytes.
+func (d *decoder) string16() string {
+	return string(d.next(int(d.uint16())))
+}
+
+// string32 reads a string preceded by its length as 4 bytes.
+func (d *decoder) string32() string {
+	return string(d.next(int(d.uint32())))
+}
@@ -8,6 +8,7 @@ type (
 const (
 	HTTP Protocol = "http"
 	TCP  Protocol = "tcp"
+	UDP  Protocol = "udp"
 )
 
 const (
@@ -16,6 +17,8 @@ const (
 	// These messages are used to register a connection with the server.
 	MessageConnectionRegister     MessageType = 1
 	MessageConnectionRegisterResp MessageType = 2
+	// MessageAuthChallenge carries the nonce used for public key authentication.
+	MessageAuthChallenge MessageType = 14
 
 	// Maintenance messages
 	// These messages are used to maintain the connection with the server.
@@ -28,6 +31,24 @@ const (
 	MessageBeginStream     MessageType = 6
 	MessageEndStream       MessageType = 7
 	MessageConnectionReady MessageType = 8
+	// MessageStreamError reports a stream the client could not serve.
+	MessageStreamError MessageType = 16
+
+	// Configuration messages
+	// These messages let the server change client settings at runtime.
+	MessageConfigUpdate    MessageType = 9
+	MessageConfigUpdateAck MessageType = 10
+
+	// Operator messages
+	// These messages carry notices from the server operator to clients.
+	MessageBroadcast MessageType = 11
+
+	// Lifetime messages
+	// These messages carry expiry warnings and pause/resume requests for tunnels.
+	MessageTunnelExpiry MessageType = 12
+	MessageTunnelState  MessageType = 13
+	// MessageReconnect asks the client to move to a new connection.
+	MessageReconnect MessageType = 15
 )
 
 func (t MessageType) String() string {
@@ -36,6 +57,8 @@ func (t MessageType) String() string {
 		return "ConnectionRegister"
 	case MessageConnectionRegisterResp:
 		return "ConnectionRegisterResp"
+	case MessageAuthChallenge:
+		return "AuthChallenge"
 	case MessageDisconnect:
 		return "Disconnect"
 	case MessageHeartbeat:
@@ -48,6 +71,20 @@ func (t MessageType) String() string {
 		return "EndStream"
 	case MessageConnectionReady:
 		return "ConnectionReady"
+	case MessageStreamError:
+		return "StreamError"
+	case MessageConfigUpdate:
+		return "ConfigUpdate"
+	case MessageConfigUpdateAck:
+		return "ConfigUpdateAck"
+	case MessageBroadcast:
+		return "Broadcast"
+	case MessageTunnelExpiry:
+		return "TunnelExpiry"
+	case MessageTunnelState:
+		return "TunnelState"
+	case MessageReconnect:
+		return "Reconnect"
 	default:
 		return "Unknown"
 	}
@@ -55,7 +92,7 @@ func (t MessageType) String() string {
 
 func (p Protocol) Valid() bool {
 	switch p {
-	case HTTP, TCP:
+	case HTTP, TCP, UDP:
 		return true
 	default:
 		return false
@@ -68,6 +105,8 @@ func (p Protocol) Byte() byte {
 		return 0
 	case TCP:
 		return 1
+	case UDP:
+		return 2
 	default:
 		return 255
 	}
@@ -79,6 +118,8 @@ func ProtocolFromByte(b byte) Protocol {
 		return HTTP
 	case 1:
 		return TCP
+	case 2:
+		return UDP
 	default:
 		return ""
 	}
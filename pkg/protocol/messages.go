@@ -3,17 +3,25 @@ package protocol
 import (
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
 	"math"
+	"time"
 )
 
 var (
 	ErrInvalidMessage = errors.New("invalid message")
+	// ErrMessageTooLarge is returned by ReadMessage for a header announcing
+	// a payload above its limit, before anything is allocated for it.
+	ErrMessageTooLarge = fmt.Errorf("%w: payload too large", ErrInvalidMessage)
 )
 
 const (
 	// Header size in bytes (1 byte type + 4 bytes length).
 	HeaderSize = 5
+	// DefaultMaxPayloadSize bounds the payload of a message read without a
+	// limit of its own. Control messages are far smaller.
+	DefaultMaxPayloadSize = 1 << 20
 )
 
 // Message represents a protocol message.
@@ -25,7 +33,9 @@ type Message struct {
 
 type Parsable interface {
 	Marshal() *Message
-	Unmarshal([]byte)
+	// Unmarshal decodes payload, failing on payloads that end inside a
+	// field instead of reading past them.
+	Unmarshal(payload []byte) error
 }
 
 // Write writes the message to the given writer.
@@ -42,8 +52,13 @@ func (m *Message) Write(w io.Writer) (int, error) {
 	return w.Write(data)
 }
 
-// ReadMessage reads a message from the given reader.
-func ReadMessage(r io.Reader) (int, *Message, error) {
+// ReadMessage reads a message from the given reader, failing on payloads
+// above limit bytes; 0 means DefaultMaxPayloadSize.
+func ReadMessage(r io.Reader, limit uint32) (int, *Message, error) {
+	if limit == 0 {
+		limit = DefaultMaxPayloadSize
+	}
+
 	header := make([]byte, HeaderSize)
 	read, err := io.ReadFull(r, header)
 	if err != nil {
@@ -52,6 +67,10 @@ func ReadMessage(r io.Reader) (int, *Message, error) {
 
 	msgType := header[0]
 	length := binary.BigEndian.Uint32(header[1:])
+	if length > limit {
+		return read, nil, fmt.Errorf("%w: %s message of %d bytes, at most %d",
+			ErrMessageTooLarge, MessageType(msgType), length, limit)
+	}
 
 	// Read payload if any
 	var payload []byte
@@ -72,8 +91,11 @@ func ReadMessage(r io.Reader) (int, *Message, error) {
 	}, nil
 }
 
+// CloseConnection announces that its sender closes the connection. Code is
+// the QUIC error code the connection is then closed with.
 type CloseConnection struct {
 	Reason string
+	Code   CloseCode
 }
 
 type Heartbeat struct {
@@ -84,8 +106,33 @@ type ErrorMessage struct {
 	Message string
 }
 
+// BeginConnection asks the client to open a connection to the backend of
+// Subdomain. The other fields describe the user the stream serves, for the
+// client's policies and forwarded headers; older servers leave them empty.
 type BeginConnection struct {
 	Subdomain string
+	// RemoteAddr is the address of the user, as host:port. Behind trusted
+	// proxies the host is the one they forwarded and the port is 0.
+	RemoteAddr string
+	// LocalAddr is the server address the user connected to, as host:port.
+	LocalAddr string
+	// Host is the host the user asked for, from the Host header of HTTP
+	// requests; empty for TCP tunnels.
+	Host string
+	// TLS is set when the user reached the server over TLS.
+	TLS *TLSInfo
+	// KeepAliveInterval, when set, offers to ping the peer of a raw stream
+	// this often and to reset it after KeepAliveTimeout without traffic; the
+	// client accepts in ConnectionReady.
+	KeepAliveInterval time.Duration
+	KeepAliveTimeout  time.Duration
+}
+
+// TLSInfo describes the TLS connection of a user to the server.
+type TLSInfo struct {
+	Version     uint16
+	CipherSuite uint16
+	ServerName  string
 }
 
 type EndConnection struct {
@@ -94,12 +141,20 @@ type EndConnection struct {
 
 type ConnectionReady struct {
 	Subdomain string
+	// KeepAlive accepts the keepalive offered in BeginConnection; older
+	// clients leave it false.
+	KeepAlive bool
+	// Persistent tells the server the client keeps its backend connection
+	// open for the next request on the stream, which the server may then
+	// write right after its BeginConnection. Older clients leave it false.
+	Persistent bool
 }
 
 func (c *CloseConnection) Marshal() *Message {
 	payload := make([]byte, 0)
 	payload = append(payload, byte(len(c.Reason)))
 	payload = append(payload, []byte(c.Reason)...)
+	payload = binary.BigEndian.AppendUint64(payload, uint64(c.Code))
 
 	return &Message{
 		Type:    MessageDisconnect,
@@ -146,35 +201,36 @@ func byteToBool(b byte) bool {
 }
 
 // Unmarshal converts a byte slice to the appropriate message type.
-func Unmarshal[T Parsable](msg T, data *Message) {
-	msg.Unmarshal(data.Payload)
+func Unmarshal[T Parsable](msg T, data *Message) error {
+	if err := msg.Unmarshal(data.Payload); err != nil {
+		return fmt.Errorf("failed to decode %s message: %w", data.Type, err)
+	}
+	return nil
 }
 
-func (c *CloseConnection) Unmarshal(payload []byte) {
-	offset := 0
-
-	// Read reason
-	reasonLen := int(payload[offset])
-	offset++
-	c.Reason = string(payload[offset : offset+reasonLen])
+func (c *CloseConnection) Unmarshal(payload []byte) error {
+	if len(payload) == 0 {
+		return nil
+	}
+	d := newDecoder(payload)
+	c.Reason = d.string8()
+	// Older peers send no code.
+	if d.has(1) {
+		c.Code = CloseCode(d.uint64())
+	}
+	return d.err
 }
 
-func (h *Heartbeat) Unmarshal(payload []byte) {
-	offset := 0
-
-	// Read message
-	messageLen := int(payload[offset])
-	offset++
-	h.Message = string(payload[offset : offset+messageLen])
+func (h *Heartbeat) Unmarshal(payload []byte) error {
+	d := newDecoder(payload)
+	h.Message = d.string8()
+	return d.err
 }
 
-func (e *ErrorMessage) Unmarshal(payload []byte) {
-	offset := 0
-
-	// Read message
-	messageLen := int(payload[offset])
-	offset++
-	e.Message = string(payload[offset : offset+messageLen])
+func (e *ErrorMessage) Unmarshal(payload []byte) error {
+	d := newDecoder(payload)
+	e.Message = d.string8()
+	return d.err
 }
 
 func NewErrorMessage(message string) *ErrorMessage {
@@ -189,6 +245,20 @@ func (b *BeginConnection) Marshal() *Message {
 	payload = binary.BigEndian.AppendUint32(payload, lenUint32(b.Subdomain))
 	payload = append(payload, []byte(b.Subdomain)...)
 
+	for _, field := range []string{b.RemoteAddr, b.LocalAddr, b.Host} {
+		payload = appendString16(payload, field)
+	}
+	payload = append(payload, boolToByte(b.TLS != nil))
+	if b.TLS != nil {
+		payload = binary.BigEndian.AppendUint16(payload, b.TLS.Version)
+		payload = binary.BigEndian.AppendUint16(payload, b.TLS.CipherSuite)
+		payload = appendString16(payload, b.TLS.ServerName)
+	}
+	if b.KeepAliveInterval > 0 {
+		payload = binary.BigEndian.AppendUint32(payload, millis32(b.KeepAliveInterval))
+		payload = binary.BigEndian.AppendUint32(payload, millis32(b.KeepAliveTimeout))
+	}
+
 	return &Message{
 		Type:    MessageBeginStream,
 		Length:  lenUint32(payload),
@@ -210,23 +280,50 @@ func (e *EndConnection) Marshal() *Message {
 }
 
 // Unmarshal converts a byte slice to a BeginConnection.
-func (b *BeginConnection) Unmarshal(payload []byte) {
-	offset := 0
+func (b *BeginConnection) Unmarshal(payload []byte) error {
+	d := newDecoder(payload)
+	b.Subdomain = d.string32()
 
-	subdomainLen := binary.BigEndian.Uint32(payload[offset:])
-	offset += 4
+	// Optional user details, sent by newer servers.
+	if !d.has(1) {
+		return d.err
+	}
+	b.RemoteAddr = d.string16()
+	b.LocalAddr = d.string16()
+	b.Host = d.string16()
+	if d.has(1) && d.bool() {
+		b.TLS = &TLSInfo{
+			Version:     d.uint16(),
+			CipherSuite: d.uint16(),
+			ServerName:  d.string16(),
+		}
+	}
 
-	b.Subdomain = string(payload[offset : offset+int(subdomainLen)])
+	// Optional stream keepalive, sent by servers configured for it.
+	if d.has(1) {
+		b.KeepAliveInterval = time.Duration(d.uint32()) * time.Millisecond
+		b.KeepAliveTimeout = time.Duration(d.uint32()) * time.Millisecond
+	}
+	return d.err
 }
 
-// Unmarshal converts a byte slice to an EndConnection.
-func (e *EndConnection) Unmarshal(payload []byte) {
-	offset := 0
+// millis32 returns d in milliseconds, capped to fit 4 bytes.
+func millis32(d time.Duration) uint32 {
+	return uint32(min(d.Milliseconds(), math.MaxUint32)) //nolint:gosec // G115: capped above
+}
 
-	subdomainLen := binary.BigEndian.Uint32(payload[offset:])
-	offset += 4
+// appendString16 appends s to payload after its length as 2 bytes.
+func appendString16(payload []byte, s string) []byte {
+	//nolint:gosec // G115: addresses and host names are short
+	payload = binary.BigEndian.AppendUint16(payload, uint16(len(s)))
+	return append(payload, s...)
+}
 
-	e.Subdomain = string(payload[offset : offset+int(subdomainLen)])
+// Unmarshal converts a byte slice to an EndConnection.
+func (e *EndConnection) Unmarshal(payload []byte) error {
+	d := newDecoder(payload)
+	e.Subdomain = d.string32()
+	return d.err
 }
 
 // Marshal converts a ConnectionReady to a byte slice.
@@ -234,6 +331,9 @@ func (c *ConnectionReady) Marshal() *Message {
 	payload := []byte{}
 	payload = binary.BigEndian.AppendUint32(payload, lenUint32(c.Subdomain))
 	payload = append(payload, []byte(c.Subdomain)...)
+	if c.KeepAlive || c.Persistent {
+		payload = append(payload, boolToByte(c.KeepAlive), boolToByte(c.Persistent))
+	}
 
 	return &Message{
 		Type:    MessageConnectionReady,
@@ -243,13 +343,13 @@ func (c *ConnectionReady) Marshal() *Message {
 }
 
 // Unmarshal converts a byte slice to a ConnectionReady.
-func (c *ConnectionReady) Unmarshal(payload []byte) {
-	offset := 0
-
-	subdomainLen := binary.BigEndian.Uint32(payload[offset:])
-	offset += 4
-
-	c.Subdomain = string(payload[offset : offset+int(subdomainLen)])
+func (c *ConnectionReady) Unmarshal(payload []byte) error {
+	d := newDecoder(payload)
+	c.Subdomain = d.string32()
+	// Optional flags, sent by newer clients.
+	c.KeepAlive = d.has(1) && d.bool()
+	c.Persistent = d.has(1) && d.bool()
+	return d.err
 }
 
 type lenSupported interface {
@@ -2,7 +2,10 @@ package protocol_test
 
 import (
 	"bytes"
+	"errors"
+	"slices"
 	"testing"
+	"time"
 
 	"github.com/magiconair/properties/assert"
 	"github.com/snakeice/gunnel/pkg/protocol"
@@ -21,15 +24,38 @@ func TestMessageTypes(t *testing.T) {
 				Host:      "localhost",
 				Port:      8080,
 				Protocol:  protocol.TCP,
+				Token:     "secret",
+				ClientID:  "client-1",
+				TTL:       2 * time.Hour,
+				Schedule:  "mon-fri 09:00-18:00",
+				JWT: &protocol.JWTPolicy{
+					Issuer:       "https://issuer.example.com/",
+					Audience:     "api",
+					JWKSURL:      "https://issuer.example.com/.well-known/jwks.json",
+					ClaimHeaders: map[string]string{"sub": "X-User"},
+				},
+				PublicKey:    bytes.Repeat([]byte{1}, 32),
+				Signature:    bytes.Repeat([]byte{2}, 64),
+				Version:      "v1.2.3",
+				PublicStatus: true,
 			},
 			newFunc: func() protocol.Parsable { return &protocol.ConnectionRegister{} },
 		},
+		{
+			name:    "AuthChallenge",
+			message: &protocol.AuthChallenge{Nonce: bytes.Repeat([]byte{7}, 32)},
+			newFunc: func() protocol.Parsable { return &protocol.AuthChallenge{} },
+		},
 		{
 			name: "ConnectionRegisterResp",
 			message: &protocol.ConnectionRegisterResp{
 				Success:   true,
 				Subdomain: "test",
 				Message:   "Success",
+				Version:   "v1.2.3",
+				URL:       "https://test.example.com",
+				Reject:    protocol.RejectReservedSubdomain,
+				Port:      20001,
 			},
 			newFunc: func() protocol.Parsable { return &protocol.ConnectionRegisterResp{} },
 		},
@@ -40,6 +66,14 @@ func TestMessageTypes(t *testing.T) {
 			},
 			newFunc: func() protocol.Parsable { return &protocol.CloseConnection{} },
 		},
+		{
+			name: "CloseConnectionWithCode",
+			message: &protocol.CloseConnection{
+				Reason: "token deleted",
+				Code:   protocol.CloseAuthRevoked,
+			},
+			newFunc: func() protocol.Parsable { return &protocol.CloseConnection{} },
+		},
 		{
 			name: "Heartbeat",
 			message: &protocol.Heartbeat{
@@ -47,6 +81,48 @@ func TestMessageTypes(t *testing.T) {
 			},
 			newFunc: func() protocol.Parsable { return &protocol.Heartbeat{} },
 		},
+		{
+			name: "Broadcast",
+			message: &protocol.Broadcast{
+				Level:   "warning",
+				Message: "server restarting at 18:00",
+				SentAt:  time.Unix(1700000000, 0),
+			},
+			newFunc: func() protocol.Parsable { return &protocol.Broadcast{} },
+		},
+		{
+			name: "TunnelExpiry",
+			message: &protocol.TunnelExpiry{
+				Subdomain: "demo",
+				ExpiresAt: time.Unix(1700000000, 0),
+				Expired:   true,
+			},
+			newFunc: func() protocol.Parsable { return &protocol.TunnelExpiry{} },
+		},
+		{
+			name: "TunnelState",
+			message: &protocol.TunnelState{
+				Subdomain: "demo",
+				Paused:    true,
+			},
+			newFunc: func() protocol.Parsable { return &protocol.TunnelState{} },
+		},
+		{
+			name: "TunnelStateClosed",
+			message: &protocol.TunnelState{
+				Subdomain: "demo",
+				Closed:    true,
+			},
+			newFunc: func() protocol.Parsable { return &protocol.TunnelState{} },
+		},
+		{
+			name: "Reconnect",
+			message: &protocol.Reconnect{
+				Reason: "connection lifetime reached",
+				Grace:  time.Minute,
+			},
+			newFunc: func() protocol.Parsable { return &protocol.Reconnect{} },
+		},
 		{
 			name: "ErrorMessage",
 			message: &protocol.ErrorMessage{
@@ -61,6 +137,31 @@ func TestMessageTypes(t *testing.T) {
 			},
 			newFunc: func() protocol.Parsable { return &protocol.BeginConnection{} },
 		},
+		{
+			name: "BeginConnectionWithMetadata",
+			message: &protocol.BeginConnection{
+				Subdomain:  "test",
+				RemoteAddr: "203.0.113.7:51234",
+				LocalAddr:  "198.51.100.1:443",
+				Host:       "test.example.com",
+				TLS: &protocol.TLSInfo{
+					Version:     0x0304,
+					CipherSuite: 0x1301,
+					ServerName:  "test.example.com",
+				},
+			},
+			newFunc: func() protocol.Parsable { return &protocol.BeginConnection{} },
+		},
+		{
+			name: "BeginConnectionWithKeepAlive",
+			message: &protocol.BeginConnection{
+				Subdomain:         "test",
+				RemoteAddr:        "203.0.113.7:51234",
+				KeepAliveInterval: 15 * time.Second,
+				KeepAliveTimeout:  45 * time.Second,
+			},
+			newFunc: func() protocol.Parsable { return &protocol.BeginConnection{} },
+		},
 		{
 			name: "EndConnection",
 			message: &protocol.EndConnection{
@@ -75,6 +176,50 @@ func TestMessageTypes(t *testing.T) {
 			},
 			newFunc: func() protocol.Parsable { return &protocol.ConnectionReady{} },
 		},
+		{
+			name: "ConnectionReadyWithKeepAlive",
+			message: &protocol.ConnectionReady{
+				Subdomain: "test",
+				KeepAlive: true,
+			},
+			newFunc: func() protocol.Parsable { return &protocol.ConnectionReady{} },
+		},
+		{
+			name: "ConnectionReadyPersistent",
+			message: &protocol.ConnectionReady{
+				Subdomain:  "test",
+				Persistent: true,
+			},
+			newFunc: func() protocol.Parsable { return &protocol.ConnectionReady{} },
+		},
+		{
+			name: "StreamError",
+			message: &protocol.StreamError{
+				Code:    protocol.StreamErrorBackendUnreachable,
+				Message: "dial tcp 127.0.0.1:3000: connect: connection refused",
+			},
+			newFunc: func() protocol.Parsable { return &protocol.StreamError{} },
+		},
+		{
+			name: "ConfigUpdate",
+			message: &protocol.ConfigUpdate{
+				Version:           3,
+				HeartbeatInterval: 15 * time.Second,
+				RateLimit:         100,
+				Features:          map[string]bool{"inspector": true, "beta": false},
+				Notice:            "maintenance at 18:00",
+			},
+			newFunc: func() protocol.Parsable { return &protocol.ConfigUpdate{} },
+		},
+		{
+			name: "ConfigUpdateAck",
+			message: &protocol.ConfigUpdateAck{
+				Version: 3,
+				Applied: true,
+				Message: "kept local heartbeat_interval",
+			},
+			newFunc: func() protocol.Parsable { return &protocol.ConfigUpdateAck{} },
+		},
 	}
 
 	for _, tt := range tests {
@@ -89,14 +234,16 @@ func TestMessageTypes(t *testing.T) {
 				t.Fatalf("failed to write message: %v", err)
 			}
 
-			_, readMessage, err := protocol.ReadMessage(&buf)
+			_, readMessage, err := protocol.ReadMessage(&buf, 0)
 			if err != nil {
 				t.Fatalf("failed to read message: %v", err)
 			}
 
 			// Unmarshal the message
 			unmarshaledMessage := tt.newFunc()
-			protocol.Unmarshal(unmarshaledMessage, readMessage)
+			if err := protocol.Unmarshal(unmarshaledMessage, readMessage); err != nil {
+				t.Fatalf("failed to unmarshal message: %v", err)
+			}
 
 			// Verify the unmarshaled message matches the original
 			if originalMessage.Type != readMessage.Type {
@@ -104,6 +251,112 @@ func TestMessageTypes(t *testing.T) {
 			}
 
 			assert.Equal(t, originalMessage, readMessage)
+			assert.Equal(t, tt.message, unmarshaledMessage)
 		})
 	}
 }
+
+func TestDatagram(t *testing.T) {
+	original := protocol.Datagram{Subdomain: "dns", Session: 7, Payload: []byte("query")}
+	data, err := original.MarshalBinary()
+	if err != nil {
+		t.Fatalf("failed to marshal datagram: %v", err)
+	}
+
+	var decoded protocol.Datagram
+	if err := decoded.UnmarshalBinary(data); err != nil {
+		t.Fatalf("failed to unmarshal datagram: %v", err)
+	}
+	assert.Equal(t, original, decoded)
+
+	err = decoded.UnmarshalBinary(data[:len("dns")+2])
+	assert.Equal(t, protocol.ErrInvalidDatagram, err)
+}
+
+func TestUnmarshalTruncated(t *testing.T) {
+	tests := []struct {
+		newMessage func() protocol.Parsable
+		// older are the prefix lengths that end before an optional field,
+		// as sent by older peers.
+		older []int
+	}{
+		{
+			newMessage: func() protocol.Parsable {
+				return &protocol.ConnectionRegister{
+					Subdomain: "test",
+					Host:      "localhost",
+					Port:      3000,
+					Token:     "secret",
+					TTL:       time.Hour,
+					JWT:       &protocol.JWTPolicy{Issuer: "iss", ClaimHeaders: map[string]string{"sub": "X-User"}},
+					PublicKey: []byte("key"),
+					Signature: []byte("sig"),
+				}
+			},
+			older: []int{20, 27, 28, 32, 34, 56, 64, 65},
+		},
+		{
+			newMessage: func() protocol.Parsable {
+				return &protocol.BeginConnection{
+					Subdomain: "test",
+					Host:      "test.example.com",
+					TLS:       &protocol.TLSInfo{Version: 0x0304, ServerName: "test.example.com"},
+				}
+			},
+			older: []int{8, 30},
+		},
+		{
+			newMessage: func() protocol.Parsable {
+				return &protocol.ConfigUpdate{Version: 1, Features: map[string]bool{"beta": true}, Notice: "hi"}
+			},
+		},
+		{newMessage: func() protocol.Parsable { return &protocol.Broadcast{Level: "info", Message: "hello"} }},
+		{newMessage: func() protocol.Parsable { return &protocol.ErrorMessage{Message: "boom"} }},
+	}
+
+	for _, tt := range tests {
+		payload := tt.newMessage().Marshal().Payload
+		for n := range len(payload) {
+			err := tt.newMessage().Unmarshal(payload[:n])
+			if slices.Contains(tt.older, n) {
+				if err != nil {
+					t.Errorf("%T: Unmarshal of the %d bytes an older peer sends = %v", tt.newMessage(), n, err)
+				}
+				continue
+			}
+			if !errors.Is(err, protocol.ErrTruncated) && !errors.Is(err, protocol.ErrInvalidMessage) {
+				t.Errorf("%T: Unmarshal of %d/%d bytes = %v, want ErrTruncated or ErrInvalidMessage",
+					tt.newMessage(), n, len(payload), err)
+			}
+		}
+	}
+
+	err := (&protocol.ErrorMessage{}).Unmarshal([]byte{4, 'b', 'o'})
+	if !errors.Is(err, protocol.ErrTruncated) || !errors.Is(err, protocol.ErrInvalidMessage) {
+		t.Errorf("expected ErrTruncated, got %v", err)
+	}
+
+	// A length far beyond the payload must not be trusted.
+	err = (&protocol.EndConnection{}).Unmarshal([]byte{0xff, 0xff, 0xff, 0xff, 't'})
+	if !errors.Is(err, protocol.ErrTruncated) {
+		t.Errorf("expected ErrTruncated, got %v", err)
+	}
+}
+
+func TestReadMessageTooLarge(t *testing.T) {
+	// A header announcing a 4GB payload must fail before the payload is
+	// allocated or read.
+	header := []byte{byte(protocol.MessageHeartbeat), 0xff, 0xff, 0xff, 0xff}
+	if _, _, err := protocol.ReadMessage(bytes.NewReader(header), 0); !errors.Is(err, protocol.ErrMessageTooLarge) ||
+		!errors.Is(err, protocol.ErrInvalidMessage) {
+		t.Fatalf("ReadMessage() error = %v, want ErrMessageTooLarge", err)
+	}
+
+	var buf bytes.Buffer
+	if _, err := (&protocol.Heartbeat{Message: "ping"}).Marshal().Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := protocol.ReadMessage(&buf, 4); !errors.Is(err, protocol.ErrMessageTooLarge) {
+		t.Fatalf("ReadMessage() error = %v, want ErrMessageTooLarge above the limit", err)
+	}
+}
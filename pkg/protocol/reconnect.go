@@ -0,0 +1,38 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// Reconnect asks a client to replace the connection it arrives on. The client
+// registers its tunnels on a new connection first; the server closes the old
+// one once Grace has elapsed.
+type Reconnect struct {
+	Reason string
+	Grace  time.Duration
+}
+
+func (r *Reconnect) Marshal() *Message {
+	payload := make([]byte, 0)
+
+	//nolint:gosec // G115: reasons are short fixed strings
+	payload = binary.BigEndian.AppendUint16(payload, uint16(len(r.Reason)))
+	payload = append(payload, []byte(r.Reason)...)
+
+	// Grace in seconds
+	payload = binary.BigEndian.AppendUint32(payload, durationSeconds(r.Grace))
+
+	return &Message{
+		Type:    MessageReconnect,
+		Length:  lenUint32(payload),
+		Payload: payload,
+	}
+}
+
+func (r *Reconnect) Unmarshal(payload []byte) error {
+	d := newDecoder(payload)
+	r.Reason = d.string16()
+	r.Grace = time.Duration(d.uint32()) * time.Second
+	return d.err
+}
@@ -1,6 +1,11 @@
 package protocol
 
-import "encoding/binary"
+import (
+	"encoding/binary"
+	"maps"
+	"slices"
+	"time"
+)
 
 type (
 	ConnectionRegister struct {
@@ -9,42 +14,136 @@ type (
 		Port      uint32
 		Protocol  Protocol
 		Token     string
+		// ClientID groups several QUIC connections of the same client process.
+		ClientID string
+		// TTL asks the server to remove the tunnel after this long (0 = never).
+		TTL time.Duration
+		// Schedule limits when the tunnel is publicly reachable, in the
+		// format accepted by schedule.Parse (empty = always).
+		Schedule string
+		// JWT requires callers of the tunnel to present a valid token (nil = off).
+		JWT *JWTPolicy
+		// PublicKey and Signature authenticate the client with an Ed25519 key
+		// instead of Token. Signature covers AuthChallenge.SignedMessage.
+		PublicKey []byte
+		Signature []byte
+		// Version is the client's build version (empty for older clients).
+		Version string
+		// PublicStatus lists the tunnel on the server's public status page.
+		PublicStatus bool
+	}
+
+	// JWTPolicy describes how the server validates bearer tokens for a tunnel.
+	JWTPolicy struct {
+		Issuer   string
+		Audience string
+		JWKSURL  string
+		// ClaimHeaders maps verified claim names to request headers set
+		// toward the backend.
+		ClaimHeaders map[string]string
 	}
 
 	ConnectionRegisterResp struct {
 		Success   bool
 		Subdomain string
 		Message   string
+		// Version is the server's build version (empty for older servers).
+		Version string
+		// URL is the public address of the tunnel (empty for older servers).
+		URL string
+		// Reject tells why the registration failed (RejectNone for older
+		// servers and on success).
+		Reject RejectReason
+		// Port is the public port of a TCP tunnel (0 for HTTP tunnels and
+		// older servers).
+		Port uint16
 	}
 )
 
-func (c *ConnectionRegister) Unmarshal(payload []byte) {
-	offset := 0
+// RejectReason tells a client why the server refused to register a tunnel,
+// e.g. so it can ask the user for another subdomain.
+type RejectReason byte
 
-	subdomainLen := int(payload[offset])
-	offset++
-	c.Subdomain = string(payload[offset : offset+subdomainLen])
-	offset += subdomainLen
-
-	hostLen := int(payload[offset])
-	offset++
-	c.Host = string(payload[offset : offset+hostLen])
-	offset += hostLen
+const (
+	RejectNone RejectReason = iota
+	RejectUnauthorized
+	RejectSubdomainTaken
+	RejectInvalidSubdomain
+	RejectReservedSubdomain
+	RejectConfusableSubdomain
+	RejectInvalidSchedule
+	// RejectNotPermitted: the subdomain is outside the token's patterns or the
+	// token already holds as many tunnels as it is allowed.
+	RejectNotPermitted
+	RejectNoPort
+	// RejectInvalidJWKS: the JWT policy names a JWKS URL the server will not
+	// fetch, e.g. plain http or a private address.
+	RejectInvalidJWKS
+)
 
-	c.Port = binary.BigEndian.Uint32(payload[offset:])
-	offset += 4
+func (r RejectReason) String() string {
+	switch r {
+	case RejectNone:
+		return "none"
+	case RejectUnauthorized:
+		return "unauthorized"
+	case RejectSubdomainTaken:
+		return "subdomain_taken"
+	case RejectInvalidSubdomain:
+		return "invalid_subdomain"
+	case RejectReservedSubdomain:
+		return "reserved_subdomain"
+	case RejectConfusableSubdomain:
+		return "confusable_subdomain"
+	case RejectInvalidSchedule:
+		return "invalid_schedule"
+	case RejectNotPermitted:
+		return "not_permitted"
+	case RejectNoPort:
+		return "no_port"
+	case RejectInvalidJWKS:
+		return "invalid_jwks"
+	default:
+		return "unknown"
+	}
+}
 
-	c.Protocol = Protocol(payload[offset])
-	offset++
+func (c *ConnectionRegister) Unmarshal(payload []byte) error {
+	d := newDecoder(payload)
+	c.Subdomain = d.string8()
+	c.Host = d.string8()
+	c.Port = d.uint32()
+	c.Protocol = ProtocolFromByte(d.uint8())
 
-	// Optional token (appended at the end). Backward compatible: only read if present.
-	if len(payload) > offset {
-		tokenLen := int(payload[offset])
-		offset++
-		if len(payload) >= offset+tokenLen {
-			c.Token = string(payload[offset : offset+tokenLen])
-		}
+	// The fields below were added over time; older clients end the payload
+	// before them.
+	if d.has(1) {
+		c.Token = d.string8()
+	}
+	if d.has(1) {
+		c.ClientID = d.string8()
 	}
+	if d.has(1) {
+		c.TTL = time.Duration(d.uint32()) * time.Second
+	}
+	if d.has(1) {
+		c.Schedule = d.string16()
+	}
+	if d.has(1) && d.bool() {
+		c.JWT = &JWTPolicy{}
+		c.JWT.unmarshal(d)
+	}
+	if d.has(1) {
+		c.PublicKey = d.bytes8()
+		c.Signature = d.bytes8()
+	}
+	if d.has(1) {
+		c.Version = d.string8()
+	}
+	if d.has(1) {
+		c.PublicStatus = d.bool()
+	}
+	return d.err
 }
 
 func (c *ConnectionRegister) Marshal() *Message {
@@ -69,6 +168,37 @@ func (c *ConnectionRegister) Marshal() *Message {
 	payload = append(payload, byte(len(c.Token)))
 	payload = append(payload, []byte(c.Token)...)
 
+	// Optional client ID
+	payload = append(payload, byte(len(c.ClientID)))
+	payload = append(payload, []byte(c.ClientID)...)
+
+	// Optional TTL in seconds
+	payload = binary.BigEndian.AppendUint32(payload, durationSeconds(c.TTL))
+
+	// Optional schedule
+	//nolint:gosec // G115: schedules are short config strings
+	payload = binary.BigEndian.AppendUint16(payload, uint16(len(c.Schedule)))
+	payload = append(payload, []byte(c.Schedule)...)
+
+	// Optional JWT policy
+	payload = append(payload, boolToByte(c.JWT != nil))
+	if c.JWT != nil {
+		payload = c.JWT.appendTo(payload)
+	}
+
+	// Optional public key authentication
+	payload = append(payload, byte(len(c.PublicKey)))
+	payload = append(payload, c.PublicKey...)
+	payload = append(payload, byte(len(c.Signature)))
+	payload = append(payload, c.Signature...)
+
+	// Optional client version
+	payload = append(payload, byte(len(c.Version)))
+	payload = append(payload, []byte(c.Version)...)
+
+	// Optional public status page opt-in
+	payload = append(payload, boolToByte(c.PublicStatus))
+
 	return &Message{
 		Type:    MessageConnectionRegister,
 		Length:  lenUint32(payload),
@@ -76,28 +206,69 @@ func (c *ConnectionRegister) Marshal() *Message {
 	}
 }
 
-func (c *ConnectionRegisterResp) Unmarshal(payload []byte) {
-	offset := 0
+func (p *JWTPolicy) appendTo(payload []byte) []byte {
+	for _, field := range []string{p.Issuer, p.Audience, p.JWKSURL} {
+		//nolint:gosec // G115: policy fields are short config strings
+		payload = binary.BigEndian.AppendUint16(payload, uint16(len(field)))
+		payload = append(payload, []byte(field)...)
+	}
 
-	// Success flag
-	c.Success = byteToBool(payload[offset])
-	offset++
+	claims := slices.Sorted(maps.Keys(p.ClaimHeaders))
+	payload = append(payload, byte(len(claims)))
+	for _, claim := range claims {
+		header := p.ClaimHeaders[claim]
+		payload = append(payload, byte(len(claim)))
+		payload = append(payload, []byte(claim)...)
+		payload = append(payload, byte(len(header)))
+		payload = append(payload, []byte(header)...)
+	}
 
-	// Subdomain (1 byte length + bytes)
-	subdomainLen := int(payload[offset])
-	offset++
-	c.Subdomain = string(payload[offset : offset+subdomainLen])
-	offset += subdomainLen
+	return payload
+}
 
-	// Message (4 byte length + bytes)
-	messageLen := binary.BigEndian.Uint32(payload[offset:])
-	offset += 4
-	c.Message = string(payload[offset : offset+int(messageLen)])
+// unmarshal decodes the policy at the position of d.
+func (p *JWTPolicy) unmarshal(d *decoder) {
+	p.Issuer = d.string16()
+	p.Audience = d.string16()
+	p.JWKSURL = d.string16()
+
+	claimCount := int(d.uint8())
+	if claimCount == 0 {
+		return
+	}
+	p.ClaimHeaders = make(map[string]string, claimCount)
+	for range claimCount {
+		claim := d.string8()
+		p.ClaimHeaders[claim] = d.string8()
+	}
+}
+
+func (c *ConnectionRegisterResp) Unmarshal(payload []byte) error {
+	d := newDecoder(payload)
+	c.Success = d.bool()
+	c.Subdomain = d.string8()
+	c.Message = d.string32()
+
+	// Optional fields, left out by older servers.
+	if d.has(1) {
+		c.Version = d.string8()
+	}
+	if d.has(1) {
+		c.URL = d.string16()
+	}
+	if d.has(1) {
+		c.Reject = RejectReason(d.uint8())
+	}
+	if d.has(1) {
+		c.Port = d.uint16()
+	}
+	return d.err
 }
 
 func (c *ConnectionRegisterResp) Marshal() *Message {
-	// success(1) + subLen(1) + subdomain + msgLen(4) + message
-	payload := make([]byte, 1+1+len(c.Subdomain)+4+len(c.Message))
+	// success(1) + subLen(1) + subdomain + msgLen(4) + message + verLen(1) + version
+	// + urlLen(2) + url + reject(1) + port(2)
+	payload := make([]byte, 1+1+len(c.Subdomain)+4+len(c.Message)+1+len(c.Version)+2+len(c.URL)+1+2)
 	offset := 0
 
 	// Success flag
@@ -114,6 +285,27 @@ func (c *ConnectionRegisterResp) Marshal() *Message {
 	binary.BigEndian.PutUint32(payload[offset:], lenUint32(c.Message))
 	offset += 4
 	copy(payload[offset:], c.Message)
+	offset += len(c.Message)
+
+	// Version
+	payload[offset] = byte(len(c.Version))
+	offset++
+	copy(payload[offset:], c.Version)
+	offset += len(c.Version)
+
+	// URL
+	//nolint:gosec // G115: URLs are short host names
+	binary.BigEndian.PutUint16(payload[offset:], uint16(len(c.URL)))
+	offset += 2
+	copy(payload[offset:], c.URL)
+	offset += len(c.URL)
+
+	// Reject reason
+	payload[offset] = byte(c.Reject)
+	offset++
+
+	// TCP port
+	binary.BigEndian.PutUint16(payload[offset:], c.Port)
 
 	return &Message{
 		Type:    MessageConnectionRegisterResp,
@@ -0,0 +1,60 @@
+package protocol
+
+import "encoding/binary"
+
+// StreamErrorCode tells why a client could not serve a stream.
+type StreamErrorCode byte
+
+const (
+	StreamErrorUnknown StreamErrorCode = iota
+	// StreamErrorNoBackend: the client has no backend for the subdomain.
+	StreamErrorNoBackend
+	// StreamErrorBackendUnreachable: resolving or connecting to the backend
+	// failed, e.g. because nothing listens on its port.
+	StreamErrorBackendUnreachable
+	// StreamErrorRefused: a policy of the backend refused the user, e.g.
+	// because of its address.
+	StreamErrorRefused
+)
+
+func (c StreamErrorCode) String() string {
+	switch c {
+	case StreamErrorNoBackend:
+		return "no_backend"
+	case StreamErrorBackendUnreachable:
+		return "backend_unreachable"
+	case StreamErrorRefused:
+		return "refused"
+	default:
+		return "unknown"
+	}
+}
+
+// StreamError is what a client sends on a stream it cannot serve, in place
+// of ConnectionReady or of the HTTP response, so the server answers at once.
+// Message details the failure for the server logs.
+type StreamError struct {
+	Code    StreamErrorCode
+	Message string
+}
+
+func (e *StreamError) Marshal() *Message {
+	payload := []byte{byte(e.Code)}
+
+	//nolint:gosec // G115: messages are short error strings
+	payload = binary.BigEndian.AppendUint16(payload, uint16(len(e.Message)))
+	payload = append(payload, []byte(e.Message)...)
+
+	return &Message{
+		Type:    MessageStreamError,
+		Length:  lenUint32(payload),
+		Payload: payload,
+	}
+}
+
+func (e *StreamError) Unmarshal(payload []byte) error {
+	d := newDecoder(payload)
+	e.Code = StreamErrorCode(d.uint8())
+	e.Message = d.string16()
+	return d.err
+}
@@ -0,0 +1,81 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// MalformedResponseHeader marks the 502 a client answers with when its
+// backend sent something that is not HTTP. The body is the start of what the
+// backend sent.
+const MalformedResponseHeader = "X-Gunnel-Malformed-Response"
+
+// TunnelState asks the server to pause or resume public access to a tunnel
+// without dropping its registration, or with Closed to drop the tunnel while
+// the connection keeps serving the others.
+type TunnelState struct {
+	Subdomain string
+	Paused    bool
+	Closed    bool
+}
+
+// TunnelExpiry warns a client that a tunnel registered with a TTL is about to
+// expire, or that it has expired and the server dropped its route.
+type TunnelExpiry struct {
+	Subdomain string
+	ExpiresAt time.Time
+	Expired   bool
+}
+
+func (t *TunnelExpiry) Marshal() *Message {
+	payload := make([]byte, 0)
+
+	payload = append(payload, byte(len(t.Subdomain)))
+	payload = append(payload, []byte(t.Subdomain)...)
+
+	//nolint:gosec // G115: unix seconds are positive for any realistic timestamp
+	payload = binary.BigEndian.AppendUint64(payload, uint64(t.ExpiresAt.Unix()))
+	payload = append(payload, boolToByte(t.Expired))
+
+	return &Message{
+		Type:    MessageTunnelExpiry,
+		Length:  lenUint32(payload),
+		Payload: payload,
+	}
+}
+
+func (t *TunnelExpiry) Unmarshal(payload []byte) error {
+	d := newDecoder(payload)
+	t.Subdomain = d.string8()
+	//nolint:gosec // G115: written from a unix timestamp
+	t.ExpiresAt = time.Unix(int64(d.uint64()), 0)
+	t.Expired = d.bool()
+	return d.err
+}
+
+func (t *TunnelState) Marshal() *Message {
+	payload := make([]byte, 0)
+
+	payload = append(payload, byte(len(t.Subdomain)))
+	payload = append(payload, []byte(t.Subdomain)...)
+	payload = append(payload, boolToByte(t.Paused))
+	if t.Closed {
+		payload = append(payload, boolToByte(t.Closed))
+	}
+
+	return &Message{
+		Type:    MessageTunnelState,
+		Length:  lenUint32(payload),
+		Payload: payload,
+	}
+}
+
+func (t *TunnelState) Unmarshal(payload []byte) error {
+	d := newDecoder(payload)
+	t.Subdomain = d.string8()
+	t.Paused = d.bool()
+	if d.has(1) {
+		t.Closed = d.bool()
+	}
+	return d.err
+}
@@ -0,0 +1,251 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+const (
+	// masqueDefaultTemplate is the well-known CONNECT-UDP path (RFC 9298).
+	masqueDefaultTemplate = "/.well-known/masque/udp/{target_host}/{target_port}/"
+	masqueDefaultPort     = "443"
+	masqueKeepAlive       = 15 * time.Second
+	masquePacketSize      = 1350
+)
+
+// masque relays datagrams through an HTTP/3 proxy with CONNECT-UDP.
+type masque struct {
+	addr     string
+	host     string
+	template string
+	auth     string
+}
+
+func newMASQUE(u *url.URL) *masque {
+	// The path is re-escaped by url.Parse; undo it for the template braces.
+	template := strings.NewReplacer("%7B", "{", "%7D", "}").Replace(u.EscapedPath())
+	if template == "" || template == "/" {
+		template = masqueDefaultTemplate
+	}
+	if u.RawQuery != "" {
+		template += "?" + u.RawQuery
+	}
+
+	m := &masque{addr: u.Host, host: u.Hostname(), template: template}
+	if u.Port() == "" {
+		m.addr = net.JoinHostPort(u.Hostname(), masqueDefaultPort)
+	}
+	if u.User != nil {
+		m.auth = basicAuth(u.User)
+	}
+	return m
+}
+
+func basicAuth(user *url.Userinfo) string {
+	password, _ := user.Password()
+	req := &http.Request{Header: http.Header{}}
+	req.SetBasicAuth(user.Username(), password)
+	return req.Header.Get("Authorization")
+}
+
+// targetURL expands the URI template for addr.
+func (m *masque) targetURL(addr string) (*url.URL, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	path := strings.NewReplacer(
+		"{target_host}", url.PathEscape(host),
+		"{target_port}", url.PathEscape(port),
+	).Replace(m.template)
+	return url.Parse("https://" + m.addr + path)
+}
+
+func (m *masque) dial(ctx context.Context, addr string) (net.PacketConn, net.Addr, error) {
+	target, err := m.targetURL(addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid port in %q", addr)
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName: m.host,
+		NextProtos: []string{http3.NextProtoH3},
+		MinVersion: tls.VersionTLS13,
+		//nolint:gosec // Only enabled when GUNNEL_INSECURE env var is set
+		InsecureSkipVerify: os.Getenv("GUNNEL_INSECURE") == "true",
+	}
+	qconn, err := quic.DialAddr(ctx, m.addr, tlsConfig, &quic.Config{
+		EnableDatagrams: true,
+		KeepAlivePeriod: masqueKeepAlive,
+		// Large enough to carry the client's 1200 byte packets as datagrams.
+		InitialPacketSize: masquePacketSize,
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to reach masque proxy: %w", err)
+	}
+
+	stream, err := m.connect(ctx, qconn, target)
+	if err != nil {
+		return nil, nil, errors.Join(err, qconn.CloseWithError(0, ""))
+	}
+
+	conn := &masquePacketConn{
+		qconn:  qconn,
+		stream: stream,
+		remote: &domainAddr{host: host, port: port},
+	}
+	conn.ctx, conn.cancel = context.WithCancel(context.Background())
+	return conn, conn.remote, nil
+}
+
+// connect opens the CONNECT-UDP request stream for target.
+func (m *masque) connect(ctx context.Context, qconn *quic.Conn, target *url.URL) (*http3.RequestStream, error) {
+	cc := (&http3.Transport{EnableDatagrams: true}).NewClientConn(qconn)
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-cc.ReceivedSettings():
+	}
+	if settings := cc.Settings(); !settings.EnableDatagrams || !settings.EnableExtendedConnect {
+		return nil, errors.New("masque proxy does not support HTTP datagrams and extended CONNECT")
+	}
+
+	stream, err := cc.OpenRequestStream(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		Proto:  "connect-udp",
+		Host:   target.Host,
+		URL:    target,
+		Header: http.Header{"Capsule-Protocol": []string{"?1"}},
+	}
+	if m.auth != "" {
+		req.Header.Set("Proxy-Authorization", m.auth)
+	}
+	if err := stream.SendRequestHeader(req.WithContext(ctx)); err != nil {
+		return nil, err
+	}
+
+	rsp, err := stream.ReadResponse()
+	if err != nil {
+		return nil, err
+	}
+	if rsp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("masque proxy refused CONNECT-UDP: %s", rsp.Status)
+	}
+	return stream, nil
+}
+
+// masquePacketConn carries datagrams as HTTP datagrams with context ID 0.
+type masquePacketConn struct {
+	qconn  *quic.Conn
+	stream *http3.RequestStream
+	remote net.Addr
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu           sync.Mutex
+	readDeadline time.Time
+	readCancel   context.CancelFunc
+}
+
+func (c *masquePacketConn) WriteTo(p []byte, _ net.Addr) (int, error) {
+	datagram := make([]byte, 0, 1+len(p))
+	datagram = append(datagram, 0) // context ID 0: UDP payload
+	datagram = append(datagram, p...)
+	if err := c.stream.SendDatagram(datagram); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *masquePacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		ctx, cancel := c.readContext()
+		datagram, err := c.stream.ReceiveDatagram(ctx)
+		deadlineHit := errors.Is(ctx.Err(), context.DeadlineExceeded)
+		cancel()
+
+		if err != nil {
+			if deadlineHit {
+				return 0, nil, os.ErrDeadlineExceeded
+			}
+			if c.ctx.Err() != nil {
+				return 0, nil, net.ErrClosed
+			}
+			return 0, nil, err
+		}
+		// Only context ID 0 carries UDP payloads; drop anything else.
+		if len(datagram) == 0 || datagram[0] != 0 {
+			continue
+		}
+		return copy(p, datagram[1:]), c.remote, nil
+	}
+}
+
+func (c *masquePacketConn) readContext() (context.Context, context.CancelFunc) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ctx, cancel := context.WithCancel(c.ctx)
+	if !c.readDeadline.IsZero() {
+		cancel()
+		ctx, cancel = context.WithDeadline(c.ctx, c.readDeadline)
+	}
+	c.readCancel = cancel
+	return ctx, cancel
+}
+
+func (c *masquePacketConn) Close() error {
+	c.cancel()
+	c.stream.CancelRead(quic.StreamErrorCode(http3.ErrCodeNoError))
+	return errors.Join(c.stream.Close(), c.qconn.CloseWithError(0, ""))
+}
+
+func (c *masquePacketConn) LocalAddr() net.Addr { return c.qconn.LocalAddr() }
+
+func (c *masquePacketConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+// SetReadDeadline also interrupts a pending read when t is in the past.
+func (c *masquePacketConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.readDeadline = t
+	if !t.IsZero() && !t.After(time.Now()) && c.readCancel != nil {
+		c.readCancel()
+	}
+	return nil
+}
+
+// SetWriteDeadline is a no-op: datagrams are never blocked on flow control.
+func (c *masquePacketConn) SetWriteDeadline(time.Time) error { return nil }
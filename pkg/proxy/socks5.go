@@ -0,0 +1,332 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	socksVersion      = 5
+	socksAuthNone     = 0x00
+	socksAuthPassword = 0x02
+	socksNoAcceptable = 0xff
+	socksCmdAssociate = 0x03
+	socksAtypIPv4     = 0x01
+	socksAtypDomain   = 0x03
+	socksAtypIPv6     = 0x04
+	socksDefaultPort  = "1080"
+	maxDatagramSize   = 65535
+)
+
+type socks5 struct {
+	addr          string
+	username      string
+	password      string
+	resolveRemote bool
+}
+
+func newSOCKS5(u *url.URL) *socks5 {
+	s := &socks5{addr: u.Host, resolveRemote: u.Scheme == "socks5h"}
+	if u.Port() == "" {
+		s.addr = net.JoinHostPort(u.Hostname(), socksDefaultPort)
+	}
+	if u.User != nil {
+		s.username = u.User.Username()
+		s.password, _ = u.User.Password()
+	}
+	return s
+}
+
+// dial sets up a UDP association with the proxy and returns a packet conn
+// that wraps every datagram in the SOCKS5 UDP header.
+func (s *socks5) dial(ctx context.Context, addr string) (net.PacketConn, net.Addr, error) {
+	target, err := s.target(ctx, addr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var d net.Dialer
+	ctrl, err := d.DialContext(ctx, "tcp", s.addr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to reach socks5 proxy: %w", err)
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := ctrl.SetDeadline(deadline); err != nil {
+			return nil, nil, errors.Join(err, ctrl.Close())
+		}
+	}
+	relay, err := s.associate(ctrl)
+	if err == nil {
+		err = ctrl.SetDeadline(time.Time{})
+	}
+	if err != nil {
+		return nil, nil, errors.Join(err, ctrl.Close())
+	}
+
+	udp, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, nil, errors.Join(err, ctrl.Close())
+	}
+
+	conn := &socksPacketConn{udp: udp, ctrl: ctrl, relay: relay, readBuf: make([]byte, maxDatagramSize)}
+	go conn.watchControl()
+	return conn, target, nil
+}
+
+// target resolves addr locally unless the proxy resolves names itself.
+func (s *socks5) target(ctx context.Context, addr string) (net.Addr, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port in %q", addr)
+	}
+
+	if net.ParseIP(host) == nil && s.resolveRemote {
+		return &domainAddr{host: host, port: port}, nil
+	}
+
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	return &net.UDPAddr{IP: ips[0].IP, Port: port}, nil
+}
+
+func (s *socks5) associate(ctrl net.Conn) (*net.UDPAddr, error) {
+	if err := s.authenticate(ctrl); err != nil {
+		return nil, err
+	}
+
+	// Ask for a relay; 0.0.0.0:0 lets the proxy accept our datagrams from
+	// whatever address NAT gives them.
+	if _, err := ctrl.Write([]byte{socksVersion, socksCmdAssociate, 0, socksAtypIPv4, 0, 0, 0, 0, 0, 0}); err != nil {
+		return nil, err
+	}
+
+	reply := make([]byte, 3)
+	if _, err := io.ReadFull(ctrl, reply); err != nil {
+		return nil, err
+	}
+	if reply[1] != 0 {
+		return nil, fmt.Errorf("socks5 proxy refused UDP associate (code %d)", reply[1])
+	}
+
+	relay, err := readAddr(ctrl)
+	if err != nil {
+		return nil, err
+	}
+	udpRelay, ok := relay.(*net.UDPAddr)
+	if !ok {
+		return nil, errors.New("socks5 proxy returned a domain name as relay address")
+	}
+	if udpRelay.IP.IsUnspecified() {
+		// The relay lives on the proxy host itself.
+		if tcp, ok := ctrl.RemoteAddr().(*net.TCPAddr); ok {
+			udpRelay.IP = tcp.IP
+		}
+	}
+	return udpRelay, nil
+}
+
+func (s *socks5) authenticate(ctrl net.Conn) error {
+	method := byte(socksAuthNone)
+	if s.username != "" {
+		method = socksAuthPassword
+	}
+	if _, err := ctrl.Write([]byte{socksVersion, 1, method}); err != nil {
+		return err
+	}
+
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(ctrl, reply); err != nil {
+		return err
+	}
+	if reply[1] == socksNoAcceptable || reply[1] != method {
+		return errors.New("socks5 proxy rejected the authentication method")
+	}
+	if method == socksAuthNone {
+		return nil
+	}
+
+	if len(s.username) > 255 || len(s.password) > 255 {
+		return errors.New("socks5 credentials are too long")
+	}
+	req := []byte{1, byte(len(s.username))}
+	req = append(req, s.username...)
+	req = append(req, byte(len(s.password)))
+	req = append(req, s.password...)
+	if _, err := ctrl.Write(req); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(ctrl, reply); err != nil {
+		return err
+	}
+	if reply[1] != 0 {
+		return errors.New("socks5 proxy rejected the credentials")
+	}
+	return nil
+}
+
+// readAddr reads ATYP, address and port as sent in replies and UDP headers.
+func readAddr(r io.Reader) (net.Addr, error) {
+	atyp := make([]byte, 1)
+	if _, err := io.ReadFull(r, atyp); err != nil {
+		return nil, err
+	}
+
+	var host []byte
+	switch atyp[0] {
+	case socksAtypIPv4:
+		host = make([]byte, net.IPv4len)
+	case socksAtypIPv6:
+		host = make([]byte, net.IPv6len)
+	case socksAtypDomain:
+		n := make([]byte, 1)
+		if _, err := io.ReadFull(r, n); err != nil {
+			return nil, err
+		}
+		host = make([]byte, n[0])
+	default:
+		return nil, fmt.Errorf("unknown socks5 address type %d", atyp[0])
+	}
+
+	buf := make([]byte, len(host)+2)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	copy(host, buf)
+	port := int(binary.BigEndian.Uint16(buf[len(host):]))
+
+	if atyp[0] == socksAtypDomain {
+		return &domainAddr{host: string(host), port: port}, nil
+	}
+	return &net.UDPAddr{IP: net.IP(host), Port: port}, nil
+}
+
+// appendAddr appends addr in SOCKS5 wire format.
+func appendAddr(b []byte, addr net.Addr) ([]byte, error) {
+	switch a := addr.(type) {
+	case *domainAddr:
+		if len(a.host) > 255 {
+			return nil, errors.New("host name too long")
+		}
+		b = append(b, socksAtypDomain, byte(len(a.host)))
+		b = append(b, a.host...)
+		return binary.BigEndian.AppendUint16(b, uint16(a.port)), nil //nolint:gosec // G115: ports fit in 16 bits
+	case *net.UDPAddr:
+		return appendIP(b, a.IP, a.Port), nil
+	case *net.IPAddr:
+		return nil, errors.New("missing port")
+	default:
+		udp, err := net.ResolveUDPAddr("udp", addr.String())
+		if err != nil {
+			return nil, err
+		}
+		return appendIP(b, udp.IP, udp.Port), nil
+	}
+}
+
+func appendIP(b []byte, ip net.IP, port int) []byte {
+	if ip4 := ip.To4(); ip4 != nil {
+		b = append(b, socksAtypIPv4)
+		b = append(b, ip4...)
+	} else {
+		b = append(b, socksAtypIPv6)
+		b = append(b, ip.To16()...)
+	}
+	return binary.BigEndian.AppendUint16(b, uint16(port)) //nolint:gosec // G115: ports fit in 16 bits
+}
+
+// domainAddr is a host name the proxy resolves.
+type domainAddr struct {
+	host string
+	port int
+}
+
+func (a *domainAddr) Network() string { return "udp" }
+func (a *domainAddr) String() string  { return net.JoinHostPort(a.host, strconv.Itoa(a.port)) }
+
+// socksPacketConn sends datagrams through the proxy relay. The association
+// lasts as long as the TCP control connection stays open. The UDP socket is
+// not embedded so QUIC cannot bypass the header handling through the
+// socket's OOB methods.
+type socksPacketConn struct {
+	udp       *net.UDPConn
+	ctrl      net.Conn
+	relay     *net.UDPAddr
+	readBuf   []byte
+	closeOnce sync.Once
+	closeErr  error
+}
+
+func (c *socksPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	packet, err := appendAddr([]byte{0, 0, 0}, addr)
+	if err != nil {
+		return 0, err
+	}
+	packet = append(packet, p...)
+
+	if _, err := c.udp.WriteToUDP(packet, c.relay); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// ReadFrom is only called from the QUIC read loop, so readBuf is not shared.
+func (c *socksPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	buf := c.readBuf
+	for {
+		n, from, err := c.udp.ReadFromUDP(buf)
+		if err != nil {
+			return 0, nil, err
+		}
+		// Drop anything that is not from the relay or is fragmented.
+		if !from.IP.Equal(c.relay.IP) || from.Port != c.relay.Port || n < 4 || buf[2] != 0 {
+			continue
+		}
+
+		r := bytes.NewReader(buf[3:n])
+		src, err := readAddr(r)
+		if err != nil {
+			continue
+		}
+		return copy(p, buf[n-r.Len():n]), src, nil
+	}
+}
+
+func (c *socksPacketConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.closeErr = errors.Join(c.udp.Close(), c.ctrl.Close())
+	})
+	return c.closeErr
+}
+
+func (c *socksPacketConn) LocalAddr() net.Addr                { return c.udp.LocalAddr() }
+func (c *socksPacketConn) SetDeadline(t time.Time) error      { return c.udp.SetDeadline(t) }
+func (c *socksPacketConn) SetReadDeadline(t time.Time) error  { return c.udp.SetReadDeadline(t) }
+func (c *socksPacketConn) SetWriteDeadline(t time.Time) error { return c.udp.SetWriteDeadline(t) }
+
+// watchControl closes the socket once the proxy drops the association.
+func (c *socksPacketConn) watchControl() {
+	if _, err := io.Copy(io.Discard, c.ctrl); err != nil && !errors.Is(err, net.ErrClosed) {
+		logrus.WithError(err).Debug("SOCKS5 control connection failed")
+	}
+	if err := c.Close(); err != nil {
+		logrus.WithError(err).Debug("Failed to close SOCKS5 association")
+	}
+}
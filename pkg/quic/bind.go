@@ -0,0 +1,126 @@
+package quic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// BindDialer returns a PacketDialer whose socket is bound to address, or to
+// the network interface iface, so traffic leaves through that path on
+// multi-homed hosts. Only one of address and iface may be set. Interfaces
+// are bound with SO_BINDTODEVICE on Linux and IP_BOUND_IF on macOS, so the
+// route of the interface is used whatever its addresses.
+func BindDialer(address, iface string) (PacketDialer, error) {
+	switch {
+	case address != "" && iface != "":
+		return nil, errors.New("bind address and interface are mutually exclusive")
+	case address != "":
+		ip := net.ParseIP(address)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid bind address %q", address)
+		}
+		local := net.JoinHostPort(ip.String(), "0")
+		usable := func(v4 bool) bool { return v4 == (ip.To4() != nil) }
+		return func(ctx context.Context, addr string) (net.PacketConn, net.Addr, error) {
+			return listenFrom(ctx, addr, usable, func(ctx context.Context, network string) (net.PacketConn, error) {
+				return (&net.ListenConfig{}).ListenPacket(ctx, network, local)
+			})
+		}, nil
+	case iface != "":
+		ifi, err := net.InterfaceByName(iface)
+		if err != nil {
+			return nil, fmt.Errorf("bind interface %q: %w", iface, err)
+		}
+		control, err := bindToDevice(ifi)
+		if err != nil {
+			return nil, fmt.Errorf("bind interface %q: %w", iface, err)
+		}
+		config := &net.ListenConfig{Control: control}
+		return func(ctx context.Context, addr string) (net.PacketConn, net.Addr, error) {
+			v4, v6, err := interfaceFamilies(ifi)
+			if err != nil {
+				return nil, nil, err
+			}
+			usable := func(isV4 bool) bool { return (isV4 && v4) || (!isV4 && v6) }
+			return listenFrom(ctx, addr, usable, func(ctx context.Context, network string) (net.PacketConn, error) {
+				return config.ListenPacket(ctx, network, ":0")
+			})
+		}, nil
+	default:
+		return nil, nil //nolint:nilnil // nil dialer means the default socket
+	}
+}
+
+// listenFrom resolves addr and opens a UDP socket with listen for the first
+// of its addresses in a family usable locally.
+func listenFrom(
+	ctx context.Context,
+	addr string,
+	usable func(v4 bool) bool,
+	listen func(ctx context.Context, network string) (net.PacketConn, error),
+) (net.PacketConn, net.Addr, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ip := selectRemote(ips, usable)
+	if ip == nil {
+		return nil, nil, fmt.Errorf("no local address can reach %s", host)
+	}
+	remote, err := net.ResolveUDPAddr("udp", net.JoinHostPort(ip.String(), port))
+	if err != nil {
+		return nil, nil, err
+	}
+	network := "udp6"
+	if ip.To4() != nil {
+		network = "udp4"
+	}
+	conn, err := listen(ctx, network)
+	if err != nil {
+		return nil, nil, err
+	}
+	return conn, remote, nil
+}
+
+// selectRemote returns the first of ips in a family usable locally, or nil.
+func selectRemote(ips []net.IPAddr, usable func(v4 bool) bool) net.IP {
+	for _, candidate := range ips {
+		if usable(candidate.IP.To4() != nil) {
+			return candidate.IP
+		}
+	}
+	return nil
+}
+
+// interfaceFamilies reports whether iface has an IPv4 and a routable IPv6
+// address, as the kernel picks the source address from them.
+func interfaceFamilies(iface *net.Interface) (bool, bool, error) {
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return false, false, err
+	}
+
+	var v4, v6 bool
+	for _, a := range addrs {
+		ipNet, ok := a.(*net.IPNet)
+		if !ok || ipNet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if ipNet.IP.To4() != nil {
+			v4 = true
+		} else {
+			v6 = true
+		}
+	}
+	if !v4 && !v6 {
+		return false, false, fmt.Errorf("interface %s has no usable address", iface.Name)
+	}
+	return v4, v6, nil
+}
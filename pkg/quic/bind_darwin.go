@@ -0,0 +1,25 @@
+package quic
+
+import (
+	"errors"
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// bindToDevice binds sockets to iface with IP_BOUND_IF, or IPV6_BOUND_IF for
+// IPv6 sockets.
+func bindToDevice(iface *net.Interface) (func(network, address string, c syscall.RawConn) error, error) {
+	return func(network, _ string, c syscall.RawConn) error {
+		level, opt := unix.IPPROTO_IP, unix.IP_BOUND_IF
+		if network == "udp6" {
+			level, opt = unix.IPPROTO_IPV6, unix.IPV6_BOUND_IF
+		}
+		var sockErr error
+		err := c.Control(func(fd uintptr) {
+			sockErr = unix.SetsockoptInt(int(fd), level, opt, iface.Index)
+		})
+		return errors.Join(err, sockErr)
+	}, nil
+}
@@ -0,0 +1,20 @@
+package quic
+
+import (
+	"errors"
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// bindToDevice binds sockets to iface with SO_BINDTODEVICE.
+func bindToDevice(iface *net.Interface) (func(network, address string, c syscall.RawConn) error, error) {
+	return func(_, _ string, c syscall.RawConn) error {
+		var sockErr error
+		err := c.Control(func(fd uintptr) {
+			sockErr = unix.BindToDevice(int(fd), iface.Name)
+		})
+		return errors.Join(err, sockErr)
+	}, nil
+}
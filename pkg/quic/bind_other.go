@@ -0,0 +1,14 @@
+//go:build !linux && !darwin
+
+package quic
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+	"syscall"
+)
+
+func bindToDevice(*net.Interface) (func(network, address string, c syscall.RawConn) error, error) {
+	return nil, fmt.Errorf("binding to an interface is not supported on %s", runtime.GOOS)
+}
@@ -0,0 +1,102 @@
+package quic_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"testing"
+
+	gunnelquic "github.com/snakeice/gunnel/pkg/quic"
+)
+
+func TestSelectRemote(t *testing.T) {
+	v4 := net.IPAddr{IP: net.ParseIP("192.0.2.10")}
+	v6 := net.IPAddr{IP: net.ParseIP("2001:db8::10")}
+	onlyV4 := func(isV4 bool) bool { return isV4 }
+	onlyV6 := func(isV4 bool) bool { return !isV4 }
+	both := func(bool) bool { return true }
+
+	tests := []struct {
+		name   string
+		ips    []net.IPAddr
+		usable func(bool) bool
+		want   net.IP
+	}{
+		{name: "ipv4 bind skips ipv6", ips: []net.IPAddr{v6, v4}, usable: onlyV4, want: v4.IP},
+		{name: "ipv6 bind skips ipv4", ips: []net.IPAddr{v4, v6}, usable: onlyV6, want: v6.IP},
+		{name: "dual stack keeps resolver order", ips: []net.IPAddr{v6, v4}, usable: both, want: v6.IP},
+		{name: "no usable family", ips: []net.IPAddr{v6}, usable: onlyV4},
+		{name: "nothing resolved", usable: both},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := gunnelquic.SelectRemote(tt.ips, tt.usable); !got.Equal(tt.want) {
+				t.Errorf("SelectRemote = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBindDialerAddress(t *testing.T) {
+	dial, err := gunnelquic.BindDialer("127.0.0.1", "")
+	if err != nil {
+		t.Fatalf("BindDialer: %v", err)
+	}
+	conn, remote, err := dial(context.Background(), "localhost:4433")
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+
+	if local := conn.LocalAddr().(*net.UDPAddr); !local.IP.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Errorf("socket bound to %v, want 127.0.0.1", local.IP)
+	}
+	if remote.String() != "127.0.0.1:4433" {
+		t.Errorf("remote = %v, want the IPv4 address of localhost", remote)
+	}
+}
+
+func TestBindDialerInterface(t *testing.T) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var loopback string
+	for _, ifi := range ifaces {
+		if ifi.Flags&net.FlagLoopback != 0 && ifi.Flags&net.FlagUp != 0 {
+			loopback = ifi.Name
+			break
+		}
+	}
+	if loopback == "" {
+		t.Skip("no loopback interface")
+	}
+
+	dial, err := gunnelquic.BindDialer("", loopback)
+	if err != nil {
+		t.Skipf("binding to an interface is unavailable: %v", err)
+	}
+	conn, remote, err := dial(context.Background(), "127.0.0.1:4433")
+	if errors.Is(err, os.ErrPermission) {
+		t.Skipf("binding to an interface needs privileges: %v", err)
+	}
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+
+	if remote.String() != "127.0.0.1:4433" {
+		t.Errorf("remote = %v, want 127.0.0.1:4433", remote)
+	}
+	if _, err := conn.WriteTo([]byte("ping"), remote); err != nil {
+		t.Errorf("write through %s: %v", loopback, err)
+	}
+}
+
+func TestBindDialerRejectsBoth(t *testing.T) {
+	if _, err := gunnelquic.BindDialer("127.0.0.1", "lo"); err == nil {
+		t.Error("BindDialer accepted both an address and an interface")
+	}
+}
@@ -0,0 +1,6 @@
+package quic
+
+// SelectRemote picks the server address a bound socket can reach.
+var SelectRemote = selectRemote
+
+const MaxIncomingStreams = defaultMaxIncomingStreams
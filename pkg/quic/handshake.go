@@ -0,0 +1,32 @@
+package quic
+
+import "crypto/tls"
+
+// Handshake is what a connection negotiated, to debug middleboxes that
+// interfere with QUIC or TLS.
+type Handshake struct {
+	QUICVersion string `json:"quic_version"`
+	TLSVersion  string `json:"tls_version"`
+	// ALPN is empty when the peers negotiated no application protocol.
+	ALPN        string `json:"alpn"`
+	CipherSuite string `json:"cipher_suite"`
+	Used0RTT    bool   `json:"used_0rtt"`
+	Resumed     bool   `json:"resumed"`
+	// Datagrams reports whether both peers support QUIC datagrams, which
+	// UDP tunnels need.
+	Datagrams bool `json:"datagrams"`
+}
+
+// Handshake returns what the connection negotiated.
+func (c *Client) Handshake() Handshake {
+	state := c.conn.ConnectionState()
+	return Handshake{
+		QUICVersion: state.Version.String(),
+		TLSVersion:  tls.VersionName(state.TLS.Version),
+		ALPN:        state.TLS.NegotiatedProtocol,
+		CipherSuite: tls.CipherSuiteName(state.TLS.CipherSuite),
+		Used0RTT:    state.Used0RTT,
+		Resumed:     state.TLS.DidResume,
+		Datagrams:   state.SupportsDatagrams.Local && state.SupportsDatagrams.Remote,
+	}
+}
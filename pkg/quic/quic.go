@@ -7,8 +7,10 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"math/big"
+	"net"
 	"os"
 	"sync"
 	"time"
@@ -21,6 +23,7 @@ const (
 	keepAlivePeriod           = 30 * time.Second
 	maxIdleTimeout            = 60 * time.Second
 	defaultMaxIncomingStreams = 10000
+	relayedPacketSize         = 1200
 )
 
 var (
@@ -39,16 +42,34 @@ type Server struct {
 // Client represents a QUIC client.
 type Client struct {
 	conn *quic.Conn
+	// streamLimit is the MaxIncomingStreams the connection was set up with.
+	streamLimit int
+	// packetConn is set when the client owns the socket, e.g. a proxy relay.
+	packetConn net.PacketConn
 }
 
+// PacketDialer opens the datagram socket a client sends its QUIC packets
+// through, along with the address packets for addr are written to.
+type PacketDialer func(ctx context.Context, addr string) (net.PacketConn, net.Addr, error)
+
 // NewServer creates a new QUIC server.
 func NewServer(addr string) (*Server, error) {
+	return NewServerWithIdleTimeout(addr, 0)
+}
+
+// NewServerWithIdleTimeout creates a QUIC server that drops connections
+// silent for idleTimeout, e.g. of a crashed client; zero keeps the default
+// of 60s. Peers keep their connection alive at half of it.
+func NewServerWithIdleTimeout(addr string, idleTimeout time.Duration) (*Server, error) {
 	tlsConfig, err := getCachedTLSConfig()
 	if err != nil {
 		return nil, fmt.Errorf("failed to generate TLS config: %w", err)
 	}
 
 	config := generateQuicConfig()
+	if idleTimeout > 0 {
+		config.MaxIdleTimeout = idleTimeout
+	}
 
 	listener, err := quic.ListenAddr(addr, tlsConfig, config)
 	if err != nil {
@@ -62,6 +83,12 @@ func NewServer(addr string) (*Server, error) {
 
 // NewClient creates a new QUIC client.
 func NewClient(addr string) (*Client, error) {
+	return NewClientWithDialer(addr, nil)
+}
+
+// NewClientWithDialer creates a QUIC client whose packets go through the
+// socket returned by dial. A nil dial uses a regular UDP socket.
+func NewClientWithDialer(addr string, dial PacketDialer) (*Client, error) {
 	insecureMode := os.Getenv("GUNNEL_INSECURE") == "true"
 
 	tlsConfig := &tls.Config{
@@ -71,26 +98,56 @@ func NewClient(addr string) (*Client, error) {
 
 	config := generateQuicConfig()
 
-	conn, err := quic.DialAddr(context.Background(), addr, tlsConfig, config)
+	if dial == nil {
+		conn, err := quic.DialAddr(context.Background(), addr, tlsConfig, config)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create QUIC connection: %w", err)
+		}
+		return &Client{conn: conn, streamLimit: int(config.MaxIncomingStreams)}, nil
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig.ServerName = host
+
+	ctx, cancel := context.WithTimeout(context.Background(), handshakeTimeout)
+	defer cancel()
+
+	packetConn, remote, err := dial(ctx, addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open packet connection: %w", err)
+	}
+	if _, direct := packetConn.(*net.UDPConn); !direct {
+		// Relayed packets gain proxy headers; stay at the QUIC minimum size
+		// so they still fit into the proxy's own packets.
+		config.InitialPacketSize = relayedPacketSize
+		config.DisablePathMTUDiscovery = true
+	}
+
+	conn, err := quic.Dial(ctx, packetConn, remote, tlsConfig, config)
 	if err != nil {
+		if cerr := packetConn.Close(); cerr != nil {
+			err = errors.Join(err, cerr)
+		}
 		return nil, fmt.Errorf("failed to create QUIC connection: %w", err)
 	}
 
-	return &Client{
-		conn: conn,
-	}, nil
+	return &Client{conn: conn, packetConn: packetConn, streamLimit: int(config.MaxIncomingStreams)}, nil
 }
 
+// NewClientFromConn wraps a connection accepted by a Server.
 func NewClientFromConn(conn *quic.Conn) *Client {
 	return &Client{
-		conn: conn,
+		conn:        conn,
+		streamLimit: defaultMaxIncomingStreams,
 	}
 }
 
-// Accept accepts a new QUIC connection.
+// Accept blocks until a client completes its handshake, ctx is done or the
+// server is closed. Stalled handshakes are bounded by HandshakeIdleTimeout.
 func (s *Server) Accept(ctx context.Context) (*quic.Conn, error) {
-	ctx, cancel := context.WithTimeout(ctx, handshakeTimeout)
-	defer cancel()
 	return s.listener.Accept(ctx)
 }
 
@@ -115,9 +172,35 @@ func (c *Client) AcceptStream(ctx context.Context) (*quic.Stream, error) {
 	return c.conn.AcceptStream(ctx)
 }
 
+// SendDatagram sends p as an unreliable QUIC datagram. Payloads larger than
+// the path allows fail with a *quic.DatagramTooLargeError.
+func (c *Client) SendDatagram(p []byte) error {
+	return c.conn.SendDatagram(p)
+}
+
+// ReceiveDatagram blocks until a QUIC datagram arrives or ctx is done.
+func (c *Client) ReceiveDatagram(ctx context.Context) ([]byte, error) {
+	return c.conn.ReceiveDatagram(ctx)
+}
+
+// Context is done once the connection is closed, by either side.
+func (c *Client) Context() context.Context {
+	return c.conn.Context()
+}
+
 // Close closes the client connection.
 func (c *Client) Close() error {
-	return c.conn.CloseWithError(0, "")
+	return c.CloseWithError(0, "")
+}
+
+// CloseWithError closes the client connection, telling the peer why with an
+// application error code and reason.
+func (c *Client) CloseWithError(code uint64, reason string) error {
+	err := c.conn.CloseWithError(quic.ApplicationErrorCode(code), reason)
+	if c.packetConn != nil {
+		err = errors.Join(err, c.packetConn.Close())
+	}
+	return err
 }
 
 // GetStreamID returns the stream ID of the client connection.
@@ -125,6 +208,23 @@ func (c *Client) Addr() string {
 	return c.conn.LocalAddr().String()
 }
 
+// LocalAddr returns the local network address of the connection.
+func (c *Client) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+// RemoteAddr returns the network address of the peer.
+func (c *Client) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// StreamLimit returns the maximum number of concurrent bidirectional streams
+// the peer accepts on this connection. Servers and clients advertise the
+// MaxIncomingStreams of the same config, so it is the one this end used.
+func (c *Client) StreamLimit() int {
+	return c.streamLimit
+}
+
 // getCachedTLSConfig returns a cached TLS config, generating it once and reusing for all connections.
 // This significantly reduces startup time by avoiding regenerating certificates on every server start.
 func getCachedTLSConfig() (*tls.Config, error) {
@@ -179,5 +279,6 @@ func generateQuicConfig() *quic.Config {
 		MaxIncomingStreams:    defaultMaxIncomingStreams,
 		MaxIncomingUniStreams: defaultMaxIncomingStreams,
 		Allow0RTT:             true,
+		EnableDatagrams:       true,
 	}
 }
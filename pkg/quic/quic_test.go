@@ -0,0 +1,38 @@
+package quic_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	gunnelquic "github.com/snakeice/gunnel/pkg/quic"
+)
+
+func TestStreamLimitMatchesConfig(t *testing.T) {
+	t.Setenv("GUNNEL_INSECURE", "true")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	srv, err := gunnelquic.NewServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	defer srv.Close()
+
+	client, err := gunnelquic.NewClient(srv.Addr())
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	defer client.Close()
+	if got := client.StreamLimit(); got != gunnelquic.MaxIncomingStreams {
+		t.Errorf("client StreamLimit = %d, want %d", got, gunnelquic.MaxIncomingStreams)
+	}
+
+	conn, err := srv.Accept(ctx)
+	if err != nil {
+		t.Fatalf("accept: %v", err)
+	}
+	if got := gunnelquic.NewClientFromConn(conn).StreamLimit(); got != gunnelquic.MaxIncomingStreams {
+		t.Errorf("server StreamLimit = %d, want %d", got, gunnelquic.MaxIncomingStreams)
+	}
+}
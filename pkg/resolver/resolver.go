@@ -0,0 +1,164 @@
+// Package resolver resolves backend hostnames through configurable DNS
+// servers and static overrides, with an optional cache.
+package resolver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+const dnsPort = "53"
+
+// Config replaces the system resolver for backend hostnames.
+type Config struct {
+	// Servers are DNS servers ("10.0.0.2" or "10.0.0.2:5353") tried in
+	// order; empty uses the system resolver.
+	Servers []string `yaml:"servers"`
+	// Hosts maps hostnames to IP addresses, like /etc/hosts.
+	Hosts map[string]string `yaml:"hosts"`
+	// CacheTTL keeps successful lookups for this long (0 = no cache).
+	CacheTTL time.Duration `yaml:"cache_ttl"`
+}
+
+// Validate reports invalid servers or host overrides.
+func (c *Config) Validate() error {
+	if c == nil {
+		return nil
+	}
+	for _, server := range c.Servers {
+		if _, err := serverAddr(server); err != nil {
+			return err
+		}
+	}
+	for host, ip := range c.Hosts {
+		if net.ParseIP(ip) == nil {
+			return fmt.Errorf("hosts.%s: %q is not an IP address", host, ip)
+		}
+	}
+	if c.CacheTTL < 0 {
+		return errors.New("cache_ttl must not be negative")
+	}
+	return nil
+}
+
+func serverAddr(server string) (string, error) {
+	if ip := net.ParseIP(server); ip != nil {
+		return net.JoinHostPort(server, dnsPort), nil
+	}
+	host, _, err := net.SplitHostPort(server)
+	if err != nil || net.ParseIP(host) == nil {
+		return "", fmt.Errorf("dns server %q must be an IP address with an optional port", server)
+	}
+	return server, nil
+}
+
+// Resolver looks up hostnames. A nil *Resolver leaves addresses to the
+// system resolver.
+type Resolver struct {
+	hosts     map[string]string
+	resolvers []*net.Resolver
+	ttl       time.Duration
+
+	mu    sync.Mutex
+	cache map[string]cacheEntry
+}
+
+type cacheEntry struct {
+	addrs   []string
+	expires time.Time
+}
+
+// New returns a resolver for cfg.
+func New(cfg *Config) (*Resolver, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	r := &Resolver{
+		hosts: cfg.Hosts,
+		ttl:   cfg.CacheTTL,
+		cache: make(map[string]cacheEntry),
+	}
+	for _, server := range cfg.Servers {
+		addr, _ := serverAddr(server)
+		r.resolvers = append(r.resolvers, &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, addr)
+			},
+		})
+	}
+	if len(r.resolvers) == 0 {
+		r.resolvers = []*net.Resolver{net.DefaultResolver}
+	}
+	return r, nil
+}
+
+// LookupHost returns the addresses of host, trying each server in turn.
+func (r *Resolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	if ip, ok := r.hosts[host]; ok {
+		return []string{ip}, nil
+	}
+	if net.ParseIP(host) != nil {
+		return []string{host}, nil
+	}
+	if addrs, ok := r.cached(host, time.Now()); ok {
+		return addrs, nil
+	}
+
+	var errs []error
+	for _, res := range r.resolvers {
+		addrs, err := res.LookupHost(ctx, host)
+		if err == nil {
+			r.store(host, addrs, time.Now())
+			return addrs, nil
+		}
+		errs = append(errs, err)
+	}
+	return nil, errors.Join(errs...)
+}
+
+// ResolveAddr resolves the host of a host:port address. A nil resolver
+// returns addr unchanged.
+func (r *Resolver) ResolveAddr(ctx context.Context, addr string) (string, error) {
+	if r == nil {
+		return addr, nil
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	addrs, err := r.LookupHost(ctx, host)
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(addrs[0], port), nil
+}
+
+func (r *Resolver) cached(host string, now time.Time) ([]string, bool) {
+	if r.ttl == 0 {
+		return nil, false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	entry, ok := r.cache[host]
+	if !ok || now.After(entry.expires) {
+		delete(r.cache, host)
+		return nil, false
+	}
+	return entry.addrs, true
+}
+
+func (r *Resolver) store(host string, addrs []string, now time.Time) {
+	if r.ttl == 0 || len(addrs) == 0 {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cache[host] = cacheEntry{addrs: addrs, expires: now.Add(r.ttl)}
+}
@@ -0,0 +1,109 @@
+package resolver_test
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/snakeice/gunnel/pkg/resolver"
+)
+
+func TestResolveAddrHostsOverride(t *testing.T) {
+	r, err := resolver.New(&resolver.Config{Hosts: map[string]string{"api.internal": "10.0.0.5"}})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	got, err := r.ResolveAddr(context.Background(), "api.internal:8080")
+	if err != nil || got != "10.0.0.5:8080" {
+		t.Errorf("ResolveAddr() = %q, %v; want 10.0.0.5:8080", got, err)
+	}
+
+	var none *resolver.Resolver
+	if got, _ := none.ResolveAddr(context.Background(), "api.internal:8080"); got != "api.internal:8080" {
+		t.Errorf("nil resolver changed the address to %q", got)
+	}
+}
+
+func TestLookupHostUsesServerAndCache(t *testing.T) {
+	server, queries := serveDNS(t, net.IPv4(192, 0, 2, 7))
+	r, err := resolver.New(&resolver.Config{Servers: []string{server}, CacheTTL: time.Minute})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	for range 3 {
+		addrs, err := r.LookupHost(context.Background(), "backend.test")
+		if err != nil || len(addrs) != 1 || addrs[0] != "192.0.2.7" {
+			t.Fatalf("LookupHost() = %v, %v; want [192.0.2.7]", addrs, err)
+		}
+	}
+	// One lookup asks for A and AAAA records; the cache answers the rest.
+	if n := queries.Load(); n > 2 {
+		t.Errorf("server got %d queries, want the cached answer reused", n)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	invalid := []*resolver.Config{
+		{Servers: []string{"dns.example.com"}},
+		{Hosts: map[string]string{"api": "not-an-ip"}},
+		{CacheTTL: -time.Second},
+	}
+	for _, cfg := range invalid {
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("Validate(%+v) accepted an invalid config", cfg)
+		}
+	}
+}
+
+// serveDNS answers A queries with ip and any other query with no records.
+func serveDNS(t *testing.T, ip net.IP) (string, *atomic.Int32) {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket() error = %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+
+	queries := &atomic.Int32{}
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			queries.Add(1)
+			if _, err := conn.WriteTo(dnsAnswer(buf[:n], ip), addr); err != nil {
+				return
+			}
+		}
+	}()
+	return conn.LocalAddr().String(), queries
+}
+
+func dnsAnswer(query []byte, ip net.IP) []byte {
+	const headerLen = 12
+	end := headerLen
+	for query[end] != 0 {
+		end += int(query[end]) + 1
+	}
+	question := query[headerLen : end+5]
+	isA := binary.BigEndian.Uint16(query[end+1:]) == 1
+
+	resp := make([]byte, headerLen, 64)
+	copy(resp, query[:2])
+	binary.BigEndian.PutUint16(resp[2:], 0x8180)
+	binary.BigEndian.PutUint16(resp[4:], 1)
+	resp = append(resp, question...)
+	if isA {
+		binary.BigEndian.PutUint16(resp[6:], 1)
+		resp = append(resp, 0xc0, headerLen, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4)
+		resp = append(resp, ip.To4()...)
+	}
+	return resp
+}
@@ -0,0 +1,256 @@
+// Package schedule parses weekly activity windows such as
+// "mon-fri 09:00-18:00" and evaluates them against a point in time.
+package schedule
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	minutesPerDay = 24 * 60
+	daysPerWeek   = 7
+	tzPrefix      = "TZ="
+)
+
+var (
+	ErrEmpty       = errors.New("schedule has no windows")
+	ErrInvalidDay  = errors.New("invalid day")
+	ErrInvalidTime = errors.New("invalid time")
+)
+
+//nolint:gochecknoglobals // read-only lookup table
+var dayNames = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// Window is active on the given weekdays from Start until End, in minutes
+// after midnight. A window whose End is before its Start runs past midnight
+// into the following day.
+type Window struct {
+	Days  [daysPerWeek]bool
+	Start int
+	End   int
+	spec  string
+}
+
+// Schedule is a set of weekly windows evaluated in Location.
+type Schedule struct {
+	Location *time.Location
+	Windows  []Window
+}
+
+// Parse reads a schedule of the form
+//
+//	[TZ=<zone>;] <days> <HH:MM>-<HH:MM>[; <days> <HH:MM>-<HH:MM>...]
+//
+// where days is "*" or a comma separated list of days and day ranges,
+// e.g. "mon-fri,sun".
+func Parse(spec string) (*Schedule, error) {
+	s := &Schedule{Location: time.UTC}
+
+	for part := range strings.SplitSeq(spec, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		if zone, ok := strings.CutPrefix(part, tzPrefix); ok {
+			loc, err := time.LoadLocation(zone)
+			if err != nil {
+				return nil, fmt.Errorf("invalid timezone %q: %w", zone, err)
+			}
+			s.Location = loc
+			continue
+		}
+
+		w, err := parseWindow(part)
+		if err != nil {
+			return nil, fmt.Errorf("window %q: %w", part, err)
+		}
+		s.Windows = append(s.Windows, w)
+	}
+
+	if len(s.Windows) == 0 {
+		return nil, ErrEmpty
+	}
+
+	return s, nil
+}
+
+func parseWindow(spec string) (Window, error) {
+	w := Window{spec: spec}
+
+	days, hours, ok := strings.Cut(spec, " ")
+	if !ok {
+		return w, fmt.Errorf("%w: expected \"<days> <HH:MM>-<HH:MM>\"", ErrInvalidTime)
+	}
+
+	if err := w.parseDays(strings.ToLower(days)); err != nil {
+		return w, err
+	}
+
+	from, to, ok := strings.Cut(strings.TrimSpace(hours), "-")
+	if !ok {
+		return w, fmt.Errorf("%w: %q", ErrInvalidTime, hours)
+	}
+
+	var err error
+	if w.Start, err = parseClock(from); err != nil {
+		return w, err
+	}
+	if w.End, err = parseClock(to); err != nil {
+		return w, err
+	}
+	if w.Start == w.End {
+		return w, fmt.Errorf("%w: window is empty", ErrInvalidTime)
+	}
+
+	return w, nil
+}
+
+func (w *Window) parseDays(spec string) error {
+	if spec == "*" {
+		for d := range w.Days {
+			w.Days[d] = true
+		}
+		return nil
+	}
+
+	for item := range strings.SplitSeq(spec, ",") {
+		first, last, isRange := strings.Cut(item, "-")
+		from, ok := dayNames[first]
+		if !ok {
+			return fmt.Errorf("%w: %q", ErrInvalidDay, first)
+		}
+		to := from
+		if isRange {
+			if to, ok = dayNames[last]; !ok {
+				return fmt.Errorf("%w: %q", ErrInvalidDay, last)
+			}
+		}
+
+		for d := from; ; d = (d + 1) % daysPerWeek {
+			w.Days[d] = true
+			if d == to {
+				break
+			}
+		}
+	}
+
+	return nil
+}
+
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		if strings.TrimSpace(s) == "24:00" {
+			return minutesPerDay, nil
+		}
+		return 0, fmt.Errorf("%w: %q", ErrInvalidTime, s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// contains reports whether the window covers minute of day on weekday.
+func (w Window) contains(day time.Weekday, minute int) bool {
+	if w.Start < w.End {
+		return w.Days[day] && minute >= w.Start && minute < w.End
+	}
+
+	// Overnight window: the tail after midnight belongs to the previous day.
+	yesterday := (day + daysPerWeek - 1) % daysPerWeek
+	return (w.Days[day] && minute >= w.Start) || (w.Days[yesterday] && minute < w.End)
+}
+
+// Active reports whether t falls inside any window.
+func (s *Schedule) Active(t time.Time) bool {
+	t = t.In(s.Location)
+	minute := t.Hour()*60 + t.Minute()
+
+	for _, w := range s.Windows {
+		if w.contains(t.Weekday(), minute) {
+			return true
+		}
+	}
+	return false
+}
+
+// Next returns the next time at or after t when the schedule is active, with
+// minute precision. It returns the zero time if no window ever opens.
+func (s *Schedule) Next(t time.Time) time.Time {
+	t = t.In(s.Location).Truncate(time.Minute)
+	if s.Active(t) {
+		return t
+	}
+
+	// Inactive at t, so the schedule turns active where a window starts or
+	// where a DST change moves the clocks into a window; try each day of the
+	// coming week for the earliest of those.
+	year, month, day := t.Date()
+	for offset := range daysPerWeek + 1 {
+		midnight := time.Date(year, month, day+offset, 0, 0, 0, 0, s.Location)
+		var candidates []time.Time
+		if _, change := midnight.ZoneBounds(); !change.IsZero() && change.Before(midnight.AddDate(0, 0, 1)) {
+			candidates = append(candidates, change)
+		}
+		for _, w := range s.Windows {
+			if w.Days[midnight.Weekday()] {
+				candidates = append(candidates, wallClock(s.Location, year, month, day+offset, w.Start)...)
+			}
+		}
+
+		var next time.Time
+		for _, at := range candidates {
+			if !at.Before(t) && (next.IsZero() || at.Before(next)) && s.Active(at) {
+				next = at
+			}
+		}
+		if !next.IsZero() {
+			return next
+		}
+	}
+	return time.Time{}
+}
+
+// wallClock returns the instants the clocks of loc show minute of the given
+// day: two when a DST change repeats it and none when it skips it.
+func wallClock(loc *time.Location, year int, month time.Month, day, minute int) []time.Time {
+	wall := time.Date(year, month, day, 0, minute, 0, 0, time.UTC)
+
+	instants := make([]time.Time, 0, 2)
+	for _, ref := range []time.Time{
+		time.Date(year, month, day, 0, 0, 0, 0, loc),
+		time.Date(year, month, day+1, 0, 0, 0, 0, loc),
+	} {
+		_, zoneOffset := ref.Zone()
+		at := wall.Add(-time.Duration(zoneOffset) * time.Second).In(loc)
+		y, m, d := at.Date()
+		hh, mm, _ := at.Clock()
+		if time.Date(y, m, d, hh, mm, 0, 0, time.UTC).Equal(wall) && !slices.ContainsFunc(instants, at.Equal) {
+			instants = append(instants, at)
+		}
+	}
+	return instants
+}
+
+// String returns the schedule in the form accepted by Parse.
+func (s *Schedule) String() string {
+	parts := make([]string, 0, len(s.Windows)+1)
+	if s.Location != time.UTC {
+		parts = append(parts, tzPrefix+s.Location.String())
+	}
+	for _, w := range s.Windows {
+		parts = append(parts, w.spec)
+	}
+	return strings.Join(parts, "; ")
+}
@@ -0,0 +1,106 @@
+package schedule_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/snakeice/gunnel/pkg/schedule"
+)
+
+func TestActive(t *testing.T) {
+	s, err := schedule.Parse("mon-fri 09:00-18:00; sat 22:00-02:00")
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		at   string
+		want bool
+	}{
+		{name: "weekday inside", at: "2026-10-14T10:30:00Z", want: true},
+		{name: "weekday end is exclusive", at: "2026-10-14T18:00:00Z", want: false},
+		{name: "sunday", at: "2026-10-18T10:00:00Z", want: false},
+		{name: "saturday night", at: "2026-10-17T23:00:00Z", want: true},
+		{name: "overnight tail", at: "2026-10-18T01:59:00Z", want: true},
+		{name: "after overnight tail", at: "2026-10-18T02:00:00Z", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			at, _ := time.Parse(time.RFC3339, tt.at)
+			if got := s.Active(at); got != tt.want {
+				t.Errorf("Active(%s) = %v, want %v", tt.at, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNext(t *testing.T) {
+	s, err := schedule.Parse("TZ=UTC; mon 09:00-10:00")
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+
+	from, _ := time.Parse(time.RFC3339, "2026-10-14T12:00:00Z")
+	want, _ := time.Parse(time.RFC3339, "2026-10-19T09:00:00Z")
+	if got := s.Next(from); !got.Equal(want) {
+		t.Errorf("Next = %s, want %s", got, want)
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	invalid := []string{
+		"", "TZ=UTC", "funday 09:00-10:00", "mon 9-10", "mon 10:00-10:00", "TZ=Nowhere/City; * 00:00-01:00",
+	}
+	for _, spec := range invalid {
+		if _, err := schedule.Parse(spec); err == nil {
+			t.Errorf("expected error for %q", spec)
+		}
+	}
+}
+
+// scanNext finds the next active minute by trying every minute of a week.
+func scanNext(s *schedule.Schedule, t time.Time) time.Time {
+	t = t.In(s.Location).Truncate(time.Minute)
+	for range 8 * 24 * 60 {
+		if s.Active(t) {
+			return t
+		}
+		t = t.Add(time.Minute)
+	}
+	return time.Time{}
+}
+
+func TestNextMatchesScan(t *testing.T) {
+	specs := []string{
+		"mon-fri 09:00-18:00; sat 22:00-02:00",
+		"TZ=Europe/Berlin; sun 02:30-03:30; wed 23:00-24:00",
+		"TZ=America/New_York; * 01:30-02:15",
+		"thu 00:00-00:01",
+		"fri 24:00-06:00",
+		"TZ=Australia/Lord_Howe; * 01:45-02:10",
+	}
+	// Cover DST changes in Europe (2026-03-29, 2026-10-25), the US
+	// (2026-03-08, 2026-11-01) and Lord Howe, which shifts by 30 minutes
+	// (2026-04-05, 2026-10-04).
+	starts := []string{
+		"2026-03-06T00:00:00Z", "2026-03-27T12:00:00Z", "2026-10-23T12:00:00Z", "2026-10-30T12:00:00Z",
+		"2026-04-03T12:00:00Z", "2026-10-02T12:00:00Z",
+	}
+
+	for _, spec := range specs {
+		s, err := schedule.Parse(spec)
+		if err != nil {
+			t.Fatalf("parse %q: %v", spec, err)
+		}
+		for _, start := range starts {
+			from, _ := time.Parse(time.RFC3339, start)
+			for at := from; at.Before(from.Add(9 * 24 * time.Hour)); at = at.Add(37 * time.Minute) {
+				if got, want := s.Next(at), scanNext(s, at); !got.Equal(want) {
+					t.Fatalf("%q: Next(%s) = %s, want %s", spec, at, got, want)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package secret
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	awsService   = "secretsmanager"
+	awsAlgorithm = "AWS4-HMAC-SHA256"
+	awsTarget    = "secretsmanager.GetSecretValue"
+	awsJSON      = "application/x-amz-json-1.1"
+)
+
+// AWSSecretsManager reads a JSON secret from AWS Secrets Manager. Credentials
+// come from AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and the optional
+// AWS_SESSION_TOKEN.
+type AWSSecretsManager struct {
+	region   string
+	secretID string
+	endpoint string
+	client   *http.Client
+}
+
+// NewAWSSecretsManager returns a Source for secretID. endpoint overrides the
+// regional endpoint, e.g. for VPC endpoints.
+func NewAWSSecretsManager(region, secretID, endpoint string) *AWSSecretsManager {
+	if endpoint == "" {
+		endpoint = "https://" + awsService + "." + region + ".amazonaws.com"
+	}
+
+	return &AWSSecretsManager{
+		region:   region,
+		secretID: secretID,
+		endpoint: strings.TrimSuffix(endpoint, "/"),
+		client:   &http.Client{Timeout: fetchTimeout},
+	}
+}
+
+func (a *AWSSecretsManager) Fetch(ctx context.Context) (map[string]string, error) {
+	accessKey := os.Getenv("AWS_ACCESS_KEY_ID")
+	secretKey := os.Getenv("AWS_SECRET_ACCESS_KEY")
+	if accessKey == "" || secretKey == "" {
+		return nil, fmt.Errorf("%w: AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY", ErrMissingEnv)
+	}
+
+	body, err := json.Marshal(map[string]string{"SecretId": a.secretID})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.endpoint+"/", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", awsJSON)
+	req.Header.Set("X-Amz-Target", awsTarget)
+	if token := os.Getenv("AWS_SESSION_TOKEN"); token != "" {
+		req.Header.Set("X-Amz-Security-Token", token)
+	}
+	a.sign(req, body, accessKey, secretKey, time.Now().UTC())
+
+	var answer struct {
+		SecretString string `json:"SecretString"`
+	}
+	if err := do(a.client, req, &answer); err != nil {
+		return nil, err
+	}
+
+	var data map[string]any
+	if err := json.Unmarshal([]byte(answer.SecretString), &data); err != nil {
+		return nil, errors.New("secret is not a JSON object")
+	}
+	return stringValues(data), nil
+}
+
+// sign adds an AWS Signature Version 4 to req.
+func (a *AWSSecretsManager) sign(req *http.Request, body []byte, accessKey, secretKey string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+
+	host := req.URL.Host
+	if u, err := url.Parse(a.endpoint); err == nil {
+		host = u.Host
+	}
+
+	headers := map[string]string{
+		"content-type": req.Header.Get("Content-Type"),
+		"host":         host,
+		"x-amz-date":   amzDate,
+		"x-amz-target": req.Header.Get("X-Amz-Target"),
+	}
+	names := []string{"content-type", "host", "x-amz-date"}
+	if token := req.Header.Get("X-Amz-Security-Token"); token != "" {
+		headers["x-amz-security-token"] = token
+		names = append(names, "x-amz-security-token")
+	}
+	names = append(names, "x-amz-target")
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(headers[name]) + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method, "/", "", canonicalHeaders.String(), signedHeaders, hashHex(body),
+	}, "\n")
+
+	scope := day + "/" + a.region + "/" + awsService + "/aws4_request"
+	stringToSign := strings.Join([]string{awsAlgorithm, amzDate, scope, hashHex([]byte(canonicalRequest))}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), day)
+	key = hmacSHA256(key, a.region)
+	key = hmacSHA256(key, awsService)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", awsAlgorithm+" Credential="+accessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hashHex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,139 @@
+// Package secret resolves credentials referenced from configuration files,
+// either as ${ENV_VAR} placeholders or as paths to files holding the value.
+package secret
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	ErrMissingEnv = errors.New("environment variable not set")
+	ErrEmptyFile  = errors.New("secret file is empty")
+	ErrConflict   = errors.New("value and file are mutually exclusive")
+)
+
+// placeholder matches ${NAME}, and $${NAME} which stands for a literal
+// ${NAME}.
+//
+//nolint:gochecknoglobals // compiled once, read-only
+var placeholder = regexp.MustCompile(`\$?\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// ExpandEnv replaces ${NAME} in every string of a decoded YAML document with
+// the value of the environment variable NAME; $${NAME} is left as ${NAME}.
+// Keys are left untouched. All unset variables are reported in a single error.
+func ExpandEnv(doc any) (any, error) {
+	var missing []string
+	expanded := expand(doc, &missing)
+	if err := missingError(missing); err != nil {
+		return nil, err
+	}
+	return expanded, nil
+}
+
+// ExpandNode replaces placeholders in the values of a YAML node tree like
+// ExpandEnv. Plain scalars lose their tag so the expanded value is resolved
+// again: "port: ${PORT}" decodes as a number, while "port: '${PORT}'" stays a
+// string.
+func ExpandNode(node *yaml.Node) error {
+	var missing []string
+	expandNode(node, &missing)
+	return missingError(missing)
+}
+
+func expandNode(node *yaml.Node, missing *[]string) {
+	switch node.Kind { //nolint:exhaustive // aliases point at expanded nodes
+	case yaml.ScalarNode:
+		if !strings.Contains(node.Value, "${") {
+			return
+		}
+		node.Value = expandString(node.Value, missing)
+		if node.Style == 0 {
+			node.Tag = ""
+		}
+	case yaml.MappingNode:
+		for i := 1; i < len(node.Content); i += 2 {
+			expandNode(node.Content[i], missing)
+		}
+	case yaml.DocumentNode, yaml.SequenceNode:
+		for _, child := range node.Content {
+			expandNode(child, missing)
+		}
+	}
+}
+
+func expandString(s string, missing *[]string) string {
+	return placeholder.ReplaceAllStringFunc(s, func(match string) string {
+		if strings.HasPrefix(match, "$$") {
+			return match[1:]
+		}
+		name := match[2 : len(match)-1]
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			*missing = append(*missing, name)
+		}
+		return value
+	})
+}
+
+func missingError(missing []string) error {
+	if len(missing) == 0 {
+		return nil
+	}
+	slices.Sort(missing)
+	return fmt.Errorf("%w: %s", ErrMissingEnv, strings.Join(slices.Compact(missing), ", "))
+}
+
+func expand(node any, missing *[]string) any {
+	switch v := node.(type) {
+	case string:
+		return expandString(v, missing)
+	case map[string]any:
+		for key, value := range v {
+			v[key] = expand(value, missing)
+		}
+	case map[any]any:
+		for key, value := range v {
+			v[key] = expand(value, missing)
+		}
+	case []any:
+		for i, value := range v {
+			v[i] = expand(value, missing)
+		}
+	}
+	return node
+}
+
+// ReadFile returns the content of a secret file without surrounding
+// whitespace, so files written by echo or editors work as is.
+func ReadFile(path string) (string, error) {
+	data, err := os.ReadFile(filepath.Clean(path))
+	if err != nil {
+		return "", err
+	}
+
+	value := strings.TrimSpace(string(data))
+	if value == "" {
+		return "", fmt.Errorf("%w: %s", ErrEmptyFile, path)
+	}
+	return value, nil
+}
+
+// Resolve returns value, or the content of file when one is given. Setting
+// both is rejected so it is never ambiguous which secret is used.
+func Resolve(value, file string) (string, error) {
+	if file == "" {
+		return value, nil
+	}
+	if value != "" {
+		return "", ErrConflict
+	}
+	return ReadFile(file)
+}
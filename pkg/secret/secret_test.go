@@ -0,0 +1,145 @@
+package secret_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/snakeice/gunnel/pkg/secret"
+	"gopkg.in/yaml.v3"
+)
+
+func TestExpandEnv(t *testing.T) {
+	t.Setenv("GUNNEL_TEST_TOKEN", "s3cr#t: value")
+
+	doc := map[string]any{
+		"token":   "${GUNNEL_TEST_TOKEN}",
+		"domain":  "example.com",
+		"price":   "$5",
+		"backend": []any{map[string]any{"host": "db-${GUNNEL_TEST_TOKEN}"}},
+	}
+
+	got, err := secret.ExpandEnv(doc)
+	if err != nil {
+		t.Fatalf("expand failed: %v", err)
+	}
+
+	m, _ := got.(map[string]any)
+	if m["token"] != "s3cr#t: value" {
+		t.Errorf("token = %q", m["token"])
+	}
+	if m["price"] != "$5" {
+		t.Errorf("price = %q, want it unchanged", m["price"])
+	}
+	backend, _ := m["backend"].([]any)
+	host, _ := backend[0].(map[string]any)
+	if host["host"] != "db-s3cr#t: value" {
+		t.Errorf("host = %q", host["host"])
+	}
+}
+
+func TestExpandEnvMissing(t *testing.T) {
+	_, err := secret.ExpandEnv(map[string]any{
+		"a": "${GUNNEL_TEST_UNSET_B}",
+		"b": "${GUNNEL_TEST_UNSET_A}",
+	})
+	if !errors.Is(err, secret.ErrMissingEnv) {
+		t.Fatalf("err = %v, want ErrMissingEnv", err)
+	}
+	if want := "environment variable not set: GUNNEL_TEST_UNSET_A, GUNNEL_TEST_UNSET_B"; err.Error() != want {
+		t.Errorf("err = %q, want %q", err, want)
+	}
+}
+
+func TestResolve(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(path, []byte("from-file\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, err := secret.Resolve("", path); err != nil || got != "from-file" {
+		t.Errorf("Resolve(file) = %q, %v", got, err)
+	}
+	if got, err := secret.Resolve("inline", ""); err != nil || got != "inline" {
+		t.Errorf("Resolve(value) = %q, %v", got, err)
+	}
+	if _, err := secret.Resolve("inline", path); !errors.Is(err, secret.ErrConflict) {
+		t.Errorf("Resolve(both) err = %v, want ErrConflict", err)
+	}
+	if _, err := secret.Resolve("", filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("Resolve(missing file) succeeded")
+	}
+}
+
+func TestVaultFetch(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "root" || r.URL.Path != "/v1/kv/data/gunnel/server" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		_, _ = io.WriteString(w, `{"data":{"data":{"token":"a,b","port":8080},"metadata":{"version":3}}}`)
+	}))
+	defer srv.Close()
+
+	values, err := secret.NewVault(srv.URL, "root", "kv", "/gunnel/server").Fetch(context.Background())
+	if err != nil {
+		t.Fatalf("fetch failed: %v", err)
+	}
+	if values["token"] != "a,b" {
+		t.Errorf("token = %q", values["token"])
+	}
+	if _, ok := values["port"]; ok {
+		t.Error("non-string values should be skipped")
+	}
+
+	if _, err := secret.NewVault(srv.URL, "wrong", "kv", "gunnel/server").Fetch(context.Background()); err == nil {
+		t.Error("fetch with a bad token succeeded")
+	}
+}
+
+func TestExpandNodeResolvesTypes(t *testing.T) {
+	t.Setenv("GUNNEL_TEST_PORT", "3000")
+	t.Setenv("GUNNEL_TEST_BOOL", "true")
+	t.Setenv("GUNNEL_TEST_TTL", "90s")
+
+	var doc yaml.Node
+	err := yaml.Unmarshal([]byte(`
+port: ${GUNNEL_TEST_PORT}
+enabled: ${GUNNEL_TEST_BOOL}
+ttl: ${GUNNEL_TEST_TTL}
+quoted: "${GUNNEL_TEST_PORT}"
+literal: $${GUNNEL_TEST_UNSET}
+`), &doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := secret.ExpandNode(&doc); err != nil {
+		t.Fatalf("expand failed: %v", err)
+	}
+
+	var got struct {
+		Port    uint32        `yaml:"port"`
+		Enabled bool          `yaml:"enabled"`
+		TTL     time.Duration `yaml:"ttl"`
+		Quoted  string        `yaml:"quoted"`
+		Literal string        `yaml:"literal"`
+	}
+	if err := doc.Decode(&got); err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	if got.Port != 3000 || !got.Enabled || got.TTL != 90*time.Second {
+		t.Errorf("typed placeholders decoded as %+v", got)
+	}
+	if got.Quoted != "3000" {
+		t.Errorf("quoted = %q, want the string 3000", got.Quoted)
+	}
+	if got.Literal != "${GUNNEL_TEST_UNSET}" {
+		t.Errorf("literal = %q, want the escaped placeholder", got.Literal)
+	}
+}
@@ -0,0 +1,63 @@
+package secret
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	fetchTimeout = 10 * time.Second
+	maxBodySize  = 1 << 20
+)
+
+// Source fetches a set of named secrets from an external secret store.
+type Source interface {
+	Fetch(ctx context.Context) (map[string]string, error)
+}
+
+// do sends req and decodes the JSON answer into out.
+func do(client *http.Client, req *http.Request, out any) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := resp.Body.Close(); cerr != nil {
+			logrus.WithError(cerr).Debug("Failed to close secret store response")
+		}
+	}()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxBodySize))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("secret store answered %s: %s", resp.Status, truncate(body))
+	}
+	return json.Unmarshal(body, out)
+}
+
+// stringValues keeps the string values of a decoded JSON object.
+func stringValues(data map[string]any) map[string]string {
+	values := make(map[string]string, len(data))
+	for key, value := range data {
+		if s, ok := value.(string); ok {
+			values[key] = s
+		}
+	}
+	return values
+}
+
+func truncate(body []byte) string {
+	const limit = 200
+	if len(body) > limit {
+		return string(body[:limit]) + "..."
+	}
+	return string(body)
+}
@@ -0,0 +1,55 @@
+package secret
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// Vault reads a secret from a HashiCorp Vault KV version 2 engine.
+type Vault struct {
+	address string
+	token   string
+	mount   string
+	path    string
+	client  *http.Client
+}
+
+// NewVault returns a Source for the KV v2 secret at mount/path (mount
+// defaults to "secret").
+func NewVault(address, token, mount, path string) *Vault {
+	if mount == "" {
+		mount = "secret"
+	}
+
+	return &Vault{
+		address: strings.TrimSuffix(address, "/"),
+		token:   token,
+		mount:   strings.Trim(mount, "/"),
+		path:    strings.Trim(path, "/"),
+		client:  &http.Client{Timeout: fetchTimeout},
+	}
+}
+
+func (v *Vault) Fetch(ctx context.Context) (map[string]string, error) {
+	url := v.address + "/v1/" + v.mount + "/data/" + v.path
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", v.token)
+
+	var answer struct {
+		Data struct {
+			Data map[string]any `json:"data"`
+		} `json:"data"`
+	}
+	if err := do(v.client, req, &answer); err != nil {
+		return nil, err
+	}
+	if answer.Data.Data == nil {
+		return nil, errors.New("vault secret has no data")
+	}
+	return stringValues(answer.Data.Data), nil
+}
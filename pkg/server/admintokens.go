@@ -0,0 +1,62 @@
+package server
+
+import (
+	"fmt"
+
+	"github.com/snakeice/gunnel/pkg/secret"
+	"github.com/snakeice/gunnel/pkg/webui"
+)
+
+// AdminTokenConfig is an additional admin API token. Scope is "read" (the
+// default), which only allows the GET endpoints, or "full".
+type AdminTokenConfig struct {
+	Name      string `yaml:"name"`
+	Token     string `yaml:"token"`
+	TokenFile string `yaml:"token_file"`
+	Scope     string `yaml:"scope"`
+}
+
+// validateAdminTokens resolves the token files and checks that every token
+// is named, unique and scoped.
+func (c *Config) validateAdminTokens() error {
+	seen := make(map[string]string)
+	for i := range c.AdminTokens {
+		t := &c.AdminTokens[i]
+		where := fmt.Sprintf("admin_tokens[%d]", i)
+		if t.Name == "" {
+			return fmt.Errorf("%s: name is required", where)
+		}
+
+		token, err := secret.Resolve(t.Token, t.TokenFile)
+		if err != nil {
+			return fmt.Errorf("%s.token_file: %w", where, err)
+		}
+		if token == "" {
+			return fmt.Errorf("%s: token is required", where)
+		}
+		if other, ok := seen[token]; ok || token == c.AdminToken {
+			if !ok {
+				other = "admin_token"
+			}
+			return fmt.Errorf("%s: token already used by %s", where, other)
+		}
+		seen[token] = t.Name
+		t.Token = token
+
+		if t.Scope == "" {
+			t.Scope = string(webui.ScopeRead)
+		}
+		if !webui.AdminScope(t.Scope).Valid() {
+			return fmt.Errorf(`%s: scope must be "read" or "full"`, where)
+		}
+	}
+	return nil
+}
+
+func (c *Config) adminTokens() []webui.AdminToken {
+	tokens := make([]webui.AdminToken, 0, len(c.AdminTokens))
+	for _, t := range c.AdminTokens {
+		tokens = append(tokens, webui.AdminToken{Name: t.Name, Token: t.Token, Scope: webui.AdminScope(t.Scope)})
+	}
+	return tokens
+}
@@ -0,0 +1,62 @@
+package server
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+// loadAuthorizedKeys reads an OpenSSH authorized_keys file. Only ssh-ed25519
+// entries are accepted.
+func loadAuthorizedKeys(path string) ([]ed25519.PublicKey, error) {
+	data, err := os.ReadFile(filepath.Clean(path))
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []ed25519.PublicKey
+	for len(data) > 0 {
+		// ParseAuthorizedKey skips blank lines, comments and malformed
+		// entries; it only fails once no key is left.
+		pub, comment, _, rest, err := ssh.ParseAuthorizedKey(data)
+		if err != nil {
+			break
+		}
+		data = rest
+
+		cryptoPub, ok := pub.(ssh.CryptoPublicKey)
+		if !ok {
+			return nil, fmt.Errorf("%s: unsupported key %q", path, comment)
+		}
+		key, ok := cryptoPub.CryptoPublicKey().(ed25519.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("%s: %s key %q is not supported, use ed25519", path, pub.Type(), comment)
+		}
+		keys = append(keys, key)
+	}
+
+	if len(keys) == 0 {
+		return nil, errors.New("no keys found in " + path)
+	}
+	return keys, nil
+}
+
+// configureAuthorizedKeys enables public key authentication of clients.
+func (s *Server) configureAuthorizedKeys() {
+	if s.config.AuthorizedKeys == "" {
+		return
+	}
+
+	// An unreadable file still enables key authentication with no keys, so
+	// the server keeps rejecting unauthenticated clients.
+	keys, err := loadAuthorizedKeys(s.config.AuthorizedKeys)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to load authorized keys, key based registrations will be rejected")
+	}
+	s.connManager.SetAuthorizedKeys(keys)
+}
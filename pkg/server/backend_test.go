@@ -0,0 +1,72 @@
+package server_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/snakeice/gunnel/pkg/client"
+)
+
+// serveBackend starts handler as a backend and returns its port.
+func serveBackend(t *testing.T, handler http.HandlerFunc) uint32 {
+	t.Helper()
+	backend := httptest.NewServer(handler)
+	t.Cleanup(backend.Close)
+	u, err := url.Parse(backend.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, err := strconv.ParseUint(u.Port(), 10, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return uint32(port)
+}
+
+func TestBackendTimeoutOpensCircuit(t *testing.T) {
+	var fast atomic.Int64
+	port := serveBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(5 * time.Second):
+			}
+			return
+		}
+		fast.Add(1)
+		_, _ = w.Write([]byte("ok"))
+	})
+
+	tun := startTunnelWith(t, "", &client.BackendConfig{
+		Host: "127.0.0.1", Port: port, Subdomain: "demo", Protocol: "http",
+		Timeout:        200 * time.Millisecond,
+		CircuitBreaker: &client.CircuitBreakerConfig{Failures: 2, Cooldown: time.Hour},
+	})
+
+	if resp := tun.do(t, http.MethodGet, "demo.localhost", "/fast", "", ""); resp.StatusCode != http.StatusOK {
+		t.Fatalf("request answered in time = %d, want 200", resp.StatusCode)
+	}
+	for range 2 {
+		start := time.Now()
+		resp := tun.do(t, http.MethodGet, "demo.localhost", "/slow", "", "")
+		if resp.StatusCode != http.StatusGatewayTimeout {
+			t.Fatalf("request to a hanging backend = %d, want 504", resp.StatusCode)
+		}
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Fatalf("request to a hanging backend took %s, want about the 200ms timeout", elapsed)
+		}
+	}
+
+	resp := tun.do(t, http.MethodGet, "demo.localhost", "/fast", "", "")
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("request with the circuit open = %d, want 503", resp.StatusCode)
+	}
+	if got := fast.Load(); got != 1 {
+		t.Errorf("backend served %d fast requests, want 1 with the circuit open", got)
+	}
+}
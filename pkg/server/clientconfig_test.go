@@ -0,0 +1,59 @@
+package server_test
+
+import (
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/snakeice/gunnel/pkg/client"
+	"github.com/snakeice/gunnel/pkg/protocol"
+)
+
+// waitNotice waits until c received a notice with message.
+func waitNotice(t *testing.T, c *client.Client, message string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if slices.ContainsFunc(c.Notices(), func(n protocol.Broadcast) bool { return n.Message == message }) {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("client did not receive the notice %q, got %+v", message, c.Notices())
+}
+
+func TestAdminAPIPushesClientConfig(t *testing.T) {
+	tun := startTunnel(t, "admin_token: adm\n", 1)
+
+	resp := tun.do(t, http.MethodPut, "gunnel.localhost", "/api/admin/client-config", "adm",
+		`{"notice":"maintenance at noon","features":{"beta":true}}`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("PUT client-config = %d", resp.StatusCode)
+	}
+
+	waitNotice(t, tun.client, "maintenance at noon")
+	if !tun.client.Feature("beta") {
+		t.Error("expected the pushed feature flag to be enabled")
+	}
+}
+
+func TestReloadPushesClientConfig(t *testing.T) {
+	tun := startTunnel(t, "client_config:\n  notice: first\n", 1)
+	waitNotice(t, tun.client, "first")
+
+	data, err := os.ReadFile(tun.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data = []byte(strings.Replace(string(data), "notice: first", "notice: second", 1))
+	if err := os.WriteFile(tun.path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := tun.srv.ReloadClientConfig(); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	waitNotice(t, tun.client, "second")
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+	"github.com/snakeice/gunnel/pkg/manager"
+	"github.com/snakeice/gunnel/pkg/secret"
+)
+
+// ClientTokenConfig is a registration token limited to subdomain patterns
+// and a number of tunnels, like the client tokens of the admin API. The token
+// is given as is, from a file or as its hex SHA-256.
+type ClientTokenConfig struct {
+	Name        string   `yaml:"name"`
+	Token       string   `yaml:"token"`
+	TokenFile   string   `yaml:"token_file"`
+	TokenSHA256 string   `yaml:"token_sha256"`
+	Subdomains  []string `yaml:"subdomains"`
+	MaxTunnels  int      `yaml:"max_tunnels"`
+}
+
+// validateClientTokens resolves the token files and checks that every token
+// is named, unique and valid, keeping only its hash.
+func (c *Config) validateClientTokens() error {
+	names := make(map[string]bool)
+	hashes := make(map[string]string)
+	for i := range c.ClientTokens {
+		t := &c.ClientTokens[i]
+		where := fmt.Sprintf("client_tokens[%d]", i)
+		if names[t.Name] {
+			return fmt.Errorf("%s: name %q is used twice", where, t.Name)
+		}
+		names[t.Name] = true
+
+		token, err := secret.Resolve(t.Token, t.TokenFile)
+		if err != nil {
+			return fmt.Errorf("%s.token_file: %w", where, err)
+		}
+		switch {
+		case token != "" && t.TokenSHA256 != "":
+			return fmt.Errorf("%s: set either token or token_sha256", where)
+		case token != "" && token == c.Token:
+			return fmt.Errorf("%s: token is the shared token, whose clients are not limited", where)
+		case token != "":
+			sum := sha256.Sum256([]byte(token))
+			t.TokenSHA256 = hex.EncodeToString(sum[:])
+		case t.TokenSHA256 == "":
+			return fmt.Errorf("%s: token is required", where)
+		}
+		t.Token, t.TokenFile = "", ""
+
+		spec := t.spec()
+		if err := manager.ValidateClientToken(t.Name, &spec); err != nil {
+			return fmt.Errorf("%s: %w", where, err)
+		}
+		t.TokenSHA256 = spec.TokenHash
+		if other, ok := hashes[t.TokenSHA256]; ok {
+			return fmt.Errorf("%s: token already used by %s", where, other)
+		}
+		hashes[t.TokenSHA256] = t.Name
+	}
+	return nil
+}
+
+func (t *ClientTokenConfig) spec() manager.ClientTokenSpec {
+	return manager.ClientTokenSpec{
+		Subdomains: t.Subdomains,
+		MaxTunnels: t.MaxTunnels,
+		TokenHash:  t.TokenSHA256,
+	}
+}
+
+// applyClientTokens puts the client tokens of the config into the registry,
+// over tokens of the same name created through the admin API.
+func (s *Server) applyClientTokens() error {
+	for _, t := range s.config.ClientTokens {
+		_, _, created, err := s.connManager.PutClientToken(t.Name, t.spec())
+		if err != nil {
+			return fmt.Errorf("client token %q: %w", t.Name, err)
+		}
+		logrus.WithFields(logrus.Fields{
+			"token":   t.Name,
+			"created": created,
+		}).Debug("Applied client token from config")
+	}
+	return nil
+}
@@ -2,11 +2,27 @@ package server
 
 import (
 	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	yaml "github.com/goccy/go-yaml"
 	"github.com/sirupsen/logrus"
+	"github.com/snakeice/gunnel/pkg/clientip"
+	"github.com/snakeice/gunnel/pkg/manager"
+	"github.com/snakeice/gunnel/pkg/secret"
+	"github.com/snakeice/gunnel/pkg/sockopt"
+	"github.com/snakeice/gunnel/pkg/store"
+	"github.com/snakeice/gunnel/pkg/transport"
+	"golang.org/x/net/http/httpguts"
+	yamlv3 "gopkg.in/yaml.v3"
 )
 
 // Config represents the configuration for the client.
@@ -16,10 +32,360 @@ import (
 type Config struct {
 	Domain     string            `yaml:"domain"`
 	Token      string            `yaml:"token"`
+	AdminToken string            `yaml:"admin_token"` // enables the admin API on the gunnel subdomain
 	ServerPort int               `yaml:"server_port"`
 	QuicPort   int               `yaml:"quic_port"`
 	Cert       *CertConfig       `yaml:"cert"`
 	Limits     *ConnectionLimits `yaml:"limits"`
+	// TokenFile and AdminTokenFile read the tokens from files instead.
+	TokenFile      string `yaml:"token_file"`
+	AdminTokenFile string `yaml:"admin_token_file"`
+	// AdminTokens are additional admin API tokens, e.g. read-only ones for
+	// monitoring.
+	AdminTokens []AdminTokenConfig `yaml:"admin_tokens"`
+	// ClientTokens are registration tokens limited to subdomain patterns and
+	// a tunnel quota, applied at startup next to those of the admin API.
+	ClientTokens []ClientTokenConfig `yaml:"client_tokens"`
+	// BindAddress limits the HTTP and QUIC listeners to one local IP;
+	// QuicBindAddress overrides it for QUIC (empty = all addresses).
+	BindAddress     string `yaml:"bind_address"`
+	QuicBindAddress string `yaml:"quic_bind_address"`
+	// ManagementPort serves /healthz and /readyz for orchestrator probes on
+	// BindAddress (0 = disabled).
+	ManagementPort int `yaml:"management_port"`
+	// MetricsAddress serves /metrics on a listener of its own, e.g.
+	// 127.0.0.1:9100, instead of on the gunnel subdomain.
+	MetricsAddress string `yaml:"metrics_address"`
+	// ProxyProtocol requires a PROXY protocol v1/v2 header on every HTTP
+	// connection, as sent by L4 load balancers, and uses its client address.
+	ProxyProtocol bool `yaml:"proxy_protocol"`
+	// ProxyProtocolTrusted lists the CIDRs of the balancers allowed to send
+	// the header; connections from others are closed. Empty trusts every peer.
+	ProxyProtocolTrusted []string `yaml:"proxy_protocol_trusted"`
+	// TrustedProxies lists the CIDRs (e.g. a CDN's ranges) allowed to report
+	// the client address via X-Forwarded-For/X-Real-IP; others are ignored.
+	TrustedProxies []string `yaml:"trusted_proxies"`
+	// Secrets fetches credentials from Vault or AWS Secrets Manager.
+	Secrets *SecretsConfig `yaml:"secrets"`
+	// AuthorizedKeys is an OpenSSH authorized_keys file; clients holding one
+	// of its ed25519 keys may register without the shared token.
+	AuthorizedKeys string `yaml:"authorized_keys"`
+	// User and Group (names or ids) are switched to once the listeners are
+	// bound; Group defaults to the user's primary group. TCP and UDP tunnel
+	// ports are bound later, so tcp_ports must then stay above 1023.
+	User  string `yaml:"user"`
+	Group string `yaml:"group"`
+	// AllowRoot lets the server keep running as root (--allow-root).
+	AllowRoot bool `yaml:"-"`
+	// Sandbox restricts files and system calls once the listeners are bound.
+	Sandbox *SandboxConfig `yaml:"sandbox"`
+	// TunnelsFile persists the named tunnels created through the admin API;
+	// without it they are lost on restart.
+	TunnelsFile string `yaml:"tunnels_file"`
+	// TokensFile persists the client tokens managed through the admin API;
+	// without it they are lost on restart.
+	TokensFile string `yaml:"tokens_file"`
+	// StatsD also reports metrics to a StatsD or DogStatsD agent.
+	StatsD *StatsDConfig `yaml:"statsd"`
+	// UsageFile persists the per-tenant usage aggregates served by the admin
+	// usage report; without it they are kept in memory only.
+	UsageFile string `yaml:"usage_file"`
+	// UsageRetention is how long daily usage aggregates are kept (400 days
+	// by default).
+	UsageRetention time.Duration `yaml:"usage_retention"`
+	// UptimeFile persists the tunnel state changes behind uptime reports;
+	// UptimeRetention is how long they are kept (30 days by default).
+	UptimeFile      string        `yaml:"uptime_file"`
+	UptimeRetention time.Duration `yaml:"uptime_retention"`
+	// HistoryFile persists the per-minute traffic of tunnels charted by the
+	// WebUI; HistoryRetention is how long it is kept (24h by default).
+	HistoryFile      string        `yaml:"history_file"`
+	HistoryRetention time.Duration `yaml:"history_retention"`
+	// Storage keeps named tunnels, usage, uptime and traffic history, and
+	// persisted inspector captures, in one store (a directory, Redis, bolt,
+	// sqlite or memory) instead of the *_file options.
+	Storage *store.Config `yaml:"storage"`
+	// StatusPage serves a read-only status page at status.<domain> listing
+	// the tunnels whose clients set public_status.
+	StatusPage bool `yaml:"status_page"`
+	// Teams lets groups of client tokens share their tunnels in the WebUI.
+	Teams map[string]*TeamConfig `yaml:"teams"`
+	// ClientConfig is pushed to every client after it registers, and again
+	// to the connected ones when it changes on SIGHUP.
+	ClientConfig *ClientConfig `yaml:"client_config"`
+	// ForwardAuth verifies each proxied request against an external endpoint.
+	ForwardAuth *ForwardAuthConfig `yaml:"forward_auth"`
+	// JWT requires a valid token on the listed subdomains; it overrides any
+	// policy a client sends at registration.
+	JWT map[string]*JWTConfig `yaml:"jwt"`
+	// MTLS requires client certificates on the listed subdomains.
+	MTLS map[string]*MTLSConfig `yaml:"mtls"`
+	// NotFound selects how requests for unknown subdomains are answered.
+	NotFound *NotFoundConfig `yaml:"not_found"`
+	// Socket tunes the TCP connections accepted by the public HTTP listener.
+	Socket *sockopt.Options `yaml:"socket"`
+	// ResponseHeaders sets headers on the responses of the listed subdomains
+	// ("*" for every tunnel), overriding the backend's.
+	ResponseHeaders map[string]map[string]string `yaml:"response_headers"`
+	// BodyRewrites replaces text in the HTML and JSON responses of the listed
+	// subdomains, e.g. localhost links in a demo.
+	BodyRewrites map[string][]BodyRewriteConfig `yaml:"body_rewrites"`
+	// Inspector keeps the recent HTTP exchanges of every tunnel, bodies
+	// included, for the inspector of the web UI.
+	Inspector *InspectorConfig `yaml:"inspector"`
+	// RequestLogs samples and redacts the request log of the listed
+	// subdomains, or of all tunnels under "*".
+	RequestLogs map[string]*RequestLogConfig `yaml:"request_logs"`
+	// PathRouting also serves tunnels under a path of the domain, for setups
+	// without wildcard DNS.
+	PathRouting *PathRoutingConfig `yaml:"path_routing"`
+	// Uploads enables the file drop endpoint of the listed subdomains.
+	Uploads map[string]*UploadConfig `yaml:"uploads"`
+	// Hedging re-sends slow GET, HEAD and OPTIONS requests on a second stream.
+	Hedging *HedgingConfig `yaml:"hedging"`
+	// HTTP sets the timeouts of the public HTTP server and how many slow
+	// requests one IP may hold open.
+	HTTP *HTTPServerConfig `yaml:"http"`
+	// TCPPorts is the range TCP and UDP tunnels take their public port from;
+	// without it the OS picks any free port.
+	TCPPorts *TCPPortsConfig `yaml:"tcp_ports"`
+	// TCPLimits caps the connections each IP opens to TCP tunnel ports.
+	TCPLimits *TCPLimitsConfig `yaml:"tcp_limits"`
+	// StreamPool sizes the idle streams kept per client connection for new
+	// requests.
+	StreamPool *StreamPoolConfig `yaml:"stream_pool"`
+	// StreamKeepAlive pings clients over the streams of TCP connections and
+	// WebSockets, resetting those that stop answering.
+	StreamKeepAlive *StreamKeepAliveConfig `yaml:"stream_keepalive"`
+	// ClientIdleTimeout is how long a client connection may stay silent
+	// before it is considered dead, e.g. after a crash, and its tunnels are
+	// freed (60s by default). Clients ping at half of it.
+	ClientIdleTimeout time.Duration `yaml:"client_idle_timeout"`
+	// DownloadsDir offers the client archives of a release, e.g. its dist
+	// directory, for download from the WebUI.
+	DownloadsDir string `yaml:"downloads_dir"`
+
+	// path is the file LoadConfig read, re-read on SIGHUP.
+	path string
+}
+
+// TCPPortsConfig is an inclusive range of public ports for TCP and UDP tunnels.
+type TCPPortsConfig struct {
+	Min int `yaml:"min"`
+	Max int `yaml:"max"`
+}
+
+// contains reports whether port falls in the range.
+func (c *TCPPortsConfig) contains(port int) bool {
+	return c != nil && port >= c.Min && port <= c.Max
+}
+
+// TCPLimitsConfig caps the connections one source IP may open to the public
+// ports of TCP tunnels, over all of them (0 = unlimited).
+type TCPLimitsConfig struct {
+	MaxConnectionsPerIP  int `yaml:"max_connections_per_ip"`
+	ConnectionsPerMinute int `yaml:"connections_per_minute"`
+	// BanAfter bans an IP for BanDuration once this many of its connections
+	// were refused within a minute (0 = never).
+	BanAfter    int           `yaml:"ban_after"`
+	BanDuration time.Duration `yaml:"ban_duration"`
+}
+
+func (c *TCPLimitsConfig) validate() error {
+	if c == nil {
+		return nil
+	}
+	if c.MaxConnectionsPerIP < 0 || c.ConnectionsPerMinute < 0 || c.BanAfter < 0 || c.BanDuration < 0 {
+		return errors.New("limits must not be negative")
+	}
+	if c.BanAfter > 0 && c.BanDuration == 0 {
+		return errors.New("ban_after needs ban_duration")
+	}
+	return nil
+}
+
+// maxStreamPoolIdle is the idle time after which clients close a stream.
+const maxStreamPoolIdle = 30 * time.Second
+
+// StreamPoolConfig sizes the pool of idle streams each client connection
+// hands out to new requests, saving a stream setup per request.
+type StreamPoolConfig struct {
+	// MaxIdle bounds the idle streams per connection (default 50, negative
+	// disables the pool).
+	MaxIdle int `yaml:"max_idle"`
+	// IdleTimeout closes streams idle this long (default 20s).
+	IdleTimeout time.Duration `yaml:"idle_timeout"`
+}
+
+func (c *StreamPoolConfig) validate() error {
+	if c == nil {
+		return nil
+	}
+	if c.IdleTimeout < 0 || c.IdleTimeout >= maxStreamPoolIdle {
+		return fmt.Errorf("idle_timeout must be below %s, when clients close idle streams", maxStreamPoolIdle)
+	}
+	return nil
+}
+
+func (c *StreamPoolConfig) poolConfig() transport.PoolConfig {
+	cfg := transport.DefaultPoolConfig()
+	if c == nil {
+		return cfg
+	}
+	switch {
+	case c.MaxIdle < 0:
+		cfg.Enabled = false
+	case c.MaxIdle > 0:
+		cfg.MaxIdle = c.MaxIdle
+	}
+	if c.IdleTimeout > 0 {
+		cfg.IdleTimeout = c.IdleTimeout
+	}
+	return cfg
+}
+
+// minClientIdleTimeout keeps client connections from being dropped over a
+// few lost keepalives.
+const minClientIdleTimeout = 5 * time.Second
+
+// StreamKeepAliveConfig pings the client over each raw stream every Interval
+// and resets streams silent for Timeout (three intervals by default).
+type StreamKeepAliveConfig struct {
+	Interval time.Duration `yaml:"interval"`
+	Timeout  time.Duration `yaml:"timeout"`
+}
+
+func (c *StreamKeepAliveConfig) validate() error {
+	if c == nil {
+		return nil
+	}
+	if c.Interval < time.Second {
+		return errors.New("interval must be at least 1s")
+	}
+	if c.Timeout != 0 && c.Timeout <= c.Interval {
+		return errors.New("timeout must be longer than interval")
+	}
+	return nil
+}
+
+// HedgingConfig sends a second attempt of idempotent requests unanswered
+// after Delay. Budget is the share of requests per tunnel that may be hedged
+// (0.1 by default).
+type HedgingConfig struct {
+	Delay  time.Duration `yaml:"delay"`
+	Budget float64       `yaml:"budget"`
+}
+
+// UploadConfig lets holders of Token send files to a tunnel at
+// /_gunnel/upload; each file is streamed to the backend as a POST to Target
+// ("/" by default). MaxSize limits uploads in bytes; zero means no limit.
+type UploadConfig struct {
+	Token     string `yaml:"token"`
+	TokenFile string `yaml:"token_file"`
+	Target    string `yaml:"target"`
+	MaxSize   int64  `yaml:"max_size"`
+}
+
+func (u *UploadConfig) endpoint() *manager.UploadEndpoint {
+	return &manager.UploadEndpoint{Token: u.Token, Target: u.Target, MaxBytes: u.MaxSize}
+}
+
+// PathRoutingConfig mounts tunnels at https://domain<prefix><name>/ (prefix
+// "/t/" by default). RewriteBase adds a <base href> to HTML pages so their
+// relative links resolve under the mount path.
+type PathRoutingConfig struct {
+	Enabled     bool   `yaml:"enabled"`
+	Prefix      string `yaml:"prefix"`
+	RewriteBase bool   `yaml:"rewrite_base"`
+}
+
+func (p *PathRoutingConfig) enabled() bool {
+	return p != nil && p.Enabled
+}
+
+// BodyRewriteConfig replaces Match, a literal or a regular expression, with
+// Replace, which may contain {public_url} and {subdomain}.
+type BodyRewriteConfig struct {
+	Match   string `yaml:"match"`
+	Replace string `yaml:"replace"`
+	Regex   bool   `yaml:"regex"`
+}
+
+// InspectorConfig sets how many exchanges are kept per tunnel and how many
+// bytes of each body (0 = defaults, 50 and 16KB), and the headers whose
+// values are masked (default: the credential headers). Persist saves the
+// exchanges in storage so they survive a restart; captured bodies often
+// carry secrets, so it needs storage with encryption_keys.
+type InspectorConfig struct {
+	Requests      int      `yaml:"requests"`
+	MaxBody       int      `yaml:"max_body"`
+	RedactHeaders []string `yaml:"redact_headers"`
+	Persist       bool     `yaml:"persist"`
+}
+
+// RequestLogConfig logs one in SampleRate successful requests, and every
+// failed one, with the values of the query parameters matching RedactQuery
+// masked.
+type RequestLogConfig struct {
+	SampleRate  int      `yaml:"sample_rate"`
+	RedactQuery []string `yaml:"redact_query"`
+}
+
+func (c *RequestLogConfig) policy() *manager.RequestLogPolicy {
+	if c == nil {
+		return nil
+	}
+	return &manager.RequestLogPolicy{SampleRate: c.SampleRate, RedactQuery: c.RedactQuery}
+}
+
+func rewriteRules(list []BodyRewriteConfig) []manager.RewriteRule {
+	rules := make([]manager.RewriteRule, 0, len(list))
+	for _, r := range list {
+		rules = append(rules, manager.RewriteRule{Match: r.Match, Replace: r.Replace, Regex: r.Regex})
+	}
+	return rules
+}
+
+// NotFoundConfig answers unknown subdomains with a generic 404 page (page,
+// the default), a redirect to URL (redirect) or the backend at URL (proxy).
+type NotFoundConfig struct {
+	Mode string `yaml:"mode"`
+	URL  string `yaml:"url"`
+}
+
+// JWTConfig describes how bearer tokens are validated for a tunnel.
+type JWTConfig struct {
+	Issuer       string            `yaml:"issuer"`
+	Audience     string            `yaml:"audience"`
+	JWKSURL      string            `yaml:"jwks_url"`
+	ClaimHeaders map[string]string `yaml:"claim_headers"`
+}
+
+// ForwardAuthConfig configures the external verification endpoint. A 2xx
+// answer lets the request through; anything else is returned to the user.
+type ForwardAuthConfig struct {
+	Address             string        `yaml:"address"`
+	AuthResponseHeaders []string      `yaml:"auth_response_headers"`
+	Timeout             time.Duration `yaml:"timeout"`
+}
+
+// StatsDConfig configures the StatsD emitter. Metrics of a tunnel are tagged
+// with its subdomain and token (the usage tenant, never the secret itself).
+type StatsDConfig struct {
+	Address string            `yaml:"address"`
+	Prefix  string            `yaml:"prefix"`
+	Flavor  string            `yaml:"flavor"` // dogstatsd (default), telegraf or statsd
+	Tags    map[string]string `yaml:"tags"`
+	// FlushInterval is how often buffered metrics are sent (default 1s).
+	FlushInterval time.Duration `yaml:"flush_interval"`
+}
+
+// ClientConfig holds settings the server pushes to clients at runtime.
+type ClientConfig struct {
+	HeartbeatInterval time.Duration   `yaml:"heartbeat_interval"`
+	RateLimit         uint32          `yaml:"rate_limit"`
+	Features          map[string]bool `yaml:"features"`
+	Notice            string          `yaml:"notice"`
 }
 
 type CertConfig struct {
@@ -36,6 +402,34 @@ type ConnectionLimits struct {
 	MaxConnectionsPerIP int `yaml:"max_connections_per_ip"`
 	// ConnectionRateLimit is the max new connections per minute per IP (0 = unlimited)
 	ConnectionRateLimit int `yaml:"connection_rate_limit"`
+	// MaxConnectionLifetime asks clients to move to a new connection once one
+	// has been open this long (0 = unlimited)
+	MaxConnectionLifetime time.Duration `yaml:"max_connection_lifetime"`
+	// RotationGrace is how long a rotated connection stays open while its
+	// client reconnects (default 1m)
+	RotationGrace time.Duration `yaml:"rotation_grace"`
+	// MaxStreams is the maximum number of requests and TCP connections
+	// proxied at once; more are answered 503 (0 = unlimited)
+	MaxStreams int64 `yaml:"max_streams"`
+	// MaxBufferedBytes bounds the response bodies buffered for rewriting;
+	// new requests are answered 503 past 90% of it (0 = unlimited)
+	MaxBufferedBytes int64 `yaml:"max_buffered_bytes"`
+	// MaxCapturedRequests bounds the requests to unknown subdomains kept for
+	// the honeypot report (0 = unlimited)
+	MaxCapturedRequests int `yaml:"max_captured_requests"`
+	// MaxMessageSize bounds the payload of a protocol message; a peer
+	// announcing a larger one gets an error and its stream is closed
+	// (default 1MB)
+	MaxMessageSize int64 `yaml:"max_message_size"`
+}
+
+// maxMessageSize is the MaxMessageSize given to transports, 0 for the
+// default.
+func (l *ConnectionLimits) maxMessageSize() uint32 {
+	if l == nil {
+		return 0
+	}
+	return uint32(l.MaxMessageSize) //nolint:gosec // G115: validated
 }
 
 func DefaultConfig() *Config {
@@ -57,6 +451,17 @@ func DefaultConfig() *Config {
 }
 
 func (c *Config) LoadConfig(configPath string) error {
+	if err := c.decodeFile(configPath); err != nil {
+		return err
+	}
+	c.path = filepath.Clean(configPath)
+
+	return c.Validate()
+}
+
+// decodeFile decodes the config file at configPath into c without
+// validating it.
+func (c *Config) decodeFile(configPath string) error {
 	// Clean the path to prevent directory traversal
 	configPath = filepath.Clean(configPath)
 
@@ -70,18 +475,279 @@ func (c *Config) LoadConfig(configPath string) error {
 		}
 	}()
 
-	err = yaml.NewDecoder(file).Decode(c)
+	return c.decodeExpanded(file)
+}
+
+// decodeExpanded decodes the YAML in r into c after replacing ${ENV}
+// placeholders in its values.
+func (c *Config) decodeExpanded(r io.Reader) error {
+	var doc yamlv3.Node
+	if err := yamlv3.NewDecoder(r).Decode(&doc); err != nil {
+		return err
+	}
+	if err := secret.ExpandNode(&doc); err != nil {
+		return err
+	}
+
+	// The expanded tree is printed again so the values are decoded the
+	// same way as a config without placeholders.
+	data, err := yamlv3.Marshal(&doc)
 	if err != nil {
 		return err
 	}
+	return yaml.Unmarshal(data, c)
+}
 
-	return c.validate()
+func isHTTPURL(raw string) bool {
+	u, err := url.Parse(raw)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
 }
 
-func (c *Config) validate() error {
+// Validate checks the config and resolves its secrets. LoadConfig calls it;
+// configs built in code must call it before NewServer.
+func (c *Config) Validate() error {
 	if c.Domain == "" {
 		return errors.New("domain is required")
 	}
 
+	if err := c.resolveSecrets(); err != nil {
+		return err
+	}
+
+	if c.MetricsAddress != "" {
+		if _, _, err := net.SplitHostPort(c.MetricsAddress); err != nil {
+			return fmt.Errorf("metrics_address: %w", err)
+		}
+	}
+
+	for name, addr := range map[string]string{"bind_address": c.BindAddress, "quic_bind_address": c.QuicBindAddress} {
+		if addr != "" && net.ParseIP(addr) == nil {
+			return fmt.Errorf("%s must be an IP address", name)
+		}
+	}
+
+	for subdomain, headers := range c.ResponseHeaders {
+		for name, value := range headers {
+			if !httpguts.ValidHeaderFieldName(name) || !httpguts.ValidHeaderFieldValue(value) {
+				return fmt.Errorf("response_headers.%s: invalid header %q", subdomain, name)
+			}
+		}
+	}
+
+	for subdomain, list := range c.BodyRewrites {
+		if err := manager.ValidateRewriteRules(rewriteRules(list)); err != nil {
+			return fmt.Errorf("body_rewrites.%s: %w", subdomain, err)
+		}
+	}
+
+	if i := c.Inspector; i != nil && (i.Requests < 0 || i.MaxBody < 0) {
+		return errors.New("inspector.requests and inspector.max_body must not be negative")
+	}
+	if i := c.Inspector; i != nil && i.Persist && (c.Storage == nil || len(c.Storage.EncryptionKeys) == 0) {
+		return errors.New("inspector.persist needs storage with encryption_keys")
+	}
+
+	for subdomain, logs := range c.RequestLogs {
+		if policy := logs.policy(); policy != nil {
+			if err := manager.ValidateRequestLogPolicy(policy); err != nil {
+				return fmt.Errorf("request_logs.%s: %w", subdomain, err)
+			}
+		}
+	}
+
+	if pr := c.PathRouting; pr.enabled() && strings.ContainsAny(pr.Prefix, "?#") {
+		return errors.New("path_routing.prefix must be a plain path")
+	}
+
+	if c.UptimeRetention < 0 || c.HistoryRetention < 0 || c.UsageRetention < 0 {
+		return errors.New("usage_retention, uptime_retention and history_retention must not be negative")
+	}
+
+	if err := c.validateStorage(); err != nil {
+		return fmt.Errorf("storage: %w", err)
+	}
+
+	if c.Group != "" && c.User == "" {
+		return errors.New("group needs user")
+	}
+
+	if p := c.TCPPorts; p != nil {
+		if p.Min < 1 || p.Max > 65535 || p.Min > p.Max {
+			return errors.New("tcp_ports needs 1 <= min <= max <= 65535")
+		}
+		if p.contains(c.ServerPort) || p.contains(c.ManagementPort) {
+			return errors.New("tcp_ports must not include server_port or management_port")
+		}
+		// Tunnel ports are bound at registration, after privileges are
+		// dropped, so an unprivileged user cannot take the low ones.
+		if c.User != "" && p.Min < minUnprivilegedPort {
+			return fmt.Errorf("tcp_ports.min must be at least %d when user is set", minUnprivilegedPort)
+		}
+	}
+
+	if err := c.TCPLimits.validate(); err != nil {
+		return fmt.Errorf("tcp_limits: %w", err)
+	}
+
+	if err := c.StreamPool.validate(); err != nil {
+		return fmt.Errorf("stream_pool: %w", err)
+	}
+
+	if err := c.StreamKeepAlive.validate(); err != nil {
+		return fmt.Errorf("stream_keepalive: %w", err)
+	}
+
+	if c.ClientIdleTimeout != 0 && c.ClientIdleTimeout < minClientIdleTimeout {
+		return fmt.Errorf("client_idle_timeout must be at least %v", minClientIdleTimeout)
+	}
+
+	if c.DownloadsDir != "" {
+		if info, err := os.Stat(c.DownloadsDir); err != nil || !info.IsDir() {
+			return errors.New("downloads_dir must be an existing directory")
+		}
+	}
+
+	if err := c.HTTP.validate(); err != nil {
+		return fmt.Errorf("http: %w", err)
+	}
+
+	if l := c.Limits; l != nil && (l.MaxStreams < 0 || l.MaxBufferedBytes < 0 || l.MaxCapturedRequests < 0) {
+		return errors.New("limits.max_streams, max_buffered_bytes and max_captured_requests must not be negative")
+	}
+
+	if l := c.Limits; l != nil && (l.MaxMessageSize < 0 || l.MaxMessageSize > math.MaxUint32) {
+		return errors.New("limits.max_message_size must be between 0 and 4GB")
+	}
+
+	if h := c.Hedging; h != nil && (h.Delay <= 0 || h.Budget < 0 || h.Budget > 1) {
+		return errors.New("hedging needs a positive delay and a budget between 0 and 1")
+	}
+
+	for subdomain, upload := range c.Uploads {
+		switch {
+		case upload == nil || upload.Token == "":
+			return fmt.Errorf("uploads.%s.token is required", subdomain)
+		case upload.Target != "" && !strings.HasPrefix(upload.Target, "/"):
+			return fmt.Errorf("uploads.%s.target must be an absolute path", subdomain)
+		case upload.MaxSize < 0:
+			return fmt.Errorf("uploads.%s.max_size must not be negative", subdomain)
+		}
+	}
+
+	if err := c.Socket.Validate(); err != nil {
+		return fmt.Errorf("socket: %w", err)
+	}
+
+	if c.ForwardAuth != nil && !isHTTPURL(c.ForwardAuth.Address) {
+		return errors.New("forward_auth.address must be an absolute http(s) URL")
+	}
+
+	if nf := c.NotFound; nf != nil {
+		if _, err := manager.NewNotFoundHandler(nf.Mode, nf.URL); err != nil {
+			return fmt.Errorf("not_found: %w", err)
+		}
+	}
+
+	for subdomain, policy := range c.JWT {
+		if policy == nil || !isHTTPURL(policy.JWKSURL) {
+			return fmt.Errorf("jwt.%s.jwks_url must be an absolute http(s) URL", subdomain)
+		}
+	}
+
+	if _, err := clientip.NewResolver(c.TrustedProxies); err != nil {
+		return fmt.Errorf("trusted_proxies: %w", err)
+	}
+
+	if _, err := clientip.ParseNets(c.ProxyProtocolTrusted); err != nil {
+		return fmt.Errorf("proxy_protocol_trusted: %w", err)
+	}
+
+	if c.Secrets != nil {
+		if _, err := c.Secrets.source(); err != nil {
+			return err
+		}
+	}
+
+	if c.AuthorizedKeys != "" {
+		if _, err := loadAuthorizedKeys(c.AuthorizedKeys); err != nil {
+			return fmt.Errorf("authorized_keys: %w", err)
+		}
+	}
+
+	if l := c.Limits; l != nil && l.MaxConnectionLifetime > 0 && l.RotationGrace >= l.MaxConnectionLifetime {
+		return errors.New("limits.rotation_grace must be shorter than limits.max_connection_lifetime")
+	}
+
+	if c.StatsD != nil {
+		if err := c.StatsD.validate(); err != nil {
+			return err
+		}
+	}
+
+	if err := c.validateTeams(); err != nil {
+		return err
+	}
+
+	if err := c.validateAdminTokens(); err != nil {
+		return err
+	}
+	if err := c.validateClientTokens(); err != nil {
+		return err
+	}
+
+	return c.validateMTLS()
+}
+
+func (c *Config) quicBindAddress() string {
+	if c.QuicBindAddress != "" {
+		return c.QuicBindAddress
+	}
+	return c.BindAddress
+}
+
+// publicURL returns the address a subdomain is reachable at, or "" when no
+// domain is configured. The port is left out when it is the scheme default.
+func (c *Config) publicURL(subdomain string) string {
+	if c.Domain == "" {
+		return ""
+	}
+
+	u := url.URL{Scheme: "http", Host: subdomain + "." + c.Domain}
+	if c.PathRouting.enabled() {
+		u.Host, u.Path = c.Domain, manager.MountPath(c.PathRouting.Prefix, subdomain)
+	}
+	defaultPort := 80
+	if (c.Cert != nil && c.Cert.Enabled) || c.Secrets != nil {
+		u.Scheme, defaultPort = "https", 443
+	}
+	if c.ServerPort != 0 && c.ServerPort != defaultPort {
+		u.Host = net.JoinHostPort(u.Host, strconv.Itoa(c.ServerPort))
+	}
+	return u.String()
+}
+
+func (c *Config) resolveSecrets() error {
+	token, err := secret.Resolve(c.Token, c.TokenFile)
+	if err != nil {
+		return fmt.Errorf("token_file: %w", err)
+	}
+	c.Token = token
+
+	adminToken, err := secret.Resolve(c.AdminToken, c.AdminTokenFile)
+	if err != nil {
+		return fmt.Errorf("admin_token_file: %w", err)
+	}
+	c.AdminToken = adminToken
+
+	for subdomain, upload := range c.Uploads {
+		if upload == nil {
+			continue
+		}
+		token, err := secret.Resolve(upload.Token, upload.TokenFile)
+		if err != nil {
+			return fmt.Errorf("uploads.%s.token_file: %w", subdomain, err)
+		}
+		upload.Token = token
+	}
 	return nil
 }
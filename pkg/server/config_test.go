@@ -0,0 +1,257 @@
+package server_test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/snakeice/gunnel/pkg/manager"
+	"github.com/snakeice/gunnel/pkg/server"
+	"github.com/snakeice/gunnel/pkg/store"
+)
+
+func TestLoadConfigTypedPlaceholders(t *testing.T) {
+	t.Setenv("GUNNEL_TEST_PORT", "8080")
+	t.Setenv("GUNNEL_TEST_PROXY", "true")
+	t.Setenv("GUNNEL_TEST_RETENTION", "48h")
+	t.Setenv("GUNNEL_TEST_TOKEN", "0123")
+
+	path := filepath.Join(t.TempDir(), "server.yaml")
+	err := os.WriteFile(path, []byte(`
+domain: example.com
+server_port: ${GUNNEL_TEST_PORT}
+proxy_protocol: ${GUNNEL_TEST_PROXY}
+usage_retention: ${GUNNEL_TEST_RETENTION}
+token: "${GUNNEL_TEST_TOKEN}"
+admin_token: $${GUNNEL_TEST_UNSET}
+`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := server.DefaultConfig()
+	if err := config.LoadConfig(path); err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+	if config.ServerPort != 8080 || !config.ProxyProtocol || config.UsageRetention != 48*time.Hour {
+		t.Errorf("typed placeholders decoded as port %d, proxy_protocol %v, usage_retention %s",
+			config.ServerPort, config.ProxyProtocol, config.UsageRetention)
+	}
+	if config.Token != "0123" {
+		t.Errorf("token = %q, want the string 0123", config.Token)
+	}
+	if config.AdminToken != "${GUNNEL_TEST_UNSET}" {
+		t.Errorf("admin_token = %q, want the escaped placeholder", config.AdminToken)
+	}
+}
+
+func TestValidateTCPPortsWithUser(t *testing.T) {
+	tests := []struct {
+		name    string
+		user    string
+		min     int
+		wantErr bool
+	}{
+		{"low ports as root", "", 100, false},
+		{"low ports after dropping privileges", "gunnel", 100, true},
+		{"range starting below 1024", "gunnel", 1023, true},
+		{"unprivileged ports", "gunnel", 1024, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := server.DefaultConfig()
+			config.Domain = "example.com"
+			config.User = tt.user
+			config.TCPPorts = &server.TCPPortsConfig{Min: tt.min, Max: tt.min + 99}
+			if err := config.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateInspectorPersist(t *testing.T) {
+	tests := []struct {
+		name    string
+		storage *store.Config
+		wantErr bool
+	}{
+		{"without storage", nil, true},
+		{"unencrypted storage", &store.Config{Driver: store.DriverMemory}, true},
+		{"encrypted storage", &store.Config{
+			Driver: store.DriverMemory, EncryptionKeys: []string{strings.Repeat("A", 43) + "="},
+		}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := server.DefaultConfig()
+			config.Domain = "example.com"
+			config.Storage = tt.storage
+			config.Inspector = &server.InspectorConfig{Persist: true}
+			if err := config.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestValidateClientTokens(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("from-file\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		tokens  []server.ClientTokenConfig
+		wantErr string
+	}{
+		{name: "valid", tokens: []server.ClientTokenConfig{
+			{Name: "ci", Token: "ci-token", Subdomains: []string{"preview-*", "ci"}, MaxTunnels: 3},
+		}},
+		{name: "token file", tokens: []server.ClientTokenConfig{{Name: "ci", TokenFile: tokenFile}}},
+		{name: "hash", tokens: []server.ClientTokenConfig{{Name: "ci", TokenSHA256: sha256Hex("ci-token")}}},
+		{name: "unlimited quota", tokens: []server.ClientTokenConfig{{Name: "ci", Token: "ci-token", MaxTunnels: 0}}},
+		{name: "bad pattern", wantErr: "bad subdomain pattern", tokens: []server.ClientTokenConfig{
+			{Name: "ci", Token: "ci-token", Subdomains: []string{"preview-["}},
+		}},
+		{name: "empty pattern", wantErr: "bad subdomain pattern", tokens: []server.ClientTokenConfig{
+			{Name: "ci", Token: "ci-token", Subdomains: []string{""}},
+		}},
+		{name: "negative quota", wantErr: "max_tunnels must not be negative", tokens: []server.ClientTokenConfig{
+			{Name: "ci", Token: "ci-token", MaxTunnels: -1},
+		}},
+		{name: "bad name", wantErr: "bad name", tokens: []server.ClientTokenConfig{{Name: "CI token", Token: "ci-token"}}},
+		{name: "duplicate name", wantErr: "used twice", tokens: []server.ClientTokenConfig{
+			{Name: "ci", Token: "ci-token"}, {Name: "ci", Token: "other-token"},
+		}},
+		{name: "duplicate token", wantErr: "already used by ci", tokens: []server.ClientTokenConfig{
+			{Name: "ci", Token: "ci-token"}, {Name: "deploy", TokenSHA256: sha256Hex("ci-token")},
+		}},
+		{name: "token and hash", wantErr: "either token or token_sha256", tokens: []server.ClientTokenConfig{
+			{Name: "ci", Token: "ci-token", TokenSHA256: sha256Hex("ci-token")},
+		}},
+		{name: "no token", wantErr: "token is required", tokens: []server.ClientTokenConfig{{Name: "ci"}}},
+		{name: "shared token", wantErr: "is the shared token", tokens: []server.ClientTokenConfig{
+			{Name: "ci", Token: "shared"},
+		}},
+		{name: "bad hash", wantErr: "must be a hex SHA-256", tokens: []server.ClientTokenConfig{
+			{Name: "ci", TokenSHA256: "not-a-hash"},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := server.DefaultConfig()
+			config.Domain = "example.com"
+			config.Token = "shared"
+			config.ClientTokens = tt.tokens
+			err := config.Validate()
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("Validate() error = %v", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Errorf("Validate() error = %v, want one containing %q", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			for _, token := range config.ClientTokens {
+				if token.Token != "" || token.TokenFile != "" || len(token.TokenSHA256) != sha256.Size*2 {
+					t.Errorf("validated token %q keeps %+v, want only its hash", token.Name, token)
+				}
+			}
+		})
+	}
+}
+
+func TestApplyClientTokens(t *testing.T) {
+	tests := []struct {
+		name    string
+		stored  map[string]manager.ClientTokenSpec
+		config  []server.ClientTokenConfig
+		want    map[string]manager.ClientTokenSpec
+		wantErr bool
+	}{
+		{
+			name: "created",
+			config: []server.ClientTokenConfig{
+				{Name: "ci", Token: "ci-token", Subdomains: []string{"preview-*"}, MaxTunnels: 3},
+			},
+			want: map[string]manager.ClientTokenSpec{
+				"ci": {Subdomains: []string{"preview-*"}, MaxTunnels: 3, TokenHash: sha256Hex("ci-token")},
+			},
+		},
+		{
+			name: "config wins over a stored token of the same name",
+			stored: map[string]manager.ClientTokenSpec{
+				"ci": {Subdomains: []string{"any-*"}, MaxTunnels: 1, TokenHash: sha256Hex("old-token")},
+			},
+			config: []server.ClientTokenConfig{
+				{Name: "ci", Token: "ci-token", Subdomains: []string{"preview-*"}, MaxTunnels: 3},
+			},
+			want: map[string]manager.ClientTokenSpec{
+				"ci": {Subdomains: []string{"preview-*"}, MaxTunnels: 3, TokenHash: sha256Hex("ci-token")},
+			},
+		},
+		{
+			name: "other stored tokens are kept",
+			stored: map[string]manager.ClientTokenSpec{
+				"deploy": {MaxTunnels: 1, TokenHash: sha256Hex("deploy-token")},
+			},
+			config: []server.ClientTokenConfig{{Name: "ci", Token: "ci-token"}},
+			want: map[string]manager.ClientTokenSpec{
+				"ci":     {TokenHash: sha256Hex("ci-token")},
+				"deploy": {MaxTunnels: 1, TokenHash: sha256Hex("deploy-token")},
+			},
+		},
+		{
+			name: "token used by a stored token of another name",
+			stored: map[string]manager.ClientTokenSpec{
+				"deploy": {TokenHash: sha256Hex("ci-token")},
+			},
+			config:  []server.ClientTokenConfig{{Name: "ci", Token: "ci-token"}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := server.DefaultConfig()
+			config.Domain = "example.com"
+			config.ClientTokens = tt.config
+			if err := config.Validate(); err != nil {
+				t.Fatalf("Validate() error = %v", err)
+			}
+
+			tokens, err := server.NewServer(config).ApplyClientTokens(tt.stored)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("ApplyClientTokens() = %+v, want an error", tokens)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ApplyClientTokens() error = %v", err)
+			}
+			if len(tokens) != len(tt.want) {
+				t.Fatalf("registry = %+v, want %d tokens", tokens, len(tt.want))
+			}
+			for _, token := range tokens {
+				want, ok := tt.want[token.Name]
+				if !ok || !slices.Equal(token.Subdomains, want.Subdomains) || token.MaxTunnels != want.MaxTunnels ||
+					token.TokenHash != want.TokenHash {
+					t.Errorf("token %q = %+v, want %+v", token.Name, token, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,49 @@
+package server
+
+import (
+	"bufio"
+	"net"
+
+	"github.com/snakeice/gunnel/pkg/manager"
+)
+
+// ReloadClientConfig runs what SIGHUP does for the client config.
+func (s *Server) ReloadClientConfig() error {
+	return s.reloadClientConfig()
+}
+
+// ParseProxyHeader parses a PROXY protocol v1 or v2 header.
+func ParseProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	return parseProxyHeader(r)
+}
+
+// NewProxyProtoListener expects a PROXY protocol header on the connections
+// of ln, from the trusted CIDRs only when any are given.
+func NewProxyProtoListener(ln net.Listener, trusted []*net.IPNet) net.Listener {
+	return &proxyProtoListener{Listener: ln, trusted: trusted}
+}
+
+// SandboxPaths returns what the sandbox leaves readable and writable.
+func (c *Config) SandboxPaths() ([]string, []string) {
+	return c.sandboxPaths()
+}
+
+// CheckRoot runs the root check of Start.
+func (c *Config) CheckRoot() error {
+	return c.checkRoot()
+}
+
+// ApplyClientTokens puts stored into the client token registry, as if read
+// from tokens_file, applies the client tokens of the config over them the way
+// Start does and returns the registry.
+func (s *Server) ApplyClientTokens(stored map[string]manager.ClientTokenSpec) ([]manager.ClientToken, error) {
+	for name, spec := range stored {
+		if _, _, _, err := s.connManager.PutClientToken(name, spec); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.applyClientTokens(); err != nil {
+		return nil, err
+	}
+	return s.connManager.ClientTokens(), nil
+}
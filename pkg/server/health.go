@@ -0,0 +1,188 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
+)
+
+const readinessTimeout = 2 * time.Second
+
+// readiness tracks the state the /readyz probe reports.
+type readiness struct {
+	quic atomic.Bool
+	http atomic.Bool
+	// tls is set once the HTTP server has a certificate, when TLS is expected.
+	tls atomic.Bool
+}
+
+type probeResult struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+// startManagement serves /healthz and /readyz on the management port until
+// ctx is done. It starts before the listeners so probes answer while the
+// server obtains its certificate.
+func (s *Server) startManagement(ctx context.Context) {
+	if s.config.ManagementPort == 0 {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) {
+		writeProbe(w, probeResult{Status: "ok"})
+	})
+	mux.HandleFunc("/readyz", s.handleReadyz)
+
+	serveInternal(ctx, "Management server (healthz/readyz)",
+		portToAddr(s.config.BindAddress, s.config.ManagementPort), mux)
+}
+
+// startMetrics serves /metrics on the metrics address, if one is set, until
+// ctx is done.
+func (s *Server) startMetrics(ctx context.Context) {
+	if s.config.MetricsAddress == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", promhttp.Handler())
+	serveInternal(ctx, "Metrics server", s.config.MetricsAddress, mux)
+}
+
+// serveInternal serves handler on addr, for operators rather than users,
+// until ctx is done.
+func serveInternal(ctx context.Context, name, addr string, handler http.Handler) {
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+
+	// Bind right away so the port is taken before privileges are dropped.
+	ln, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		logrus.WithError(err).Errorf("%s failed", name)
+		return
+	}
+
+	go func() {
+		logrus.Infof("%s listening on %s", name, srv.Addr)
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logrus.WithError(err).Errorf("%s failed", name)
+		}
+	}()
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			logrus.WithError(err).Debugf("%s shutdown error", name)
+		}
+	}()
+}
+
+func (s *Server) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+	defer cancel()
+
+	checks := map[string]error{
+		"quic":    boolCheck(s.ready.quic.Load(), "QUIC listener not started"),
+		"http":    boolCheck(s.ready.http.Load(), "HTTP listener not started"),
+		"storage": s.checkStorage(ctx),
+	}
+	if s.tlsExpected() {
+		checks["cert"] = boolCheck(s.ready.tls.Load(), "no TLS certificate")
+	}
+
+	result := probeResult{Status: "ok", Checks: make(map[string]string, len(checks))}
+	for name, err := range checks {
+		if err != nil {
+			result.Status = "unavailable"
+			result.Checks[name] = err.Error()
+			continue
+		}
+		result.Checks[name] = "ok"
+	}
+
+	if result.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	writeProbe(w, result)
+}
+
+func (s *Server) tlsExpected() bool {
+	return s.config.Cert.Enabled || s.secrets != nil
+}
+
+// checkStorage verifies that the certificate storage and the state storage,
+// or the directories of the state files, can be written.
+func (s *Server) checkStorage(ctx context.Context) error {
+	if s.config.Cert.Enabled {
+		storage := certmagic.Default.Storage
+		const probeKey = "gunnel/readyz"
+		if err := storage.Store(ctx, probeKey, []byte("ok")); err != nil {
+			return err
+		}
+		if err := storage.Delete(ctx, probeKey); err != nil {
+			return err
+		}
+	}
+
+	if s.state != nil && s.state.shared != nil {
+		const probeKey = "readyz"
+		if err := s.state.shared.Put(probeKey, []byte("ok")); err != nil {
+			return err
+		}
+		return s.state.shared.Delete(probeKey)
+	}
+
+	for _, path := range s.config.stateFiles() {
+		if path == "" {
+			continue
+		}
+		if err := checkWritableDir(filepath.Dir(path)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkWritableDir(dir string) error {
+	f, err := os.CreateTemp(dir, ".gunnel-readyz-*")
+	if err != nil {
+		return err
+	}
+	name := f.Name()
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Remove(name)
+}
+
+func boolCheck(ok bool, reason string) error {
+	if ok {
+		return nil
+	}
+	return errors.New(reason)
+}
+
+func writeProbe(w http.ResponseWriter, result probeResult) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		logrus.WithError(err).Debug("Failed to write probe response")
+	}
+}
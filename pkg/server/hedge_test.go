@@ -0,0 +1,51 @@
+package server_test
+
+import (
+	"io"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// slowFirstBackend answers the first request of every method after a second
+// and the others right away, counting them.
+func slowFirstBackend(t *testing.T, requests map[string]*atomic.Int64) uint32 {
+	t.Helper()
+	return serveBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		if requests[r.Method].Add(1) == 1 {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(time.Second):
+			}
+			_, _ = w.Write([]byte("first"))
+			return
+		}
+		_, _ = w.Write([]byte("second"))
+	})
+}
+
+func TestHedgingOnlyRetriesIdempotentRequests(t *testing.T) {
+	requests := map[string]*atomic.Int64{http.MethodGet: {}, http.MethodPost: {}}
+	tun := startTunnel(t, "hedging:\n  delay: 100ms\n", slowFirstBackend(t, requests))
+
+	start := time.Now()
+	resp := tun.do(t, http.MethodGet, "demo.localhost", "/", "", "")
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "second" {
+		t.Fatalf("slow GET answered %d %q, want the hedged attempt's 200 %q", resp.StatusCode, body, "second")
+	}
+	if elapsed := time.Since(start); elapsed >= time.Second {
+		t.Errorf("slow GET took %s, want the hedged attempt's answer before the first one's", elapsed)
+	}
+
+	resp = tun.do(t, http.MethodPost, "demo.localhost", "/", "", "order")
+	body, _ = io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "first" {
+		t.Fatalf("slow POST answered %d %q, want the only attempt's 200 %q", resp.StatusCode, body, "first")
+	}
+	if got := requests[http.MethodPost].Load(); got != 1 {
+		t.Errorf("backend received the POST %d times, want once", got)
+	}
+}
@@ -0,0 +1,217 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/snakeice/gunnel/pkg/logging"
+	"github.com/snakeice/gunnel/pkg/metrics"
+)
+
+// Defaults of HTTPServerConfig.
+const (
+	defaultReadHeaderTimeout   = 5 * time.Second
+	defaultReadTimeout         = 10 * time.Second
+	defaultWriteTimeout        = 10 * time.Second
+	defaultIdleTimeout         = 120 * time.Second
+	defaultMaxHeaderReadsPerIP = 32
+)
+
+// HTTPServerConfig tunes the public HTTP server against slow clients. Zero
+// fields use the defaults.
+type HTTPServerConfig struct {
+	// ReadHeaderTimeout bounds reading the request headers (default 5s).
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout"`
+	// ReadTimeout bounds reading a whole request, body included (default 10s).
+	ReadTimeout time.Duration `yaml:"read_timeout"`
+	// WriteTimeout bounds writing a response (default 10s).
+	WriteTimeout time.Duration `yaml:"write_timeout"`
+	// IdleTimeout closes keep-alive connections idle this long (default 2m).
+	IdleTimeout time.Duration `yaml:"idle_timeout"`
+	// MaxHeaderReadsPerIP bounds the connections of one IP that have not
+	// sent their request headers yet; more are closed right away (default
+	// 32, negative = unlimited).
+	MaxHeaderReadsPerIP int `yaml:"max_header_reads_per_ip"`
+}
+
+func (c *HTTPServerConfig) validate() error {
+	if c == nil {
+		return nil
+	}
+	if c.ReadHeaderTimeout < 0 || c.ReadTimeout < 0 || c.WriteTimeout < 0 || c.IdleTimeout < 0 {
+		return errors.New("timeouts must not be negative")
+	}
+	return nil
+}
+
+// apply sets the timeouts on server.
+func (c *HTTPServerConfig) apply(server *http.Server) {
+	var cfg HTTPServerConfig
+	if c != nil {
+		cfg = *c
+	}
+	server.ReadHeaderTimeout = orDefault(cfg.ReadHeaderTimeout, defaultReadHeaderTimeout)
+	server.ReadTimeout = orDefault(cfg.ReadTimeout, defaultReadTimeout)
+	server.WriteTimeout = orDefault(cfg.WriteTimeout, defaultWriteTimeout)
+	server.IdleTimeout = orDefault(cfg.IdleTimeout, defaultIdleTimeout)
+}
+
+func (c *HTTPServerConfig) maxHeaderReadsPerIP() int {
+	if c == nil || c.MaxHeaderReadsPerIP == 0 {
+		return defaultMaxHeaderReadsPerIP
+	}
+	return c.MaxHeaderReadsPerIP
+}
+
+func orDefault(d, def time.Duration) time.Duration {
+	if d == 0 {
+		return def
+	}
+	return d
+}
+
+// headerGate counts, per IP, the connections still reading their first
+// request headers, so a slowloris client holding many of them open cannot
+// exhaust the server while staying within every timeout.
+type headerGate struct {
+	max int
+	mu  sync.Mutex
+	ips map[string]int
+}
+
+func newHeaderGate(maxPerIP int) *headerGate {
+	return &headerGate{max: maxPerIP, ips: make(map[string]int)}
+}
+
+func (g *headerGate) acquire(ip string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.ips[ip] >= g.max {
+		return false
+	}
+	g.ips[ip]++
+	return true
+}
+
+func (g *headerGate) release(ip string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.ips[ip]--; g.ips[ip] <= 0 {
+		delete(g.ips, ip)
+	}
+}
+
+// errTooManyHeaderReads fails the first read of a connection whose IP is at
+// the headerGate limit. It is wrapped in a read *net.OpError so net/http
+// closes the connection without answering.
+var errTooManyHeaderReads = errors.New("too many connections reading headers")
+
+// headerGateListener puts accepted connections behind a headerGate. The slot
+// is taken on the first read rather than in Accept, where a PROXY protocol
+// header would have to be waited for.
+type headerGateListener struct {
+	net.Listener
+	gate *headerGate
+}
+
+func (l *headerGateListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &gatedConn{Conn: conn, gate: l.gate}, nil
+}
+
+// gatedConn holds a headerGate slot from its first read until its first
+// request reaches the handler or it is closed.
+type gatedConn struct {
+	net.Conn
+	gate     *headerGate
+	acquire  sync.Once
+	release  sync.Once
+	ip       string
+	admitted bool
+}
+
+func (c *gatedConn) Read(p []byte) (int, error) {
+	c.acquire.Do(func() {
+		c.ip = remoteIP(c.RemoteAddr())
+		c.admitted = c.gate.acquire(c.ip)
+		if !c.admitted {
+			logging.HTTPEdge.WithField("remote", c.ip).Debug("Too many connections reading headers, closing")
+			metrics.RecordLoadShed("header_reads")
+		}
+	})
+	if !c.admitted {
+		return 0, &net.OpError{Op: "read", Net: "tcp", Addr: c.RemoteAddr(), Err: errTooManyHeaderReads}
+	}
+	return c.Conn.Read(p)
+}
+
+// done frees the slot, if the connection took one.
+func (c *gatedConn) done() {
+	c.acquire.Do(func() {})
+	c.release.Do(func() {
+		if c.admitted {
+			c.gate.release(c.ip)
+		}
+	})
+}
+
+func (c *gatedConn) Close() error {
+	c.done()
+	return c.Conn.Close()
+}
+
+type gatedConnKey struct{}
+
+// connContext remembers the gatedConn of each connection for releaseHeaderGate.
+func connContext(ctx context.Context, conn net.Conn) context.Context {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	if gated, ok := conn.(*gatedConn); ok {
+		return context.WithValue(ctx, gatedConnKey{}, gated)
+	}
+	return ctx
+}
+
+// releaseHeaderGate frees the headerGate slot of a connection once its
+// headers are in.
+func releaseHeaderGate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if gated, ok := r.Context().Value(gatedConnKey{}).(*gatedConn); ok {
+			gated.done()
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// refuseBanned answers 403 to the IPs banned on TCP tunnel ports.
+func (s *Server) refuseBanned(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			ip = r.RemoteAddr
+		}
+		if s.connManager.IPBanned(ip) {
+			logging.HTTPEdge.WithField("remote", ip).Debug("Refusing request from banned IP")
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func remoteIP(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
@@ -0,0 +1,108 @@
+package server_test
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// dialEdge opens a raw connection to the HTTP listener of tun.
+func (tun *tunnel) dialEdge(t *testing.T) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", strings.TrimPrefix(tun.url, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// closedWithin reports whether the server closes conn within d.
+func closedWithin(t *testing.T, conn net.Conn, d time.Duration) bool {
+	t.Helper()
+	if err := conn.SetReadDeadline(time.Now().Add(d)); err != nil {
+		t.Fatal(err)
+	}
+	_, err := io.Copy(io.Discard, conn)
+	var netErr net.Error
+	return !errors.As(err, &netErr) || !netErr.Timeout()
+}
+
+func TestSlowHeadersAreCutOff(t *testing.T) {
+	tun := startTunnel(t, "http:\n  read_header_timeout: 300ms\n", 1)
+
+	conn := tun.dialEdge(t)
+	if _, err := io.WriteString(conn, "GET / HTTP/1.1\r\nHost: demo.localhost\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	if !closedWithin(t, conn, 3*time.Second) {
+		t.Error("connection that never finished its headers is still open")
+	}
+}
+
+func TestHeaderReadsPerIPLimit(t *testing.T) {
+	tun := startTunnel(t, "http:\n  max_header_reads_per_ip: 2\n", 1)
+
+	slow := []net.Conn{tun.dialEdge(t), tun.dialEdge(t)}
+	for _, conn := range slow {
+		if _, err := io.WriteString(conn, "GET / HTTP/1.1\r\n"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	if !closedWithin(t, tun.dialEdge(t), time.Second) {
+		t.Error("connection past the per-IP limit was not closed")
+	}
+	for _, conn := range slow {
+		if closedWithin(t, conn, 100*time.Millisecond) {
+			t.Error("connection within the per-IP limit was closed")
+		}
+	}
+
+	// Finishing the headers frees the slots.
+	for _, conn := range slow {
+		if _, err := io.WriteString(conn, "Host: gunnel.localhost\r\nConnection: close\r\n\r\n"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+	if resp := tun.do(t, http.MethodGet, "gunnel.localhost", "/api/stats", "", ""); resp.StatusCode != http.StatusOK {
+		t.Errorf("request once the slots are free = %d, want 200", resp.StatusCode)
+	}
+}
+
+func TestStreamingOutlivesWriteTimeout(t *testing.T) {
+	const events = 5
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i := range events {
+			fmt.Fprintf(w, "data: %d\n\n", i)
+			w.(http.Flusher).Flush()
+			time.Sleep(150 * time.Millisecond)
+		}
+	}))
+	defer backend.Close()
+
+	tun := startTunnel(t, "http:\n  write_timeout: 300ms\n",
+		uint32(backend.Listener.Addr().(*net.TCPAddr).Port)) //nolint:gosec // a port number
+
+	start := time.Now()
+	resp := tun.do(t, http.MethodGet, "demo.localhost", "/", "", "")
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("stream cut after %v: %v", time.Since(start), err)
+	}
+	if got := strings.Count(string(body), "data: "); got != events {
+		t.Errorf("received %d events, want %d:\n%s", got, events, body)
+	}
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+		t.Errorf("stream took %v, shorter than the write timeout it should outlive", elapsed)
+	}
+}
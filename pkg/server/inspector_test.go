@@ -0,0 +1,130 @@
+package server_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/snakeice/gunnel/pkg/manager"
+)
+
+func TestInspectorRedactsCredentials(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Set-Cookie", "session=backend-secret")
+		w.Header().Set("X-Backend", "kept")
+		_, _ = w.Write([]byte("hello"))
+	}))
+	defer backend.Close()
+	u, err := url.Parse(backend.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, err := strconv.ParseUint(u.Port(), 10, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tun := startTunnel(t, "admin_token: adm\ninspector:\n  requests: 10\n", uint32(port))
+
+	req, err := http.NewRequest(http.MethodGet, tun.url+"/orders", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = "demo.localhost"
+	req.Header.Set("Authorization", "Bearer user-secret")
+	req.Header.Set("Cookie", "session=user-secret")
+	req.Header.Set("X-Request", "kept")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("proxied request = %d", resp.StatusCode)
+	}
+
+	var list []manager.CapturedSummary
+	if err := json.NewDecoder(tun.do(t, http.MethodGet, "gunnel.localhost", "/api/requests", "adm", "").Body).
+		Decode(&list); err != nil || len(list) != 1 {
+		t.Fatalf("captured requests = %+v, %v", list, err)
+	}
+	var captured manager.CapturedRequest
+	if err := json.NewDecoder(tun.do(t, http.MethodGet, "gunnel.localhost", "/api/requests/"+list[0].ID, "adm", "").
+		Body).Decode(&captured); err != nil {
+		t.Fatal(err)
+	}
+
+	if captured.Path != "/orders" || captured.ResponseBody != "hello" {
+		t.Errorf("captured %s %q, want /orders answered with hello", captured.Path, captured.ResponseBody)
+	}
+	for name, got := range map[string]string{
+		"Authorization": captured.RequestHeaders.Get("Authorization"),
+		"Cookie":        captured.RequestHeaders.Get("Cookie"),
+		"Set-Cookie":    captured.ResponseHeaders.Get("Set-Cookie"),
+	} {
+		if got != "REDACTED" {
+			t.Errorf("captured %s = %q, want it redacted", name, got)
+		}
+	}
+	if captured.RequestHeaders.Get("X-Request") != "kept" || captured.ResponseHeaders.Get("X-Backend") != "kept" {
+		t.Errorf("expected other headers to be kept, got %v and %v", captured.RequestHeaders, captured.ResponseHeaders)
+	}
+}
+
+func TestInspectorPersistsEncryptedCaptures(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("webhook-secret"))
+	}))
+	defer backend.Close()
+	port := uint32(backend.Listener.Addr().(*net.TCPAddr).Port) //nolint:gosec // a port number
+
+	dir := t.TempDir()
+	config := fmt.Sprintf(`admin_token: adm
+storage:
+  path: %s
+  encryption_keys: [%s]
+inspector:
+  persist: true
+`, dir, base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, 32)))
+
+	tun := startTunnel(t, config, port)
+	if resp := tun.do(t, http.MethodGet, "demo.localhost", "/hook", "", ""); resp.StatusCode != http.StatusOK {
+		t.Fatalf("proxied request = %d", resp.StatusCode)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := tun.srv.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	stored, err := os.ReadFile(filepath.Join(dir, "captures.json"))
+	if err != nil {
+		t.Fatalf("captures were not saved: %v", err)
+	}
+	if bytes.Contains(stored, []byte("webhook-secret")) || bytes.Contains(stored, []byte("/hook")) {
+		t.Error("captures were saved unencrypted")
+	}
+
+	restarted := startTunnel(t, config, port)
+	var list []manager.CapturedSummary
+	if err := json.NewDecoder(restarted.do(t, http.MethodGet, "gunnel.localhost", "/api/requests", "adm", "").Body).
+		Decode(&list); err != nil || len(list) != 1 || list[0].Path != "/hook" {
+		t.Fatalf("captured requests after a restart = %+v, %v", list, err)
+	}
+	var captured manager.CapturedRequest
+	if err := json.NewDecoder(restarted.do(t, http.MethodGet, "gunnel.localhost", "/api/requests/"+list[0].ID, "adm",
+		"").Body).Decode(&captured); err != nil || captured.ResponseBody != "webhook-secret" {
+		t.Errorf("captured body after a restart = %q, %v", captured.ResponseBody, err)
+	}
+}
@@ -0,0 +1,35 @@
+package server_test
+
+import (
+	"testing"
+
+	"github.com/snakeice/gunnel/pkg/protocol"
+)
+
+func TestRegistrationRefusesUnsafeJWKSURL(t *testing.T) {
+	tun := startTunnel(t, "", 1)
+
+	tests := []struct {
+		url    string
+		reject protocol.RejectReason
+	}{
+		{"http://127.0.0.1/jwks.json", protocol.RejectInvalidJWKS},
+		{"http://issuer.example.com/jwks.json", protocol.RejectInvalidJWKS},
+		{"https://127.0.0.1/jwks.json", protocol.RejectInvalidJWKS},
+		{"https://[::1]/jwks.json", protocol.RejectInvalidJWKS},
+		{"https://169.254.169.254/latest", protocol.RejectInvalidJWKS},
+		{"https://10.0.0.1/jwks.json", protocol.RejectInvalidJWKS},
+		{"https://issuer.example.com/jwks.json", protocol.RejectNone},
+	}
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			got := tun.register(t, &protocol.ConnectionRegister{
+				Subdomain: "demo", Host: "127.0.0.1", Port: 1, Protocol: protocol.HTTP,
+				JWT: &protocol.JWTPolicy{Issuer: "https://issuer.example.com", JWKSURL: tt.url},
+			})
+			if got.Reject != tt.reject {
+				t.Errorf("registration = %s (%q), want %s", got.Reject, got.Message, tt.reject)
+			}
+		})
+	}
+}
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/snakeice/gunnel/pkg/logging"
+	"github.com/snakeice/gunnel/pkg/manager"
+)
+
+// MTLSConfig requires visitors of a tunnel to present a client certificate
+// issued by one of the CAs in CAFile (PEM bundle).
+type MTLSConfig struct {
+	CAFile string `yaml:"ca_file"`
+}
+
+func loadCAPool(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(filepath.Clean(path))
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+// configureMTLS registers the CA pool of every mTLS tunnel with the manager.
+// A bundle that fails to load leaves the tunnel with an empty pool, so it
+// stays closed instead of becoming public.
+func (s *Server) configureMTLS() {
+	for subdomain, cfg := range s.config.MTLS {
+		pool, err := loadCAPool(cfg.CAFile)
+		if err != nil {
+			logging.HTTPEdge.WithError(err).WithField("subdomain", subdomain).
+				Error("Failed to load client CA bundle, tunnel will reject every visitor")
+			pool = x509.NewCertPool()
+		}
+		s.connManager.SetClientCA(subdomain, pool)
+	}
+}
+
+// requireClientCerts makes the TLS handshake ask for a client certificate
+// when the SNI name belongs to a tunnel with mTLS enabled.
+func (s *Server) requireClientCerts(base *tls.Config) {
+	base.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		subdomain := s.connManager.ResolveShareLink(manager.SubdomainFromHost(hello.ServerName))
+		pool, ok := s.connManager.ClientCAs(subdomain)
+		if !ok {
+			return nil, nil //nolint:nilnil // nil config keeps the base configuration
+		}
+
+		cfg := base.Clone()
+		cfg.GetConfigForClient = nil
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+		cfg.ClientCAs = pool
+		return cfg, nil
+	}
+}
+
+func (c *Config) validateMTLS() error {
+	for subdomain, cfg := range c.MTLS {
+		if cfg == nil || cfg.CAFile == "" {
+			return fmt.Errorf("mtls.%s.ca_file is required", subdomain)
+		}
+		if _, err := loadCAPool(cfg.CAFile); err != nil {
+			return fmt.Errorf("mtls.%s: %w", subdomain, err)
+		}
+	}
+	if len(c.MTLS) > 0 && (c.Cert == nil || !c.Cert.Enabled) {
+		return errors.New("mtls requires cert.enabled")
+	}
+	return nil
+}
@@ -0,0 +1,204 @@
+package server_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCA issues certificates for the mTLS tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key}
+}
+
+// issue returns a PEM certificate and key for name with the given usage.
+func (ca *testCA) issue(t *testing.T, name string, usage x509.ExtKeyUsage) ([]byte, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func (ca *testCA) pem() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw})
+}
+
+// fakeVault serves values as the KV version 2 secret secret/gunnel.
+func fakeVault(t *testing.T, values map[string]string) string {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/secret/data/gunnel" {
+			http.NotFound(w, r)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{"data": map[string]any{"data": values}})
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+func TestMTLSRequiresClientCertificate(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.Header.Get("X-Client-Cert-Subject")))
+	}))
+	defer backend.Close()
+	backendPort := backend.Listener.Addr().(*net.TCPAddr).Port
+
+	trusted, untrusted := newTestCA(t, "trusted"), newTestCA(t, "untrusted")
+	serverCert, serverKey := trusted.issue(t, "*.localhost", x509.ExtKeyUsageServerAuth)
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, trusted.pem(), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	vault := fakeVault(t, map[string]string{"tls_cert": string(serverCert), "tls_key": string(serverKey)})
+
+	t.Setenv("GUNNEL_TOKEN", "shared")
+	tun := startTunnel(t, fmt.Sprintf(`token: shared
+cert:
+  enabled: true
+  email: admin@example.com
+secrets:
+  provider: vault
+  vault:
+    address: %s
+    token: root
+    path: gunnel
+mtls:
+  demo:
+    ca_file: %s
+`, vault, caFile), uint32(backendPort)) //nolint:gosec // a port number
+
+	good, err := tls.X509KeyPair(trusted.issue(t, "alice", x509.ExtKeyUsageClientAuth))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrongCA, err := tls.X509KeyPair(untrusted.issue(t, "mallory", x509.ExtKeyUsageClientAuth))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := strings.TrimPrefix(tun.url, "http://")
+	// get presents cert whenever the server asks, even when it does not
+	// chain to the CAs the server names.
+	get := func(sni, host string, cert *tls.Certificate) (int, string, error) {
+		tlsConfig := &tls.Config{
+			ServerName:         sni,
+			InsecureSkipVerify: true, //nolint:gosec // the test server certificate is self-issued
+		}
+		if cert != nil {
+			tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+				return cert, nil
+			}
+		}
+		client := &http.Client{
+			Timeout:   5 * time.Second,
+			Transport: &http.Transport{DisableKeepAlives: true, TLSClientConfig: tlsConfig},
+		}
+		req, err := http.NewRequest(http.MethodGet, "https://"+addr+"/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Host = host
+		resp, err := client.Do(req)
+		if err != nil {
+			return 0, "", err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body), err
+	}
+
+	code, body, err := get("demo.localhost", "demo.localhost", &good)
+	if err != nil || code != http.StatusOK || body != "CN=alice" {
+		t.Fatalf("trusted client certificate = %d %q, %v; want 200 with its subject", code, body, err)
+	}
+
+	// Without mTLS on the SNI name the handshake succeeds, so the request
+	// itself must be answered 403.
+	tests := []struct {
+		name      string
+		sni       string
+		host      string
+		cert      *tls.Certificate
+		handshake bool
+	}{
+		{"no certificate", "demo.localhost", "demo.localhost", nil, false},
+		{"certificate from another CA", "demo.localhost", "demo.localhost", &wrongCA, false},
+		{"host differs from SNI", "other.localhost", "demo.localhost", &good, true},
+		{"host differs from SNI with another CA", "other.localhost", "demo.localhost", &wrongCA, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, body, err := get(tt.sni, tt.host, tt.cert)
+			switch {
+			case err != nil && tt.handshake:
+				t.Errorf("SNI %s, Host %s failed: %v, want 403", tt.sni, tt.host, err)
+			case err == nil && code != http.StatusForbidden:
+				t.Errorf("SNI %s, Host %s = %d %q, want the request refused", tt.sni, tt.host, code, body)
+			}
+		})
+	}
+}
@@ -0,0 +1,72 @@
+package server_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/snakeice/gunnel/pkg/protocol"
+	"github.com/snakeice/gunnel/pkg/transport"
+)
+
+// register sends reg over a fresh connection to tun, bypassing the client's
+// own subdomain normalization, and returns the server's answer.
+func (tun *tunnel) register(t *testing.T, reg *protocol.ConnectionRegister) protocol.ConnectionRegisterResp {
+	t.Helper()
+	transp, err := transport.New(tun.quic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer transp.Close()
+
+	stream := transp.Root()
+	if err := stream.Send(reg); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		msg, err := stream.Receive()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.Type != protocol.MessageConnectionRegisterResp {
+			continue
+		}
+		var resp protocol.ConnectionRegisterResp
+		if err := protocol.Unmarshal(&resp, msg); err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+}
+
+func TestNamedTunnelRejectsSubdomainVariants(t *testing.T) {
+	t.Setenv("GUNNEL_TOKEN", "shared")
+	tun := startTunnel(t, "token: shared\nadmin_token: admin\n", 1)
+
+	resp := tun.do(t, http.MethodPost, "gunnel.localhost", "/api/admin/tunnels", "admin", `{"name":"web"}`)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("create named tunnel = %d", resp.StatusCode)
+	}
+	var created struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"web", "WEB", " web", "Web "} {
+		got := tun.register(t, &protocol.ConnectionRegister{
+			Subdomain: name, Host: "127.0.0.1", Port: 1, Protocol: protocol.HTTP, Token: "shared",
+		})
+		if got.Success || got.Reject != protocol.RejectUnauthorized {
+			t.Errorf("registering %q with the shared token = %+v, want it unauthorized", name, got)
+		}
+	}
+
+	got := tun.register(t, &protocol.ConnectionRegister{
+		Subdomain: "WEB", Host: "127.0.0.1", Port: 1, Protocol: protocol.HTTP, Token: created.Token,
+	})
+	if !got.Success || got.Subdomain != "web" {
+		t.Errorf("registering with the tunnel credentials = %+v, want web", got)
+	}
+}
@@ -0,0 +1,285 @@
+package server_test
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/snakeice/gunnel/pkg/protocol"
+	"github.com/snakeice/gunnel/pkg/transport"
+)
+
+// countingBackend serves handler and counts the connections made to it.
+func countingBackend(t *testing.T, handler http.HandlerFunc) (uint32, *atomic.Int32) {
+	t.Helper()
+	var conns atomic.Int32
+	backend := httptest.NewUnstartedServer(handler)
+	backend.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	backend.Start()
+	t.Cleanup(backend.Close)
+	return uint32(backend.Listener.Addr().(*net.TCPAddr).Port), &conns //nolint:gosec // a port number
+}
+
+// rawBackend hands every connection made to it to serve, counting them.
+func rawBackend(t *testing.T, serve func(conn net.Conn, rd *bufio.Reader)) (uint32, *atomic.Int32) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	var conns atomic.Int32
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conns.Add(1)
+			go func() {
+				defer conn.Close()
+				serve(conn, bufio.NewReader(conn))
+			}()
+		}
+	}()
+	return uint32(ln.Addr().(*net.TCPAddr).Port), &conns //nolint:gosec // a port number
+}
+
+// get sends a GET for demo.localhost through tun, closing the connection
+// to the edge after it when closeConn is set.
+func (tun *tunnel) get(t *testing.T, closeConn bool) (int, string) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, tun.url+"/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = "demo.localhost"
+	req.Close = closeConn
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(body)
+}
+
+func TestRequestsOnAStreamShareABackendConnection(t *testing.T) {
+	port, conns := countingBackend(t, func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = io.WriteString(w, "ok")
+	})
+	tun := startTunnel(t, "", port)
+
+	for range 3 {
+		if code, body := tun.get(t, false); code != http.StatusOK || body != "ok" {
+			t.Fatalf("GET = %d %q", code, body)
+		}
+	}
+	if got := conns.Load(); got != 1 {
+		t.Errorf("backend saw %d connections, want the first one reused", got)
+	}
+}
+
+func TestKeptBackendConnectionClosedByBackend(t *testing.T) {
+	var posts atomic.Int32
+	// The backend answers the first request of each connection and closes
+	// it when the next one arrives, as on hitting its idle timeout.
+	port, conns := rawBackend(t, func(conn net.Conn, rd *bufio.Reader) {
+		for i := 0; ; i++ {
+			req, err := http.ReadRequest(rd)
+			if err != nil {
+				return
+			}
+			if req.Method == http.MethodPost {
+				posts.Add(1)
+			}
+			_, _ = io.Copy(io.Discard, req.Body)
+			if i > 0 {
+				return
+			}
+			_, _ = io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")
+		}
+	})
+	tun := startTunnel(t, "", port)
+
+	for i := range 2 {
+		if code, body := tun.get(t, false); code != http.StatusOK || body != "ok" {
+			t.Fatalf("GET %d = %d %q, want it retried on a new connection", i, code, body)
+		}
+	}
+	if got := conns.Load(); got != 2 {
+		t.Errorf("backend saw %d connections, want 2", got)
+	}
+	// The retry happens in the client, not by the server on a new stream.
+	if got := tun.answered.statuses(); !slices.Equal(got, []int{http.StatusOK, http.StatusOK}) {
+		t.Errorf("client answered %v, want both GETs answered once", got)
+	}
+
+	// A request body may have been consumed, so a POST is not sent twice.
+	if resp := tun.do(t, http.MethodPost, "demo.localhost", "/", "", "payload"); resp.StatusCode == http.StatusOK {
+		t.Error("POST on a connection the backend closed succeeded, want it failed")
+	}
+	if got := posts.Load(); got != 1 {
+		t.Errorf("backend received the POST %d times, want once", got)
+	}
+}
+
+func TestConnectionCloseStopsReuse(t *testing.T) {
+	t.Run("backend", func(t *testing.T) {
+		port, conns := countingBackend(t, func(w http.ResponseWriter, _ *http.Request) {
+			w.Header().Set("Connection", "close")
+			_, _ = io.WriteString(w, "ok")
+		})
+		tun := startTunnel(t, "", port)
+		for range 2 {
+			if code, _ := tun.get(t, false); code != http.StatusOK {
+				t.Fatalf("GET = %d", code)
+			}
+		}
+		if got := conns.Load(); got != 2 {
+			t.Errorf("backend saw %d connections, want a new one after Connection: close", got)
+		}
+	})
+
+	t.Run("request", func(t *testing.T) {
+		port, conns := countingBackend(t, func(w http.ResponseWriter, _ *http.Request) {
+			_, _ = io.WriteString(w, "ok")
+		})
+		tun := startTunnel(t, "", port)
+		for range 2 {
+			if code, _ := tun.get(t, true); code != http.StatusOK {
+				t.Fatalf("GET = %d", code)
+			}
+		}
+		if got := conns.Load(); got != 2 {
+			t.Errorf("backend saw %d connections, want a new one after Connection: close", got)
+		}
+	})
+
+	t.Run("close-delimited body", func(t *testing.T) {
+		port, conns := rawBackend(t, func(conn net.Conn, rd *bufio.Reader) {
+			if _, err := http.ReadRequest(rd); err == nil {
+				_, _ = io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\n\r\nuntil close")
+			}
+		})
+		tun := startTunnel(t, "", port)
+		for range 2 {
+			if code, body := tun.get(t, false); code != http.StatusOK || body != "until close" {
+				t.Fatalf("GET = %d %q", code, body)
+			}
+		}
+		if got := conns.Load(); got != 2 {
+			t.Errorf("backend saw %d connections, want a new one after a close-delimited body", got)
+		}
+	})
+}
+
+// TestClientWithoutPersistentIsAwaited serves a tunnel with a client that
+// predates Persistent: it answers every begin message before reading the
+// request, so the server must not send the request ahead of that answer.
+func TestClientWithoutPersistentIsAwaited(t *testing.T) {
+	tun := startTunnel(t, "", 1)
+
+	transp, err := transport.New(tun.quic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer transp.Close()
+	root := transp.Root()
+	if err := root.Send(&protocol.ConnectionRegister{
+		Subdomain: "legacy", Host: "127.0.0.1", Port: 1, Protocol: protocol.HTTP,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		msg, err := root.Receive()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.Type == protocol.MessageConnectionRegisterResp {
+			break
+		}
+	}
+
+	var early atomic.Int32
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		for {
+			strm, err := transp.AcceptStream(ctx)
+			if err != nil {
+				return
+			}
+			go serveLegacy(strm, &early)
+		}
+	}()
+
+	for i := range 2 {
+		resp := tun.do(t, http.MethodGet, "legacy.localhost", "/", "", "")
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusOK || string(body) != "legacy" {
+			t.Fatalf("GET %d = %d %q", i, resp.StatusCode, body)
+		}
+	}
+	if got := early.Load(); got != 0 {
+		t.Errorf("%d requests arrived before the client was ready", got)
+	}
+}
+
+// serveLegacy answers the requests on strm the way clients without
+// Persistent do, counting requests sent before their ready message in early.
+func serveLegacy(strm transport.Stream, early *atomic.Int32) {
+	defer strm.Close()
+	rd := strm.BufferedReader()
+	for {
+		msg, err := strm.Receive()
+		if err != nil || msg.Type != protocol.MessageBeginStream {
+			return
+		}
+		if err := strm.SetReadDeadline(time.Now().Add(100 * time.Millisecond)); err != nil {
+			return
+		}
+		_, err = rd.Peek(1)
+		if err := strm.SetReadDeadline(time.Time{}); err != nil {
+			return
+		}
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			early.Add(1)
+		}
+		if err := strm.Send(&protocol.ConnectionReady{Subdomain: "legacy"}); err != nil {
+			return
+		}
+		req, err := http.ReadRequest(rd)
+		if err != nil {
+			return
+		}
+		if _, err := io.Copy(io.Discard, req.Body); err != nil {
+			return
+		}
+		resp := &http.Response{
+			StatusCode: http.StatusOK, ProtoMajor: 1, ProtoMinor: 1,
+			ContentLength: int64(len("legacy")), Body: io.NopCloser(strings.NewReader("legacy")),
+		}
+		if err := resp.Write(strm); err != nil || strm.Flush() != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+)
+
+// minUnprivilegedPort is the first port an unprivileged user may bind.
+const minUnprivilegedPort = 1024
+
+// ErrRunningAsRoot is returned when the server would keep running as root.
+var ErrRunningAsRoot = errors.New(
+	"refusing to run as root: set user to drop privileges once the listeners are bound, or pass --allow-root")
+
+// checkRoot refuses to start as root unless privileges are dropped after
+// binding or AllowRoot is set.
+func (c *Config) checkRoot() error {
+	if !isRoot() || c.User != "" {
+		return nil
+	}
+	if !c.AllowRoot {
+		return ErrRunningAsRoot
+	}
+	logrus.Warn("Running as root; set user to drop privileges once the listeners are bound")
+	return nil
+}
+
+// dropPrivileges switches to the configured user and group. It runs once the
+// listeners are bound, so low ports keep working while everything parsing
+// untrusted input runs unprivileged.
+func (s *Server) dropPrivileges() error {
+	if s.config.User == "" {
+		return nil
+	}
+	if err := setUser(s.config.User, s.config.Group); err != nil {
+		return fmt.Errorf("failed to drop privileges to %s: %w", s.config.User, err)
+	}
+	if isRoot() {
+		return errors.New("still running as root after dropping privileges")
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"user":  s.config.User,
+		"group": s.config.Group,
+	}).Info("Dropped privileges")
+	return nil
+}
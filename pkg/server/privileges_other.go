@@ -0,0 +1,16 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd)
+
+package server
+
+import (
+	"errors"
+	"runtime"
+)
+
+func isRoot() bool {
+	return false
+}
+
+func setUser(string, string) error {
+	return errors.New("dropping privileges is not supported on " + runtime.GOOS)
+}
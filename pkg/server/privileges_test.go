@@ -0,0 +1,31 @@
+package server_test
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/snakeice/gunnel/pkg/server"
+)
+
+func TestCheckRootRefusesRoot(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("needs to run as root")
+	}
+
+	config := server.DefaultConfig()
+	if err := config.CheckRoot(); !errors.Is(err, server.ErrRunningAsRoot) {
+		t.Errorf("CheckRoot() as root = %v, want ErrRunningAsRoot", err)
+	}
+
+	config.AllowRoot = true
+	if err := config.CheckRoot(); err != nil {
+		t.Errorf("CheckRoot() with allow root = %v", err)
+	}
+
+	config.AllowRoot = false
+	config.User = "nobody"
+	if err := config.CheckRoot(); err != nil {
+		t.Errorf("CheckRoot() with a user to switch to = %v", err)
+	}
+}
@@ -0,0 +1,58 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd
+
+package server
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+func isRoot() bool {
+	return os.Geteuid() == 0
+}
+
+// setUser switches every thread to name, a user name or uid, and group, a
+// group name or gid that defaults to the user's primary group.
+func setUser(name, group string) error {
+	u, err := user.Lookup(name)
+	if err != nil {
+		if u, err = user.LookupId(name); err != nil {
+			return err
+		}
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return fmt.Errorf("unexpected uid %q: %w", u.Uid, err)
+	}
+
+	gidValue := u.Gid
+	if group != "" {
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			if g, err = user.LookupGroupId(group); err != nil {
+				return err
+			}
+		}
+		gidValue = g.Gid
+	}
+	gid, err := strconv.Atoi(gidValue)
+	if err != nil {
+		return fmt.Errorf("unexpected gid %q: %w", gidValue, err)
+	}
+
+	// Order matters: supplementary groups and the group can only be changed
+	// while still root.
+	if err := syscall.Setgroups([]int{gid}); err != nil {
+		return fmt.Errorf("setgroups: %w", err)
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return fmt.Errorf("setgid: %w", err)
+	}
+	if err := syscall.Setuid(uid); err != nil {
+		return fmt.Errorf("setuid: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,183 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/snakeice/gunnel/pkg/clientip"
+)
+
+const (
+	proxyHeaderTimeout = 5 * time.Second
+	proxyV1MaxLen      = 107
+	proxyV2HeaderLen   = 16
+	// proxyV2MaxLen bounds the addresses and TLVs after the v2 header; real
+	// balancers send a few hundred bytes at most.
+	proxyV2MaxLen   = 4096
+	proxyV2CmdLocal = 0x0
+	proxyV2CmdProxy = 0x1
+	proxyV2FamTCP4  = 0x11
+	proxyV2FamTCP6  = 0x21
+)
+
+var (
+	errProxyHeader = errors.New("invalid PROXY protocol header")
+	proxyV2Sig     = []byte("\r\n\r\n\x00\r\nQUIT\n") //nolint:gochecknoglobals // read-only signature
+)
+
+// proxyProtoListener accepts connections prefixed with a PROXY protocol v1
+// or v2 header, as sent by L4 load balancers, and reports the client address
+// from the header as RemoteAddr. The header is read lazily on first use so a
+// slow peer never blocks Accept. When trusted is set, connections from other
+// peers are closed instead of trusting their header.
+type proxyProtoListener struct {
+	net.Listener
+	trusted []*net.IPNet
+}
+
+func (l *proxyProtoListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyProtoConn{Conn: conn, reader: bufio.NewReader(conn), trusted: l.trusted}, nil
+}
+
+type proxyProtoConn struct {
+	net.Conn
+	reader  *bufio.Reader
+	trusted []*net.IPNet
+	once    sync.Once
+	remote  net.Addr
+	err     error
+}
+
+func (c *proxyProtoConn) Read(p []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(p)
+}
+
+func (c *proxyProtoConn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyProtoConn) readHeader() {
+	peer := c.Conn.RemoteAddr()
+	if len(c.trusted) > 0 && !clientip.Contains(c.trusted, net.ParseIP(remoteIP(peer))) {
+		c.err = errors.Join(fmt.Errorf("%w: %s is not a trusted balancer", errProxyHeader, peer), c.Close())
+		return
+	}
+	if err := c.SetReadDeadline(time.Now().Add(proxyHeaderTimeout)); err != nil {
+		c.err = err
+		return
+	}
+
+	c.remote, c.err = parseProxyHeader(c.reader)
+	if c.err == nil {
+		c.err = c.SetReadDeadline(time.Time{})
+	}
+	if c.err != nil {
+		c.err = errors.Join(c.err, c.Close())
+	}
+}
+
+// parseProxyHeader consumes a v1 or v2 header. A nil address means the
+// header carried no client address (LOCAL or UNKNOWN).
+func parseProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	sig, err := r.Peek(len(proxyV2Sig))
+	if err == nil && bytes.Equal(sig, proxyV2Sig) {
+		return parseProxyV2(r)
+	}
+	if sig, err = r.Peek(6); err == nil && string(sig) == "PROXY " {
+		return parseProxyV1(r)
+	}
+	return nil, fmt.Errorf("%w: missing signature", errProxyHeader)
+}
+
+func parseProxyV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if len(line) > proxyV1MaxLen {
+			return nil, fmt.Errorf("%w: v1 header too long", errProxyHeader)
+		}
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil //nolint:nilnil // UNKNOWN keeps the connection's own address
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("%w: malformed v1 header", errProxyHeader)
+	}
+
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("%w: malformed v1 source", errProxyHeader)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func parseProxyV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, proxyV2HeaderLen)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if header[12]>>4 != 2 {
+		return nil, fmt.Errorf("%w: unsupported v2 version", errProxyHeader)
+	}
+
+	length := binary.BigEndian.Uint16(header[14:16])
+	if length > proxyV2MaxLen {
+		return nil, fmt.Errorf("%w: v2 header too long", errProxyHeader)
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	switch header[12] & 0x0f {
+	case proxyV2CmdLocal:
+		return nil, nil //nolint:nilnil // health checks from the balancer itself
+	case proxyV2CmdProxy:
+	default:
+		return nil, fmt.Errorf("%w: unknown v2 command", errProxyHeader)
+	}
+
+	switch header[13] {
+	case proxyV2FamTCP4:
+		if len(body) < 12 {
+			return nil, fmt.Errorf("%w: short v2 address", errProxyHeader)
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}, nil
+	case proxyV2FamTCP6:
+		if len(body) < 36 {
+			return nil, fmt.Errorf("%w: short v2 address", errProxyHeader)
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}, nil
+	default:
+		// UDP, UNIX or unspecified: nothing useful to report.
+		return nil, nil //nolint:nilnil // keep the connection's own address
+	}
+}
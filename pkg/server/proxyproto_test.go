@@ -0,0 +1,177 @@
+package server_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/snakeice/gunnel/pkg/clientip"
+	"github.com/snakeice/gunnel/pkg/server"
+)
+
+const (
+	v2Local = 0x20
+	v2Proxy = 0x21
+	v2TCP4  = 0x11
+	v2TCP6  = 0x21
+	v2Unix  = 0x31
+)
+
+// proxyV2 builds a v2 header announcing length bytes of body.
+func proxyV2(command, family byte, length int, body []byte) []byte {
+	header := []byte("\r\n\r\n\x00\r\nQUIT\n")
+	header = append(header, command, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(length)) //nolint:gosec // test lengths fit
+	return append(header, body...)
+}
+
+func tcp4Body() []byte {
+	body := append(net.ParseIP("203.0.113.7").To4(), net.ParseIP("10.0.0.1").To4()...)
+	body = binary.BigEndian.AppendUint16(body, 51234)
+	return binary.BigEndian.AppendUint16(body, 80)
+}
+
+func tcp6Body() []byte {
+	body := append(net.ParseIP("2001:db8::7").To16(), net.ParseIP("2001:db8::1").To16()...)
+	body = binary.BigEndian.AppendUint16(body, 51234)
+	return binary.BigEndian.AppendUint16(body, 443)
+}
+
+func unixBody() []byte {
+	body := make([]byte, 216)
+	copy(body, "/run/balancer.sock")
+	return body
+}
+
+func TestParseProxyHeader(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  []byte
+		want    string
+		wantErr string
+	}{
+		{name: "v1 tcp4", header: []byte("PROXY TCP4 203.0.113.7 10.0.0.1 51234 80\r\n"), want: "203.0.113.7:51234"},
+		{
+			name:   "v1 tcp6",
+			header: []byte("PROXY TCP6 2001:db8::7 2001:db8::1 51234 443\r\n"),
+			want:   "[2001:db8::7]:51234",
+		},
+		{name: "v1 unknown", header: []byte("PROXY UNKNOWN\r\n")},
+		{name: "v1 truncated", header: []byte("PROXY TCP4 203.0.113.7 10.0.0.1"), wantErr: "EOF"},
+		{name: "v1 too long", header: []byte("PROXY " + strings.Repeat("1", 120) + "\r\n"), wantErr: "too long"},
+		{name: "v1 bad port", header: []byte("PROXY TCP4 203.0.113.7 10.0.0.1 x 80\r\n"), wantErr: "malformed"},
+		{name: "v1 bad protocol", header: []byte("PROXY UDP4 203.0.113.7 10.0.0.1 1 80\r\n"), wantErr: "malformed"},
+		{name: "v2 proxy tcp4", header: proxyV2(v2Proxy, v2TCP4, 12, tcp4Body()), want: "203.0.113.7:51234"},
+		{name: "v2 proxy tcp6", header: proxyV2(v2Proxy, v2TCP6, 36, tcp6Body()), want: "[2001:db8::7]:51234"},
+		{name: "v2 proxy unix", header: proxyV2(v2Proxy, v2Unix, 216, unixBody())},
+		{name: "v2 local tcp4", header: proxyV2(v2Local, v2TCP4, 12, tcp4Body())},
+		{name: "v2 local tcp6", header: proxyV2(v2Local, v2TCP6, 36, tcp6Body())},
+		{name: "v2 local unix", header: proxyV2(v2Local, v2Unix, 216, unixBody())},
+		{name: "v2 truncated header", header: proxyV2(v2Proxy, v2TCP4, 12, nil)[:14], wantErr: "EOF"},
+		{name: "v2 truncated body", header: proxyV2(v2Proxy, v2TCP4, 12, tcp4Body()[:6]), wantErr: "EOF"},
+		{name: "v2 short address", header: proxyV2(v2Proxy, v2TCP4, 6, tcp4Body()[:6]), wantErr: "short"},
+		{name: "v2 oversized length", header: proxyV2(v2Proxy, v2TCP4, 0xffff, tcp4Body()), wantErr: "too long"},
+		{name: "v2 bad version", header: proxyV2(0x11, v2TCP4, 12, tcp4Body()), wantErr: "version"},
+		{name: "v2 bad command", header: proxyV2(0x2f, v2TCP4, 12, tcp4Body()), wantErr: "command"},
+		{name: "bad v2 signature", header: append([]byte("\r\n\r\n\x00\r\nQUIX\n"), 0x21, 0x11, 0, 0), wantErr: "signature"},
+		{name: "no header", header: []byte("GET / HTTP/1.1\r\n\r\n"), wantErr: "signature"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Broken headers end the stream, so truncation is not hidden by
+			// the payload.
+			stream := tt.header
+			if tt.wantErr == "" {
+				stream = append(stream, "payload"...)
+			}
+			r := bufio.NewReader(bytes.NewReader(stream))
+			addr, err := server.ParseProxyHeader(r)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want one mentioning %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseProxyHeader: %v", err)
+			}
+
+			got := ""
+			if addr != nil {
+				got = addr.String()
+			}
+			if got != tt.want {
+				t.Errorf("address = %q, want %q", got, tt.want)
+			}
+			if rest, _ := io.ReadAll(r); string(rest) != "payload" {
+				t.Errorf("left %q after the header, want the payload", rest)
+			}
+		})
+	}
+}
+
+func TestProxyProtoTrustedBalancers(t *testing.T) {
+	tests := []struct {
+		name    string
+		trusted []string
+		want    string
+	}{
+		{name: "trusted", trusted: []string{"127.0.0.0/8"}, want: "203.0.113.7:51234"},
+		{name: "any peer", want: "203.0.113.7:51234"},
+		{name: "untrusted", trusted: []string{"10.0.0.0/8"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			trusted, err := clientip.ParseNets(tt.trusted)
+			if err != nil {
+				t.Fatal(err)
+			}
+			inner, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			ln := server.NewProxyProtoListener(inner, trusted)
+			defer ln.Close()
+
+			client, err := net.Dial("tcp", ln.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+			if _, err := client.Write([]byte("PROXY TCP4 203.0.113.7 10.0.0.1 51234 80\r\nping")); err != nil {
+				t.Fatal(err)
+			}
+
+			conn, err := ln.Accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			if err := conn.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+				t.Fatal(err)
+			}
+
+			buf := make([]byte, 4)
+			_, err = io.ReadFull(conn, buf)
+			if tt.want == "" {
+				if err == nil {
+					t.Fatalf("read %q from an untrusted balancer, want the connection refused", buf)
+				}
+				return
+			}
+			if err != nil || string(buf) != "ping" {
+				t.Fatalf("read %q, %v; want ping", buf, err)
+			}
+			if got := conn.RemoteAddr().String(); got != tt.want {
+				t.Errorf("RemoteAddr = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,61 @@
+package server
+
+import (
+	"context"
+	"reflect"
+
+	"github.com/sirupsen/logrus"
+	"github.com/snakeice/gunnel/pkg/protocol"
+	"github.com/snakeice/gunnel/pkg/signal"
+)
+
+// update is the protocol form of the client config.
+func (cc *ClientConfig) update() protocol.ConfigUpdate {
+	return protocol.ConfigUpdate{
+		HeartbeatInterval: cc.HeartbeatInterval,
+		RateLimit:         cc.RateLimit,
+		Features:          cc.Features,
+		Notice:            cc.Notice,
+	}
+}
+
+// reloadLoop re-reads client_config from the config file on SIGHUP and
+// pushes it to the connected clients when it changed. The other settings
+// need a restart.
+func (s *Server) reloadLoop(ctx context.Context) {
+	hangups := signal.NotifyHangup(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hangups:
+		}
+
+		if err := s.reloadClientConfig(); err != nil {
+			logrus.WithError(err).WithField("path", s.config.path).
+				Error("Failed to reload client config, keeping the current one")
+		}
+	}
+}
+
+func (s *Server) reloadClientConfig() error {
+	fresh := &Config{}
+	if err := fresh.decodeFile(s.config.path); err != nil {
+		return err
+	}
+	if fresh.ClientConfig == nil {
+		logrus.Info("Reloaded config has no client_config, keeping the current one")
+		return nil
+	}
+
+	update := fresh.ClientConfig.update()
+	if current, ok := s.connManager.ClientConfig(); ok {
+		current.Version = 0
+		if reflect.DeepEqual(current, update) {
+			logrus.Debug("Client config unchanged")
+			return nil
+		}
+	}
+	s.connManager.PushConfig(update)
+	return nil
+}
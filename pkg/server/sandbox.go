@@ -0,0 +1,113 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/caddyserver/certmagic"
+	"github.com/sirupsen/logrus"
+	"github.com/snakeice/gunnel/pkg/store"
+)
+
+// errSandboxUnsupported is returned by the sandbox layers the kernel or
+// platform does not provide; the server keeps running without them.
+var errSandboxUnsupported = errors.New("not supported on this system")
+
+// SandboxConfig confines the server once its listeners are bound: Landlock
+// limits the files it can open and a seccomp filter denies the system calls
+// it never needs, such as execve, ptrace and mount. Both are Linux only and
+// skipped with a warning where the kernel lacks them.
+type SandboxConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// ReadPaths and WritePaths are opened up on top of the system files the
+	// server reads (certificates, DNS and time zone data) and the
+	// directories of its state.
+	ReadPaths  []string `yaml:"read_paths"`
+	WritePaths []string `yaml:"write_paths"`
+}
+
+// defaultSandboxReadPaths are read by the Go runtime and the TLS and DNS
+// code; missing ones are skipped.
+var defaultSandboxReadPaths = []string{ //nolint:gochecknoglobals // fixed list
+	"/etc",
+	"/run/systemd/resolve",
+	"/usr/share/zoneinfo",
+	"/usr/share/ca-certificates",
+	"/usr/local/share/ca-certificates",
+	"/usr/lib/ssl",
+}
+
+// sandboxPaths returns what the sandbox leaves readable and writable.
+func (c *Config) sandboxPaths() ([]string, []string) {
+	read := append(append([]string{}, defaultSandboxReadPaths...), c.Sandbox.ReadPaths...)
+	write := append([]string{}, c.Sandbox.WritePaths...)
+
+	// Re-read on SIGHUP for the client config.
+	if c.path != "" {
+		read = append(read, c.path)
+	}
+	if c.DownloadsDir != "" {
+		read = append(read, c.DownloadsDir)
+	}
+
+	for _, path := range c.stateFiles() {
+		if path != "" {
+			write = append(write, filepath.Dir(path))
+		}
+	}
+	if c.Storage != nil {
+		switch c.Storage.Driver {
+		case "", store.DriverFile:
+			write = append(write, c.Storage.Path)
+		case store.DriverBolt, store.DriverSQLite:
+			// Lock and journal files go next to the database.
+			write = append(write, filepath.Dir(c.Storage.Path))
+		}
+	}
+	if c.Cert != nil && c.Cert.Enabled {
+		if fs, ok := certmagic.Default.Storage.(*certmagic.FileStorage); ok {
+			write = append(write, fs.Path)
+		}
+	}
+	return read, write
+}
+
+// enterSandbox applies the sandbox when enabled. Write paths are created
+// first, as nothing can create them afterwards.
+func (s *Server) enterSandbox() error {
+	if s.config.Sandbox == nil || !s.config.Sandbox.Enabled {
+		return nil
+	}
+
+	read, write := s.config.sandboxPaths()
+	for _, dir := range write {
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return fmt.Errorf("failed to create sandbox write path: %w", err)
+		}
+	}
+
+	logger := logrus.WithFields(logrus.Fields{
+		"read_paths":  read,
+		"write_paths": write,
+	})
+	switch err := restrictPaths(read, write); {
+	case errors.Is(err, errSandboxUnsupported):
+		logger.WithError(err).Warn("Landlock unavailable, file access is not sandboxed")
+	case err != nil:
+		return fmt.Errorf("failed to restrict file access: %w", err)
+	default:
+		logger.Info("Restricted file access with Landlock")
+	}
+
+	switch err := restrictSyscalls(); {
+	case errors.Is(err, errSandboxUnsupported):
+		logrus.WithError(err).Warn("Seccomp unavailable, system calls are not filtered")
+	case err != nil:
+		return fmt.Errorf("failed to filter system calls: %w", err)
+	default:
+		logrus.Info("Filtered system calls with seccomp")
+	}
+	return nil
+}
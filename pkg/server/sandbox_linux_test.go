@@ -0,0 +1,92 @@
+package server_test
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/snakeice/gunnel/pkg/client"
+)
+
+// TestSandboxKeepsTunnelsWorking registers a TCP tunnel and writes the named
+// tunnel registry once the sandbox is on. The sandbox cannot be lifted, so
+// the test re-runs itself in a child process with GUNNEL_SANDBOX_HELPER set
+// to the directory the state goes to, outside the configured write paths.
+func TestSandboxKeepsTunnelsWorking(t *testing.T) {
+	stateDir := os.Getenv("GUNNEL_SANDBOX_HELPER")
+	if stateDir == "" {
+		stateDir = t.TempDir()
+		tmpDir := t.TempDir()
+		//nolint:gosec // re-runs this test binary
+		cmd := exec.Command(os.Args[0], "-test.run=^TestSandboxKeepsTunnelsWorking$", "-test.v")
+		cmd.Env = append(os.Environ(), "GUNNEL_SANDBOX_HELPER="+stateDir, "TMPDIR="+tmpDir)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("sandboxed server failed: %v\n%s", err, out)
+		}
+		if _, err := os.Stat(filepath.Join(stateDir, "tunnels", "tunnels.json")); err != nil {
+			t.Errorf("named tunnel registry was not written under the sandbox: %v", err)
+		}
+		return
+	}
+
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	go func() {
+		for {
+			conn, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	t.Setenv("GUNNEL_TOKEN", "shared")
+	port := freePort(t, "tcp")
+	tun := startTunnelWith(t, fmt.Sprintf(`token: shared
+admin_token: admin
+tunnels_file: %s/tunnels/tunnels.json
+tcp_ports:
+  min: %d
+  max: %d
+sandbox:
+  enabled: true
+  write_paths: [%s]
+`, stateDir, port, port, os.TempDir()), &client.BackendConfig{
+		Host:      "127.0.0.1",
+		Port:      uint32(backend.Addr().(*net.TCPAddr).Port), //nolint:gosec // a port number
+		Subdomain: "demo",
+		Protocol:  "tcp",
+	})
+
+	conn, err := net.DialTimeout("tcp", fmt.Sprintf("127.0.0.1:%d", port), 5*time.Second)
+	if err != nil {
+		t.Fatalf("TCP tunnel port bound after the sandbox is unreachable: %v", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("echo through the TCP tunnel = %q, %v", buf, err)
+	}
+
+	resp := tun.do(t, http.MethodPost, "gunnel.localhost", "/api/admin/tunnels", "admin", `{"name":"web"}`)
+	if resp.StatusCode != http.StatusCreated {
+		t.Errorf("creating a named tunnel under the sandbox = %d", resp.StatusCode)
+	}
+}
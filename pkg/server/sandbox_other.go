@@ -0,0 +1,12 @@
+//go:build !linux
+
+package server
+
+import (
+	"fmt"
+	"runtime"
+)
+
+func restrictPaths([]string, []string) error {
+	return fmt.Errorf("landlock on %s: %w", runtime.GOOS, errSandboxUnsupported)
+}
@@ -0,0 +1,81 @@
+package server_test
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/caddyserver/certmagic"
+	"github.com/snakeice/gunnel/pkg/server"
+)
+
+// loadSandboxConfig loads yaml as a config file in dir.
+func loadSandboxConfig(t *testing.T, dir, yaml string) *server.Config {
+	t.Helper()
+	path := filepath.Join(dir, "server.yaml")
+	if err := os.WriteFile(path, []byte("domain: example.com\n"+yaml), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	config := server.DefaultConfig()
+	if err := config.LoadConfig(path); err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	return config
+}
+
+func expectPaths(t *testing.T, kind string, got []string, want ...string) {
+	t.Helper()
+	for _, path := range want {
+		if !slices.Contains(got, path) {
+			t.Errorf("%s paths %v miss %s", kind, got, path)
+		}
+	}
+}
+
+func TestSandboxPathsCoverStateFiles(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "dist"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	config := loadSandboxConfig(t, dir, fmt.Sprintf(`
+tunnels_file: %[1]s/tunnels/tunnels.json
+tokens_file: %[1]s/tokens/tokens.json
+usage_file: %[1]s/usage/usage.json
+uptime_file: %[1]s/uptime/uptime.json
+history_file: %[1]s/history/history.json
+downloads_dir: %[1]s/dist
+sandbox:
+  enabled: true
+  read_paths: [%[1]s/extra-read]
+  write_paths: [%[1]s/extra-write]
+`, dir))
+
+	read, write := config.SandboxPaths()
+	expectPaths(t, "read", read,
+		filepath.Join(dir, "server.yaml"), filepath.Join(dir, "dist"), filepath.Join(dir, "extra-read"))
+	expectPaths(t, "write", write,
+		filepath.Join(dir, "tunnels"), filepath.Join(dir, "tokens"), filepath.Join(dir, "usage"),
+		filepath.Join(dir, "uptime"), filepath.Join(dir, "history"), filepath.Join(dir, "extra-write"))
+}
+
+func TestSandboxPathsCoverStoreAndCerts(t *testing.T) {
+	dir := t.TempDir()
+	config := loadSandboxConfig(t, dir, fmt.Sprintf(`
+storage:
+  path: %[1]s/store
+cert:
+  enabled: true
+  email: admin@example.com
+sandbox:
+  enabled: true
+`, dir))
+
+	_, write := config.SandboxPaths()
+	certs, ok := certmagic.Default.Storage.(*certmagic.FileStorage)
+	if !ok {
+		t.Fatalf("certmagic stores certificates in %T, want a directory", certmagic.Default.Storage)
+	}
+	expectPaths(t, "write", write, filepath.Join(dir, "store"), certs.Path)
+}
@@ -0,0 +1,12 @@
+//go:build !linux || !(amd64 || arm64)
+
+package server
+
+import (
+	"fmt"
+	"runtime"
+)
+
+func restrictSyscalls() error {
+	return fmt.Errorf("seccomp on %s/%s: %w", runtime.GOOS, runtime.GOARCH, errSandboxUnsupported)
+}
@@ -0,0 +1,195 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/snakeice/gunnel/pkg/secret"
+	"github.com/snakeice/gunnel/pkg/signal"
+)
+
+// Keys read from the secret store. token may list several comma or newline
+// separated tokens so clients can move to a new one before the old expires.
+const (
+	secretToken      = "token"
+	secretAdminToken = "admin_token"
+	secretTLSCert    = "tls_cert"
+	secretTLSKey     = "tls_key"
+
+	defaultSecretsRefresh = time.Hour
+)
+
+// SecretsConfig fetches server credentials from an external secret store at
+// startup, every RefreshInterval and on SIGHUP. The secret holds the keys
+// token, admin_token, tls_cert and tls_key (PEM); missing keys fall back to
+// the static configuration.
+type SecretsConfig struct {
+	Provider        string            `yaml:"provider"` // vault or aws
+	RefreshInterval time.Duration     `yaml:"refresh_interval"`
+	Vault           *VaultConfig      `yaml:"vault"`
+	AWS             *AWSSecretsConfig `yaml:"aws"`
+}
+
+// VaultConfig points at a KV version 2 secret.
+type VaultConfig struct {
+	Address   string `yaml:"address"`
+	Token     string `yaml:"token"`
+	TokenFile string `yaml:"token_file"`
+	Mount     string `yaml:"mount"`
+	Path      string `yaml:"path"`
+}
+
+// AWSSecretsConfig points at an AWS Secrets Manager secret holding a JSON object.
+type AWSSecretsConfig struct {
+	Region   string `yaml:"region"`
+	SecretID string `yaml:"secret_id"`
+	Endpoint string `yaml:"endpoint"`
+}
+
+// secretStore caches the last credentials fetched from the secret store, so
+// a failed refresh keeps serving them.
+type secretStore struct {
+	source   secret.Source
+	interval time.Duration
+	tokens   atomic.Pointer[[]string]
+	cert     atomic.Pointer[tls.Certificate]
+}
+
+func (c *SecretsConfig) source() (secret.Source, error) {
+	switch c.Provider {
+	case "vault":
+		if c.Vault == nil || !isHTTPURL(c.Vault.Address) || c.Vault.Path == "" {
+			return nil, errors.New("secrets.vault needs an http(s) address and a path")
+		}
+		token, err := secret.Resolve(c.Vault.Token, c.Vault.TokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("secrets.vault.token_file: %w", err)
+		}
+		if token == "" {
+			return nil, errors.New("secrets.vault.token is required")
+		}
+		return secret.NewVault(c.Vault.Address, token, c.Vault.Mount, c.Vault.Path), nil
+	case "aws":
+		if c.AWS == nil || c.AWS.Region == "" || c.AWS.SecretID == "" {
+			return nil, errors.New("secrets.aws needs a region and a secret_id")
+		}
+		return secret.NewAWSSecretsManager(c.AWS.Region, c.AWS.SecretID, c.AWS.Endpoint), nil
+	default:
+		return nil, fmt.Errorf("unknown secrets provider %q", c.Provider)
+	}
+}
+
+// configureSecrets prepares the secret store; the first fetch happens in Start.
+func (s *Server) configureSecrets() {
+	cfg := s.config.Secrets
+	if cfg == nil {
+		return
+	}
+
+	source, err := cfg.source()
+	if err != nil {
+		// validate rejects this configuration, so only reachable when the
+		// config was built in code.
+		logrus.WithError(err).Error("Invalid secrets configuration")
+		return
+	}
+
+	interval := cfg.RefreshInterval
+	if interval <= 0 {
+		interval = defaultSecretsRefresh
+	}
+	s.secrets = &secretStore{source: source, interval: interval}
+
+	s.connManager.SetTokenValidator(s.secrets.validToken)
+}
+
+func (st *secretStore) validToken(token string) bool {
+	tokens := st.tokens.Load()
+	if tokens == nil || token == "" {
+		return false
+	}
+	for _, valid := range *tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(valid)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// certificate serves the TLS certificate read from the secret store.
+func (st *secretStore) certificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cert := st.cert.Load()
+	if cert == nil {
+		return nil, errors.New("no certificate in secret store")
+	}
+	return cert, nil
+}
+
+// refreshSecrets fetches the credentials and applies them. On failure the
+// previous values stay in use.
+func (s *Server) refreshSecrets(ctx context.Context) error {
+	values, err := s.secrets.source.Fetch(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to fetch secrets: %w", err)
+	}
+
+	if certPEM, keyPEM := values[secretTLSCert], values[secretTLSKey]; certPEM != "" || keyPEM != "" {
+		cert, err := tls.X509KeyPair([]byte(certPEM), []byte(keyPEM))
+		if err != nil {
+			return fmt.Errorf("invalid TLS key pair in secret store: %w", err)
+		}
+		s.secrets.cert.Store(&cert)
+	}
+
+	tokenList := s.config.Token
+	if value, ok := values[secretToken]; ok {
+		tokenList = value
+	}
+	tokens := strings.FieldsFunc(tokenList, func(r rune) bool { return r == ',' || r == '\n' })
+	for i := range tokens {
+		tokens[i] = strings.TrimSpace(tokens[i])
+	}
+	if len(tokens) == 0 {
+		logrus.Warn("No client token configured, token based registrations will be rejected")
+	}
+	s.secrets.tokens.Store(&tokens)
+
+	if value, ok := values[secretAdminToken]; ok {
+		s.webUI.SetAdminToken(value)
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"provider": s.config.Secrets.Provider,
+		"tokens":   len(tokens),
+		"tls":      s.secrets.cert.Load() != nil,
+	}).Info("Secrets loaded")
+	return nil
+}
+
+// secretsLoop re-fetches the credentials periodically and on SIGHUP.
+func (s *Server) secretsLoop(ctx context.Context) {
+	ticker := time.NewTicker(s.secrets.interval)
+	defer ticker.Stop()
+
+	hangups := signal.NotifyHangup(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-hangups:
+			logrus.Info("Received SIGHUP, reloading secrets")
+		}
+
+		if err := s.refreshSecrets(ctx); err != nil {
+			logrus.WithError(err).Error("Failed to refresh secrets, keeping cached values")
+		}
+	}
+}
@@ -2,30 +2,50 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"net/http/pprof"
 	"os"
+	"strconv"
 	"sync"
 	"time"
 
 	"github.com/quic-go/quic-go"
 	"github.com/sirupsen/logrus"
 	"github.com/snakeice/gunnel/pkg/certmanager"
+	"github.com/snakeice/gunnel/pkg/clientip"
+	"github.com/snakeice/gunnel/pkg/logging"
 	"github.com/snakeice/gunnel/pkg/manager"
 	"github.com/snakeice/gunnel/pkg/metrics"
+	"github.com/snakeice/gunnel/pkg/protocol"
 	gunnelquic "github.com/snakeice/gunnel/pkg/quic"
-	"github.com/snakeice/gunnel/pkg/signal"
+	"github.com/snakeice/gunnel/pkg/timeseries"
 	"github.com/snakeice/gunnel/pkg/transport"
+	"github.com/snakeice/gunnel/pkg/tunnel"
+	"github.com/snakeice/gunnel/pkg/usage"
 	"github.com/snakeice/gunnel/pkg/webui"
 )
 
+// usageFlushInterval is how often usage aggregates and traffic history are
+// saved to disk.
+const usageFlushInterval = time.Minute
+
 type Server struct {
 	config      *Config
 	connManager *manager.Manager
 	webUI       *webui.WebUI
 	connLimiter *ConnectionLimiter
+	secrets     *secretStore
+	state       *stateStores
+	ready       readiness
+
+	// runMu guards stop and stopped, set while Start runs.
+	runMu   sync.Mutex
+	stop    context.CancelFunc
+	stopped chan struct{}
 }
 
 func NewServer(config *Config) *Server {
@@ -34,9 +54,104 @@ func NewServer(config *Config) *Server {
 	webUI := webui.NewWebUI(m)
 
 	m.SetGunnelSubdomainHandler(webUI.HandleRequest)
+	if config.StatusPage {
+		m.SetStatusPageHandler(webUI.PublicHandler())
+	}
+	m.SetPublicURL(config.publicURL)
+	m.SetTCPEndpoint(config.BindAddress, config.Domain)
+	if p := config.TCPPorts; p != nil {
+		m.SetTCPPortRange(p.Min, p.Max)
+	}
+	if l := config.TCPLimits; l != nil {
+		m.SetTCPLimits(&manager.TCPLimits{
+			MaxConnsPerIP:     l.MaxConnectionsPerIP,
+			MaxConnsPerMinute: l.ConnectionsPerMinute,
+			BanAfter:          l.BanAfter,
+			BanDuration:       l.BanDuration,
+		})
+	}
+	webUI.SetServeMetrics(config.MetricsAddress == "")
+	webUI.SetDownloadsDir(config.DownloadsDir)
+	webUI.SetAdminToken(config.AdminToken)
+	webUI.SetAdminTokens(config.adminTokens())
 	if config.Token != "" {
 		m.SetTokenValidator(func(token string) bool { return token == config.Token })
 	}
+	if len(config.Teams) > 0 {
+		m.SetTeamMembers(config.teamMembers())
+	}
+	if cc := config.ClientConfig; cc != nil {
+		m.SetClientConfig(cc.update())
+	}
+
+	if resolver, err := clientip.NewResolver(config.TrustedProxies); err != nil {
+		logrus.WithError(err).Error("Invalid trusted proxies, forwarding headers will be ignored")
+	} else {
+		m.SetTrustedProxies(resolver)
+	}
+
+	if fa := config.ForwardAuth; fa != nil && fa.Address != "" {
+		m.SetForwardAuth(manager.NewForwardAuth(fa.Address, fa.AuthResponseHeaders, fa.Timeout))
+	}
+
+	if nf := config.NotFound; nf != nil {
+		if handler, err := manager.NewNotFoundHandler(nf.Mode, nf.URL); err != nil {
+			logrus.WithError(err).Error("Invalid not_found settings, serving the default 404 page")
+		} else {
+			m.SetNotFoundHandler(handler)
+		}
+	}
+
+	if pr := config.PathRouting; pr.enabled() {
+		m.SetPathRouting(&manager.PathRouting{Prefix: pr.Prefix, RewriteBase: pr.RewriteBase})
+	}
+
+	if h := config.Hedging; h != nil {
+		m.SetHedgePolicy(&manager.HedgePolicy{Delay: h.Delay, Budget: h.Budget})
+	}
+
+	if k := config.StreamKeepAlive; k != nil {
+		m.SetStreamKeepAlive(&tunnel.KeepAlive{Interval: k.Interval, Timeout: k.Timeout})
+	}
+
+	for subdomain, upload := range config.Uploads {
+		if upload != nil {
+			m.SetUploadEndpoint(subdomain, upload.endpoint())
+		}
+	}
+
+	for subdomain, headers := range config.ResponseHeaders {
+		m.SetResponseHeaders(subdomain, headers)
+	}
+
+	if i := config.Inspector; i != nil {
+		m.SetInspector(&manager.InspectorConfig{
+			Requests:      i.Requests,
+			MaxBody:       i.MaxBody,
+			RedactHeaders: i.RedactHeaders,
+		})
+	}
+
+	for subdomain, logs := range config.RequestLogs {
+		if err := m.SetRequestLogPolicy(subdomain, logs.policy()); err != nil {
+			logrus.WithError(err).WithField("subdomain", subdomain).Error("Invalid request log policy")
+		}
+	}
+
+	for subdomain, list := range config.BodyRewrites {
+		if err := m.SetBodyRewrites(subdomain, rewriteRules(list)); err != nil {
+			logrus.WithError(err).WithField("subdomain", subdomain).Error("Invalid body rewrite rules")
+		}
+	}
+
+	for subdomain, policy := range config.JWT {
+		m.SetJWTPolicy(subdomain, protocol.JWTPolicy{
+			Issuer:       policy.Issuer,
+			Audience:     policy.Audience,
+			JWKSURL:      policy.JWKSURL,
+			ClaimHeaders: policy.ClaimHeaders,
+		})
+	}
 
 	var limiter *ConnectionLimiter
 	if config.Limits != nil {
@@ -45,6 +160,12 @@ func NewServer(config *Config) *Server {
 			config.Limits.MaxConnectionsPerIP,
 			config.Limits.ConnectionRateLimit,
 		)
+		m.SetConnectionLifetime(config.Limits.MaxConnectionLifetime, config.Limits.RotationGrace)
+		m.SetMemoryLimits(&manager.MemoryLimits{
+			MaxStreams:          config.Limits.MaxStreams,
+			MaxBufferedBytes:    config.Limits.MaxBufferedBytes,
+			MaxCapturedRequests: config.Limits.MaxCapturedRequests,
+		})
 	}
 
 	s := &Server{
@@ -53,20 +174,137 @@ func NewServer(config *Config) *Server {
 		connManager: m,
 		connLimiter: limiter,
 	}
+	s.configureMTLS()
+	s.configureAuthorizedKeys()
+	s.configureSecrets()
 
 	return s
 }
 
+// Start runs the server until ctx is done or Shutdown is called. Signals
+// are left to the caller.
 func (s *Server) Start(ctx context.Context) error {
+	if err := s.config.checkRoot(); err != nil {
+		return err
+	}
+
+	stopped := make(chan struct{})
+	defer close(stopped)
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
+	s.runMu.Lock()
+	s.stop, s.stopped = cancel, stopped
+	s.runMu.Unlock()
 
-	go func() {
-		signal.WaitInterruptSignal()
-
-		logrus.Info("Received interrupt signal, shutting down")
-		cancel()
+	state, err := s.openState()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := state.Close(); err != nil {
+			logrus.WithError(err).Warn("Failed to close storage")
+		}
 	}()
+	s.state = state
+
+	s.startManagement(ctx)
+	s.startMetrics(ctx)
+
+	st, key, err := state.forFile(s.config.TunnelsFile, tunnelsKey)
+	if err != nil {
+		return err
+	}
+	if st != nil {
+		if err := s.connManager.LoadNamedTunnels(st, key); err != nil {
+			return err
+		}
+	}
+
+	if st, key, err = state.forFile(s.config.TokensFile, tokensKey); err != nil {
+		return err
+	}
+	if st != nil {
+		if err := s.connManager.LoadClientTokens(st, key); err != nil {
+			return err
+		}
+	}
+	if err := s.applyClientTokens(); err != nil {
+		return err
+	}
+
+	if st, key, err = state.forFile(s.config.UptimeFile, uptimeKey); err != nil {
+		return err
+	}
+	if err := s.connManager.LoadUptimeHistory(st, key, s.config.UptimeRetention); err != nil {
+		return err
+	}
+
+	if st, key, err = state.forFile(s.config.UsageFile, usageKey); err != nil {
+		return err
+	}
+	recorder, err := usage.New(st, key)
+	if err != nil {
+		return err
+	}
+	recorder.SetRetention(s.config.UsageRetention)
+	s.connManager.SetUsage(recorder)
+	go recorder.Run(ctx, usageFlushInterval)
+
+	if st, key, err = state.forFile(s.config.HistoryFile, historyKey); err != nil {
+		return err
+	}
+	history, err := timeseries.New(st, key, s.config.HistoryRetention)
+	if err != nil {
+		return err
+	}
+	s.connManager.SetHistory(history)
+	go history.Run(ctx, usageFlushInterval)
+
+	if i := s.config.Inspector; i != nil && i.Persist {
+		if err := s.connManager.LoadCaptures(state.shared, capturesKey); err != nil {
+			return err
+		}
+	}
+
+	if err := s.startStatsD(ctx); err != nil {
+		return err
+	}
+
+	if s.secrets != nil {
+		if err := s.refreshSecrets(ctx); err != nil {
+			return err
+		}
+		go s.secretsLoop(ctx)
+	}
+	if s.config.path != "" {
+		go s.reloadLoop(ctx)
+	}
+
+	// Bind every listener before dropping privileges, so low ports work.
+	httpServer := s.newHTTPServer()
+	s.ready.tls.Store(httpServer.TLSConfig != nil)
+	httpListener, err := s.listenHTTP(httpServer.Addr)
+	if err != nil {
+		return fmt.Errorf("failed to start http server: %w", err)
+	}
+	quicServer, err := gunnelquic.NewServerWithIdleTimeout(
+		portToAddr(s.config.quicBindAddress(), s.config.QuicPort),
+		s.config.ClientIdleTimeout,
+	)
+	if err != nil {
+		_ = httpListener.Close()
+		return fmt.Errorf("failed to start QUIC server: %w", err)
+	}
+	if err := s.dropPrivileges(); err != nil {
+		_ = httpListener.Close()
+		_ = quicServer.Close()
+		return err
+	}
+	if err := s.enterSandbox(); err != nil {
+		_ = httpListener.Close()
+		_ = quicServer.Close()
+		return err
+	}
 
 	s.startPprofIfEnabled(ctx)
 	errChan := make(chan error, 10)
@@ -74,16 +312,9 @@ func (s *Server) Start(ctx context.Context) error {
 	wg := &sync.WaitGroup{}
 	wg.Add(1)
 
-	httpServer := s.newHTTPServer()
 	go func() {
 		logrus.Infof("starting HTTP/S server on %s", httpServer.Addr)
-		var err error
-		if httpServer.TLSConfig != nil {
-			// cert and key are provided by the TLSConfig.GetCertificate function
-			err = httpServer.ListenAndServeTLS("", "")
-		} else {
-			err = httpServer.ListenAndServe()
-		}
+		err := s.serveHTTP(httpServer, httpListener)
 
 		if err != nil && !errors.Is(err, http.ErrServerClosed) {
 			errChan <- fmt.Errorf("failed to start http server: %w", err)
@@ -93,7 +324,7 @@ func (s *Server) Start(ctx context.Context) error {
 	go func() {
 		<-ctx.Done()
 		logrus.Info("Server context done, shutting down http server")
-		shutdownCtx, shutdownCancel := context.WithTimeout(ctx, 5*time.Second)
+		shutdownCtx, shutdownCancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
 		defer shutdownCancel()
 		if err := httpServer.Shutdown(shutdownCtx); err != nil {
 			logrus.WithError(err).Warn("http server shutdown error")
@@ -103,34 +334,90 @@ func (s *Server) Start(ctx context.Context) error {
 		}
 	}()
 
-	go s.StartQUICServer(ctx, errChan, wg)
+	go s.StartQUICServer(ctx, quicServer, wg)
 	go s.updater(ctx, errChan)
 
 	wg.Wait()
+	if err := recorder.Flush(); err != nil {
+		logrus.WithError(err).Error("Failed to save usage")
+	}
+	if err := history.Flush(); err != nil {
+		logrus.WithError(err).Error("Failed to save history")
+	}
+	if err := s.connManager.CloseUptimeHistory(); err != nil {
+		logrus.WithError(err).Error("Failed to save uptime history")
+	}
+	if err := s.connManager.FlushCaptures(); err != nil {
+		logrus.WithError(err).Error("Failed to save captured requests")
+	}
 	logrus.Info("Server stopped")
 	return nil
 }
 
+// Shutdown stops the server started with Start and waits until it has
+// stopped, or until ctx is done.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.runMu.Lock()
+	stop, stopped := s.stop, s.stopped
+	s.runMu.Unlock()
+	if stop == nil {
+		return nil
+	}
+	stop()
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// SetTokenValidator replaces the check of client tokens, e.g. with a
+// lookup in the embedding program's own user store. Call it before Start.
+func (s *Server) SetTokenValidator(valid func(token string) bool) {
+	s.connManager.SetTokenValidator(valid)
+}
+
+// HandlesHangup reports whether the server reloads its secrets or client
+// config on SIGHUP, so callers should not stop on that signal.
+func (s *Server) HandlesHangup() bool {
+	return s.secrets != nil || s.config.path != ""
+}
+
 func (s *Server) certInfo() *certmanager.CertReqInfo {
 	return &certmanager.CertReqInfo{
 		Domain:         s.config.Domain,
 		WildcardDomain: s.config.Cert.WildcardDomain,
 		Email:          s.config.Cert.Email,
 		SubdomainChecker: func(subdomain string) bool {
-			return s.connManager.HasKnownSubdomain(subdomain)
+			return s.connManager.HasKnownSubdomain(s.connManager.ResolveShareLink(subdomain))
 		},
 	}
 }
 
 func (s *Server) newHTTPServer() *http.Server {
-	addr := portToAddr(s.config.ServerPort)
+	addr := portToAddr(s.config.BindAddress, s.config.ServerPort)
 	server := &http.Server{
-		Addr:              addr,
-		Handler:           s.connManager,
-		ReadHeaderTimeout: 5 * time.Second,
-		ReadTimeout:       10 * time.Second,
-		WriteTimeout:      10 * time.Second,
-		IdleTimeout:       120 * time.Second,
+		Addr:    addr,
+		Handler: s.refuseBanned(s.connManager),
+	}
+	s.config.HTTP.apply(server)
+	if s.config.HTTP.maxHeaderReadsPerIP() > 0 {
+		server.Handler = releaseHeaderGate(server.Handler)
+		server.ConnContext = connContext
+	}
+
+	if s.secrets != nil && s.secrets.cert.Load() != nil {
+		logrus.Info("Using TLS certificate from secret store")
+		server.TLSConfig = &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: s.secrets.certificate,
+			NextProtos:     []string{"h2", "http/1.1"},
+		}
+		if len(s.config.MTLS) > 0 {
+			s.requireClientCerts(server.TLSConfig)
+		}
+		return server
 	}
 
 	if s.config.Cert.Enabled {
@@ -142,6 +429,9 @@ func (s *Server) newHTTPServer() *http.Server {
 		case err != nil:
 			logrus.WithError(err).Warn("TLS setup failed, continuing without TLS")
 		case tlsConfig != nil:
+			if len(s.config.MTLS) > 0 {
+				s.requireClientCerts(tlsConfig)
+			}
 			server.TLSConfig = tlsConfig
 		default:
 			logrus.Warn("Could not obtain any certificate, continuing without TLS")
@@ -161,6 +451,15 @@ func (s *Server) updater(ctx context.Context, errChan chan error) {
 		select {
 		case <-ticker.C:
 			s.webUI.UpdateStats()
+			s.connManager.UpdateTunnelStates()
+			s.connManager.ReportMemory()
+			s.connManager.ReportTCPLimits()
+			if err := s.connManager.FlushUptimeHistory(); err != nil {
+				logrus.WithError(err).Error("Failed to save uptime history")
+			}
+			if err := s.connManager.FlushCaptures(); err != nil {
+				logrus.WithError(err).Error("Failed to save captured requests")
+			}
 			if s.connLimiter != nil {
 				logrus.WithField("active_connections", s.connLimiter.ActiveConnections()).
 					Debug("Connection stats")
@@ -181,17 +480,15 @@ func (s *Server) updater(ctx context.Context, errChan chan error) {
 	}
 }
 
-func (s *Server) StartQUICServer(ctx context.Context, errChan chan error, wg *sync.WaitGroup) {
+// StartQUICServer accepts client connections on quicServer until ctx is
+// done, then closes it.
+func (s *Server) StartQUICServer(ctx context.Context, quicServer *gunnelquic.Server, wg *sync.WaitGroup) {
 	defer wg.Done()
 
-	quicServer, err := gunnelquic.NewServer(portToAddr(s.config.QuicPort))
-	if err != nil {
-		errChan <- fmt.Errorf("failed to start QUIC server: %w", err)
-		return
-	}
-
 	var closeOnce sync.Once
 	closeServer := func() {
+		// Tell the clients why before the listener drops their connections.
+		s.connManager.CloseAll(protocol.CloseServerShutdown, "server shutting down")
 		if err := quicServer.Close(); err != nil {
 			logrus.WithError(err).Warn("failed to close QUIC server")
 		}
@@ -204,6 +501,8 @@ func (s *Server) StartQUICServer(ctx context.Context, errChan chan error, wg *sy
 	}()
 
 	logrus.Infof("QUIC server started on %s", quicServer.Addr())
+	s.ready.quic.Store(true)
+	defer s.ready.quic.Store(false)
 	s.acceptQUICLoop(ctx, quicServer)
 }
 
@@ -211,37 +510,58 @@ func (s *Server) acceptQUICLoop(ctx context.Context, quicServer *gunnelquic.Serv
 	for {
 		conn, err := quicServer.Accept(ctx)
 		if err != nil {
-			if ctx.Err() != nil {
+			if ctx.Err() != nil || errors.Is(err, quic.ErrServerClosed) {
 				return
 			}
-			if !errors.Is(err, context.DeadlineExceeded) {
-				logrus.WithError(err).Error("Failed to accept client connection")
-			}
+			logging.Control.WithError(err).Error("Failed to accept client connection")
 			continue
 		}
-		s.handleQUICConn(ctx, conn)
+		// The client's first stream may come late, e.g. from a daemon that
+		// has no tunnel yet; waiting for it must not hold up the others.
+		go s.handleQUICConn(ctx, conn)
 	}
 }
 
 func (s *Server) handleQUICConn(ctx context.Context, conn *quic.Conn) {
 	remoteAddr := conn.RemoteAddr().String()
+	if s.connManager.IPBanned(remoteIP(conn.RemoteAddr())) {
+		logging.Control.WithField("remote_addr", remoteAddr).Warn("Connection rejected from banned IP")
+		code := quic.ApplicationErrorCode(protocol.CloseConnectionLimit)
+		if err := conn.CloseWithError(code, "address is banned"); err != nil {
+			logging.Control.WithError(err).Warn("Failed to close rejected connection")
+		}
+		return
+	}
 	if s.connLimiter != nil && !s.connLimiter.Acquire(remoteAddr) {
-		logrus.WithField("remote_addr", remoteAddr).Warn("Connection rejected by limiter")
-		if err := conn.CloseWithError(0, "connection limit exceeded"); err != nil {
-			logrus.WithError(err).Warn("Failed to close rejected connection")
+		logging.Control.WithField("remote_addr", remoteAddr).Warn("Connection rejected by limiter")
+		code := quic.ApplicationErrorCode(protocol.CloseConnectionLimit)
+		if err := conn.CloseWithError(code, "connection limit exceeded"); err != nil {
+			logging.Control.WithError(err).Warn("Failed to close rejected connection")
 		}
 		return
 	}
 
-	transp, err := transport.NewFromServer(ctx, conn)
+	transp, err := transport.NewFromServerWithPool(
+		ctx, conn, s.config.StreamPool.poolConfig(), s.config.Limits.maxMessageSize(),
+	)
 	if err != nil {
-		logrus.WithError(err).Error("Failed to create transport wrapper")
+		logging.Control.WithError(err).Error("Failed to create transport wrapper")
 		if s.connLimiter != nil {
 			s.connLimiter.Release(remoteAddr)
 		}
 		return
 	}
 
+	handshake := transp.Handshake()
+	logging.Control.WithFields(logrus.Fields{
+		"remote_addr":   remoteAddr,
+		"connection_id": transp.ID(),
+		"quic_version":  handshake.QUICVersion,
+		"alpn":          handshake.ALPN,
+		"cipher_suite":  handshake.CipherSuite,
+		"used_0rtt":     handshake.Used0RTT,
+	}).Debug("QUIC handshake completed")
+
 	go s.runQUICHandler(conn, remoteAddr, transp)
 }
 
@@ -251,7 +571,7 @@ func (s *Server) runQUICHandler(conn *quic.Conn, remoteAddr string, transp trans
 			s.connLimiter.Release(remoteAddr)
 		}
 		if err := conn.CloseWithError(0, ""); err != nil {
-			logrus.WithError(err).Warn("failed to close QUIC connection")
+			logging.Control.WithError(err).Warn("failed to close QUIC connection")
 		}
 	}()
 	s.connManager.HandleConnection(transp)
@@ -288,7 +608,7 @@ func (s *Server) startPprofIfEnabled(ctx context.Context) {
 
 	go func() {
 		<-ctx.Done()
-		shutdownCtx, shutdownCancel := context.WithTimeout(ctx, 5*time.Second)
+		shutdownCtx, shutdownCancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
 		defer shutdownCancel()
 		if err := srv.Shutdown(shutdownCtx); err != nil {
 			logrus.WithError(err).Warn("pprof server shutdown error")
@@ -296,6 +616,38 @@ func (s *Server) startPprofIfEnabled(ctx context.Context) {
 	}()
 }
 
-func portToAddr(port int) string {
-	return fmt.Sprintf(":%d", port)
+// listenHTTP listens on addr, expecting a PROXY protocol header on every
+// connection when enabled.
+func (s *Server) listenHTTP(addr string) (net.Listener, error) {
+	ln, err := s.config.Socket.Listen(context.Background(), addr)
+	if err != nil {
+		return nil, err
+	}
+	if s.config.ProxyProtocol {
+		trusted, err := clientip.ParseNets(s.config.ProxyProtocolTrusted)
+		if err != nil {
+			return nil, errors.Join(fmt.Errorf("proxy_protocol_trusted: %w", err), ln.Close())
+		}
+		ln = &proxyProtoListener{Listener: ln, trusted: trusted}
+	}
+	if maxPerIP := s.config.HTTP.maxHeaderReadsPerIP(); maxPerIP > 0 {
+		ln = &headerGateListener{Listener: ln, gate: newHeaderGate(maxPerIP)}
+	}
+	return ln, nil
+}
+
+// serveHTTP serves httpServer on ln until it is shut down.
+func (s *Server) serveHTTP(httpServer *http.Server, ln net.Listener) error {
+	s.ready.http.Store(true)
+	defer s.ready.http.Store(false)
+
+	if httpServer.TLSConfig != nil {
+		// cert and key are provided by the TLSConfig.GetCertificate function
+		return httpServer.ServeTLS(ln, "", "")
+	}
+	return httpServer.Serve(ln)
+}
+
+func portToAddr(host string, port int) string {
+	return net.JoinHostPort(host, strconv.Itoa(port))
 }
@@ -0,0 +1,51 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/snakeice/gunnel/pkg/metrics"
+)
+
+const defaultStatsDFlushInterval = time.Second
+
+func (c *StatsDConfig) validate() error {
+	switch metrics.Flavor(c.Flavor) {
+	case "", metrics.DogStatsD, metrics.Telegraf, metrics.PlainStatsD:
+	default:
+		return errors.New("statsd.flavor must be dogstatsd, telegraf or statsd")
+	}
+	if c.Address == "" {
+		return errors.New("statsd.address is required")
+	}
+	return nil
+}
+
+// startStatsD reports metrics to the configured StatsD agent until ctx is done.
+func (s *Server) startStatsD(ctx context.Context) error {
+	cfg := s.config.StatsD
+	if cfg == nil || cfg.Address == "" {
+		return nil
+	}
+
+	emitter, err := metrics.NewStatsD(cfg.Address, cfg.Prefix, metrics.Flavor(cfg.Flavor), cfg.Tags)
+	if err != nil {
+		return err
+	}
+	emitter.SetTenantLookup(s.connManager.Tenant)
+	metrics.EnableStatsD(emitter)
+
+	interval := cfg.FlushInterval
+	if interval <= 0 {
+		interval = defaultStatsDFlushInterval
+	}
+	go emitter.Run(ctx, interval)
+
+	logrus.WithFields(logrus.Fields{
+		"address": cfg.Address,
+		"flavor":  cfg.Flavor,
+	}).Info("Reporting metrics to StatsD")
+	return nil
+}
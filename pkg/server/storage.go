@@ -0,0 +1,99 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+	"github.com/snakeice/gunnel/pkg/store"
+)
+
+// Keys of the server state, also the file names used by the file driver.
+const (
+	tunnelsKey = "tunnels.json"
+	tokensKey  = "tokens.json"
+	usageKey   = "usage.json"
+	uptimeKey  = "uptime.json"
+	historyKey = "history.json"
+	// capturesKey only lives in the shared storage, see
+	// InspectorConfig.Persist.
+	capturesKey = "captures.json"
+)
+
+// stateStores tells where each kind of server state is kept: all of it in
+// the configured storage, or each kind in its own *_file. Kinds with neither
+// only live in memory.
+type stateStores struct {
+	shared store.Store
+	opened []store.Store
+}
+
+func (s *Server) openState() (*stateStores, error) {
+	if s.config.Storage == nil {
+		return &stateStores{}, nil
+	}
+
+	shared, err := store.Open(s.config.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	// Re-encrypt what older keys or no key sealed, so after a key rotation
+	// the previous key is only needed until the next start.
+	if encrypted, ok := shared.(*store.Encrypted); ok {
+		rewritten, err := encrypted.Rotate()
+		if err != nil {
+			_ = shared.Close()
+			return nil, fmt.Errorf("failed to re-encrypt storage: %w", err)
+		}
+		if rewritten > 0 {
+			logrus.WithField("values", rewritten).Info("Re-encrypted storage with the current key")
+		}
+	}
+	return &stateStores{shared: shared, opened: []store.Store{shared}}, nil
+}
+
+// forFile returns the store and key of one kind of state, configured as path
+// when no storage is set. The store is nil when the state is not persisted.
+func (st *stateStores) forFile(path, key string) (store.Store, string, error) {
+	if st.shared != nil {
+		return st.shared, key, nil
+	}
+	if path == "" {
+		return nil, key, nil
+	}
+
+	fileStore, fileKey, err := store.ForFile(path)
+	if err != nil {
+		return nil, "", err
+	}
+	st.opened = append(st.opened, fileStore)
+	return fileStore, fileKey, nil
+}
+
+func (st *stateStores) Close() error {
+	var err error
+	for _, s := range st.opened {
+		err = errors.Join(err, s.Close())
+	}
+	return err
+}
+
+// validateStorage rejects mixing storage with the per-kind files, so the
+// state is never split between them.
+func (c *Config) validateStorage() error {
+	if c.Storage == nil {
+		return nil
+	}
+	for _, path := range c.stateFiles() {
+		if path != "" {
+			return errors.New("storage replaces tunnels_file, tokens_file, usage_file, uptime_file and history_file")
+		}
+	}
+	return c.Storage.Validate()
+}
+
+// stateFiles lists the per-kind state files, empty when unset.
+func (c *Config) stateFiles() []string {
+	return []string{c.TunnelsFile, c.TokensFile, c.UsageFile, c.UptimeFile, c.HistoryFile}
+}
@@ -0,0 +1,77 @@
+package server_test
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/snakeice/gunnel/pkg/client"
+	"github.com/snakeice/gunnel/pkg/protocol"
+	"github.com/snakeice/gunnel/pkg/transport"
+)
+
+// quicRefused reports whether a registration over a new QUIC connection to
+// tun fails.
+func (tun *tunnel) quicRefused(t *testing.T) bool {
+	t.Helper()
+	transp, err := transport.New(tun.quic)
+	if err != nil {
+		return true
+	}
+	defer transp.Close()
+
+	stream := transp.Root()
+	reg := &protocol.ConnectionRegister{Subdomain: "other", Host: "127.0.0.1", Port: 1, Protocol: protocol.HTTP}
+	if err := stream.Send(reg); err != nil {
+		return true
+	}
+	_, err = stream.Receive()
+	return err != nil
+}
+
+func TestBannedIPIsRefusedEverywhere(t *testing.T) {
+	const banDuration = 2 * time.Second
+	port := freePort(t, "tcp")
+	tun := startTunnelWith(t, fmt.Sprintf(`tcp_ports:
+  min: %d
+  max: %d
+tcp_limits:
+  connections_per_minute: 1
+  ban_after: 1
+  ban_duration: %s
+`, port, port, banDuration), &client.BackendConfig{Host: "127.0.0.1", Port: 1, Subdomain: "demo", Protocol: "tcp"})
+
+	if tun.quicRefused(t) {
+		t.Fatal("QUIC registration refused before any ban")
+	}
+
+	// The second connection within a minute is refused, which bans the IP.
+	for range 2 {
+		conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+	}
+	banned := time.Now()
+	deadline := banned.Add(banDuration / 2)
+	for tun.do(t, http.MethodGet, "gunnel.localhost", "/api/stats", "", "").StatusCode != http.StatusForbidden {
+		if time.Now().After(deadline) {
+			t.Fatal("HTTP request from a banned IP was not refused")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if !tun.quicRefused(t) {
+		t.Error("QUIC connection from a banned IP was accepted")
+	}
+
+	time.Sleep(time.Until(banned.Add(banDuration + 200*time.Millisecond)))
+	if resp := tun.do(t, http.MethodGet, "gunnel.localhost", "/api/stats", "", ""); resp.StatusCode != http.StatusOK {
+		t.Errorf("HTTP request once the ban expired = %d, want 200", resp.StatusCode)
+	}
+	if tun.quicRefused(t) {
+		t.Error("QUIC registration refused once the ban expired")
+	}
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/snakeice/gunnel/pkg/manager"
+	"github.com/snakeice/gunnel/pkg/secret"
+)
+
+var errInvalidRole = errors.New(`role must be "viewer" or "admin"`)
+
+// TeamConfig groups the tokens of an organization. Tunnels registered with
+// any member's token are visible to the whole team in the WebUI.
+type TeamConfig struct {
+	Members []TeamMemberConfig `yaml:"members"`
+}
+
+// TeamMemberConfig is one client token of a team. Role is "viewer" (the
+// default), who can see and inspect tunnels, or "admin", who can also pause
+// and resume them.
+type TeamMemberConfig struct {
+	Name      string `yaml:"name"`
+	Token     string `yaml:"token"`
+	TokenFile string `yaml:"token_file"`
+	Role      string `yaml:"role"`
+}
+
+// validateTeams resolves the member tokens and checks that each identifies
+// a single member.
+func (c *Config) validateTeams() error {
+	seen := make(map[string]string)
+	for team, cfg := range c.Teams {
+		if cfg == nil || len(cfg.Members) == 0 {
+			return fmt.Errorf("teams.%s: at least one member is required", team)
+		}
+
+		for i := range cfg.Members {
+			member := &cfg.Members[i]
+			where := fmt.Sprintf("teams.%s.members[%d]", team, i)
+
+			token, err := secret.Resolve(member.Token, member.TokenFile)
+			if err != nil {
+				return fmt.Errorf("%s.token_file: %w", where, err)
+			}
+			if token == "" {
+				return fmt.Errorf("%s: token is required", where)
+			}
+			if other, ok := seen[token]; ok {
+				return fmt.Errorf("%s: token already used by %s", where, other)
+			}
+			seen[token] = where
+			member.Token = token
+
+			if member.Role == "" {
+				member.Role = string(manager.RoleViewer)
+			}
+			if !manager.Role(member.Role).Valid() {
+				return fmt.Errorf("%s: %w", where, errInvalidRole)
+			}
+		}
+	}
+	return nil
+}
+
+// teamMembers indexes the configured members by token.
+func (c *Config) teamMembers() map[string]manager.TeamMember {
+	members := make(map[string]manager.TeamMember)
+	for team, cfg := range c.Teams {
+		for _, member := range cfg.Members {
+			members[member.Token] = manager.TeamMember{
+				Team: team,
+				Name: member.Name,
+				Role: manager.Role(member.Role),
+			}
+		}
+	}
+	return members
+}
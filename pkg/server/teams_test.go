@@ -0,0 +1,126 @@
+package server_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/snakeice/gunnel/pkg/client"
+	"github.com/snakeice/gunnel/pkg/protocol"
+)
+
+// connect runs a client exposing backend with token, returning it once the
+// tunnel is up.
+func (tun *tunnel) connect(t *testing.T, token string, backend *client.BackendConfig) *client.Client {
+	t.Helper()
+	config := &client.Config{
+		ServerAddr:     tun.quic,
+		Token:          token,
+		MaxConnections: 1,
+		Backend:        map[string]*client.BackendConfig{backend.Subdomain: backend},
+	}
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	c, err := client.New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	up := make(chan struct{}, 1)
+	c.OnTunnelUp(func(string, string) {
+		select {
+		case up <- struct{}{}:
+		default:
+		}
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- c.Start(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	select {
+	case <-up:
+	case err := <-done:
+		t.Fatalf("client stopped before registering: %v", err)
+	case <-time.After(10 * time.Second):
+		t.Fatalf("tunnel %s did not come up", backend.Subdomain)
+	}
+	return c
+}
+
+func teamTunnels(t *testing.T, tun *tunnel, token string) []string {
+	t.Helper()
+	resp := tun.do(t, http.MethodGet, "gunnel.localhost", "/api/team/tunnels", token, "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("team tunnels = %d", resp.StatusCode)
+	}
+	var body struct {
+		Tunnels []struct {
+			Subdomain string `json:"subdomain"`
+		} `json:"tunnels"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	subdomains := make([]string, 0, len(body.Tunnels))
+	for _, tunnel := range body.Tunnels {
+		subdomains = append(subdomains, tunnel.Subdomain)
+	}
+	return subdomains
+}
+
+func TestFailedRegistrationDoesNotClaimSubdomain(t *testing.T) {
+	// The only TCP tunnel port is taken, so TCP registrations fail after
+	// the team checks.
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+	port := taken.Addr().(*net.TCPAddr).Port
+
+	t.Setenv("GUNNEL_TOKEN", "shared")
+	tun := startTunnel(t, fmt.Sprintf(`token: shared
+tcp_ports:
+  min: %d
+  max: %d
+teams:
+  blue:
+    members:
+      - name: bob
+        token: blue-token
+`, port, port), 1)
+
+	blue := tun.connect(t, "blue-token", &client.BackendConfig{
+		Host: "127.0.0.1", Port: 1, Subdomain: "blue-app", Protocol: "http",
+	})
+	if got := teamTunnels(t, tun, "blue-token"); len(got) != 1 || got[0] != "blue-app" {
+		t.Fatalf("team tunnels = %v, want [blue-app]", got)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err = blue.AddBackend(ctx, "demo", &client.BackendConfig{
+		Host: "127.0.0.1", Port: 1, Subdomain: "demo", Protocol: "tcp",
+	})
+	var rejected *client.RegistrationError
+	if !errors.As(err, &rejected) || rejected.Reason != protocol.RejectNoPort {
+		t.Fatalf("TCP registration without a free port = %v, want it refused", err)
+	}
+	if got := teamTunnels(t, tun, "blue-token"); len(got) != 1 || got[0] != "blue-app" {
+		t.Errorf("team tunnels = %v after a failed registration, want only [blue-app]", got)
+	}
+	resp := tun.do(t, http.MethodPost, "gunnel.localhost", "/api/team/tunnels/demo/pause", "blue-token", "")
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("pausing the tunnel of another client = %d, want 404", resp.StatusCode)
+	}
+}
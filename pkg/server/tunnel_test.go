@@ -0,0 +1,184 @@
+package server_test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/snakeice/gunnel/pkg/client"
+	"github.com/snakeice/gunnel/pkg/server"
+)
+
+func freePort(t *testing.T, network string) int {
+	t.Helper()
+	if network == "udp" {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		return conn.LocalAddr().(*net.UDPAddr).Port
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+// tunnel is a server and a client exposing one backend as demo.localhost.
+type tunnel struct {
+	srv    *server.Server
+	client *client.Client
+	// path is the config file of the server, url its HTTP listener and quic
+	// the address clients dial.
+	path string
+	url  string
+	quic string
+	// answered collects the requests the client answered.
+	answered *requestLog
+}
+
+// requestLog collects the requests a client answered.
+type requestLog struct {
+	mu      sync.Mutex
+	entries []client.RequestLog
+}
+
+func (l *requestLog) add(entry client.RequestLog) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries = append(l.entries, entry)
+}
+
+// statuses returns the status of every request answered so far.
+func (l *requestLog) statuses() []int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	statuses := make([]int, 0, len(l.entries))
+	for _, entry := range l.entries {
+		statuses = append(statuses, entry.Status)
+	}
+	return statuses
+}
+
+// startTunnel starts a server from the config file content and a client
+// exposing backendPort, returning them once the tunnel is up.
+func startTunnel(t *testing.T, content string, backendPort uint32) *tunnel {
+	t.Helper()
+	return startTunnelWith(t, content, &client.BackendConfig{
+		Host: "127.0.0.1", Port: backendPort, Subdomain: "demo", Protocol: "http",
+	})
+}
+
+// startTunnelWith is startTunnel with the client exposing backend, whose
+// subdomain must be demo.
+func startTunnelWith(t *testing.T, content string, backend *client.BackendConfig) *tunnel {
+	t.Helper()
+	t.Setenv("GUNNEL_INSECURE", "true")
+
+	httpPort, quicPort := freePort(t, "tcp"), freePort(t, "udp")
+	path := filepath.Join(t.TempDir(), "server.yaml")
+	content = fmt.Sprintf("domain: localhost\nbind_address: 127.0.0.1\nserver_port: %d\nquic_port: %d\n%s",
+		httpPort, quicPort, content)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	config := server.DefaultConfig()
+	if err := config.LoadConfig(path); err != nil {
+		t.Fatal(err)
+	}
+	config.AllowRoot = true
+
+	ctx, cancel := context.WithCancel(context.Background())
+	srv := server.NewServer(config)
+	srvDone := make(chan error, 1)
+	go func() { srvDone <- srv.Start(ctx) }()
+
+	clientConfig := &client.Config{
+		ServerAddr:     fmt.Sprintf("127.0.0.1:%d", quicPort),
+		MaxConnections: 1,
+		Backend:        map[string]*client.BackendConfig{"demo": backend},
+	}
+	if err := clientConfig.Validate(); err != nil {
+		cancel()
+		t.Fatal(err)
+	}
+	c, err := client.New(clientConfig)
+	if err != nil {
+		cancel()
+		t.Fatal(err)
+	}
+	answered := &requestLog{}
+	c.OnRequest(answered.add)
+	up := make(chan struct{}, 1)
+	c.OnTunnelUp(func(string, string) {
+		select {
+		case up <- struct{}{}:
+		default:
+		}
+	})
+
+	clientDone := make(chan error, 1)
+	go func() {
+		// The QUIC listener may not be up yet on the first attempts.
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			err := c.Start(ctx)
+			if err == nil || ctx.Err() != nil || time.Now().After(deadline) {
+				clientDone <- err
+				return
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-clientDone
+		<-srvDone
+	})
+
+	select {
+	case <-up:
+	case err := <-clientDone:
+		t.Fatalf("client stopped before registering: %v", err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("tunnel did not come up")
+	}
+	return &tunnel{
+		srv:    srv,
+		client: c,
+		path:   path,
+		url:    fmt.Sprintf("http://127.0.0.1:%d", httpPort),
+		quic:   clientConfig.ServerAddr,
+
+		answered: answered,
+	}
+}
+
+// do sends a request for host to the HTTP listener of tun.
+func (tun *tunnel) do(t *testing.T, method, host, path, token, body string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(method, tun.url+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = host
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
@@ -1,6 +1,7 @@
 package signal
 
 import (
+	"context"
 	"os"
 	"os/signal"
 	"syscall"
@@ -9,16 +10,35 @@ import (
 )
 
 func WaitInterruptSignal() {
+	waitSignal(syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+}
+
+// WaitShutdownSignal is WaitInterruptSignal without SIGHUP, for processes
+// that reload on hangup (see NotifyHangup).
+func WaitShutdownSignal() {
+	waitSignal(syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+}
+
+func waitSignal(signals ...os.Signal) {
 	signalChan := make(chan os.Signal, 1)
 
-	signal.Notify(signalChan,
-		syscall.SIGHUP,
-		syscall.SIGINT,
-		syscall.SIGTERM,
-		syscall.SIGQUIT)
+	signal.Notify(signalChan, signals...)
 
 	<-signalChan
 
 	// Perform cleanup actions here
 	logrus.Info("Received interrupt signal. Cleaning up...")
 }
+
+// NotifyHangup returns a channel that receives every SIGHUP until ctx is done.
+func NotifyHangup(ctx context.Context) <-chan os.Signal {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+
+	go func() {
+		<-ctx.Done()
+		signal.Stop(hangups)
+	}()
+
+	return hangups
+}
@@ -0,0 +1,119 @@
+// Package sockopt applies configurable TCP socket options to dialed and
+// accepted connections.
+package sockopt
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Options tunes TCP sockets. Zero values keep Go's defaults: Nagle's
+// algorithm disabled and keep-alive probes every 15s.
+type Options struct {
+	// NoDelay sets TCP_NODELAY; false batches small writes (Nagle).
+	NoDelay *bool `yaml:"nodelay"`
+	// KeepAlive is the keep-alive probe period; negative disables probes.
+	KeepAlive time.Duration `yaml:"keepalive"`
+	// ReadBuffer and WriteBuffer size the kernel socket buffers in bytes.
+	ReadBuffer  int `yaml:"read_buffer"`
+	WriteBuffer int `yaml:"write_buffer"`
+}
+
+// Validate reports options the kernel would reject.
+func (o *Options) Validate() error {
+	if o == nil {
+		return nil
+	}
+	if o.ReadBuffer < 0 || o.WriteBuffer < 0 {
+		return errors.New("socket buffer sizes must not be negative")
+	}
+	return nil
+}
+
+// Dialer returns a dialer with timeout whose connections get the options.
+func (o *Options) Dialer(timeout time.Duration) *net.Dialer {
+	d := &net.Dialer{Timeout: timeout}
+	if o != nil {
+		d.KeepAlive = o.KeepAlive
+	}
+	return d
+}
+
+// DialContext dials a TCP address and applies the options to the connection.
+func (o *Options) DialContext(ctx context.Context, addr string, timeout time.Duration) (net.Conn, error) {
+	conn, err := o.Dialer(timeout).DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if err := o.Apply(conn); err != nil {
+		if cerr := conn.Close(); cerr != nil {
+			logrus.WithError(cerr).Debug("Failed to close connection")
+		}
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Apply sets the options on conn; connections that are not TCP are left
+// untouched.
+func (o *Options) Apply(conn net.Conn) error {
+	tcp, ok := conn.(*net.TCPConn)
+	if o == nil || !ok {
+		return nil
+	}
+
+	if o.NoDelay != nil {
+		if err := tcp.SetNoDelay(*o.NoDelay); err != nil {
+			return err
+		}
+	}
+	if o.ReadBuffer > 0 {
+		if err := tcp.SetReadBuffer(o.ReadBuffer); err != nil {
+			return err
+		}
+	}
+	if o.WriteBuffer > 0 {
+		if err := tcp.SetWriteBuffer(o.WriteBuffer); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Listen listens on a TCP address; accepted connections get the options.
+func (o *Options) Listen(ctx context.Context, addr string) (net.Listener, error) {
+	lc := net.ListenConfig{}
+	if o != nil {
+		lc.KeepAlive = o.KeepAlive
+	}
+
+	ln, err := lc.Listen(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if o == nil {
+		return ln, nil
+	}
+	return &listener{Listener: ln, opts: o}, nil
+}
+
+type listener struct {
+	net.Listener
+	opts *Options
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if err := l.opts.Apply(conn); err != nil {
+		// The connection still works with the default options.
+		logrus.WithError(err).WithField("remote_addr", conn.RemoteAddr()).Debug("Failed to tune socket")
+	}
+	return conn, nil
+}
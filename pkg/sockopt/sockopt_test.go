@@ -0,0 +1,75 @@
+package sockopt_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/snakeice/gunnel/pkg/sockopt"
+)
+
+func TestListenAndDialApplyOptions(t *testing.T) {
+	noDelay := false
+	opts := &sockopt.Options{NoDelay: &noDelay, KeepAlive: time.Minute, ReadBuffer: 64 << 10, WriteBuffer: 64 << 10}
+	if err := opts.Validate(); err != nil {
+		t.Fatalf("Validate() error = %v", err)
+	}
+
+	ln, err := opts.Listen(context.Background(), "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	closeOnCleanup(t, ln)
+
+	accepted := make(chan error, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			err = conn.Close()
+		}
+		accepted <- err
+	}()
+
+	conn, err := opts.DialContext(context.Background(), ln.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatalf("DialContext() error = %v", err)
+	}
+	if err := conn.Close(); err != nil {
+		t.Errorf("Close() error = %v", err)
+	}
+	if err := <-accepted; err != nil {
+		t.Errorf("Accept() error = %v", err)
+	}
+}
+
+func TestValidateRejectsNegativeBuffers(t *testing.T) {
+	if err := (&sockopt.Options{ReadBuffer: -1}).Validate(); err == nil {
+		t.Error("Validate() accepted a negative buffer size")
+	}
+	if err := (*sockopt.Options)(nil).Validate(); err != nil {
+		t.Errorf("nil options: Validate() error = %v", err)
+	}
+}
+
+func TestApplyIgnoresNonTCP(t *testing.T) {
+	a, b := net.Pipe()
+	closeOnCleanup(t, a)
+	closeOnCleanup(t, b)
+
+	noDelay := true
+	if err := (&sockopt.Options{NoDelay: &noDelay}).Apply(a); err != nil {
+		t.Errorf("Apply() error = %v", err)
+	}
+}
+
+func closeOnCleanup(t *testing.T, c io.Closer) {
+	t.Helper()
+	t.Cleanup(func() {
+		if err := c.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+			t.Errorf("Close() error = %v", err)
+		}
+	})
+}
@@ -0,0 +1,83 @@
+package store
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+//nolint:gochecknoglobals // constant bucket name, []byte for the bolt API
+var boltBucket = []byte("gunnel")
+
+// Bolt keeps every key in one bucket of a bbolt database file. The file is
+// locked while open, so two servers cannot share it.
+type Bolt struct {
+	db *bolt.DB
+}
+
+// NewBolt opens or creates the database at path, giving up after
+// defaultTimeout when another process holds it.
+func NewBolt(path string) (*Bolt, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create store directory: %w", err)
+	}
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: defaultTimeout})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open bolt database: %w", err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltBucket)
+		return err
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return &Bolt{db: db}, nil
+}
+
+func (b *Bolt) Get(key string) ([]byte, error) {
+	var value []byte
+	err := b.db.View(func(tx *bolt.Tx) error {
+		// Values are only valid inside the transaction.
+		value = slices.Clone(tx.Bucket(boltBucket).Get([]byte(key)))
+		return nil
+	})
+	if err == nil && value == nil {
+		return nil, ErrNotFound
+	}
+	return value, err
+}
+
+func (b *Bolt) Put(key string, value []byte) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).Put([]byte(key), value)
+	})
+}
+
+func (b *Bolt) Delete(key string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).Delete([]byte(key))
+	})
+}
+
+// Keys walks the bucket from prefix, as bolt keeps keys sorted.
+func (b *Bolt) Keys(prefix string) ([]string, error) {
+	var keys []string
+	err := b.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltBucket).Cursor()
+		for k, _ := c.Seek([]byte(prefix)); k != nil && bytes.HasPrefix(k, []byte(prefix)); k, _ = c.Next() {
+			keys = append(keys, string(k))
+		}
+		return nil
+	})
+	return keys, err
+}
+
+func (b *Bolt) Close() error {
+	return b.db.Close()
+}
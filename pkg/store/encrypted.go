@@ -0,0 +1,191 @@
+package store
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sync/atomic"
+)
+
+// sealedMagic starts every value written by Encrypted, followed by the id of
+// the key, the nonce and the AES-GCM ciphertext.
+var sealedMagic = []byte("GNE1") //nolint:gochecknoglobals // constant byte prefix
+
+const keyIDLen = 4
+
+var (
+	// ErrUnknownKey is returned for values sealed with a key that is no
+	// longer configured.
+	ErrUnknownKey = errors.New("value is encrypted with an unknown key")
+	// ErrNotSealed is returned for unencrypted values once Rotate has
+	// sealed the store, since anyone able to write to it could plant them.
+	ErrNotSealed = errors.New("value is not encrypted")
+)
+
+type sealKey struct {
+	id   []byte
+	aead cipher.AEAD
+}
+
+// Encrypted seals the values of another store with AES-GCM. The first key
+// encrypts; the others only decrypt values written before a rotation.
+// Values that were stored unencrypted are read as they are until Rotate has
+// sealed them.
+type Encrypted struct {
+	inner Store
+	keys  []sealKey
+	// strict rejects unencrypted values, set once Rotate succeeded or by
+	// Config.StrictEncryption for stores that have been sealed before.
+	strict atomic.Bool
+}
+
+// ParseKey decodes a base64 AES key of 16, 24 or 32 bytes.
+func ParseKey(encoded string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key encoding: %w", err)
+	}
+	switch len(key) {
+	case 16, 24, 32:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("invalid key length %d, want 16, 24 or 32 bytes", len(key))
+	}
+}
+
+// NewEncrypted wraps inner so values are encrypted with keys[0].
+func NewEncrypted(inner Store, keys [][]byte) (*Encrypted, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("at least one encryption key is required")
+	}
+	e := &Encrypted{inner: inner}
+	for _, key := range keys {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(key)
+		e.keys = append(e.keys, sealKey{id: sum[:keyIDLen], aead: aead})
+	}
+	return e, nil
+}
+
+func (e *Encrypted) seal(key string, value []byte) ([]byte, error) {
+	active := e.keys[0]
+	nonce := make([]byte, active.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, 0, len(sealedMagic)+keyIDLen+len(nonce)+len(value)+active.aead.Overhead())
+	out = append(out, sealedMagic...)
+	out = append(out, active.id...)
+	out = append(out, nonce...)
+	// The store key is authenticated so sealed values cannot be swapped.
+	return active.aead.Seal(out, nonce, value, []byte(key)), nil
+}
+
+// open decrypts value and reports whether it was sealed with the active key.
+// Unencrypted values are returned as they are when allowPlain is set.
+func (e *Encrypted) open(key string, value []byte, allowPlain bool) ([]byte, bool, error) {
+	if !bytes.HasPrefix(value, sealedMagic) {
+		if !allowPlain {
+			return nil, false, fmt.Errorf("%w: %s", ErrNotSealed, key)
+		}
+		return value, false, nil
+	}
+	rest := value[len(sealedMagic):]
+	if len(rest) < keyIDLen {
+		return nil, false, errors.New("truncated encrypted value")
+	}
+
+	for i, k := range e.keys {
+		if !bytes.Equal(rest[:keyIDLen], k.id) {
+			continue
+		}
+		sealed := rest[keyIDLen:]
+		if len(sealed) < k.aead.NonceSize() {
+			return nil, false, errors.New("truncated encrypted value")
+		}
+		nonce, ciphertext := sealed[:k.aead.NonceSize()], sealed[k.aead.NonceSize():]
+		plain, err := k.aead.Open(nil, nonce, ciphertext, []byte(key))
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to decrypt %s: %w", key, err)
+		}
+		return plain, i == 0, nil
+	}
+	return nil, false, ErrUnknownKey
+}
+
+func (e *Encrypted) Get(key string) ([]byte, error) {
+	value, err := e.inner.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	plain, _, err := e.open(key, value, !e.strict.Load())
+	return plain, err
+}
+
+func (e *Encrypted) Put(key string, value []byte) error {
+	sealed, err := e.seal(key, value)
+	if err != nil {
+		return err
+	}
+	return e.inner.Put(key, sealed)
+}
+
+func (e *Encrypted) Delete(key string) error {
+	return e.inner.Delete(key)
+}
+
+func (e *Encrypted) Keys(prefix string) ([]string, error) {
+	return e.inner.Keys(prefix)
+}
+
+func (e *Encrypted) Close() error {
+	return e.inner.Close()
+}
+
+// Rotate re-encrypts every value not sealed with the active key, including
+// unencrypted ones unless the store is strict, and returns how many it
+// rewrote. Afterwards the older keys can be removed, and unencrypted values
+// are no longer read.
+func (e *Encrypted) Rotate() (int, error) {
+	keys, err := e.inner.Keys("")
+	if err != nil {
+		return 0, err
+	}
+
+	rewritten := 0
+	for _, key := range keys {
+		value, err := e.inner.Get(key)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return rewritten, err
+		}
+		plain, current, err := e.open(key, value, !e.strict.Load())
+		if err != nil {
+			return rewritten, err
+		}
+		if current {
+			continue
+		}
+		if err := e.Put(key, plain); err != nil {
+			return rewritten, err
+		}
+		rewritten++
+	}
+	e.strict.Store(true)
+	return rewritten, nil
+}
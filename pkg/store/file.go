@@ -0,0 +1,88 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+const tmpSuffix = ".tmp"
+
+// File keeps each key in its own file of a directory, replaced atomically
+// on every Put.
+type File struct {
+	dir string
+}
+
+// NewFile returns a store in dir, creating it if needed.
+func NewFile(dir string) (*File, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create store directory: %w", err)
+	}
+	return &File{dir: dir}, nil
+}
+
+func (f *File) path(key string) (string, error) {
+	if key == "" || strings.ContainsAny(key, `/\`) || !filepath.IsLocal(key) || strings.HasSuffix(key, tmpSuffix) {
+		return "", fmt.Errorf("invalid key %q", key)
+	}
+	return filepath.Join(f.dir, key), nil
+}
+
+func (f *File) Get(key string) ([]byte, error) {
+	path, err := f.path(key)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(filepath.Clean(path))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	return data, err
+}
+
+func (f *File) Put(key string, value []byte) error {
+	path, err := f.path(key)
+	if err != nil {
+		return err
+	}
+	tmp := path + tmpSuffix
+	if err := os.WriteFile(tmp, value, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (f *File) Delete(key string) error {
+	path, err := f.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (f *File) Keys(prefix string) ([]string, error) {
+	entries, err := os.ReadDir(f.dir)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(entries))
+	for _, e := range entries {
+		name := e.Name()
+		if e.Type().IsRegular() && strings.HasPrefix(name, prefix) && !strings.HasSuffix(name, tmpSuffix) {
+			keys = append(keys, name)
+		}
+	}
+	slices.Sort(keys)
+	return keys, nil
+}
+
+func (f *File) Close() error {
+	return nil
+}
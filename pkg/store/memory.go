@@ -0,0 +1,57 @@
+package store
+
+import (
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Memory keeps values in memory only, e.g. for tests and throwaway servers.
+type Memory struct {
+	mu     sync.RWMutex
+	values map[string][]byte
+}
+
+func NewMemory() *Memory {
+	return &Memory{values: map[string][]byte{}}
+}
+
+func (m *Memory) Get(key string) ([]byte, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	value, ok := m.values[key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return slices.Clone(value), nil
+}
+
+func (m *Memory) Put(key string, value []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.values[key] = slices.Clone(value)
+	return nil
+}
+
+func (m *Memory) Delete(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.values, key)
+	return nil
+}
+
+func (m *Memory) Keys(prefix string) ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	keys := slices.Sorted(maps.Keys(m.values))
+	return slices.DeleteFunc(keys, func(k string) bool { return !strings.HasPrefix(k, prefix) }), nil
+}
+
+func (m *Memory) Close() error {
+	return nil
+}
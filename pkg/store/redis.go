@@ -0,0 +1,112 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Redis stores keys in a Redis server. The client pools connections and
+// re-establishes them after network errors.
+type Redis struct {
+	client  *redis.Client
+	prefix  string
+	timeout time.Duration
+}
+
+// NewRedis connects to the server of c, failing early when it is
+// unreachable or rejects the credentials.
+func NewRedis(c *Config) (*Redis, error) {
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	r := &Redis{
+		client: redis.NewClient(&redis.Options{
+			Addr:         c.Address,
+			Password:     c.Password,
+			DB:           c.DB,
+			DialTimeout:  timeout,
+			ReadTimeout:  timeout,
+			WriteTimeout: timeout,
+		}),
+		prefix:  c.Prefix,
+		timeout: timeout,
+	}
+
+	ctx, cancel := r.context()
+	defer cancel()
+	if err := r.client.Ping(ctx).Err(); err != nil {
+		_ = r.client.Close()
+		return nil, fmt.Errorf("failed to connect to redis: %w", err)
+	}
+	return r, nil
+}
+
+// context bounds one operation by the configured timeout.
+func (r *Redis) context() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), r.timeout)
+}
+
+func (r *Redis) Get(key string) ([]byte, error) {
+	ctx, cancel := r.context()
+	defer cancel()
+
+	value, err := r.client.Get(ctx, r.prefix+key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, ErrNotFound
+	}
+	return value, err
+}
+
+func (r *Redis) Put(key string, value []byte) error {
+	ctx, cancel := r.context()
+	defer cancel()
+
+	return r.client.Set(ctx, r.prefix+key, value, 0).Err()
+}
+
+func (r *Redis) Delete(key string) error {
+	ctx, cancel := r.context()
+	defer cancel()
+
+	return r.client.Del(ctx, r.prefix+key).Err()
+}
+
+// Keys walks the keyspace with SCAN, so it does not block the server.
+func (r *Redis) Keys(prefix string) ([]string, error) {
+	ctx, cancel := r.context()
+	defer cancel()
+
+	var keys []string
+	iter := r.client.Scan(ctx, 0, globEscape(r.prefix+prefix)+"*", 100).Iterator()
+	for iter.Next(ctx) {
+		keys = append(keys, strings.TrimPrefix(iter.Val(), r.prefix))
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+	// SCAN may return a key more than once.
+	slices.Sort(keys)
+	return slices.Compact(keys), nil
+}
+
+func (r *Redis) Close() error {
+	return r.client.Close()
+}
+
+func globEscape(s string) string {
+	var b strings.Builder
+	for _, c := range s {
+		if strings.ContainsRune(`*?[]\`, c) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
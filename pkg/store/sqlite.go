@@ -0,0 +1,83 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// SQLite keeps keys in a table of an SQLite database file.
+type SQLite struct {
+	db *sql.DB
+}
+
+// NewSQLite opens or creates the database at path. It needs a build with
+// cgo; otherwise it returns ErrUnsupported.
+func NewSQLite(path string) (*SQLite, error) {
+	if !sqliteSupported {
+		return nil, fmt.Errorf("sqlite driver: %w", ErrUnsupported)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create store directory: %w", err)
+	}
+	// WAL lets readers run during a write; the busy timeout makes writers
+	// from other processes wait instead of failing.
+	dsn := fmt.Sprintf("%s?_journal_mode=WAL&_busy_timeout=%d", path, defaultTimeout.Milliseconds())
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open sqlite database: %w", err)
+	}
+	// One connection serializes writes within the process.
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS kv (key TEXT PRIMARY KEY, value BLOB NOT NULL)`); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("failed to open sqlite database: %w", err)
+	}
+	return &SQLite{db: db}, nil
+}
+
+func (s *SQLite) Get(key string) ([]byte, error) {
+	var value []byte
+	err := s.db.QueryRow(`SELECT value FROM kv WHERE key = ?`, key).Scan(&value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	return value, err
+}
+
+func (s *SQLite) Put(key string, value []byte) error {
+	_, err := s.db.Exec(`INSERT INTO kv (key, value) VALUES (?, ?)
+		ON CONFLICT (key) DO UPDATE SET value = excluded.value`, key, value)
+	return err
+}
+
+func (s *SQLite) Delete(key string) error {
+	_, err := s.db.Exec(`DELETE FROM kv WHERE key = ?`, key)
+	return err
+}
+
+// Keys compares prefixes with substr rather than LIKE, which would need
+// escaping and ignores case.
+func (s *SQLite) Keys(prefix string) ([]string, error) {
+	rows, err := s.db.Query(`SELECT key FROM kv WHERE substr(key, 1, length(?1)) = ?1 ORDER BY key`, prefix)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+func (s *SQLite) Close() error {
+	return s.db.Close()
+}
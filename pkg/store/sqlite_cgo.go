@@ -0,0 +1,10 @@
+//go:build cgo
+
+package store
+
+import (
+	// Registers the sqlite3 database/sql driver.
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const sqliteSupported = true
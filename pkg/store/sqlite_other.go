@@ -0,0 +1,6 @@
+//go:build !cgo
+
+package store
+
+// go-sqlite3 wraps the C library, so builds without cgo lack the driver.
+const sqliteSupported = false
@@ -0,0 +1,159 @@
+// Package store is the key-value storage behind the server's persistent
+// state (named tunnels, usage, uptime and traffic history), so a deployment
+// picks one backend for all of it.
+package store
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"time"
+)
+
+var (
+	// ErrNotFound is returned by Get for missing keys.
+	ErrNotFound = errors.New("key not found")
+	// ErrUnsupported is returned for drivers this build lacks.
+	ErrUnsupported = errors.New("not supported by this build")
+)
+
+// Store holds small JSON documents by key. Implementations are safe for
+// concurrent use.
+type Store interface {
+	// Get returns the value of key or ErrNotFound.
+	Get(key string) ([]byte, error)
+	// Put replaces the value of key atomically.
+	Put(key string, value []byte) error
+	// Delete removes key; missing keys are not an error.
+	Delete(key string) error
+	// Keys lists the keys starting with prefix, sorted.
+	Keys(prefix string) ([]string, error)
+	Close() error
+}
+
+// Drivers.
+const (
+	DriverFile   = "file"
+	DriverMemory = "memory"
+	DriverRedis  = "redis"
+	DriverBolt   = "bolt"
+	DriverSQLite = "sqlite"
+)
+
+// defaultTimeout bounds each operation against a remote store.
+const defaultTimeout = 5 * time.Second
+
+// Config selects and configures a store.
+type Config struct {
+	// Driver is file (default), memory, redis, bolt or sqlite.
+	Driver string `yaml:"driver"`
+	// Path is the directory of the file driver, where each key is a file,
+	// or the database file of the bolt and sqlite drivers.
+	Path string `yaml:"path"`
+	// Address, Password and DB locate the Redis server; Prefix is prepended
+	// to every key so several servers can share it.
+	Address  string `yaml:"address"`
+	Password string `yaml:"password"`
+	DB       int    `yaml:"db"`
+	Prefix   string `yaml:"prefix"`
+	// Timeout bounds each Redis command (5s by default).
+	Timeout time.Duration `yaml:"timeout"`
+	// EncryptionKeys are base64 AES keys sealing every value with AES-GCM.
+	// The first one encrypts, the others decrypt values written before a
+	// rotation.
+	EncryptionKeys []string `yaml:"encryption_keys"`
+	// StrictEncryption refuses unencrypted values from the start, instead
+	// of encrypting them on open, once the store is known to be sealed.
+	StrictEncryption bool `yaml:"strict_encryption"`
+}
+
+// Validate checks that the driver is known and has what it needs.
+func (c *Config) Validate() error {
+	switch c.Driver {
+	case "", DriverFile:
+		if c.Path == "" {
+			return errors.New("the file driver needs a path")
+		}
+	case DriverBolt, DriverSQLite:
+		if c.Path == "" {
+			return fmt.Errorf("the %s driver needs a path", c.Driver)
+		}
+		if c.Driver == DriverSQLite && !sqliteSupported {
+			return fmt.Errorf("the sqlite driver needs a build with cgo: %w", ErrUnsupported)
+		}
+	case DriverMemory:
+	case DriverRedis:
+		if c.Address == "" {
+			return errors.New("the redis driver needs an address")
+		}
+		if c.DB < 0 || c.Timeout < 0 {
+			return errors.New("db and timeout must not be negative")
+		}
+	default:
+		return fmt.Errorf("unknown driver %q", c.Driver)
+	}
+	if c.StrictEncryption && len(c.EncryptionKeys) == 0 {
+		return errors.New("strict_encryption needs encryption_keys")
+	}
+	_, err := c.keys()
+	return err
+}
+
+func (c *Config) keys() ([][]byte, error) {
+	keys := make([][]byte, 0, len(c.EncryptionKeys))
+	for i, encoded := range c.EncryptionKeys {
+		key, err := ParseKey(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("encryption_keys[%d]: %w", i, err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// Open connects to the store described by c, encrypting values when it has
+// encryption keys.
+func Open(c *Config) (Store, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+
+	var s Store
+	var err error
+	switch c.Driver {
+	case DriverMemory:
+		s = NewMemory()
+	case DriverRedis:
+		s, err = NewRedis(c)
+	case DriverBolt:
+		s, err = NewBolt(c.Path)
+	case DriverSQLite:
+		s, err = NewSQLite(c.Path)
+	default:
+		s, err = NewFile(c.Path)
+	}
+	if err != nil || len(c.EncryptionKeys) == 0 {
+		return s, err
+	}
+
+	keys, err := c.keys()
+	if err != nil {
+		return nil, err
+	}
+	encrypted, err := NewEncrypted(s, keys)
+	if err != nil {
+		return nil, err
+	}
+	encrypted.strict.Store(c.StrictEncryption)
+	return encrypted, nil
+}
+
+// ForFile returns a file store holding the document at path and the key to
+// read it with, for state configured as a single file.
+func ForFile(path string) (Store, string, error) {
+	s, err := NewFile(filepath.Dir(path))
+	if err != nil {
+		return nil, "", err
+	}
+	return s, filepath.Base(path), nil
+}
@@ -0,0 +1,200 @@
+package store_test
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/snakeice/gunnel/pkg/store"
+)
+
+// checkStored verifies the state TestStores leaves in s.
+func checkStored(t *testing.T, s store.Store) {
+	t.Helper()
+	value, err := s.Get("usage.json")
+	if err != nil || string(value) != `{"key":"usage.json"}` {
+		t.Fatalf("Get = %q, %v", value, err)
+	}
+	if _, err := s.Get("tunnels.json"); !errors.Is(err, store.ErrNotFound) {
+		t.Fatalf("Get of a deleted key = %v, want ErrNotFound", err)
+	}
+	keys, err := s.Keys("u")
+	if err != nil || strings.Join(keys, ",") != "u*[x].json,uptime.json,usage.json" {
+		t.Fatalf("Keys = %v, %v", keys, err)
+	}
+	keys, err = s.Keys("u*")
+	if err != nil || strings.Join(keys, ",") != "u*[x].json" {
+		t.Fatalf("Keys with glob characters = %v, %v", keys, err)
+	}
+}
+
+func TestStores(t *testing.T) {
+	redisServer := miniredis.RunT(t)
+	redisServer.RequireAuth("secret")
+
+	backends := []struct {
+		name string
+		open func(dir string) (store.Store, error)
+		// durable stores keep their values when reopened.
+		durable bool
+	}{
+		{"memory", func(string) (store.Store, error) { return store.NewMemory(), nil }, false},
+		{"file", func(dir string) (store.Store, error) { return store.NewFile(dir) }, true},
+		{"redis", func(string) (store.Store, error) {
+			return store.NewRedis(&store.Config{Address: redisServer.Addr(), Password: "secret", Prefix: "gunnel:"})
+		}, true},
+		{"bolt", func(dir string) (store.Store, error) { return store.NewBolt(filepath.Join(dir, "state.db")) }, true},
+		{"sqlite", func(dir string) (store.Store, error) { return store.NewSQLite(filepath.Join(dir, "state.db")) }, true},
+	}
+
+	for _, backend := range backends {
+		t.Run(backend.name, func(t *testing.T) {
+			dir := t.TempDir()
+			s, err := backend.open(dir)
+			if errors.Is(err, store.ErrUnsupported) {
+				t.Skip(err)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := s.Get("usage.json"); !errors.Is(err, store.ErrNotFound) {
+				t.Fatalf("Get of a missing key = %v, want ErrNotFound", err)
+			}
+			for _, key := range []string{"usage.json", "uptime.json", "tunnels.json", "u*[x].json"} {
+				if err := s.Put(key, []byte(`{"key":"`+key+`"}`)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := s.Put("usage.json", []byte(`{"key":"usage.json"}`)); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Delete("tunnels.json"); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Delete("missing.json"); err != nil {
+				t.Fatalf("Delete of a missing key = %v", err)
+			}
+			checkStored(t, s)
+			if err := s.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if !backend.durable {
+				return
+			}
+
+			s, err = backend.open(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			checkStored(t, s)
+		})
+	}
+}
+
+func TestRedisRejectsWrongPassword(t *testing.T) {
+	redisServer := miniredis.RunT(t)
+	redisServer.RequireAuth("secret")
+	if _, err := store.NewRedis(&store.Config{Address: redisServer.Addr(), Password: "wrong"}); err == nil {
+		t.Fatal("NewRedis accepted a wrong password")
+	}
+}
+
+func TestEncryptedRotation(t *testing.T) {
+	oldKey, newKey := bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 32)
+	inner := store.NewMemory()
+	if err := inner.Put("plain.json", []byte(`{"legacy":true}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	old, err := store.NewEncrypted(inner, [][]byte{oldKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := old.Put("capture.json", []byte(`{"secret":"whsec_123"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if raw, _ := inner.Get("capture.json"); bytes.Contains(raw, []byte("whsec_123")) {
+		t.Fatal("value stored in clear text")
+	}
+
+	rotated, err := store.NewEncrypted(inner, [][]byte{newKey, oldKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := rotated.Rotate(); err != nil || n != 2 {
+		t.Fatalf("Rotate = %d, %v, want 2 values rewritten", n, err)
+	}
+
+	current, err := store.NewEncrypted(inner, [][]byte{newKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]string{"plain.json": `{"legacy":true}`, "capture.json": `{"secret":"whsec_123"}`} {
+		if value, err := current.Get(key); err != nil || string(value) != want {
+			t.Fatalf("Get(%s) = %q, %v", key, value, err)
+		}
+	}
+	if _, err := old.Get("capture.json"); !errors.Is(err, store.ErrUnknownKey) {
+		t.Fatalf("Get with the retired key = %v, want ErrUnknownKey", err)
+	}
+}
+
+func TestEncryptedRejectsPlaintextAfterRotate(t *testing.T) {
+	inner := store.NewMemory()
+	if err := inner.Put("legacy.json", []byte(`{"legacy":true}`)); err != nil {
+		t.Fatal(err)
+	}
+	encrypted, err := store.NewEncrypted(inner, [][]byte{bytes.Repeat([]byte{1}, 32)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := encrypted.Get("legacy.json"); err != nil {
+		t.Fatalf("Get before Rotate = %v, want the unencrypted value", err)
+	}
+	if _, err := encrypted.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Someone with write access to the store plants a value.
+	if err := inner.Put("tokens.json", []byte(`[{"name":"evil"}]`)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := encrypted.Get("tokens.json"); !errors.Is(err, store.ErrNotSealed) {
+		t.Fatalf("Get of a planted value = %v, want ErrNotSealed", err)
+	}
+	if value, err := encrypted.Get("legacy.json"); err != nil || string(value) != `{"legacy":true}` {
+		t.Fatalf("Get(legacy.json) = %q, %v", value, err)
+	}
+}
+
+func TestStrictEncryptionRefusesPlaintextOnOpen(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "tokens.json"), []byte(`[]`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := store.Open(&store.Config{
+		Path:             dir,
+		EncryptionKeys:   []string{base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))},
+		StrictEncryption: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	encrypted, ok := s.(*store.Encrypted)
+	if !ok {
+		t.Fatalf("Open returned %T, want *store.Encrypted", s)
+	}
+	if _, err := encrypted.Rotate(); !errors.Is(err, store.ErrNotSealed) {
+		t.Fatalf("Rotate = %v, want ErrNotSealed", err)
+	}
+}
@@ -0,0 +1,32 @@
+package subdomain
+
+import (
+	"fmt"
+	"math/rand/v2"
+)
+
+// Word lists of Random, picked to be short, easy to spell and harmless in
+// any combination.
+//
+//nolint:gochecknoglobals // read-only lists
+var (
+	adjectives = []string{
+		"bold", "brave", "bright", "calm", "clever", "cosmic", "crisp", "eager",
+		"fancy", "fast", "gentle", "happy", "jolly", "keen", "kind", "lively",
+		"lucky", "merry", "mighty", "misty", "noble", "polite", "proud", "quick",
+		"quiet", "rapid", "shiny", "silent", "sunny", "swift", "witty", "zesty",
+	}
+	animals = []string{
+		"badger", "beaver", "bison", "camel", "crane", "dolphin", "eagle", "falcon",
+		"ferret", "gecko", "heron", "ibis", "jaguar", "koala", "lemur", "lynx",
+		"marmot", "moose", "newt", "otter", "owl", "panda", "puffin", "quokka",
+		"raven", "robin", "salmon", "seal", "tapir", "tiger", "walrus", "yak",
+	}
+)
+
+// Random returns a memorable valid name such as "bold-otter-42", for tunnels
+// registered without a subdomain. It is not unique: callers check it is free.
+func Random() string {
+	return fmt.Sprintf("%s-%s-%d",
+		adjectives[rand.N(len(adjectives))], animals[rand.N(len(animals))], rand.N(100))
+}
@@ -0,0 +1,157 @@
+// Package subdomain normalizes and validates the subdomain names tunnels
+// register under.
+package subdomain
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/idna"
+)
+
+const (
+	// MaxLength is the longest DNS label.
+	MaxLength = 63
+	// acePrefix starts the ASCII form of internationalized labels.
+	acePrefix = "xn--"
+)
+
+var (
+	// ErrInvalid is returned for names that are not DNS-safe labels.
+	ErrInvalid = errors.New("invalid subdomain")
+	// ErrReserved is returned for names the server keeps for itself.
+	ErrReserved = errors.New("subdomain is reserved")
+	// ErrConfusable is returned for names that imitate another name with
+	// look-alike characters, e.g. a Cyrillic "а" or "adm1n".
+	ErrConfusable = errors.New("subdomain is confusable with another name")
+)
+
+// Reserved lists the names no tunnel may register.
+//
+//nolint:gochecknoglobals // read-only list
+var Reserved = []string{"gunnel", "www", "admin", "api"}
+
+// confusables maps non-ASCII letters to the lowercase ASCII letter they are
+// drawn like.
+//
+//nolint:gochecknoglobals // read-only table
+var confusables = map[rune]rune{
+	'а': 'a', 'с': 'c', 'ԁ': 'd', 'е': 'e', 'һ': 'h', 'і': 'i', 'ј': 'j', 'о': 'o', 'р': 'p',
+	'ԛ': 'q', 'ѕ': 's', 'у': 'y', 'х': 'x', 'ԝ': 'w', 'α': 'a', 'ι': 'i', 'ν': 'v', 'ο': 'o',
+	'ρ': 'p', 'υ': 'u', 'χ': 'x', 'ı': 'i',
+}
+
+// skeletonReplacer folds digits and letter pairs drawn like a letter, so
+// "adm0n" and "vvww" compare equal to the names they imitate. A 1 stands for
+// an i or an l, which looksLike handles.
+//
+//nolint:gochecknoglobals // read-only replacer
+var skeletonReplacer = strings.NewReplacer(
+	"0", "o", "3", "e", "5", "s", "rn", "m", "vv", "w",
+)
+
+// looksLike reports whether name imitates reserved with look-alike digits
+// and letter pairs.
+func looksLike(name, reserved string) bool {
+	name, reserved = skeletonReplacer.Replace(name), skeletonReplacer.Replace(reserved)
+	if len(name) != len(reserved) {
+		return false
+	}
+	for i := range len(name) {
+		if name[i] != reserved[i] && (name[i] != '1' || (reserved[i] != 'i' && reserved[i] != 'l')) {
+			return false
+		}
+	}
+	return true
+}
+
+// Normalize lowercases name, converts internationalized names to punycode and
+// checks the result is a DNS label of letters, digits and inner hyphens that
+// is neither reserved nor imitating a reserved name. Errors wrap ErrInvalid,
+// ErrReserved or ErrConfusable.
+func Normalize(name string) (string, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "" {
+		return "", fmt.Errorf("%w: name is empty", ErrInvalid)
+	}
+
+	name, err := toASCII(name)
+	if err != nil {
+		return "", err
+	}
+
+	switch {
+	case len(name) > MaxLength:
+		return "", fmt.Errorf("%w: longer than %d characters", ErrInvalid, MaxLength)
+	case name[0] == '-' || name[len(name)-1] == '-':
+		return "", fmt.Errorf("%w: %q starts or ends with a hyphen", ErrInvalid, name)
+	}
+
+	for _, r := range name {
+		if (r < 'a' || r > 'z') && (r < '0' || r > '9') && r != '-' {
+			return "", fmt.Errorf("%w: %q may only contain a-z, 0-9 and hyphens", ErrInvalid, name)
+		}
+	}
+
+	if slices.Contains(Reserved, name) {
+		return "", fmt.Errorf("%w: %q", ErrReserved, name)
+	}
+	for _, reserved := range Reserved {
+		if looksLike(name, reserved) {
+			return "", fmt.Errorf("%w: %q looks like %q", ErrConfusable, name, reserved)
+		}
+	}
+
+	return name, nil
+}
+
+// toASCII converts an internationalized label to its punycode (xn--) form.
+// Labels already in that form are decoded to check them. Look-alikes of ASCII
+// letters are refused either way.
+func toASCII(name string) (string, error) {
+	label := name
+	if strings.HasPrefix(name, acePrefix) {
+		decoded, err := idna.Lookup.ToUnicode(name)
+		if err != nil {
+			return "", fmt.Errorf("%w: %q: %w", ErrInvalid, name, err)
+		}
+		label = decoded
+	} else if isASCII(name) {
+		return name, nil
+	}
+
+	for _, r := range label {
+		if isConfusable(r) {
+			return "", fmt.Errorf("%w: %q contains the look-alike character %q", ErrConfusable, label, r)
+		}
+	}
+
+	ascii, err := idna.Lookup.ToASCII(label)
+	if err != nil {
+		return "", fmt.Errorf("%w: %q: %w", ErrInvalid, label, err)
+	}
+	if strings.Contains(ascii, ".") {
+		return "", fmt.Errorf("%w: %q is not a single label", ErrInvalid, label)
+	}
+	return ascii, nil
+}
+
+func isASCII(s string) bool {
+	for i := range len(s) {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+func isConfusable(r rune) bool {
+	if _, ok := confusables[r]; ok {
+		return true
+	}
+	// Fullwidth forms of ASCII letters and digits.
+	return (r >= 'ａ' && r <= 'ｚ') || (r >= '０' && r <= '９')
+}
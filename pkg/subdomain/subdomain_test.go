@@ -0,0 +1,68 @@
+package subdomain_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/snakeice/gunnel/pkg/subdomain"
+)
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+		err  error
+	}{
+		{"MyApp", "myapp", nil},
+		{" api-v2 ", "api-v2", nil},
+		{"a", "a", nil},
+		{"", "", subdomain.ErrInvalid},
+		{"-app", "", subdomain.ErrInvalid},
+		{"app-", "", subdomain.ErrInvalid},
+		{"my_app", "", subdomain.ErrInvalid},
+		{"my.app", "", subdomain.ErrInvalid},
+		{strings.Repeat("a", subdomain.MaxLength+1), "", subdomain.ErrInvalid},
+		{"Admin", "", subdomain.ErrReserved},
+		{"www", "", subdomain.ErrReserved},
+		{"аpple", "", subdomain.ErrConfusable}, // Cyrillic а
+		{"ａpp", "", subdomain.ErrConfusable},   // fullwidth a
+		{"adm1n", "", subdomain.ErrConfusable},
+		{"gunne1", "", subdomain.ErrConfusable},
+		{"vvww", "", subdomain.ErrConfusable},
+		{"ap1", "", subdomain.ErrConfusable},
+		{"adrnin", "", subdomain.ErrConfusable},
+		{"apl", "apl", nil},
+		{"a-p-i", "a-p-i", nil},
+		{"ad-min", "ad-min", nil},
+		{"gunnei", "gunnei", nil},
+		{"api1", "api1", nil},
+		{"мяч", "xn--l1awx", nil}, // Cyrillic letters not drawn like ASCII ones
+		{"Café", "xn--caf-dma", nil},
+		{"xn--mnchen-3ya", "xn--mnchen-3ya", nil},
+		{"xn--zz", "", subdomain.ErrInvalid},
+		{"xn--pple-43d", "", subdomain.ErrConfusable}, // punycode of the Cyrillic аpple
+		{"a.b", "", subdomain.ErrInvalid},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := subdomain.Normalize(tt.name)
+			if !errors.Is(err, tt.err) || (tt.err == nil && err != nil) {
+				t.Fatalf("Normalize(%q) error = %v, want %v", tt.name, err, tt.err)
+			}
+			if got != tt.want {
+				t.Errorf("Normalize(%q) = %q, want %q", tt.name, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRandom(t *testing.T) {
+	for range 100 {
+		name := subdomain.Random()
+		if normalized, err := subdomain.Normalize(name); err != nil || normalized != name {
+			t.Fatalf("Random() = %q, which normalizes to %q, %v", name, normalized, err)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+// Package timeseries keeps per-tunnel request counters in one minute buckets
+// and persists them, so charts survive restarts.
+package timeseries
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/snakeice/gunnel/pkg/store"
+)
+
+// DefaultRetention is how long buckets are kept by default.
+const DefaultRetention = 24 * time.Hour
+
+// Point holds the traffic of one tunnel, or of all of them, during a step.
+type Point struct {
+	Time     time.Time `json:"time"`
+	Requests uint64    `json:"requests"`
+	Errors   uint64    `json:"errors"`
+	BytesIn  uint64    `json:"bytes_in"`
+	BytesOut uint64    `json:"bytes_out"`
+}
+
+func (p *Point) add(other *Point) {
+	p.Requests += other.Requests
+	p.Errors += other.Errors
+	p.BytesIn += other.BytesIn
+	p.BytesOut += other.BytesOut
+}
+
+// Store aggregates requests per subdomain and minute and periodically saves
+// them.
+type Store struct {
+	mu        sync.Mutex
+	store     store.Store
+	key       string
+	retention time.Duration
+	// series maps subdomain -> unix minute -> counters.
+	series map[string]map[int64]*Point
+	dirty  bool
+}
+
+// New returns a store persisting to key of st, loading the buckets already
+// saved there and keeping them for retention (DefaultRetention when zero).
+// With a nil st the buckets only live in memory.
+func New(st store.Store, key string, retention time.Duration) (*Store, error) {
+	if retention <= 0 {
+		retention = DefaultRetention
+	}
+	s := &Store{store: st, key: key, retention: retention, series: map[string]map[int64]*Point{}}
+	if st == nil {
+		return s, nil
+	}
+
+	data, err := st.Get(key)
+	if errors.Is(err, store.ErrNotFound) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read history: %w", err)
+	}
+
+	var saved map[string][]*Point
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, fmt.Errorf("failed to parse history: %w", err)
+	}
+	for subdomain, points := range saved {
+		buckets := make(map[int64]*Point, len(points))
+		for _, p := range points {
+			if p != nil {
+				buckets[p.Time.Unix()/60] = p
+			}
+		}
+		s.series[subdomain] = buckets
+	}
+	return s, nil
+}
+
+// Record accounts one proxied request of subdomain.
+func (s *Store) Record(subdomain string, failed bool, bytesIn, bytesOut int64) {
+	now := time.Now()
+	minute := now.Unix() / 60
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	buckets, ok := s.series[subdomain]
+	if !ok {
+		buckets = map[int64]*Point{}
+		s.series[subdomain] = buckets
+	}
+	p, ok := buckets[minute]
+	if !ok {
+		p = &Point{Time: time.Unix(minute*60, 0).UTC()}
+		buckets[minute] = p
+	}
+
+	p.Requests++
+	if failed {
+		p.Errors++
+	}
+	p.BytesIn += uint64(max(bytesIn, 0))   //nolint:gosec // G115: clamped to non-negative
+	p.BytesOut += uint64(max(bytesOut, 0)) //nolint:gosec // G115: clamped to non-negative
+	s.dirty = true
+}
+
+// Query returns the traffic of subdomain, or of every tunnel when it is
+// empty, from since until now in steps of step (one minute at least). Steps
+// without traffic are included with zero counters.
+func (s *Store) Query(subdomain string, since time.Time, step time.Duration) []Point {
+	stepMinutes := max(int64(step/time.Minute), 1)
+	first := since.Unix() / 60 / stepMinutes * stepMinutes
+	last := time.Now().Unix() / 60
+
+	points := make([]Point, 0, (last-first)/stepMinutes+1)
+	for m := first; m <= last; m += stepMinutes {
+		points = append(points, Point{Time: time.Unix(m*60, 0).UTC()})
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for name, buckets := range s.series {
+		if subdomain != "" && name != subdomain {
+			continue
+		}
+		for minute, p := range buckets {
+			if minute < first || minute > last {
+				continue
+			}
+			points[(minute-first)/stepMinutes].add(p)
+		}
+	}
+	return points
+}
+
+// Purge deletes the buckets of subdomain and reports whether it had any.
+// Call Flush to persist the deletion.
+func (s *Store) Purge(subdomain string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.series[subdomain]; !ok {
+		return false
+	}
+	delete(s.series, subdomain)
+	s.dirty = true
+	return true
+}
+
+// Flush drops buckets past retention and saves the rest if they changed.
+func (s *Store) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cutoff := time.Now().Add(-s.retention).Unix() / 60
+	saved := make(map[string][]*Point, len(s.series))
+	for subdomain, buckets := range s.series {
+		for minute, p := range buckets {
+			if minute < cutoff {
+				delete(buckets, minute)
+				s.dirty = true
+				continue
+			}
+			saved[subdomain] = append(saved[subdomain], p)
+		}
+		if len(buckets) == 0 {
+			delete(s.series, subdomain)
+		}
+	}
+
+	if s.store == nil || !s.dirty {
+		return nil
+	}
+
+	data, err := json.Marshal(saved)
+	if err != nil {
+		return fmt.Errorf("failed to encode history: %w", err)
+	}
+	if err := s.store.Put(s.key, data); err != nil {
+		return fmt.Errorf("failed to write history: %w", err)
+	}
+	s.dirty = false
+	return nil
+}
+
+// Run flushes every interval until ctx is done, then flushes a last time.
+func (s *Store) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			if err := s.Flush(); err != nil {
+				logrus.WithError(err).Error("Failed to save history")
+			}
+			return
+		case <-ticker.C:
+			if err := s.Flush(); err != nil {
+				logrus.WithError(err).Error("Failed to save history")
+			}
+		}
+	}
+}
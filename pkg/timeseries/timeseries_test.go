@@ -0,0 +1,55 @@
+package timeseries_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/snakeice/gunnel/pkg/store"
+	"github.com/snakeice/gunnel/pkg/timeseries"
+)
+
+func TestQueryAndPersist(t *testing.T) {
+	st, err := store.NewFile(t.TempDir())
+	if err != nil {
+		t.Fatalf("store: %v", err)
+	}
+
+	series, err := timeseries.New(st, "history.json", 0)
+	if err != nil {
+		t.Fatalf("new: %v", err)
+	}
+	series.Record("web", false, 10, 100)
+	series.Record("web", true, 0, 5)
+	series.Record("api", false, -1, 50)
+	if err := series.Flush(); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+
+	reloaded, err := timeseries.New(st, "history.json", 0)
+	if err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+
+	since := time.Now().Add(-time.Hour)
+	sum := func(points []timeseries.Point) timeseries.Point {
+		var total timeseries.Point
+		for _, p := range points {
+			total.Requests += p.Requests
+			total.Errors += p.Errors
+			total.BytesIn += p.BytesIn
+			total.BytesOut += p.BytesOut
+		}
+		return total
+	}
+
+	points := reloaded.Query("web", since, 10*time.Minute)
+	if len(points) < 6 || len(points) > 7 {
+		t.Fatalf("expected an hour in 10 minute steps, got %d points", len(points))
+	}
+	if got := sum(points); got.Requests != 2 || got.Errors != 1 || got.BytesIn != 10 || got.BytesOut != 105 {
+		t.Fatalf("unexpected web totals %+v", got)
+	}
+	if got := sum(reloaded.Query("", since, time.Minute)); got.Requests != 3 || got.BytesOut != 155 {
+		t.Fatalf("unexpected global totals %+v", got)
+	}
+}
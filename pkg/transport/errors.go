@@ -0,0 +1,129 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"syscall"
+
+	"github.com/quic-go/quic-go"
+	"github.com/sirupsen/logrus"
+	"github.com/snakeice/gunnel/pkg/protocol"
+)
+
+// ErrStreamClosed is returned when using a stream that was already closed.
+var ErrStreamClosed = errors.New("stream is closed")
+
+// ErrorClass tells routine transport errors apart from the ones worth an
+// operator's attention.
+type ErrorClass int
+
+const (
+	// ClassFatal is any error not known to be routine.
+	ClassFatal ErrorClass = iota
+	// ClassTimeout is a deadline or timeout firing on an idle connection.
+	ClassTimeout
+	// ClassClosed is the peer, or a local shutdown, closing the stream or
+	// connection.
+	ClassClosed
+)
+
+func (c ErrorClass) String() string {
+	switch c {
+	case ClassTimeout:
+		return "timeout"
+	case ClassClosed:
+		return "closed"
+	case ClassFatal:
+		return "fatal"
+	}
+	return "unknown"
+}
+
+// Level is the level errors of the class are logged at, so that an idle,
+// healthy deployment stays quiet at info level.
+func (c ErrorClass) Level() logrus.Level {
+	if c == ClassFatal {
+		return logrus.ErrorLevel
+	}
+	return logrus.DebugLevel
+}
+
+// Classify returns the class of a non-nil error returned by a transport, a
+// stream or the QUIC library.
+func Classify(err error) ErrorClass {
+	var (
+		appErr    *quic.ApplicationError
+		streamErr *quic.StreamError
+		idleErr   *quic.IdleTimeoutError
+		resetErr  *quic.StatelessResetError
+		netErr    net.Error
+	)
+
+	// Application errors unwrap to net.ErrClosed, so check their code first;
+	// code 0 is a plain close and close codes give its reason.
+	if errors.As(err, &appErr) && appErr.ErrorCode != 0 && !protocol.CloseCode(appErr.ErrorCode).Known() {
+		return ClassFatal
+	}
+
+	switch {
+	case errors.Is(err, io.EOF),
+		errors.Is(err, io.ErrUnexpectedEOF),
+		errors.Is(err, io.ErrClosedPipe),
+		errors.Is(err, context.Canceled),
+		errors.Is(err, net.ErrClosed),
+		errors.Is(err, ErrStreamClosed),
+		errors.Is(err, quic.ErrServerClosed),
+		errors.Is(err, syscall.EPIPE),
+		errors.Is(err, syscall.ECONNRESET),
+		errors.As(err, &streamErr),
+		errors.As(err, &idleErr),
+		errors.As(err, &resetErr):
+		return ClassClosed
+	case errors.Is(err, context.DeadlineExceeded),
+		errors.Is(err, os.ErrDeadlineExceeded),
+		errors.As(err, &netErr) && netErr.Timeout():
+		return ClassTimeout
+	}
+	return ClassFatal
+}
+
+// LogLevel is shorthand for Classify(err).Level().
+func LogLevel(err error) logrus.Level {
+	return Classify(err).Level()
+}
+
+// CloseReason describes why the connection of transp closed, e.g.
+// "heartbeat timeout: no heartbeat for 1m30s". It is empty while the
+// connection is open or when it closed without a reason.
+func CloseReason(transp Transport) string {
+	return DescribeClose(context.Cause(transp.Context()))
+}
+
+// DescribeClose returns the reason carried by err, an error of a closed
+// connection, or "" when it carries none.
+func DescribeClose(err error) string {
+	var (
+		appErr   *quic.ApplicationError
+		idleErr  *quic.IdleTimeoutError
+		resetErr *quic.StatelessResetError
+	)
+	switch {
+	case err == nil:
+		return ""
+	case errors.As(err, &appErr):
+		if code := protocol.CloseCode(appErr.ErrorCode); code.Known() {
+			return code.Describe(appErr.ErrorMessage)
+		}
+		return appErr.ErrorMessage
+	case errors.As(err, &idleErr):
+		return "idle timeout"
+	case errors.As(err, &resetErr):
+		return "connection reset"
+	case errors.Is(err, quic.ErrServerClosed):
+		return protocol.CloseServerShutdown.String()
+	}
+	return ""
+}
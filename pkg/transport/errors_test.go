@@ -0,0 +1,73 @@
+package transport_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/quic-go/quic-go"
+	"github.com/snakeice/gunnel/pkg/protocol"
+	"github.com/snakeice/gunnel/pkg/transport"
+)
+
+func closeError(code protocol.CloseCode, reason string) error {
+	return &quic.ApplicationError{ErrorCode: quic.ApplicationErrorCode(code), ErrorMessage: reason, Remote: true}
+}
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want transport.ErrorClass
+	}{
+		{"eof", io.EOF, transport.ClassClosed},
+		{"wrapped eof", fmt.Errorf("failed to read message: %w", io.EOF), transport.ClassClosed},
+		{"canceled", context.Canceled, transport.ClassClosed},
+		{"stream closed", transport.ErrStreamClosed, transport.ClassClosed},
+		{"idle timeout", &quic.IdleTimeoutError{}, transport.ClassClosed},
+		{"application close", &quic.ApplicationError{Remote: true}, transport.ClassClosed},
+		{"application error", &quic.ApplicationError{ErrorCode: 2}, transport.ClassFatal},
+		{"close reason", closeError(protocol.CloseRotated, ""), transport.ClassClosed},
+		{"deadline", context.DeadlineExceeded, transport.ClassTimeout},
+		{"read deadline", fmt.Errorf("read: %w", os.ErrDeadlineExceeded), transport.ClassTimeout},
+		{"other", errors.New("boom"), transport.ClassFatal},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := transport.Classify(tt.err); got != tt.want {
+				t.Errorf("Classify(%v) = %s, want %s", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDescribeClose(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"nil", nil, ""},
+		{"plain close", &quic.ApplicationError{Remote: true}, ""},
+		{
+			"close code",
+			closeError(protocol.CloseHeartbeatTimeout, "no heartbeat for 1m30s"),
+			"heartbeat timeout: no heartbeat for 1m30s",
+		},
+		{"close code only", closeError(protocol.CloseServerShutdown, ""), "server shutdown"},
+		{"idle timeout", &quic.IdleTimeoutError{}, "idle timeout"},
+		{"other", io.EOF, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := transport.DescribeClose(tt.err); got != tt.want {
+				t.Errorf("DescribeClose(%v) = %q, want %q", tt.err, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,15 @@
+package transport
+
+import "time"
+
+// ReadDeadline returns the deadline the next read on stream gets.
+func ReadDeadline(stream Stream) time.Time {
+	strm := stream.(*streamClient)
+	return strm.nextDeadline(&strm.readDeadline)
+}
+
+// WriteDeadline returns the deadline the next write on stream gets.
+func WriteDeadline(stream Stream) time.Time {
+	strm := stream.(*streamClient)
+	return strm.nextDeadline(&strm.writeDeadline)
+}
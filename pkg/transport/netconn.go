@@ -0,0 +1,54 @@
+package transport
+
+import (
+	"net"
+	"time"
+)
+
+// AsNetConn adapts a Stream to net.Conn so it can be handed to http.Server,
+// tls.Server or any library expecting a connection. Unlike Stream.Write,
+// writes through the adapter are flushed to the peer immediately, and a zero
+// deadline means no deadline, as net.Conn documents, rather than the stream's
+// per-operation default.
+func AsNetConn(stream Stream) net.Conn {
+	if conn, ok := stream.(net.Conn); ok {
+		return conn
+	}
+	return &streamConn{Stream: stream}
+}
+
+type streamConn struct {
+	Stream
+}
+
+func (c *streamConn) Write(p []byte) (int, error) {
+	n, err := c.Stream.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, c.Flush()
+}
+
+func (c *streamConn) SetReadDeadline(t time.Time) error {
+	return c.Stream.SetReadDeadline(connDeadline(t))
+}
+
+func (c *streamConn) SetWriteDeadline(t time.Time) error {
+	return c.Stream.SetWriteDeadline(connDeadline(t))
+}
+
+func (c *streamConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+// connDeadline maps the zero time, which clears a net.Conn deadline, to
+// NoDeadline.
+func connDeadline(t time.Time) time.Time {
+	if t.IsZero() {
+		return NoDeadline
+	}
+	return t
+}
@@ -0,0 +1,164 @@
+package transport_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	gunnelquic "github.com/snakeice/gunnel/pkg/quic"
+	"github.com/snakeice/gunnel/pkg/transport"
+)
+
+// streamPair returns the root streams of both ends of a local QUIC
+// connection.
+func streamPair(t *testing.T) (transport.Stream, transport.Stream) {
+	t.Helper()
+	t.Setenv("GUNNEL_INSECURE", "true")
+
+	srv, err := gunnelquic.NewServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to start QUIC server: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(func() {
+		cancel()
+		_ = srv.Close()
+	})
+
+	accepted := make(chan transport.Transport, 1)
+	go func() {
+		defer close(accepted)
+		conn, err := srv.Accept(ctx)
+		if err != nil {
+			return
+		}
+		transp, err := transport.NewFromServer(ctx, conn)
+		if err != nil {
+			return
+		}
+		accepted <- transp
+	}()
+
+	client, err := transport.New(srv.Addr())
+	if err != nil {
+		t.Fatalf("failed to create transport: %v", err)
+	}
+	t.Cleanup(client.Close)
+
+	// The server only learns of the stream once data arrives on it.
+	if _, err := client.Root().Write([]byte{0}); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Root().Flush(); err != nil {
+		t.Fatal(err)
+	}
+	server, ok := <-accepted
+	if !ok {
+		t.Fatal("failed to accept the connection")
+	}
+	t.Cleanup(server.Close)
+	if _, err := io.ReadFull(server.Root(), make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+	return client.Root(), server.Root()
+}
+
+// readWithin reads len(want) bytes from stream and fails unless they arrive
+// within d.
+func readWithin(t *testing.T, stream transport.Stream, want string, d time.Duration) {
+	t.Helper()
+	if err := stream.SetReadDeadline(time.Now().Add(d)); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = stream.SetReadDeadline(time.Time{}) }()
+	buf := make([]byte, len(want))
+	if _, err := io.ReadFull(stream, buf); err != nil {
+		t.Fatalf("reading %q: %v", want, err)
+	}
+	if string(buf) != want {
+		t.Fatalf("read %q, want %q", buf, want)
+	}
+}
+
+func TestNetConnWritesReachThePeer(t *testing.T) {
+	client, server := streamPair(t)
+	conn := transport.AsNetConn(client)
+
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	readWithin(t, server, "hello", time.Second)
+}
+
+func TestNetConnDeadlines(t *testing.T) {
+	client, server := streamPair(t)
+	conn := transport.AsNetConn(client)
+
+	if err := conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("read past the deadline = %v, want %v", err, os.ErrDeadlineExceeded)
+	}
+
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	farOff := time.Now().Add(24 * time.Hour)
+	if got := transport.ReadDeadline(client); got.Before(farOff) {
+		t.Errorf("read deadline after clearing = %v, want none", got)
+	}
+	if got := transport.WriteDeadline(client); got.Before(farOff) {
+		t.Errorf("write deadline after clearing = %v, want none", got)
+	}
+
+	read := make(chan error, 1)
+	go func() {
+		_, err := io.ReadFull(conn, make([]byte, 2))
+		read <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+	if _, err := server.Write([]byte("ok")); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-read:
+		if err != nil {
+			t.Errorf("read once the deadline is cleared = %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("read once the deadline is cleared never returned")
+	}
+}
+
+func TestNetConnAddresses(t *testing.T) {
+	client, server := streamPair(t)
+	conn := transport.AsNetConn(client)
+
+	if conn.LocalAddr() == nil || conn.RemoteAddr() == nil {
+		t.Fatalf("addresses = %v, %v", conn.LocalAddr(), conn.RemoteAddr())
+	}
+	// The client listens on the wildcard address, so only ports compare.
+	if got, want := port(t, conn.LocalAddr()), port(t, server.RemoteAddr()); got != want {
+		t.Errorf("LocalAddr port = %d, want the one the peer sees, %d", got, want)
+	}
+	if got, want := conn.RemoteAddr().String(), server.LocalAddr().String(); got != want {
+		t.Errorf("RemoteAddr = %s, want the peer's address, %s", got, want)
+	}
+}
+
+func port(t *testing.T, addr net.Addr) int {
+	t.Helper()
+	udp, ok := addr.(*net.UDPAddr)
+	if !ok {
+		t.Fatalf("address %v is a %T, want a UDP address", addr, addr)
+	}
+	return udp.Port
+}
@@ -6,29 +6,53 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/quic-go/quic-go"
 	"github.com/sirupsen/logrus"
+	"github.com/snakeice/gunnel/pkg/logging"
 	"github.com/snakeice/gunnel/pkg/metrics"
 	"github.com/snakeice/gunnel/pkg/protocol"
 )
 
-const deadlineDefault = 60 * time.Second
+const (
+	deadlineDefault = 60 * time.Second
+	// writeBufferSize bounds how much data Write coalesces before it hits the
+	// QUIC stream. Callers must Flush once a logical message is complete.
+	writeBufferSize = 16 * 1024
+	// resetErrorCode is sent to the peer of a stream aborted with Reset.
+	resetErrorCode quic.StreamErrorCode = 1
+)
 
 type Stream interface {
 	io.ReadWriteCloser
 	ID() string
+	// ConnectionID is the ID of the transport the stream belongs to.
+	ConnectionID() string
 	SetID(id string)
 	Send(msg protocol.Parsable) error
 	Receive() (*protocol.Message, error)
 
 	SetSubdomain(subdomain string)
+	// SetPersistent records the subdomain whose client keeps its backend
+	// connection open for the next request on the stream; empty for none.
+	SetPersistent(subdomain string)
+	Persistent() string
 
 	Read(p []byte) (n int, err error)
 	Write(p []byte) (n int, err error)
+	Flush() error
 	CloseWrite() error
+	// Reset aborts both directions without waiting for pending reads and
+	// writes, e.g. when the peer stopped answering; Close is still needed.
+	Reset()
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+	LocalAddr() net.Addr
+	RemoteAddr() net.Addr
 	Context() context.Context
 	BufferedReader() *bufio.Reader
 }
@@ -36,33 +60,64 @@ type Stream interface {
 // Transport represents a transport connection.
 type streamClient struct {
 	id          string
+	connID      string
 	stream      *quic.Stream
 	metricsInfo *metrics.StreamInfo
 	reader      *bufio.Reader
+	writer      *bufio.Writer
+	localAddr   net.Addr
+	remoteAddr  net.Addr
+	// raw is stream, kept after Close so Reset needs no lock.
+	raw *quic.Stream
+
+	// readDeadline and writeDeadline hold caller supplied deadlines as unix
+	// nanoseconds; zero means every operation gets deadlineDefault.
+	readDeadline  atomic.Int64
+	writeDeadline atomic.Int64
+	// idleSince is when the stream entered its transport's pool, as unix
+	// nanoseconds; zero while it is in use.
+	idleSince atomic.Int64
+	// persistent is the subdomain given to SetPersistent.
+	persistent atomic.Value
+	// onClose is called by Close, to drop the stream from its transport.
+	onClose func()
+	// maxMessageSize bounds the payload of received messages; 0 means
+	// protocol.DefaultMaxPayloadSize.
+	maxMessageSize uint32
 
 	mu sync.RWMutex
+	// wmu serializes access to writer; it is always taken after mu.
+	wmu sync.Mutex
 }
 
-func GenerateID(strmID quic.StreamID) string {
-	return fmt.Sprintf("strm-%s-%d", strmID.InitiatedBy().String(), strmID.StreamNum())
+// GenerateID names a stream after its connection, its initiator and its
+// number, e.g. "conn-3/strm-client-4". Stream numbers restart on every
+// connection, so the connection ID keeps the name unique.
+func GenerateID(connID string, strmID quic.StreamID) string {
+	return fmt.Sprintf("%s/strm-%s-%d", connID, strmID.InitiatedBy().String(), strmID.StreamNum())
 }
 
-func newStreamHandler(stream *quic.Stream) *streamClient {
+func newStreamHandler(stream *quic.Stream, connID string, localAddr, remoteAddr net.Addr) *streamClient {
 	if stream == nil {
-		logrus.WithFields(logrus.Fields{
+		logging.Data.WithFields(logrus.Fields{
 			"stream_id": "nil",
 		}).Debug("Stream is nil, cannot create streamClient")
 		return nil
 	}
 
 	strm := &streamClient{
-		stream: stream,
-		id:     GenerateID(stream.StreamID()),
-		reader: bufio.NewReader(stream),
+		stream:     stream,
+		raw:        stream,
+		id:         GenerateID(connID, stream.StreamID()),
+		connID:     connID,
+		reader:     bufio.NewReader(stream),
+		writer:     bufio.NewWriterSize(stream, writeBufferSize),
+		localAddr:  localAddr,
+		remoteAddr: remoteAddr,
 	}
 
 	strm.watchClose()
-	strm.metricsInfo = metrics.NewInfo(strm.ID())
+	strm.metricsInfo = metrics.NewInfo(strm.ID(), connID)
 
 	metrics.IncActiveStream("")
 
@@ -87,7 +142,7 @@ func (t *streamClient) watchClose() {
 
 		if t.stream != nil && t.stream == stream {
 			if err := t.stream.Close(); err != nil {
-				logrus.WithError(err).Warn("Failed to close stream on context done")
+				logging.Data.WithError(err).Log(LogLevel(err), "Failed to close stream on context done")
 			}
 		}
 	}(t.stream)
@@ -106,12 +161,22 @@ func (t *streamClient) Send(msg protocol.Parsable) error {
 	defer t.mu.RUnlock()
 
 	if t.stream == nil {
-		return errors.New("stream is closed")
+		return ErrStreamClosed
 	}
 
 	streamPayload := msg.Marshal()
 
-	n, err := streamPayload.Write(t)
+	t.wmu.Lock()
+	defer t.wmu.Unlock()
+
+	if err := t.stream.SetWriteDeadline(t.nextDeadline(&t.writeDeadline)); err != nil {
+		return fmt.Errorf("failed to set write deadline: %w", err)
+	}
+
+	n, err := streamPayload.Write(t.writer)
+	if err == nil {
+		err = t.writer.Flush()
+	}
 	if err != nil {
 		return fmt.Errorf("failed to write packet: %w", err)
 	}
@@ -119,7 +184,7 @@ func (t *streamClient) Send(msg protocol.Parsable) error {
 	t.metricsInfo.UpdateOut(n)
 	metrics.RecordBytesSent(t.metricsInfo.Subdomain, n)
 
-	logrus.WithFields(logrus.Fields{
+	logging.Data.WithFields(logrus.Fields{
 		"stream_id": t.ID(),
 		"size":      n,
 		"type":      streamPayload.Type.String(),
@@ -129,40 +194,57 @@ func (t *streamClient) Send(msg protocol.Parsable) error {
 }
 
 func (t *streamClient) Receive() (*protocol.Message, error) {
+	msg, err := t.receive()
+	if errors.Is(err, protocol.ErrMessageTooLarge) {
+		t.rejectOversized(err)
+	}
+	return msg, err
+}
+
+// rejectOversized tells the peer why its message was refused and closes the
+// stream, as the payload left unread breaks the framing of what follows.
+func (t *streamClient) rejectOversized(err error) {
+	logger := logging.Data.WithField("stream_id", t.ID())
+	logger.WithError(err).Warn("Rejected oversized message, closing stream")
+
+	if sendErr := t.Send(protocol.NewErrorMessage(err.Error())); sendErr != nil {
+		logger.WithError(sendErr).Log(LogLevel(sendErr), "Failed to report oversized message")
+	}
+	t.raw.CancelRead(resetErrorCode)
+	if closeErr := t.Close(); closeErr != nil {
+		logger.WithError(closeErr).Log(LogLevel(closeErr), "Failed to close stream")
+	}
+}
+
+func (t *streamClient) receive() (*protocol.Message, error) {
 	t.mu.RLock()
 	defer t.mu.RUnlock()
 
 	if t.stream == nil {
-		return nil, errors.New("stream is closed")
+		return nil, ErrStreamClosed
 	}
 
-	if err := t.stream.SetReadDeadline(time.Now().Add(deadlineDefault)); err != nil {
-		logrus.WithFields(logrus.Fields{
+	if err := t.stream.SetReadDeadline(t.nextDeadline(&t.readDeadline)); err != nil {
+		logging.Data.WithFields(logrus.Fields{
 			"error":     err,
 			"stream_id": t.ID(),
-		}).Error("Failed to set read deadline")
+		}).Debug("Failed to set read deadline")
 		return nil, err
 	}
 
-	n, msg, err := protocol.ReadMessage(t.reader)
+	n, msg, err := protocol.ReadMessage(t.reader, t.maxMessageSize)
 	if err != nil {
+		// The caller logs the error at its classified level.
 		if errors.Is(err, io.EOF) {
-			logrus.WithFields(logrus.Fields{
-				"stream_id": t.ID(),
-			}).Trace("EOF reached in transport receive")
 			return nil, err
 		}
-		logrus.WithFields(logrus.Fields{
-			"error":     err,
-			"stream_id": t.ID(),
-		}).Error("Failed to read message")
 		return nil, fmt.Errorf("failed to read message: %w", err)
 	}
 
 	t.metricsInfo.UpdateIn(n)
 	metrics.RecordBytesReceived(t.metricsInfo.Subdomain, n)
 
-	logrus.WithFields(logrus.Fields{
+	logging.Data.WithFields(logrus.Fields{
 		"size":      n,
 		"stream_id": t.ID(),
 		"type":      msg.Type.String(),
@@ -179,18 +261,29 @@ func (t *streamClient) Close() error {
 	defer t.mu.Unlock()
 
 	if t.stream == nil {
-		logrus.WithFields(logrus.Fields{
+		logging.Data.WithFields(logrus.Fields{
 			"stream_id": t.ID(),
 		}).Debug("Stream is nil, nothing to close")
 		return nil
 	}
 
 	t.metricsInfo.IsActive = false
-	t.metricsInfo.LastActive = time.Now()
+	t.metricsInfo.Touch()
 
 	metrics.DecActiveStream(t.metricsInfo.Subdomain)
 
-	if err := t.stream.Close(); err != nil {
+	if err := t.flush(); err != nil {
+		logging.Data.WithFields(logrus.Fields{
+			"error":     err,
+			"stream_id": t.ID(),
+		}).Debug("Failed to flush stream before close")
+	}
+
+	err := t.stream.Close()
+	if t.onClose != nil {
+		t.onClose()
+	}
+	if err != nil {
 		return fmt.Errorf("failed to close streamClient: %w", err)
 	}
 
@@ -204,17 +297,17 @@ func (t *streamClient) Read(p []byte) (int, error) {
 	defer t.mu.RUnlock()
 
 	if t.stream == nil {
-		logrus.WithFields(logrus.Fields{
+		logging.Data.WithFields(logrus.Fields{
 			"stream_id": t.ID(),
 		}).Debug("Stream is nil, nothing to read")
-		return 0, errors.New("stream is nil")
+		return 0, ErrStreamClosed
 	}
 
-	if err := t.stream.SetReadDeadline(time.Now().Add(deadlineDefault)); err != nil {
-		logrus.WithFields(logrus.Fields{
+	if err := t.stream.SetReadDeadline(t.nextDeadline(&t.readDeadline)); err != nil {
+		logging.Data.WithFields(logrus.Fields{
 			"error":     err,
 			"stream_id": t.ID(),
-		}).Error("Failed to set read deadline")
+		}).Debug("Failed to set read deadline")
 		return 0, err
 	}
 
@@ -223,67 +316,157 @@ func (t *streamClient) Read(p []byte) (int, error) {
 	t.metricsInfo.UpdateIn(n)
 	metrics.RecordBytesReceived(t.metricsInfo.Subdomain, n)
 	if err != nil {
-		if errors.Is(err, io.EOF) {
-			logrus.WithFields(logrus.Fields{
-				"stream_id": t.ID(),
-			}).Trace("EOF reached in transport read")
-			return n, err
-		}
-
-		logrus.WithFields(logrus.Fields{
+		logging.Data.WithFields(logrus.Fields{
 			"error":     err,
 			"stream_id": t.ID(),
-		}).Error("Error reading from transport")
+		}).Trace("Error reading from transport")
 
 		return n, err
 	}
 
-	logrus.WithFields(logrus.Fields{
+	logging.Data.WithFields(logrus.Fields{
 		"bytes_read": n,
 		"stream_id":  t.ID(),
 	}).Trace("Read from transport")
 	return n, nil
 }
 
+// Write buffers p and only touches the QUIC stream once the buffer fills up.
+// Call Flush to push a complete message to the peer.
 func (t *streamClient) Write(p []byte) (int, error) {
 	t.mu.RLock()
 	defer t.mu.RUnlock()
 
 	if t.stream == nil {
-		logrus.WithFields(logrus.Fields{
+		logging.Data.WithFields(logrus.Fields{
 			"stream_id": t.ID(),
 		}).Debug("Stream is nil, nothing to write")
-		return 0, errors.New("stream is nil")
+		return 0, ErrStreamClosed
 	}
 
-	if err := t.stream.SetWriteDeadline(time.Now().Add(deadlineDefault)); err != nil {
-		logrus.WithFields(logrus.Fields{
-			"error":     err,
-			"stream_id": t.ID(),
-		}).Error("Failed to set write deadline")
-		return 0, err
+	t.wmu.Lock()
+	defer t.wmu.Unlock()
+
+	if len(p) > t.writer.Available() {
+		if err := t.stream.SetWriteDeadline(t.nextDeadline(&t.writeDeadline)); err != nil {
+			logging.Data.WithFields(logrus.Fields{
+				"error":     err,
+				"stream_id": t.ID(),
+			}).Debug("Failed to set write deadline")
+			return 0, err
+		}
 	}
 
-	n, err := t.stream.Write(p)
+	n, err := t.writer.Write(p)
 
 	t.metricsInfo.UpdateOut(n)
 	metrics.RecordBytesSent(t.metricsInfo.Subdomain, n)
 
 	if err != nil {
-		logrus.WithFields(logrus.Fields{
+		logging.Data.WithFields(logrus.Fields{
 			"error":     err,
 			"stream_id": t.ID(),
-		}).Error("Error writing to transport")
+		}).Trace("Error writing to transport")
 
 		return n, err
 	}
-	logrus.WithFields(logrus.Fields{
+	logging.Data.WithFields(logrus.Fields{
 		"bytes_written": n,
 		"stream_id":     t.ID(),
 	}).Trace("Wrote to transport")
 	return n, nil
 }
 
+// Flush writes any buffered data to the QUIC stream.
+func (t *streamClient) Flush() error {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	if t.stream == nil {
+		return ErrStreamClosed
+	}
+
+	return t.flush()
+}
+
+// flush must be called with mu held (read or write).
+func (t *streamClient) flush() error {
+	t.wmu.Lock()
+	defer t.wmu.Unlock()
+
+	if t.writer.Buffered() == 0 {
+		return nil
+	}
+
+	if err := t.stream.SetWriteDeadline(t.nextDeadline(&t.writeDeadline)); err != nil {
+		return fmt.Errorf("failed to set write deadline: %w", err)
+	}
+
+	if err := t.writer.Flush(); err != nil {
+		return fmt.Errorf("failed to flush stream: %w", err)
+	}
+
+	return nil
+}
+
+// nextDeadline returns the caller supplied deadline or, when none is set,
+// deadlineDefault from now.
+func (t *streamClient) nextDeadline(deadline *atomic.Int64) time.Time {
+	if ns := deadline.Load(); ns != 0 {
+		return time.Unix(0, ns)
+	}
+	return time.Now().Add(deadlineDefault)
+}
+
+// SetReadDeadline overrides the per-read default deadline. A zero value
+// restores the default.
+func (t *streamClient) SetReadDeadline(deadline time.Time) error {
+	t.readDeadline.Store(deadlineNanos(deadline))
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if t.stream == nil {
+		return net.ErrClosed
+	}
+	return t.stream.SetReadDeadline(t.nextDeadline(&t.readDeadline))
+}
+
+// SetWriteDeadline overrides the per-write default deadline. A zero value
+// restores the default.
+func (t *streamClient) SetWriteDeadline(deadline time.Time) error {
+	t.writeDeadline.Store(deadlineNanos(deadline))
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if t.stream == nil {
+		return net.ErrClosed
+	}
+	return t.stream.SetWriteDeadline(t.nextDeadline(&t.writeDeadline))
+}
+
+func deadlineNanos(deadline time.Time) int64 {
+	if deadline.IsZero() {
+		return 0
+	}
+	return deadline.UnixNano()
+}
+
+func (t *streamClient) LocalAddr() net.Addr {
+	return t.localAddr
+}
+
+func (t *streamClient) RemoteAddr() net.Addr {
+	return t.remoteAddr
+}
+
+func (t *streamClient) ConnectionID() string {
+	if t == nil {
+		return ""
+	}
+
+	return t.connID
+}
+
 func (t *streamClient) SetID(id string) {
 	t.mu.Lock()
 	defer t.mu.Unlock()
@@ -291,6 +474,15 @@ func (t *streamClient) SetID(id string) {
 	t.id = id
 }
 
+func (t *streamClient) SetPersistent(subdomain string) {
+	t.persistent.Store(subdomain)
+}
+
+func (t *streamClient) Persistent() string {
+	subdomain, _ := t.persistent.Load().(string)
+	return subdomain
+}
+
 func (t *streamClient) SetSubdomain(subdomain string) {
 	t.mu.Lock()
 	defer t.mu.Unlock()
@@ -310,18 +502,30 @@ func (t *streamClient) CloseWrite() error {
 	defer t.mu.RUnlock()
 
 	if t.stream == nil {
-		logrus.WithFields(logrus.Fields{
+		logging.Data.WithFields(logrus.Fields{
 			"stream_id": t.ID(),
 		}).Debug("Stream is nil, nothing to close write")
 		return nil
 	}
 
+	if err := t.flush(); err != nil {
+		return err
+	}
+
 	if err := t.stream.Close(); err != nil {
 		return fmt.Errorf("failed to close write side: %w", err)
 	}
 	return nil
 }
 
+func (t *streamClient) Reset() {
+	if t == nil || t.raw == nil {
+		return
+	}
+	t.raw.CancelRead(resetErrorCode)
+	t.raw.CancelWrite(resetErrorCode)
+}
+
 func (t *streamClient) Context() context.Context {
 	t.mu.RLock()
 	defer t.mu.RUnlock()
@@ -345,16 +549,45 @@ func (t *streamClient) isValid() bool {
 	return ctx != nil && ctx.Err() == nil
 }
 
-func (t *streamClient) markIdle() {
+// markIdle readies the stream for the pool: pending writes are flushed and
+// deadlines restored to the default. It reports false when the stream cannot
+// carry another request, e.g. because the peer sent more than was read.
+func (t *streamClient) markIdle() bool {
 	if t == nil {
-		return
+		return false
 	}
 	t.mu.Lock()
 	defer t.mu.Unlock()
+	if t.stream == nil || t.reader.Buffered() > 0 {
+		return false
+	}
+	if err := t.flush(); err != nil {
+		return false
+	}
+	t.readDeadline.Store(0)
+	t.writeDeadline.Store(0)
+	t.idleSince.Store(time.Now().UnixNano())
 	if t.metricsInfo != nil {
 		t.metricsInfo.IsActive = false
-		t.metricsInfo.LastActive = time.Now()
+		t.metricsInfo.Touch()
 	}
+	return true
+}
+
+// markActive takes the stream out of the pool for a new request.
+func (t *streamClient) markActive() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.idleSince.Store(0)
+	if t.metricsInfo != nil {
+		t.metricsInfo.IsActive = true
+		t.metricsInfo.Touch()
+	}
+}
+
+// pooled reports whether the stream waits in its transport's pool.
+func (t *streamClient) pooled() bool {
+	return t.idleSince.Load() != 0
 }
 
 func (t *streamClient) BufferedReader() *bufio.Reader {
@@ -0,0 +1,113 @@
+package transport_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/snakeice/gunnel/pkg/protocol"
+	"github.com/snakeice/gunnel/pkg/transport"
+)
+
+// pending reports whether the peer's next read on stream stays empty for a
+// while, i.e. nothing was flushed to it.
+func pending(t *testing.T, stream transport.Stream) bool {
+	t.Helper()
+	if err := stream.SetReadDeadline(time.Now().Add(100 * time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = stream.SetReadDeadline(time.Time{}) }()
+	_, err := stream.BufferedReader().Peek(1)
+	return errors.Is(err, os.ErrDeadlineExceeded)
+}
+
+func TestSmallWritesWaitForFlush(t *testing.T) {
+	client, server := streamPair(t)
+
+	for _, part := range []string{"buf", "fered"} {
+		if _, err := client.Write([]byte(part)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !pending(t, server) {
+		t.Fatal("small writes reached the peer before Flush")
+	}
+	if err := client.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	readWithin(t, server, "buffered", time.Second)
+}
+
+func TestLargeWritesPassThrough(t *testing.T) {
+	client, server := streamPair(t)
+
+	large := bytes.Repeat([]byte("x"), 20*1024)
+	if _, err := client.Write(large); err != nil {
+		t.Fatal(err)
+	}
+	readWithin(t, server, string(large), time.Second)
+}
+
+func TestPendingWritesAreFlushed(t *testing.T) {
+	t.Run("Close", func(t *testing.T) {
+		client, server := streamPair(t)
+		if _, err := client.Write([]byte("bye")); err != nil {
+			t.Fatal(err)
+		}
+		if err := client.Close(); err != nil {
+			t.Fatal(err)
+		}
+		readWithin(t, server, "bye", time.Second)
+	})
+
+	t.Run("CloseWrite", func(t *testing.T) {
+		client, server := streamPair(t)
+		if _, err := client.Write([]byte("bye")); err != nil {
+			t.Fatal(err)
+		}
+		if err := client.CloseWrite(); err != nil {
+			t.Fatal(err)
+		}
+		if err := server.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := io.ReadAll(server); err != nil || string(got) != "bye" {
+			t.Errorf("read until EOF = %q, %v, want \"bye\"", got, err)
+		}
+	})
+
+	t.Run("Send", func(t *testing.T) {
+		client, server := streamPair(t)
+		if _, err := client.Write([]byte("raw")); err != nil {
+			t.Fatal(err)
+		}
+		if err := client.Send(&protocol.ConnectionReady{Subdomain: "demo"}); err != nil {
+			t.Fatal(err)
+		}
+		readWithin(t, server, "raw", time.Second)
+		msg, err := server.Receive()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.Type != protocol.MessageConnectionReady {
+			t.Errorf("message after the pending data = %v, want %v", msg.Type, protocol.MessageConnectionReady)
+		}
+	})
+}
+
+func TestFlushHonoursWriteDeadline(t *testing.T) {
+	client, _ := streamPair(t)
+
+	if _, err := client.Write([]byte("late")); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.SetWriteDeadline(time.Now().Add(-time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Flush(); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Flush past the write deadline = %v, want %v", err, os.ErrDeadlineExceeded)
+	}
+}
@@ -0,0 +1,23 @@
+package transport
+
+import (
+	"mime"
+	"net/http"
+	"time"
+)
+
+// NoDeadline is far enough in the future to never expire. Setting it on a
+// stream lifts the per-operation default deadline, e.g. for long-lived
+// responses.
+//
+//nolint:gochecknoglobals // constant time value
+var NoDeadline = time.Now().AddDate(100, 0, 0)
+
+// IsStreaming reports whether resp is meant to be delivered as it is
+// produced: Server-Sent Events and bodies of unknown length, e.g. chunked
+// ones. Both ends of a tunnel flush those as data arrives and lift the
+// stream deadlines, so pauses between events do not time out.
+func IsStreaming(resp *http.Response) bool {
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return mediaType == "text/event-stream" || resp.ContentLength == -1
+}
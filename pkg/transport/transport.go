@@ -4,7 +4,6 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"slices"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -12,31 +11,66 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/quic-go/quic-go"
 	"github.com/sirupsen/logrus"
+	"github.com/snakeice/gunnel/pkg/logging"
+	"github.com/snakeice/gunnel/pkg/metrics"
+	"github.com/snakeice/gunnel/pkg/protocol"
 	gunnelquic "github.com/snakeice/gunnel/pkg/quic"
 )
 
 type StreamHandler func(stream *quic.Stream) error
 
+// ErrStreamLimit is returned by Acquire when the peer's concurrent stream limit is exhausted.
+var ErrStreamLimit = errors.New("tunnel at capacity: stream limit reached")
+
 type Transport interface {
+	// ID identifies the connection, unique within the process.
+	ID() string
 	Addr() string
 	Close()
+	// CloseWithReason closes the connection, telling the peer why.
+	CloseWithReason(code protocol.CloseCode, reason string)
 	Acquire() (Stream, error)
 	Release(stream Stream) error
 	AcceptStream(ctx context.Context) (Stream, error)
 	Len() int
 	LenActive(subdomain ...string) int
+	Range(fn func(stream Stream) bool)
+	Has(stream Stream) bool
+	StreamLimit() int
 	Root() Stream
 	IsClosed() bool
+	// Context is done once the connection is closed, by either side.
+	Context() context.Context
+	// SendDatagram and ReceiveDatagram carry unreliable QUIC datagrams,
+	// used for UDP tunnels.
+	SendDatagram(p []byte) error
+	ReceiveDatagram(ctx context.Context) ([]byte, error)
+	// Handshake is what the QUIC connection negotiated.
+	Handshake() gunnelquic.Handshake
 
 	ImServer() bool
 }
 
+// PoolConfig sizes the pool of idle streams a transport hands out for new
+// requests instead of opening a stream for each.
 type PoolConfig struct {
-	MaxIdle     int
+	// MaxIdle bounds the idle streams kept.
+	MaxIdle int
+	// IdleTimeout closes streams idle this long. Clients close streams idle
+	// for 30s, so it must stay below that.
 	IdleTimeout time.Duration
 	Enabled     bool
 }
 
+// DefaultPoolConfig is the pool of transports not given one.
+func DefaultPoolConfig() PoolConfig {
+	return PoolConfig{
+		MaxIdle:     50,
+		IdleTimeout: 20 * time.Second,
+		Enabled:     true,
+	}
+}
+
 //nolint:gochecknoglobals // prometheus metrics are package-level by convention
 var (
 	metricsPoolSize = prometheus.NewGauge(prometheus.GaugeOpts{
@@ -56,52 +90,72 @@ var (
 	})
 )
 
+//nolint:gochecknoglobals // process-wide sequence numbering connections
+var connectionSeq atomic.Uint64
+
 //nolint:gochecknoinits // required for prometheus metric registration
 func init() {
 	prometheus.MustRegister(metricsPoolSize, metricsPoolHits, metricsPoolMisses)
 }
 
 type connectionTransport struct {
-	root       *streamClient
-	closed     bool
-	client     *gunnelquic.Client
-	streams    []*streamClient
-	mu         sync.RWMutex
-	server     bool
-	ctx        context.Context
-	cancelFunc context.CancelFunc
-
-	pool       chan *streamClient
+	id     string
+	root   *streamClient
+	closed bool
+	client *gunnelquic.Client
+	// streams is keyed by stream ID so Acquire/Accept/metrics callers never
+	// contend on a single lock; streamCount mirrors its size.
+	streams     sync.Map
+	streamCount atomic.Int64
+	mu          sync.RWMutex
+	server      bool
+	ctx         context.Context
+	cancelFunc  context.CancelFunc
+
+	// idle holds the pooled streams, the most recently used last.
+	idle       []*streamClient
+	poolMu     sync.Mutex
 	poolConfig PoolConfig
 	poolHits   atomic.Int64
 	poolMisses atomic.Int64
+	// maxMessageSize is given to every stream, see streamClient.
+	maxMessageSize uint32
 }
 
 func New(addr string) (Transport, error) {
-	client, err := gunnelquic.NewClient(addr)
+	return NewWithDialer(addr, nil)
+}
+
+// NewWithDialer is New with QUIC packets sent through dial, e.g. a proxy.
+func NewWithDialer(addr string, dial gunnelquic.PacketDialer) (Transport, error) {
+	client, err := gunnelquic.NewClientWithDialer(addr, dial)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create QUIC client: %w", err)
 	}
 
-	return newWrapper(client, false)
+	return newWrapper(client, false, DefaultPoolConfig(), 0)
 }
 
-func newWrapper(client *gunnelquic.Client, isServer bool) (*connectionTransport, error) {
+func newWrapper(
+	client *gunnelquic.Client, isServer bool, pool PoolConfig, maxMessageSize uint32,
+) (*connectionTransport, error) {
 	ctx, cancel := context.WithCancel(context.Background())
 
+	if pool.IdleTimeout <= 0 {
+		pool.IdleTimeout = DefaultPoolConfig().IdleTimeout
+	}
+	pool.Enabled = pool.Enabled && pool.MaxIdle > 0
+
 	transp := &connectionTransport{
+		id:         fmt.Sprintf("conn-%d", connectionSeq.Add(1)),
 		client:     client,
-		streams:    []*streamClient{},
 		closed:     false,
 		server:     isServer,
 		ctx:        ctx,
 		cancelFunc: cancel,
-		pool:       make(chan *streamClient, 50),
-		poolConfig: PoolConfig{
-			MaxIdle:     50,
-			IdleTimeout: 30 * time.Second,
-			Enabled:     true,
-		},
+		poolConfig: pool,
+
+		maxMessageSize: maxMessageSize,
 	}
 
 	if !isServer {
@@ -111,8 +165,8 @@ func newWrapper(client *gunnelquic.Client, isServer bool) (*connectionTransport,
 			return nil, fmt.Errorf("failed to open stream: %w", err)
 		}
 
-		handled := newStreamHandler(stream)
-		transp.streams = append(transp.streams, handled)
+		handled := transp.wrap(stream)
+		transp.track(handled)
 		transp.root = handled
 	}
 
@@ -122,9 +176,18 @@ func newWrapper(client *gunnelquic.Client, isServer bool) (*connectionTransport,
 }
 
 func NewFromServer(ctx context.Context, client *quic.Conn) (Transport, error) {
+	return NewFromServerWithPool(ctx, client, DefaultPoolConfig(), 0)
+}
+
+// NewFromServerWithPool is NewFromServer with the stream pool sized by pool
+// and received messages bounded by maxMessageSize bytes (0 for
+// protocol.DefaultMaxPayloadSize).
+func NewFromServerWithPool(
+	ctx context.Context, client *quic.Conn, pool PoolConfig, maxMessageSize uint32,
+) (Transport, error) {
 	conn := gunnelquic.NewClientFromConn(client)
 
-	transp, err := newWrapper(conn, true)
+	transp, err := newWrapper(conn, true, pool, maxMessageSize)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create transport wrapper: %w", err)
 	}
@@ -134,53 +197,45 @@ func NewFromServer(ctx context.Context, client *quic.Conn) (Transport, error) {
 		return nil, fmt.Errorf("failed to accept stream: %w", err)
 	}
 
-	handler := newStreamHandler(strm)
+	handler := transp.wrap(strm)
 	transp.root = handler
-	transp.streams = append(transp.streams, handler)
+	transp.track(handler)
 
 	return transp, nil
 }
 
 func (t *connectionTransport) Acquire() (Stream, error) {
 	if t.poolConfig.Enabled {
-		select {
-		case pooledStream := <-t.pool:
-			if pooledStream != nil && pooledStream.isValid() {
-				t.mu.Lock()
-				t.streams = append(t.streams, pooledStream)
-				t.mu.Unlock()
-				t.poolHits.Add(1)
-				metricsPoolHits.Inc()
-				return pooledStream, nil
-			}
-			// Invalid stream from pool - this is a miss
-			t.poolMisses.Add(1)
-			metricsPoolMisses.Inc()
-			if pooledStream != nil {
-				if closeErr := pooledStream.Close(); closeErr != nil {
-					logrus.WithError(closeErr).Warn("Failed to close invalid pooled stream")
-				}
-			}
-		default:
-			// Pool empty - this is also a miss
-			t.poolMisses.Add(1)
-			metricsPoolMisses.Inc()
+		if pooledStream := t.takeIdle(); pooledStream != nil {
+			t.poolHits.Add(1)
+			metricsPoolHits.Inc()
+			return pooledStream, nil
 		}
+		t.poolMisses.Add(1)
+		metricsPoolMisses.Inc()
 	}
 
 	stream, err := t.client.OpenStream()
 	if err != nil {
+		var limitErr *quic.StreamLimitReachedError
+		if errors.As(err, &limitErr) {
+			logging.Data.WithFields(logrus.Fields{
+				"connection": t.label(),
+				"streams":    t.Len(),
+				"limit":      t.client.StreamLimit(),
+			}).Warn("Stream limit reached")
+			return nil, ErrStreamLimit
+		}
 		return nil, fmt.Errorf("failed to open stream: %w", err)
 	}
 
-	streamHandler := newStreamHandler(stream)
+	streamHandler := t.wrap(stream)
 	if streamHandler == nil {
 		return nil, errors.New("failed to create stream handler")
 	}
 
-	t.mu.Lock()
-	defer t.mu.Unlock()
-	t.streams = append(t.streams, streamHandler)
+	t.track(streamHandler)
+	t.recordUtilization()
 
 	return streamHandler, nil
 }
@@ -194,11 +249,9 @@ func (t *connectionTransport) AcceptStream(ctx context.Context) (Stream, error)
 		return nil, fmt.Errorf("failed to accept stream: %w", err)
 	}
 
-	streamHandler := newStreamHandler(stream)
-
-	t.mu.Lock()
-	defer t.mu.Unlock()
-	t.streams = append(t.streams, streamHandler)
+	streamHandler := t.wrap(stream)
+	t.track(streamHandler)
+	t.recordUtilization()
 
 	return streamHandler, nil
 }
@@ -209,26 +262,59 @@ func (t *connectionTransport) Release(stream Stream) error {
 		return stream.Close()
 	}
 
-	if sc == nil || !sc.isValid() {
-		if sc != nil {
-			return sc.Close()
-		}
+	if sc == nil {
 		return nil
 	}
+	if !t.poolConfig.Enabled || !sc.isValid() || !sc.markIdle() {
+		return sc.Close()
+	}
 
-	sc.markIdle()
+	t.poolMu.Lock()
+	if t.ctx.Err() != nil || len(t.idle) >= t.poolConfig.MaxIdle {
+		t.poolMu.Unlock()
+		return sc.Close()
+	}
+	t.idle = append(t.idle, sc)
+	t.poolMu.Unlock()
+	metricsPoolSize.Inc()
+	return nil
+}
 
-	select {
-	case t.pool <- sc:
-		metricsPoolSize.Set(float64(len(t.pool)))
-		return nil
-	default:
+// takeIdle returns the most recently used stream of the pool still fit for a
+// request, closing the stale ones met on the way, or nil.
+func (t *connectionTransport) takeIdle() *streamClient {
+	t.poolMu.Lock()
+	defer t.poolMu.Unlock()
+
+	for len(t.idle) > 0 {
+		sc := t.idle[len(t.idle)-1]
+		t.idle = t.idle[:len(t.idle)-1]
+		metricsPoolSize.Dec()
+		if t.fresh(sc, time.Now()) {
+			sc.markActive()
+			return sc
+		}
+		t.closePooled(sc)
 	}
+	return nil
+}
 
-	return sc.Close()
+// fresh reports whether the pooled stream sc may still carry a request.
+func (t *connectionTransport) fresh(sc *streamClient, now time.Time) bool {
+	return sc.isValid() && now.Sub(time.Unix(0, sc.idleSince.Load())) < t.poolConfig.IdleTimeout
+}
+
+func (t *connectionTransport) closePooled(sc *streamClient) {
+	if err := sc.Close(); err != nil {
+		logging.Data.WithError(err).Log(LogLevel(err), "Failed to close pooled stream")
+	}
 }
 
 func (t *connectionTransport) Close() {
+	t.CloseWithReason(protocol.CloseNone, "")
+}
+
+func (t *connectionTransport) CloseWithReason(code protocol.CloseCode, reason string) {
 	t.mu.Lock()
 	defer t.mu.Unlock()
 	if t.closed {
@@ -240,127 +326,174 @@ func (t *connectionTransport) Close() {
 		t.cancelFunc()
 	}
 
-	if t.root != nil {
-		if err := t.root.Close(); err != nil {
-			logrus.WithError(err).Errorf("Failed to close root stream: %s", t.root.ID())
-		}
-	}
-
-	close(t.pool)
-	for range t.pool {
-	}
+	t.poolMu.Lock()
+	metricsPoolSize.Sub(float64(len(t.idle)))
+	t.idle = nil
+	t.poolMu.Unlock()
 
 	if t.client == nil {
+		t.closeRoot()
 		return
 	}
 
-	if err := t.client.Close(); err != nil {
-		logrus.WithError(err).Errorf("Failed to close client: %s", t.client.Addr())
+	// Closing the connection first fails any read still blocked on the root
+	// stream, which would otherwise hold the stream until its deadline.
+	if err := t.client.CloseWithError(uint64(code), reason); err != nil {
+		logging.Data.WithError(err).Logf(LogLevel(err), "Failed to close client: %s", t.client.Addr())
+		t.closeRoot()
 		return
 	}
+	t.closeRoot()
 
-	for _, stream := range t.streams {
+	t.streams.Range(func(key, value any) bool {
+		//nolint:errcheck // type guaranteed by track
+		stream := value.(*streamClient)
 		if err := stream.Close(); err != nil {
-			logrus.WithError(err).Errorf("Failed to close stream: %s", stream.ID())
+			logging.Data.WithError(err).Logf(LogLevel(err), "Failed to close stream: %s", stream.ID())
 		}
-	}
-	t.streams = nil
+		t.untrack(key)
+		return true
+	})
+
+	metrics.RemoveConnection(t.label())
 
-	logrus.Infof("Closed transport connection: %s", t.client.Addr())
+	side := "client"
 	if t.server {
-		logrus.Infof("Server transport connection closed: %s", t.client.Addr())
-	} else {
-		logrus.Infof("Client transport connection closed: %s", t.client.Addr())
+		side = "server"
+	}
+	logging.Data.WithFields(logrus.Fields{
+		"side":          side,
+		"connection_id": t.id,
+	}).Infof("Closed transport connection: %s", t.client.Addr())
+}
+
+func (t *connectionTransport) closeRoot() {
+	if t.root == nil {
+		return
+	}
+	if err := t.root.Close(); err != nil {
+		logging.Data.WithError(err).Logf(LogLevel(err), "Failed to close root stream: %s", t.root.ID())
+	}
+}
+
+// track registers a stream in the transport registry. Tracking the same
+// stream twice (e.g. a pooled stream handed out again) is a no-op.
+func (t *connectionTransport) track(stream *streamClient) {
+	if _, loaded := t.streams.LoadOrStore(stream.ID(), stream); !loaded {
+		t.streamCount.Add(1)
+	}
+}
+
+// untrack removes a stream from the registry by ID.
+func (t *connectionTransport) untrack(id any) {
+	if _, loaded := t.streams.LoadAndDelete(id); loaded {
+		t.streamCount.Add(-1)
 	}
 }
 
 func (t *connectionTransport) Len() int {
-	t.mu.RLock()
-	defer t.mu.RUnlock()
-	return len(t.streams)
+	return int(t.streamCount.Load())
+}
+
+// Range calls fn for every stream tracked by the transport until fn returns false.
+// It does not block concurrent Acquire/AcceptStream calls.
+func (t *connectionTransport) Range(fn func(stream Stream) bool) {
+	t.streams.Range(func(_, value any) bool {
+		//nolint:errcheck // type guaranteed by track
+		return fn(value.(*streamClient))
+	})
+}
+
+// Has reports whether stream was opened or accepted on this transport.
+func (t *connectionTransport) Has(stream Stream) bool {
+	if stream == nil {
+		return false
+	}
+	value, ok := t.streams.Load(stream.ID())
+	return ok && value == stream
+}
+
+// StreamLimit returns the peer's concurrent stream limit for this connection.
+func (t *connectionTransport) StreamLimit() int {
+	if t.client == nil {
+		return 0
+	}
+	return t.client.StreamLimit()
 }
 
 func (t *connectionTransport) LenActive(subdomain ...string) int {
-	t.mu.RLock()
-	defer t.mu.RUnlock()
 	var count = 0
 	sub := ""
 	if len(subdomain) > 0 {
 		sub = subdomain[0]
 	}
-	for _, stream := range t.streams {
+	t.streams.Range(func(_, value any) bool {
+		//nolint:errcheck // type guaranteed by track
+		stream := value.(*streamClient)
 		if stream.metricsInfo.IsActive && (sub == "" || stream.metricsInfo.Subdomain == sub) {
 			count++
 		}
-	}
+		return true
+	})
 
 	return count
 }
 
-// cleanupInactiveStreams removes streams that have been inactive for too long.
-func (t *connectionTransport) findInactiveStreamIDs(maxInactive time.Duration) []int {
-	var ids []int
-
-	t.mu.RLock()
-	for id, stream := range t.streams {
-		if !stream.metricsInfo.IsActive &&
-			time.Since(stream.metricsInfo.LastActive) >= maxInactive {
-			ids = append(ids, id)
-			logrus.Infof("Marking inactive stream %s for removal", stream.ID())
+// findInactiveStreamIDs returns the IDs of streams that have been inactive for too long.
+func (t *connectionTransport) findInactiveStreamIDs(maxInactive time.Duration) []string {
+	var ids []string
+
+	t.streams.Range(func(key, value any) bool {
+		//nolint:errcheck // type guaranteed by track
+		stream := value.(*streamClient)
+		if !stream.metricsInfo.IsActive && !stream.pooled() &&
+			time.Since(stream.metricsInfo.LastActive()) >= maxInactive {
+			//nolint:errcheck // type guaranteed by track
+			ids = append(ids, key.(string))
+			logging.Data.Infof("Marking inactive stream %s for removal", stream.ID())
 		}
-	}
-	t.mu.RUnlock()
+		return true
+	})
 
 	return ids
 }
 
-// removeStreams removes streams by index, closing them first.
-// Indices must be sorted in reverse order for safe removal.
-func (t *connectionTransport) removeStreams(indices []int) {
-	if len(indices) == 0 {
-		return
-	}
-
-	t.mu.Lock()
-	defer t.mu.Unlock()
-
-	// Close all streams first
-	for _, id := range indices {
-		if id < len(t.streams) {
-			stream := t.streams[id]
-			if err := stream.Close(); err != nil {
-				logrus.WithError(err).Warnf("Failed to close stream %s", stream.ID())
-			}
+// removeStreams closes and removes streams by ID.
+func (t *connectionTransport) removeStreams(ids []string) {
+	for _, id := range ids {
+		value, ok := t.streams.Load(id)
+		if !ok {
+			continue
 		}
-	}
-
-	// Then remove them (in reverse order to maintain indices)
-	slices.Sort(indices)
-	slices.Reverse(indices)
-
-	for _, id := range indices {
-		if id < len(t.streams) {
-			t.streams = slices.Delete(t.streams, id, id+1)
+		//nolint:errcheck // type guaranteed by track
+		stream := value.(*streamClient)
+		if err := stream.Close(); err != nil {
+			logging.Data.WithError(err).Logf(LogLevel(err), "Failed to close stream %s", stream.ID())
 		}
+		t.untrack(id)
 	}
 }
 
 func (t *connectionTransport) cleanupClosedStreams() {
-	t.mu.Lock()
-	defer t.mu.Unlock()
+	t.streams.Range(func(key, value any) bool {
+		//nolint:errcheck // type guaranteed by track
+		stream := value.(*streamClient)
+		if stream.metricsInfo.IsActive || stream.pooled() {
+			return true
+		}
 
-	var active []*streamClient
-	for _, stream := range t.streams {
-		if stream.metricsInfo.IsActive {
-			active = append(active, stream)
-		} else if stream.stream != nil {
+		stream.mu.Lock()
+		if stream.stream != nil {
 			if err := stream.stream.Close(); err != nil {
-				logrus.WithError(err).Warn("Failed to close stream")
+				logging.Data.WithError(err).Log(LogLevel(err), "Failed to close stream")
 			}
 			stream.stream = nil
 		}
-	}
-	t.streams = active
+		stream.mu.Unlock()
+
+		t.untrack(key)
+		return true
+	})
 }
 
 func (t *connectionTransport) cleanupLoop() {
@@ -370,7 +503,7 @@ func (t *connectionTransport) cleanupLoop() {
 	oldStreamsTicker := time.NewTicker(5 * time.Minute)
 	defer oldStreamsTicker.Stop()
 
-	poolCleanupTicker := time.NewTicker(t.poolConfig.IdleTimeout)
+	poolCleanupTicker := time.NewTicker(t.poolConfig.IdleTimeout / 2)
 	defer poolCleanupTicker.Stop()
 
 	for {
@@ -379,6 +512,7 @@ func (t *connectionTransport) cleanupLoop() {
 			return
 		case <-cleanupTicker.C:
 			t.cleanupClosedStreams()
+			t.recordUtilization()
 		case <-oldStreamsTicker.C:
 			streamsToRemove := t.findInactiveStreamIDs(5 * time.Minute)
 			t.removeStreams(streamsToRemove)
@@ -388,39 +522,63 @@ func (t *connectionTransport) cleanupLoop() {
 	}
 }
 
+// cleanupIdlePool closes the pooled streams idle for too long.
 func (t *connectionTransport) cleanupIdlePool() {
 	if !t.poolConfig.Enabled {
 		return
 	}
 
-	var valid []*streamClient
-drain:
-	for {
-		select {
-		case sc := <-t.pool:
-			if sc.isValid() {
-				valid = append(valid, sc)
-			}
-		default:
-			break drain
+	now := time.Now()
+	t.poolMu.Lock()
+	var stale []*streamClient
+	kept := t.idle[:0]
+	for _, sc := range t.idle {
+		if t.fresh(sc, now) {
+			kept = append(kept, sc)
+		} else {
+			stale = append(stale, sc)
 		}
 	}
+	clear(t.idle[len(kept):])
+	t.idle = kept
+	t.poolMu.Unlock()
 
-	for _, sc := range valid {
-		if !sc.isValid() {
-			if err := sc.Close(); err != nil {
-				logrus.WithError(err).Warn("Failed to close stream in pool cleanup")
-			}
-			continue
-		}
-		select {
-		case t.pool <- sc:
-		default:
-			if err := sc.Close(); err != nil {
-				logrus.WithError(err).Warn("Failed to close stream in pool cleanup")
-			}
+	metricsPoolSize.Sub(float64(len(stale)))
+	for _, sc := range stale {
+		t.closePooled(sc)
+	}
+}
+
+// wrap turns a raw QUIC stream of this connection into a streamClient.
+func (t *connectionTransport) wrap(stream *quic.Stream) *streamClient {
+	sc := newStreamHandler(stream, t.id, t.client.LocalAddr(), t.client.RemoteAddr())
+	if sc == nil {
+		return nil
+	}
+	sc.maxMessageSize = t.maxMessageSize
+	id := sc.ID()
+	sc.onClose = func() {
+		t.untrack(id)
+		// A closed transport already removed its utilization metrics.
+		if t.ctx.Err() == nil {
+			t.recordUtilization()
 		}
 	}
+	return sc
+}
+
+// label identifies the connection in metrics. Addresses repeat across the
+// pooled connections of a client, so the connection ID is used instead.
+func (t *connectionTransport) label() string {
+	return t.id
+}
+
+func (t *connectionTransport) ID() string {
+	return t.id
+}
+
+func (t *connectionTransport) recordUtilization() {
+	metrics.SetConnectionStreams(t.label(), t.Len(), t.client.StreamLimit())
 }
 
 func (t *connectionTransport) Addr() string {
@@ -444,6 +602,25 @@ func (t *connectionTransport) Root() Stream {
 	return t.root
 }
 
+func (t *connectionTransport) Context() context.Context {
+	if t.client == nil {
+		return t.ctx
+	}
+	return t.client.Context()
+}
+
+func (t *connectionTransport) SendDatagram(p []byte) error {
+	return t.client.SendDatagram(p)
+}
+
+func (t *connectionTransport) ReceiveDatagram(ctx context.Context) ([]byte, error) {
+	return t.client.ReceiveDatagram(ctx)
+}
+
+func (t *connectionTransport) Handshake() gunnelquic.Handshake {
+	return t.client.Handshake()
+}
+
 func (t *connectionTransport) ImServer() bool {
 	return t.server
 }
@@ -453,7 +630,9 @@ func (t *connectionTransport) PoolConfig() PoolConfig {
 }
 
 func (t *connectionTransport) PoolSize() int {
-	return len(t.pool)
+	t.poolMu.Lock()
+	defer t.poolMu.Unlock()
+	return len(t.idle)
 }
 
 func (t *connectionTransport) PoolHits() int64 {
@@ -1,8 +1,16 @@
 package transport_test
 
 import (
+	"context"
+	"errors"
+	"io"
+	"runtime"
 	"testing"
+	"time"
 
+	"github.com/quic-go/quic-go"
+	"github.com/snakeice/gunnel/pkg/protocol"
+	gunnelquic "github.com/snakeice/gunnel/pkg/quic"
 	"github.com/snakeice/gunnel/pkg/transport"
 )
 
@@ -12,3 +20,205 @@ func TestTransportInterface(t *testing.T) {
 
 	t.Log("✓ Transport interface verified")
 }
+
+// newLoopbackTransport dials a local QUIC server that drains and closes every
+// stream it accepts, so stream credit is returned to the client.
+func newLoopbackTransport(b testing.TB) transport.Transport {
+	b.Helper()
+	b.Setenv("GUNNEL_INSECURE", "true")
+
+	srv, err := gunnelquic.NewServer("127.0.0.1:0")
+	if err != nil {
+		b.Fatalf("failed to start QUIC server: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	b.Cleanup(func() {
+		cancel()
+		_ = srv.Close()
+	})
+
+	go func() {
+		conn, err := srv.Accept(ctx)
+		if err != nil {
+			return
+		}
+		for {
+			strm, err := conn.AcceptStream(ctx)
+			if err != nil {
+				return
+			}
+			go func() {
+				_, _ = io.Copy(io.Discard, strm)
+				_ = strm.Close()
+			}()
+		}
+	}()
+
+	transp, err := transport.New(srv.Addr())
+	if err != nil {
+		b.Fatalf("failed to create transport: %v", err)
+	}
+	b.Cleanup(transp.Close)
+
+	return transp
+}
+
+// BenchmarkAcquireRelease measures stream bookkeeping with ~1k concurrent callers.
+func BenchmarkAcquireRelease(b *testing.B) {
+	transp := newLoopbackTransport(b)
+
+	b.SetParallelism(1000 / runtime.GOMAXPROCS(0))
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			strm, err := transp.Acquire()
+			if err != nil {
+				b.Errorf("acquire failed: %v", err)
+				return
+			}
+			_ = transp.LenActive()
+			if err := transp.Release(strm); err != nil {
+				b.Errorf("release failed: %v", err)
+				return
+			}
+		}
+	})
+}
+
+// BenchmarkRangeUnderLoad measures Range/LenActive while streams churn.
+func BenchmarkRangeUnderLoad(b *testing.B) {
+	transp := newLoopbackTransport(b)
+
+	for range 1000 {
+		strm, err := transp.Acquire()
+		if err != nil {
+			b.Fatalf("acquire failed: %v", err)
+		}
+		b.Cleanup(func() { _ = strm.Close() })
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			count := 0
+			transp.Range(func(transport.Stream) bool {
+				count++
+				return true
+			})
+			_ = transp.LenActive("bench")
+		}
+	})
+}
+
+func TestReleasedStreamIsReused(t *testing.T) {
+	transp := newLoopbackTransport(t)
+
+	first, err := transp.Acquire()
+	if err != nil {
+		t.Fatalf("acquire failed: %v", err)
+	}
+	if _, err := first.Write([]byte("request")); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	active := transp.LenActive()
+	if err := transp.Release(first); err != nil {
+		t.Fatalf("release failed: %v", err)
+	}
+
+	second, err := transp.Acquire()
+	if err != nil {
+		t.Fatalf("acquire failed: %v", err)
+	}
+	if second.ID() != first.ID() {
+		t.Errorf("Acquire opened %s, want the released %s", second.ID(), first.ID())
+	}
+	if got := transp.LenActive(); got != active {
+		t.Errorf("LenActive = %d, want %d with the reused stream active", got, active)
+	}
+}
+
+func TestGenerateIDScopedByConnection(t *testing.T) {
+	first := transport.GenerateID("conn-1", quic.StreamID(0))
+	second := transport.GenerateID("conn-2", quic.StreamID(0))
+
+	if first != "conn-1/strm-client-1" {
+		t.Errorf("GenerateID = %q, want %q", first, "conn-1/strm-client-1")
+	}
+	if first == second {
+		t.Errorf("streams of different connections share the ID %q", first)
+	}
+}
+
+func TestClosedStreamsAreUntracked(t *testing.T) {
+	transp := newLoopbackTransport(t)
+	base := transp.Len()
+
+	streams := make([]transport.Stream, 3)
+	for i := range streams {
+		strm, err := transp.Acquire()
+		if err != nil {
+			t.Fatalf("acquire failed: %v", err)
+		}
+		streams[i] = strm
+	}
+	if got := transp.Len(); got != base+len(streams) {
+		t.Fatalf("Len = %d after acquiring, want %d", got, base+len(streams))
+	}
+
+	for _, strm := range streams {
+		if err := strm.Close(); err != nil {
+			t.Fatalf("close failed: %v", err)
+		}
+	}
+	if got := transp.Len(); got != base {
+		t.Errorf("Len = %d after closing, want %d", got, base)
+	}
+	if got := transp.StreamLimit(); got == 0 {
+		t.Error("StreamLimit = 0, want the limit the server advertised")
+	}
+}
+
+func TestServerTransportsKeepTheirMessageLimit(t *testing.T) {
+	t.Setenv("GUNNEL_INSECURE", "true")
+
+	// receive sends a heartbeat to a server transport whose messages are
+	// limited to limit bytes, returning the error it was received with.
+	receive := func(limit uint32) error {
+		srv, err := gunnelquic.NewServer("127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("failed to start QUIC server: %v", err)
+		}
+		defer srv.Close()
+
+		client, err := transport.New(srv.Addr())
+		if err != nil {
+			t.Fatalf("failed to create transport: %v", err)
+		}
+		defer client.Close()
+		if err := client.Root().Send(&protocol.Heartbeat{Message: "ping"}); err != nil {
+			t.Fatalf("send failed: %v", err)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		conn, err := srv.Accept(ctx)
+		if err != nil {
+			t.Fatalf("accept failed: %v", err)
+		}
+		server, err := transport.NewFromServerWithPool(ctx, conn, transport.DefaultPoolConfig(), limit)
+		if err != nil {
+			t.Fatalf("failed to create server transport: %v", err)
+		}
+		defer server.Close()
+		_, err = server.Root().Receive()
+		return err
+	}
+
+	if err := receive(4); !errors.Is(err, protocol.ErrMessageTooLarge) {
+		t.Errorf("Receive with a 4 byte limit = %v, want ErrMessageTooLarge", err)
+	}
+	if err := receive(0); err != nil {
+		t.Errorf("Receive with the default limit = %v, want the heartbeat", err)
+	}
+}
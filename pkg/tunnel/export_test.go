@@ -0,0 +1,34 @@
+package tunnel
+
+import (
+	"time"
+
+	"github.com/snakeice/gunnel/pkg/transport"
+)
+
+// Frame types and sizes of streams with keepalive, for the tests.
+const (
+	FrameData       = frameData
+	FramePing       = framePing
+	FramePong       = framePong
+	FrameFin        = frameFin
+	MaxFramePayload = maxFramePayload
+)
+
+// KeepAliveConn is the framing Proxy puts on streams with keepalive.
+type KeepAliveConn = keepAliveConn
+
+// NewKeepAliveConn frames stream the way Proxy does.
+func NewKeepAliveConn(stream transport.Stream, config KeepAlive, onTimeout func()) *KeepAliveConn {
+	return newKeepAliveConn(transport.AsNetConn(stream), stream, config, onTimeout)
+}
+
+// LastSeen is when c last heard from its peer.
+func (c *keepAliveConn) LastSeen() time.Time {
+	return time.Unix(0, c.lastSeen.Load())
+}
+
+// Halt stops c pinging.
+func (c *keepAliveConn) Halt() {
+	c.halt()
+}
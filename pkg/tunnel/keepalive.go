@@ -0,0 +1,218 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/snakeice/gunnel/pkg/transport"
+)
+
+// Frame types of a stream with keepalive. Each frame is its type, the length
+// of its payload as 2 bytes and the payload.
+const (
+	frameData byte = iota
+	framePing
+	framePong
+	frameFin
+)
+
+const (
+	frameHeaderSize = 3
+	maxFramePayload = 16 * 1024
+	// defaultTimeoutIntervals is how many intervals KeepAlive.Timeout
+	// defaults to.
+	defaultTimeoutIntervals = 3
+)
+
+// ErrKeepAliveTimeout is returned by Proxy when the stream was reset because
+// its peer stopped answering.
+var ErrKeepAliveTimeout = errors.New("stream keepalive timed out")
+
+// KeepAlive pings the peer of a tunnel stream while both directions are
+// open and resets the stream when nothing arrives from it for Timeout,
+// catching streams wedged while their connection still answers heartbeats.
+// Both ends must use it, as it frames the bytes of the stream.
+type KeepAlive struct {
+	// Interval is how often the peer is pinged; zero disables keepalive.
+	Interval time.Duration
+	// Timeout is how long the peer may stay silent (three intervals by
+	// default).
+	Timeout time.Duration
+}
+
+// Enabled reports whether k pings at all.
+func (k KeepAlive) Enabled() bool {
+	return k.Interval > 0
+}
+
+func (k KeepAlive) timeout() time.Duration {
+	if k.Timeout > 0 {
+		return k.Timeout
+	}
+	return defaultTimeoutIntervals * k.Interval
+}
+
+// keepAliveConn frames the data written to a stream, pinging its peer and
+// answering its pings between data frames. FIN frames stand in for
+// half-closes, so the stream stays writable for pongs.
+type keepAliveConn struct {
+	net.Conn
+	stream    transport.Stream
+	config    KeepAlive
+	onTimeout func()
+
+	// wmu serializes frames; header is only used under it.
+	wmu    sync.Mutex
+	header [frameHeaderSize]byte
+
+	// rheader and remaining, the unread bytes of the current data frame,
+	// belong to the reading goroutine.
+	rheader   [frameHeaderSize]byte
+	remaining int
+
+	// lastSeen is when the peer last sent anything, as unix nanoseconds.
+	lastSeen    atomic.Int64
+	pinging     atomic.Bool
+	finSent     atomic.Bool
+	finReceived atomic.Bool
+	timedOut    atomic.Bool
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+func newKeepAliveConn(conn net.Conn, stream transport.Stream, config KeepAlive, onTimeout func()) *keepAliveConn {
+	c := &keepAliveConn{
+		Conn:      conn,
+		stream:    stream,
+		config:    config,
+		onTimeout: onTimeout,
+		stop:      make(chan struct{}),
+	}
+	c.seen()
+	go c.ping()
+	return c
+}
+
+func (c *keepAliveConn) Read(p []byte) (int, error) {
+	for c.remaining == 0 {
+		if c.finReceived.Load() {
+			return 0, io.EOF
+		}
+		if err := c.readFrame(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := c.Conn.Read(p[:min(len(p), c.remaining)])
+	c.remaining -= n
+	if n > 0 {
+		c.seen()
+	}
+	return n, err
+}
+
+// readFrame reads the next frame header, handling control frames whole and
+// leaving the payload of data frames to Read.
+func (c *keepAliveConn) readFrame() error {
+	if _, err := io.ReadFull(c.Conn, c.rheader[:]); err != nil {
+		return err
+	}
+	c.seen()
+	size := int(binary.BigEndian.Uint16(c.rheader[1:]))
+	switch typ := c.rheader[0]; typ {
+	case frameData:
+		c.remaining = size
+		return nil
+	case framePing, framePong:
+		if _, err := io.CopyN(io.Discard, c.Conn, int64(size)); err != nil {
+			return err
+		}
+		if typ == framePing {
+			return c.writeFrame(framePong, nil)
+		}
+		return nil
+	case frameFin:
+		c.finReceived.Store(true)
+		return nil
+	default:
+		return fmt.Errorf("unknown keepalive frame type %d", typ)
+	}
+}
+
+func (c *keepAliveConn) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p[:min(len(p), maxFramePayload)]
+		if err := c.writeFrame(frameData, chunk); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
+
+// CloseWrite tells the peer no more data follows.
+func (c *keepAliveConn) CloseWrite() error {
+	c.finSent.Store(true)
+	return c.writeFrame(frameFin, nil)
+}
+
+func (c *keepAliveConn) writeFrame(typ byte, payload []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.header[0] = typ
+	binary.BigEndian.PutUint16(c.header[1:], uint16(len(payload))) //nolint:gosec // G115: at most maxFramePayload
+	if _, err := c.stream.Write(c.header[:]); err != nil {
+		return err
+	}
+	if _, err := c.stream.Write(payload); err != nil {
+		return err
+	}
+	return c.stream.Flush()
+}
+
+func (c *keepAliveConn) seen() {
+	c.lastSeen.Store(time.Now().UnixNano())
+}
+
+// ping pings the peer every interval until either side half-closes, after
+// which the peer, or this end, no longer reads the answers.
+func (c *keepAliveConn) ping() {
+	ticker := time.NewTicker(c.config.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+		}
+		if c.finSent.Load() || c.finReceived.Load() {
+			return
+		}
+		if time.Since(time.Unix(0, c.lastSeen.Load())) > c.config.timeout() {
+			c.timedOut.Store(true)
+			c.onTimeout()
+			return
+		}
+		// A wedged stream blocks writes, so the ping must not hold up the
+		// timeout check.
+		if c.pinging.CompareAndSwap(false, true) {
+			go func() {
+				defer c.pinging.Store(false)
+				_ = c.writeFrame(framePing, nil)
+			}()
+		}
+	}
+}
+
+// halt stops pinging.
+func (c *keepAliveConn) halt() {
+	c.stopOnce.Do(func() { close(c.stop) })
+}
@@ -0,0 +1,263 @@
+package tunnel_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	gunnelquic "github.com/snakeice/gunnel/pkg/quic"
+	"github.com/snakeice/gunnel/pkg/transport"
+	"github.com/snakeice/gunnel/pkg/tunnel"
+)
+
+// noPings keeps the keepalive of a test quiet so it only sees its own frames.
+var noPings = tunnel.KeepAlive{Interval: time.Hour} //nolint:gochecknoglobals // test fixture
+
+// streamPair returns the root streams of both ends of a local QUIC
+// connection.
+func streamPair(t *testing.T) (transport.Stream, transport.Stream) {
+	t.Helper()
+	t.Setenv("GUNNEL_INSECURE", "true")
+
+	srv, err := gunnelquic.NewServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to start QUIC server: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(func() {
+		cancel()
+		_ = srv.Close()
+	})
+
+	accepted := make(chan transport.Transport, 1)
+	go func() {
+		defer close(accepted)
+		conn, err := srv.Accept(ctx)
+		if err != nil {
+			return
+		}
+		transp, err := transport.NewFromServer(ctx, conn)
+		if err != nil {
+			return
+		}
+		accepted <- transp
+	}()
+
+	client, err := transport.New(srv.Addr())
+	if err != nil {
+		t.Fatalf("failed to create transport: %v", err)
+	}
+	t.Cleanup(client.Close)
+
+	// The server only learns of the stream once data arrives on it.
+	if _, err := client.Root().Write([]byte{0}); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Root().Flush(); err != nil {
+		t.Fatal(err)
+	}
+	server, ok := <-accepted
+	if !ok {
+		t.Fatal("failed to accept the connection")
+	}
+	t.Cleanup(server.Close)
+	if _, err := io.ReadFull(server.Root(), make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+	return client.Root(), server.Root()
+}
+
+// sendFrame writes a raw keepalive frame to stream.
+func sendFrame(t *testing.T, stream transport.Stream, typ byte, payload []byte) {
+	t.Helper()
+	header := []byte{typ, 0, 0}
+	binary.BigEndian.PutUint16(header[1:], uint16(len(payload))) //nolint:gosec // test payloads are small
+	if _, err := stream.Write(append(header, payload...)); err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.Flush(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readFrame reads one raw keepalive frame from stream.
+func readFrame(t *testing.T, stream transport.Stream) (byte, []byte) {
+	t.Helper()
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(stream, header); err != nil {
+		t.Fatal(err)
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(header[1:]))
+	if _, err := io.ReadFull(stream, payload); err != nil {
+		t.Fatal(err)
+	}
+	return header[0], payload
+}
+
+func TestKeepAliveSplitsLargeWrites(t *testing.T) {
+	local, peer := streamPair(t)
+	conn := tunnel.NewKeepAliveConn(local, noPings, func() {})
+	defer conn.Halt()
+
+	data := bytes.Repeat([]byte("0123456789"), tunnel.MaxFramePayload/4)
+	go func() {
+		if n, err := conn.Write(data); err != nil || n != len(data) {
+			t.Errorf("Write = %d, %v", n, err)
+		}
+	}()
+
+	var got []byte
+	for len(got) < len(data) {
+		typ, payload := readFrame(t, peer)
+		if typ != tunnel.FrameData {
+			t.Fatalf("frame type = %d, want data", typ)
+		}
+		if len(payload) > tunnel.MaxFramePayload {
+			t.Fatalf("frame carries %d bytes, more than %d", len(payload), tunnel.MaxFramePayload)
+		}
+		got = append(got, payload...)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("frames do not carry the written data")
+	}
+}
+
+func TestKeepAliveReassemblesFrames(t *testing.T) {
+	local, peer := streamPair(t)
+	writer := tunnel.NewKeepAliveConn(local, noPings, func() {})
+	defer writer.Halt()
+	reader := tunnel.NewKeepAliveConn(peer, noPings, func() {})
+	defer reader.Halt()
+
+	data := bytes.Repeat([]byte("0123456789"), tunnel.MaxFramePayload/4)
+	go func() {
+		if _, err := writer.Write(data); err != nil {
+			t.Error(err)
+		}
+	}()
+	got := make([]byte, len(data))
+	if _, err := io.ReadFull(reader, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("read data differs from the written data")
+	}
+}
+
+func TestKeepAliveAnswersPings(t *testing.T) {
+	local, peer := streamPair(t)
+	conn := tunnel.NewKeepAliveConn(local, noPings, func() {})
+	defer conn.Halt()
+
+	time.Sleep(20 * time.Millisecond)
+	before := conn.LastSeen()
+	read := make(chan []byte, 1)
+	go func() {
+		buf := make([]byte, 4)
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Error(err)
+		}
+		read <- buf[:n]
+	}()
+
+	sendFrame(t, peer, tunnel.FramePing, nil)
+	if typ, _ := readFrame(t, peer); typ != tunnel.FramePong {
+		t.Fatalf("answer to a ping has type %d, want pong", typ)
+	}
+	if !conn.LastSeen().After(before) {
+		t.Error("a ping did not refresh when the peer was last seen")
+	}
+
+	// The ping is not handed to the reader.
+	sendFrame(t, peer, tunnel.FrameData, []byte("data"))
+	if got := <-read; string(got) != "data" {
+		t.Errorf("Read = %q, want the data frame", got)
+	}
+}
+
+func TestKeepAliveFinKeepsPongsFlowing(t *testing.T) {
+	local, peer := streamPair(t)
+	conn := tunnel.NewKeepAliveConn(local, noPings, func() {})
+	defer conn.Halt()
+
+	if err := conn.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	if typ, _ := readFrame(t, peer); typ != tunnel.FrameFin {
+		t.Fatalf("CloseWrite sent frame type %d, want fin", typ)
+	}
+
+	// The half-closed end still answers pings while waiting for the peer.
+	sendFrame(t, peer, tunnel.FramePing, nil)
+	sendFrame(t, peer, tunnel.FrameFin, nil)
+	if n, err := conn.Read(make([]byte, 4)); n != 0 || !errors.Is(err, io.EOF) {
+		t.Fatalf("Read after the peer's fin = %d, %v, want EOF", n, err)
+	}
+	if typ, _ := readFrame(t, peer); typ != tunnel.FramePong {
+		t.Fatalf("answer to a ping after fin has type %d, want pong", typ)
+	}
+	if _, err := conn.Read(make([]byte, 4)); !errors.Is(err, io.EOF) {
+		t.Errorf("second Read after fin = %v, want EOF", err)
+	}
+}
+
+func TestKeepAliveRejectsUnknownFrames(t *testing.T) {
+	local, peer := streamPair(t)
+	conn := tunnel.NewKeepAliveConn(local, noPings, func() {})
+	defer conn.Halt()
+
+	sendFrame(t, peer, 0x7f, nil)
+	if _, err := conn.Read(make([]byte, 4)); err == nil || !strings.Contains(err.Error(), "unknown keepalive frame type") {
+		t.Errorf("Read of an unknown frame = %v, want an error", err)
+	}
+}
+
+func TestKeepAliveTimesOutSilentPeer(t *testing.T) {
+	local, _ := streamPair(t)
+	app, proxied := net.Pipe()
+	defer app.Close()
+
+	tun := tunnel.NewTunnelWithLocal(proxied, local).
+		WithKeepAlive(tunnel.KeepAlive{Interval: 20 * time.Millisecond, Timeout: 100 * time.Millisecond})
+	done := make(chan error, 1)
+	go func() { done <- tun.Proxy() }()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, tunnel.ErrKeepAliveTimeout) {
+			t.Errorf("Proxy = %v, want ErrKeepAliveTimeout", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Proxy still running with a silent peer")
+	}
+	// onTimeout closes the local side, which the application notices.
+	if _, err := app.Read(make([]byte, 1)); err == nil {
+		t.Error("local connection still open after the timeout")
+	}
+}
+
+func TestKeepAliveCallsOnTimeout(t *testing.T) {
+	local, _ := streamPair(t)
+	timedOut := make(chan struct{})
+	conn := tunnel.NewKeepAliveConn(local, tunnel.KeepAlive{Interval: 20 * time.Millisecond}, func() {
+		close(timedOut)
+	})
+	defer conn.Halt()
+
+	start := time.Now()
+	select {
+	case <-timedOut:
+		if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+			t.Errorf("timed out after %v, before the default three intervals", elapsed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("onTimeout not called for a silent peer")
+	}
+}
@@ -1,6 +1,7 @@
 package tunnel
 
 import (
+	"bufio"
 	"context"
 	"errors"
 	"fmt"
@@ -10,16 +11,32 @@ import (
 	"time"
 
 	"github.com/sirupsen/logrus"
+	"github.com/snakeice/gunnel/pkg/logging"
 	"github.com/snakeice/gunnel/pkg/transport"
 )
 
-const nilString = "nil"
+const (
+	nilString = "nil"
+	// copyBufferSize matches the buffer io.Copy allocates on its own.
+	copyBufferSize = 32 * 1024
+)
+
+// bufferPool holds *[]byte copy buffers shared by every tunnel.
+//
+//nolint:gochecknoglobals // shared pool
+var bufferPool = sync.Pool{
+	New: func() any {
+		buf := make([]byte, copyBufferSize)
+		return &buf
+	},
+}
 
 // Tunnel represents a bidirectional tunnel between two connections.
 type Tunnel struct {
-	local  net.Conn
-	remote transport.Stream
-	mu     sync.Mutex
+	local     net.Conn
+	remote    transport.Stream
+	keepAlive KeepAlive
+	mu        sync.Mutex
 }
 
 // NewTunnel creates a new tunnel instance.
@@ -32,7 +49,7 @@ func NewTunnel(addr string, remote transport.Stream) (*Tunnel, error) {
 		return nil, fmt.Errorf("failed to connect to local service: %w", err)
 	}
 
-	logrus.WithFields(logrus.Fields{
+	logging.Data.WithFields(logrus.Fields{
 		"local_addr":  local.LocalAddr().String(),
 		"remote_addr": addr,
 	}).Trace("Connected to local service")
@@ -50,159 +67,164 @@ func NewTunnelWithLocal(local net.Conn, remote transport.Stream) *Tunnel {
 	}
 }
 
-// Proxy starts bidirectional tunneling.
-//
+// WithKeepAlive pings the peer of the remote stream while proxying, see
+// KeepAlive. The peer must have agreed to it.
+func (t *Tunnel) WithKeepAlive(k KeepAlive) *Tunnel {
+	t.keepAlive = k
+	return t
+}
+
+// NewBufferedConn returns conn reading through r, for connections whose first
+// bytes were already buffered, e.g. by an HTTP parser before an upgrade.
+func NewBufferedConn(conn net.Conn, r *bufio.Reader) net.Conn {
+	return &bufferedConn{Conn: conn, reader: r}
+}
 
-//nolint:gocognit // This function handles bidirectional proxying logic
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// CloseWrite half-closes the connection when it supports that and closes it
+// otherwise, so the peer still learns no more data is coming.
+func (c *bufferedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+// Proxy starts bidirectional tunneling. Raw connections may stay idle for
+// long, so the per-operation default deadline of the stream is lifted.
 func (t *Tunnel) Proxy() error {
 	// Capture current ends to avoid racing with Close() mutating t.local/t.remote
 	local := t.local
-	remote := t.remote
+	var remote net.Conn
+	if t.remote != nil {
+		remote = transport.AsNetConn(t.remote)
+		if err := remote.SetDeadline(transport.NoDeadline); err != nil {
+			logging.Data.WithError(err).Debug("Failed to lift stream deadline")
+		}
+	}
+
+	var ka *keepAliveConn
+	if remote != nil && t.keepAlive.Enabled() {
+		stream := t.remote
+		ka = newKeepAliveConn(remote, stream, t.keepAlive, func() {
+			logging.Data.WithField("stream_id", stream.ID()).Debug("Stream keepalive timed out, resetting stream")
+			stream.Reset()
+			if local != nil {
+				_ = local.Close()
+			}
+		})
+		defer ka.halt()
+		remote = ka
+	}
 
 	var wg sync.WaitGroup
 	wg.Add(2)
 
-	// Start bidirectional copying
 	go func() {
 		defer wg.Done()
-
-		laddr := nilString
-		if local != nil {
-			laddr = local.LocalAddr().String()
-		}
-		rid := nilString
-		if remote != nil {
-			rid = remote.ID()
-		}
-
-		logrus.WithFields(logrus.Fields{
-			"direction": "remote_to_local",
-			"local":     laddr,
-			"remote":    rid,
-		}).Debug("Starting remote to local copy")
-
-		if err := t.copy(remote, local); err != nil {
-			logrus.WithFields(logrus.Fields{
-				"error":     err,
-				"direction": "remote_to_local",
-			}).Error("Error copying from remote to local")
-		}
-
-		// Half-close local write side if supported to signal end-of-request,
-		// but keep the connection open for reading the response.
-		if local != nil {
-			if cw, ok := local.(interface{ CloseWrite() error }); ok {
-				if err := cw.CloseWrite(); err != nil && !errors.Is(err, net.ErrClosed) {
-					logrus.WithFields(logrus.Fields{
-						"error":     err,
-						"direction": "remote_to_local",
-					}).Warn("Failed to half-close local write side")
-				} else {
-					logrus.WithFields(logrus.Fields{
-						"direction": "remote_to_local",
-					}).Debug("Half-closed local write side")
-				}
-			}
-		}
+		t.pipe(local, remote, "remote_to_local")
 	}()
 
 	go func() {
 		defer wg.Done()
-
-		laddr := nilString
-		if local != nil {
-			laddr = local.LocalAddr().String()
-		}
-		rid := nilString
-		if remote != nil {
-			rid = remote.ID()
-		}
-
-		logrus.WithFields(logrus.Fields{
-			"direction": "local_to_remote",
-			"local":     laddr,
-			"remote":    rid,
-		}).Debug("Starting local to remote copy")
-
-		if err := t.copy(local, remote); err != nil {
-			logrus.WithFields(logrus.Fields{
-				"error":     err,
-				"direction": "local_to_remote",
-			}).Error("Error copying from local to remote")
-		}
-
-		// After finishing local->remote copy, half-close the write side of the remote
-		// stream to signal end-of-request and allow the response to flush back.
-		if remote != nil {
-			if err := remote.CloseWrite(); err != nil {
-				logrus.WithFields(logrus.Fields{
-					"error":     err,
-					"direction": "local_to_remote",
-				}).Warn("Failed to close write side of remote stream")
-			} else {
-				logrus.WithFields(logrus.Fields{
-					"direction": "local_to_remote",
-				}).Debug("Closed write side of remote stream")
-			}
-		}
+		t.pipe(remote, local, "local_to_remote")
 	}()
 
 	// Wait for both directions to complete to avoid races with Close()
 	wg.Wait()
+	if ka != nil && ka.timedOut.Load() {
+		return ErrKeepAliveTimeout
+	}
 	return nil
 }
 
-// copy handles the actual data transfer between connections.
-//
-//nolint:gocognit // Bidirectional IO transfer with error handling
-func (t *Tunnel) copy(dst io.Writer, src io.Reader) error {
-	buf := make([]byte, 32*1024)
-	totalBytes := 0
-	lastLogTime := time.Now()
-	lastLogBytes := 0
-
-	for {
-		if src == nil {
-			return nil
-		}
+// pipe copies src into dst and then half-closes dst, signalling end-of-data to
+// the peer while keeping the other direction open for the response.
+func (t *Tunnel) pipe(dst, src net.Conn, direction string) {
+	logger := logging.Data.WithFields(logrus.Fields{
+		"direction": direction,
+		"src":       describeConn(src),
+		"dst":       describeConn(dst),
+	})
 
-		n, err := src.Read(buf)
-		if err != nil {
-			if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
-				if totalBytes > 0 {
-					logrus.WithFields(logrus.Fields{
-						"total_bytes": totalBytes,
-						"duration":    time.Since(lastLogTime),
-					}).Debug("Copy completed")
-				}
-				return nil
-			}
-			logrus.WithError(err).Error("Failed to read data")
-			return fmt.Errorf("failed to read data: %w", err)
-		}
+	logger.Debug("Starting copy")
 
-		if n > 0 {
-			totalBytes += n
+	start := time.Now()
+	n, err := t.copy(dst, src)
+	if err != nil {
+		logger.WithError(err).Log(transport.LogLevel(err), "Error copying data")
+	}
+	if n > 0 {
+		elapsed := time.Since(start)
+		logger.WithFields(logrus.Fields{
+			"total_bytes": n,
+			"duration":    elapsed,
+			"rate":        fmt.Sprintf("%.2f MB/s", float64(n)/elapsed.Seconds()/1024/1024),
+		}).Debug("Copy completed")
+	}
 
-			if _, err := dst.Write(buf[:n]); err != nil {
-				logrus.WithError(err).Error("Failed to write data")
-				return fmt.Errorf("failed to write data: %w", err)
-			}
+	if dst == nil {
+		return
+	}
 
-			elapsed := time.Since(lastLogTime)
-			if totalBytes-lastLogBytes >= 1024*1024 || elapsed > 10*time.Second {
-				bytesTransferred := totalBytes - lastLogBytes
-				ratePerSecond := float64(bytesTransferred) / elapsed.Seconds()
-				rateMBps := ratePerSecond / 1024 / 1024
-				logrus.WithFields(logrus.Fields{
-					"bytes_transferred": totalBytes,
-					"rate":              fmt.Sprintf("%.2f MB/s", rateMBps),
-				}).Debug("Copy progress")
-				lastLogBytes = totalBytes
-				lastLogTime = time.Now()
-			}
-		}
+	cw, ok := dst.(interface{ CloseWrite() error })
+	if !ok {
+		return
+	}
+
+	if err := cw.CloseWrite(); err != nil && !errors.Is(err, net.ErrClosed) {
+		logger.WithError(err).Warn("Failed to half-close write side")
+		return
+	}
+
+	logger.Debug("Half-closed write side")
+}
+
+func describeConn(conn net.Conn) string {
+	if conn == nil {
+		return nilString
+	}
+	if strm, ok := conn.(interface{ ID() string }); ok {
+		return strm.ID()
+	}
+	if addr := conn.LocalAddr(); addr != nil {
+		return addr.String()
+	}
+	return nilString
+}
+
+// copy moves src into dst with io.CopyBuffer, so the ReaderFrom/WriterTo
+// fast paths of either end (splice between TCP sockets) are used when they
+// exist and a pooled buffer otherwise.
+func (t *Tunnel) copy(dst io.Writer, src io.Reader) (int64, error) {
+	if src == nil || dst == nil {
+		return 0, nil
+	}
+
+	buf := getBuffer()
+	defer bufferPool.Put(buf)
+
+	n, err := io.CopyBuffer(dst, src, *buf)
+	if err != nil && !errors.Is(err, net.ErrClosed) {
+		return n, fmt.Errorf("failed to copy data: %w", err)
+	}
+	return n, nil
+}
+
+func getBuffer() *[]byte {
+	if buf, ok := bufferPool.Get().(*[]byte); ok {
+		return buf
 	}
+	buf := make([]byte, copyBufferSize)
+	return &buf
 }
 
 // Close closes both connections.
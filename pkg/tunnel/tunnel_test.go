@@ -0,0 +1,128 @@
+package tunnel_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+
+	gunnelquic "github.com/snakeice/gunnel/pkg/quic"
+	"github.com/snakeice/gunnel/pkg/transport"
+	"github.com/snakeice/gunnel/pkg/tunnel"
+)
+
+const transferSize = 64 << 20
+
+// newSink dials a local QUIC server that counts and discards what each stream
+// carries, then closes it.
+func newSink(b *testing.B) (transport.Transport, <-chan int64) {
+	b.Helper()
+	b.Setenv("GUNNEL_INSECURE", "true")
+
+	srv, err := gunnelquic.NewServer("127.0.0.1:0")
+	if err != nil {
+		b.Fatalf("failed to start QUIC server: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	b.Cleanup(func() {
+		cancel()
+		_ = srv.Close()
+	})
+
+	received := make(chan int64, 4)
+	go func() {
+		conn, err := srv.Accept(ctx)
+		if err != nil {
+			return
+		}
+		for {
+			strm, err := conn.AcceptStream(ctx)
+			if err != nil {
+				return
+			}
+			go func() {
+				n, _ := io.Copy(io.Discard, strm)
+				_ = strm.Close()
+				received <- n
+			}()
+		}
+	}()
+
+	transp, err := transport.New(srv.Addr())
+	if err != nil {
+		b.Fatalf("failed to create transport: %v", err)
+	}
+	b.Cleanup(transp.Close)
+
+	return transp, received
+}
+
+// tcpPair returns both ends of a loopback TCP connection.
+func tcpPair(b *testing.B) (net.Conn, net.Conn) {
+	b.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- conn
+	}()
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		b.Fatalf("dial: %v", err)
+	}
+	server, ok := <-accepted
+	if !ok {
+		b.Fatal("accept failed")
+	}
+	return client, server
+}
+
+// BenchmarkProxyLocalToRemote measures a large upload from a local TCP
+// connection into a QUIC stream.
+func BenchmarkProxyLocalToRemote(b *testing.B) {
+	transp, received := newSink(b)
+	payload := make([]byte, 1<<20)
+
+	b.SetBytes(transferSize)
+	b.ResetTimer()
+	for range b.N {
+		strm, err := transp.Acquire()
+		if err != nil {
+			b.Fatalf("acquire: %v", err)
+		}
+		app, local := tcpPair(b)
+		tun := tunnel.NewTunnelWithLocal(local, strm)
+
+		go func() {
+			for sent := 0; sent < transferSize; sent += len(payload) {
+				if _, err := app.Write(payload); err != nil {
+					b.Errorf("write: %v", err)
+					return
+				}
+			}
+			_ = app.(*net.TCPConn).CloseWrite()
+		}()
+
+		if err := tun.Proxy(); err != nil {
+			b.Fatalf("proxy: %v", err)
+		}
+		if n := <-received; n != transferSize {
+			b.Fatalf("received %d bytes, want %d", n, transferSize)
+		}
+
+		_ = tun.Close()
+		_ = app.Close()
+	}
+}
@@ -0,0 +1,406 @@
+// Package usage aggregates proxied traffic per tenant and day, persists the
+// aggregates and builds daily or monthly usage reports from them.
+package usage
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/snakeice/gunnel/pkg/store"
+)
+
+const (
+	dayLayout   = "2006-01-02"
+	monthLayout = "2006-01"
+
+	// maxPaths bounds the distinct paths tracked per tenant and day; further
+	// paths are counted under otherPaths.
+	maxPaths   = 500
+	otherPaths = "(other)"
+
+	// DefaultRetention is how long daily aggregates are kept by default.
+	DefaultRetention = 400 * 24 * time.Hour
+)
+
+// Period selects the granularity of a report.
+type Period string
+
+const (
+	Daily   Period = "daily"
+	Monthly Period = "monthly"
+)
+
+// ErrInvalidPeriod is returned for periods other than Daily and Monthly.
+var ErrInvalidPeriod = errors.New(`period must be "daily" or "monthly"`)
+
+// Bucket is the usage of one tenant during one day.
+type Bucket struct {
+	Requests uint64            `json:"requests"`
+	BytesIn  uint64            `json:"bytes_in"`
+	BytesOut uint64            `json:"bytes_out"`
+	Tunnels  map[string]uint64 `json:"tunnels"` // requests per tunnel
+	Paths    map[string]uint64 `json:"paths"`   // requests per path
+}
+
+func newBucket() *Bucket {
+	return &Bucket{Tunnels: map[string]uint64{}, Paths: map[string]uint64{}}
+}
+
+func (b *Bucket) merge(other *Bucket) {
+	b.Requests += other.Requests
+	b.BytesIn += other.BytesIn
+	b.BytesOut += other.BytesOut
+	for k, v := range other.Tunnels {
+		b.Tunnels[k] += v
+	}
+	for k, v := range other.Paths {
+		b.Paths[k] += v
+	}
+}
+
+// Recorder aggregates requests in memory and periodically saves them.
+type Recorder struct {
+	mu        sync.Mutex
+	store     store.Store
+	key       string
+	retention time.Duration
+	days      map[string]map[string]*Bucket // day -> tenant -> usage
+	dirty     bool
+}
+
+// New returns a recorder persisting to key of st, loading the aggregates
+// already saved there. With a nil store the aggregates only live in memory.
+func New(st store.Store, key string) (*Recorder, error) {
+	r := &Recorder{
+		store:     st,
+		key:       key,
+		retention: DefaultRetention,
+		days:      map[string]map[string]*Bucket{},
+	}
+	if st == nil {
+		return r, nil
+	}
+
+	data, err := st.Get(key)
+	if errors.Is(err, store.ErrNotFound) {
+		return r, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read usage: %w", err)
+	}
+	if err := json.Unmarshal(data, &r.days); err != nil {
+		return nil, fmt.Errorf("failed to parse usage: %w", err)
+	}
+	if r.days == nil {
+		r.days = map[string]map[string]*Bucket{}
+	}
+	for _, tenants := range r.days {
+		for tenant, b := range tenants {
+			loaded := newBucket()
+			if b != nil {
+				loaded.merge(b)
+			}
+			tenants[tenant] = loaded
+		}
+	}
+	return r, nil
+}
+
+// SetRetention changes how long daily aggregates are kept; zero restores
+// DefaultRetention.
+func (r *Recorder) SetRetention(retention time.Duration) {
+	if retention <= 0 {
+		retention = DefaultRetention
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.retention = retention
+}
+
+// PurgeTenant deletes every aggregate of tenant and returns how many daily
+// records it removed. Call Flush to persist the deletion.
+func (r *Recorder) PurgeTenant(tenant string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	removed := 0
+	for day, tenants := range r.days {
+		if _, ok := tenants[tenant]; ok {
+			delete(tenants, tenant)
+			removed++
+		}
+		if len(tenants) == 0 {
+			delete(r.days, day)
+		}
+	}
+	r.dirty = r.dirty || removed > 0
+	return removed
+}
+
+// Tunnels returns the tunnels tenant sent requests through, in order.
+func (r *Recorder) Tunnels(tenant string) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var tunnels []string
+	for _, tenants := range r.days {
+		if b, ok := tenants[tenant]; ok {
+			for tunnel := range b.Tunnels {
+				tunnels = append(tunnels, tunnel)
+			}
+		}
+	}
+	slices.Sort(tunnels)
+	return slices.Compact(tunnels)
+}
+
+// PurgeTunnel deletes the request counts of tunnel from every aggregate and
+// returns how many it removed. Tenant totals and paths are not split by
+// tunnel and stay. Call Flush to persist the deletion.
+func (r *Recorder) PurgeTunnel(tunnel string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	removed := 0
+	for _, tenants := range r.days {
+		for _, b := range tenants {
+			if _, ok := b.Tunnels[tunnel]; ok {
+				delete(b.Tunnels, tunnel)
+				removed++
+			}
+		}
+	}
+	r.dirty = r.dirty || removed > 0
+	return removed
+}
+
+// Record accounts one proxied request of tenant.
+func (r *Recorder) Record(tenant, tunnel, path string, bytesIn, bytesOut int64) {
+	day := time.Now().UTC().Format(dayLayout)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	tenants, ok := r.days[day]
+	if !ok {
+		tenants = map[string]*Bucket{}
+		r.days[day] = tenants
+	}
+	b, ok := tenants[tenant]
+	if !ok {
+		b = newBucket()
+		tenants[tenant] = b
+	}
+
+	b.Requests++
+	b.BytesIn += uint64(max(bytesIn, 0))   //nolint:gosec // G115: clamped to non-negative
+	b.BytesOut += uint64(max(bytesOut, 0)) //nolint:gosec // G115: clamped to non-negative
+	b.Tunnels[tunnel]++
+	if _, tracked := b.Paths[path]; !tracked && len(b.Paths) >= maxPaths {
+		path = otherPaths
+	}
+	b.Paths[path]++
+	r.dirty = true
+}
+
+// Flush drops aggregates past retention and saves the rest if they changed.
+func (r *Recorder) Flush() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	cutoff := time.Now().UTC().Add(-r.retention).Format(dayLayout)
+	for day := range r.days {
+		if day < cutoff {
+			delete(r.days, day)
+			r.dirty = true
+		}
+	}
+
+	if r.store == nil || !r.dirty {
+		return nil
+	}
+
+	data, err := json.Marshal(r.days)
+	if err != nil {
+		return fmt.Errorf("failed to encode usage: %w", err)
+	}
+	if err := r.store.Put(r.key, data); err != nil {
+		return fmt.Errorf("failed to write usage: %w", err)
+	}
+	r.dirty = false
+	return nil
+}
+
+// Run flushes every interval until ctx is done, then flushes a last time.
+func (r *Recorder) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			if err := r.Flush(); err != nil {
+				logrus.WithError(err).Error("Failed to save usage")
+			}
+			return
+		case <-ticker.C:
+			if err := r.Flush(); err != nil {
+				logrus.WithError(err).Error("Failed to save usage")
+			}
+		}
+	}
+}
+
+// PathCount is the number of requests to a path.
+type PathCount struct {
+	Path     string `json:"path"`
+	Requests uint64 `json:"requests"`
+}
+
+// Summary is the usage of one tenant during one day or month.
+type Summary struct {
+	Period        string      `json:"period"`
+	Tenant        string      `json:"tenant"`
+	Requests      uint64      `json:"requests"`
+	BytesIn       uint64      `json:"bytes_in"`
+	BytesOut      uint64      `json:"bytes_out"`
+	UniqueTunnels int         `json:"unique_tunnels"`
+	TopPaths      []PathCount `json:"top_paths"`
+}
+
+// Query filters a report. Zero times leave the range open and an empty
+// Tenant includes every tenant.
+type Query struct {
+	Period Period
+	From   time.Time
+	To     time.Time
+	Tenant string
+	Top    int
+}
+
+// Report summarizes the recorded usage per tenant and period, sorted by
+// period then tenant.
+func (r *Recorder) Report(q Query) ([]Summary, error) {
+	layout := dayLayout
+	switch q.Period {
+	case Daily, "":
+	case Monthly:
+		layout = monthLayout
+	default:
+		return nil, ErrInvalidPeriod
+	}
+
+	from, to := "", "9999-12-31"
+	if !q.From.IsZero() {
+		from = q.From.UTC().Format(dayLayout)
+	}
+	if !q.To.IsZero() {
+		to = q.To.UTC().Format(dayLayout)
+	}
+
+	type key struct{ period, tenant string }
+	merged := map[key]*Bucket{}
+
+	r.mu.Lock()
+	for day, tenants := range r.days {
+		if day < from || day > to {
+			continue
+		}
+		period := day[:len(layout)]
+		for tenant, b := range tenants {
+			if q.Tenant != "" && tenant != q.Tenant {
+				continue
+			}
+			k := key{period, tenant}
+			if merged[k] == nil {
+				merged[k] = newBucket()
+			}
+			merged[k].merge(b)
+		}
+	}
+	r.mu.Unlock()
+
+	summaries := make([]Summary, 0, len(merged))
+	for k, b := range merged {
+		summaries = append(summaries, Summary{
+			Period:        k.period,
+			Tenant:        k.tenant,
+			Requests:      b.Requests,
+			BytesIn:       b.BytesIn,
+			BytesOut:      b.BytesOut,
+			UniqueTunnels: len(b.Tunnels),
+			TopPaths:      topPaths(b.Paths, q.Top),
+		})
+	}
+	slices.SortFunc(summaries, func(a, b Summary) int {
+		if c := strings.Compare(a.Period, b.Period); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Tenant, b.Tenant)
+	})
+	return summaries, nil
+}
+
+func topPaths(paths map[string]uint64, n int) []PathCount {
+	top := make([]PathCount, 0, len(paths))
+	for path, count := range paths {
+		top = append(top, PathCount{Path: path, Requests: count})
+	}
+	slices.SortFunc(top, func(a, b PathCount) int {
+		if a.Requests != b.Requests {
+			if a.Requests > b.Requests {
+				return -1
+			}
+			return 1
+		}
+		return strings.Compare(a.Path, b.Path)
+	})
+	if n > 0 && len(top) > n {
+		top = top[:n]
+	}
+	return top
+}
+
+// WriteCSV writes summaries as CSV; top paths are joined as "path=count"
+// separated by spaces.
+func WriteCSV(w io.Writer, summaries []Summary) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{
+		"period", "tenant", "requests", "bytes_in", "bytes_out", "unique_tunnels", "top_paths",
+	}); err != nil {
+		return err
+	}
+
+	for _, s := range summaries {
+		paths := make([]string, 0, len(s.TopPaths))
+		for _, p := range s.TopPaths {
+			paths = append(paths, p.Path+"="+strconv.FormatUint(p.Requests, 10))
+		}
+		if err := cw.Write([]string{
+			s.Period,
+			s.Tenant,
+			strconv.FormatUint(s.Requests, 10),
+			strconv.FormatUint(s.BytesIn, 10),
+			strconv.FormatUint(s.BytesOut, 10),
+			strconv.Itoa(s.UniqueTunnels),
+			strings.Join(paths, " "),
+		}); err != nil {
+			return err
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,94 @@
+package usage_test
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/snakeice/gunnel/pkg/store"
+	"github.com/snakeice/gunnel/pkg/usage"
+)
+
+func TestReportAndPersist(t *testing.T) {
+	st, err := store.NewFile(t.TempDir())
+	if err != nil {
+		t.Fatalf("store: %v", err)
+	}
+
+	rec, err := usage.New(st, "usage.json")
+	if err != nil {
+		t.Fatalf("new: %v", err)
+	}
+	rec.Record("team:acme/alice", "web", "/", 10, 100)
+	rec.Record("team:acme/alice", "web", "/api", 0, 50)
+	rec.Record("team:acme/alice", "api", "/api", -1, 50)
+	rec.Record("token:abcd", "other", "/", 0, 1)
+	if err := rec.Flush(); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+
+	reloaded, err := usage.New(st, "usage.json")
+	if err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+
+	summaries, err := reloaded.Report(usage.Query{Period: usage.Monthly, Tenant: "team:acme/alice", Top: 1})
+	if err != nil {
+		t.Fatalf("report: %v", err)
+	}
+	if len(summaries) != 1 {
+		t.Fatalf("expected one summary, got %+v", summaries)
+	}
+
+	got := summaries[0]
+	if got.Period != time.Now().UTC().Format("2006-01") {
+		t.Errorf("unexpected period %q", got.Period)
+	}
+	if got.Requests != 3 || got.BytesIn != 10 || got.BytesOut != 200 || got.UniqueTunnels != 2 {
+		t.Errorf("unexpected totals %+v", got)
+	}
+	if len(got.TopPaths) != 1 || got.TopPaths[0] != (usage.PathCount{Path: "/api", Requests: 2}) {
+		t.Errorf("unexpected top paths %+v", got.TopPaths)
+	}
+
+	var csv strings.Builder
+	if err := usage.WriteCSV(&csv, summaries); err != nil {
+		t.Fatalf("csv: %v", err)
+	}
+	if !strings.Contains(csv.String(), ",team:acme/alice,3,10,200,2,/api=2\n") {
+		t.Errorf("unexpected CSV:\n%s", csv.String())
+	}
+
+	if _, err := reloaded.Report(usage.Query{Period: "weekly"}); err == nil {
+		t.Error("expected an error for an unknown period")
+	}
+}
+
+func TestPurge(t *testing.T) {
+	rec, err := usage.New(nil, "")
+	if err != nil {
+		t.Fatalf("new: %v", err)
+	}
+	rec.Record("team:acme/alice", "web", "/", 0, 1)
+	rec.Record("team:acme/alice", "api", "/", 0, 1)
+	rec.Record("token:abcd", "web", "/", 0, 1)
+
+	if got := rec.Tunnels("team:acme/alice"); !slices.Equal(got, []string{"api", "web"}) {
+		t.Fatalf("Tunnels = %v, want [api web]", got)
+	}
+	if n := rec.PurgeTunnel("web"); n != 2 {
+		t.Fatalf("PurgeTunnel removed %d records, want 2", n)
+	}
+	if n := rec.PurgeTenant("token:abcd"); n != 1 {
+		t.Fatalf("PurgeTenant removed %d records, want 1", n)
+	}
+
+	summaries, err := rec.Report(usage.Query{Period: usage.Daily})
+	if err != nil {
+		t.Fatalf("report: %v", err)
+	}
+	if len(summaries) != 1 || summaries[0].Tenant != "team:acme/alice" || summaries[0].UniqueTunnels != 1 {
+		t.Fatalf("unexpected usage after purge %+v", summaries)
+	}
+}
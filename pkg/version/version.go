@@ -0,0 +1,112 @@
+// Package version holds the build information embedded at link time, e.g.
+//
+//	go build -ldflags "-X github.com/snakeice/gunnel/pkg/version.Version=v1.2.3"
+package version
+
+import (
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+)
+
+// Set through -ldflags -X by release builds.
+//
+//nolint:gochecknoglobals // overridden by the linker
+var (
+	Version = "dev"
+	Commit  = ""
+	Date    = ""
+	BuiltBy = ""
+)
+
+// Info describes the running binary.
+type Info struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	Date      string `json:"date,omitempty"`
+	BuiltBy   string `json:"built_by,omitempty"`
+	GoVersion string `json:"go_version"`
+	Platform  string `json:"platform"`
+}
+
+// Get returns the build information. Commit and date fall back to the VCS
+// stamp of the Go toolchain for builds without ldflags.
+func Get() Info {
+	info := Info{
+		Version:   Version,
+		Commit:    Commit,
+		Date:      Date,
+		BuiltBy:   BuiltBy,
+		GoVersion: runtime.Version(),
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+	}
+
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range bi.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				if info.Commit == "" {
+					info.Commit = s.Value
+				}
+			case "vcs.time":
+				if info.Date == "" {
+					info.Date = s.Value
+				}
+			}
+		}
+	}
+
+	return info
+}
+
+// String formats the information on one line, e.g.
+// "v1.2.3 (commit abc1234, built 2024-01-02T15:04:05Z, go1.22.0 linux/amd64)".
+func (i Info) String() string {
+	s := i.Version + " ("
+	if i.Commit != "" {
+		commit := i.Commit
+		if len(commit) > 7 {
+			commit = commit[:7]
+		}
+		s += "commit " + commit + ", "
+	}
+	if i.Date != "" {
+		s += "built " + i.Date + ", "
+	}
+	return s + i.GoVersion + " " + i.Platform + ")"
+}
+
+// Compatible reports whether binaries of versions a and b can be expected to
+// talk to each other: releases with the same major version, or the same
+// minor version before 1.0. Development builds, and peers too old to send
+// their version, are compatible with anything.
+func Compatible(a, b string) bool {
+	aMajor, aMinor, okA := parse(a)
+	bMajor, bMinor, okB := parse(b)
+	if !okA || !okB {
+		return true
+	}
+	if aMajor == 0 || bMajor == 0 {
+		return aMajor == bMajor && aMinor == bMinor
+	}
+	return aMajor == bMajor
+}
+
+// parse returns the major and minor numbers of a release version such as
+// "v1.2.3" or "1.2.3-rc1".
+func parse(v string) (int, int, bool) {
+	parts := strings.SplitN(strings.TrimPrefix(v, "v"), ".", 3)
+	if len(parts) < 2 {
+		return 0, 0, false
+	}
+	major, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, false
+	}
+	minor, err := strconv.Atoi(strings.SplitN(parts[1], "-", 2)[0])
+	if err != nil {
+		return 0, 0, false
+	}
+	return major, minor, true
+}
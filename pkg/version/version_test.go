@@ -0,0 +1,57 @@
+package version_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/snakeice/gunnel/pkg/version"
+)
+
+func TestInfoString(t *testing.T) {
+	info := version.Info{
+		Version:   "v1.2.3",
+		Commit:    "0123456789abcdef",
+		Date:      "2024-01-02T15:04:05Z",
+		GoVersion: "go1.22.0",
+		Platform:  "linux/amd64",
+	}
+
+	want := "v1.2.3 (commit 0123456, built 2024-01-02T15:04:05Z, go1.22.0 linux/amd64)"
+	if got := info.String(); got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+
+	info.Commit, info.Date = "", ""
+	if got := info.String(); got != "v1.2.3 (go1.22.0 linux/amd64)" {
+		t.Errorf("String() without VCS info = %q", got)
+	}
+}
+
+func TestGetDefaults(t *testing.T) {
+	info := version.Get()
+	if info.Version != version.Version {
+		t.Errorf("Version = %q, want %q", info.Version, version.Version)
+	}
+	if !strings.Contains(info.Platform, "/") {
+		t.Errorf("Platform = %q, want os/arch", info.Platform)
+	}
+}
+
+func TestCompatible(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"v1.2.3", "v1.9.0", true},
+		{"v1.2.3", "2.0.0", false},
+		{"v0.4.1", "v0.4.7-next", true},
+		{"v0.4.1", "v0.5.0", false},
+		{"dev", "v3.0.0", true},
+		{"v1.0.0", "", true},
+	}
+	for _, tt := range tests {
+		if got := version.Compatible(tt.a, tt.b); got != tt.want {
+			t.Errorf("Compatible(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
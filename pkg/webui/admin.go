@@ -0,0 +1,207 @@
+package webui
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/snakeice/gunnel/pkg/logging"
+	"github.com/snakeice/gunnel/pkg/protocol"
+)
+
+const adminPrefix = "/api/admin/"
+
+// maxAdminBody bounds the JSON body accepted by admin endpoints.
+const maxAdminBody = 64 << 10
+
+// AdminScope limits what an admin token may do.
+type AdminScope string
+
+const (
+	// ScopeRead only allows the GET endpoints, e.g. for dashboards and
+	// alerting.
+	ScopeRead AdminScope = "read"
+	// ScopeFull also allows the endpoints that change state.
+	ScopeFull AdminScope = "full"
+)
+
+// Valid reports whether s is a known scope.
+func (s AdminScope) Valid() bool {
+	return s == ScopeRead || s == ScopeFull
+}
+
+// AdminToken is an additional admin API credential with a scope.
+type AdminToken struct {
+	Name  string
+	Token string
+	Scope AdminScope
+}
+
+// SetAdminToken enables the admin API. Requests must send the token as a
+// bearer token; with no token set every admin endpoint answers 404.
+func (ui *WebUI) SetAdminToken(token string) {
+	ui.mu.Lock()
+	defer ui.mu.Unlock()
+
+	ui.adminToken = token
+}
+
+// SetAdminTokens adds scoped tokens to the admin API next to the full
+// access token of SetAdminToken.
+func (ui *WebUI) SetAdminTokens(tokens []AdminToken) {
+	ui.mu.Lock()
+	defer ui.mu.Unlock()
+
+	ui.adminTokens = tokens
+}
+
+// adminCredential returns the name and scope of the admin token given, or
+// false when it matches none.
+func (ui *WebUI) adminCredential(given string) (string, AdminScope, bool) {
+	ui.mu.RLock()
+	defer ui.mu.RUnlock()
+
+	if ui.adminToken != "" && subtle.ConstantTimeCompare([]byte(given), []byte(ui.adminToken)) == 1 {
+		return "admin_token", ScopeFull, true
+	}
+	for _, t := range ui.adminTokens {
+		if subtle.ConstantTimeCompare([]byte(given), []byte(t.Token)) == 1 {
+			return t.Name, t.Scope, true
+		}
+	}
+	return "", "", false
+}
+
+func (ui *WebUI) adminEnabled() bool {
+	ui.mu.RLock()
+	defer ui.mu.RUnlock()
+
+	return ui.adminToken != "" || len(ui.adminTokens) > 0
+}
+
+// adminOnly wraps h with method, bearer token and scope checks. GET
+// endpoints accept read tokens; the others need full access.
+func (ui *WebUI) adminOnly(method string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !ui.adminEnabled() {
+			http.NotFound(w, r)
+			return
+		}
+
+		if r.Method != method {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		name, scope, known := ui.adminCredential(given)
+		if !ok || given == "" || !known {
+			logging.WebUI.WithField("remote", r.RemoteAddr).Warn("Rejected admin API request")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		if method != http.MethodGet && scope != ScopeFull {
+			logging.WebUI.WithFields(logrus.Fields{
+				"remote": r.RemoteAddr,
+				"token":  name,
+				"path":   r.URL.Path,
+			}).Warn("Rejected admin API request outside the token's scope")
+			http.Error(w, "Forbidden: token is read-only", http.StatusForbidden)
+			return
+		}
+
+		h(w, r)
+	}
+}
+
+type broadcastRequest struct {
+	Message string `json:"message"`
+	Level   string `json:"level"`
+}
+
+func (ui *WebUI) handleBroadcast(w http.ResponseWriter, r *http.Request) {
+	var req broadcastRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAdminBody)).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+
+	if strings.TrimSpace(req.Message) == "" {
+		http.Error(w, "message is required", http.StatusBadRequest)
+		return
+	}
+
+	if req.Level != "" {
+		if _, err := logrus.ParseLevel(req.Level); err != nil {
+			http.Error(w, "invalid level", http.StatusBadRequest)
+			return
+		}
+	}
+
+	sent := ui.mngr.Broadcast(req.Level, req.Message)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]any{"clients": sent}); err != nil {
+		http.Error(w, "Failed to encode JSON", http.StatusInternalServerError)
+	}
+}
+
+// clientConfig is the JSON form of the settings pushed to clients.
+type clientConfig struct {
+	Version           uint32          `json:"version,omitempty"`
+	HeartbeatInterval string          `json:"heartbeat_interval,omitempty"`
+	RateLimit         uint32          `json:"rate_limit,omitempty"`
+	Features          map[string]bool `json:"features,omitempty"`
+	Notice            string          `json:"notice,omitempty"`
+}
+
+func (ui *WebUI) handleGetClientConfig(w http.ResponseWriter, r *http.Request) {
+	update, ok := ui.mngr.ClientConfig()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	body := clientConfig{
+		Version:   update.Version,
+		RateLimit: update.RateLimit,
+		Features:  update.Features,
+		Notice:    update.Notice,
+	}
+	if update.HeartbeatInterval > 0 {
+		body.HeartbeatInterval = update.HeartbeatInterval.String()
+	}
+	writeJSON(w, body)
+}
+
+// handlePutClientConfig replaces the client settings and pushes them to the
+// connected clients right away.
+func (ui *WebUI) handlePutClientConfig(w http.ResponseWriter, r *http.Request) {
+	var req clientConfig
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAdminBody)).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+
+	update := protocol.ConfigUpdate{
+		RateLimit: req.RateLimit,
+		Features:  req.Features,
+		Notice:    req.Notice,
+	}
+	if req.HeartbeatInterval != "" {
+		interval, err := time.ParseDuration(req.HeartbeatInterval)
+		if err != nil || interval < time.Second {
+			http.Error(w, "heartbeat_interval must be a duration of at least 1s", http.StatusBadRequest)
+			return
+		}
+		update.HeartbeatInterval = interval
+	}
+
+	sent := ui.mngr.PushConfig(update)
+	current, _ := ui.mngr.ClientConfig()
+	writeJSON(w, map[string]any{"version": current.Version, "clients": sent})
+}
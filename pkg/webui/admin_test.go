@@ -0,0 +1,81 @@
+package webui_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/snakeice/gunnel/pkg/manager"
+	"github.com/snakeice/gunnel/pkg/webui"
+)
+
+// mutatingAdminRoutes are the admin endpoints that change state.
+var mutatingAdminRoutes = []struct { //nolint:gochecknoglobals // test table
+	method, path string
+}{
+	{http.MethodPost, "/api/admin/broadcast"},
+	{http.MethodPut, "/api/admin/client-config"},
+	{http.MethodPost, "/api/admin/tunnels"},
+	{http.MethodPut, "/api/admin/tunnels/web"},
+	{http.MethodDelete, "/api/admin/tunnels/web"},
+	{http.MethodPut, "/api/admin/tokens/ci"},
+	{http.MethodDelete, "/api/admin/tokens/ci"},
+	{http.MethodPost, "/api/admin/purge"},
+	{http.MethodDelete, "/api/admin/tcp/bans/192.0.2.1"},
+	{http.MethodPost, "/api/admin/replay"},
+	{http.MethodDelete, "/api/admin/sessions"},
+	{http.MethodDelete, "/api/admin/sessions/abc"},
+	{http.MethodPost, "/api/admin/shares"},
+	{http.MethodDelete, "/api/admin/shares/demo"},
+}
+
+func adminRequest(ui *webui.WebUI, method, path, token, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	ui.HandleRequest(rec, req)
+	return rec
+}
+
+func TestAdminTokenScopes(t *testing.T) {
+	ui := webui.NewWebUI(manager.New())
+	ui.SetAdminToken("full-token")
+	ui.SetAdminTokens([]webui.AdminToken{
+		{Name: "dashboard", Token: "read-token", Scope: webui.ScopeRead},
+		{Name: "ci", Token: "ci-token", Scope: webui.ScopeFull},
+	})
+
+	for _, route := range mutatingAdminRoutes {
+		t.Run(route.method+" "+route.path, func(t *testing.T) {
+			if rec := adminRequest(ui, route.method, route.path, "read-token", "{}"); rec.Code != http.StatusForbidden {
+				t.Errorf("read-only token = %d, want 403", rec.Code)
+			}
+			for _, token := range []string{"full-token", "ci-token"} {
+				rec := adminRequest(ui, route.method, route.path, token, "{}")
+				if rec.Code == http.StatusUnauthorized || rec.Code == http.StatusForbidden {
+					t.Errorf("full access token %s = %d, want it let through", token, rec.Code)
+				}
+			}
+		})
+	}
+
+	if rec := adminRequest(ui, http.MethodGet, "/api/admin/tunnels", "read-token", ""); rec.Code != http.StatusOK {
+		t.Errorf("listing tunnels with a read-only token = %d, want 200", rec.Code)
+	}
+	if rec := adminRequest(ui, http.MethodPost, "/api/admin/tunnels", "read-token", `{"name":"shop"}`); rec.Code !=
+		http.StatusForbidden {
+		t.Errorf("creating a tunnel with a read-only token = %d, want 403", rec.Code)
+	}
+	if rec := adminRequest(ui, http.MethodPost, "/api/admin/tunnels", "ci-token", `{"name":"shop"}`); rec.Code !=
+		http.StatusCreated {
+		t.Errorf("creating a tunnel with a full access token = %d, want 201", rec.Code)
+	}
+	if rec := adminRequest(ui, http.MethodDelete, "/api/admin/tunnels/shop", "full-token", ""); rec.Code >= 300 {
+		t.Errorf("deleting a tunnel with the admin token = %d, want success", rec.Code)
+	}
+	if rec := adminRequest(ui, http.MethodGet, "/api/admin/tunnels", "wrong-token", ""); rec.Code !=
+		http.StatusUnauthorized {
+		t.Errorf("unknown token = %d, want 401", rec.Code)
+	}
+}
@@ -0,0 +1,109 @@
+package webui
+
+import (
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/snakeice/gunnel/pkg/logging"
+	"github.com/snakeice/gunnel/pkg/version"
+)
+
+const downloadsPrefix = "/downloads/"
+
+// Download is a client archive offered by the WebUI. OS and Arch are parsed
+// from the goreleaser archive name, e.g. gunnel_Linux_x86_64.tar.gz.
+type Download struct {
+	Name string `json:"name"`
+	OS   string `json:"os"`
+	Arch string `json:"arch"`
+	Size int64  `json:"size"`
+	URL  string `json:"url"`
+}
+
+// goreleaser renames these GOARCH values in archive names.
+var archiveArchs = map[string]string{"x86_64": "amd64", "i386": "386"}
+
+// SetDownloadsDir serves the client archives in dir, usually the dist
+// directory of a release, under /downloads/.
+func (ui *WebUI) SetDownloadsDir(dir string) {
+	ui.downloadsDir = dir
+}
+
+func (ui *WebUI) downloads() []Download {
+	if ui.downloadsDir == "" {
+		return nil
+	}
+	entries, err := os.ReadDir(ui.downloadsDir)
+	if err != nil {
+		logging.WebUI.WithError(err).Warn("Failed to list downloads")
+		return nil
+	}
+
+	list := make([]Download, 0, len(entries))
+	for _, entry := range entries {
+		name := entry.Name()
+		goos, arch, ok := parseArchiveName(name)
+		if !ok || !entry.Type().IsRegular() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		list = append(list, Download{Name: name, OS: goos, Arch: arch, Size: info.Size(), URL: downloadsPrefix + name})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// parseArchiveName returns the GOOS and GOARCH of a gunnel_<os>_<arch>
+// archive.
+func parseArchiveName(name string) (string, string, bool) {
+	base, ok := strings.CutPrefix(name, "gunnel_")
+	if !ok {
+		return "", "", false
+	}
+	switch {
+	case strings.HasSuffix(base, ".tar.gz"):
+		base = strings.TrimSuffix(base, ".tar.gz")
+	case strings.HasSuffix(base, ".zip"):
+		base = strings.TrimSuffix(base, ".zip")
+	default:
+		return "", "", false
+	}
+	goos, arch, ok := strings.Cut(base, "_")
+	if !ok || goos == "" || arch == "" {
+		return "", "", false
+	}
+	if a, ok := archiveArchs[arch]; ok {
+		arch = a
+	}
+	return strings.ToLower(goos), arch, true
+}
+
+func (ui *WebUI) handleListDownloads(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, map[string]any{
+		"version":   version.Version,
+		"downloads": ui.downloads(),
+	})
+}
+
+func (ui *WebUI) handleDownload(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("file")
+	if ui.downloadsDir == "" || name != path.Base(name) {
+		http.NotFound(w, r)
+		return
+	}
+	if _, _, ok := parseArchiveName(name); !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	logging.WebUI.WithFields(logrus.Fields{"file": name, "remote": r.RemoteAddr}).Debug("Serving client download")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+	http.ServeFileFS(w, r, os.DirFS(ui.downloadsDir), name)
+}
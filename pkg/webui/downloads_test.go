@@ -0,0 +1,97 @@
+package webui_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/snakeice/gunnel/pkg/manager"
+	"github.com/snakeice/gunnel/pkg/webui"
+)
+
+func TestParseArchiveName(t *testing.T) {
+	tests := []struct {
+		name     string
+		os, arch string
+		ok       bool
+	}{
+		{name: "gunnel_Linux_x86_64.tar.gz", os: "linux", arch: "amd64", ok: true},
+		{name: "gunnel_Darwin_arm64.tar.gz", os: "darwin", arch: "arm64", ok: true},
+		{name: "gunnel_Windows_i386.zip", os: "windows", arch: "386", ok: true},
+		{name: "gunnel_Freebsd_riscv64.tar.gz", os: "freebsd", arch: "riscv64", ok: true},
+		{name: "checksums.txt"},
+		{name: "gunnel_Linux_x86_64.deb"},
+		{name: "gunnel_Linux.tar.gz"},
+		{name: "gunnel__x86_64.tar.gz"},
+		{name: "other_Linux_x86_64.tar.gz"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			goos, arch, ok := webui.ParseArchiveName(tt.name)
+			if ok != tt.ok || goos != tt.os || arch != tt.arch {
+				t.Errorf("ParseArchiveName = %q, %q, %v; want %q, %q, %v", goos, arch, ok, tt.os, tt.arch, tt.ok)
+			}
+		})
+	}
+}
+
+func TestHandleDownload(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "dist")
+	files := map[string]string{
+		filepath.Join(dir, "gunnel_Linux_x86_64.tar.gz"):  "archive",
+		filepath.Join(dir, "checksums.txt"):               "sums",
+		filepath.Join(root, "gunnel_Darwin_arm64.tar.gz"): "outside",
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	for path, content := range files {
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ui := webui.NewWebUI(manager.New())
+	ui.SetDownloadsDir(dir)
+
+	tests := []struct {
+		name   string
+		path   string
+		status int
+		body   string
+	}{
+		{name: "archive", path: "/downloads/gunnel_Linux_x86_64.tar.gz", status: http.StatusOK, body: "archive"},
+		{name: "not an archive", path: "/downloads/checksums.txt", status: http.StatusNotFound},
+		{name: "missing archive", path: "/downloads/gunnel_Windows_x86_64.zip", status: http.StatusNotFound},
+		{name: "traversal", path: "/downloads/..%2Fgunnel_Darwin_arm64.tar.gz", status: http.StatusNotFound},
+		{name: "encoded dot segment", path: "/downloads/%2E%2E", status: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			ui.HandleRequest(rec, httptest.NewRequest(http.MethodGet, tt.path, nil))
+
+			resp := rec.Result()
+			defer resp.Body.Close()
+			if resp.StatusCode != tt.status {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.status)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			body, _ := io.ReadAll(resp.Body)
+			if string(body) != tt.body {
+				t.Errorf("body = %q, want %q", body, tt.body)
+			}
+			if got := resp.Header.Get("Content-Disposition"); got != `attachment; filename="gunnel_Linux_x86_64.tar.gz"` {
+				t.Errorf("Content-Disposition = %q", got)
+			}
+		})
+	}
+}
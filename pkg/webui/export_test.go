@@ -0,0 +1,4 @@
+package webui
+
+// ParseArchiveName returns the GOOS and GOARCH of a client archive name.
+var ParseArchiveName = parseArchiveName
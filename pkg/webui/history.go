@@ -0,0 +1,44 @@
+package webui
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/snakeice/gunnel/pkg/timeseries"
+)
+
+// historyPoints is the number of points served by default, e.g. one every
+// ten minutes over a day.
+const historyPoints = 144
+
+type historyResponse struct {
+	Step   string             `json:"step"`
+	Points []timeseries.Point `json:"points"`
+}
+
+// handleHistory serves the traffic of ?subdomain= (every tunnel when empty)
+// over ?window= in ?step= intervals, for the WebUI charts.
+func (ui *WebUI) handleHistory(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	window, err := parseWindow(query.Get("window"))
+	if err != nil {
+		http.Error(w, "Invalid window", http.StatusBadRequest)
+		return
+	}
+
+	step := (window / historyPoints).Truncate(time.Minute)
+	if value := query.Get("step"); value != "" {
+		step, err = time.ParseDuration(value)
+		if err != nil || step <= 0 {
+			http.Error(w, "Invalid step", http.StatusBadRequest)
+			return
+		}
+	}
+	step = max(step, time.Minute)
+
+	resp := historyResponse{Step: step.String(), Points: []timeseries.Point{}}
+	if store := ui.mngr.History(); store != nil {
+		resp.Points = store.Query(query.Get("subdomain"), time.Now().Add(-window), step)
+	}
+	writeJSON(w, resp)
+}
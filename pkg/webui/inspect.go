@@ -0,0 +1,150 @@
+package webui
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/snakeice/gunnel/pkg/logging"
+	"github.com/snakeice/gunnel/pkg/manager"
+)
+
+const requestsPrefix = "/api/requests"
+
+// inspectorOnly authenticates the bearer token of an admin, who sees the
+// requests of every tunnel, or of a team member, who only sees those of the
+// team's tunnels. h gets the subdomains visible, nil for all. manage requires
+// a full access admin token or the team admin role.
+func (ui *WebUI) inspectorOnly(
+	manage bool,
+	h func(w http.ResponseWriter, r *http.Request, visible []string),
+) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !ui.mngr.InspectorEnabled() {
+			http.NotFound(w, r)
+			return
+		}
+
+		token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if _, scope, ok := ui.adminCredential(token); ok && token != "" {
+			if manage && scope != ScopeFull {
+				http.Error(w, "Forbidden: token is read-only", http.StatusForbidden)
+				return
+			}
+			h(w, r, nil)
+			return
+		}
+		member, ok := ui.mngr.TeamMember(token)
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if manage && !member.CanManage() {
+			http.Error(w, "Forbidden: admin role required", http.StatusForbidden)
+			return
+		}
+		visible := make([]string, 0)
+		for _, t := range ui.mngr.TeamTunnels(member.Team) {
+			visible = append(visible, t.Subdomain)
+		}
+		h(w, r, visible)
+	}
+}
+
+func (ui *WebUI) handleListRequests(w http.ResponseWriter, r *http.Request, visible []string) {
+	if subdomain := r.URL.Query().Get("subdomain"); subdomain != "" {
+		if visible != nil && !slices.Contains(visible, subdomain) {
+			visible = []string{}
+		} else {
+			visible = []string{subdomain}
+		}
+	}
+	writeJSON(w, ui.mngr.CapturedRequests(visible))
+}
+
+func (ui *WebUI) handleGetRequest(w http.ResponseWriter, r *http.Request, visible []string) {
+	captured, ok := ui.mngr.CapturedRequest(r.PathValue("id"))
+	if !ok || (visible != nil && !slices.Contains(visible, captured.Subdomain)) {
+		http.NotFound(w, r)
+		return
+	}
+	writeJSON(w, captured)
+}
+
+func (ui *WebUI) handleReplayRequest(w http.ResponseWriter, r *http.Request, visible []string) {
+	id := r.PathValue("id")
+	if captured, ok := ui.mngr.CapturedRequest(id); !ok ||
+		(visible != nil && !slices.Contains(visible, captured.Subdomain)) {
+		http.NotFound(w, r)
+		return
+	}
+
+	replayed, err := ui.mngr.ReplayRequest(r.Context(), id)
+	switch {
+	case errors.Is(err, manager.ErrCaptureNotFound):
+		http.NotFound(w, r)
+		return
+	case errors.Is(err, manager.ErrReplayTruncated):
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	case errors.Is(err, manager.ErrNoConnection):
+		http.Error(w, "tunnel not connected", http.StatusServiceUnavailable)
+		return
+	case err != nil:
+		logging.WebUI.WithError(err).WithField("request", id).Warn("Failed to replay captured request")
+		http.Error(w, "Failed to replay request", http.StatusBadGateway)
+		return
+	}
+	writeJSON(w, replayed)
+}
+
+func (ui *WebUI) handleInspectPage(w http.ResponseWriter, _ *http.Request) {
+	content, err := templates.ReadFile("templates/inspect.html")
+	if err != nil {
+		http.Error(w, "Failed to read template", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	if _, err := w.Write(content); err != nil {
+		http.Error(w, "Failed to write response", http.StatusInternalServerError)
+	}
+}
+
+// handleReplayTraffic replays the requests captured for one tunnel against
+// another and answers with the report once done.
+func (ui *WebUI) handleReplayTraffic(w http.ResponseWriter, r *http.Request) {
+	var req manager.TrafficReplay
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAdminBody)).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+
+	report, err := ui.mngr.ReplayTraffic(r.Context(), req)
+	switch {
+	case errors.Is(err, manager.ErrInspectorDisabled):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case errors.Is(err, manager.ErrNoConnection):
+		http.Error(w, "tunnel not connected: "+req.To, http.StatusServiceUnavailable)
+		return
+	case errors.Is(err, context.Canceled):
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	logging.WebUI.WithFields(logrus.Fields{
+		"from":    report.From,
+		"to":      report.To,
+		"sent":    report.Sent,
+		"changed": report.Changed,
+		"failed":  report.Failed,
+	}).Info("Traffic replayed through the admin API")
+	writeJSON(w, report)
+}
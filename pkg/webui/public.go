@@ -0,0 +1,82 @@
+package webui
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/snakeice/gunnel/pkg/manager"
+)
+
+// publicTunnel is what the public status page shows of a tunnel: no client
+// addresses, connection details or traffic contents.
+type publicTunnel struct {
+	Subdomain string              `json:"subdomain"`
+	State     manager.TunnelState `json:"state"`
+	Since     time.Time           `json:"since"`
+	Uptime24h float64             `json:"uptime_24h"`
+	Uptime30d float64             `json:"uptime_30d"`
+}
+
+type publicPoint struct {
+	Time     time.Time `json:"time"`
+	Requests uint64    `json:"requests"`
+	Errors   uint64    `json:"errors"`
+}
+
+// PublicHandler returns the read-only status page served at status.<domain>.
+// It only lists the tunnels whose clients set public_status.
+func (ui *WebUI) PublicHandler() http.HandlerFunc {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", ui.handlePublicIndex)
+	mux.HandleFunc("GET /api/tunnels", ui.handlePublicTunnels)
+	mux.HandleFunc("GET /api/tunnels/{subdomain}/history", ui.handlePublicHistory)
+	return mux.ServeHTTP
+}
+
+func (ui *WebUI) handlePublicIndex(w http.ResponseWriter, _ *http.Request) {
+	content, err := templates.ReadFile("templates/public.html")
+	if err != nil {
+		http.Error(w, "Failed to read template", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	if _, err := w.Write(content); err != nil {
+		http.Error(w, "Failed to write response", http.StatusInternalServerError)
+	}
+}
+
+func (ui *WebUI) handlePublicTunnels(w http.ResponseWriter, _ *http.Request) {
+	statuses := ui.mngr.PublicTunnelStatuses()
+	tunnels := make([]publicTunnel, 0, len(statuses))
+	for _, st := range statuses {
+		t := publicTunnel{Subdomain: st.Subdomain, State: st.State, Since: st.Since}
+		if uptime, ok := ui.mngr.TunnelUptime(st.Subdomain, 24*time.Hour); ok {
+			t.Uptime24h = uptime.Ratio
+		}
+		if uptime, ok := ui.mngr.TunnelUptime(st.Subdomain, 30*24*time.Hour); ok {
+			t.Uptime30d = uptime.Ratio
+		}
+		tunnels = append(tunnels, t)
+	}
+	writeJSON(w, tunnels)
+}
+
+// handlePublicHistory serves the request and error counts of a public tunnel
+// over the last 24 hours.
+func (ui *WebUI) handlePublicHistory(w http.ResponseWriter, r *http.Request) {
+	subdomain := r.PathValue("subdomain")
+	if !ui.mngr.IsPublic(subdomain) {
+		http.NotFound(w, r)
+		return
+	}
+
+	points := make([]publicPoint, 0, historyPoints)
+	if store := ui.mngr.History(); store != nil {
+		window := defaultUptimeWindow
+		for _, p := range store.Query(subdomain, time.Now().Add(-window), window/historyPoints) {
+			points = append(points, publicPoint{Time: p.Time, Requests: p.Requests, Errors: p.Errors})
+		}
+	}
+	writeJSON(w, points)
+}
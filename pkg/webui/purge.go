@@ -0,0 +1,53 @@
+package webui
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/snakeice/gunnel/pkg/logging"
+	"github.com/snakeice/gunnel/pkg/manager"
+)
+
+// purgeRequest selects whose data to delete: one subdomain, a usage tenant
+// as shown in usage reports, or the tenant of a client token.
+type purgeRequest struct {
+	Subdomain string `json:"subdomain"`
+	Tenant    string `json:"tenant"`
+	Token     string `json:"token"`
+}
+
+func (ui *WebUI) handlePurge(w http.ResponseWriter, r *http.Request) {
+	var req purgeRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAdminBody)).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+
+	selectors := 0
+	for _, value := range []string{req.Subdomain, req.Tenant, req.Token} {
+		if value != "" {
+			selectors++
+		}
+	}
+	if selectors != 1 {
+		http.Error(w, "exactly one of subdomain, tenant or token is required", http.StatusBadRequest)
+		return
+	}
+
+	var report manager.PurgeReport
+	var err error
+	switch {
+	case req.Subdomain != "":
+		report, err = ui.mngr.PurgeSubdomain(req.Subdomain)
+	case req.Token != "":
+		report, err = ui.mngr.PurgeTenant(ui.mngr.TenantForToken(req.Token))
+	default:
+		report, err = ui.mngr.PurgeTenant(req.Tenant)
+	}
+	if err != nil {
+		logging.WebUI.WithError(err).Error("Failed to save purged stores")
+		http.Error(w, "Purged in memory but failed to save", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, report)
+}
@@ -0,0 +1,39 @@
+package webui
+
+import (
+	"net/http"
+
+	"github.com/sirupsen/logrus"
+	"github.com/snakeice/gunnel/pkg/logging"
+)
+
+func (ui *WebUI) handleListSessions(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, ui.mngr.Sessions(r.URL.Query().Get("subdomain")))
+}
+
+func (ui *WebUI) handleCloseSession(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if err := ui.mngr.CloseSession(id); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	logging.WebUI.WithField("session", id).Info("Session closed through the admin API")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleCloseSessions closes every session of the subdomain in the query.
+func (ui *WebUI) handleCloseSessions(w http.ResponseWriter, r *http.Request) {
+	subdomain := r.URL.Query().Get("subdomain")
+	if subdomain == "" {
+		http.Error(w, "subdomain is required", http.StatusBadRequest)
+		return
+	}
+	closed := ui.mngr.CloseSessions(subdomain)
+
+	logging.WebUI.WithFields(logrus.Fields{
+		"subdomain": subdomain,
+		"sessions":  closed,
+	}).Info("Sessions closed through the admin API")
+	writeJSON(w, map[string]any{"subdomain": subdomain, "closed": closed})
+}
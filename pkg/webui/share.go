@@ -0,0 +1,115 @@
+package webui
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/snakeice/gunnel/pkg/logging"
+	"github.com/snakeice/gunnel/pkg/manager"
+)
+
+type createShareRequest struct {
+	Subdomain string `json:"subdomain"`
+	// TTL is a duration such as "2h"; empty for 24 hours.
+	TTL string `json:"ttl"`
+}
+
+func (ui *WebUI) handleListShares(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, ui.mngr.ShareLinks())
+}
+
+func (ui *WebUI) handleCreateShare(w http.ResponseWriter, r *http.Request) {
+	ui.createShare(w, r, "", logrus.Fields{"by": "admin"})
+}
+
+func (ui *WebUI) handleDeleteShare(w http.ResponseWriter, r *http.Request) {
+	ui.deleteShare(w, r, "", logrus.Fields{"by": "admin"})
+}
+
+func (ui *WebUI) handleTeamListShares(w http.ResponseWriter, r *http.Request, _ manager.TeamMember) {
+	subdomain := r.PathValue("subdomain")
+	list := make([]manager.ShareLink, 0)
+	for _, link := range ui.mngr.ShareLinks() {
+		if link.Subdomain == subdomain {
+			list = append(list, link)
+		}
+	}
+	writeJSON(w, list)
+}
+
+func (ui *WebUI) handleTeamCreateShare(w http.ResponseWriter, r *http.Request, member manager.TeamMember) {
+	ui.createShare(w, r, r.PathValue("subdomain"), logrus.Fields{"team": member.Team, "member": member.Name})
+}
+
+func (ui *WebUI) handleTeamDeleteShare(w http.ResponseWriter, r *http.Request, member manager.TeamMember) {
+	ui.deleteShare(w, r, r.PathValue("subdomain"), logrus.Fields{"team": member.Team, "member": member.Name})
+}
+
+// createShare mints a share link for the subdomain of the body, or for
+// subdomain when set. The body may be empty.
+func (ui *WebUI) createShare(w http.ResponseWriter, r *http.Request, subdomain string, who logrus.Fields) {
+	var req createShareRequest
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAdminBody)).Decode(&req)
+	if err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	if subdomain == "" {
+		subdomain = req.Subdomain
+	}
+	if subdomain == "" {
+		http.Error(w, "subdomain is required", http.StatusBadRequest)
+		return
+	}
+
+	var ttl time.Duration
+	if req.TTL != "" {
+		if ttl, err = time.ParseDuration(req.TTL); err != nil {
+			http.Error(w, "invalid ttl", http.StatusBadRequest)
+			return
+		}
+	}
+
+	link, err := ui.mngr.CreateShareLink(subdomain, ttl)
+	switch {
+	case errors.Is(err, manager.ErrSubdomainNotFound):
+		http.Error(w, "tunnel not connected", http.StatusNotFound)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	logging.WebUI.WithFields(who).WithFields(logrus.Fields{
+		"subdomain": link.Subdomain,
+		"share":     link.Name,
+		"expires":   link.ExpiresAt,
+	}).Info("Share link created")
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(link); err != nil {
+		logging.WebUI.WithError(err).Debug("Failed to write share link")
+	}
+}
+
+// deleteShare revokes the share link of the path, which must stand for
+// subdomain when set.
+func (ui *WebUI) deleteShare(w http.ResponseWriter, r *http.Request, subdomain string, who logrus.Fields) {
+	name := r.PathValue("name")
+	if link, ok := ui.mngr.ShareLink(name); !ok || (subdomain != "" && link.Subdomain != subdomain) {
+		http.Error(w, manager.ErrShareNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	if err := ui.mngr.DeleteShareLink(name); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	logging.WebUI.WithFields(who).WithField("share", name).Info("Share link revoked")
+	w.WriteHeader(http.StatusNoContent)
+}
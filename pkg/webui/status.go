@@ -0,0 +1,85 @@
+package webui
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/snakeice/gunnel/pkg/manager"
+)
+
+const defaultUptimeWindow = 24 * time.Hour
+
+// handleTunnelStatus serves the health of one tunnel for monitors: 200 while
+// a client serves it, 503 when it is offline and 404 for unknown tunnels.
+func (ui *WebUI) handleTunnelStatus(w http.ResponseWriter, r *http.Request) {
+	status, ok := ui.mngr.TunnelStatus(r.PathValue("subdomain"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if status.State == manager.StateOffline {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		http.Error(w, "Failed to encode JSON", http.StatusInternalServerError)
+	}
+}
+
+func (ui *WebUI) handleTunnelStatuses(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, ui.mngr.TunnelStatuses())
+}
+
+// handleTunnelUptime serves the uptime and state timeline of a tunnel over
+// ?window= (a duration such as 12h, or days such as 7d; 24h by default).
+func (ui *WebUI) handleTunnelUptime(w http.ResponseWriter, r *http.Request) {
+	window, err := parseWindow(r.URL.Query().Get("window"))
+	if err != nil {
+		http.Error(w, "Invalid window", http.StatusBadRequest)
+		return
+	}
+
+	uptime, ok := ui.mngr.TunnelUptime(r.PathValue("subdomain"), window)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	writeJSON(w, uptime)
+}
+
+func (ui *WebUI) handleTunnelPage(w http.ResponseWriter, _ *http.Request) {
+	content, err := templates.ReadFile("templates/tunnel.html")
+	if err != nil {
+		http.Error(w, "Failed to read template", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	if _, err := w.Write(content); err != nil {
+		http.Error(w, "Failed to write response", http.StatusInternalServerError)
+	}
+}
+
+func parseWindow(value string) (time.Duration, error) {
+	if value == "" {
+		return defaultUptimeWindow, nil
+	}
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n <= 0 {
+			return 0, errors.New("invalid number of days")
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		return 0, errors.New("invalid duration")
+	}
+	return d, nil
+}
@@ -0,0 +1,22 @@
+package webui
+
+import (
+	"net/http"
+
+	"github.com/snakeice/gunnel/pkg/logging"
+)
+
+func (ui *WebUI) handleListTCPBans(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, ui.mngr.TCPBans())
+}
+
+func (ui *WebUI) handleDeleteTCPBan(w http.ResponseWriter, r *http.Request) {
+	ip := r.PathValue("ip")
+	if err := ui.mngr.UnbanTCP(ip); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	logging.WebUI.WithField("remote", ip).Info("TCP ban lifted through the admin API")
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,132 @@
+package webui
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/snakeice/gunnel/pkg/logging"
+	"github.com/snakeice/gunnel/pkg/manager"
+	"github.com/snakeice/gunnel/pkg/metrics"
+)
+
+const teamPrefix = "/api/team/"
+
+// maxInspectStreams bounds the streams returned when inspecting a tunnel.
+const maxInspectStreams = 50
+
+type teamHandler func(w http.ResponseWriter, r *http.Request, member manager.TeamMember)
+
+// teamOnly authenticates the bearer token of a team member. Handlers of a
+// single tunnel only see tunnels of the member's team, and manage requires
+// the admin role.
+func (ui *WebUI) teamOnly(manage bool, h teamHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		member, ok := ui.mngr.TeamMember(token)
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		if subdomain := r.PathValue("subdomain"); subdomain != "" && !ui.mngr.OwnedBy(subdomain, member.Team) {
+			http.NotFound(w, r)
+			return
+		}
+
+		if manage && !member.CanManage() {
+			http.Error(w, "Forbidden: admin role required", http.StatusForbidden)
+			return
+		}
+
+		h(w, r, member)
+	}
+}
+
+type teamStream struct {
+	ID           string    `json:"id"`
+	ConnectionID string    `json:"connection_id"`
+	StartTime    time.Time `json:"start_time"`
+	LastActive   time.Time `json:"last_active"`
+	Active       bool      `json:"active"`
+	BytesIn      int64     `json:"bytes_in"`
+	BytesOut     int64     `json:"bytes_out"`
+}
+
+func (ui *WebUI) handleTeamTunnels(w http.ResponseWriter, _ *http.Request, member manager.TeamMember) {
+	writeJSON(w, map[string]any{
+		"team":    member.Team,
+		"member":  member.Name,
+		"role":    member.Role,
+		"tunnels": ui.mngr.TeamTunnels(member.Team),
+	})
+}
+
+func (ui *WebUI) handleTeamInspect(w http.ResponseWriter, r *http.Request, member manager.TeamMember) {
+	subdomain := r.PathValue("subdomain")
+
+	var tunnel *manager.TeamTunnel
+	for _, t := range ui.mngr.TeamTunnels(member.Team) {
+		if t.Subdomain == subdomain {
+			tunnel = &t
+			break
+		}
+	}
+	if tunnel == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	streams := make([]teamStream, 0)
+	for _, list := range [][]*metrics.StreamInfo{metrics.GetActiveStreams(), metrics.GetInactiveStreams()} {
+		for _, s := range list {
+			if s.Subdomain != subdomain || len(streams) == maxInspectStreams {
+				continue
+			}
+			streams = append(streams, teamStream{
+				ID:           s.ID,
+				ConnectionID: s.ConnectionID,
+				StartTime:    s.StartTime,
+				LastActive:   s.LastActive(),
+				Active:       s.IsActive,
+				BytesIn:      s.BytesReceived.Load(),
+				BytesOut:     s.BytesSent.Load(),
+			})
+		}
+	}
+
+	resp := map[string]any{
+		"tunnel":   tunnel,
+		"streams":  streams,
+		"sessions": ui.mngr.Sessions(subdomain),
+	}
+	if malformed, ok := ui.mngr.LastMalformedResponse(subdomain); ok {
+		resp["malformed_response"] = malformed
+	}
+	writeJSON(w, resp)
+}
+
+func (ui *WebUI) handleTeamPause(paused bool) teamHandler {
+	return func(w http.ResponseWriter, r *http.Request, member manager.TeamMember) {
+		subdomain := r.PathValue("subdomain")
+		ui.mngr.SetPaused(subdomain, paused)
+
+		logging.WebUI.WithFields(logrus.Fields{
+			"subdomain": subdomain,
+			"team":      member.Team,
+			"member":    member.Name,
+			"paused":    paused,
+		}).Info("Tunnel state changed by team member")
+
+		writeJSON(w, map[string]any{"subdomain": subdomain, "paused": paused})
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		http.Error(w, "Failed to encode JSON", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,126 @@
+package webui
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/snakeice/gunnel/pkg/logging"
+	"github.com/snakeice/gunnel/pkg/manager"
+)
+
+type putClientTokenRequest struct {
+	Subdomains  []string `json:"subdomains"`
+	MaxTunnels  int      `json:"max_tunnels"`
+	TokenSHA256 string   `json:"token_sha256"`
+}
+
+type clientTokenInfo struct {
+	ID          string    `json:"id"`
+	Name        string    `json:"name"`
+	Subdomains  []string  `json:"subdomains"`
+	MaxTunnels  int       `json:"max_tunnels"`
+	TokenSHA256 string    `json:"token_sha256"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+	// Token is only set in the answer creating a generated token.
+	Token string `json:"token,omitempty"`
+}
+
+func newClientTokenInfo(t manager.ClientToken) clientTokenInfo {
+	subdomains := t.Subdomains
+	if subdomains == nil {
+		subdomains = []string{}
+	}
+	return clientTokenInfo{
+		ID:          t.ID,
+		Name:        t.Name,
+		Subdomains:  subdomains,
+		MaxTunnels:  t.MaxTunnels,
+		TokenSHA256: t.TokenHash,
+		CreatedAt:   t.CreatedAt,
+		UpdatedAt:   t.UpdatedAt,
+	}
+}
+
+// handlePutClientToken creates or replaces the client token of the path.
+// Applying the same body again is a no-op answered with 200; a creation is
+// answered with 201 and, unless token_sha256 was given, the new token.
+func (ui *WebUI) handlePutClientToken(w http.ResponseWriter, r *http.Request) {
+	var req putClientTokenRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAdminBody)).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+
+	token, secret, created, err := ui.mngr.PutClientToken(r.PathValue("name"), manager.ClientTokenSpec{
+		Subdomains: req.Subdomains,
+		MaxTunnels: req.MaxTunnels,
+		TokenHash:  req.TokenSHA256,
+	})
+	switch {
+	case errors.Is(err, manager.ErrInvalidClientToken):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case err != nil:
+		logging.WebUI.WithError(err).Error("Failed to apply client token")
+		http.Error(w, "Failed to apply client token", http.StatusInternalServerError)
+		return
+	}
+
+	info := newClientTokenInfo(token)
+	info.Token = secret
+
+	w.Header().Set("Content-Type", "application/json")
+	if created {
+		logging.WebUI.WithField("token", token.Name).Info("Client token created")
+		w.WriteHeader(http.StatusCreated)
+	}
+	if err := json.NewEncoder(w).Encode(info); err != nil {
+		logging.WebUI.WithError(err).Error("Failed to encode client token")
+	}
+}
+
+func (ui *WebUI) handleGetClientToken(w http.ResponseWriter, r *http.Request) {
+	token, ok := ui.mngr.LookupClientToken(r.PathValue("name"))
+	if !ok {
+		http.Error(w, manager.ErrClientTokenNotFound.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(newClientTokenInfo(token)); err != nil {
+		http.Error(w, "Failed to encode JSON", http.StatusInternalServerError)
+	}
+}
+
+func (ui *WebUI) handleListClientTokens(w http.ResponseWriter, _ *http.Request) {
+	tokens := ui.mngr.ClientTokens()
+	list := make([]clientTokenInfo, 0, len(tokens))
+	for _, t := range tokens {
+		list = append(list, newClientTokenInfo(t))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(list); err != nil {
+		http.Error(w, "Failed to encode JSON", http.StatusInternalServerError)
+	}
+}
+
+func (ui *WebUI) handleDeleteClientToken(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	err := ui.mngr.DeleteClientToken(name)
+	switch {
+	case errors.Is(err, manager.ErrClientTokenNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case err != nil:
+		logging.WebUI.WithError(err).Error("Failed to delete client token")
+		http.Error(w, "Failed to delete client token", http.StatusInternalServerError)
+		return
+	}
+
+	logging.WebUI.WithField("token", name).Info("Client token deleted")
+	w.WriteHeader(http.StatusNoContent)
+}
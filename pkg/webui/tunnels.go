@@ -0,0 +1,175 @@
+package webui
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/snakeice/gunnel/pkg/logging"
+	"github.com/snakeice/gunnel/pkg/manager"
+)
+
+type createTunnelRequest struct {
+	Name      string `json:"name"`
+	Subdomain string `json:"subdomain"`
+}
+
+// tunnelCredentials is returned once, when a named tunnel is created.
+type tunnelCredentials struct {
+	TunnelID  string `json:"tunnel_id"`
+	Name      string `json:"name"`
+	Subdomain string `json:"subdomain"`
+	Token     string `json:"token"`
+}
+
+type tunnelInfo struct {
+	TunnelID  string              `json:"tunnel_id"`
+	Name      string              `json:"name"`
+	Subdomain string              `json:"subdomain"`
+	CreatedAt time.Time           `json:"created_at"`
+	Connected bool                `json:"connected"`
+	State     manager.TunnelState `json:"state"`
+}
+
+func (ui *WebUI) handleCreateTunnel(w http.ResponseWriter, r *http.Request) {
+	var req createTunnelRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAdminBody)).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+
+	tunnel, token, err := ui.mngr.CreateNamedTunnel(req.Name, req.Subdomain)
+	switch {
+	case errors.Is(err, manager.ErrInvalidName):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case errors.Is(err, manager.ErrTunnelExists):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		logging.WebUI.WithError(err).Error("Failed to create named tunnel")
+		http.Error(w, "Failed to create tunnel", http.StatusInternalServerError)
+		return
+	}
+
+	logging.WebUI.WithFields(logrus.Fields{
+		"tunnel":    tunnel.Name,
+		"subdomain": tunnel.Subdomain,
+	}).Info("Named tunnel created")
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(tunnelCredentials{
+		TunnelID:  tunnel.ID,
+		Name:      tunnel.Name,
+		Subdomain: tunnel.Subdomain,
+		Token:     token,
+	}); err != nil {
+		logging.WebUI.WithError(err).Error("Failed to encode tunnel credentials")
+	}
+}
+
+// handlePutTunnel creates or updates the named tunnel of the path, so
+// declarative tools can apply it repeatedly. Only a creation returns
+// credentials.
+func (ui *WebUI) handlePutTunnel(w http.ResponseWriter, r *http.Request) {
+	var req createTunnelRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAdminBody)).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+
+	tunnel, token, created, err := ui.mngr.PutNamedTunnel(r.PathValue("name"), req.Subdomain)
+	switch {
+	case errors.Is(err, manager.ErrInvalidName):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case errors.Is(err, manager.ErrTunnelExists):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		logging.WebUI.WithError(err).Error("Failed to apply named tunnel")
+		http.Error(w, "Failed to apply tunnel", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !created {
+		if err := json.NewEncoder(w).Encode(ui.tunnelInfo(tunnel)); err != nil {
+			logging.WebUI.WithError(err).Error("Failed to encode tunnel")
+		}
+		return
+	}
+
+	logging.WebUI.WithFields(logrus.Fields{
+		"tunnel":    tunnel.Name,
+		"subdomain": tunnel.Subdomain,
+	}).Info("Named tunnel created")
+
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(tunnelCredentials{
+		TunnelID:  tunnel.ID,
+		Name:      tunnel.Name,
+		Subdomain: tunnel.Subdomain,
+		Token:     token,
+	}); err != nil {
+		logging.WebUI.WithError(err).Error("Failed to encode tunnel credentials")
+	}
+}
+
+func (ui *WebUI) handleGetTunnel(w http.ResponseWriter, r *http.Request) {
+	tunnel, ok := ui.mngr.LookupNamedTunnel(r.PathValue("name"))
+	if !ok {
+		http.Error(w, manager.ErrTunnelNotFound.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(ui.tunnelInfo(tunnel)); err != nil {
+		http.Error(w, "Failed to encode JSON", http.StatusInternalServerError)
+	}
+}
+
+func (ui *WebUI) handleListTunnels(w http.ResponseWriter, _ *http.Request) {
+	tunnels := ui.mngr.NamedTunnels()
+	list := make([]tunnelInfo, 0, len(tunnels))
+	for _, t := range tunnels {
+		list = append(list, ui.tunnelInfo(t))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(list); err != nil {
+		http.Error(w, "Failed to encode JSON", http.StatusInternalServerError)
+	}
+}
+
+func (ui *WebUI) tunnelInfo(t manager.NamedTunnel) tunnelInfo {
+	status, _ := ui.mngr.TunnelStatus(t.Subdomain)
+	return tunnelInfo{
+		TunnelID:  t.ID,
+		Name:      t.Name,
+		Subdomain: t.Subdomain,
+		CreatedAt: t.CreatedAt,
+		Connected: ui.mngr.HasKnownSubdomain(t.Subdomain),
+		State:     status.State,
+	}
+}
+
+func (ui *WebUI) handleDeleteTunnel(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	err := ui.mngr.DeleteNamedTunnel(name)
+	switch {
+	case errors.Is(err, manager.ErrTunnelNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case err != nil:
+		logging.WebUI.WithError(err).Error("Failed to delete named tunnel")
+		http.Error(w, "Failed to delete tunnel", http.StatusInternalServerError)
+		return
+	}
+
+	logging.WebUI.WithField("tunnel", name).Info("Named tunnel deleted")
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,71 @@
+package webui
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/snakeice/gunnel/pkg/logging"
+	"github.com/snakeice/gunnel/pkg/usage"
+)
+
+const defaultTopPaths = 10
+
+// handleUsage reports usage per tenant. Query parameters: period (daily or
+// monthly), from and to (YYYY-MM-DD, inclusive), tenant, top (number of
+// paths) and format (json or csv).
+func (ui *WebUI) handleUsage(w http.ResponseWriter, r *http.Request) {
+	recorder := ui.mngr.Usage()
+	if recorder == nil {
+		http.Error(w, "Usage reports not enabled", http.StatusServiceUnavailable)
+		return
+	}
+
+	params := r.URL.Query()
+	query := usage.Query{
+		Period: usage.Period(params.Get("period")),
+		Tenant: params.Get("tenant"),
+		Top:    defaultTopPaths,
+	}
+
+	for name, dst := range map[string]*time.Time{"from": &query.From, "to": &query.To} {
+		value := params.Get(name)
+		if value == "" {
+			continue
+		}
+		day, err := time.Parse(time.DateOnly, value)
+		if err != nil {
+			http.Error(w, name+" must be a date (YYYY-MM-DD)", http.StatusBadRequest)
+			return
+		}
+		*dst = day
+	}
+
+	if top := params.Get("top"); top != "" {
+		n, err := strconv.Atoi(top)
+		if err != nil || n < 0 {
+			http.Error(w, "top must be a non-negative number", http.StatusBadRequest)
+			return
+		}
+		query.Top = n
+	}
+
+	summaries, err := recorder.Report(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	switch params.Get("format") {
+	case "", "json":
+		writeJSON(w, summaries)
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", `attachment; filename="gunnel-usage.csv"`)
+		if err := usage.WriteCSV(w, summaries); err != nil {
+			logging.WebUI.WithError(err).Error("Failed to write usage CSV")
+		}
+	default:
+		http.Error(w, `format must be "json" or "csv"`, http.StatusBadRequest)
+	}
+}
@@ -4,13 +4,17 @@ import (
 	"embed"
 	"encoding/json"
 	"net/http"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/snakeice/gunnel/pkg/connection"
 	"github.com/snakeice/gunnel/pkg/manager"
 	"github.com/snakeice/gunnel/pkg/metrics"
+	"github.com/snakeice/gunnel/pkg/version"
 )
 
 //go:embed templates
@@ -24,6 +28,14 @@ type WebUI struct {
 	stats     map[string]any
 	clients   []map[string]any
 	streams   []map[string]any
+
+	adminToken  string
+	adminTokens []AdminToken
+	// hideMetrics stops serving /metrics, e.g. when the server has a
+	// dedicated metrics listener.
+	hideMetrics atomic.Bool
+	// downloadsDir holds the client archives offered for download.
+	downloadsDir string
 }
 
 func NewWebUI(router *manager.Manager) *WebUI {
@@ -41,7 +53,53 @@ func NewWebUI(router *manager.Manager) *WebUI {
 	mux.HandleFunc("/api/clients", webui.handleClients)
 	mux.HandleFunc("/api/streams", webui.handleStreams)
 	mux.HandleFunc("/api/honeypot", webui.handleHoneypot)
+	mux.HandleFunc("GET /metrics", webui.handleMetrics)
 	mux.HandleFunc("/api/prometheus", webui.handlePrometheusMetrics)
+	mux.HandleFunc("/api/version", webui.handleVersion)
+	mux.HandleFunc("GET /api/downloads", webui.handleListDownloads)
+	mux.HandleFunc("GET "+downloadsPrefix+"{file}", webui.handleDownload)
+	mux.HandleFunc("GET /api/history", webui.handleHistory)
+	mux.HandleFunc("GET /api/status/{subdomain}", webui.handleTunnelStatus)
+	mux.HandleFunc("GET /api/status/{subdomain}/uptime", webui.handleTunnelUptime)
+	mux.HandleFunc("GET /tunnels/{subdomain}", webui.handleTunnelPage)
+	mux.HandleFunc("GET /inspect", webui.handleInspectPage)
+	mux.HandleFunc("GET "+requestsPrefix, webui.inspectorOnly(false, webui.handleListRequests))
+	mux.HandleFunc("GET "+requestsPrefix+"/{id}", webui.inspectorOnly(false, webui.handleGetRequest))
+	mux.HandleFunc("POST "+requestsPrefix+"/{id}/replay", webui.inspectorOnly(true, webui.handleReplayRequest))
+	mux.HandleFunc(adminPrefix+"broadcast", webui.adminOnly(http.MethodPost, webui.handleBroadcast))
+	mux.HandleFunc("GET "+adminPrefix+"client-config", webui.adminOnly(http.MethodGet, webui.handleGetClientConfig))
+	mux.HandleFunc("PUT "+adminPrefix+"client-config", webui.adminOnly(http.MethodPut, webui.handlePutClientConfig))
+	mux.HandleFunc("GET "+adminPrefix+"tunnels", webui.adminOnly(http.MethodGet, webui.handleListTunnels))
+	mux.HandleFunc("POST "+adminPrefix+"tunnels", webui.adminOnly(http.MethodPost, webui.handleCreateTunnel))
+	mux.HandleFunc("GET "+adminPrefix+"tunnels/{name}", webui.adminOnly(http.MethodGet, webui.handleGetTunnel))
+	mux.HandleFunc("PUT "+adminPrefix+"tunnels/{name}", webui.adminOnly(http.MethodPut, webui.handlePutTunnel))
+	mux.HandleFunc("DELETE "+adminPrefix+"tunnels/{name}",
+		webui.adminOnly(http.MethodDelete, webui.handleDeleteTunnel))
+	mux.HandleFunc("GET "+adminPrefix+"tokens", webui.adminOnly(http.MethodGet, webui.handleListClientTokens))
+	mux.HandleFunc("GET "+adminPrefix+"tokens/{name}", webui.adminOnly(http.MethodGet, webui.handleGetClientToken))
+	mux.HandleFunc("PUT "+adminPrefix+"tokens/{name}", webui.adminOnly(http.MethodPut, webui.handlePutClientToken))
+	mux.HandleFunc("DELETE "+adminPrefix+"tokens/{name}",
+		webui.adminOnly(http.MethodDelete, webui.handleDeleteClientToken))
+	mux.HandleFunc(adminPrefix+"status", webui.adminOnly(http.MethodGet, webui.handleTunnelStatuses))
+	mux.HandleFunc(adminPrefix+"usage", webui.adminOnly(http.MethodGet, webui.handleUsage))
+	mux.HandleFunc(adminPrefix+"purge", webui.adminOnly(http.MethodPost, webui.handlePurge))
+	mux.HandleFunc("GET "+adminPrefix+"tcp/bans", webui.adminOnly(http.MethodGet, webui.handleListTCPBans))
+	mux.HandleFunc("DELETE "+adminPrefix+"tcp/bans/{ip}", webui.adminOnly(http.MethodDelete, webui.handleDeleteTCPBan))
+	mux.HandleFunc("POST "+adminPrefix+"replay", webui.adminOnly(http.MethodPost, webui.handleReplayTraffic))
+	mux.HandleFunc("GET "+adminPrefix+"sessions", webui.adminOnly(http.MethodGet, webui.handleListSessions))
+	mux.HandleFunc("DELETE "+adminPrefix+"sessions", webui.adminOnly(http.MethodDelete, webui.handleCloseSessions))
+	mux.HandleFunc("DELETE "+adminPrefix+"sessions/{id}", webui.adminOnly(http.MethodDelete, webui.handleCloseSession))
+	mux.HandleFunc("GET "+adminPrefix+"shares", webui.adminOnly(http.MethodGet, webui.handleListShares))
+	mux.HandleFunc("POST "+adminPrefix+"shares", webui.adminOnly(http.MethodPost, webui.handleCreateShare))
+	mux.HandleFunc("DELETE "+adminPrefix+"shares/{name}", webui.adminOnly(http.MethodDelete, webui.handleDeleteShare))
+	mux.HandleFunc("GET "+teamPrefix+"tunnels", webui.teamOnly(false, webui.handleTeamTunnels))
+	mux.HandleFunc("GET "+teamPrefix+"tunnels/{subdomain}", webui.teamOnly(false, webui.handleTeamInspect))
+	mux.HandleFunc("POST "+teamPrefix+"tunnels/{subdomain}/pause", webui.teamOnly(true, webui.handleTeamPause(true)))
+	mux.HandleFunc("POST "+teamPrefix+"tunnels/{subdomain}/resume", webui.teamOnly(true, webui.handleTeamPause(false)))
+	mux.HandleFunc("GET "+teamPrefix+"tunnels/{subdomain}/shares", webui.teamOnly(false, webui.handleTeamListShares))
+	mux.HandleFunc("POST "+teamPrefix+"tunnels/{subdomain}/shares", webui.teamOnly(true, webui.handleTeamCreateShare))
+	mux.HandleFunc("DELETE "+teamPrefix+"tunnels/{subdomain}/shares/{name}",
+		webui.teamOnly(true, webui.handleTeamDeleteShare))
 
 	webui.Mux = mux
 
@@ -49,6 +107,12 @@ func NewWebUI(router *manager.Manager) *WebUI {
 }
 
 func (ui *WebUI) HandleRequest(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, adminPrefix) || strings.HasPrefix(r.URL.Path, teamPrefix) ||
+		strings.HasPrefix(r.URL.Path, requestsPrefix) || strings.HasPrefix(r.URL.Path, downloadsPrefix) {
+		ui.Mux.ServeHTTP(w, r)
+		return
+	}
+
 	ui.mu.RLock()
 	defer ui.mu.RUnlock()
 
@@ -133,6 +197,24 @@ func (ui *WebUI) handleHoneypot(w http.ResponseWriter, _ *http.Request) {
 	}
 }
 
+func (ui *WebUI) handleVersion(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, version.Get())
+}
+
+// SetServeMetrics controls whether /metrics is served in the Prometheus
+// exposition format (the default).
+func (ui *WebUI) SetServeMetrics(serve bool) {
+	ui.hideMetrics.Store(!serve)
+}
+
+func (ui *WebUI) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if ui.hideMetrics.Load() {
+		http.NotFound(w, r)
+		return
+	}
+	promhttp.Handler().ServeHTTP(w, r)
+}
+
 func (ui *WebUI) handlePrometheusMetrics(w http.ResponseWriter, _ *http.Request) {
 	ui.mu.RLock()
 	defer ui.mu.RUnlock()
@@ -265,16 +347,26 @@ func (ui *WebUI) UpdateStats() {
 		})
 	}
 
+	sessions := ui.mngr.SessionCounts()
+	states := make(map[string]manager.TunnelState)
+	for _, st := range ui.mngr.TunnelStatuses() {
+		states[st.Subdomain] = st.State
+	}
+
 	ui.mngr.ForEachClient(func(subdomain string, info *connection.Connection) {
 		if !info.Connected() {
 			return
 		}
 		ui.clients = append(ui.clients, map[string]any{
-			"subdomain":   subdomain,
-			"connections": info.GetConnCount(subdomain),
-			"last_active": info.GetLastActive(),
-			"connected":   info.Connected(),
-			"heartbeat":   info.GetHeartbeatStats(),
+			"subdomain":     subdomain,
+			"state":         states[subdomain],
+			"connection_id": info.ID(),
+			"connections":   info.GetConnCount(subdomain),
+			"sessions":      sessions[subdomain],
+			"last_active":   info.GetLastActive(),
+			"connected":     info.Connected(),
+			"heartbeat":     info.GetHeartbeatStats(),
+			"handshake":     info.Handshake(),
 		})
 	})
 }